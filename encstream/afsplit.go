@@ -0,0 +1,113 @@
+package encstream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Files encrypted to recipients with -anti-forensic store each wrapped file
+// key split across afStripes stripes with the anti-forensic splitter of
+// LUKS: every stripe but the last is random, and the last is the wrapped key
+// XORed with the diffusion of all the others. All of the stripes, several KiB
+// per recipient, are needed to recover the wrapped key, so overwriting any
+// part of them destroys it. That matters when a file is rewrapped in place:
+// SSDs and copy-on-write filesystems may keep stale copies of a few sectors
+// of the old header, but are unlikely to keep all of them.
+//
+// The split is stored instead of the wrapped key, in a recordSplitRecipient
+// header record, and covered by the MAC like any other stanza.
+
+// afStripes is how many stripes a wrapped file key is split into.
+const afStripes = 128
+
+var (
+	errBadSplit            = errors.New("malformed anti-forensic split")
+	errAntiForensicOptions = errors.New("-anti-forensic splits the keys wrapped for recipients, so it needs -r or -R")
+)
+
+// afSplit splits data into stripes stripes of its length, all but the last
+// of which are read from random.
+func afSplit(data []byte, stripes int, random io.Reader) ([]byte, error) {
+	if stripes < 2 {
+		return nil, errBadSplit
+	}
+	split := make([]byte, len(data)*stripes)
+	last := len(data) * (stripes - 1)
+	err := readRandom(random, split[:last])
+	if err != nil {
+		return nil, err
+	}
+	d := afDiffuseStripes(split[:last], len(data))
+	for i := range data {
+		split[last+i] = d[i] ^ data[i]
+	}
+	return split, nil
+}
+
+// afMerge recovers the data of size bytes split into split by afSplit.
+func afMerge(split []byte, size int) ([]byte, error) {
+	if size == 0 || len(split)%size != 0 || len(split)/size < 2 {
+		return nil, errBadSplit
+	}
+	last := len(split) - size
+	d := afDiffuseStripes(split[:last], size)
+	for i := range d {
+		d[i] ^= split[last+i]
+	}
+	return d, nil
+}
+
+// afDiffuseStripes XORs each of the stripes of size bytes into an
+// accumulator, diffusing it after each one.
+func afDiffuseStripes(stripes []byte, size int) []byte {
+	d := make([]byte, size)
+	for i := 0; i < len(stripes); i += size {
+		for j := range d {
+			d[j] ^= stripes[i+j]
+		}
+		d = afDiffuse(d)
+	}
+	return d
+}
+
+// afDiffuse hashes every SHA-256 sized block of d, prefixed with its index,
+// so that each bit of the result depends on every bit of its block.
+func afDiffuse(d []byte) []byte {
+	out := make([]byte, 0, len(d))
+	for i := 0; i < len(d); i += sha256.Size {
+		end := i + sha256.Size
+		if end > len(d) {
+			end = len(d)
+		}
+		var index [4]byte
+		binary.BigEndian.PutUint32(index[:], uint32(i/sha256.Size))
+		h := sha256.New()
+		h.Write(index[:])
+		h.Write(d[i:end])
+		out = append(out, h.Sum(nil)[:end-i]...)
+	}
+	return out
+}
+
+// splitStanza returns s with its wrapped key split into afStripes stripes,
+// made with random.
+func splitStanza(s recipientStanza, random io.Reader) (recipientStanza, error) {
+	split, err := afSplit(s.WrappedKey[:], afStripes, random)
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	s.Split = split
+	return s, nil
+}
+
+// isSplit reports whether any of the wrapped file keys in header are split.
+func isSplit(header fileHeader) bool {
+	for _, s := range header.Recipients {
+		if s.Split != nil {
+			return true
+		}
+	}
+	return false
+}
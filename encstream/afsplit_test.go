@@ -0,0 +1,114 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// TestAFSplit verifies that split data merges back, and that changing any
+// stripe changes the result.
+func TestAFSplit(t *testing.T) {
+	data := []byte("0123456789abcdef0123456789abcdef0123456789abcdef")
+	split, err := afSplit(data, afStripes, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(split) != len(data)*afStripes {
+		t.Fatal("wrong split size", len(split))
+	}
+	merged, err := afMerge(split, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, data) {
+		t.Fatal("split data merged to something else")
+	}
+	for _, i := range []int{0, len(data) * afStripes / 2, len(split) - 1} {
+		modified := append([]byte{}, split...)
+		modified[i] ^= 1
+		merged, err := afMerge(modified, len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(merged, data) {
+			t.Fatal("a modified split merged to the original data at", i)
+		}
+	}
+	if _, err := afMerge(split[:len(data)], len(data)); err != errBadSplit {
+		t.Fatal("expected errBadSplit for a single stripe, got", err)
+	}
+	if _, err := afMerge(split[1:], len(data)); err != errBadSplit {
+		t.Fatal("expected errBadSplit for a truncated split, got", err)
+	}
+}
+
+// TestSplitRecipients verifies that files encrypted with split stanzas
+// decrypt, and that rewrapping them keeps the stanzas split.
+func TestSplitRecipients(t *testing.T) {
+	alice, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("attack at dawn")
+	decrypts := func(id identity, ciphertext []byte) bool {
+		_, r, err := openCiphertext(identityKeys{id}, bytes.NewReader(ciphertext))
+		if err != nil {
+			return false
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext", err)
+		}
+		return true
+	}
+
+	output := new(memoryOutput)
+	opts := encryptOptions{recipients: []recipient{alice.public}, antiForensic: true}
+	_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), output, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(output.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Recipients) != 1 || len(header.Recipients[0].Split) != afStripes*len(header.Recipients[0].WrappedKey) {
+		t.Fatal("the wrapped file key was not split")
+	}
+	if !decrypts(alice, output.buf) {
+		t.Fatal("a file with a split stanza did not decrypt")
+	}
+
+	rewrapped := new(memoryOutput)
+	_, err = rewrapFile(identityKeys{alice}, bytes.NewReader(output.buf), rewrapped, rewrapOptions{add: []recipient{bob.public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err = readHeader(bytes.NewReader(rewrapped.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Recipients) != 2 || !isSplit(header) || header.Recipients[1].Split == nil {
+		t.Fatal("rewrapping did not keep the stanzas split")
+	}
+	if !decrypts(alice, rewrapped.buf) || !decrypts(bob, rewrapped.buf) {
+		t.Fatal("a rewrapped file with split stanzas did not decrypt")
+	}
+
+	// enough split recipients do not fit in a header.
+	many := make([]recipient, maxHeaderSize/(afStripes*len(header.Recipients[0].WrappedKey))+1)
+	for i := range many {
+		many[i] = alice.public
+	}
+	opts = encryptOptions{recipients: many, antiForensic: true}
+	_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), new(memoryOutput), 0, opts)
+	if err != errHeaderTooLarge {
+		t.Fatal("expected errHeaderTooLarge, got", err)
+	}
+}
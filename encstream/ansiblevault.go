@@ -0,0 +1,155 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// enc can also decrypt files written by ansible-vault, in the 1.1 and 1.2
+// formats every version since Ansible 1.5 writes, so that vaulted vars files
+// can be moved to enc. A vault file is a header line, such as
+// "$ANSIBLE_VAULT;1.2;AES256;prod", where 1.2 adds the vault ID, followed by
+// lines of hex. The hex decodes to three lines that are hex themselves: the
+// salt, the HMAC-SHA256 of the ciphertext, and the ciphertext, which is the
+// plaintext padded as for CBC and encrypted with AES-256-CTR. The AES key, the
+// HMAC key and the IV are derived from the passphrase and the salt with
+// PBKDF2-HMAC-SHA256. The HMAC is checked before any plaintext is written.
+//
+// Only whole vault files are supported, not the values encrypted with
+// ansible-vault encrypt_string inside YAML files.
+
+const (
+	ansibleVaultMagic = "$ANSIBLE_VAULT;"
+	ansibleVaultIter  = 10000
+)
+
+var (
+	errAnsibleVaultFormat     = errors.New("malformed ansible-vault file")
+	errAnsibleVaultVersion    = errors.New("only ansible-vault 1.1 and 1.2 files with AES256 are supported")
+	errAnsibleVaultPassphrase = errors.New("wrong passphrase, or the ansible-vault file was modified")
+)
+
+// ansibleVault is a parsed ansible-vault file.
+type ansibleVault struct {
+	salt       []byte
+	mac        []byte
+	ciphertext []byte
+}
+
+// isAnsibleVault reports whether r, which is left at its start, holds an
+// ansible-vault file.
+func isAnsibleVault(r io.ReadSeeker) (bool, error) {
+	prefix := make([]byte, len(ansibleVaultMagic))
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return string(prefix[:n]) == ansibleVaultMagic, err
+}
+
+// parseAnsibleVault parses the ansible-vault file b.
+func parseAnsibleVault(b []byte) (ansibleVault, error) {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	header := strings.Split(strings.TrimSpace(lines[0]), ";")
+	if len(header) < 3 || header[0]+";" != ansibleVaultMagic {
+		return ansibleVault{}, errAnsibleVaultFormat
+	}
+	switch {
+	case header[1] == "1.1" && len(header) == 3:
+	case header[1] == "1.2" && len(header) == 4:
+		// the vault ID only picks the passphrase.
+	default:
+		return ansibleVault{}, errAnsibleVaultVersion
+	}
+	if strings.TrimSpace(header[2]) != "AES256" {
+		return ansibleVault{}, errAnsibleVaultVersion
+	}
+	var body strings.Builder
+	for _, line := range lines[1:] {
+		body.WriteString(strings.TrimSpace(line))
+	}
+	decoded, err := hex.DecodeString(body.String())
+	if err != nil {
+		return ansibleVault{}, errAnsibleVaultFormat
+	}
+	var v ansibleVault
+	fields := bytes.Split(decoded, []byte("\n"))
+	if len(fields) != 3 {
+		return ansibleVault{}, errAnsibleVaultFormat
+	}
+	for i, field := range []*[]byte{&v.salt, &v.mac, &v.ciphertext} {
+		*field, err = hex.DecodeString(string(fields[i]))
+		if err != nil {
+			return ansibleVault{}, errAnsibleVaultFormat
+		}
+	}
+	if len(v.ciphertext) == 0 || len(v.ciphertext)%aes.BlockSize != 0 {
+		return ansibleVault{}, errAnsibleVaultFormat
+	}
+	return v, nil
+}
+
+// decrypt checks the HMAC of v with passphrase and returns its plaintext.
+func (v ansibleVault) decrypt(passphrase []byte) ([]byte, error) {
+	derived := pbkdf2.Key(passphrase, v.salt, ansibleVaultIter, 2*32+aes.BlockSize, sha256.New)
+	key, macKey, iv := derived[:32], derived[32:64], derived[64:]
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(v.ciphertext)
+	if !hmac.Equal(mac.Sum(nil), v.mac) {
+		return nil, errAnsibleVaultPassphrase
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(v.ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, v.ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errAnsibleVaultFormat
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, errAnsibleVaultFormat
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// decryptAnsibleVault decrypts the ansible-vault file read from input, which
+// is encrypted with passphrase, to finalOutput.
+func decryptAnsibleVault(passphrase []byte, input io.Reader, finalOutput string) error {
+	b, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	v, err := parseAnsibleVault(b)
+	if err != nil {
+		return err
+	}
+	plaintext, err := v.decrypt(passphrase)
+	if err != nil {
+		return err
+	}
+	output, err := createPlaintext(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	_, err = output.Write(plaintext)
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
@@ -0,0 +1,65 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ansibleVaultFile was written in the ansible-vault 1.1 format with the
+// passphrase hunter2 and a fixed salt.
+const ansibleVaultFile = `$ANSIBLE_VAULT;1.1;AES256
+30303031303230333034303530363037303830393061306230633064306530663130313131323133
+3134313531363137313831393161316231633164316531660a613239343537353037393137323737
+66613438303861333434653534666565323231633832626266323265643538633061353336643166
+6437353864326361620a306338363438666465303866316132623639313939316635373839653833
+37613533336639366364343335653231383938383436643762393137616433343133383136633338
+6162646165366533663863663636623661376163373039313065
+`
+
+// TestAnsibleVault verifies that ansible-vault files decrypt with the right
+// passphrase, and that modified ones do not.
+func TestAnsibleVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-ansible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "vars.yml")
+	expected := "db_password: s3cret\napi_token: abc123\n"
+
+	labelled := strings.Replace(ansibleVaultFile, "1.1;AES256", "1.2;AES256;prod", 1)
+	for _, file := range []string{ansibleVaultFile, labelled} {
+		input := strings.NewReader(file)
+		if ok, err := isAnsibleVault(input); err != nil || !ok {
+			t.Fatal("the vault was not detected", err)
+		}
+		os.Remove(output)
+		if err := decryptAnsibleVault([]byte("hunter2"), input, output); err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ioutil.ReadFile(output)
+		if err != nil || string(plaintext) != expected {
+			t.Fatalf("expected %q, got %q %v", expected, plaintext, err)
+		}
+	}
+
+	os.Remove(output)
+	if err := decryptAnsibleVault([]byte("hunter3"), strings.NewReader(ansibleVaultFile), output); err != errAnsibleVaultPassphrase {
+		t.Fatal("expected errAnsibleVaultPassphrase, got", err)
+	}
+	// the last byte of the ciphertext, whose hex is in the last two lines.
+	modified := strings.Replace(ansibleVaultFile, "3065\n", "3066\n", 1)
+	if err := decryptAnsibleVault([]byte("hunter2"), strings.NewReader(modified), output); err != errAnsibleVaultPassphrase {
+		t.Fatal("expected errAnsibleVaultPassphrase, got", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatal("plaintext was written")
+	}
+	if ok, _ := isAnsibleVault(bytes.NewReader([]byte("enc"))); ok {
+		t.Fatal("a short file was detected as a vault")
+	}
+}
@@ -0,0 +1,322 @@
+// Package encstream implements enc's file format and chunked streams, and the
+// enc command line tool on top of them, which Main runs. Programs that embed
+// enc use Encrypt and Decrypt for whole files, NewWriter and NewReader for
+// streams, and NewClientChannel and NewServerChannel for live connections.
+package encstream
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Encrypt and Decrypt are the file-level API for programs that embed enc, such
+// as GUIs and servers. They take options instead of flags, and report progress
+// through callbacks rather than on stderr.
+
+// KDFPhase is a step of key derivation, reported by WithKDFProgress.
+type KDFPhase int
+
+const (
+	// KDFStarted is reported before the keys are derived from the
+	// passphrase, which takes seconds with the default parameters.
+	KDFStarted KDFPhase = iota
+	// KDFFinished is reported once they have been, successfully or not.
+	KDFFinished
+)
+
+// fileConfig holds the settings of Encrypt and Decrypt.
+type fileConfig struct {
+	progress     func(bytesDone, bytesTotal int64)
+	kdfProgress  func(phase KDFPhase)
+	limits       decoderLimits
+	maxKDFMemory uint32 // KiB, or 0 for the default limit
+	vault        *VaultTransit
+	rand         io.Reader
+	now          func() time.Time
+}
+
+// newFileConfig applies opts to the default settings.
+func newFileConfig(opts []FileOption) fileConfig {
+	c := fileConfig{limits: defaultDecoderLimits(), now: time.Now}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// FileOption configures Encrypt or Decrypt.
+type FileOption func(*fileConfig)
+
+// WithProgress calls f as the input is read, with the number of bytes read so
+// far and the total, or -1 if the size of the input is unknown. Decrypt reads
+// the file twice, once to authenticate it and once to decrypt it, so its total
+// is twice the size of the file.
+func WithProgress(f func(bytesDone, bytesTotal int64)) FileOption {
+	return func(c *fileConfig) {
+		c.progress = f
+	}
+}
+
+// WithKDFProgress calls f when key derivation starts and finishes. It is not
+// called for files encrypted to recipients, which need no key derivation.
+func WithKDFProgress(f func(phase KDFPhase)) FileOption {
+	return func(c *fileConfig) {
+		c.kdfProgress = f
+	}
+}
+
+// Decrypt reads the header of a file before it can be authenticated, and
+// derives the keys with the memory the header asks for, so a service that
+// decrypts files from untrusted sources should bound both, and the plaintext
+// it is willing to write. The limits are checked before anything is allocated
+// for the header or the key derivation. Chunks are at most 16KB, and a larger
+// one is refused before it is read.
+
+// WithMaxHeaderSize makes Decrypt refuse a file whose header is larger than n
+// bytes. Headers are never larger than 256KB, the default; they grow with the
+// number of recipients and the size of the label.
+func WithMaxHeaderSize(n int) FileOption {
+	return func(c *fileConfig) {
+		if n > 0 && n < maxHeaderSize {
+			c.limits.maxHeaderSize = n
+		}
+	}
+}
+
+// WithMaxPlaintextSize makes Decrypt fail rather than write more than n bytes
+// of plaintext. The partial output is removed, but archive entries extracted
+// before the limit was reached are kept.
+func WithMaxPlaintextSize(n int64) FileOption {
+	return func(c *fileConfig) {
+		if n >= 0 {
+			c.limits.maxPlaintextSize = n
+		}
+	}
+}
+
+// WithMaxKDFMemory makes Decrypt refuse a file whose key derivation asks for
+// more than n bytes of memory. It can only lower the default limit, which is
+// twice the memory enc uses by default, within the memory limit of the Go
+// runtime.
+func WithMaxKDFMemory(n int64) FileOption {
+	return func(c *fileConfig) {
+		if n >= 1<<10 && n>>10 <= math.MaxUint32 {
+			c.maxKDFMemory = uint32(n >> 10)
+		}
+	}
+}
+
+// WithVaultTransit makes Encrypt encrypt with a data key of v instead of the
+// passphrase, which is ignored, and Decrypt decrypt files encrypted so. Data
+// keys are cached by v, so sharing it between files saves round trips to
+// Vault.
+func WithVaultTransit(v *VaultTransit) FileOption {
+	return func(c *fileConfig) {
+		c.vault = v
+	}
+}
+
+// WithRand makes Encrypt read the salt, keys and nonces of the file from r
+// instead of crypto/rand, so that tests can encrypt deterministically. If r
+// fails, or repeats a nonce, Encrypt returns an error. It has no effect on
+// Decrypt.
+func WithRand(r io.Reader) FileOption {
+	return func(c *fileConfig) {
+		c.rand = r
+	}
+}
+
+// WithClock makes Decrypt warn that a file has expired by the time now
+// returns instead of by the system clock. It has no effect on Encrypt.
+func WithClock(now func() time.Time) FileOption {
+	return func(c *fileConfig) {
+		c.now = now
+	}
+}
+
+// SetMaxMemory bounds the memory enc uses to n bytes, at least 64 MiB, as
+// -max-memory does: the KDF memory of new files and how many chunks are
+// processed at once are fitted into it. It sets the memory limit of the Go
+// runtime, which GOMEMLIMIT sets otherwise, so it applies to the whole
+// program.
+func SetMaxMemory(n int64) error {
+	return setMemoryBudget(n)
+}
+
+// Encrypt encrypts the plaintext read from input to the file output with
+// passphrase. If output is "-", the file is written to stdout.
+func Encrypt(passphrase []byte, input io.Reader, output string, opts ...FileOption) error {
+	return EncryptContext(context.Background(), passphrase, input, output, opts...)
+}
+
+// EncryptContext is like Encrypt, but stops when ctx is done, removing the
+// partial output unless it is stdout. The context is checked during key
+// derivation and between reads of the input.
+func EncryptContext(ctx context.Context, passphrase []byte, input io.Reader, output string, opts ...FileOption) error {
+	if err := checkSelfTest(); err != nil {
+		return err
+	}
+	c := newFileConfig(opts)
+	// nothing Encrypt writes depends on the time, so c.now is not used.
+	return encrypt(passphrase, input, output, 0, encryptOptions{ctx: ctx, progress: c.progress, kdfProgress: c.kdfProgress, vault: c.vault, rand: c.rand})
+}
+
+// Decrypt decrypts the file input with passphrase to output, or to stdout if
+// output is "-". If input is an archive, it is extracted into the directory
+// output.
+func Decrypt(passphrase []byte, input string, output string, opts ...FileOption) error {
+	return DecryptContext(context.Background(), passphrase, input, output, opts...)
+}
+
+// DecryptContext is like Decrypt, but stops when ctx is done, removing the
+// partial output. The context is checked during key derivation and between
+// reads of the input. Archive entries extracted before ctx was done are kept.
+func DecryptContext(ctx context.Context, passphrase []byte, input string, output string, opts ...FileOption) error {
+	if err := checkSelfTest(); err != nil {
+		return err
+	}
+	c := newFileConfig(opts)
+	f, err := openEncrypted(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	passphraseKeys := newPassphraseKeys(passphrase)
+	if c.maxKDFMemory > 0 && c.maxKDFMemory < passphraseKeys.limits.maxArgonMemory {
+		passphraseKeys.limits.maxArgonMemory = c.maxKDFMemory
+	}
+	var keys keySource = passphraseKeys
+	if c.vault != nil {
+		keys = c.vault
+	}
+	if c.kdfProgress != nil {
+		keys = kdfHooks{keys, c.kdfProgress}
+	}
+	keys = contextKeys{keys, ctx}
+	var r io.Reader = f
+	var size int64
+	if c.progress != nil {
+		size, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		r = &progressReader{r: f, total: 2 * size, f: c.progress}
+	}
+	header, plaintext, err := openCiphertextLimit(keys, struct {
+		io.Reader
+		io.Seeker
+	}{contextReader{ctx, r}, f}, c.limits, c.now())
+	if err != nil {
+		return err
+	}
+	err = writePlaintext(header, plaintext.secretKey, plaintext, output, extractOptions{})
+	if err != nil {
+		return err
+	}
+	if c.progress != nil {
+		// the header is only read once, so finish the count.
+		c.progress(2*size, 2*size)
+	}
+	return nil
+}
+
+// contextKeys stops waiting for a keySource when ctx is done. The key
+// derivation itself cannot be interrupted, so it finishes in the background.
+type contextKeys struct {
+	keySource
+	ctx context.Context
+}
+
+func (c contextKeys) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if err := c.ctx.Err(); err != nil {
+		return sk, macKey, err
+	}
+	type keys struct {
+		sk, macKey [32]byte
+		err        error
+	}
+	done := make(chan keys, 1)
+	go func() {
+		var k keys
+		k.sk, k.macKey, k.err = c.keySource.fileKeys(header)
+		done <- k
+	}()
+	select {
+	case k := <-done:
+		return k.sk, k.macKey, k.err
+	case <-c.ctx.Done():
+		return sk, macKey, c.ctx.Err()
+	}
+}
+
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// kdfHooks reports the key derivation of a keySource to a callback.
+type kdfHooks struct {
+	keySource
+	f func(phase KDFPhase)
+}
+
+func (k kdfHooks) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if len(header.Recipients) > 0 || header.Vault.Path != "" {
+		return k.keySource.fileKeys(header)
+	}
+	k.f(KDFStarted)
+	defer k.f(KDFFinished)
+	return k.keySource.fileKeys(header)
+}
+
+// progressReader reports the bytes read through it to a callback. The count
+// never exceeds a known total.
+type progressReader struct {
+	r           io.Reader
+	done, total int64
+	f           func(bytesDone, bytesTotal int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		if p.total >= 0 && p.done > p.total {
+			p.done = p.total
+		}
+		p.f(p.done, p.total)
+	}
+	return n, err
+}
+
+// readerSize returns the number of bytes left in r, or -1 if it is not known.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *uncachedReader:
+		return readerSize(r.f)
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - pos
+	}
+	return -1
+}
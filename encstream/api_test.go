@@ -0,0 +1,311 @@
+package encstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestProgress verifies that Encrypt and Decrypt report monotonic progress
+// that ends at the total, and report the KDF phases in order.
+func TestProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := make([]byte, maxChunkSize*4+1)
+	_, err = rand.Read(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var done, total int64
+	var calls int
+	progress := func(bytesDone, bytesTotal int64) {
+		if bytesDone < done || bytesTotal != total {
+			t.Fatal("progress went from", done, "of", total, "to", bytesDone, "of", bytesTotal)
+		}
+		done = bytesDone
+		calls++
+	}
+	var phases []KDFPhase
+	kdfProgress := func(phase KDFPhase) {
+		phases = append(phases, phase)
+	}
+	checkPhases := func() {
+		if len(phases) != 2 || phases[0] != KDFStarted || phases[1] != KDFFinished {
+			t.Fatal("wrong KDF phases", phases)
+		}
+		phases = nil
+	}
+
+	ciphertext := filepath.Join(dir, "ciphertext")
+	total = int64(len(plaintext))
+	err = Encrypt([]byte("hunter2"), bytes.NewReader(plaintext), ciphertext, WithProgress(progress), WithKDFProgress(kdfProgress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done != total || calls < 2 {
+		t.Fatal("encryption ended at", done, "of", total, "after", calls, "calls")
+	}
+	checkPhases()
+
+	info, err := os.Stat(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, total, calls = 0, 2*info.Size(), 0
+	decrypted := filepath.Join(dir, "decrypted")
+	err = Decrypt([]byte("hunter2"), ciphertext, decrypted, WithProgress(progress), WithKDFProgress(kdfProgress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done != total || calls < 2 {
+		t.Fatal("decryption ended at", done, "of", total, "after", calls, "calls")
+	}
+	checkPhases()
+	data, err := ioutil.ReadFile(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+
+	err = Decrypt([]byte("hunter3"), ciphertext, filepath.Join(dir, "wrong"), WithKDFProgress(kdfProgress))
+	if err != errBadMAC {
+		t.Fatal("expected errBadMAC, got", err)
+	}
+	checkPhases()
+}
+
+// TestContext verifies that EncryptContext and DecryptContext stop when their
+// context is cancelled, before or during the work, and leave no output.
+func TestContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := make([]byte, maxChunkSize*16)
+	passphrase := []byte("hunter2")
+	ciphertext := filepath.Join(dir, "ciphertext")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = EncryptContext(ctx, passphrase, bytes.NewReader(plaintext), ciphertext)
+	if err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if _, err := os.Stat(ciphertext); !os.IsNotExist(err) {
+		t.Fatal("a cancelled encryption left its output behind")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancelHalfway := WithProgress(func(bytesDone, bytesTotal int64) {
+		if bytesDone > bytesTotal/2 {
+			cancel()
+		}
+	})
+	err = EncryptContext(ctx, passphrase, bytes.NewReader(plaintext), ciphertext, cancelHalfway)
+	if err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if _, err := os.Stat(ciphertext); !os.IsNotExist(err) {
+		t.Fatal("a cancelled encryption left its output behind")
+	}
+
+	err = Encrypt(passphrase, bytes.NewReader(plaintext), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cancel once decryption proper has started, after authentication.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancelDecrypting := WithProgress(func(bytesDone, bytesTotal int64) {
+		if bytesDone > bytesTotal*3/4 {
+			cancel()
+		}
+	})
+	decrypted := filepath.Join(dir, "decrypted")
+	err = DecryptContext(ctx, passphrase, ciphertext, decrypted, cancelDecrypting)
+	if err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if _, err := os.Stat(decrypted); !os.IsNotExist(err) {
+		t.Fatal("a cancelled decryption left its output behind")
+	}
+}
+
+// TestDecoderLimits verifies that Decrypt refuses a header, a plaintext or a
+// key derivation larger than its limits, leaving no output, and accepts a
+// file exactly within them.
+func TestDecoderLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-decoderlimits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := bytes.Repeat([]byte("limits "), 5000)
+	ciphertext := filepath.Join(dir, "ciphertext")
+	passphrase := []byte("hunter2")
+	err = Encrypt(passphrase, bytes.NewReader(plaintext), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeaderFile(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSize := len(header.encode())
+
+	output := filepath.Join(dir, "plaintext")
+	refused := func(err error, what string) {
+		if err == nil {
+			t.Fatal("a file beyond the", what, "limit was decrypted")
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Fatal("a file beyond the", what, "limit left output:", err)
+		}
+	}
+	refused(Decrypt(passphrase, ciphertext, output, WithMaxHeaderSize(headerSize-1)), "header")
+	refused(Decrypt(passphrase, ciphertext, output, WithMaxPlaintextSize(int64(len(plaintext)-1))), "plaintext")
+	refused(Decrypt(passphrase, ciphertext, output, WithMaxKDFMemory(int64(header.ArgonMemory-1)<<10)), "KDF memory")
+
+	err = Decrypt(passphrase, ciphertext, output, WithMaxHeaderSize(headerSize), WithMaxPlaintextSize(int64(len(plaintext))), WithMaxKDFMemory(int64(header.ArgonMemory)<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+
+	var sk [32]byte
+	stream := new(bytes.Buffer)
+	w := NewWriter(sk, stream)
+	w.Write(plaintext)
+	w.Close()
+	_, err = ioutil.ReadAll(NewReader(sk, bytes.NewReader(stream.Bytes()), WithMaxSize(int64(len(plaintext)-1))))
+	if err != errPlaintextTooLarge {
+		t.Fatal("expected errPlaintextTooLarge, got", err)
+	}
+}
+
+// TestRand verifies that Encrypt reads all of its randomness from WithRand,
+// so that the same source gives the same file, and that a source that fails
+// or repeats itself is an error rather than a panic.
+func TestRand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-rand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := make([]byte, maxChunkSize*3)
+	passphrase := []byte("hunter2")
+	seed := make([]byte, 1<<16)
+	rand.Read(seed)
+
+	var files [2][]byte
+	for i := range files {
+		name := filepath.Join(dir, "file")
+		err := Encrypt(passphrase, bytes.NewReader(plaintext), name, WithRand(bytes.NewReader(seed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i], err = ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(name)
+	}
+	if !bytes.Equal(files[0], files[1]) {
+		t.Fatal("the same source of randomness gave different files")
+	}
+
+	err = Encrypt(passphrase, bytes.NewReader(plaintext), filepath.Join(dir, "short"), WithRand(bytes.NewReader(seed[:100])))
+	if err == nil {
+		t.Fatal("a source of randomness that ran out was not an error")
+	}
+	err = Encrypt(passphrase, bytes.NewReader(plaintext), filepath.Join(dir, "zero"), WithRand(zeroReader{}))
+	if err != errNonceReuse {
+		t.Fatal("expected errNonceReuse, got", err)
+	}
+	for _, name := range []string{"short", "zero"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatal("a failed encryption left its output behind")
+		}
+	}
+}
+
+// zeroReader reads as an endless run of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// TestRandOptions verifies that recipient, anti-forensic, no-metadata,
+// deniable and raw files are also read only from the source of randomness,
+// so that the same source gives the same bytes.
+func TestRandOptions(t *testing.T) {
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, maxChunkSize+100)
+	seed := make([]byte, 1<<16)
+	rand.Read(seed)
+
+	tests := []struct {
+		passphrase []byte
+		opts       encryptOptions
+	}{
+		{nil, encryptOptions{recipients: []recipient{id.public}}},
+		{nil, encryptOptions{recipients: []recipient{id.public}, antiForensic: true}},
+		{nil, encryptOptions{recipients: []recipient{id.public}, noMetadata: true}},
+		{[]byte("hunter2"), encryptOptions{deniable: 4096}},
+	}
+	for i, test := range tests {
+		var files [2][]byte
+		for j := range files {
+			opts := test.opts
+			opts.rand = bytes.NewReader(seed)
+			output := new(memoryOutput)
+			if _, _, _, err := encryptTo(test.passphrase, bytes.NewReader(plaintext), output, 0, opts); err != nil {
+				t.Fatal(i, err)
+			}
+			files[j] = output.buf
+		}
+		if !bytes.Equal(files[0], files[1]) {
+			t.Fatal(i, "the same source of randomness gave different files")
+		}
+	}
+
+	params := rawParams{time: 1, memory: 1 << 10, lanes: 1}
+	var raw [2][]byte
+	for j := range raw {
+		output := new(memoryOutput)
+		if err := encryptRaw([]byte("hunter2"), bytes.NewReader(plaintext), output, params, bytes.NewReader(seed)); err != nil {
+			t.Fatal(err)
+		}
+		raw[j] = output.buf
+	}
+	if !bytes.Equal(raw[0], raw[1]) {
+		t.Fatal("the same source of randomness gave different raw files")
+	}
+	if err := encryptRaw([]byte("hunter2"), bytes.NewReader(plaintext), new(memoryOutput), params, bytes.NewReader(nil)); err == nil || !strings.HasPrefix(err.Error(), errEntropy.Error()) {
+		t.Fatal("expected errEntropy from a source that ran out, got", err)
+	}
+}
@@ -0,0 +1,266 @@
+package encstream
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// enc append adds files to an existing archive without rewriting what it
+// already holds, for logs and exports that accumulate in one ciphertext.
+//
+// An archive's plaintext is a tar stream that ends with the manifest and
+// tar's end-of-archive blocks, so appending replaces that tail: the chunks
+// from the one holding the start of the manifest onwards are cut off, and the
+// rest of that chunk, the new entries, the merged manifest and the end of
+// the archive are encrypted in their place under the same key. The MAC is
+// then computed again, which reads but does not rewrite the earlier
+// ciphertext, and written over the old one in the header. Until then the
+// file fails to authenticate, so an append that fails puts the old tail
+// back; one interrupted by a crash leaves a file that does not authenticate.
+//
+// Only archives whose header can stay the same can be appended to: not
+// signed, padded or deduplicated ones, or ones with a trailer MAC, recovery
+// records or a deniable region, and not armored ones or volumes.
+
+var (
+	errAppendFormat = errors.New("enc append only supports plain binary archives: not signed, padded, deduplicated, armored or streamed ones, or ones with recovery records, a deniable region or a plaintext digest")
+	errAppendInput  = errors.New("the inputs to append need a name: give the directory itself rather than . or /")
+)
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// manifestOffset reads the tar stream r up to the manifest, returning the
+// manifest and the offset in r of the first of its records.
+func manifestOffset(r io.Reader) (manifest, int64, error) {
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	var end int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return manifest{}, 0, errNoManifest
+		}
+		if err != nil {
+			return manifest{}, 0, err
+		}
+		if hdr.Name == manifestName {
+			var m manifest
+			err = json.NewDecoder(tr).Decode(&m)
+			return m, end, err
+		}
+		// the entry's data starts where its header ends, and is padded to
+		// a whole block.
+		end = cr.n + (hdr.Size+511)&^511
+	}
+}
+
+// findChunk scans the chunks read from r, which starts at the file offset
+// start, for the one holding the plaintext offset target. It returns the file
+// offset of the chunk, its index and the plaintext offset it starts at.
+func findChunk(r io.Reader, start int64, target int64) (offset int64, index uint64, plaintextOffset int64, err error) {
+	br := bufio.NewReader(r)
+	offset = start
+	for {
+		var header [24 + 8]byte
+		_, err = io.ReadFull(br, header[:])
+		if err != nil {
+			return 0, 0, 0, errBadHeader
+		}
+		size := binary.LittleEndian.Uint64(header[24:])
+		if size < tagSize || size > maxChunkSize+tagSize {
+			return 0, 0, 0, errBadHeader
+		}
+		n := int64(size) - tagSize
+		if target < plaintextOffset+n {
+			return offset, index, plaintextOffset, nil
+		}
+		_, err = br.Discard(int(size))
+		if err != nil {
+			return 0, 0, 0, errBadHeader
+		}
+		offset += int64(len(header)) + int64(size)
+		plaintextOffset += n
+		index++
+	}
+}
+
+// mergeManifest returns m with the entries of added, which replace the
+// entries of m with the same paths.
+func mergeManifest(m manifest, added manifest) manifest {
+	replaced := added.entries()
+	merged := manifest{Parent: m.Parent}
+	for _, e := range m.Entries {
+		if _, ok := replaced[e.Path]; !ok {
+			merged.Entries = append(merged.Entries, e)
+		}
+	}
+	merged.Entries = append(merged.Entries, added.Entries...)
+	return merged
+}
+
+// appendArchive adds the files and directories inputs to the encrypted
+// archive name, decrypted with keys, under the directory prefix of the
+// archive if it is not empty. Each input is stored under its base name, and
+// replaces the entries of the same names when extracted.
+func appendArchive(keys keySource, name string, inputs []string, prefix string, opts archiveOptions) error {
+	if prefix != "" {
+		var err error
+		prefix, err = cleanEntryName(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	for _, input := range inputs {
+		abs, err := filepath.Abs(input)
+		if err != nil {
+			return err
+		}
+		if base := filepath.Base(abs); base == "." || base == string(filepath.Separator) {
+			return errAppendInput
+		}
+	}
+	if _, ok := volumeBase(name); ok || hasRecovery(name) {
+		return errAppendFormat
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	armored, err := isArmored(f)
+	if err != nil {
+		return err
+	}
+	if armored {
+		return errAppendFormat
+	}
+	header, err := readHeader(f)
+	if err != nil {
+		return err
+	}
+	if header.Flags&flagArchive == 0 {
+		return errNotArchive
+	}
+	if header.Version == 0 || header.Flags != flagArchive || header.Reserved != 0 || header.Signer != ([32]byte{}) {
+		return errAppendFormat
+	}
+	sk, macKey, err := keys.fileKeys(header)
+	if err != nil {
+		return err
+	}
+	plaintext, err := authenticate(f, header, sk, macKey)
+	if err != nil {
+		return err
+	}
+	ciphertextOffset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	m, tail, err := manifestOffset(plaintext)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	offset, index, chunkStart, err := findChunk(io.NewSectionReader(f, ciphertextOffset, size-ciphertextOffset), ciphertextOffset, tail)
+	if err != nil {
+		return err
+	}
+	// the chunks from the cut one on are read to the end, so that the last
+	// of them opens as the last chunk.
+	kept := make([]byte, tail-chunkStart)
+	_, err = io.ReadFull(NewReader(sk, io.NewSectionReader(f, offset, size-offset), header.chunkOptionsAt(index)...), kept)
+	if err != nil {
+		return err
+	}
+	oldTail := make([]byte, size-offset)
+	_, err = f.ReadAt(oldTail, offset)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(offset)
+	if err == nil {
+		err = writeAppended(f, header, sk, macKey, ciphertextOffset, offset, index, kept, m, inputs, prefix, opts)
+	}
+	if err != nil {
+		// put the old tail back, so that the archive authenticates again.
+		if f.Truncate(offset) == nil {
+			f.WriteAt(oldTail, offset)
+		}
+		return err
+	}
+	return f.Sync()
+}
+
+// writeAppended writes the new tail of the archive f at offset, from the
+// chunk with index index on, starting with the plaintext kept from the chunk
+// that was cut off, and then writes the new MAC into the header.
+func writeAppended(f *os.File, header fileHeader, sk [32]byte, macKey [32]byte, ciphertextOffset int64, offset int64, index uint64, kept []byte, m manifest, inputs []string, prefix string, opts archiveOptions) error {
+	hash, err := newFileMAC(header, macKey)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(hash, io.NewSectionReader(f, ciphertextOffset, offset-ciphertextOffset))
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	encWriter := NewWriter(sk, io.MultiWriter(hash, f), header.chunkOptionsAt(index)...)
+	// every write to an EncWriter ends a chunk, so fill them first.
+	bw := bufio.NewWriterSize(encWriter, maxChunkSize)
+	_, err = bw.Write(kept)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(bw)
+	var added manifest
+	for _, input := range inputs {
+		abs, err := filepath.Abs(input)
+		if err != nil {
+			return err
+		}
+		err = writeTree(tw, input, path.Join(prefix, filepath.Base(abs)), &added, nil, opts)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeManifest(tw, mergeManifest(m, added))
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = encWriter.Close()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(hash.Sum(nil), ciphertextOffset-int64(len(header.Tag)))
+	return err
+}
@@ -0,0 +1,104 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestAppendArchive verifies that files appended to an archive are
+// extracted along with the ones it held, replacing those of the same name,
+// and that the ciphertext before the manifest is left as it was.
+func TestAppendArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, contents []byte) {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := bytes.Repeat([]byte("log line\n"), 10000)
+	write("src/a.txt", []byte("alpha"))
+	write("src/logs/1.log", big)
+	archive := filepath.Join(dir, "archive.enc")
+	opts := encryptOptions{recipients: []recipient{id.public}}
+	if _, err := encryptArchive(nil, filepath.Join(dir, "src"), archive, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("new/2.log", []byte("second"))
+	write("new/more/3.log", big)
+	write("a.txt", []byte("replaced"))
+	keys := identityKeys{id}
+	if err := appendArchive(keys, archive, []string{filepath.Join(dir, "new", "2.log"), filepath.Join(dir, "new", "more")}, "logs", archiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendArchive(keys, archive, []string{filepath.Join(dir, "a.txt")}, "", archiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the chunks that only hold the first copy of big are still where they
+	// were.
+	header, err := readHeader(bytes.NewReader(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := len(header.encode())
+	n := len(big) / maxChunkSize * (24 + 8 + maxChunkSize + tagSize)
+	if !bytes.Equal(before[start:start+n], after[start:start+n]) {
+		t.Fatal("the existing ciphertext was rewritten")
+	}
+
+	out := filepath.Join(dir, "out")
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := decryptFile(keys, f, out); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string][]byte{
+		"a.txt":           []byte("replaced"),
+		"logs/1.log":      big,
+		"logs/2.log":      []byte("second"),
+		"logs/more/3.log": big,
+	} {
+		extracted, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(extracted, contents) {
+			t.Fatalf("%v was not extracted intact: %v", name, err)
+		}
+	}
+	if err := verifyExtracted(keys, f, out, ioutil.Discard); err != nil {
+		t.Fatal("the manifest does not match:", err)
+	}
+
+	plain := filepath.Join(dir, "plain.enc")
+	if err := encrypt(nil, bytes.NewReader([]byte("x")), plain, 0, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendArchive(keys, plain, []string{filepath.Join(dir, "a.txt")}, "", archiveOptions{}); err != errNotArchive {
+		t.Fatal("expected errNotArchive, got", err)
+	}
+}
@@ -0,0 +1,509 @@
+package encstream
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Archives are tar streams of a directory tree. They are only ever stored
+// inside the ciphertext, so entry names, sizes and the shape of the tree are
+// as confidential as the file contents.
+
+var errUnsafePath = errors.New("archive entry escapes the destination directory")
+
+// writeArchive writes the tree rooted at root to w as a tar stream. Entry names
+// are relative to root. Only directories, regular files and symlinks are
+// stored, with their owners, ACLs and capabilities; see owner.go. Symlinks are
+// stored or followed and entries filtered as opts says, and files with several
+// hard links are stored once; see links.go. The stream ends with a manifest of
+// every regular file, which is also returned.
+//
+// If since is non-nil, the archive is an incremental snapshot on top of the
+// snapshot described by since: regular files that are unchanged since then
+// are listed in the manifest but their contents are not stored.
+func writeArchive(root string, w io.Writer, since *manifest, opts archiveOptions) (manifest, error) {
+	tw := tar.NewWriter(w)
+	var m manifest
+	var previous map[string]manifestEntry
+	if since != nil {
+		m.Parent = since.id()
+		previous = since.entries()
+	}
+	err := writeTree(tw, root, "", &m, previous, opts)
+	if err != nil {
+		return manifest{}, err
+	}
+	err = writeManifest(tw, m)
+	if err != nil {
+		return manifest{}, err
+	}
+	return m, tw.Close()
+}
+
+// writeTree writes the entries of the tree rooted at root to tw, adding the
+// regular files to m, as writeArchive describes. Entry names are relative to
+// root, under the directory prefix if it is not empty, in which case root
+// itself is stored as prefix; root can then be a file.
+func writeTree(tw *tar.Writer, root string, prefix string, m *manifest, previous map[string]manifestEntry, opts archiveOptions) error {
+	links := newHardlinks(opts.symlinks)
+	filter := newTreeFilter(root, opts.filter)
+	return walkTree(root, opts.symlinks, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." && prefix == "" {
+			return nil
+		}
+		if rel != "." {
+			excluded, err := filter.excluded(filepath.ToSlash(rel), info.IsDir())
+			if err != nil {
+				return err
+			}
+			if excluded {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if name == manifestName {
+			return errReservedName
+		}
+		var link string
+		switch mode := info.Mode(); {
+		case mode.IsDir(), mode.IsRegular():
+		case mode&os.ModeSymlink != 0:
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if link == "" {
+			err = recordXattrs(hdr, p)
+			if err != nil {
+				return err
+			}
+		}
+		if first, ok := links.first(info, len(m.Entries)); ok {
+			e := m.Entries[first]
+			e.Path = hdr.Name
+			m.Entries = append(m.Entries, e)
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = m.Entries[first].Path
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		if e, ok := previous[hdr.Name]; ok && info.Mode().IsRegular() {
+			unchanged, err := e.matches(p, info)
+			if err != nil {
+				return err
+			}
+			if unchanged {
+				e.ModTime = info.ModTime()
+				m.Entries = append(m.Entries, e)
+				return nil
+			}
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hash, err := blake2b.New256(nil)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.MultiWriter(tw, hash), f)
+		if err != nil {
+			return err
+		}
+		m.Entries = append(m.Entries, manifestEntry{
+			Path:    hdr.Name,
+			Size:    n,
+			ModTime: info.ModTime(),
+			BLAKE2b: hex.EncodeToString(hash.Sum(nil)),
+		})
+		return nil
+	})
+}
+
+// cleanEntryName returns the cleaned name of an archive entry, rejecting names
+// that would be extracted outside of the destination directory.
+func cleanEntryName(name string) (string, error) {
+	name = path.Clean(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", errUnsafePath
+	}
+	return name, nil
+}
+
+// selected reports whether the entry name should be extracted given the list
+// of requested paths. An empty list selects everything.
+func selected(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = path.Clean(filepath.ToSlash(p))
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveOptions says how writeArchive walks a tree.
+type archiveOptions struct {
+	// symlinks says whether symlinks are stored or followed; see links.go.
+	symlinks symlinkMode
+	// filter, if set, leaves entries out; see filter.go.
+	filter *pathFilter
+}
+
+// archiveFlags are the flags of the commands that write archives.
+type archiveFlags struct {
+	symlinks string
+	filter   pathFilter
+}
+
+func (f *archiveFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.symlinks, "symlinks", "store", symlinksUsage)
+	fs.Var(filterFlag{filter: &f.filter}, "exclude", "leave out of archives the files and directories matching this pattern, e.g. '*.o' or 'build/'; may be repeated")
+	fs.Var(filterFlag{filter: &f.filter, include: true}, "include", "keep in archives the files and directories matching this pattern, even if an earlier -exclude matches them; may be repeated")
+	fs.Var(filterFlag{filter: &f.filter, file: true}, "exclude-from", "leave out of archives what matches the patterns in this file, one per line in the syntax of .gitignore files; may be repeated")
+}
+
+// options returns the archiveOptions the flags describe. It exits on
+// failure.
+func (f *archiveFlags) options() archiveOptions {
+	mode, err := parseSymlinkMode(f.symlinks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := archiveOptions{symlinks: mode}
+	if len(f.filter.rules) > 0 {
+		opts.filter = &f.filter
+	}
+	return opts
+}
+
+// extractOptions says what extractArchive extracts, and how.
+type extractOptions struct {
+	// paths, if not empty, limits extraction to the entries at or beneath
+	// them.
+	paths []string
+	// owners, if set, restores the owners, modes, ACLs and capabilities of
+	// the entries; see owner.go.
+	owners *ownerOptions
+}
+
+// extractArchive extracts the tar stream r into the directory dest, creating it
+// if needed, as described by opts. The archive's manifest is returned, or nil
+// if it has none.
+func extractArchive(r io.Reader, dest string, opts extractOptions) (*manifest, error) {
+	err := os.MkdirAll(dest, 0700)
+	if err != nil {
+		return nil, err
+	}
+	var m *manifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == manifestName {
+			m = new(manifest)
+			err = json.NewDecoder(tr).Decode(m)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !selected(name, opts.paths) {
+			continue
+		}
+		err = checkParents(dest, name)
+		if err != nil {
+			return nil, err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = removeSymlink(target)
+			if err == nil {
+				err = os.MkdirAll(target, hdr.FileInfo().Mode().Perm()|0700)
+			}
+		case tar.TypeReg:
+			err = extractFile(tr, hdr, target)
+		case tar.TypeSymlink:
+			err = os.MkdirAll(filepath.Dir(target), 0700)
+			if err == nil {
+				err = removeSymlink(target)
+			}
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		case tar.TypeLink:
+			err = extractLink(dest, hdr, target)
+		default:
+			continue
+		}
+		if err == nil && opts.owners != nil {
+			err = opts.owners.restore(hdr, target)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// extractFile writes the contents of the current entry of tr to target.
+func extractFile(tr *tar.Reader, hdr *tar.Header, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return err
+	}
+	err = removeSymlink(target)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, tr)
+	if err != nil {
+		f.Close()
+		os.Remove(target)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// checkParents returns errUnsafePath if any directory that the entry name
+// would be extracted under in dest is a symlink, which an archive could have
+// planted to write outside of dest.
+func checkParents(dest string, name string) error {
+	p := dest
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errUnsafePath
+		}
+	}
+	return nil
+}
+
+// extractLink links target to the file of the hard link entry hdr, which was
+// extracted into dest before it.
+func extractLink(dest string, hdr *tar.Header, target string) error {
+	name, err := cleanEntryName(hdr.Linkname)
+	if err != nil {
+		return err
+	}
+	err = checkParents(dest, name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(filepath.Join(dest, filepath.FromSlash(name)), target)
+}
+
+// removeSymlink removes target if it is a symlink, so that extracting over
+// it does not write wherever it points.
+func removeSymlink(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(target)
+}
+
+// chmodChecked changes the mode of the file at p, failing with
+// errUnsafePath rather than following p if it is a symlink.
+func chmodChecked(p string, mode os.FileMode) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return errUnsafePath
+	}
+	return os.Chmod(p, mode)
+}
+
+// writeTar copies the entries of the tar stream r that paths selects to w as
+// a tar stream of their own, leaving out the manifest, so that an archive can
+// be piped to tar or anything else that reads tar. Entries are written as
+// they are read: owners, ACLs and other extended attributes are kept.
+func writeTar(r io.Reader, w io.Writer, paths []string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == manifestName || !selected(path.Clean(hdr.Name), paths) {
+			continue
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// listArchive prints a line for each entry in the tar stream r to w.
+func listArchive(r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == manifestName {
+			continue
+		}
+		name := hdr.Name
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			name += " -> " + hdr.Linkname
+		case tar.TypeLink:
+			name += " link to " + hdr.Linkname
+		}
+		fmt.Fprintf(w, "%v %12d %v %v\n", hdr.FileInfo().Mode(), hdr.Size, hdr.ModTime.Format("2006-01-02 15:04"), name)
+	}
+}
+
+// archiveListing is an entry of an archive as listed by enc list -json.
+type archiveListing struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	Owner   string    `json:"owner,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// listArchiveJSON writes a JSON object for each entry in the tar stream r to
+// w, one per line.
+func listArchiveJSON(r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	enc := json.NewEncoder(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == manifestName {
+			continue
+		}
+		entry := archiveListing{
+			Name:    strings.TrimSuffix(hdr.Name, "/"),
+			Size:    hdr.Size,
+			Mode:    fmt.Sprintf("%04o", hdr.Mode&07777),
+			ModTime: hdr.ModTime.UTC(),
+			Owner:   hdr.Uname,
+			Group:   hdr.Gname,
+			Link:    hdr.Linkname,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entry.Type = "dir"
+		case tar.TypeSymlink:
+			entry.Type = "symlink"
+		case tar.TypeLink:
+			entry.Type = "hardlink"
+		default:
+			entry.Type = "file"
+		}
+		err = enc.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package encstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestArchiveRoundTrip verifies that a directory tree survives being written
+// to and extracted from an archive, and that extraction can be limited to a
+// subset of the entries.
+func TestArchiveRoundTrip(t *testing.T) {
+	src, err := ioutil.TempDir("", "enctest-archive-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	files := map[string]string{
+		"a.txt":         "alpha",
+		"dir/b.txt":     "bravo",
+		"dir/sub/c.txt": "charlie",
+		"other/d.txt":   "delta",
+	}
+	for name, contents := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(src, archive, nil, archiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	listing := new(bytes.Buffer)
+	if err := listArchive(bytes.NewReader(archive.Bytes()), listing); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		if !strings.Contains(listing.String(), name) {
+			t.Fatal("listing is missing", name)
+		}
+	}
+	if !strings.Contains(listing.String(), "link -> a.txt") {
+		t.Fatal("listing is missing the symlink")
+	}
+
+	listing.Reset()
+	if err := listArchiveJSON(bytes.NewReader(archive.Bytes()), listing); err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]archiveListing)
+	dec := json.NewDecoder(listing)
+	for dec.More() {
+		var entry archiveListing
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		listed[entry.Name] = entry
+	}
+	for name, contents := range files {
+		if entry := listed[name]; entry.Type != "file" || entry.Size != int64(len(contents)) || entry.Mode != "0600" {
+			t.Fatalf("%v: bad JSON listing %+v", name, entry)
+		}
+	}
+	if entry := listed["link"]; entry.Type != "symlink" || entry.Link != "a.txt" {
+		t.Fatalf("bad JSON listing of the symlink %+v", entry)
+	}
+	if listed["dir"].Type != "dir" || len(listed) != len(files)+4 {
+		t.Fatal("bad JSON listing of the directories", listed)
+	}
+
+	dest, err := ioutil.TempDir("", "enctest-archive-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if _, err := extractArchive(bytes.NewReader(archive.Bytes()), dest, extractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != contents {
+			t.Fatal("extracted", name, "has contents", string(b), "wanted", contents)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "link")); err != nil || link != "a.txt" {
+		t.Fatal("symlink was not restored", link, err)
+	}
+
+	partial, err := ioutil.TempDir("", "enctest-archive-partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(partial)
+	if _, err := extractArchive(bytes.NewReader(archive.Bytes()), partial, extractOptions{paths: []string{"dir"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(partial, "dir", "sub", "c.txt")); err != nil {
+		t.Fatal("selected entry was not extracted:", err)
+	}
+	if _, err := os.Stat(filepath.Join(partial, "a.txt")); !os.IsNotExist(err) {
+		t.Fatal("unselected entry was extracted")
+	}
+}
+
+// TestArchiveUnsafePaths verifies that entries which would land outside the
+// destination directory are rejected.
+func TestArchiveUnsafePaths(t *testing.T) {
+	for _, name := range []string{"../escape", "/etc/escape", "a/../../escape"} {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dest, err := ioutil.TempDir("", "enctest-archive-unsafe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+		if _, err := extractArchive(buf, dest, extractOptions{}); err != errUnsafePath {
+			t.Fatal("expected", errUnsafePath, "for", name, "got", err)
+		}
+	}
+}
+
+// TestExtractThroughSymlink verifies that entries cannot be extracted, or
+// hard linked to files, through symlinks planted by earlier entries.
+func TestExtractThroughSymlink(t *testing.T) {
+	outside, err := ioutil.TempDir("", "enctest-archive-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	for _, last := range []*tar.Header{
+		{Name: "evil/x", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "x", Typeflag: tar.TypeLink, Linkname: "evil/secret"},
+	} {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		if err := tw.WriteHeader(&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: outside}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(last); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dest, err := ioutil.TempDir("", "enctest-archive-dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+		if _, err := extractArchive(buf, dest, extractOptions{}); err != errUnsafePath {
+			t.Fatalf("%v: expected errUnsafePath, got %v", last.Name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+			t.Fatal("an entry was extracted outside of the destination")
+		}
+	}
+}
+
+// TestExtractOverSymlink verifies that a file entry replaces a symlink of the
+// same name planted by an earlier entry, rather than writing where it points.
+func TestExtractOverSymlink(t *testing.T) {
+	outside, err := ioutil.TempDir("", "enctest-archive-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	target := filepath.Join(outside, "x")
+	if err := ioutil.WriteFile(target, []byte("kept"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: target}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "evil", Typeflag: tar.TypeReg, Mode: 0600, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("evil")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := ioutil.TempDir("", "enctest-archive-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if _, err := extractArchive(buf, dest, extractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(target); err != nil || string(data) != "kept" {
+		t.Fatal("an entry was written through a symlink outside of the destination")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dest, "evil")); err != nil || string(data) != "evil" {
+		t.Fatal("the entry was not extracted in place of the symlink")
+	}
+}
+
+// TestWriteTar verifies that an archive is written as a plain tar stream of
+// the selected entries, without the manifest.
+func TestWriteTar(t *testing.T) {
+	src, err := ioutil.TempDir("", "enctest-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	files := map[string]string{"a.txt": "alpha", "docs/b.txt": "beta", "docs/c/d.txt": "delta"}
+	for name, contents := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(src, archive, nil, archiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		paths    []string
+		expected []string
+	}{
+		{nil, []string{"a.txt", "docs", "docs/b.txt", "docs/c", "docs/c/d.txt"}},
+		{[]string{"docs/c"}, []string{"docs/c", "docs/c/d.txt"}},
+	} {
+		out := new(bytes.Buffer)
+		if err := writeTar(bytes.NewReader(archive.Bytes()), out, c.paths); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		tr := tar.NewReader(out)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			name := strings.TrimSuffix(hdr.Name, "/")
+			names = append(names, name)
+			if hdr.Typeflag == tar.TypeReg {
+				contents, err := ioutil.ReadAll(tr)
+				if err != nil || string(contents) != files[name] {
+					t.Fatalf("%v: expected %q, got %q %v", name, files[name], contents, err)
+				}
+			}
+		}
+		if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+			t.Fatalf("%v: expected %v, got %v", c.paths, c.expected, names)
+		}
+	}
+}
+
+// TestListJSON verifies every field of the entries enc ls -json prints for
+// an encrypted archive, and that a file that is not an archive is refused.
+func TestListJSON(t *testing.T) {
+	mtime := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+	tarball := new(bytes.Buffer)
+	tw := tar.NewWriter(tarball)
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime, Uname: "alice", Gname: "staff"},
+		{Name: "dir/a.txt", Typeflag: tar.TypeReg, Mode: 0640, Size: 5, ModTime: mtime, Uname: "alice", Gname: "staff"},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/a.txt", Mode: 0777, ModTime: mtime},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "dir/a.txt", Mode: 0640, ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("hello"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := encryptOptions{recipients: []recipient{id.public}}
+	archive := new(memoryOutput)
+	if _, _, _, err := encryptTo(nil, bytes.NewReader(tarball.Bytes()), archive, flagArchive, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	listing := new(bytes.Buffer)
+	if err := listArchiveFile(identityKeys{id}, bytes.NewReader(archive.buf), listing, true); err != nil {
+		t.Fatal(err)
+	}
+	var listed []archiveListing
+	dec := json.NewDecoder(listing)
+	for dec.More() {
+		var entry archiveListing
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, entry)
+	}
+	expected := []archiveListing{
+		{Name: "dir", Type: "dir", Mode: "0755", ModTime: mtime, Owner: "alice", Group: "staff"},
+		{Name: "dir/a.txt", Type: "file", Size: 5, Mode: "0640", ModTime: mtime, Owner: "alice", Group: "staff"},
+		{Name: "link", Type: "symlink", Mode: "0777", ModTime: mtime, Link: "dir/a.txt"},
+		{Name: "hard", Type: "hardlink", Mode: "0640", ModTime: mtime, Link: "dir/a.txt"},
+	}
+	if len(listed) != len(expected) {
+		t.Fatalf("listed %v entries, expected %v", len(listed), len(expected))
+	}
+	for i, entry := range listed {
+		want := expected[i]
+		if !entry.ModTime.Equal(want.ModTime) {
+			t.Fatalf("%v: listed mtime %v, expected %v", want.Name, entry.ModTime, want.ModTime)
+		}
+		entry.ModTime = want.ModTime
+		if entry != want {
+			t.Fatalf("listed %+v, expected %+v", entry, want)
+		}
+	}
+
+	file := new(memoryOutput)
+	if _, _, _, err := encryptTo(nil, bytes.NewReader([]byte("hello")), file, 0, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := listArchiveFile(identityKeys{id}, bytes.NewReader(file.buf), ioutil.Discard, true); err != errNotArchive {
+		t.Fatal("expected errNotArchive, got", err)
+	}
+}
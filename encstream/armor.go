@@ -0,0 +1,317 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Armored files carry the binary encrypted file as base64 text between
+// PEM-like delimiters, so that they can be pasted into emails, tickets and
+// configuration files:
+//
+//	-----BEGIN ENC FILE-----
+//	Label: <label and metadata fields from the header, if any>
+//
+//	<base64, wrapped at 64 columns>
+//	=<base64 CRC-24 of the binary file>
+//	-----END ENC FILE-----
+//
+// The CRC only catches transcription errors early; the MAC still
+// authenticates the contents. Decoding ignores surrounding text, leading and
+// trailing whitespace on every line and the line length, since mail and chat
+// clients tend to change those.
+//
+// The metadata lines are copies of the label and metadata fields in the
+// header, shown so that they can be read without any tools. When decoding,
+// they must match the fields in the header, which the MAC authenticates.
+
+const (
+	armorBegin     = "-----BEGIN ENC FILE-----"
+	armorEnd       = "-----END ENC FILE-----"
+	armorLineWidth = 64
+)
+
+var (
+	errArmor        = errors.New("invalid armor")
+	errArmorCRC     = errors.New("armor checksum mismatch; the text was damaged in transit")
+	errArmorOptions = errors.New("armored output cannot be split into volumes or carry recovery records")
+	errArmorHeaders = errors.New("armor headers do not match the metadata in the file; they may have been altered")
+)
+
+// crc24 computes the CRC-24 used by OpenPGP armor (RFC 4880, section 6.1).
+type crc24 uint32
+
+func newCRC24() crc24 { return 0xb704ce }
+
+func (c *crc24) Write(p []byte) (int, error) {
+	crc := uint32(*c)
+	for _, b := range p {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	*c = crc24(crc & 0xffffff)
+	return len(p), nil
+}
+
+func (c crc24) encode() string {
+	return "=" + base64.StdEncoding.EncodeToString([]byte{byte(c >> 16), byte(c >> 8), byte(c)})
+}
+
+// lineWrapper inserts a newline every armorLineWidth bytes.
+type lineWrapper struct {
+	w      io.Writer
+	column int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := armorLineWidth - l.column
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err := l.w.Write(p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		l.column += n
+		if l.column == armorLineWidth {
+			_, err = l.w.Write([]byte("\n"))
+			if err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+	}
+	return written, nil
+}
+
+// writeArmor armors the binary encrypted file read from r to w, showing the
+// armor headers of its header.
+func writeArmor(w io.Writer, r io.Reader, fields []metadataField) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(armorBegin + "\n")
+	for _, f := range fields {
+		bw.WriteString(f.Key + ": " + f.Value + "\n")
+	}
+	if len(fields) > 0 {
+		bw.WriteString("\n")
+	}
+	crc := newCRC24()
+	lines := &lineWrapper{w: bw}
+	enc := base64.NewEncoder(base64.StdEncoding, lines)
+	_, err := io.Copy(io.MultiWriter(enc, &crc), r)
+	if err != nil {
+		return err
+	}
+	err = enc.Close()
+	if err != nil {
+		return err
+	}
+	if lines.column != 0 {
+		bw.WriteString("\n")
+	}
+	bw.WriteString(crc.encode() + "\n")
+	bw.WriteString(armorEnd + "\n")
+	return bw.Flush()
+}
+
+// readArmor decodes the armored file read from r to w, returning the
+// metadata lines shown in the armor.
+func readArmor(w io.Writer, r io.Reader) ([]metadataField, error) {
+	scanner := bufio.NewScanner(r)
+	for {
+		if !scanner.Scan() {
+			if scanner.Err() != nil {
+				return nil, scanner.Err()
+			}
+			return nil, errArmor
+		}
+		if strings.TrimSpace(scanner.Text()) == armorBegin {
+			break
+		}
+	}
+
+	crc := newCRC24()
+	pr, pw := io.Pipe()
+	decoded := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.MultiWriter(w, &crc), base64.NewDecoder(base64.StdEncoding, pr))
+		pr.CloseWithError(err)
+		decoded <- err
+	}()
+	// finish stops the decoder, returning its error if there is one and err
+	// otherwise.
+	finish := func(err error) error {
+		pw.CloseWithError(err)
+		if decodeErr := <-decoded; decodeErr != nil && decodeErr != err {
+			return errArmor
+		}
+		return err
+	}
+
+	var fields []metadataField
+	inHeaders := true
+	checksum := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// base64 has no colons, so the metadata lines are told apart from
+		// the body by them.
+		if i := strings.Index(line, ": "); inHeaders && i > 0 {
+			fields = append(fields, metadataField{Key: line[:i], Value: line[i+2:]})
+			continue
+		}
+		inHeaders = false
+		switch {
+		case line == armorEnd:
+			err := finish(nil)
+			if err != nil {
+				return nil, err
+			}
+			if checksum != "" && checksum != crc.encode() {
+				return nil, errArmorCRC
+			}
+			return fields, nil
+		case strings.HasPrefix(line, "=") && len(line) == 5:
+			checksum = line
+		case checksum != "":
+			// nothing but the end line may follow the checksum.
+			return nil, finish(errArmor)
+		default:
+			_, err := io.WriteString(pw, line)
+			if err != nil {
+				return nil, finish(err)
+			}
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, finish(scanner.Err())
+	}
+	return nil, finish(errArmor)
+}
+
+// checkArmorHeaders checks that the metadata lines shown in the armor match
+// the label and metadata fields in the header of the decoded file r, leaving r
+// at its start.
+func checkArmorHeaders(fields []metadataField, r io.ReadSeeker) error {
+	header, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	want := header.armorHeaders()
+	if len(fields) != len(want) {
+		return errArmorHeaders
+	}
+	for i := range fields {
+		if fields[i] != want[i] {
+			return errArmorHeaders
+		}
+	}
+	return nil
+}
+
+// isArmored reports whether r, which is left at its start, holds an armored
+// file. Leading whitespace is allowed before the armor.
+func isArmored(r io.ReadSeeker) (bool, error) {
+	prefix := make([]byte, 512)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	return bytes.HasPrefix(bytes.TrimLeft(prefix[:n], " \t\r\n"), []byte(armorBegin)), nil
+}
+
+// armoredOutput is an encryptOutput that writes the binary encrypted file to
+// a temporary file and armors it into the final output on commit.
+type armoredOutput struct {
+	*atomicFile
+}
+
+func createArmored(name string) (*armoredOutput, error) {
+	f, err := os.Create(name + ".binary.temp")
+	if err != nil {
+		return nil, err
+	}
+	return &armoredOutput{&atomicFile{File: f, name: name}}, nil
+}
+
+func (a *armoredOutput) commit() error {
+	defer a.abort()
+	_, err := a.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	header, err := readHeader(a.File)
+	if err != nil {
+		return err
+	}
+	_, err = a.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	output, err := createAtomic(a.name)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	err = writeArmor(output, a.File, header.armorHeaders())
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
+
+// dearmoredFile is a temporary file holding a decoded armored file, removed
+// on Close.
+type dearmoredFile struct {
+	*os.File
+}
+
+// dearmor decodes the armored file read from r into a temporary file,
+// positioned at its start.
+func dearmor(r io.Reader) (*dearmoredFile, error) {
+	f, err := ioutil.TempFile("", "enc-dearmored")
+	if err != nil {
+		return nil, err
+	}
+	d := &dearmoredFile{f}
+	fields, err := readArmor(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = checkArmorHeaders(fields, f)
+	}
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *dearmoredFile) Close() error {
+	err := d.File.Close()
+	os.Remove(d.Name())
+	return err
+}
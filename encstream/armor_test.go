@@ -0,0 +1,112 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+// TestCRC24 checks the CRC-24 implementation against the standard check
+// value.
+func TestCRC24(t *testing.T) {
+	crc := newCRC24()
+	crc.Write([]byte("123456789"))
+	if crc != 0x21cf02 {
+		t.Fatalf("got %06x, wanted 21cf02", uint32(crc))
+	}
+}
+
+// TestArmorRoundTrip verifies that armored data survives the changes mail and
+// chat clients tend to make, and that damage to it is detected.
+func TestArmorRoundTrip(t *testing.T) {
+	data := make([]byte, 1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	armored := new(bytes.Buffer)
+	if err := writeArmor(armored, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(armored.String(), "\n")
+	if lines[0] != armorBegin || len(lines[1]) != armorLineWidth {
+		t.Fatal("unexpected armor layout:\n" + armored.String())
+	}
+	isArmoredText, err := isArmored(bytes.NewReader(armored.Bytes()))
+	if err != nil || !isArmoredText {
+		t.Fatal("armor was not detected", err)
+	}
+	isArmoredText, err = isArmored(bytes.NewReader(data))
+	if err != nil || isArmoredText {
+		t.Fatal("binary data was detected as armor", err)
+	}
+
+	// rewrap the body, indent it, use CRLF line endings and quote it within
+	// other text.
+	body := strings.Join(lines[1:len(lines)-3], "")
+	var mangled []string
+	mangled = append(mangled, "see below:", "", "  "+armorBegin)
+	for len(body) > 0 {
+		n := 50
+		if n > len(body) {
+			n = len(body)
+		}
+		mangled = append(mangled, "  "+body[:n])
+		body = body[n:]
+	}
+	mangled = append(mangled, "  "+lines[len(lines)-3], "  "+armorEnd, "thanks")
+	decoded := new(bytes.Buffer)
+	if _, err := readArmor(decoded, strings.NewReader(strings.Join(mangled, "\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Bytes(), data) {
+		t.Fatal("armor did not decode to the original data")
+	}
+
+	// replacing a character leaves valid base64 but breaks the CRC.
+	damaged := []byte(armored.String())
+	i := len(armorBegin) + 11
+	if damaged[i] == 'A' {
+		damaged[i] = 'B'
+	} else {
+		damaged[i] = 'A'
+	}
+	if _, err := readArmor(new(bytes.Buffer), bytes.NewReader(damaged)); err != errArmorCRC {
+		t.Fatal("expected", errArmorCRC, "got", err)
+	}
+	if _, err := readArmor(new(bytes.Buffer), strings.NewReader(armorBegin+"\nZm9v\n")); err != errArmor {
+		t.Fatal("expected", errArmor, "for truncated armor, got", err)
+	}
+}
+
+// TestArmorHeaders verifies that the metadata in a header is shown in the
+// armor, and that altering it there is detected.
+func TestArmorHeaders(t *testing.T) {
+	h, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Metadata = []metadataField{{"Comment", "prod DB backup"}}
+	armored := new(bytes.Buffer)
+	if err := writeArmor(armored, bytes.NewReader(h.encode()), h.Metadata); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(armored.String(), armorBegin+"\nComment: prod DB backup\n\n") {
+		t.Fatal("metadata is not shown in the armor:\n" + armored.String())
+	}
+
+	for text, want := range map[string]error{
+		armored.String(): nil,
+		strings.Replace(armored.String(), "prod", "test", 1):                  errArmorHeaders,
+		strings.Replace(armored.String(), "Comment: prod DB backup\n", "", 1): errArmorHeaders,
+	} {
+		decoded := new(bytes.Buffer)
+		fields, err := readArmor(decoded, strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkArmorHeaders(fields, bytes.NewReader(decoded.Bytes())); err != want {
+			t.Fatal("expected", want, "got", err)
+		}
+	}
+}
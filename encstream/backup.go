@@ -0,0 +1,155 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backups are chains of archives. The first snapshot in a chain is a full
+// archive; every following snapshot only stores the files that changed since
+// its parent, but its manifest lists the entire tree. Next to every snapshot,
+// its manifest is written to an encrypted sidecar file so that the following
+// snapshot can be taken without decrypting the whole archive.
+
+// manifestSuffix is appended to a snapshot's name to form the name of its
+// manifest sidecar.
+const manifestSuffix = ".manifest"
+
+var (
+	errSnapshotOrder   = errors.New("snapshot does not follow the previous snapshot; restore them in the order they were taken")
+	errIncompleteChain = errors.New("the first snapshot is incremental; restore must start from a full snapshot")
+)
+
+// backupDir encrypts root to finalOutput as a snapshot, and writes its
+// manifest to an encrypted sidecar next to it. If since is not empty, it names
+// the manifest sidecar of the previous snapshot, and only files that changed
+// since then are stored. opts says how root is walked.
+func backupDir(passphrase []byte, root string, finalOutput string, since string, opts archiveOptions) error {
+	var parent *manifest
+	if since != "" {
+		m, err := readManifestFile(newPassphraseKeys(passphrase), since)
+		if err != nil {
+			return err
+		}
+		parent = &m
+	}
+	m, err := encryptArchive(passphrase, root, finalOutput, parent, encryptOptions{archive: opts})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return encrypt(passphrase, bytes.NewReader(b), finalOutput+manifestSuffix, 0, encryptOptions{})
+}
+
+// readManifestFile decrypts the manifest stored at path, which is either a
+// manifest sidecar or a snapshot itself.
+func readManifestFile(keys keySource, path string) (manifest, error) {
+	f, err := openEncrypted(path)
+	if err != nil {
+		return manifest{}, err
+	}
+	defer f.Close()
+	header, plaintext, err := openCiphertext(keys, f)
+	if err != nil {
+		return manifest{}, err
+	}
+	if header.Flags&flagArchive != 0 {
+		return readManifest(plaintext)
+	}
+	var m manifest
+	err = json.NewDecoder(plaintext).Decode(&m)
+	return m, err
+}
+
+// restoreSnapshots restores the chain of snapshots, given in the order they
+// were taken, into dest, restoring owners as described by owners if it is
+// set. Since the manifest is the last entry of a snapshot, each snapshot is
+// read twice: once to check that its manifest follows the previous one, and
+// once to extract it.
+func restoreSnapshots(keys keySource, snapshots []string, dest string, owners *ownerOptions) error {
+	var previous *manifest
+	for _, snapshot := range snapshots {
+		m, err := readManifestFile(keys, snapshot)
+		if err != nil {
+			return err
+		}
+		f, err := openEncrypted(snapshot)
+		if err != nil {
+			return err
+		}
+		header, plaintext, err := openCiphertext(keys, f)
+		if err == nil && header.Flags&flagArchive == 0 {
+			err = errNotArchive
+		}
+		if err == nil {
+			err = applySnapshot(plaintext, dest, &m, previous, owners)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		previous = &m
+	}
+	return nil
+}
+
+// checkChain returns an error unless the snapshot described by m follows the
+// snapshot described by previous, or starts a chain if previous is nil.
+func checkChain(m, previous *manifest) error {
+	if previous == nil && m.Parent != "" {
+		return errIncompleteChain
+	}
+	if previous != nil && m.Parent != previous.id() {
+		return errSnapshotOrder
+	}
+	return nil
+}
+
+// applySnapshot extracts the snapshot archive r, whose manifest is m, into
+// dest on top of the snapshot described by previous, removing the files that
+// were deleted in between, and restoring owners as described by owners if it
+// is set. Nothing is extracted unless m follows previous.
+func applySnapshot(r io.Reader, dest string, m, previous *manifest, owners *ownerOptions) error {
+	err := checkChain(m, previous)
+	if err != nil {
+		return err
+	}
+	extracted, err := extractArchive(r, dest, extractOptions{owners: owners})
+	if err != nil {
+		return err
+	}
+	if extracted == nil {
+		return errNoManifest
+	}
+	if extracted.id() != m.id() {
+		return errSnapshotOrder
+	}
+	if previous != nil {
+		current := m.entries()
+		for _, e := range previous.Entries {
+			if _, ok := current[e.Path]; ok {
+				continue
+			}
+			name, err := cleanEntryName(e.Path)
+			if err != nil {
+				return err
+			}
+			err = checkParents(dest, name)
+			if err != nil {
+				return err
+			}
+			err = os.Remove(filepath.Join(dest, filepath.FromSlash(name)))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestIncrementalSnapshots verifies that incremental snapshots only store
+// changed files, and that applying a chain of snapshots in order reproduces
+// the final tree.
+func TestIncrementalSnapshots(t *testing.T) {
+	src, err := ioutil.TempDir("", "enctest-backup-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("unchanged", "unchanged")
+	write("touched", "touched")
+	write("modified", "modified")
+	write("deleted", "deleted")
+
+	full := new(bytes.Buffer)
+	m, err := writeArchive(src, full, nil, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("modified", "MODIFIED")
+	write("added", "added")
+	if err := os.Remove(filepath.Join(src, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "touched"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	incremental := new(bytes.Buffer)
+	m2, err := writeArchive(src, incremental, &m, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Parent != m.id() {
+		t.Fatal("incremental snapshot does not reference its parent")
+	}
+	if len(m2.Entries) != 4 {
+		t.Fatal("incremental manifest has", len(m2.Entries), "entries, wanted 4")
+	}
+	listing := new(bytes.Buffer)
+	if err := listArchive(bytes.NewReader(incremental.Bytes()), listing); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(listing.String(), "\n") != 2 || !strings.Contains(listing.String(), "modified") || !strings.Contains(listing.String(), "added") {
+		t.Fatal("incremental snapshot should only store the modified and added files, got:\n" + listing.String())
+	}
+
+	dest, err := ioutil.TempDir("", "enctest-backup-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	fullManifest, err := readManifest(bytes.NewReader(full.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	incrementalManifest, err := readManifest(bytes.NewReader(incremental.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applySnapshot(bytes.NewReader(incremental.Bytes()), dest, &incrementalManifest, nil, nil); err != errIncompleteChain {
+		t.Fatal("expected", errIncompleteChain, "got", err)
+	}
+	if names, err := ioutil.ReadDir(dest); err != nil || len(names) != 0 {
+		t.Fatal("an incomplete chain was extracted:", names, err)
+	}
+	if err := applySnapshot(bytes.NewReader(full.Bytes()), dest, &fullManifest, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applySnapshot(bytes.NewReader(full.Bytes()), dest, &fullManifest, &fullManifest, nil); err != errSnapshotOrder {
+		t.Fatal("expected", errSnapshotOrder, "got", err)
+	}
+	if err := applySnapshot(bytes.NewReader(incremental.Bytes()), dest, &incrementalManifest, &fullManifest, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := m2.verify(dest, out); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dest, "deleted")); !os.IsNotExist(err) {
+		t.Fatal("deleted file was not removed on restore")
+	}
+}
+
+// TestSnapshotDeletionsStayInside verifies that removing the files deleted
+// between snapshots does not follow a symbolic link out of the destination.
+func TestSnapshotDeletionsStayInside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-backup-links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dest, outside := filepath.Join(dir, "src"), filepath.Join(dir, "dest"), filepath.Join(dir, "outside")
+	for _, d := range []string{src, dest, outside} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	victim := filepath.Join(outside, "victim")
+	if err := ioutil.WriteFile(victim, []byte("victim"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+
+	previous := manifest{Entries: []manifestEntry{{Path: "link/victim"}}}
+	snapshot := new(bytes.Buffer)
+	m, err := writeArchive(src, snapshot, &previous, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applySnapshot(bytes.NewReader(snapshot.Bytes()), dest, &m, &previous, nil); err != errUnsafePath {
+		t.Fatal("expected", errUnsafePath, "got", err)
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatal("a file outside the destination was removed:", err)
+	}
+}
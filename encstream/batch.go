@@ -0,0 +1,143 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Given several inputs, enc encrypts each of them to its own file in the
+// output directory, several at a time. Deriving a key from the passphrase is
+// by far the most expensive step, so it is done once for the whole batch: the
+// files share the salt and KDF parameters, and each file's keys are a subkey
+// of the shared key, selected by a random salt in its header. Decrypting any
+// one of them derives the shared key and then the subkey.
+
+var (
+	errBatchOptions  = errors.New("-rm, -shred, -qr, -hide, -rsyncable, -dedup-with and -o - take a single input")
+	errSharedOptions = errors.New("a shared key cannot be combined with -fips or -dedup-with")
+)
+
+// sharedKey is a key derived from a passphrase once and shared by a batch of
+// files.
+type sharedKey struct {
+	header fileHeader // the salt and KDF parameters the key was derived with
+	key    [32]byte
+}
+
+// newSharedKey derives a sharedKey from passphrase with a new salt.
+func newSharedKey(passphrase []byte) (*sharedKey, error) {
+	header, err := newHeader()
+	if err != nil {
+		return nil, err
+	}
+	key, _ := deriveKeys(passphrase, header)
+	return &sharedKey{header: header, key: key}, nil
+}
+
+// subkeys derives the keys of a file from the shared key and the file's
+// subkey salt.
+func subkeys(shared [32]byte, salt [32]byte) (sk [32]byte, macKey [32]byte, err error) {
+	hash, err := blake2b.New256(shared[:])
+	if err != nil {
+		return sk, macKey, err
+	}
+	hash.Write([]byte("enc subkey"))
+	hash.Write(salt[:])
+	var fileKey [32]byte
+	copy(fileKey[:], hash.Sum(nil))
+	sk, macKey = keysFromFileKey(fileKey)
+	return sk, macKey, nil
+}
+
+// batchOutputs returns the output in outDir for each of inputs, named after
+// the input with ".enc" appended.
+func batchOutputs(inputs []string, outDir string) ([]string, error) {
+	outputs := make([]string, len(inputs))
+	seen := make(map[string]string)
+	for i, input := range inputs {
+		name := filepath.Base(filepath.Clean(input)) + ".enc"
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%v and %v would both be encrypted to %v", other, input, name)
+		}
+		seen[name] = input
+		outputs[i] = filepath.Join(outDir, name)
+	}
+	return outputs, nil
+}
+
+// encryptBatch encrypts each of inputs, which may be files or directories, to
+// its own file in the directory outDir, running up to jobs encryptions at
+// once. Failures are logged, and do not stop the other inputs.
+func encryptBatch(passphrase []byte, inputs []string, outDir string, jobs int, opts encryptOptions) error {
+	outputs, err := batchOutputs(inputs, outDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(outDir, 0700)
+	if err != nil {
+		return err
+	}
+	if len(opts.recipients) == 0 && opts.vault == nil && !opts.fips && opts.dedupWith == nil {
+		opts.shared, err = newSharedKey(passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	jobs = fitJobs(jobs)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				err := encryptInput(passphrase, inputs[i], outputs[i], opts)
+				if err != nil {
+					log.Println("could not encrypt", inputs[i]+":", err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range inputs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%v of %v inputs could not be encrypted", failed, len(inputs))
+	}
+	return nil
+}
+
+// encryptInput encrypts the file or directory at input to output.
+func encryptInput(passphrase []byte, input string, output string, opts encryptOptions) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		_, err = encryptArchive(passphrase, input, output, nil, opts)
+		return err
+	}
+	return encryptFile(passphrase, f, output, opts)
+}
@@ -0,0 +1,80 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEncryptBatch verifies that a batch of files is encrypted to separate
+// outputs that share the KDF salt but not their keys, and that each of them
+// decrypts on its own.
+func TestEncryptBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var inputs [][]byte
+	var names []string
+	for i := 0; i < 4; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, maxChunkSize*i+1)
+		name := filepath.Join(dir, "input"+string(rune('a'+i)))
+		err = ioutil.WriteFile(name, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, data)
+		names = append(names, name)
+	}
+	if _, err := batchOutputs([]string{names[0], filepath.Join(dir, "other", "inputa")}, dir); err == nil {
+		t.Fatal("two inputs with the same name were given the same output")
+	}
+
+	passphrase := []byte("hunter2")
+	outDir := filepath.Join(dir, "encrypted")
+	err = encryptBatch(passphrase, names, outDir, 3, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first fileHeader
+	subkeys := make(map[[32]byte]bool)
+	for i, name := range names {
+		output := filepath.Join(outDir, filepath.Base(name)+".enc")
+		header, err := readHeaderFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = header
+		}
+		if header.Salt != first.Salt || header.Subkey == ([32]byte{}) || subkeys[header.Subkey] {
+			t.Fatal("the files do not share a salt with distinct subkeys")
+		}
+		subkeys[header.Subkey] = true
+
+		f, err := openEncrypted(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, r, err := openCiphertext(newPassphraseKeys(passphrase), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, inputs[i]) {
+			t.Fatal("decryption resulted in a different plaintext")
+		}
+	}
+
+	err = encryptBatch(passphrase, append(names, filepath.Join(dir, "missing")), outDir, 2, encryptOptions{})
+	if err == nil {
+		t.Fatal("a missing input was not reported")
+	}
+}
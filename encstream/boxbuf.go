@@ -0,0 +1,724 @@
+package encstream
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+//
+// maxChunkSize determines the amount of data written to an EncWriter before a
+// new chunk is written.
+//
+// Refer to the following excerpt from NACL's documentation as to why this chunking behavior is used:
+//
+//  Messages should be small because:
+//
+// 1. The whole message needs to be held in memory to be processed.
+//
+// 2. Using large messages pressures implementations on small machines to decrypt and process plaintext before authenticating it. This is very dangerous, and this API does not allow it, but a protocol that uses excessive message sizes might present some implementations with no other choice.
+//
+// 3. Fixed overheads will be sufficiently amortised by messages as small as 8KB.
+//
+// 4. Performance may be improved by working with messages that fit into data caches.
+//
+// Thus large amounts of data should be chunked so that each message is small. (Each message still needs a unique nonce.) If in doubt, 16KB is a reasonable chunk size.
+//
+// See also: https://www.imperialviolet.org/2014/06/27/streamingencryption.html
+//
+
+const maxChunkSize = 16384 // 16kb
+
+// maxConfigurableChunkSize bounds WithChunkSize, and with it what a DecReader
+// allocates for a chunk.
+const maxConfigurableChunkSize = 1 << 24
+
+var (
+	errChunkOrder        = errors.New("chunk out of order")
+	errPlaintextTooLarge = errors.New("the plaintext is larger than the limit")
+	errEntropy           = errors.New("could not read entropy for encryption")
+	errNonceReuse        = errors.New("a random nonce repeated, so the source of randomness is broken")
+	errNoLastChunk       = errors.New("the stream ends before its last chunk")
+)
+
+// NonceStrategy selects how the nonce of each chunk is chosen.
+type NonceStrategy int
+
+const (
+	// RandomNonces draws every nonce at random, and fails if one repeats.
+	RandomNonces NonceStrategy = iota
+	// SyntheticNonces derives every nonce from the key and the chunk
+	// plaintext, so identical chunks produce identical ciphertext.
+	SyntheticNonces
+	// CounterNonces numbers the chunks from zero, and a DecReader given it
+	// refuses chunks out of order, so that a stream sent over a live
+	// connection cannot be reordered or replayed.
+	CounterNonces
+)
+
+// streamConfig holds the settings of an EncWriter or DecReader.
+type streamConfig struct {
+	chunkSize   int
+	newAEAD     func(key []byte) (cipher.AEAD, error)
+	aad         []byte
+	nonces      NonceStrategy
+	rand        io.Reader
+	parallelism int
+	limit       int64
+	maxSize     int64
+	indexed     bool
+	first       uint64 // index of the first chunk, if indexed
+	unfinished  bool
+}
+
+// StreamOption configures an EncWriter or DecReader.
+type StreamOption func(*streamConfig)
+
+// WithChunkSize sets the most plaintext sealed in a single chunk. A DecReader
+// must be given at least the chunk size used to write the stream, and refuses
+// a larger chunk before allocating it, so it also bounds the memory of every
+// chunk read. It is capped at 16MB.
+func WithChunkSize(size int) StreamOption {
+	return func(c *streamConfig) {
+		if size > 0 && size <= maxConfigurableChunkSize {
+			c.chunkSize = size
+		}
+	}
+}
+
+// WithAEAD sets the AEAD that seals the chunks, given its constructor. Its
+// nonces must be at most 24 bytes. The default is XChaCha20-Poly1305.
+func WithAEAD(newAEAD func(key []byte) (cipher.AEAD, error)) StreamOption {
+	return func(c *streamConfig) {
+		c.newAEAD = newAEAD
+	}
+}
+
+// WithAAD binds additional data, which must be given again to decrypt, to
+// every chunk.
+func WithAAD(aad []byte) StreamOption {
+	return func(c *streamConfig) {
+		c.aad = aad
+	}
+}
+
+// WithNonceStrategy selects how an EncWriter chooses nonces. A DecReader reads
+// them from the stream, but checks their order with CounterNonces.
+func WithNonceStrategy(nonces NonceStrategy) StreamOption {
+	return func(c *streamConfig) {
+		c.nonces = nonces
+	}
+}
+
+// WithNonceRand makes an EncWriter read random nonces from r instead of
+// crypto/rand, for deterministic tests. It has no effect on a DecReader.
+func WithNonceRand(r io.Reader) StreamOption {
+	return func(c *streamConfig) {
+		c.rand = r
+	}
+}
+
+// WithParallelism seals or opens up to n chunks at a time on separate
+// goroutines. The output is the same as with n = 1, the default.
+func WithParallelism(n int) StreamOption {
+	return func(c *streamConfig) {
+		if n > 0 {
+			c.parallelism = n
+		}
+	}
+}
+
+// WithLimit makes a DecReader end after n bytes of plaintext, ignoring the
+// rest of the stream. It has no effect on an EncWriter.
+func WithLimit(n int64) StreamOption {
+	return func(c *streamConfig) {
+		if n >= 0 {
+			c.limit = n
+		}
+	}
+}
+
+// WithMaxSize makes a DecReader fail, rather than return more than n bytes of
+// plaintext, so that a stream from an untrusted source cannot be endless.
+// Unlike WithLimit, a stream of more than n bytes is an error. It has no
+// effect on an EncWriter.
+func WithMaxSize(n int64) StreamOption {
+	return func(c *streamConfig) {
+		if n >= 0 {
+			c.maxSize = n
+		}
+	}
+}
+
+// WithIndexedChunks binds the index of every chunk, counting from first, and
+// whether it is the last chunk, into its additional data, so that chunks
+// cannot be reordered, dropped, or cut off or added at the end. A DecReader
+// must be given the index of the chunk it starts at, and takes the chunk
+// before the end of its input to be the last. An EncWriter only writes full
+// chunks before Close, which always writes the last one, even if it is empty.
+func WithIndexedChunks(first uint64) StreamOption {
+	return func(c *streamConfig) {
+		c.indexed = true
+		c.first = first
+	}
+}
+
+// withUnfinished makes a DecReader with WithIndexedChunks open a stream whose
+// last chunk has not been written yet, as a partial output is read back to
+// resume it.
+func withUnfinished() StreamOption {
+	return func(c *streamConfig) {
+		c.unfinished = true
+	}
+}
+
+// newStreamConfig applies opts to the default settings.
+func newStreamConfig(opts []StreamOption) streamConfig {
+	c := streamConfig{
+		chunkSize:   maxChunkSize,
+		newAEAD:     chacha20poly1305.NewX,
+		rand:        rand.Reader,
+		parallelism: 1,
+		limit:       -1,
+		maxSize:     -1,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// EncWriter is an io.Writer that can be used to encrypt data with a secret key.
+// EncWriter seals chunks with XChaCha20-Poly1305, or the AEAD given with
+// WithAEAD.
+type EncWriter struct {
+	out        io.Writer
+	buf        []byte
+	frames     *bufio.Writer // collects the writes of a few chunks for out
+	pending    [][]byte      // chunks waiting to be sealed together
+	free       [][]byte      // buffers of chunks already written
+	nonces     [][24]byte    // nonces of the pending chunks
+	size       [8]byte       // encoded size of the chunk being written
+	usedNonces map[[24]byte]struct{}
+	chunker    *chunker // nil unless chunk boundaries are content-defined
+	nonceKey   *chunker // nil unless nonces are synthetic
+	counter    uint64   // number of the next chunk, with CounterNonces
+	chunks     uint64   // chunks sealed so far, with WithIndexedChunks
+	aads       [][]byte // additional data of the pending chunks, if indexed
+	closing    bool     // the last pending chunk is the last of the stream
+
+	secretKey [32]byte
+	config    streamConfig
+	aead      cipher.AEAD
+}
+
+// DecReader is an io.Reader that can be used to decrypt data using a secret
+// key. DecReader opens chunks with XChaCha20-Poly1305, or the AEAD given with
+// WithAEAD.
+type DecReader struct {
+	in     io.Reader
+	buf    []byte
+	index  int
+	opened [][]byte // chunks opened ahead of buf
+	free   [][]byte // buffers of chunks already read
+	nonces [][24]byte
+	sealed [][]byte // chunks read ahead, opened in place
+	errs   []error
+	header [32]byte // nonce and size of the next chunk
+	err    error    // error reading ahead, returned after opened
+	read   int64    // plaintext bytes returned so far
+	count  uint64   // number of the next chunk, with CounterNonces
+	chunks uint64   // chunks opened before those read ahead, if indexed
+	aads   [][]byte // additional data of the chunks read ahead, if indexed
+	ahead  bool     // header was read ahead, to tell the last chunk
+
+	secretKey [32]byte
+	config    streamConfig
+	aead      cipher.AEAD
+}
+
+// NewWriter creates a new EncWriter using the provided secretKey to encrypt
+// data as needed to out.
+func NewWriter(secretKey [32]byte, out io.Writer, opts ...StreamOption) *EncWriter {
+	w := &EncWriter{
+		usedNonces: make(map[[24]byte]struct{}),
+		secretKey:  secretKey,
+		config:     newStreamConfig(opts),
+		out:        out,
+	}
+	if w.config.nonces == SyntheticNonces {
+		w.nonceKey = newChunker(secretKey, w.config.chunkSize)
+	}
+	return w
+}
+
+// NewDedupWriter creates a new EncWriter using the provided secretKey to
+// encrypt data to out using content-defined chunk boundaries and synthetic
+// nonces, so that repeated data encrypted under the same key produces
+// identical ciphertext chunks. Close must be called to write the final chunk.
+// The output can be decrypted by a DecReader as usual.
+func NewDedupWriter(secretKey [32]byte, out io.Writer, opts ...StreamOption) *EncWriter {
+	w := NewWriter(secretKey, out, append(opts, WithNonceStrategy(SyntheticNonces))...)
+	w.chunker = w.nonceKey
+	return w
+}
+
+// NewReader creates a new DecReader using secretKey to decrypt the data as
+// needed from in.
+func NewReader(secretKey [32]byte, in io.Reader, opts ...StreamOption) *DecReader {
+	return &DecReader{
+		secretKey: secretKey,
+		config:    newStreamConfig(opts),
+		in:        in,
+	}
+}
+
+// Write writes the entirety of p to the underlying io.Writer, encrypting the
+// data with the public key and chunking as needed.
+func (w *EncWriter) Write(p []byte) (int, error) {
+	if w.chunker != nil {
+		return w.writeContentDefined(p)
+	}
+	for i, b := range p {
+		if len(w.buf) == w.config.chunkSize {
+			err := w.writeChunk()
+			if err != nil {
+				return i, err
+			}
+		}
+		if w.buf == nil {
+			w.buf = w.buffer()
+		}
+		w.buf = append(w.buf, b)
+	}
+	var err error
+	if !w.config.indexed || len(w.buf) == w.config.chunkSize {
+		// indexed chunks hold back a partial chunk, which may be the last.
+		err = w.writeChunk()
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err == nil && w.frames != nil {
+		err = w.frames.Flush()
+	}
+	return len(p), err
+}
+
+// writeContentDefined buffers p, writing a chunk whenever the chunker finds a
+// boundary.
+func (w *EncWriter) writeContentDefined(p []byte) (int, error) {
+	for i, b := range p {
+		if w.buf == nil {
+			w.buf = w.buffer()
+		}
+		w.buf = append(w.buf, b)
+		if w.chunker.boundary(b, len(w.buf)) {
+			err := w.writeChunk()
+			if err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes any buffered data as a final chunk. It does not close the
+// underlying io.Writer.
+func (w *EncWriter) Close() error {
+	if len(w.buf) > 0 || (w.config.indexed && !w.closing) {
+		w.closing = true
+		err := w.writeChunk()
+		if err != nil {
+			return err
+		}
+	}
+	err := w.flush()
+	if err == nil && w.frames != nil {
+		err = w.frames.Flush()
+	}
+	for _, buf := range w.free {
+		putChunkBuffer(w.config.chunkSize, buf)
+	}
+	w.free = nil
+	return err
+}
+
+// buffered returns the number of plaintext bytes written to w that are not
+// yet sealed, which only indexed chunks hold back after a Write.
+func (w *EncWriter) buffered() int {
+	return len(w.buf)
+}
+
+// buffer returns an empty buffer for the next chunk, reusing the buffer of a
+// chunk already written if there is one.
+func (w *EncWriter) buffer() []byte {
+	if n := len(w.free); n > 0 {
+		buf := w.free[n-1]
+		w.free = w.free[:n-1]
+		return buf
+	}
+	return getChunkBuffer(w.config.chunkSize)
+}
+
+// writeChunk queues a chunk holding EncWriter's buf and resets the buffer.
+// Chunks are sealed once parallelism of them are queued.
+func (w *EncWriter) writeChunk() error {
+	if w.buf == nil {
+		w.buf = w.buffer()
+	}
+	w.pending = append(w.pending, w.buf)
+	w.buf = nil
+	if len(w.pending) < w.config.parallelism {
+		return nil
+	}
+	return w.flush()
+}
+
+// flush seals the queued chunks and writes them out in order.
+func (w *EncWriter) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	if w.aead == nil {
+		aead, err := w.config.newAEAD(w.secretKey[:])
+		if err != nil {
+			return err
+		}
+		w.aead = aead
+		framesBuffered := 4
+		if w.config.parallelism > framesBuffered {
+			framesBuffered = w.config.parallelism
+		}
+		w.frames = bufio.NewWriterSize(w.out, framesBuffered*(24+8+w.config.chunkSize+aead.Overhead()))
+	}
+	// the nonce field of a chunk is always 24 bytes; AEADs with shorter
+	// nonces use a prefix of it and leave the rest zero.
+	w.nonces = w.nonces[:0]
+	for i, plaintext := range w.pending {
+		if w.nonceKey != nil {
+			// identical chunks are meant to share a nonce, see SyntheticNonces.
+			w.nonces = append(w.nonces, w.nonceKey.nonce(plaintext))
+			continue
+		}
+		if w.config.nonces == CounterNonces {
+			w.nonces = append(w.nonces, counterNonce(w.counter))
+			w.counter++
+			continue
+		}
+		w.nonces = append(w.nonces, [24]byte{})
+		_, err := io.ReadFull(w.config.rand, w.nonces[i][:w.aead.NonceSize()])
+		if err != nil {
+			return fmt.Errorf("%v: %v", errEntropy, err)
+		}
+		_, seen := w.usedNonces[w.nonces[i]]
+		if seen {
+			return errNonceReuse
+		}
+		w.usedNonces[w.nonces[i]] = struct{}{}
+	}
+	if w.config.indexed {
+		w.aads = indexedAADs(w.aads, w.config.aad, w.config.first+w.chunks, len(w.pending), w.closing)
+		w.chunks += uint64(len(w.pending))
+	}
+	if len(w.pending) == 1 {
+		w.seal(0)
+	} else {
+		parallel(len(w.pending), w.seal)
+	}
+	sealed := w.pending
+	w.pending = w.pending[:0]
+	defer func() {
+		for _, buf := range sealed {
+			w.free = append(w.free, buf[:0])
+		}
+	}()
+
+	for i, encryptedData := range sealed {
+		_, err := w.frames.Write(w.nonces[i][:])
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(w.size[:], uint64(len(encryptedData)))
+		_, err = w.frames.Write(w.size[:])
+		if err != nil {
+			return err
+		}
+		_, err = w.frames.Write(encryptedData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// counterNonce returns the nonce of chunk n with CounterNonces.
+func counterNonce(n uint64) [24]byte {
+	var nonce [24]byte
+	binary.LittleEndian.PutUint64(nonce[:], n)
+	return nonce
+}
+
+// seal seals the i'th pending chunk in place, into the spare capacity of its
+// buffer.
+func (w *EncWriter) seal(i int) {
+	aad := w.config.aad
+	if w.config.indexed {
+		aad = w.aads[i]
+	}
+	w.pending[i] = w.aead.Seal(w.pending[i][:0], w.nonces[i][:w.aead.NonceSize()], w.pending[i], aad)
+}
+
+// indexedAAD returns the additional data of the chunk with index i, which
+// is the last of its stream if last, with WithIndexedChunks: aad, followed
+// by the index and whether it is the last.
+func indexedAAD(dst []byte, aad []byte, i uint64, last bool) []byte {
+	dst = append(dst[:0], aad...)
+	dst = binary.LittleEndian.AppendUint64(dst, i)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// indexedAADs fills aads, reusing its buffers, with the additional data of n
+// chunks from index first, the last of which ends the stream if last.
+func indexedAADs(aads [][]byte, aad []byte, first uint64, n int, last bool) [][]byte {
+	for len(aads) < n {
+		aads = append(aads, nil)
+	}
+	for i := 0; i < n; i++ {
+		aads[i] = indexedAAD(aads[i], aad, first+uint64(i), last && i == n-1)
+	}
+	return aads
+}
+
+// tagSize is the overhead of the AEADs enc uses. Chunk buffers have room for
+// it, so that chunks can be sealed and opened in place.
+const tagSize = 16
+
+// chunkPools holds a *sync.Pool of chunk buffers for each chunk size in use.
+var chunkPools sync.Map
+
+// chunkPool returns the pool of buffers for chunks of size bytes.
+func chunkPool(size int) *sync.Pool {
+	pool, ok := chunkPools.Load(size)
+	if !ok {
+		pool, _ = chunkPools.LoadOrStore(size, new(sync.Pool))
+	}
+	return pool.(*sync.Pool)
+}
+
+// getChunkBuffer returns an empty buffer with room for a sealed chunk of size
+// bytes of plaintext.
+func getChunkBuffer(size int) []byte {
+	if buf, ok := chunkPool(size).Get().(*[]byte); ok {
+		return (*buf)[:0]
+	}
+	return make([]byte, 0, size+tagSize)
+}
+
+// putChunkBuffer returns a buffer obtained from getChunkBuffer to the pool.
+func putChunkBuffer(size int, buf []byte) {
+	chunkPool(size).Put(&buf)
+}
+
+// parallel calls f for every index below n, each on its own goroutine.
+func parallel(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Read reads from the underlying io.Reader, decrypting bytes as needed, until
+// len(p) byte have been read or the underlying stream is exhausted.
+func (b *DecReader) Read(p []byte) (int, error) {
+	if b.config.limit >= 0 {
+		if b.read >= b.config.limit {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > b.config.limit-b.read {
+			p = p[:b.config.limit-b.read]
+		}
+	}
+	read := 0
+	defer func() { b.read += int64(read) }()
+	for i := range p {
+		if b.index == 0 {
+			err := b.nextChunk()
+			if err != nil {
+				return read, err
+			}
+		}
+		if b.read+int64(read) == b.config.maxSize {
+			return read, errPlaintextTooLarge
+		}
+		p[i] = b.buf[b.index]
+		b.index++
+		read++
+		if b.index >= len(b.buf) {
+			b.index = 0
+		}
+	}
+	return read, nil
+}
+
+// nextChunk moves the next chunk into DecReader's buf, opening up to
+// parallelism chunks at a time. Empty chunks are skipped.
+func (b *DecReader) nextChunk() error {
+	for {
+		if b.buf != nil {
+			b.free = append(b.free, b.buf[:0])
+			b.buf = nil
+		}
+		if len(b.opened) == 0 {
+			err := b.openChunks()
+			if err != nil {
+				return err
+			}
+		}
+		b.buf = b.opened[0]
+		n := copy(b.opened, b.opened[1:])
+		b.opened = b.opened[:n]
+		if len(b.buf) > 0 {
+			return nil
+		}
+	}
+}
+
+// buffered returns the number of plaintext bytes of the current chunk that
+// Read can return without reading from the underlying io.Reader.
+func (b *DecReader) buffered() int {
+	if b.index == 0 {
+		return 0
+	}
+	return len(b.buf) - b.index
+}
+
+// openChunks reads and opens up to parallelism chunks. Errors reading a
+// later chunk are returned once the chunks before it have been consumed.
+func (b *DecReader) openChunks() error {
+	if b.err != nil {
+		b.release()
+		return b.err
+	}
+	if b.aead == nil {
+		aead, err := b.config.newAEAD(b.secretKey[:])
+		if err != nil {
+			return err
+		}
+		b.aead = aead
+	}
+	b.nonces, b.sealed = b.nonces[:0], b.sealed[:0]
+	var readErr error
+	for len(b.sealed) < b.config.parallelism {
+		readErr = b.readChunk()
+		if readErr != nil {
+			break
+		}
+	}
+	if b.config.indexed && readErr == nil {
+		// the last chunk is the one the input ends after.
+		_, readErr = io.ReadFull(b.in, b.header[:])
+		b.ahead = readErr == nil
+	}
+	if b.config.indexed && readErr == io.EOF && len(b.sealed) == 0 && b.chunks == 0 && !b.config.unfinished {
+		// even an empty stream has a last chunk.
+		readErr = errNoLastChunk
+	}
+	b.err = readErr
+	if len(b.sealed) == 0 {
+		b.release()
+		return readErr
+	}
+	if b.config.indexed {
+		last := readErr == io.EOF && !b.config.unfinished
+		b.aads = indexedAADs(b.aads, b.config.aad, b.config.first+b.chunks, len(b.sealed), last)
+		b.chunks += uint64(len(b.sealed))
+	}
+	b.errs = append(b.errs[:0], make([]error, len(b.sealed))...)
+	if len(b.sealed) == 1 {
+		b.open(0)
+	} else {
+		parallel(len(b.sealed), b.open)
+	}
+	for i, err := range b.errs {
+		if err != nil {
+			b.err = err
+			return err
+		}
+		b.opened = append(b.opened, b.sealed[i])
+	}
+	return nil
+}
+
+// open opens the i'th chunk read ahead in place.
+func (b *DecReader) open(i int) {
+	aad := b.config.aad
+	if b.config.indexed {
+		aad = b.aads[i]
+	}
+	b.sealed[i], b.errs[i] = b.aead.Open(b.sealed[i][:0], b.nonces[i][:b.aead.NonceSize()], b.sealed[i], aad)
+}
+
+// release gives the buffers of a finished stream back to the pool.
+func (b *DecReader) release() {
+	for _, buf := range b.free {
+		putChunkBuffer(b.config.chunkSize, buf)
+	}
+	b.free = nil
+}
+
+// readChunk reads the nonce and sealed data of the next chunk.
+func (b *DecReader) readChunk() error {
+	if b.ahead {
+		b.ahead = false
+	} else {
+		_, err := io.ReadFull(b.in, b.header[:])
+		if err != nil {
+			return err
+		}
+	}
+	chunkSize := binary.LittleEndian.Uint64(b.header[24:])
+	if chunkSize > uint64(b.config.chunkSize+b.aead.Overhead()) {
+		return errors.New("chunk too large")
+	}
+	var chunkData []byte
+	if n := len(b.free); n > 0 {
+		chunkData = b.free[n-1]
+		b.free = b.free[:n-1]
+	} else {
+		chunkData = getChunkBuffer(b.config.chunkSize)
+	}
+	chunkData = append(chunkData, make([]byte, chunkSize)...)
+	_, err := io.ReadFull(b.in, chunkData)
+	if err != nil {
+		b.free = append(b.free, chunkData[:0])
+		return err
+	}
+	var nonce [24]byte
+	copy(nonce[:], b.header[:24])
+	if b.config.nonces == CounterNonces {
+		if nonce != counterNonce(b.count) {
+			b.free = append(b.free, chunkData[:0])
+			return errChunkOrder
+		}
+		b.count++
+	}
+	b.nonces = append(b.nonces, nonce)
+	b.sealed = append(b.sealed, chunkData)
+	return nil
+}
@@ -0,0 +1,439 @@
+package encstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// TestSecureBuffers verifies that data can be encrypted and decrypted at
+// various sizes using EncWriters and DecReaders.
+func TestSecureBuffers(t *testing.T) {
+	tests := []struct {
+		sourceData []byte
+	}{
+		{[]byte("this is a test")},
+		{make([]byte, maxChunkSize-1)},
+		{make([]byte, maxChunkSize+1)},
+		{make([]byte, maxChunkSize*10)},
+		{make([]byte, maxChunkSize)},
+		{func() []byte {
+			res := make([]byte, 300e6) // 300 mb
+			_, err := io.ReadFull(rand.Reader, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res
+		}()},
+	}
+	for _, test := range tests {
+		t.Log("testing with", len(test.sourceData), "B of data")
+		result := new(bytes.Buffer)
+		skb := make([]byte, 32)
+		_, err := rand.Read(skb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sk [32]byte
+		copy(sk[:], skb)
+		encWriter := NewWriter(sk, result)
+		if len(encWriter.buf) > maxChunkSize*3 { // there should never be more than 3 chunks buffered in memory
+			t.Fatal("encWriter is leaking chunks")
+		}
+		n, err := encWriter.Write(test.sourceData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(test.sourceData) {
+			t.Fatal("output was not the correct length got", n, "wanted", len(test.sourceData))
+		}
+		if !sufficientEntropy(result.Bytes()) {
+			t.Fatal("resulting output was not uniformly random")
+		}
+		if nonceReuse(result.Bytes()) {
+			t.Fatal("resulting ciphertext has re-used nonces!")
+		}
+		decReader := NewReader(sk, result)
+		decryptedData := make([]byte, len(test.sourceData))
+		_, err = decReader.Read(decryptedData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decReader.buf) > maxChunkSize*3 { // there should never be more than 3 chunks buffered in memory
+			t.Fatal("decReader is leaking chunks")
+		}
+		if !bytes.Equal(decryptedData, test.sourceData) {
+			t.Fatal("data decrypt mismatch got", decryptedData, "wanted", test.sourceData)
+		}
+	}
+}
+
+func nonceReuse(ciphertext []byte) bool {
+	buf := bytes.NewBuffer(ciphertext)
+	seenNonces := make(map[[sha256.Size]byte]struct{})
+	for {
+		var nonce [24]byte
+		_, err := buf.Read(nonce[:])
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			panic(err)
+		}
+		sum := sha256.Sum256(nonce[:])
+		if _, seen := seenNonces[sum]; seen {
+			return true
+		}
+		seenNonces[sum] = struct{}{}
+		var chunkSize uint64
+		err = binary.Read(buf, binary.LittleEndian, &chunkSize)
+		if err != nil {
+			panic(err)
+		}
+		chunk := make([]byte, chunkSize)
+		_, err = buf.Read(chunk)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return false
+}
+
+func sufficientEntropy(data []byte) bool {
+	b := new(bytes.Buffer)
+	zip, _ := gzip.NewWriterLevel(b, gzip.BestCompression)
+	if _, err := zip.Write(data); err != nil {
+		panic(err)
+	}
+	if err := zip.Close(); err != nil {
+		panic(err)
+	}
+	if b.Len() < len(data) {
+		return false
+	}
+	return true
+}
+
+// TestDedupWriter verifies that content-defined chunking realigns after an
+// insertion, so that most chunks of two versions of the same data encrypt
+// identically, and that the output decrypts with a regular DecReader.
+func TestDedupWriter(t *testing.T) {
+	var sk [32]byte
+	_, err := rand.Read(sk[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := make([]byte, maxChunkSize*64)
+	_, err = rand.Read(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := append(append(append([]byte{}, original[:1000]...), []byte("inserted")...), original[1000:]...)
+
+	encrypt := func(data []byte, writeSize int) []byte {
+		result := new(bytes.Buffer)
+		w := NewDedupWriter(sk, result)
+		for len(data) > 0 {
+			n := writeSize
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return result.Bytes()
+	}
+	ciphertext := encrypt(original, 32768)
+	if !bytes.Equal(ciphertext, encrypt(original, 1000)) {
+		t.Fatal("chunk boundaries depend on the size of writes")
+	}
+
+	chunks := func(ciphertext []byte) map[string]struct{} {
+		res := make(map[string]struct{})
+		for len(ciphertext) > 0 {
+			size := binary.LittleEndian.Uint64(ciphertext[24:32])
+			res[string(ciphertext[:32+size])] = struct{}{}
+			ciphertext = ciphertext[32+size:]
+		}
+		return res
+	}
+	originalChunks := chunks(ciphertext)
+	modifiedChunks := chunks(encrypt(modified, 32768))
+	shared := 0
+	for c := range modifiedChunks {
+		if _, ok := originalChunks[c]; ok {
+			shared++
+		}
+	}
+	if shared < len(originalChunks)-2 {
+		t.Fatal("only", shared, "of", len(originalChunks), "chunks were shared after a small insertion")
+	}
+
+	decrypted := new(bytes.Buffer)
+	if _, err := io.Copy(decrypted, NewReader(sk, bytes.NewReader(ciphertext))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), original) {
+		t.Fatal("data decrypt mismatch")
+	}
+}
+
+// TestStreamOptions verifies that streams written with options round-trip,
+// that parallelism does not change the chunks written, and that a reader
+// needs the same AAD and a large enough chunk size.
+func TestStreamOptions(t *testing.T) {
+	var sk [32]byte
+	_, err := rand.Read(sk[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	_, err = rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := []byte("file 1")
+
+	encrypt := func(opts ...StreamOption) []byte {
+		result := new(bytes.Buffer)
+		w := NewWriter(sk, result, opts...)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return result.Bytes()
+	}
+	decrypt := func(ciphertext []byte, opts ...StreamOption) ([]byte, error) {
+		return ioutil.ReadAll(NewReader(sk, bytes.NewReader(ciphertext), opts...))
+	}
+
+	tests := [][]StreamOption{
+		{WithAAD(aad)},
+		{WithAAD(aad), WithChunkSize(1000)},
+		{WithAAD(aad), WithChunkSize(1000), WithParallelism(4)},
+		{WithAAD(aad), WithAEAD(newGCM), WithParallelism(3)},
+		{WithAAD(aad), WithNonceStrategy(SyntheticNonces)},
+	}
+	for i, opts := range tests {
+		ciphertext := encrypt(opts...)
+		decrypted, err := decrypt(ciphertext, opts...)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Fatal(i, "data decrypt mismatch")
+		}
+		parallelDecrypted, err := decrypt(ciphertext, append(opts, WithParallelism(5))...)
+		if err != nil || !bytes.Equal(parallelDecrypted, data) {
+			t.Fatal(i, "parallel decryption failed", err)
+		}
+		if _, err := decrypt(ciphertext, append(opts, WithAAD([]byte("file 2")))...); err == nil {
+			t.Fatal(i, "decrypted with the wrong AAD")
+		}
+	}
+
+	synthetic := encrypt(WithNonceStrategy(SyntheticNonces), WithChunkSize(1000))
+	if !bytes.Equal(synthetic, encrypt(WithNonceStrategy(SyntheticNonces), WithChunkSize(1000), WithParallelism(8))) {
+		t.Fatal("parallelism changed the chunks written")
+	}
+	if _, err := decrypt(encrypt(WithChunkSize(maxChunkSize * 2))); err == nil {
+		t.Fatal("a chunk larger than the reader's chunk size was accepted")
+	}
+}
+
+// TestStreamAllocations verifies that, once a stream is under way, writing and
+// reading further chunks does not allocate.
+func TestStreamAllocations(t *testing.T) {
+	var sk [32]byte
+	data := make([]byte, maxChunkSize*4)
+	ciphertext := new(bytes.Buffer)
+	w := NewWriter(sk, ciphertext)
+	ciphertext.Grow(len(data) * 200)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { w.Write(data) }); allocs > 0 {
+		t.Fatal("writing", len(data), "bytes made", allocs, "allocations")
+	}
+
+	r := NewReader(sk, bytes.NewReader(ciphertext.Bytes()))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { io.ReadFull(r, buf) }); allocs > 0 {
+		t.Fatal("reading", len(data), "bytes made", allocs, "allocations")
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	var sk [32]byte
+	data := make([]byte, maxChunkSize*64)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := NewWriter(sk, ioutil.Discard)
+		w.Write(data)
+		w.Close()
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	var sk [32]byte
+	data := make([]byte, maxChunkSize*64)
+	ciphertext := new(bytes.Buffer)
+	w := NewWriter(sk, ciphertext)
+	w.Write(data)
+	w.Close()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		io.Copy(ioutil.Discard, NewReader(sk, bytes.NewReader(ciphertext.Bytes())))
+	}
+}
+
+// writeCounter counts the Write calls made to it.
+type writeCounter struct {
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+// TestBufferedFrames verifies that the frames of the chunks sealed by a Write
+// reach the underlying writer in a single call.
+func TestBufferedFrames(t *testing.T) {
+	var sk [32]byte
+	out := new(writeCounter)
+	w := NewWriter(sk, out)
+	if _, err := w.Write(make([]byte, maxChunkSize*4)); err != nil {
+		t.Fatal(err)
+	}
+	if out.writes != 1 {
+		t.Fatal("writing four chunks made", out.writes, "writes")
+	}
+	out.writes = 0
+	d := NewDedupWriter(sk, out)
+	if _, err := d.Write(make([]byte, maxChunkSize*3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.writes != 1 {
+		t.Fatal("writing three chunks made", out.writes, "writes")
+	}
+}
+
+// TestCounterNonces verifies that a stream written with CounterNonces is read
+// back, and that reordered, replayed or dropped chunks are refused. Empty
+// chunks are skipped.
+func TestCounterNonces(t *testing.T) {
+	var sk [32]byte
+	stream := new(bytes.Buffer)
+	w := NewWriter(sk, stream, WithNonceStrategy(CounterNonces), WithChunkSize(1000))
+	var chunks [][]byte
+	for _, size := range []int{1000, 0, 1000, 500} {
+		before := stream.Len()
+		if _, err := w.Write(bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), stream.Bytes()[before:]...))
+	}
+	read := func(order ...int) ([]byte, error) {
+		var ciphertext []byte
+		for _, i := range order {
+			ciphertext = append(ciphertext, chunks[i]...)
+		}
+		return ioutil.ReadAll(NewReader(sk, bytes.NewReader(ciphertext), WithNonceStrategy(CounterNonces), WithChunkSize(1000)))
+	}
+	plaintext, err := read(0, 1, 2, 3)
+	if err != nil || len(plaintext) != 2500 {
+		t.Fatal("the stream was not read back", len(plaintext), err)
+	}
+	for _, order := range [][]int{{0, 2, 1, 3}, {0, 1, 1, 2}, {0, 2, 3}} {
+		if _, err := read(order...); err != errChunkOrder {
+			t.Fatal(order, "expected errChunkOrder, got", err)
+		}
+	}
+}
+
+// TestIndexedChunks verifies that a stream written with WithIndexedChunks is
+// read back, that small writes still make full chunks, and that reordered,
+// dropped, truncated or extended streams are refused. An empty stream still
+// has its last chunk.
+func TestIndexedChunks(t *testing.T) {
+	var sk [32]byte
+	opts := []StreamOption{WithIndexedChunks(0), WithChunkSize(1000)}
+	stream := new(bytes.Buffer)
+	w := NewWriter(sk, stream, opts...)
+	for i := 0; i < 35; i++ {
+		if _, err := w.Write(bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	frame := 24 + 8 + 1000 + tagSize
+	if stream.Len() != 3*frame+24+8+500+tagSize {
+		t.Fatal("small writes made", stream.Len(), "bytes of chunks")
+	}
+	var chunks [][]byte
+	for b := stream.Bytes(); len(b) > 0; {
+		n := frame
+		if len(b) < n {
+			n = len(b)
+		}
+		chunks = append(chunks, b[:n])
+		b = b[n:]
+	}
+	read := func(order ...int) ([]byte, error) {
+		var ciphertext []byte
+		for _, i := range order {
+			ciphertext = append(ciphertext, chunks[i]...)
+		}
+		return ioutil.ReadAll(NewReader(sk, bytes.NewReader(ciphertext), opts...))
+	}
+	plaintext, err := read(0, 1, 2, 3)
+	if err != nil || len(plaintext) != 3500 {
+		t.Fatal("the stream was not read back", len(plaintext), err)
+	}
+	for _, order := range [][]int{{1, 0, 2, 3}, {0, 2, 3}, {0, 1, 2}, {0, 1, 2, 3, 3}, {}} {
+		if _, err := read(order...); err == nil {
+			t.Fatal(order, "was read back")
+		}
+	}
+	if _, err := ioutil.ReadAll(NewReader(sk, bytes.NewReader(stream.Bytes()), WithIndexedChunks(1), WithChunkSize(1000))); err == nil {
+		t.Fatal("the stream was read back from the wrong index")
+	}
+
+	empty := new(bytes.Buffer)
+	w = NewWriter(sk, empty, opts...)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if empty.Len() != 24+8+tagSize {
+		t.Fatal("an empty stream wrote", empty.Len(), "bytes")
+	}
+	if plaintext, err := ioutil.ReadAll(NewReader(sk, empty, opts...)); err != nil || len(plaintext) != 0 {
+		t.Fatal("the empty stream was not read back", err)
+	}
+	if _, err := ioutil.ReadAll(NewReader(sk, new(bytes.Buffer), opts...)); err != errNoLastChunk {
+		t.Fatal("expected errNoLastChunk, got", err)
+	}
+}
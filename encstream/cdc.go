@@ -0,0 +1,82 @@
+package encstream
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Content-defined chunking places chunk boundaries where a rolling hash of the
+// plaintext matches a pattern, rather than every maxChunkSize bytes. An
+// insertion or deletion then only changes the chunks around it, and the
+// chunks after it realign with those of the previous version.
+//
+// Each chunk is sealed under a nonce derived from its own contents (a
+// synthetic nonce), so the same chunk encrypted under the same key always
+// produces the same ciphertext, which dedup-aware storage can collapse. This is
+// convergent encryption keyed with the file key: only holders of the key can
+// confirm the contents of a chunk. The rolling hash is keyed too, so chunk
+// boundaries do not leak information about the plaintext.
+
+const (
+	minCDCChunkSize = 2048
+	cdcMask         = 1<<13 - 1 // boundaries every 8kb on average
+)
+
+// chunker finds content-defined chunk boundaries using a keyed gear hash, and
+// derives synthetic nonces for the chunks.
+type chunker struct {
+	gear     [256]uint64
+	hash     uint64
+	nonceKey [32]byte
+	maxSize  int
+}
+
+// newChunker derives a chunker from secretKey, for chunks of at most maxSize
+// bytes.
+func newChunker(secretKey [32]byte, maxSize int) *chunker {
+	c := &chunker{
+		nonceKey: subkey(secretKey, "enc cdc nonce"),
+		maxSize:  maxSize,
+	}
+	gearKey := subkey(secretKey, "enc cdc gear")
+	for i := range c.gear {
+		sum := blake2b.Sum256(append(gearKey[:], byte(i)))
+		c.gear[i] = binary.LittleEndian.Uint64(sum[:])
+	}
+	return c
+}
+
+// subkey derives an independent key for the given purpose from secretKey.
+func subkey(secretKey [32]byte, purpose string) [32]byte {
+	hash, err := blake2b.New256(secretKey[:])
+	if err != nil {
+		panic(err)
+	}
+	hash.Write([]byte(purpose))
+	var k [32]byte
+	copy(k[:], hash.Sum(nil))
+	return k
+}
+
+// boundary feeds b into the rolling hash and reports whether a chunk of size
+// bytes, ending with b, should end here.
+func (c *chunker) boundary(b byte, size int) bool {
+	c.hash = c.hash<<1 + c.gear[b]
+	if size < minCDCChunkSize {
+		return false
+	}
+	return size >= c.maxSize || c.hash&cdcMask == 0
+}
+
+// nonce returns the synthetic nonce for a chunk with the given plaintext.
+func (c *chunker) nonce(plaintext []byte) [24]byte {
+	hash, err := blake2b.New(24, c.nonceKey[:])
+	if err != nil {
+		panic(err)
+	}
+	hash.Write(plaintext)
+	var nonce [24]byte
+	copy(nonce[:], hash.Sum(nil))
+	return nonce
+}
@@ -0,0 +1,287 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Channels reuse enc's chunk framing to secure live connections rather than
+// files. The ends authenticate with X25519 static keys in a Noise handshake
+// (see noise.go), and then each direction is a chunk stream, as written by an
+// EncWriter, under its own key. Chunks are numbered with CounterNonces, so
+// that they cannot be reordered, replayed or dropped, and the key of each
+// direction is replaced by a hash of itself every rekey interval, so that a
+// key taken from a long-lived connection does not expose what was sent
+// before. As with TCP, a connection cut between chunks looks like the other
+// end closing it: protocols that need to tell the two apart should end their
+// messages themselves.
+//
+// The client first sends a line naming the handshake, "enc channel 1 XX" or
+// "enc channel 1 IK", which is also the prologue of the handshake.
+
+const (
+	channelHello = "enc channel 1"
+
+	defaultRekeyInterval = 1 << 28
+)
+
+var (
+	errChannelHello = errors.New("the client did not start a channel handshake")
+	errChannelPeer  = errors.New("the other end of the channel has an unexpected key")
+)
+
+// channelConfig holds the settings of a Channel.
+type channelConfig struct {
+	static   *identity
+	peer     *recipient
+	verify   func(peerKey [32]byte) error
+	interval int64
+}
+
+// ChannelOption configures a Channel.
+type ChannelOption func(*channelConfig)
+
+// WithStaticKey sets the X25519 secret key that a Channel authenticates
+// with. Without it, a random key is used for the connection.
+func WithStaticKey(secretKey [32]byte) ChannelOption {
+	return func(c *channelConfig) {
+		id := identity{secret: secretKey}
+		curve25519.ScalarBaseMult((*[32]byte)(&id.public), &id.secret)
+		c.static = &id
+	}
+}
+
+// WithPeerKey makes a Channel refuse another end whose X25519 public key is
+// not publicKey. A client that knows the server's key this way uses the IK
+// handshake, which sends its own key encrypted to the server in the first
+// message rather than after a round trip.
+func WithPeerKey(publicKey [32]byte) ChannelOption {
+	return func(c *channelConfig) {
+		peer := recipient(publicKey)
+		c.peer = &peer
+	}
+}
+
+// WithPeerVerifier calls verify with the public key of the other end once the
+// handshake has authenticated it, and refuses the connection if it returns an
+// error.
+func WithPeerVerifier(verify func(peerKey [32]byte) error) ChannelOption {
+	return func(c *channelConfig) {
+		c.verify = verify
+	}
+}
+
+// WithRekeyInterval sets the number of bytes sent in each direction under a
+// key before it is replaced. Both ends must use the same interval. The
+// default is 256MB.
+func WithRekeyInterval(n int64) ChannelOption {
+	return func(c *channelConfig) {
+		if n > 0 {
+			c.interval = n
+		}
+	}
+}
+
+// Channel is a net.Conn whose data is encrypted and authenticated with the
+// chunk framing of enc files, established by NewClientChannel or
+// NewServerChannel.
+type Channel struct {
+	net.Conn
+	peer     [32]byte
+	interval int64
+
+	writeMu  sync.Mutex
+	w        *EncWriter
+	writeKey [32]byte
+	written  int64 // under writeKey
+
+	readMu  sync.Mutex
+	r       *DecReader
+	readKey [32]byte
+	read    int64 // under readKey
+}
+
+// NewClientChannel runs the client side of the handshake over conn and
+// returns the channel on success.
+func NewClientChannel(conn net.Conn, opts ...ChannelOption) (*Channel, error) {
+	c, err := newChannelConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	pattern, rs := noiseXX, recipient{}
+	if c.peer != nil {
+		pattern, rs = noiseIK, *c.peer
+	}
+	hello := channelHello + " " + pattern.name
+	_, err = fmt.Fprintln(conn, hello)
+	if err != nil {
+		return nil, err
+	}
+	send, receive, peer, err := noiseHandshakeOver(conn, pattern, true, *c.static, rs, []byte(hello))
+	if err != nil {
+		return nil, err
+	}
+	return newChannel(conn, c, send, receive, peer)
+}
+
+// NewServerChannel runs the server side of the handshake over conn, with
+// either handshake, and returns the channel on success.
+func NewServerChannel(conn net.Conn, opts ...ChannelOption) (*Channel, error) {
+	c, err := newChannelConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	hello, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := strings.CutPrefix(hello, channelHello+" ")
+	var pattern noisePattern
+	switch {
+	case ok && name == noiseXX.name:
+		pattern = noiseXX
+	case ok && name == noiseIK.name:
+		pattern = noiseIK
+	default:
+		return nil, errChannelHello
+	}
+	send, receive, peer, err := noiseHandshakeOver(conn, pattern, false, *c.static, recipient{}, []byte(hello))
+	if err != nil {
+		return nil, err
+	}
+	return newChannel(conn, c, send, receive, peer)
+}
+
+// newChannelConfig applies opts to the default settings, generating a static
+// key if none is given.
+func newChannelConfig(opts []ChannelOption) (channelConfig, error) {
+	c := channelConfig{interval: defaultRekeyInterval}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.static == nil {
+		id, err := generateIdentity()
+		if err != nil {
+			return c, err
+		}
+		c.static = &id
+	}
+	return c, nil
+}
+
+// newChannel checks the key of the other end and starts the session.
+func newChannel(conn net.Conn, c channelConfig, send, receive [32]byte, peer recipient) (*Channel, error) {
+	if c.peer != nil && *c.peer != peer {
+		return nil, errChannelPeer
+	}
+	if c.verify != nil {
+		err := c.verify(peer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ch := &Channel{
+		Conn:     conn,
+		peer:     peer,
+		interval: c.interval,
+		writeKey: send,
+		readKey:  receive,
+	}
+	ch.w = ch.newWriter()
+	ch.r = ch.newReader()
+	return ch, nil
+}
+
+// PeerKey returns the X25519 public key the other end authenticated with.
+func (ch *Channel) PeerKey() [32]byte {
+	return ch.peer
+}
+
+func (ch *Channel) newWriter() *EncWriter {
+	return NewWriter(ch.writeKey, ch.Conn, WithNonceStrategy(CounterNonces))
+}
+
+func (ch *Channel) newReader() *DecReader {
+	return NewReader(ch.readKey, ch.Conn, WithNonceStrategy(CounterNonces))
+}
+
+// nextChannelKey returns the key that replaces key.
+func nextChannelKey(key [32]byte) [32]byte {
+	h, _ := blake2b.New256(key[:])
+	h.Write([]byte("enc channel rekey"))
+	var next [32]byte
+	copy(next[:], h.Sum(nil))
+	return next
+}
+
+// Write encrypts p to the other end, sending it before returning.
+func (ch *Channel) Write(p []byte) (int, error) {
+	ch.writeMu.Lock()
+	defer ch.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if left := ch.interval - ch.written; int64(n) > left {
+			n = int(left)
+		}
+		m, err := ch.w.Write(p[:n])
+		written += m
+		ch.written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if ch.written == ch.interval {
+			ch.w.Close()
+			ch.writeKey = nextChannelKey(ch.writeKey)
+			ch.w = ch.newWriter()
+			ch.written = 0
+		}
+	}
+	return written, nil
+}
+
+// Read reads and decrypts data from the other end. Like a net.Conn, it
+// returns what has arrived rather than waiting to fill p.
+func (ch *Channel) Read(p []byte) (int, error) {
+	ch.readMu.Lock()
+	defer ch.readMu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if ch.read == ch.interval {
+		ch.readKey = nextChannelKey(ch.readKey)
+		ch.r = ch.newReader()
+		ch.read = 0
+	}
+	if left := ch.interval - ch.read; int64(len(p)) > left {
+		p = p[:left]
+	}
+	// only the first byte waits for a chunk to arrive.
+	n, err := ch.r.Read(p[:1])
+	if err == nil && len(p) > 1 {
+		more := ch.r.buffered()
+		if more > len(p)-1 {
+			more = len(p) - 1
+		}
+		var m int
+		m, err = ch.r.Read(p[1 : 1+more])
+		n += m
+	}
+	ch.read += int64(n)
+	return n, err
+}
+
+// CloseWrite closes the sending side of the connection, if it has one.
+func (ch *Channel) CloseWrite() error {
+	if c, ok := ch.Conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return ch.Conn.Close()
+}
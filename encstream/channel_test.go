@@ -0,0 +1,141 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// channelPair establishes a channel between a client and a server over TCP,
+// returning both ends or the errors of both sides.
+func channelPair(t *testing.T, clientOpts, serverOpts []ChannelOption) (client, server *Channel, clientErr, serverErr error) {
+	a, b := tcpPair(t)
+	servers := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = NewServerChannel(b, serverOpts...)
+		if err != nil {
+			b.Close()
+		}
+		servers <- err
+	}()
+	client, clientErr = NewClientChannel(a, clientOpts...)
+	if clientErr != nil {
+		a.Close()
+	}
+	serverErr = <-servers
+	return client, server, clientErr, serverErr
+}
+
+// TestChannel verifies that data sent over channels established with either
+// handshake arrives intact across rekeying, and that the ends learn each
+// other's keys.
+func TestChannel(t *testing.T) {
+	clientID, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ik := range []bool{false, true} {
+		clientOpts := []ChannelOption{WithStaticKey(clientID.secret), WithRekeyInterval(3000)}
+		if ik {
+			clientOpts = append(clientOpts, WithPeerKey(serverID.public))
+		}
+		serverOpts := []ChannelOption{WithStaticKey(serverID.secret), WithRekeyInterval(3000)}
+		client, server, clientErr, serverErr := channelPair(t, clientOpts, serverOpts)
+		if clientErr != nil || serverErr != nil {
+			t.Fatal("the handshake failed:", clientErr, serverErr)
+		}
+		if client.PeerKey() != serverID.public || server.PeerKey() != clientID.public {
+			t.Fatal("the ends did not learn each other's keys")
+		}
+
+		// a short message is returned as soon as it arrives.
+		if _, err := client.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1000)
+		n, err := server.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatal("expected hello, got", string(buf[:n]), err)
+		}
+
+		echoed := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(server, io.LimitReader(server, int64(len(data))))
+			echoed <- err
+		}()
+		go func() {
+			for i := 0; i < len(data); i += 7000 {
+				end := i + 7000
+				if end > len(data) {
+					end = len(data)
+				}
+				client.Write(data[i:end])
+			}
+		}()
+		received := make([]byte, len(data))
+		if _, err := io.ReadFull(client, received); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-echoed; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatal("the echoed data differs")
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// TestChannelRefused verifies that channels are refused when a key does not
+// match what an end expects.
+func TestChannelRefused(t *testing.T) {
+	serverID, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errRefused := errors.New("refused")
+
+	for i, c := range []struct {
+		clientOpts, serverOpts []ChannelOption
+	}{
+		// IK to a server with another key.
+		{[]ChannelOption{WithPeerKey(other.public)}, []ChannelOption{WithStaticKey(serverID.secret)}},
+		// XX to a server with another key.
+		{[]ChannelOption{WithPeerVerifier(func(key [32]byte) error {
+			if key != other.public {
+				return errRefused
+			}
+			return nil
+		})}, []ChannelOption{WithStaticKey(serverID.secret)}},
+		// a server that only accepts another client.
+		{nil, []ChannelOption{WithPeerKey(other.public)}},
+	} {
+		client, server, clientErr, serverErr := channelPair(t, c.clientOpts, c.serverOpts)
+		if clientErr == nil && serverErr == nil {
+			t.Fatalf("case %v: the channel was established", i)
+		}
+		if client != nil {
+			client.Close()
+		}
+		if server != nil {
+			server.Close()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package encstream
+
+import (
+	"errors"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Chunks are encrypted with XChaCha20-Poly1305 by default, which is fast
+// everywhere and takes random nonces without limit. CPUs with AES and
+// carry-less multiplication instructions, AES-NI and PCLMULQDQ on x86 or the
+// crypto extensions on ARM, run AES-256-GCM faster still, so -cipher auto
+// picks it on those. The choice is recorded in the header as the AES-GCM
+// suite, so decryption never has to guess, and files in it decrypt on any
+// CPU, only more slowly.
+
+var (
+	errCipher     = errors.New("-cipher must be auto, xchacha20-poly1305 or aes-256-gcm")
+	errCipherFIPS = errors.New("-cipher cannot be combined with -fips, which always uses AES-256-GCM")
+)
+
+// parseCipher returns the cipher suite -cipher names.
+func parseCipher(name string) (uint8, error) {
+	switch name {
+	case "xchacha20-poly1305":
+		return suiteDefault, nil
+	case "aes-256-gcm":
+		return suiteAESGCM, nil
+	case "auto":
+		if hasAESHardware() {
+			return suiteAESGCM, nil
+		}
+		return suiteDefault, nil
+	}
+	return 0, errCipher
+}
+
+// hasAESHardware reports whether the CPU has the instructions that make
+// AES-256-GCM faster than XChaCha20-Poly1305.
+func hasAESHardware() bool {
+	return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ || cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+}
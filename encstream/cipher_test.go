@@ -0,0 +1,54 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestCipherSuite verifies that files encrypted with AES-256-GCM record the
+// AES-GCM suite in their header and decrypt as usual, with a passphrase or
+// recipients, and that -cipher auto follows the CPU.
+func TestCipherSuite(t *testing.T) {
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("galois "), 4000)
+	for _, tc := range []struct {
+		name string
+		opts encryptOptions
+		keys keySource
+	}{
+		{"passphrase", encryptOptions{suite: suiteAESGCM}, newPassphraseKeys([]byte("hunter2"))},
+		{"recipients", encryptOptions{suite: suiteAESGCM, recipients: []recipient{id.public}}, identityKeys{id}},
+		{"dedup", encryptOptions{suite: suiteAESGCM, dedup: true}, newPassphraseKeys([]byte("hunter2"))},
+	} {
+		output := new(memoryOutput)
+		if _, _, _, err := encryptTo([]byte("hunter2"), bytes.NewReader(plaintext), output, 0, tc.opts); err != nil {
+			t.Fatal(tc.name, err)
+		}
+		header, r, err := openCiphertext(tc.keys, bytes.NewReader(output.buf))
+		if err != nil {
+			t.Fatal(tc.name, err)
+		}
+		if header.Suite != suiteAESGCM {
+			t.Fatal(tc.name, "the AES-GCM suite was not recorded")
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Fatal(tc.name, "decryption resulted in a different plaintext:", err)
+		}
+	}
+
+	if _, _, _, err := encryptTo([]byte("hunter2"), bytes.NewReader(plaintext), new(memoryOutput), 0, encryptOptions{suite: suiteAESGCM, fips: true}); err != errCipherFIPS {
+		t.Fatal("expected errCipherFIPS, got", err)
+	}
+	suite, err := parseCipher("auto")
+	if err != nil || (suite == suiteAESGCM) != hasAESHardware() {
+		t.Fatal("auto picked suite", suite, err)
+	}
+	if _, err := parseCipher("rot13"); err != errCipher {
+		t.Fatal("expected errCipher, got", err)
+	}
+}
@@ -0,0 +1,108 @@
+package encstream
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// `enc clip` encrypts the contents of the system clipboard to an armored
+// string and puts it back on the clipboard, ready to be pasted into a chat or
+// an email, and `enc clip -d` reverses that. The clipboard is accessed
+// through the usual command line tools of each platform.
+
+var errNoClipboard = errors.New("no clipboard tool found; install wl-clipboard, xclip or xsel")
+
+// clipboardTool is a pair of commands that read and write the system
+// clipboard.
+type clipboardTool struct {
+	paste []string
+	copy  []string
+}
+
+// clipboardTools returns the clipboard tools for this platform, in order of
+// preference.
+func clipboardTools() []clipboardTool {
+	switch runtime.GOOS {
+	case "darwin":
+		return []clipboardTool{{paste: []string{"pbpaste"}, copy: []string{"pbcopy"}}}
+	case "windows":
+		return []clipboardTool{{
+			paste: []string{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"},
+			copy:  []string{"clip"},
+		}}
+	}
+	tools := []clipboardTool{
+		{paste: []string{"xclip", "-selection", "clipboard", "-o"}, copy: []string{"xclip", "-selection", "clipboard", "-i"}},
+		{paste: []string{"xsel", "--clipboard", "--output"}, copy: []string{"xsel", "--clipboard", "--input"}},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([]clipboardTool{{paste: []string{"wl-paste", "-n"}, copy: []string{"wl-copy"}}}, tools...)
+	}
+	return tools
+}
+
+// findClipboardTool returns the first clipboard tool that is installed.
+func findClipboardTool() (clipboardTool, error) {
+	for _, tool := range clipboardTools() {
+		if _, err := exec.LookPath(tool.paste[0]); err == nil {
+			return tool, nil
+		}
+	}
+	return clipboardTool{}, errNoClipboard
+}
+
+// readClipboard returns the contents of the system clipboard.
+func readClipboard() ([]byte, error) {
+	tool, err := findClipboardTool()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(tool.paste[0], tool.paste[1:]...).Output()
+}
+
+// writeClipboard replaces the contents of the system clipboard with b.
+func writeClipboard(b []byte) error {
+	tool, err := findClipboardTool()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(tool.copy[0], tool.copy[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	return cmd.Run()
+}
+
+// encryptText encrypts plaintext to an armored string.
+func encryptText(passphrase []byte, plaintext []byte) (string, error) {
+	output := new(memoryOutput)
+	_, _, _, err := encryptTo(passphrase, bytes.NewReader(plaintext), output, 0, encryptOptions{})
+	if err != nil {
+		return "", err
+	}
+	armored := new(strings.Builder)
+	err = writeArmor(armored, bytes.NewReader(output.buf), nil)
+	return armored.String(), err
+}
+
+// decryptText decrypts an armored string.
+func decryptText(keys keySource, text string) ([]byte, error) {
+	ciphertext := new(bytes.Buffer)
+	fields, err := readArmor(ciphertext, strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(ciphertext.Bytes())
+	err = checkArmorHeaders(fields, r)
+	if err != nil {
+		return nil, err
+	}
+	_, plaintext, err := openCiphertext(keys, r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(plaintext)
+}
@@ -0,0 +1,29 @@
+package encstream
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestMemoryOutput verifies that memoryOutput supports going back to fill in
+// a field, the way encrypt fills in the MAC.
+func TestMemoryOutput(t *testing.T) {
+	m := new(memoryOutput)
+	m.Write([]byte("header...."))
+	m.Write([]byte("body"))
+	if _, err := m.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	m.Write([]byte("MAC!"))
+	if _, err := m.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	m.Write([]byte("."))
+	if !bytes.Equal(m.buf, []byte("headerMAC!body.")) {
+		t.Fatalf("got %q", m.buf)
+	}
+	if _, err := m.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("negative seek was allowed")
+	}
+}
@@ -0,0 +1,253 @@
+package encstream
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// The completion scripts complete the subcommands of enc and the paths of
+// encrypted files. Flags are completed from the output of `enc [command] -h`
+// when they are needed, so that the scripts do not go stale as flags are
+// added. Recipients and identities are files, so -r and -i complete paths,
+// and -R completes the names in the keyring.
+
+// completionShells are the shells `enc completion` writes scripts for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// pathFlags are the flags whose values are paths.
+var pathFlags = []string{"-o", "-dest", "-r", "-i", "-since", "-dedup-with", "-passphrase-file", "-signer", "-sign", "-require-signer", "-add-recipient", "-remove-recipient", "-hide", "-hide-passphrase-file", "-owner-map", "-group-map", "-exclude-from", "-env", "-repo"}
+
+// subcommandWords are the words that follow the commands that take one.
+var subcommandWords = map[string][]string{
+	"completion": completionShells,
+	"config":     {settingDefaultIdentity},
+	"identity":   {"change-pass", "signer-key"},
+	"k8s":        {"seal", "unseal"},
+	"cred":       {"store", "load", "serve"},
+	"keyring":    {"list", "add", "remove", "export", "import"},
+	"repo":       {"init", "backup", "snapshots", "restore", "forget", "prune", "check"},
+}
+
+// encryptedInputs are the subcommands whose arguments are encrypted files.
+var encryptedInputs = []string{"decrypt", "list", "ls", "verify", "diff", "grep", "inspect", "repair", "restore", "dotenv"}
+
+func init() {
+	// registered here rather than listed in commands, which the scripts
+	// are generated from, to avoid an initialization cycle.
+	commands = append(commands, command{"completion", "write a shell completion script for bash, zsh or fish", completionMain})
+}
+
+// completionMain implements `enc completion`, which writes a completion
+// script for a shell to stdout.
+func completionMain(args []string) {
+	fs := newFlagSet("completion",
+		"enc completion bash > /etc/bash_completion.d/enc",
+		"enc completion zsh > \"${fpath[1]}/_enc\"",
+		"enc completion fish > ~/.config/fish/completions/enc.fish")
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	err := writeCompletion(os.Stdout, positional[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeCompletion writes the completion script for shell to w.
+func writeCompletion(w io.Writer, shell string) error {
+	t, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("no completion for %q, only for %v", shell, strings.Join(completionShells, ", "))
+	}
+	type summary struct{ Name, Summary string }
+	var summaries []summary
+	var names []string
+	for _, c := range commands {
+		summaries = append(summaries, summary{c.name, c.summary})
+		names = append(names, c.name)
+	}
+	subcommands := make(map[string]string)
+	for c, words := range subcommandWords {
+		subcommands[c] = strings.Join(words, " ")
+	}
+	return t.Execute(w, map[string]interface{}{
+		"Commands":        summaries,
+		"Names":           strings.Join(append(names, "help"), " "),
+		"Subcommands":     subcommands,
+		"PathFlags":       pathFlags,
+		"EncryptedInputs": encryptedInputs,
+	})
+}
+
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# bash completion for enc
+
+_enc() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	local cmd=${COMP_WORDS[1]}
+	COMPREPLY=()
+	if [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY=($(compgen -W "{{.Names}}" -- "$cur"))
+		return
+	fi
+	case $cmd in
+	help)
+		[[ $COMP_CWORD -eq 2 ]] && COMPREPLY=($(compgen -W "{{.Names}}" -- "$cur"))
+		return
+		;;
+{{- range $c, $words := .Subcommands}}
+	{{$c}})
+		if [[ $COMP_CWORD -eq 2 ]]; then
+			COMPREPLY=($(compgen -W "{{$words}}" -- "$cur"))
+			return
+		fi
+		;;
+{{- end}}
+	esac
+	case $prev in
+	-R)
+		COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" keyring list 2>/dev/null | cut -d' ' -f1)" -- "$cur"))
+		return
+		;;
+	{{range $i, $f := .PathFlags}}{{if $i}}|{{end}}{{$f}}{{end}})
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	esac
+	local help
+	help=$("${COMP_WORDS[0]}" "$cmd" -h 2>&1)
+	if [[ $prev == -* ]] && grep -q -- "^  $prev [a-z]" <<<"$help"; then
+		# the flag takes a value that is not a path.
+		return
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$(sed -n 's/^  \(-[a-z-]*\).*/\1/p' <<<"$help")" -- "$cur"))
+		return
+	fi
+	case $cmd in
+	{{range $i, $c := .EncryptedInputs}}{{if $i}}|{{end}}{{$c}}{{end}})
+		COMPREPLY=($(compgen -f -X '!*.enc*' -- "$cur") $(compgen -d -- "$cur"))
+		;;
+	*)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		;;
+	esac
+}
+
+complete -o filenames -F _enc enc
+`)),
+
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef enc
+
+_enc() {
+	local -a commands
+	commands=(
+{{- range .Commands}}
+		'{{.Name}}:{{.Summary}}'
+{{- end}}
+		'help:show the flags of a command'
+	)
+	if (( CURRENT == 2 )); then
+		_describe 'command' commands
+		return
+	fi
+	local cmd=${words[2]} prev=${words[CURRENT-1]}
+	case $cmd in
+	help)
+		(( CURRENT == 3 )) && _describe 'command' commands
+		return
+		;;
+{{- range $c, $words := .Subcommands}}
+	{{$c}})
+		if (( CURRENT == 3 )); then
+			compadd {{$words}}
+			return
+		fi
+		;;
+{{- end}}
+	esac
+	case $prev in
+	-R)
+		compadd -- ${(f)"$(${words[1]} keyring list 2>/dev/null | cut -d' ' -f1)"}
+		return
+		;;
+	{{range $i, $f := .PathFlags}}{{if $i}}|{{end}}{{$f}}{{end}})
+		_files
+		return
+		;;
+	esac
+	local help
+	help=$(${words[1]} $cmd -h 2>&1)
+	if [[ $prev == -* ]] && print -r -- "$help" | grep -q -- "^  $prev [a-z]"; then
+		# the flag takes a value that is not a path.
+		return
+	fi
+	if [[ ${words[CURRENT]} == -* ]]; then
+		local -a flags
+		flags=(${(f)"$(print -r -- "$help" | sed -n 's/^  \(-[a-z-]*\).*/\1/p')"})
+		compadd -a flags
+		return
+	fi
+	case $cmd in
+	{{range $i, $c := .EncryptedInputs}}{{if $i}}|{{end}}{{$c}}{{end}})
+		_files -g '*.enc*'
+		;;
+	*)
+		_files
+		;;
+	esac
+}
+
+if [[ $funcstack[1] == _enc ]]; then
+	_enc "$@"
+else
+	compdef _enc enc
+fi
+`)),
+
+	"fish": template.Must(template.New("fish").Parse(`# fish completion for enc
+
+function __enc_flags
+	set -l words (commandline -opc)
+	$words[1] $words[2] -h 2>&1 | string match -r '^  -[a-z-]+' | string trim
+end
+
+function __enc_wants_path
+	set -l words (commandline -opc)
+	contains -- $words[-1]{{range .PathFlags}} {{.}}{{end}}
+end
+
+function __enc_wants_name
+	set -l words (commandline -opc)
+	test "$words[-1]" = -R
+end
+
+function __enc_subcommand_of
+	set -l words (commandline -opc)
+	test (count $words) -eq 2; and test "$words[2]" = $argv[1]
+end
+
+complete -c enc -f
+{{- range .Commands}}
+complete -c enc -n __fish_use_subcommand -a {{.Name}} -d '{{.Summary}}'
+{{- end}}
+complete -c enc -n __fish_use_subcommand -a help -d 'show the flags of a command'
+complete -c enc -n '__fish_seen_subcommand_from help' -a '{{.Names}}'
+{{- range $c, $words := .Subcommands}}
+complete -c enc -n '__enc_subcommand_of {{$c}}' -a '{{$words}}'
+{{- end}}
+complete -c enc -n __enc_wants_name -a '(enc keyring list 2>/dev/null | string split -f1 " ")'
+complete -c enc -n 'not __fish_use_subcommand; and string match -q -- "-*" (commandline -ct)' -a '(__enc_flags)'
+complete -c enc -n __enc_wants_path -F
+complete -c enc -n '__fish_seen_subcommand_from{{range .EncryptedInputs}} {{.}}{{end}}' -a '(__fish_complete_suffix .enc)'
+complete -c enc -n 'not __fish_use_subcommand; and not __fish_seen_subcommand_from{{range .EncryptedInputs}} {{.}}{{end}} help completion' -F
+`)),
+}
@@ -0,0 +1,36 @@
+package encstream
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestCompletion verifies that the completion scripts cover every subcommand
+// and that the ones for shells that are installed parse.
+func TestCompletion(t *testing.T) {
+	for _, shell := range completionShells {
+		var script bytes.Buffer
+		err := writeCompletion(&script, shell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range commands {
+			if !strings.Contains(script.String(), c.name) {
+				t.Fatal("the", shell, "completion does not cover", c.name)
+			}
+		}
+		if _, err := exec.LookPath(shell); err != nil {
+			continue
+		}
+		check := exec.Command(shell, "-n")
+		check.Stdin = &script
+		if out, err := check.CombinedOutput(); err != nil {
+			t.Fatal("the", shell, "completion does not parse:", err, string(out))
+		}
+	}
+	if writeCompletion(new(bytes.Buffer), "tcsh") == nil {
+		t.Fatal("a completion was written for an unknown shell")
+	}
+}
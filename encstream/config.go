@@ -0,0 +1,271 @@
+package encstream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Settings are kept in a config file, enc/config in the user's configuration
+// directory unless $ENC_CONFIG names another file, with a setting and its
+// value on every line:
+//
+//	default-identity /home/alice/.config/enc/alice.key
+//
+// With a default identity, encrypting without recipients encrypts to its
+// public key rather than asking for a passphrase, and decrypting without -i
+// decrypts files encrypted to recipients with it.
+
+const settingDefaultIdentity = "default-identity"
+
+// configSettings are the settings the config file can hold.
+var configSettings = map[string]bool{
+	settingDefaultIdentity: true,
+	settingCacheKeys:       true,
+	settingMaxKDFMemory:    true,
+	settingMaxKDFTime:      true,
+}
+
+var errConfigSetting = errors.New("unknown setting; see enc config -h")
+
+// config holds the settings of the config file.
+type config map[string]string
+
+// configDir returns the directory enc keeps its files in.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "enc"), nil
+}
+
+// configPath returns the path of the config file.
+func configPath() (string, error) {
+	if path := os.Getenv("ENC_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config"), nil
+}
+
+// readConfig reads the config file, which is empty if it does not exist.
+func readConfig() (config, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return c, nil
+}
+
+// parseConfig parses the settings of a config file.
+func parseConfig(r io.Reader) (config, error) {
+	c := make(config)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		setting, value, _ := strings.Cut(text, " ")
+		if !configSettings[setting] {
+			return nil, fmt.Errorf("line %v: unknown setting %q", line, setting)
+		}
+		c[setting] = strings.TrimSpace(value)
+	}
+	return c, scanner.Err()
+}
+
+// encode returns the text form of c.
+func (c config) encode() string {
+	var settings []string
+	for setting := range c {
+		settings = append(settings, setting)
+	}
+	sort.Strings(settings)
+	var b strings.Builder
+	for _, setting := range settings {
+		fmt.Fprintf(&b, "%v %v\n", setting, c[setting])
+	}
+	return b.String()
+}
+
+// defaultIdentity returns the default identity file, or "" if there is none.
+// A leading ~ stands for the home directory.
+func (c config) defaultIdentity() string {
+	name := c[settingDefaultIdentity]
+	if rest, ok := strings.CutPrefix(name, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			name = filepath.Join(home, rest)
+		}
+	}
+	return name
+}
+
+// configMain implements `enc config`, which shows and changes settings.
+func configMain(args []string) {
+	fs := newFlagSet("config",
+		"enc config [setting]",
+		"enc config default-identity [identity file]",
+		"enc config cache-keys [duration]",
+		"enc config max-kdf-memory [size]",
+		"enc config max-kdf-time [passes]",
+		"enc config -unset [setting]")
+	unset := fs.Bool("unset", false, "remove the setting")
+	positional := parseArgs(fs, args)
+
+	c, err := readConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(positional) == 0 {
+		fmt.Print(c.encode())
+		return
+	}
+	setting := positional[0]
+	if !configSettings[setting] {
+		log.Fatal(errConfigSetting)
+	}
+	switch {
+	case *unset && len(positional) == 1:
+		delete(c, setting)
+	case len(positional) == 1:
+		fmt.Println(c[setting])
+		return
+	case len(positional) == 2 && !*unset:
+		value := positional[1]
+		if setting == settingDefaultIdentity {
+			// checked now rather than at every encryption.
+			if _, err := identityPublicKeys(value); err != nil {
+				log.Fatal(err)
+			}
+			if value, err = filepath.Abs(value); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if setting == settingCacheKeys {
+			if _, err := time.ParseDuration(value); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if setting == settingMaxKDFMemory {
+			if _, err := parseKDFMemoryLimit(value); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if setting == settingMaxKDFTime {
+			if _, err := parseKDFTimeLimit(value); err != nil {
+				log.Fatal(err)
+			}
+		}
+		c[setting] = value
+	default:
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	path, err := configPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writePrivateFile(path, c.encode(), true)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// encryptsToSelf reports whether cmd encrypts to the default identity, if
+// there is one: it is given no recipients and no passphrase, nor any of the
+// options that only work with passphrases.
+func (cmd *fileFlags) encryptsToSelf(fips bool) bool {
+	return !cmd.decryptMode && len(cmd.recipientArgs) == 0 && !cmd.usePassphrase &&
+		!cmd.hasPassphraseSource() && cmd.generated == nil &&
+		!cmd.qrMode && !cmd.rsyncable && cmd.dedupWith == "" && cmd.deniableSize == "" && !cmd.raw && !fips && cmd.vaultKey == ""
+}
+
+// defaultRecipients returns the public keys of the default identity, or nil
+// if there is none.
+func defaultRecipients() ([]string, error) {
+	c, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	name := c.defaultIdentity()
+	if name == "" {
+		return nil, nil
+	}
+	keys, err := identityPublicKeys(name)
+	if err != nil {
+		return nil, fmt.Errorf("the default identity: %v", err)
+	}
+	return keys, nil
+}
+
+// defaultIdentityKeys decrypts files encrypted to recipients with the
+// default identity, and other files with a passphrase. Which of the two is
+// needed is only known from the header, so neither is asked for before then,
+// and each only once.
+type defaultIdentityKeys struct {
+	prompts      *prompts
+	identityFile string
+	limits       resourceLimits
+	cache        time.Duration
+
+	passphrase keySource
+	ids        identityKeys
+}
+
+func (k *defaultIdentityKeys) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if header.Vault.Path != "" {
+		return sk, macKey, errNeedVault
+	}
+	if len(header.Recipients) == 0 {
+		if k.passphrase == nil && k.cache > 0 {
+			k.passphrase = &keyCache{prompts: k.prompts, limits: k.limits, timeout: k.cache}
+		}
+		if k.passphrase == nil {
+			k.passphrase = passphraseKeys{passphrase: k.prompts.passphrase(false), limits: k.limits}
+		}
+		return k.passphrase.fileKeys(header)
+	}
+	if k.ids == nil {
+		ids, err := readIdentities([]string{k.identityFile}, k.prompts.unlock)
+		if err != nil {
+			return sk, macKey, err
+		}
+		k.ids = ids
+	}
+	return k.ids.fileKeys(header)
+}
+
+func (k *defaultIdentityKeys) settle(header fileHeader, authenticated bool) {
+	if s, ok := k.passphrase.(settler); ok {
+		s.settle(header, authenticated)
+	}
+}
@@ -0,0 +1,99 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDefaultIdentity verifies that the config file names a default identity
+// whose public keys are read without unlocking it, and that files encrypted
+// to it or with a passphrase are both decrypted without -i.
+func TestDefaultIdentity(t *testing.T) {
+	c, err := parseConfig(strings.NewReader("# comment\n\ndefault-identity ~/me.key\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.encode() != "default-identity ~/me.key\n" {
+		t.Fatalf("wrong encoding %q", c.encode())
+	}
+	if home, err := os.UserHomeDir(); err == nil && c.defaultIdentity() != filepath.Join(home, "me.key") {
+		t.Fatal("~ was not expanded:", c.defaultIdentity())
+	}
+	if _, err := parseConfig(strings.NewReader("default-idnetity me.key\n")); err == nil {
+		t.Fatal("an unknown setting was accepted")
+	}
+
+	dir, err := ioutil.TempDir("", "enctest-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("ENC_CONFIG", os.Getenv("ENC_CONFIG"))
+	os.Setenv("ENC_CONFIG", filepath.Join(dir, "config"))
+
+	keys, err := defaultRecipients()
+	if err != nil || keys != nil {
+		t.Fatal("expected no default identity without a config file, got", keys, err)
+	}
+
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := identityFileContents([]identity{id}, []byte("identity passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "me.key")
+	passphraseFile := filepath.Join(dir, "passphrase")
+	for file, contents := range map[string]string{
+		name:                         contents,
+		passphraseFile:               "identity passphrase\n",
+		filepath.Join(dir, "config"): "default-identity " + name + "\n",
+	} {
+		if err := writePrivateFile(file, contents, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err = defaultRecipients()
+	if err != nil || len(keys) != 1 || keys[0] != id.public.String() {
+		t.Fatal("wrong default recipients", keys, err)
+	}
+
+	p := &prompts{passphraseFile: passphraseFile}
+	k, ok := p.keys(nil, defaultLimits()).(*defaultIdentityKeys)
+	if !ok {
+		t.Fatal("the default identity was not used to decrypt")
+	}
+	plaintext := []byte("attack at dawn")
+	for _, opts := range []encryptOptions{{recipients: []recipient{id.public}}, {}} {
+		var passphrase []byte
+		if opts.recipients == nil {
+			// the passphrase file unlocks the identity, and here
+			// decrypts the file as well.
+			passphrase = []byte("identity passphrase")
+		}
+		output := new(memoryOutput)
+		if _, _, _, err := encryptTo(passphrase, bytes.NewReader(plaintext), output, 0, opts); err != nil {
+			t.Fatal(err)
+		}
+		_, r, err := openCiphertext(k, bytes.NewReader(output.buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext")
+		}
+	}
+	if k.ids == nil || k.passphrase == nil {
+		t.Fatal("the identity and passphrase were not kept for later files")
+	}
+}
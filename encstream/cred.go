@@ -0,0 +1,281 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+)
+
+// enc cred stores the small secrets services need at startup, such as
+// database passwords and API tokens, encrypted to a key bound to the host,
+// in the manner of systemd-creds. The key is derived from a random secret
+// that enc creates on the first store, readable only by its owner, and the
+// machine ID, so that the stored credentials are useless on another machine,
+// or after the secret is removed. Each credential is labelled with its name,
+// so that one cannot be passed off as another by renaming its file.
+//
+// Services get credentials without plaintext on disk through systemd's
+// LoadCredential=: enc cred serve listens on a unix socket, and systemd,
+// given the socket as the path of a credential, connects to it and reads the
+// credential into the service's credentials directory, which is in memory.
+// The name of the credential is the last element of the abstract address
+// systemd binds its end of the connection to.
+//
+// enc does not use a TPM: the secret is as safe as the files only root can
+// read.
+
+// maxCredentialSize is the largest credential enc cred stores, as with
+// systemd.
+const maxCredentialSize = 1 << 20
+
+var (
+	errCredentialName = errors.New("credential names cannot be empty, start with - or ., or contain / or whitespace")
+	errCredentialSize = errors.New("credentials are at most 1MiB")
+	errCredentialPeer = errors.New("the connection is not from systemd's LoadCredential=")
+)
+
+// machineIDPath is the file holding the machine ID the host key is bound to.
+var machineIDPath = "/etc/machine-id"
+
+// credentialPaths returns the host secret and the directory credentials are
+// stored in: system-wide ones for root, and the user's otherwise.
+func credentialPaths() (secret string, dir string, err error) {
+	if os.Geteuid() == 0 {
+		return "/var/lib/enc/credential.secret", "/etc/enc/credstore", nil
+	}
+	config, err := configDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(config, "credential.secret"), filepath.Join(config, "credstore"), nil
+}
+
+// checkCredentialName checks that name can be stored as a credential.
+func checkCredentialName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/ \t\r\n") || strings.HasPrefix(name, "-") || strings.HasPrefix(name, ".") {
+		return errCredentialName
+	}
+	return nil
+}
+
+// credentialLabel returns the label of the credential stored under name.
+func credentialLabel(name string) string {
+	return "credential " + name
+}
+
+// hostIdentity returns the host-bound identity credentials are encrypted to,
+// derived from the secret in secretPath, which is created if create is set
+// and it does not exist.
+func hostIdentity(secretPath string, create bool) (identity, error) {
+	secret, err := ioutil.ReadFile(secretPath)
+	if os.IsNotExist(err) && create {
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return identity{}, err
+		}
+		err = os.MkdirAll(filepath.Dir(secretPath), 0700)
+		if err != nil {
+			return identity{}, err
+		}
+		err = writePrivateFile(secretPath, string(secret), false)
+	}
+	if err != nil {
+		return identity{}, err
+	}
+	machineID, err := ioutil.ReadFile(machineIDPath)
+	if err != nil && !os.IsNotExist(err) {
+		return identity{}, err
+	}
+	h, err := blake2b.New256(secret)
+	if err != nil {
+		return identity{}, err
+	}
+	h.Write([]byte("enc credential host key\x00"))
+	h.Write(bytes.TrimSpace(machineID))
+	var id identity
+	h.Sum(id.secret[:0])
+	curve25519.ScalarBaseMult((*[32]byte)(&id.public), &id.secret)
+	return id, nil
+}
+
+// storeCredential encrypts value to id and stores it in dir under name,
+// replacing any credential stored there before.
+func storeCredential(id identity, dir string, name string, value []byte) error {
+	err := checkCredentialName(name)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxCredentialSize {
+		return errCredentialSize
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	output := new(memoryOutput)
+	opts := encryptOptions{recipients: []recipient{id.public}, label: credentialLabel(name)}
+	_, _, _, err = encryptTo(nil, bytes.NewReader(value), output, 0, opts)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(filepath.Join(dir, name), string(output.buf), true)
+}
+
+// loadCredential decrypts the credential stored in dir under name with id.
+func loadCredential(id identity, dir string, name string) ([]byte, error) {
+	err := checkCredentialName(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, r, err := openCiphertext(identityKeys{id}, f)
+	if err != nil {
+		return nil, err
+	}
+	if header.Label != credentialLabel(name) {
+		return nil, fmt.Errorf("%v: the credential was stored under another name", name)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// peerCredentialName returns the name of the credential systemd asks for on
+// a connection, from the abstract address it binds its end to:
+// "\0<random>/unit/<unit>/<name>".
+func peerCredentialName(addr net.Addr) (string, error) {
+	if addr == nil {
+		return "", errCredentialPeer
+	}
+	fields := strings.Split(strings.TrimPrefix(addr.String(), "@"), "/")
+	if len(fields) != 4 || fields[1] != "unit" {
+		return "", errCredentialPeer
+	}
+	return fields[3], nil
+}
+
+// serveCredentials answers LoadCredential= requests made on l with the
+// credentials in dir, logging those it cannot answer to logger.
+func serveCredentials(l net.Listener, id identity, dir string, logger *log.Logger) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			name, err := peerCredentialName(conn.RemoteAddr())
+			if err == nil {
+				var value []byte
+				value, err = loadCredential(id, dir, name)
+				if err == nil {
+					_, err = conn.Write(value)
+				}
+			}
+			if err != nil {
+				logger.Print(err)
+			}
+		}()
+	}
+}
+
+// credMain implements `enc cred`, which stores credentials for services and
+// loads them.
+func credMain(args []string) {
+	fs := newFlagSet("cred",
+		"enc cred store [-d dir] name [file or -]",
+		"enc cred load [-d dir] [-o output] name",
+		"enc cred serve [-d dir] socket")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// prints the usage for -h
+		fs.Parse(args)
+		fs.Usage()
+		os.Exit(-1)
+	}
+	command := args[0]
+	secretPath, defaultDir, err := credentialPaths()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir := fs.String("d", defaultDir, "the directory credentials are stored in")
+	var output *string
+	if command == "load" {
+		output = fs.String("o", "-", "write the credential to this file instead of stdout")
+	}
+	positional := parseArgs(fs, args[1:])
+
+	switch {
+	case command == "store" && (len(positional) == 1 || len(positional) == 2):
+		input := io.Reader(os.Stdin)
+		if len(positional) == 2 && positional[1] != "-" {
+			f, err := os.Open(positional[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			input = f
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(input, maxCredentialSize+1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		id, err := hostIdentity(secretPath, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = storeCredential(id, *dir, positional[0], value)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case command == "load" && len(positional) == 1:
+		id, err := hostIdentity(secretPath, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		value, err := loadCredential(id, *dir, positional[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *output == "-" {
+			_, err = os.Stdout.Write(value)
+		} else {
+			err = writePrivateFile(*output, string(value), true)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case command == "serve" && len(positional) == 1:
+		id, err := hostIdentity(secretPath, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Remove(positional[0])
+		l, err := net.Listen("unix", positional[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		// only the owner, systemd for a system service, may connect.
+		err = os.Chmod(positional[0], 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Fatal(serveCredentials(l, id, *dir, log.New(os.Stderr, "", log.LstdFlags)))
+	default:
+		fs.Usage()
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,56 @@
+package encstream
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestServeCredentials verifies that enc cred serve answers connections made
+// as systemd's LoadCredential= makes them, and refuses others.
+func TestServeCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-cred-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeCredential(id, dir, "db", []byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "cred.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveCredentials(l, id, dir, log.New(ioutil.Discard, "", 0))
+
+	for _, c := range []struct {
+		local, value string
+	}{
+		{"@f3a1c2d4e5b60718/unit/app.service/db", "hunter2"},
+		{"@f3a1c2d4e5b60719/unit/app.service/api", ""},
+		{"", ""},
+	} {
+		var local *net.UnixAddr
+		if c.local != "" {
+			local = &net.UnixAddr{Name: c.local, Net: "unix"}
+		}
+		conn, err := net.DialUnix("unix", local, &net.UnixAddr{Name: socket, Net: "unix"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(value) != c.value {
+			t.Fatalf("%q: expected %q, got %q %v", c.local, c.value, value, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCredentials verifies that stored credentials load on the same host,
+// and not under another name or on another machine.
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-cred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { machineIDPath = path }(machineIDPath)
+	machineIDPath = filepath.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(machineIDPath, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, "lib", "credential.secret")
+	store := filepath.Join(dir, "credstore")
+
+	if _, err := hostIdentity(secret, false); !os.IsNotExist(err) {
+		t.Fatal("expected a missing secret, got", err)
+	}
+	id, err := hostIdentity(secret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := hostIdentity(secret, true); err != nil || again != id {
+		t.Fatal("the host key changed", err)
+	}
+	if info, err := os.Stat(secret); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("the secret is not private", err)
+	}
+
+	if err := storeCredential(id, store, "../db", []byte("x")); err != errCredentialName {
+		t.Fatal("expected errCredentialName, got", err)
+	}
+	if err := storeCredential(id, store, "db", make([]byte, maxCredentialSize+1)); err != errCredentialSize {
+		t.Fatal("expected errCredentialSize, got", err)
+	}
+	if err := storeCredential(id, store, "db", []byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := loadCredential(id, store, "db")
+	if err != nil || !bytes.Equal(value, []byte("hunter2")) {
+		t.Fatal("the credential did not load", string(value), err)
+	}
+
+	if err := os.Rename(filepath.Join(store, "db"), filepath.Join(store, "api")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCredential(id, store, "api"); err == nil {
+		t.Fatal("a renamed credential loaded")
+	}
+
+	if err := ioutil.WriteFile(machineIDPath, []byte("fedcba9876543210\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other, err := hostIdentity(secret, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCredential(other, store, "api"); err == nil {
+		t.Fatal("a credential loaded on another machine")
+	}
+}
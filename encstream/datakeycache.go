@@ -0,0 +1,184 @@
+package encstream
+
+import (
+	"sync"
+	"time"
+)
+
+// Envelope encryption with a KMS, such as Vault's transit engine, costs an
+// API call for each data key generated or unwrapped. Following the caching
+// model of the AWS Encryption SDK, a data key is kept in memory, and never
+// anywhere else, to encrypt further files and to decrypt the files encrypted
+// with it, within limits on its age and on how many files it encrypts, and
+// only so many data keys are kept. Each file's keys are still its own, a
+// subkey of the data key, so the limits bound how much a single data key
+// protects, and for how long it stays in memory, rather than nonce reuse.
+//
+// The AWS SDK also limits the bytes a data key encrypts, which enc does not:
+// a file's data key is picked when its header is written, before its size is
+// known.
+
+const (
+	defaultDataKeyMaxAge   = 5 * time.Minute
+	defaultDataKeyMaxFiles = 10000
+	defaultDataKeyCapacity = 100
+)
+
+// DataKeyCache bounds how the data keys of a KMS are cached. The zero value
+// gives the defaults.
+type DataKeyCache struct {
+	// MaxAge is how long a data key is used for new files and kept once
+	// unwrapped; 0 means five minutes, and a negative age turns caching
+	// off, so that every file has its own data key and decrypting it always
+	// asks the KMS.
+	MaxAge time.Duration
+	// MaxFiles is how many files a data key encrypts before another is
+	// generated; 0 means 10000.
+	MaxFiles int
+	// Capacity is how many data keys are kept, those used least recently
+	// being dropped first; 0 means 100.
+	Capacity int
+}
+
+// withDefaults returns c with its zero limits replaced by the defaults.
+func (c DataKeyCache) withDefaults() DataKeyCache {
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultDataKeyMaxAge
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = defaultDataKeyMaxFiles
+	}
+	if c.Capacity <= 0 {
+		c.Capacity = defaultDataKeyCapacity
+	}
+	return c
+}
+
+// cachedDataKey is a data key in plaintext and as wrapped by the KMS.
+type cachedDataKey struct {
+	plaintext  [32]byte
+	ciphertext string
+	created    time.Time
+	used       time.Time
+	files      int // encrypted with it
+}
+
+// dataKeyCache caches the data keys of a KMS within the limits of a
+// DataKeyCache. It is safe for concurrent use.
+type dataKeyCache struct {
+	limits DataKeyCache
+	now    func() time.Time
+
+	mu sync.Mutex
+	// current is the data key for new files, if any.
+	current *cachedDataKey
+	// keys holds the data keys generated or unwrapped, by ciphertext.
+	keys map[string]*cachedDataKey
+}
+
+// newDataKeyCache returns an empty cache with limits.
+func newDataKeyCache(limits DataKeyCache) *dataKeyCache {
+	return &dataKeyCache{limits: limits.withDefaults(), now: time.Now, keys: make(map[string]*cachedDataKey)}
+}
+
+// expired reports whether k is too old to be used.
+func (c *dataKeyCache) expired(k *cachedDataKey, now time.Time) bool {
+	return now.Sub(k.created) >= c.limits.MaxAge
+}
+
+// forEncryption returns a data key to encrypt a file with: the current one
+// while it is within the limits, or else a new one from generate, which
+// returns it in plaintext and wrapped.
+func (c *dataKeyCache) forEncryption(generate func() ([32]byte, string, error)) ([32]byte, string, error) {
+	if c.limits.MaxAge < 0 {
+		return generate()
+	}
+	c.mu.Lock()
+	now := c.now()
+	if k := c.current; k != nil && !c.expired(k, now) && k.files < c.limits.MaxFiles {
+		k.files++
+		k.used = now
+		c.mu.Unlock()
+		return k.plaintext, k.ciphertext, nil
+	}
+	c.mu.Unlock()
+
+	plaintext, ciphertext, err := generate()
+	if err != nil {
+		return plaintext, ciphertext, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now = c.now()
+	k := &cachedDataKey{plaintext: plaintext, ciphertext: ciphertext, created: now, used: now, files: 1}
+	c.current = k
+	c.add(k)
+	return plaintext, ciphertext, nil
+}
+
+// forDecryption returns the plaintext of the data key ciphertext, from the
+// cache or else from unwrap.
+func (c *dataKeyCache) forDecryption(ciphertext string, unwrap func() ([32]byte, error)) ([32]byte, error) {
+	if c.limits.MaxAge < 0 {
+		return unwrap()
+	}
+	c.mu.Lock()
+	now := c.now()
+	if k := c.keys[ciphertext]; k != nil && !c.expired(k, now) {
+		k.used = now
+		c.mu.Unlock()
+		return k.plaintext, nil
+	}
+	c.mu.Unlock()
+
+	plaintext, err := unwrap()
+	if err != nil {
+		return plaintext, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now = c.now()
+	c.add(&cachedDataKey{plaintext: plaintext, ciphertext: ciphertext, created: now, used: now})
+	return plaintext, nil
+}
+
+// add caches k, dropping expired keys and then the least recently used ones
+// beyond the capacity. c.mu must be held.
+func (c *dataKeyCache) add(k *cachedDataKey) {
+	c.keys[k.ciphertext] = k
+	now := c.now()
+	for ciphertext, old := range c.keys {
+		if c.expired(old, now) {
+			c.drop(ciphertext)
+		}
+	}
+	for len(c.keys) > c.limits.Capacity {
+		var oldest string
+		for ciphertext, old := range c.keys {
+			if oldest == "" || old.used.Before(c.keys[oldest].used) {
+				oldest = ciphertext
+			}
+		}
+		c.drop(oldest)
+	}
+}
+
+// drop removes the data key ciphertext from the cache, and clears its
+// plaintext. c.mu must be held.
+func (c *dataKeyCache) drop(ciphertext string) {
+	k := c.keys[ciphertext]
+	delete(c.keys, ciphertext)
+	if k == c.current {
+		c.current = nil
+	}
+	k.plaintext = [32]byte{}
+}
+
+// clear drops every data key from the cache.
+func (c *dataKeyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ciphertext := range c.keys {
+		c.drop(ciphertext)
+	}
+}
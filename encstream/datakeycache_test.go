@@ -0,0 +1,76 @@
+package encstream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestDataKeyCache verifies that a data key encrypts files until it is too
+// old or has encrypted too many, that unwrapped data keys are kept within the
+// capacity, least recently used first out, and that caching can be turned off.
+func TestDataKeyCache(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	generated := 0
+	generate := func() ([32]byte, string, error) {
+		generated++
+		return [32]byte{byte(generated)}, fmt.Sprint("key", generated), nil
+	}
+	unwrapped := 0
+	unwrap := func(ciphertext string) func() ([32]byte, error) {
+		return func() ([32]byte, error) {
+			unwrapped++
+			return [32]byte{ciphertext[len(ciphertext)-1]}, nil
+		}
+	}
+
+	c := newDataKeyCache(DataKeyCache{MaxAge: time.Minute, MaxFiles: 3, Capacity: 2})
+	c.now = func() time.Time { return now }
+	var ciphertexts []string
+	for i := 0; i < 4; i++ {
+		_, ciphertext, err := c.forEncryption(generate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+	if generated != 2 || ciphertexts[2] != "key1" || ciphertexts[3] != "key2" {
+		t.Fatal("a data key encrypted the wrong number of files:", ciphertexts)
+	}
+	now = now.Add(time.Minute)
+	if _, ciphertext, _ := c.forEncryption(generate); ciphertext != "key3" {
+		t.Fatal("an expired data key was used:", ciphertext)
+	}
+	if len(c.keys) != 1 {
+		t.Fatal("expired data keys were kept:", len(c.keys))
+	}
+
+	for _, ciphertext := range []string{"keyA", "keyB", "keyA", "keyC", "keyA"} {
+		now = now.Add(time.Second)
+		key, err := c.forDecryption(ciphertext, unwrap(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != ([32]byte{ciphertext[3]}) {
+			t.Fatal("wrong data key for", ciphertext)
+		}
+	}
+	// keyA was unwrapped once, keyB and keyC once each, and key3 and keyB
+	// were dropped for keyC, beyond the capacity.
+	if unwrapped != 3 || len(c.keys) != 2 || c.keys["keyA"] == nil || c.keys["keyC"] == nil {
+		t.Fatal("wrong cache:", unwrapped, c.keys)
+	}
+	if c.current != nil {
+		t.Fatal("a dropped data key is still used for new files")
+	}
+
+	off := newDataKeyCache(DataKeyCache{MaxAge: -1})
+	generated, unwrapped = 0, 0
+	for i := 0; i < 2; i++ {
+		off.forEncryption(generate)
+		off.forDecryption("keyA", unwrap("keyA"))
+	}
+	if generated != 2 || unwrapped != 2 || len(off.keys) != 0 {
+		t.Fatal("data keys were cached with caching off")
+	}
+}
@@ -0,0 +1,200 @@
+package encstream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// enc diff compares the plaintexts of two encrypted files, which are
+// decrypted into memory and never written to disk. Like diff, it can show
+// the differences of text as a unified diff, found with Myers' algorithm.
+
+// diffContext is how many unchanged lines surround the changes of a hunk.
+const diffContext = 3
+
+// decryptToMemory authenticates and decrypts input, returning its plaintext.
+func decryptToMemory(keys keySource, input io.ReadSeeker) ([]byte, error) {
+	_, plaintext, err := openCiphertext(keys, input)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(plaintext)
+}
+
+// isText reports whether b looks like text: valid UTF-8 without NUL bytes.
+func isText(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
+}
+
+// splitLines splits s into lines, keeping their newlines.
+func splitLines(s []byte) []string {
+	var lines []string
+	for len(s) > 0 {
+		i := bytes.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		lines = append(lines, string(s[:i]))
+		s = s[i:]
+	}
+	return lines
+}
+
+// diffOp is a line of an edit script: kept (' '), deleted ('-') or inserted
+// ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest edit script turning a into b, using Myers'
+// O(ND) algorithm.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+search:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// walk back through the furthest reaching paths, from the end.
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// hunkRange formats the start and length of a hunk as unified diffs do,
+// where an empty range starts at the line before it.
+func hunkRange(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%v,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%v,%v", start+1, length)
+}
+
+// writeUnifiedDiff writes a unified diff of a and b, named nameA and nameB,
+// to w. It writes nothing if they are the same.
+func writeUnifiedDiff(w io.Writer, nameA, nameB string, a, b []byte) error {
+	ops := diffLines(splitLines(a), splitLines(b))
+	out := new(strings.Builder)
+	fmt.Fprintf(out, "--- %v\n+++ %v\n", nameA, nameB)
+	changed := false
+	// lineA and lineB are the lines of a and b that ops[i] is at.
+	lineA, lineB := 0, 0
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			lineA++
+			lineB++
+			continue
+		}
+		changed = true
+
+		// a hunk starts diffContext lines before a change, and ends
+		// diffContext lines after the last change that is not followed
+		// by more than twice that many unchanged lines.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		startA, startB := lineA-(i-start), lineB-(i-start)
+		end, unchanged := i, 0
+		for j := i; j < len(ops) && unchanged <= 2*diffContext; j++ {
+			if ops[j].kind == ' ' {
+				unchanged++
+				continue
+			}
+			unchanged = 0
+			end = j + 1
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		lengthA, lengthB := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				lengthA++
+			}
+			if op.kind != '-' {
+				lengthB++
+			}
+		}
+		fmt.Fprintf(out, "@@ -%v +%v @@\n", hunkRange(startA, lengthA), hunkRange(startB, lengthB))
+		for _, op := range ops[start:stop] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		for _, op := range ops[i:stop] {
+			if op.kind != '+' {
+				lineA++
+			}
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+		i = stop
+	}
+	if !changed {
+		return nil
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
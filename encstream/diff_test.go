@@ -0,0 +1,119 @@
+package encstream
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// TestDiffLines verifies that edit scripts turn one input into the other,
+// and are as short as the longest common subsequence allows.
+func TestDiffLines(t *testing.T) {
+	random := func(r *rand.Rand) []string {
+		lines := make([]string, r.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + r.Intn(3)))
+		}
+		return lines
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		a, b := random(r), random(r)
+		ops := diffLines(a, b)
+		var gotA, gotB []string
+		kept := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind == ' ' {
+				kept++
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("the edit script of %q and %q does not reproduce them", a, b)
+		}
+
+		// the length of the longest common subsequence, by dynamic
+		// programming.
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] > lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		if kept != lcs[0][0] {
+			t.Fatalf("the edit script of %q and %q keeps %v lines, not %v", a, b, kept, lcs[0][0])
+		}
+	}
+}
+
+// TestUnifiedDiff verifies unified diffs against those of GNU diff.
+func TestUnifiedDiff(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		diff string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"", "x\n", "@@ -0,0 +1 @@\n+x\n"},
+		{"x\n", "", "@@ -1 +0,0 @@\n-x\n"},
+		{
+			"a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\n",
+			"a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\nadded",
+			"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n@@ -12,3 +12,4 @@\n l\n m\n n\n+added\n\\ No newline at end of file\n",
+		},
+		{
+			"a\nb\nc\nd\ne\nf\ng\nh\n",
+			"A\nb\nc\nd\ne\nf\ng\nH\n",
+			"@@ -1,8 +1,8 @@\n-a\n+A\n b\n c\n d\n e\n f\n g\n-h\n+H\n",
+		},
+	} {
+		out := new(bytes.Buffer)
+		if err := writeUnifiedDiff(out, "a", "b", []byte(c.a), []byte(c.b)); err != nil {
+			t.Fatal(err)
+		}
+		want := c.diff
+		if want != "" {
+			want = "--- a\n+++ b\n" + want
+		}
+		if out.String() != want {
+			t.Fatalf("diff of %q and %q:\n%v\nexpected:\n%v", c.a, c.b, out, want)
+		}
+	}
+}
+
+// TestDecryptToMemory verifies that files are decrypted into memory, and
+// that only text is taken for text.
+func TestDecryptToMemory(t *testing.T) {
+	text, err := encryptText([]byte("pw"), []byte("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := new(bytes.Buffer)
+	if _, err := readArmor(ciphertext, strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := decryptToMemory(newPassphraseKeys([]byte("pw")), bytes.NewReader(ciphertext.Bytes()))
+	if err != nil || string(plaintext) != "hello\n" {
+		t.Fatal("wrong plaintext", plaintext, err)
+	}
+	if _, err := decryptToMemory(newPassphraseKeys([]byte("wrong")), bytes.NewReader(ciphertext.Bytes())); err == nil {
+		t.Fatal("decrypted with the wrong passphrase")
+	}
+	if !isText(plaintext) || isText([]byte("a\x00b")) || isText([]byte{0xff, 0xfe}) {
+		t.Fatal("text was not told apart from binary data")
+	}
+}
@@ -0,0 +1,180 @@
+package encstream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// -store-digest records a digest of the plaintext in the header: its
+// BLAKE2b-256 hash, hashed again with BLAKE2b keyed with a subkey of the
+// file's key, or with SHA-256 and HMAC-SHA-256 in the FIPS suite. The
+// plaintext is hashed unkeyed so that the state of the hash can be saved to
+// resume a file, which keyed BLAKE2b and HMAC do not allow. The digest is only
+// known once the plaintext has been read, so it is written into the header
+// afterwards, like the signature, and the MAC covers it after the ciphertext
+// rather than with the rest of the header. Decrypting a file with a digest
+// checks the plaintext against it before the output is renamed into place,
+// which catches a fault between decryption and the disk that the MAC, which
+// covers the ciphertext, cannot; enc inspect -expect-digest checks a restored
+// copy against it with the key, after reading the ciphertext to check the MAC
+// that covers the digest. The digest
+// of an archive is that of its tar stream, which decryption checks as it
+// extracts it. Since the digest is keyed, it can be read without the key but
+// neither confirms a guess at the plaintext nor can be made for another
+// plaintext.
+
+var (
+	errDigestMismatch = errors.New("the plaintext does not match the digest recorded in the header")
+	errNoDigest       = errors.New("the file records no plaintext digest; encrypt it with -store-digest")
+	errDigestArchive  = errors.New("the digest of an archive is of the tar stream it was encrypted from, which decryption checks; check extracted files with enc verify -deep")
+)
+
+// newDigest returns the hash of the plaintext digest of a file in suite whose
+// chunks are sealed with sk.
+func newDigest(suite uint8, sk [32]byte) hash.Hash {
+	d := &keyedDigest{key: subkey(sk, "enc digest"), suite: suite}
+	if suite == suiteFIPS {
+		d.Hash = sha256.New()
+	} else {
+		d.Hash, _ = blake2b.New256(nil)
+	}
+	return d
+}
+
+// keyedDigest is a hash of the plaintext whose sum is hashed again with key.
+type keyedDigest struct {
+	hash.Hash
+	key   [32]byte
+	suite uint8
+}
+
+func (d *keyedDigest) Sum(b []byte) []byte {
+	var mac hash.Hash
+	if d.suite == suiteFIPS {
+		mac = hmac.New(sha256.New, d.key[:])
+	} else {
+		mac, _ = blake2b.New256(d.key[:])
+	}
+	mac.Write(d.Hash.Sum(nil))
+	return mac.Sum(b)
+}
+
+func (d *keyedDigest) MarshalBinary() ([]byte, error) {
+	return d.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func (d *keyedDigest) UnmarshalBinary(state []byte) error {
+	return d.Hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+}
+
+// digestString returns the digest recorded in h, named by its algorithm.
+func (h fileHeader) digestString() string {
+	name := "keyed-blake2b-256"
+	if h.Suite == suiteFIPS {
+		name = "hmac-sha256"
+	}
+	return name + ":" + hex.EncodeToString(h.Digest[:])
+}
+
+// macDigest writes the digest recorded in h, if any, to the MAC of the file,
+// after its ciphertext.
+func (h fileHeader) macDigest(mac io.Writer) {
+	if h.Flags&flagDigest != 0 {
+		mac.Write(h.Digest[:])
+	}
+}
+
+// digestReader hashes the plaintext read through it, for checking against
+// the digest of header.
+type digestReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	header fileHeader
+}
+
+// newDigestReader returns a digestReader for the plaintext r of the file
+// with header, whose chunks are sealed with sk.
+func newDigestReader(header fileHeader, sk [32]byte, r io.Reader) *digestReader {
+	return &digestReader{r: r, hash: newDigest(header.Suite, sk), header: header}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	return n, err
+}
+
+// check reads what is left of the plaintext, such as the end of a tar
+// stream, and compares its digest with the one recorded in the header.
+func (d *digestReader) check() error {
+	_, err := io.Copy(ioutil.Discard, d)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(d.hash.Sum(nil), d.header.Digest[:]) != 1 {
+		return errDigestMismatch
+	}
+	return nil
+}
+
+// inspectDigest checks the plaintext at path, or standard input if it is
+// "-", against the digest recorded in the encrypted file name, decrypted
+// with keys. Since the MAC only covers the digest after the ciphertext, the
+// whole file is authenticated first.
+func inspectDigest(keys keySource, name string, path string) error {
+	f, err := openEncrypted(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header, err := readHeader(f)
+	if err != nil {
+		return err
+	}
+	sk, macKey, err := keys.fileKeys(header)
+	if err != nil {
+		return err
+	}
+	_, err = authenticate(f, header, sk, macKey)
+	settleKeys(keys, header, err == nil)
+	if err != nil {
+		return err
+	}
+	return expectDigest(header, sk, path)
+}
+
+// expectDigest checks the plaintext at path, or standard input if it is "-",
+// against the digest recorded in header, whose chunks are sealed with sk.
+func expectDigest(header fileHeader, sk [32]byte, path string) error {
+	if header.Flags&flagDigest == 0 {
+		return errNoDigest
+	}
+	if header.Flags&flagArchive != 0 {
+		return errDigestArchive
+	}
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	err := newDigestReader(header, sk, r).check()
+	if err == errDigestMismatch {
+		return fmt.Errorf("%v does not match the digest recorded in the header", path)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// TestStoreDigest verifies that -store-digest records the digest of the
+// plaintext under the MAC, that decryption and inspect -expect-digest check
+// against it, that a plaintext that does not match is not renamed into
+// place, and that rewrapping keeps it.
+func TestStoreDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("digest "), 50000)
+	output := new(memoryOutput)
+	_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), output, 0, encryptOptions{recipients: []recipient{id.public}, storeDigest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(output.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, macKey, err := identityKeys{id}.fileKeys(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := subkey(sk, "enc digest")
+	hash, _ := blake2b.New256(key[:])
+	sum := blake2b.Sum256(plaintext)
+	hash.Write(sum[:])
+	if header.Flags&flagDigest == 0 || !bytes.Equal(header.Digest[:], hash.Sum(nil)) {
+		t.Fatal("wrong digest", header.digestString())
+	}
+	fips := newDigest(suiteFIPS, sk)
+	fips.Write(plaintext)
+	want := hmac.New(sha256.New, key[:])
+	shaSum := sha256.Sum256(plaintext)
+	want.Write(shaSum[:])
+	if !bytes.Equal(fips.Sum(nil), want.Sum(nil)) {
+		t.Fatal("wrong digest in the FIPS suite")
+	}
+	name := filepath.Join(dir, "file.enc")
+	if err := ioutil.WriteFile(name, output.buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(dir, "restored")
+	if err := decryptTo(identityKeys{id}, bytes.NewReader(output.buf), restored, extractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspectDigest(identityKeys{id}, name, restored); err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inspectDigest(identityKeys{other}, name, restored); err == nil {
+		t.Fatal("the digest was checked with the wrong key")
+	}
+	if err := ioutil.WriteFile(restored, plaintext[1:], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspectDigest(identityKeys{id}, name, restored); err == nil {
+		t.Fatal("a different plaintext matched the digest")
+	}
+
+	// altering the digest is caught by the MAC, and a digest that is
+	// authenticated but wrong by the check of the plaintext.
+	altered := append([]byte{}, output.buf...)
+	altered[bytes.Index(altered, header.Digest[:])] ^= 1
+	if _, _, err := openCiphertext(identityKeys{id}, bytes.NewReader(altered)); err != errBadMAC {
+		t.Fatal("expected errBadMAC from an altered digest, got", err)
+	}
+	alteredName := filepath.Join(dir, "altered.enc")
+	if err := ioutil.WriteFile(alteredName, altered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspectDigest(identityKeys{id}, alteredName, restored); err != errBadMAC {
+		t.Fatal("expected errBadMAC from inspecting an altered digest, got", err)
+	}
+	wrong := header
+	wrong.Digest[0] ^= 1
+	mac, err := newFileMAC(wrong, macKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := output.buf[len(header.encode()):]
+	mac.Write(ciphertext)
+	wrong.macDigest(mac)
+	copy(wrong.Tag[:], mac.Sum(nil))
+	mismatched := append(wrong.encode(), ciphertext...)
+	wrongOutput := filepath.Join(dir, "wrong")
+	if err := decryptTo(identityKeys{id}, bytes.NewReader(mismatched), wrongOutput, extractOptions{}); err != errDigestMismatch {
+		t.Fatal("expected errDigestMismatch, got", err)
+	}
+	if _, err := os.Stat(wrongOutput); !os.IsNotExist(err) {
+		t.Fatal("a plaintext that does not match its digest was written")
+	}
+
+	rewrapped := new(memoryOutput)
+	if _, err := rewrapFile(identityKeys{id}, bytes.NewReader(output.buf), rewrapped, rewrapOptions{add: []recipient{other.public}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptTo(identityKeys{other}, bytes.NewReader(rewrapped.buf), filepath.Join(dir, "rewrapped"), extractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := encryptTo(nil, bytes.NewReader(plaintext), streamOutput{ioutil.Discard}, 0, encryptOptions{recipients: []recipient{id.public}, storeDigest: true}); err != errStreamOptions {
+		t.Fatal("expected errStreamOptions, got", err)
+	}
+}
@@ -0,0 +1,75 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// enc dotenv prints the variables of encrypted env files, in the format enc
+// exec reads, as shell commands for eval, so that per-project secrets can be
+// kept encrypted in the repository and loaded into a shell, or by direnv.
+//
+// Its output is what scripts can rely on: on success, standard output holds
+// nothing but a line `export KEY='value'` for each variable, in the order of
+// the files, with the value quoted for a POSIX shell, and enc exits with
+// status 0. On failure, including a variable whose name is not a valid shell
+// variable name, nothing is written to standard output, the error goes to
+// standard error, and the exit status is not 0. Prompts also go to standard
+// error, so they are seen under eval.
+
+// defaultDotenvFile is the env file enc dotenv reads if none is given.
+const defaultDotenvFile = ".env.enc"
+
+var errDotenvName = errors.New("is not a valid shell variable name")
+
+// isShellName reports whether name is a valid POSIX shell variable name.
+func isShellName(name string) bool {
+	for i, c := range name {
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// writeExports writes vars, of the form KEY=VALUE, to w as shell export
+// commands, checking them all before writing any.
+func writeExports(w io.Writer, vars []string) error {
+	var b strings.Builder
+	for _, v := range vars {
+		key, value, _ := strings.Cut(v, "=")
+		if !isShellName(key) {
+			return fmt.Errorf("%q %v", key, errDotenvName)
+		}
+		fmt.Fprintf(&b, "export %v=%v\n", key, shellQuote(value))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotenvMain implements `enc dotenv`, which prints the variables of encrypted
+// env files as shell export commands.
+func dotenvMain(args []string) {
+	fs := newFlagSet("dotenv", "eval \"$(enc dotenv [-i identity] [secrets.env.enc...])\"")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, false, false)
+	names := parseArgs(fs, args)
+	if len(names) == 0 {
+		names = []string{defaultDotenvFile}
+	}
+
+	vars, err := readEnvFiles(p.keys(identityFiles, p.limits()), names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeExports(os.Stdout, vars)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,24 @@
+package encstream
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestWriteExports verifies the output of enc dotenv, and that nothing is
+// written if a variable cannot be exported.
+func TestWriteExports(t *testing.T) {
+	var b strings.Builder
+	if err := writeExports(&b, []string{"TOKEN=it's", "_A1=x\ny"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "export TOKEN='it'\\''s'\nexport _A1='x\ny'\n"; b.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, b.String())
+	}
+	b.Reset()
+	for _, bad := range []string{"1A=x", "A-B=x", "A;rm=x"} {
+		if err := writeExports(&b, []string{"OK=x", bad}); err == nil || b.Len() != 0 {
+			t.Fatalf("%q was exported", bad)
+		}
+	}
+}
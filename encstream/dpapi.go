@@ -0,0 +1,38 @@
+package encstream
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// On Windows, enc keygen -dpapi seals the key of a new identity with DPAPI,
+// which binds it to the user's Windows account: only they can unseal it, on
+// that machine, or on those their profile roams to. Windows unseals it
+// without asking while they are logged in, so it protects the identity file
+// from other users and from copies, not from programs the user runs:
+//
+//	ENC-DPAPI-KEY-<sealed key>
+
+var errNoDPAPI = errors.New("DPAPI identities need Windows")
+
+// dpapiSealer seals identities with DPAPI.
+var dpapiSealer = keySealer{
+	flag:    "dpapi",
+	usage:   "seal the identity with DPAPI, so that it only works for this Windows account (Windows only)",
+	prefix:  "ENC-DPAPI-KEY-",
+	comment: "# sealed with DPAPI; only the Windows account that made it can unseal it",
+	seal: func(secret []byte) (string, error) {
+		sealed, err := dpapiSeal(secret)
+		if err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(sealed), nil
+	},
+	unseal: func(key string, reason string) ([]byte, error) {
+		sealed, err := base64.RawURLEncoding.DecodeString(key)
+		if err != nil || len(sealed) == 0 {
+			return nil, errBadKey
+		}
+		return dpapiUnseal(sealed)
+	},
+}
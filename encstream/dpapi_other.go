@@ -0,0 +1,13 @@
+//go:build !windows
+
+package encstream
+
+// dpapiSeal fails, as DPAPI is only available on Windows.
+func dpapiSeal(secret []byte) ([]byte, error) {
+	return nil, errNoDPAPI
+}
+
+// dpapiUnseal fails, as DPAPI is only available on Windows.
+func dpapiUnseal(sealed []byte) ([]byte, error) {
+	return nil, errNoDPAPI
+}
@@ -0,0 +1,47 @@
+package encstream
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// dpapiEntropy is sealed along with every key, so that programs that unseal
+// the user's DPAPI secrets without it cannot unseal those of enc.
+var dpapiEntropy = []byte("enc identity")
+
+// dpapiSeal seals secret for the current user with DPAPI.
+func dpapiSeal(secret []byte) ([]byte, error) {
+	var sealed windows.DataBlob
+	description, err := windows.UTF16PtrFromString("enc identity")
+	if err != nil {
+		return nil, err
+	}
+	err = windows.CryptProtectData(newDataBlob(secret), description, newDataBlob(dpapiEntropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &sealed)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&sealed), nil
+}
+
+// dpapiUnseal unseals a secret sealed by dpapiSeal for the current user.
+func dpapiUnseal(sealed []byte) ([]byte, error) {
+	var secret windows.DataBlob
+	err := windows.CryptUnprotectData(newDataBlob(sealed), nil, newDataBlob(dpapiEntropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &secret)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&secret), nil
+}
+
+// newDataBlob returns a DataBlob of b, which must not be empty.
+func newDataBlob(b []byte) *windows.DataBlob {
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
+
+// takeDataBlob returns a copy of a DataBlob that DPAPI allocated, and frees
+// it.
+func takeDataBlob(b *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.Data)))
+	return append([]byte(nil), unsafe.Slice(b.Data, b.Size)...)
+}
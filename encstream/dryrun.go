@@ -0,0 +1,261 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// A dry run checks an encryption without performing it: the inputs are
+// opened and walked, the output directory is checked for write access, the
+// header is built and the recipients validated, and the size of the output
+// and the time the key derivation takes are estimated. Nothing is written
+// but a temporary file to check permissions, which is removed right away.
+
+var (
+	errDryRunOptions = errors.New("-dry-run cannot be combined with -d or -qr")
+	errDryRunFailed  = errors.New("the dry run found problems")
+)
+
+// kdfSampleMemory is the most memory, in KiB, the KDF is run with to estimate
+// how long it takes; the estimate scales the time taken up to the real
+// parameters.
+const kdfSampleMemory = 64 << 10
+
+// plannedInput describes an input of a dry run.
+type plannedInput struct {
+	archive bool
+	files   int   // regular files in an archive
+	size    int64 // bytes of plaintext, including the tar framing of archives
+}
+
+// dryRun reports to w what encrypting inputs to output with opts would do. If
+// there are several inputs, output is the directory they are encrypted into.
+// Every problem found is reported, and errDryRunFailed is returned if there
+// were any.
+func dryRun(w io.Writer, inputs []string, output string, opts encryptOptions) error {
+	outputs := []string{output}
+	if len(inputs) > 1 {
+		var err error
+		outputs, err = batchOutputs(inputs, output)
+		if err != nil {
+			return err
+		}
+		if len(opts.recipients) == 0 && !opts.fips && opts.dedupWith == nil {
+			// stands in for the key encryptBatch derives, so that the
+			// headers are the same size.
+			header, err := newHeader()
+			if err != nil {
+				return err
+			}
+			opts.shared = &sharedKey{header: header}
+		}
+	}
+
+	failed := false
+	problem := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, "problem: "+format+"\n", args...)
+		failed = true
+	}
+	if output != "-" {
+		// a single output must go in an existing directory, but the output
+		// directory of several is created if needed.
+		dir, create := filepath.Dir(output), false
+		if len(inputs) > 1 {
+			dir, create = output, true
+		}
+		if err := checkWritable(dir, create); err != nil {
+			problem("cannot write to %v: %v", dir, err)
+		}
+	}
+
+	// the headers of the outputs only differ in their salts and whether
+	// they hold an archive, so they are all the size of this one.
+	header, err := newFileHeader(0, opts, output == "-")
+	if err != nil {
+		return err
+	}
+	if len(opts.recipients) > 0 {
+		_, err = wrapFileKey(&header, opts)
+		if err != nil {
+			return err
+		}
+	}
+	// a deniable region is as much overhead as the header.
+	headerSize := int64(len(header.encode())) + header.Reserved
+
+	for i, input := range inputs {
+		planned, err := planInput(input, opts.archive)
+		if err != nil {
+			problem("cannot read %v: %v", input, err)
+			continue
+		}
+		plaintextSize := planned.size
+		if opts.noMetadata {
+			plaintextSize = paddedSize(plaintextSize)
+		}
+		size := ciphertextSize(headerSize, plaintextSize, opts.recovery)
+		if opts.armor {
+			encoded := (size + 2) / 3 * 4
+			size = encoded + (encoded+armorLineWidth-1)/armorLineWidth
+		}
+
+		contents := fmt.Sprintf("%v bytes", planned.size)
+		if planned.archive {
+			contents = fmt.Sprintf("directory of %v files, about %v bytes as an archive", planned.files, planned.size)
+		}
+		destination := outputs[i]
+		if destination == "-" {
+			destination = "stdout"
+		}
+		fmt.Fprintf(w, "%v (%v) -> %v, about %v bytes\n", input, contents, destination, size)
+		if opts.volumeSize > 0 {
+			fmt.Fprintf(w, "  in %v volumes\n", (size+opts.volumeSize-1)/opts.volumeSize)
+		}
+		if info, err := os.Stat(outputs[i]); err == nil {
+			if info.IsDir() {
+				problem("%v is a directory", outputs[i])
+			} else {
+				fmt.Fprintf(w, "  replaces the existing %v\n", outputs[i])
+			}
+		}
+	}
+
+	var kdf string
+	switch {
+	case len(opts.recipients) > 0:
+		fmt.Fprintf(w, "key: encrypted to %v recipients, no key derivation\n", len(opts.recipients))
+	case header.Suite == suiteFIPS:
+		kdf = fmt.Sprintf("pbkdf2-hmac-sha256, %v iterations", header.Iterations)
+	default:
+		kdf = fmt.Sprintf("argon2id, %v passes over %v KiB", header.ArgonTime, header.ArgonMemory)
+	}
+	if kdf != "" {
+		var times string
+		switch {
+		case len(inputs) == 1:
+		case opts.shared != nil:
+			times = ", once for all files"
+		default:
+			times = ", for each file"
+		}
+		fmt.Fprintf(w, "key: %v, about %v%v\n", kdf, estimateKDF(header).Round(time.Millisecond), times)
+	}
+	if failed {
+		return errDryRunFailed
+	}
+	return nil
+}
+
+// planInput opens the file or directory at name, and for directories every
+// regular file beneath it that an archive written with archive would hold, to
+// check that it can be read, and returns its size.
+func planInput(name string, archive archiveOptions) (plannedInput, error) {
+	var planned plannedInput
+	f, err := os.Open(name)
+	if err != nil {
+		return planned, err
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return planned, err
+	}
+	if !info.IsDir() {
+		planned.size = info.Size()
+		return planned, nil
+	}
+
+	// an estimate of the tar stream writeArchive produces: a header block
+	// per entry, the contents padded to whole blocks, the manifest and the
+	// two blocks that end the archive.
+	const block = 512
+	const manifestEntry = 200
+	planned.archive = true
+	filter := newTreeFilter(name, archive.filter)
+	err = walkTree(name, archive.symlinks, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(name, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			excluded, err := filter.excluded(filepath.ToSlash(rel), info.IsDir())
+			if err != nil {
+				return err
+			}
+			if excluded && info.IsDir() {
+				return filepath.SkipDir
+			}
+			if excluded {
+				return nil
+			}
+		}
+		planned.size += block
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		planned.files++
+		planned.size += (info.Size() + block - 1) / block * block
+		return nil
+	})
+	planned.size += block + (int64(planned.files)*manifestEntry+block-1)/block*block + 2*block
+	return planned, err
+}
+
+// checkWritable checks that a file can be created in dir. If create is set
+// and dir does not exist yet, it checks the closest directory above it that
+// does instead.
+func checkWritable(dir string, create bool) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%v is not a directory", dir)
+			}
+			break
+		}
+		if !create || !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := ioutil.TempFile(dir, ".enc-dry-run")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// estimateKDF estimates how long deriving the keys described by header takes
+// on this machine, by timing the KDF with a fraction of the work.
+func estimateKDF(header fileHeader) time.Duration {
+	if header.Suite == suiteFIPS {
+		sample := header
+		sample.Iterations = 10000
+		start := time.Now()
+		deriveFIPSKeys([]byte("dry run"), sample)
+		return time.Since(start) * time.Duration(header.Iterations) / time.Duration(sample.Iterations)
+	}
+	memory := header.ArgonMemory
+	if memory > kdfSampleMemory {
+		memory = kdfSampleMemory
+	}
+	start := time.Now()
+	argon2.IDKey([]byte("dry run"), header.Salt[:], 1, memory, uint8(header.ArgonLanes), keyLen+macLen)
+	return time.Since(start) * time.Duration(header.ArgonTime) * time.Duration(header.ArgonMemory) / time.Duration(memory)
+}
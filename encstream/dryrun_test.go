@@ -0,0 +1,69 @@
+package encstream
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDryRun verifies that a dry run predicts the size of the output without
+// writing it, and reports inputs that cannot be read.
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input")
+	err = ioutil.WriteFile(input, make([]byte, maxChunkSize*5+3), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "output")
+
+	var report bytes.Buffer
+	err = dryRun(&report, []string{input}, output, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatal("the dry run wrote the output")
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = encryptFile([]byte("hunter2"), f, output, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("about %v bytes", info.Size()); !strings.Contains(report.String(), want) {
+		t.Fatalf("the dry run did not predict the output size, %v:\n%v", info.Size(), report.String())
+	}
+
+	report.Reset()
+	err = dryRun(&report, []string{input, filepath.Join(dir, "missing")}, filepath.Join(dir, "batch"), encryptOptions{})
+	if err != errDryRunFailed {
+		t.Fatal("expected errDryRunFailed, got", err)
+	}
+	if !strings.Contains(report.String(), "cannot read") {
+		t.Fatal("the missing input was not reported:\n" + report.String())
+	}
+
+	nested := filepath.Join(dir, "a", "b")
+	if checkWritable(nested, false) == nil {
+		t.Fatal("a missing directory was writable")
+	}
+	if err := checkWritable(nested, true); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+package encstream
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// .encignore files keep the rules for what to leave out of archives and
+// watched directories next to the data they describe, in the syntax of
+// filters. Their patterns match paths relative to their directory, and come
+// after those of the directories above it. Entries that the -include and
+// -exclude rules on the command line decide about are left to them, since
+// they take precedence.
+
+const ignoreFileName = ".encignore"
+
+// readIgnoreFile reads the rules of the .encignore file name, returning none
+// if there is no such file.
+func readIgnoreFile(name string) ([]filterRule, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readFilterRules(f, name)
+}
+
+// ignoreTree holds the .encignore files of the tree rooted at root, reading
+// each the first time it is needed.
+type ignoreTree struct {
+	root  string
+	files map[string][]filterRule // by slash-separated directory, relative to root
+}
+
+func newIgnoreTree(root string) *ignoreTree {
+	return &ignoreTree{root: root, files: make(map[string][]filterRule)}
+}
+
+// rules returns the rules of the .encignore file in the directory dir.
+func (t *ignoreTree) rules(dir string) ([]filterRule, error) {
+	if rules, ok := t.files[dir]; ok {
+		return rules, nil
+	}
+	rules, err := readIgnoreFile(filepath.Join(t.root, filepath.FromSlash(dir), ignoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	t.files[dir] = rules
+	return rules, nil
+}
+
+// forget drops the rules read from the .encignore file in the directory dir,
+// so that they are read again after it changes.
+func (t *ignoreTree) forget(dir string) {
+	delete(t.files, dir)
+}
+
+// ignored reports whether the .encignore files in the directories above the
+// entry at the slash-separated path rel leave it out.
+func (t *ignoreTree) ignored(rel string, dir bool) (bool, error) {
+	ignored := false
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		rules, err := t.rules(strings.Join(parts[:i], "/"))
+		if err != nil {
+			return false, err
+		}
+		if excluded, ok := matchRules(rules, strings.Join(parts[i:], "/"), dir); ok {
+			ignored = excluded
+		}
+	}
+	return ignored, nil
+}
+
+// ignoredPath is like ignored, but also reports whether rel is left out
+// because a directory above it is.
+func (t *ignoreTree) ignoredPath(rel string, dir bool) (bool, error) {
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		ignored, err := t.ignored(strings.Join(parts[:i], "/"), true)
+		if ignored || err != nil {
+			return ignored, err
+		}
+	}
+	return t.ignored(rel, dir)
+}
+
+// treeFilter decides what is left out of an archive of a tree: what the
+// filter from the command line excludes, and otherwise what the .encignore
+// files of the tree do.
+type treeFilter struct {
+	filter  *pathFilter
+	ignores *ignoreTree
+}
+
+func newTreeFilter(root string, filter *pathFilter) treeFilter {
+	return treeFilter{filter: filter, ignores: newIgnoreTree(root)}
+}
+
+// excluded reports whether the entry at the slash-separated path rel, which
+// is a directory if dir is set, is left out.
+func (f treeFilter) excluded(rel string, dir bool) (bool, error) {
+	if excluded, ok := f.filter.match(rel, dir); ok {
+		return excluded, nil
+	}
+	return f.ignores.ignored(rel, dir)
+}
@@ -0,0 +1,140 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestIgnoreRules verifies the parsing and matching of .encignore patterns.
+func TestIgnoreRules(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		rel     string
+		dir     bool
+		matched bool
+	}{
+		{"*.o", "a.o", false, true},
+		{"*.o", "x/y/a.o", false, true},
+		{"*.o", "a.c", false, false},
+		{"build/", "build", true, true},
+		{"build/", "x/build", true, true},
+		{"build/", "build", false, false},
+		{"/a.o", "a.o", false, true},
+		{"/a.o", "x/a.o", false, false},
+		{"doc/*.pdf", "doc/a.pdf", false, true},
+		{"doc/*.pdf", "doc/x/a.pdf", false, false},
+		{"**/logs", "logs", true, true},
+		{"**/logs", "x/y/logs", true, true},
+		{"logs/**", "logs", true, false},
+		{"logs/**", "logs/a", false, true},
+		{"logs/**", "logs/x/a", false, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "x/a/b", false, false},
+		{`\#a`, "#a", false, true},
+		{`\!a`, "!a", false, true},
+		{`a\ `, "a ", false, true},
+		{"a  ", "a", false, true},
+	} {
+		r, ok, err := parseFilterLine(c.pattern)
+		if err != nil || !ok {
+			t.Fatalf("%q was not parsed: %v", c.pattern, err)
+		}
+		if r.matches(c.rel, c.dir) != c.matched {
+			t.Fatalf("%q matching %v is not %v", c.pattern, c.rel, c.matched)
+		}
+	}
+	for _, line := range []string{"", "   ", "# comment"} {
+		if _, ok, err := parseFilterLine(line); ok || err != nil {
+			t.Fatalf("%q holds a pattern", line)
+		}
+	}
+	for _, line := range []string{"/", "!", "a//b", "[a"} {
+		if _, _, err := parseFilterLine(line); err != errFilterPattern {
+			t.Fatalf("%q: expected errFilterPattern, got %v", line, err)
+		}
+	}
+}
+
+// TestIgnoreFiles verifies that .encignore files leave entries out of
+// archives and watched directories, that deeper files and later patterns
+// take precedence, and that command line filters take precedence over them.
+func TestIgnoreFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-encignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		".encignore":         "*.log\ntmp/\n!keep.log\n",
+		"a.log":              "",
+		"keep.log":           "",
+		"a.c":                "",
+		"tmp/x":              "",
+		"sub/.encignore":     "# sub\n!*.log\n/local\n",
+		"sub/b.log":          "",
+		"sub/local":          "",
+		"sub/deeper/local":   "",
+		"other/forced.log":   "",
+		"other/tmp/unwanted": "",
+	}
+	for name, contents := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := []string{".encignore", "keep.log", "a.c", "sub/.encignore", "sub/b.log", "sub/deeper/local", "other/forced.log"}
+	left := []string{"a.log", "tmp/", "tmp/x", "sub/local", "other/tmp/", "other/tmp/unwanted"}
+
+	var f pathFilter
+	if err := f.add("forced.log", true); err != nil {
+		t.Fatal(err)
+	}
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(src, archive, nil, archiveOptions{filter: &f}); err != nil {
+		t.Fatal(err)
+	}
+	entries := archiveEntries(t, bytes.NewReader(archive.Bytes()))
+	for _, name := range kept {
+		if _, ok := entries[name]; !ok {
+			t.Fatal("the archive is missing", name)
+		}
+	}
+	for _, name := range left {
+		if _, ok := entries[name]; ok {
+			t.Fatal("the archive holds", name)
+		}
+	}
+
+	w, err := newWatcher(src, filepath.Join(dir, "dest"), time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		w.schedule(filepath.Join(src, filepath.FromSlash(name)))
+	}
+	for _, name := range []string{"a.log", "tmp/x", "sub/local", "other/forced.log", "other/tmp/unwanted"} {
+		if _, ok := w.pending[filepath.Join(src, filepath.FromSlash(name))]; ok {
+			t.Fatal("the watcher scheduled", name)
+		}
+	}
+	if len(w.pending) != len(files)-5 {
+		t.Fatal("the watcher did not schedule every file that is not ignored")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src, ".encignore"), []byte("[a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeArchive(src, new(bytes.Buffer), nil, archiveOptions{}); err == nil {
+		t.Fatal("a malformed .encignore file was accepted")
+	}
+}
@@ -0,0 +1,67 @@
+package encstream
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// On a Mac, enc keygen -secure-enclave seals the key of a new identity with a
+// P-256 key that is created in the Secure Enclave, never leaves it, and can
+// only be used after Touch ID. The sealed key is stored with the enclave's
+// handle to its own key, which is of no use on another Mac, or once the
+// enrolled fingerprints change:
+//
+//	ENC-ENCLAVE-KEY-<handle>.<sealed key>
+//
+// The enclave only holds P-256 keys, so it seals an X25519 identity rather
+// than being one. The backend, enclaveSeal and enclaveUnseal, needs cgo and
+// macOS.
+
+var errNoEnclave = errors.New("Secure Enclave identities need macOS on a Mac with a Secure Enclave and Touch ID")
+
+// enclaveSealer seals identities in the Secure Enclave.
+var enclaveSealer = keySealer{
+	flag:    "secure-enclave",
+	usage:   "seal the identity with a key in the Secure Enclave, so that it only works on this Mac and asks for Touch ID whenever it is used (macOS only)",
+	prefix:  "ENC-ENCLAVE-KEY-",
+	comment: "# sealed by the Secure Enclave; unsealing it asks for Touch ID",
+	seal: func(secret []byte) (string, error) {
+		handle, sealed, err := enclaveSeal(secret)
+		if err != nil {
+			return "", err
+		}
+		return enclaveKeyString(handle, sealed), nil
+	},
+	unseal: func(key string, reason string) ([]byte, error) {
+		handle, sealed, err := parseEnclaveKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return enclaveUnseal(handle, sealed, reason)
+	},
+}
+
+// enclaveKeyString returns the text form, without its prefix, of a key sealed
+// by the Secure Enclave with the key it refers to by handle.
+func enclaveKeyString(handle, sealed []byte) string {
+	return base64.RawURLEncoding.EncodeToString(handle) + "." + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// parseEnclaveKey parses the text form, without its prefix, of a key sealed
+// by the Secure Enclave.
+func parseEnclaveKey(s string) (handle, sealed []byte, err error) {
+	h, k, ok := strings.Cut(s, ".")
+	if !ok {
+		return nil, nil, errBadKey
+	}
+	handle, err = base64.RawURLEncoding.DecodeString(h)
+	if err != nil || len(handle) == 0 {
+		return nil, nil, errBadKey
+	}
+	sealed, err = base64.RawURLEncoding.DecodeString(k)
+	if err != nil || len(sealed) == 0 {
+		return nil, nil, errBadKey
+	}
+	return handle, sealed, nil
+}
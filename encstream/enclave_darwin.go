@@ -0,0 +1,188 @@
+//go:build darwin && cgo
+
+package encstream
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation -framework Security
+#include <stdio.h>
+#include <stdlib.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+// the identity key is sealed with ECIES on P-256, with a key agreed with the
+// enclave key and AES-GCM.
+#define ENCLAVE_ALGORITHM kSecKeyAlgorithmECIESEncryptionCofactorVariableIVX963SHA256AESGCM
+
+// takeError copies the description of err to msg, releases err and returns
+// its code, or -1 if there is none.
+static long takeError(CFErrorRef err, char *msg, size_t msgLen) {
+	if (err == NULL) {
+		return -1;
+	}
+	long code = CFErrorGetCode(err);
+	CFStringRef desc = CFErrorCopyDescription(err);
+	if (desc != NULL) {
+		CFStringGetCString(desc, msg, msgLen, kCFStringEncodingUTF8);
+		CFRelease(desc);
+	}
+	CFRelease(err);
+	return code;
+}
+
+static CFMutableDictionaryRef newDictionary(void) {
+	return CFDictionaryCreateMutable(kCFAllocatorDefault, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+}
+
+// seal creates a P-256 key in the Secure Enclave that can only be used after
+// Touch ID, and seals secret with it. It sets handle to the enclave's handle
+// to the key, and sealed to the sealed secret, or returns an error code.
+static long seal(const UInt8 *secret, CFIndex secretLen, CFDataRef *handle, CFDataRef *sealed, char *msg, size_t msgLen) {
+	CFErrorRef err = NULL;
+	SecAccessControlRef access = SecAccessControlCreateWithFlags(kCFAllocatorDefault,
+		kSecAttrAccessibleWhenUnlockedThisDeviceOnly,
+		kSecAccessControlPrivateKeyUsage | kSecAccessControlBiometryCurrentSet, &err);
+	if (access == NULL) {
+		return takeError(err, msg, msgLen);
+	}
+	int bits = 256;
+	CFNumberRef size = CFNumberCreate(kCFAllocatorDefault, kCFNumberIntType, &bits);
+	CFMutableDictionaryRef privateAttrs = newDictionary();
+	CFDictionarySetValue(privateAttrs, kSecAttrIsPermanent, kCFBooleanFalse);
+	CFDictionarySetValue(privateAttrs, kSecAttrAccessControl, access);
+	CFMutableDictionaryRef attrs = newDictionary();
+	CFDictionarySetValue(attrs, kSecAttrKeyType, kSecAttrKeyTypeECSECPrimeRandom);
+	CFDictionarySetValue(attrs, kSecAttrKeySizeInBits, size);
+	CFDictionarySetValue(attrs, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	CFDictionarySetValue(attrs, kSecPrivateKeyAttrs, privateAttrs);
+	SecKeyRef key = SecKeyCreateRandomKey(attrs, &err);
+	CFRelease(attrs);
+	CFRelease(privateAttrs);
+	CFRelease(size);
+	CFRelease(access);
+	if (key == NULL) {
+		return takeError(err, msg, msgLen);
+	}
+
+	// the key is not kept in the keychain, which would need entitlements
+	// enc does not have; its token object ID is an encrypted blob that only
+	// this enclave can open.
+	CFDictionaryRef keyAttrs = SecKeyCopyAttributes(key);
+	CFDataRef oid = keyAttrs == NULL ? NULL : CFDictionaryGetValue(keyAttrs, kSecAttrTokenOID);
+	if (oid == NULL) {
+		if (keyAttrs != NULL) {
+			CFRelease(keyAttrs);
+		}
+		CFRelease(key);
+		snprintf(msg, msgLen, "the key has no token object ID");
+		return -1;
+	}
+	*handle = CFRetain(oid);
+	CFRelease(keyAttrs);
+
+	SecKeyRef public = SecKeyCopyPublicKey(key);
+	CFRelease(key);
+	if (public == NULL) {
+		CFRelease(*handle);
+		snprintf(msg, msgLen, "the key has no public key");
+		return -1;
+	}
+	CFDataRef plaintext = CFDataCreate(kCFAllocatorDefault, secret, secretLen);
+	*sealed = SecKeyCreateEncryptedData(public, ENCLAVE_ALGORITHM, plaintext, &err);
+	CFRelease(plaintext);
+	CFRelease(public);
+	if (*sealed == NULL) {
+		CFRelease(*handle);
+		return takeError(err, msg, msgLen);
+	}
+	return 0;
+}
+
+// unseal opens sealed with the enclave key whose handle is given, which asks
+// for Touch ID with reason. It sets secret to the secret, or returns an error
+// code.
+static long unseal(const UInt8 *handle, CFIndex handleLen, const UInt8 *sealed, CFIndex sealedLen, const char *reason, CFDataRef *secret, char *msg, size_t msgLen) {
+	CFErrorRef err = NULL;
+	CFDataRef oid = CFDataCreate(kCFAllocatorDefault, handle, handleLen);
+	CFStringRef prompt = CFStringCreateWithCString(kCFAllocatorDefault, reason, kCFStringEncodingUTF8);
+	CFMutableDictionaryRef attrs = newDictionary();
+	CFDictionarySetValue(attrs, kSecAttrKeyType, kSecAttrKeyTypeECSECPrimeRandom);
+	CFDictionarySetValue(attrs, kSecAttrKeyClass, kSecAttrKeyClassPrivate);
+	CFDictionarySetValue(attrs, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	CFDictionarySetValue(attrs, kSecAttrTokenOID, oid);
+	CFDictionarySetValue(attrs, kSecUseOperationPrompt, prompt);
+	SecKeyRef key = SecKeyCreateWithData(oid, attrs, &err);
+	CFRelease(attrs);
+	CFRelease(prompt);
+	CFRelease(oid);
+	if (key == NULL) {
+		return takeError(err, msg, msgLen);
+	}
+	CFDataRef ciphertext = CFDataCreate(kCFAllocatorDefault, sealed, sealedLen);
+	*secret = SecKeyCreateDecryptedData(key, ENCLAVE_ALGORITHM, ciphertext, &err);
+	CFRelease(ciphertext);
+	CFRelease(key);
+	if (*secret == NULL) {
+		return takeError(err, msg, msgLen);
+	}
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// errSecUserCanceled is the code of an operation the user cancelled, such as
+// a Touch ID prompt.
+const errSecUserCanceled = -128
+
+var errEnclaveCanceled = errors.New("Touch ID was cancelled")
+
+// enclaveError returns the error of the Secure Enclave for code and the
+// description in msg.
+func enclaveError(what string, code C.long, msg []byte) error {
+	if code == errSecUserCanceled {
+		return errEnclaveCanceled
+	}
+	description := C.GoString((*C.char)(unsafe.Pointer(&msg[0])))
+	if description == "" {
+		description = "unknown error"
+	}
+	return fmt.Errorf("the Secure Enclave could not %v: %v (%v)", what, description, code)
+}
+
+// cfBytes returns a copy of the contents of data, and releases it.
+func cfBytes(data C.CFDataRef) []byte {
+	defer C.CFRelease(C.CFTypeRef(data))
+	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(data)), C.int(C.CFDataGetLength(data)))
+}
+
+// enclaveSeal creates a key in the Secure Enclave that can only be used after
+// Touch ID, and seals secret with it. It returns the handle to the key and
+// the sealed secret.
+func enclaveSeal(secret []byte) (handle, sealed []byte, err error) {
+	var h, s C.CFDataRef
+	msg := make([]byte, 256)
+	code := C.seal((*C.UInt8)(unsafe.Pointer(&secret[0])), C.CFIndex(len(secret)), &h, &s, (*C.char)(unsafe.Pointer(&msg[0])), C.size_t(len(msg)))
+	if code != 0 {
+		return nil, nil, enclaveError("create a key", code, msg)
+	}
+	return cfBytes(h), cfBytes(s), nil
+}
+
+// enclaveUnseal unseals sealed with the Secure Enclave key of handle, which
+// asks for Touch ID to reason.
+func enclaveUnseal(handle, sealed []byte, reason string) ([]byte, error) {
+	var s C.CFDataRef
+	msg := make([]byte, 256)
+	cReason := C.CString(reason)
+	defer C.free(unsafe.Pointer(cReason))
+	code := C.unseal((*C.UInt8)(unsafe.Pointer(&handle[0])), C.CFIndex(len(handle)), (*C.UInt8)(unsafe.Pointer(&sealed[0])), C.CFIndex(len(sealed)), cReason, &s, (*C.char)(unsafe.Pointer(&msg[0])), C.size_t(len(msg)))
+	if code != 0 {
+		return nil, enclaveError("unseal the identity", code, msg)
+	}
+	return cfBytes(s), nil
+}
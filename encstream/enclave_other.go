@@ -0,0 +1,15 @@
+//go:build !darwin || !cgo
+
+package encstream
+
+// enclaveSeal fails, as there is no Secure Enclave on this platform, or enc
+// was built without cgo.
+func enclaveSeal(secret []byte) (handle, sealed []byte, err error) {
+	return nil, nil, errNoEnclave
+}
+
+// enclaveUnseal fails, as there is no Secure Enclave on this platform, or enc
+// was built without cgo.
+func enclaveUnseal(handle, sealed []byte, reason string) ([]byte, error) {
+	return nil, errNoEnclave
+}
@@ -0,0 +1,113 @@
+package encstream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// enc exec runs a command with environment variables decrypted from env
+// files, so that CI jobs and scripts can use secrets without writing them to
+// disk or putting them on the command line, where they end up in shell
+// history and process listings. An env file holds a KEY=VALUE per line, as
+// for docker --env-file and systemd's EnvironmentFile=: blank lines and lines
+// starting with # are skipped, a leading "export " is allowed, and a value
+// may be quoted with single or double quotes, which are removed. The
+// variables are added to enc's own environment, replacing any of the same
+// name, and on unix enc replaces itself with the command, so that signals and
+// the exit status are the command's own.
+
+var errEnvLine = errors.New("expected KEY=VALUE")
+
+// parseEnvFile parses the contents of an env file into its variables, in
+// order.
+func parseEnvFile(b []byte) ([]string, error) {
+	var vars []string
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		text := strings.TrimSpace(string(line))
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %v: %v", i+1, errEnvLine)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars = append(vars, key+"="+value)
+	}
+	return vars, nil
+}
+
+// readEnvFiles decrypts the env files names with keys and returns their
+// variables, in order.
+func readEnvFiles(keys keySource, names []string) ([]string, error) {
+	var vars []string
+	for _, name := range names {
+		f, err := openEncrypted(name)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := decryptToMemory(keys, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		parsed, err := parseEnvFile(plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		vars = append(vars, parsed...)
+	}
+	return vars, nil
+}
+
+// mergeEnv returns environ with vars added, replacing the variables of the
+// same name.
+func mergeEnv(environ []string, vars []string) []string {
+	set := make(map[string]bool)
+	for _, v := range vars {
+		key, _, _ := strings.Cut(v, "=")
+		set[key] = true
+	}
+	var merged []string
+	for _, v := range environ {
+		key, _, _ := strings.Cut(v, "=")
+		if !set[key] {
+			merged = append(merged, v)
+		}
+	}
+	return append(merged, vars...)
+}
+
+// execMain implements `enc exec`, which runs a command with the variables of
+// encrypted env files.
+func execMain(args []string) {
+	fs := newFlagSet("exec", "enc exec -env secrets.env.enc [-env ...] -- command [args...]")
+	var envFiles, identityFiles stringList
+	fs.Var(&envFiles, "env", "add the variables of this encrypted env file; may be repeated")
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, false, false)
+	// the command's arguments are its own, so flags are not parsed after it.
+	fs.Parse(args)
+	command := fs.Args()
+
+	if len(envFiles) == 0 || len(command) == 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	vars, err := readEnvFiles(p.keys(identityFiles, p.limits()), envFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(runCommand(command, mergeEnv(os.Environ(), vars)))
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package encstream
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// runCommand runs command with the environment env, and exits with its exit
+// status.
+func runCommand(command []string, env []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,35 @@
+package encstream
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseEnvFile verifies the env files enc exec reads and how their
+// variables are added to the environment.
+func TestParseEnvFile(t *testing.T) {
+	vars, err := parseEnvFile([]byte(`# deploy secrets
+TOKEN=abc=def
+
+export AWS_REGION = eu-west-1
+PASSWORD="hunter 2"
+QUOTE='"'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"TOKEN=abc=def", "AWS_REGION=eu-west-1", "PASSWORD=hunter 2", `QUOTE="`}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Fatalf("expected %q, got %q", expected, vars)
+	}
+	for _, bad := range []string{"TOKEN", "=value", "A B=c"} {
+		if _, err := parseEnvFile([]byte(bad)); err == nil {
+			t.Fatalf("%q was accepted", bad)
+		}
+	}
+
+	merged := mergeEnv([]string{"PATH=/bin", "TOKEN=old"}, []string{"TOKEN=new"})
+	if !reflect.DeepEqual(merged, []string{"PATH=/bin", "TOKEN=new"}) {
+		t.Fatal("bad environment:", merged)
+	}
+}
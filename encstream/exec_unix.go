@@ -0,0 +1,17 @@
+//go:build unix
+
+package encstream
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// runCommand replaces enc with command, run with the environment env.
+func runCommand(command []string, env []string) error {
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, command, env)
+}
@@ -0,0 +1,56 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A file can record a not-after time in its header, for secrets that are
+// rotated on a schedule. Like the label, it is readable without the key and
+// covered by the MAC. Decrypting a file after it has expired prints a
+// warning, or fails if expiry is enforced.
+
+var errExpired = errors.New("the file has expired")
+
+// expiryString formats the not-after time t, in Unix seconds.
+func expiryString(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+// parseExpiry parses a not-after time given either as a date, as an RFC 3339
+// timestamp, or as a duration from now, which may be given in days with a d
+// suffix.
+func parseExpiry(s string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days > 0 {
+			return now.AddDate(0, 0, days), nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q; use a date, a timestamp or a duration such as 30d", s)
+}
+
+// enforceExpiry refuses to derive the keys of expired files. The expiry is
+// checked before the MAC, but that only lets a forged header cause a refusal,
+// which the MAC check would have caused anyway.
+type enforceExpiry struct {
+	keySource
+	now func() time.Time
+}
+
+func (e enforceExpiry) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if header.expired(e.now()) {
+		return sk, macKey, fmt.Errorf("%v on %v", errExpired, expiryString(header.NotAfter))
+	}
+	return e.keySource.fileKeys(header)
+}
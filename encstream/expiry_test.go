@@ -0,0 +1,52 @@
+package encstream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExpiry verifies that expired files can still be decrypted unless
+// expiry is enforced.
+func TestExpiry(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for s, want := range map[string]time.Time{
+		"2024-07-01":           time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		"2024-07-01T12:00:00Z": time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC),
+		"30d":                  now.AddDate(0, 0, 30),
+		"36h":                  now.Add(36 * time.Hour),
+	} {
+		got, err := parseExpiry(s, now)
+		if err != nil || !got.Equal(want) {
+			t.Fatalf("parseExpiry(%q) = %v, %v; wanted %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "soon", "-3d", "0d", "-1h"} {
+		if _, err := parseExpiry(s, now); err == nil {
+			t.Fatalf("parseExpiry(%q) succeeded", s)
+		}
+	}
+
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := new(memoryOutput)
+	opts := encryptOptions{recipients: []recipient{id.public}, notAfter: now}
+	if _, _, _, err := encryptTo(nil, bytes.NewReader([]byte("rotate me")), output, 0, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openCiphertext(identityKeys{id}, bytes.NewReader(output.buf)); err != nil {
+		t.Fatal("an expired file could not be decrypted without enforcement:", err)
+	}
+	before := enforceExpiry{keySource: identityKeys{id}, now: func() time.Time { return now }}
+	if _, _, err := openCiphertext(before, bytes.NewReader(output.buf)); err != nil {
+		t.Fatal(err)
+	}
+	after := enforceExpiry{keySource: identityKeys{id}, now: func() time.Time { return now.Add(time.Second) }}
+	_, _, err = openCiphertext(after, bytes.NewReader(output.buf))
+	if err == nil || !strings.HasPrefix(err.Error(), errExpired.Error()) {
+		t.Fatal("expected an expiry error, got", err)
+	}
+}
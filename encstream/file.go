@@ -0,0 +1,1114 @@
+package encstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// KDF constants
+const (
+	// the choice of parameters here is aggressive, since `enc` is meant to be used
+	// as a form of at-rest encryption. 4 passes over 4GB.
+	defaultArgonTime   = 4   // 4 passes
+	defaultArgonMemory = 4e6 // 4GB
+
+	// maxLanes is the most Argon2 lanes keys can be derived with, since
+	// x/crypto/argon2 takes them as a byte, and so the most -threads allows.
+	maxLanes = 255
+	// argon2MaxLanes is the most lanes Argon2 allows, and so the most a
+	// header can record.
+	argon2MaxLanes = 1<<24 - 1
+
+	saltSize = 32 // bytes
+	keyLen   = 32
+	macLen   = 32
+)
+
+var (
+	errBadMAC     = errors.New("authentication failed")
+	errNotArchive = errors.New("input is not an archive")
+	errWeakKDF    = errors.New("refusing to reuse KDF parameters weaker than the defaults")
+
+	errVerifyFailed = errors.New("verification failed: the written file does not decrypt to the input")
+
+	errNotSeekable   = errors.New("the output cannot seek")
+	errStreamOptions = errors.New("armor, volumes, recovery records, signatures, plaintext digests, -no-metadata and -verify cannot be used when writing to a stream")
+	errThreads       = fmt.Errorf("-threads must be between 1 and %v", maxLanes)
+	errArgonLanes    = fmt.Errorf("the file asks for Argon2id with more than the %v lanes enc can derive keys with", maxLanes)
+)
+
+// deriveKeys derives the secret key and MAC key described by header, which
+// asks for at most maxLanes lanes, from passphrase.
+func deriveKeys(passphrase []byte, header fileHeader) (sk [32]byte, macKey [32]byte) {
+	skb := argon2.IDKey(passphrase, header.Salt[:], header.ArgonTime, header.ArgonMemory, uint8(header.ArgonLanes), keyLen+macLen)
+	copy(sk[:], skb[:keyLen])
+	copy(macKey[:], skb[keyLen:])
+	return sk, macKey
+}
+
+// openCiphertext reads the header from input, derives the file keys from
+// keys and verifies the MAC over the entire file. It returns the header
+// and a DecReader positioned at the start of the ciphertext.
+func openCiphertext(keys keySource, input io.ReadSeeker) (fileHeader, *DecReader, error) {
+	return openCiphertextLimit(keys, input, defaultDecoderLimits(), time.Now())
+}
+
+// openCiphertextLimit is openCiphertext, within limits, warning if the file
+// has expired by now.
+func openCiphertextLimit(keys keySource, input io.ReadSeeker, limits decoderLimits, now time.Time) (fileHeader, *DecReader, error) {
+	_, err := input.Seek(0, 0)
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+	header, err := readHeaderLimit(input, limits.maxHeaderSize)
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+	sk, macKey, err := keys.fileKeys(header)
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+	plaintext, err := authenticate(input, header, sk, macKey, WithMaxSize(limits.maxPlaintextSize))
+	settleKeys(keys, header, err == nil)
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+	if header.expired(now) {
+		log.Println("warning: the file expired on", expiryString(header.NotAfter))
+	}
+	return header, plaintext, nil
+}
+
+// authenticate verifies the MAC over the ciphertext that follows header in
+// input using macKey. It returns a DecReader positioned at the start of the
+// ciphertext, configured with opts on top of the options of the file.
+func authenticate(input io.ReadSeeker, header fileHeader, sk [32]byte, macKey [32]byte, opts ...StreamOption) (*DecReader, error) {
+	// a header that was altered, or a wrong key, is caught before the
+	// ciphertext is read.
+	err := header.checkHeader(macKey)
+	if err != nil {
+		return nil, err
+	}
+	// grab the offset where the ciphertext starts, after decoding the header
+	ciphertextOffset, err := input.Seek(0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// files written to streams carry the MAC after the ciphertext.
+	end, err := input.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	tag := header.Tag
+	ciphertextLen := end - ciphertextOffset
+	if header.Flags&flagTrailerMAC != 0 {
+		ciphertextLen -= int64(len(tag))
+		if ciphertextLen < 0 {
+			return nil, errBadMAC
+		}
+		_, err = input.Seek(-int64(len(tag)), io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(input, tag[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = input.Seek(ciphertextOffset, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// verify the authenticity of the header and the entire ciphertext before
+	// performing any decryption operations.
+	hash, err := newFileMAC(header, macKey)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(hash, input, ciphertextLen)
+	if err != nil {
+		return nil, err
+	}
+	header.macDigest(hash)
+	var mac [64]byte
+	copy(mac[:], hash.Sum(nil))
+	if subtle.ConstantTimeCompare(mac[:], tag[:]) != 1 {
+		return nil, errBadMAC
+	}
+
+	// seek back to the start of the ciphertext, ready for decryption. The
+	// MAC covers any deniable region, but it is not part of the plaintext.
+	if header.Reserved > ciphertextLen {
+		return nil, errBadHeader
+	}
+	ciphertextLen -= header.Reserved
+	_, err = input.Seek(ciphertextOffset, 0)
+	if err != nil {
+		return nil, err
+	}
+	fileOpts := header.chunkOptions()
+	if header.Version == 0 {
+		newAEAD, err := legacyAEAD(io.LimitReader(input, ciphertextLen), sk)
+		if err != nil {
+			return nil, err
+		}
+		_, err = input.Seek(ciphertextOffset, 0)
+		if err != nil {
+			return nil, err
+		}
+		fileOpts = []StreamOption{WithAEAD(newAEAD)}
+	}
+	if header.Flags&flagPadded != 0 {
+		length, err := openLength(sk, header.Length)
+		if err != nil {
+			return nil, err
+		}
+		fileOpts = append(fileOpts, WithLimit(length))
+	}
+	fileOpts = append(fileOpts, WithParallelism(workers()))
+	plaintext := NewReader(sk, io.LimitReader(input, ciphertextLen), append(fileOpts, opts...)...)
+	return plaintext, nil
+}
+
+// verifyOutput decrypts the encrypted file at name using sk and macKey, and
+// checks that the plaintext hashes to sum.
+func verifyOutput(name string, sk [32]byte, macKey [32]byte, sum []byte) error {
+	f, err := openEncrypted(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header, err := readHeader(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errVerifyFailed, err)
+	}
+	plaintext, err := authenticate(f, header, sk, macKey)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errVerifyFailed, err)
+	}
+	hash, err := blake2b.New256(nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(hash, plaintext)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errVerifyFailed, err)
+	}
+	if subtle.ConstantTimeCompare(hash.Sum(nil), sum) != 1 {
+		return errVerifyFailed
+	}
+	return nil
+}
+
+// decryptFile decrypts input to finalOutput, or to stdout if it is "-". If
+// input is an archive, it is extracted into the directory finalOutput, or
+// written to stdout as a tar stream, optionally limited to the entries under
+// paths.
+func decryptFile(keys keySource, input io.ReadSeeker, finalOutput string, paths ...string) error {
+	return decryptTo(keys, input, finalOutput, extractOptions{paths: paths})
+}
+
+// decryptTo is decryptFile, extracting archives as described by opts.
+func decryptTo(keys keySource, input io.ReadSeeker, finalOutput string, opts extractOptions) error {
+	header, plaintext, err := openCiphertext(keys, input)
+	if err != nil {
+		return err
+	}
+	return writePlaintext(header, plaintext.secretKey, plaintext, finalOutput, opts)
+}
+
+// writePlaintext writes the plaintext of the file described by header, whose
+// chunks are sealed with sk, to finalOutput as decryptTo does.
+func writePlaintext(header fileHeader, sk [32]byte, plaintext io.Reader, finalOutput string, opts extractOptions) error {
+	var digest *digestReader
+	if header.Flags&flagDigest != 0 {
+		digest = newDigestReader(header, sk, plaintext)
+		plaintext = digest
+	}
+	if header.Flags&flagArchive != 0 {
+		var err error
+		if finalOutput == "-" {
+			err = writeTar(plaintext, os.Stdout, opts.paths)
+		} else {
+			_, err = extractArchive(plaintext, finalOutput, opts)
+		}
+		if err == nil && digest != nil {
+			err = digest.check()
+		}
+		return err
+	}
+	if len(opts.paths) > 0 {
+		return errNotArchive
+	}
+
+	output, err := createPlaintext(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	_, err = io.Copy(output, plaintext)
+	if err != nil {
+		return err
+	}
+	// a plaintext that does not match its digest is not renamed into place.
+	if digest != nil {
+		err = digest.check()
+		if err != nil {
+			return err
+		}
+	}
+	return output.commit()
+}
+
+// listArchiveFile prints the entries of the encrypted archive input to w, as
+// JSON if asJSON is set.
+func listArchiveFile(keys keySource, input io.ReadSeeker, w io.Writer, asJSON bool) error {
+	header, plaintext, err := openCiphertext(keys, input)
+	if err != nil {
+		return err
+	}
+	if header.Flags&flagArchive == 0 {
+		return errNotArchive
+	}
+	if asJSON {
+		return listArchiveJSON(plaintext, w)
+	}
+	return listArchive(plaintext, w)
+}
+
+// verifyExtracted checks the files extracted from the encrypted archive input
+// into dir against the archive's manifest, reporting problems to w.
+func verifyExtracted(keys keySource, input io.ReadSeeker, dir string, w io.Writer) error {
+	header, plaintext, err := openCiphertext(keys, input)
+	if err != nil {
+		return err
+	}
+	if header.Flags&flagArchive == 0 {
+		return errNotArchive
+	}
+	m, err := readManifest(plaintext)
+	if err != nil {
+		return err
+	}
+	return m.verify(dir, w)
+}
+
+// rsyncableOptions returns the options for encrypting to output such that
+// re-encrypting a modified input over an earlier version only changes the
+// ciphertext around the modifications, which lets tools like rsync transfer
+// just the changes. If output already holds a deduplicated encryption, its key
+// is reused.
+func rsyncableOptions(output string) encryptOptions {
+	opts := encryptOptions{dedup: true}
+	header, err := readHeaderFile(output)
+	if err == nil && header.Flags&flagDedup != 0 {
+		opts.dedupWith = &header
+	}
+	return opts
+}
+
+// readHeaderFile reads the header of the encrypted file at path.
+func readHeaderFile(path string) (fileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer f.Close()
+	return readHeader(f)
+}
+
+// newHeader creates a header with a fresh salt and the default KDF
+// parameters.
+func newHeader() (fileHeader, error) {
+	return newHeaderRand(rand.Reader)
+}
+
+// newHeaderRand is newHeader, with the salt read from random.
+func newHeaderRand(random io.Reader) (fileHeader, error) {
+	var salt [32]byte
+	err := readRandom(random, salt[:])
+	if err != nil {
+		return fileHeader{}, err
+	}
+	h := fileHeader{
+		Version:     fileVersion,
+		Salt:        salt,
+		ArgonTime:   defaultArgonTime,
+		ArgonMemory: defaultArgonMemory,
+		ArgonLanes:  uint32(workers()),
+	}
+	if budget := kdfMemoryBudget(); h.ArgonMemory > budget {
+		h.ArgonMemory = budget
+	}
+	// every lane needs 8 KiB.
+	if h.ArgonMemory < 8*h.ArgonLanes {
+		h.ArgonLanes = h.ArgonMemory / 8
+	}
+	err = h.checkKDF()
+	if err != nil {
+		return fileHeader{}, err
+	}
+	return h, nil
+}
+
+// defaultThreads returns the default of -threads: one per CPU, as many as a
+// header can record.
+func defaultThreads() int {
+	if runtime.NumCPU() > maxLanes {
+		return maxLanes
+	}
+	return runtime.NumCPU()
+}
+
+// setThreads applies -threads, refusing values that are not between 1 and
+// maxLanes.
+func setThreads(threads int) error {
+	if threads < 1 || threads > maxLanes {
+		return errThreads
+	}
+	runtime.GOMAXPROCS(threads)
+	return nil
+}
+
+// workers returns how many threads -threads and -max-memory allow, which is
+// the number of Argon2 lanes of new files and of chunks sealed or opened at a
+// time.
+func workers() int {
+	if runtime.GOMAXPROCS(0) > maxLanes {
+		return fitWorkers(maxLanes)
+	}
+	return fitWorkers(runtime.GOMAXPROCS(0))
+}
+
+// encryptOptions configures how encrypt writes a file.
+type encryptOptions struct {
+	// dedup selects content-defined chunking and convergent encryption.
+	dedup bool
+	// dedupWith, if set, is the header of an earlier version of the file
+	// whose salt and KDF parameters are reused, so that both versions are
+	// encrypted under the same key and unchanged chunks are identical.
+	dedupWith *fileHeader
+	// volumeSize, if non-zero, splits the output into volumes of this size.
+	volumeSize int64
+	// recovery, if non-zero, appends recovery records amounting to this
+	// percentage of the file.
+	recovery float64
+	// verify re-reads and decrypts the output after writing it, checking
+	// that it decrypts to the input.
+	verify bool
+	// armor writes the output as ASCII armor.
+	armor bool
+	// label and metadata are recorded in the header, readable without the
+	// key.
+	label    string
+	metadata []metadataField
+	// recipients, if any, are the keys the output is encrypted to instead of
+	// the passphrase. fullKeyID identifies them in the header by their full
+	// fingerprint rather than a short prefix of it. antiForensic stores
+	// the wrapped file keys split over several KiB; see afsplit.go.
+	recipients   []recipient
+	fullKeyID    bool
+	antiForensic bool
+	// fips restricts the algorithms to FIPS 140 approved ones; see fips.go.
+	fips bool
+	// suite, if not the default, is the cipher suite of the output, which
+	// -fips sets instead.
+	suite uint8
+	// notAfter, if not zero, is recorded in the header as the time after
+	// which the output has expired.
+	notAfter time.Time
+	// progress and kdfProgress, if set, are called as the input is read and
+	// around key derivation; see WithProgress and WithKDFProgress.
+	progress    func(bytesDone, bytesTotal int64)
+	kdfProgress func(phase KDFPhase)
+	// ctx, if set, cancels the encryption; see EncryptContext.
+	ctx context.Context
+	// handshake, if set, is called once the header has been written, and
+	// the encryption fails if it does; see transfer.go.
+	handshake func(header fileHeader, encoded []byte, macKey [32]byte) error
+	// mmap reads regular input files through a memory map; see mapFile.
+	mmap bool
+	// noCache drops the input and output files from the page cache as they
+	// are read and written; see nocache.go.
+	noCache bool
+	// uring reads regular input files and writes the output through
+	// io_uring where it is available; see uring.go. -mmap and -no-cache
+	// take precedence.
+	uring bool
+	// bwlimit, if non-zero, limits how many bytes of input are read per
+	// second.
+	bwlimit int64
+	// shared, if set, is a key shared by a batch of files, of which the
+	// output's keys are a subkey; see batch.go. It is ignored when
+	// encrypting to recipients or with vault, and cannot be combined with
+	// fips or dedupWith.
+	shared *sharedKey
+	// vault, if set, gives the data key the output's keys are a subkey of,
+	// instead of the passphrase; see vault.go.
+	vault *VaultTransit
+	// signingKey, if set, signs the header and MAC of the output, so that
+	// decryption can require it; see sign.go.
+	signingKey ed25519.PrivateKey
+	// deniable, if non-zero, reserves a region of this size after the
+	// ciphertext, holding hidden encrypted with hiddenPassphrase if that is
+	// set, or random bytes otherwise; see hidden.go.
+	deniable         int64
+	hidden           []byte
+	hiddenPassphrase []byte
+	// noMetadata pads the plaintext and refuses anything recorded in the
+	// header that need not be; see nometadata.go.
+	noMetadata bool
+	// storeDigest records a digest of the plaintext in the header; see
+	// digest.go.
+	storeDigest bool
+	// resume checkpoints the encryption next to the output, and continues
+	// from the checkpoint if there is one; see resume.go.
+	resume bool
+	// rand, if set, is read for the salt, keys and nonces of the output
+	// instead of crypto/rand, for deterministic tests.
+	rand io.Reader
+	// archive says how directories are walked when they are encrypted as
+	// archives.
+	archive archiveOptions
+}
+
+// random returns the source of randomness of opts.
+func (opts encryptOptions) random() io.Reader {
+	if opts.rand != nil {
+		return opts.rand
+	}
+	return rand.Reader
+}
+
+// readRandom fills b from random, returning errEntropy if it cannot.
+func readRandom(random io.Reader, b []byte) error {
+	_, err := io.ReadFull(random, b)
+	if err != nil {
+		return fmt.Errorf("%v: %v", errEntropy, err)
+	}
+	return nil
+}
+
+func encryptFile(passphrase []byte, input *os.File, finalOutput string, opts encryptOptions) error {
+	_, err := input.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	if opts.mmap {
+		data, err := mapFile(input)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			defer unmapFile(data)
+			return encrypt(passphrase, bytes.NewReader(data), finalOutput, 0, opts)
+		}
+	}
+	if opts.noCache {
+		return encrypt(passphrase, uncachedInput(input), finalOutput, 0, opts)
+	}
+	if opts.uring {
+		if r, err := newUringReader(input); err == nil {
+			defer r.close()
+			return encrypt(passphrase, r, finalOutput, 0, opts)
+		}
+	}
+	return encrypt(passphrase, input, finalOutput, 0, opts)
+}
+
+// encryptArchive encrypts the directory tree rooted at root to finalOutput as
+// an archive, returning its manifest. Entry names and the directory structure
+// are only stored inside the ciphertext. If since is non-nil, the archive is
+// an incremental snapshot on top of it.
+func encryptArchive(passphrase []byte, root string, finalOutput string, since *manifest, opts encryptOptions) (manifest, error) {
+	if opts.resume {
+		return manifest{}, errResumeOptions
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	manifests := make(chan manifest, 1)
+	go func() {
+		m, err := writeArchive(root, pw, since, opts.archive)
+		manifests <- m
+		pw.CloseWithError(err)
+	}()
+	err := encrypt(passphrase, pr, finalOutput, flagArchive, opts)
+	if err != nil {
+		return manifest{}, err
+	}
+	return <-manifests, nil
+}
+
+// encryptOutput is the destination of an encryption. Nothing replaces the
+// final output until commit is called; abort discards everything written so
+// far and has no effect after commit.
+type encryptOutput interface {
+	io.WriteSeeker
+	commit() error
+	abort()
+}
+
+// atomicFile is an encryptOutput written to a temporary file, which replaces
+// the named file on commit.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+func createAtomic(name string) (*atomicFile, error) {
+	f, err := os.Create(name + ".temp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, name: name}, nil
+}
+
+// preallocate reserves size bytes of disk space for the file.
+func (f *atomicFile) preallocate(size int64) error {
+	return preallocate(f.File, size)
+}
+
+func (f *atomicFile) commit() error {
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), f.name)
+}
+
+func (f *atomicFile) abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// memoryOutput is an encryptOutput held in memory.
+type memoryOutput struct {
+	buf []byte
+	pos int64
+}
+
+// Write implements io.Writer.
+func (m *memoryOutput) Write(p []byte) (int, error) {
+	if end := m.pos + int64(len(p)); end > int64(len(m.buf)) {
+		m.buf = append(m.buf, make([]byte, end-int64(len(m.buf)))...)
+	}
+	copy(m.buf[m.pos:], p)
+	m.pos += int64(len(p))
+	return len(p), nil
+}
+
+// Seek implements io.Seeker.
+func (m *memoryOutput) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.buf))
+	}
+	if offset < 0 {
+		return m.pos, errors.New("negative seek")
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+func (m *memoryOutput) commit() error { return nil }
+func (m *memoryOutput) abort()        {}
+
+// streamOutput is an encryptOutput that writes straight to a stream, such as
+// a pipe or a tape, which cannot seek. Files written to it carry their MAC in
+// a trailer. Nothing can be taken back once written, so abort has no effect.
+type streamOutput struct {
+	io.Writer
+}
+
+// Seek implements io.Seeker, but always fails.
+func (s streamOutput) Seek(offset int64, whence int) (int64, error) {
+	return 0, errNotSeekable
+}
+
+func (s streamOutput) commit() error { return nil }
+func (s streamOutput) abort()        {}
+
+// seekable reports whether output can seek back to fill in the MAC.
+func seekable(output encryptOutput) bool {
+	_, err := output.Seek(0, io.SeekCurrent)
+	return err == nil
+}
+
+// createOutput creates the encryptOutput for finalOutput described by opts.
+func createOutput(finalOutput string, opts encryptOptions) (encryptOutput, error) {
+	if finalOutput == "-" {
+		if opts.armor || opts.volumeSize > 0 || opts.recovery > 0 || opts.verify || opts.signingKey != nil || opts.storeDigest {
+			return nil, errStreamOptions
+		}
+		return streamOutput{os.Stdout}, nil
+	}
+	if opts.resume {
+		err := checkResume(finalOutput, opts)
+		if err != nil {
+			return nil, err
+		}
+		return createResumable(finalOutput)
+	}
+	if opts.armor {
+		if opts.volumeSize > 0 || opts.recovery > 0 {
+			return nil, errArmorOptions
+		}
+		return createArmored(finalOutput)
+	}
+	if opts.volumeSize > 0 {
+		return newVolumeWriter(finalOutput, opts.volumeSize, opts.noMetadata, opts.random())
+	}
+	f, err := createAtomic(finalOutput)
+	if err != nil {
+		return nil, err
+	}
+	if opts.noCache {
+		return newUncachedOutput(f), nil
+	}
+	if opts.uring {
+		if u, err := newUringOutput(f); err == nil {
+			return u, nil
+		}
+	}
+	return f, nil
+}
+
+// createPlaintext creates the output that plaintext is decrypted to. If
+// finalOutput is "-", it is stdout, which is written to directly rather than
+// through a temporary file, so what was written before a failure cannot be
+// taken back.
+func createPlaintext(finalOutput string) (encryptOutput, error) {
+	if finalOutput == "-" {
+		return streamOutput{os.Stdout}, nil
+	}
+	return createAtomic(finalOutput)
+}
+
+// encrypt encrypts the plaintext read from input to finalOutput, recording
+// flags in the header.
+func encrypt(passphrase []byte, input io.Reader, finalOutput string, flags uint32, opts encryptOptions) error {
+	output, err := createOutput(finalOutput, opts)
+	if err != nil {
+		return err
+	}
+	return encryptVerified(passphrase, input, output, finalOutput, flags, opts)
+}
+
+// encryptVerified is encrypt, writing to output, which commits to
+// finalOutput. With opts.verify, the committed file is then decrypted, and
+// removed if it does not decrypt to the input, so that a file that fails
+// verification is not mistaken for a good one.
+func encryptVerified(passphrase []byte, input io.Reader, output encryptOutput, finalOutput string, flags uint32, opts encryptOptions) error {
+	sk, macKey, sum, err := encryptTo(passphrase, input, output, flags, opts)
+	if err != nil || !opts.verify {
+		return err
+	}
+	err = verifyOutput(finalOutput, sk, macKey, sum)
+	if err != nil {
+		removeOutput(finalOutput, opts)
+	}
+	return err
+}
+
+// removeOutput removes the file, or the volumes, written to finalOutput.
+func removeOutput(finalOutput string, opts encryptOptions) {
+	if opts.volumeSize == 0 {
+		os.Remove(finalOutput)
+		return
+	}
+	for i := 1; os.Remove(volumeName(finalOutput, i)) == nil; i++ {
+	}
+}
+
+// ciphertextSize predicts the size of a file with a header of headerSize bytes
+// that encrypts size bytes of plaintext, with recovery records amounting to
+// recovery percent. Every chunk but the last is full, and the last may be
+// empty. Deduplicated files have smaller chunks, and so are somewhat larger.
+func ciphertextSize(headerSize int64, size int64, recovery float64) int64 {
+	chunks := size/maxChunkSize + 1
+	total := headerSize + size + chunks*(24+8+tagSize)
+	return total + int64(float64(total)*recovery/100)
+}
+
+// newFileHeader returns the header of a new file described by flags and opts,
+// recording a trailer MAC if the output cannot seek. The header is complete
+// but for the recipient stanzas and the MAC.
+func newFileHeader(flags uint32, opts encryptOptions, trailer bool) (fileHeader, error) {
+	header, err := newHeaderRand(opts.random())
+	if err != nil {
+		return fileHeader{}, fmt.Errorf("could not generate secret key: %v", err)
+	}
+	header.Flags = flags
+	err = checkMetadata(opts.metadata)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	err = checkLabel(opts.label)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	header.Label = opts.label
+	header.Metadata = opts.metadata
+	if !opts.notAfter.IsZero() {
+		header.NotAfter = opts.notAfter.Unix()
+	}
+	if opts.fips {
+		if len(opts.recipients) > 0 || opts.dedup || opts.dedupWith != nil {
+			return fileHeader{}, errFIPSOptions
+		}
+		header.Suite = suiteFIPS
+		header.Iterations = defaultPBKDF2Iterations
+	}
+	if opts.suite != suiteDefault {
+		if opts.fips {
+			return fileHeader{}, errCipherFIPS
+		}
+		header.Suite = opts.suite
+	}
+	if opts.dedupWith != nil {
+		if len(opts.recipients) > 0 {
+			return fileHeader{}, errRecipientsKDF
+		}
+		// the earlier version's header has not been authenticated, so don't
+		// let it weaken the KDF.
+		if opts.dedupWith.ArgonTime < defaultArgonTime || opts.dedupWith.ArgonMemory < defaultArgonMemory {
+			return fileHeader{}, errWeakKDF
+		}
+		err = defaultLimits().check(*opts.dedupWith)
+		if err != nil {
+			return fileHeader{}, err
+		}
+		opts.dedup = true
+		// the key is the earlier version's, so its cipher is kept too.
+		header.Suite = opts.dedupWith.Suite
+		header.Salt = opts.dedupWith.Salt
+		header.ArgonTime = opts.dedupWith.ArgonTime
+		header.ArgonMemory = opts.dedupWith.ArgonMemory
+		header.ArgonLanes = opts.dedupWith.ArgonLanes
+	}
+	if opts.dedup {
+		header.Flags |= flagDedup
+	}
+	if trailer {
+		if opts.recovery > 0 || opts.signingKey != nil || opts.noMetadata || opts.storeDigest {
+			return fileHeader{}, errStreamOptions
+		}
+		header.Flags |= flagTrailerMAC
+	}
+	if opts.noMetadata {
+		if opts.label != "" || len(opts.metadata) > 0 || !opts.notAfter.IsZero() || opts.signingKey != nil || opts.fullKeyID || opts.dedup || opts.dedupWith != nil || opts.deniable != 0 || opts.storeDigest {
+			return fileHeader{}, errNoMetadata
+		}
+		header.Flags |= flagPadded
+	}
+	if opts.storeDigest {
+		header.Flags |= flagDigest
+	}
+	if opts.signingKey != nil {
+		copy(header.Signer[:], opts.signingKey.Public().(ed25519.PublicKey))
+	}
+	if opts.deniable != 0 {
+		if len(opts.recipients) > 0 || opts.fips {
+			return fileHeader{}, errHiddenOptions
+		}
+		err = checkHiddenSize(opts.deniable)
+		if err != nil {
+			return fileHeader{}, err
+		}
+		header.Reserved = opts.deniable
+	}
+	if opts.vault != nil {
+		if len(opts.recipients) > 0 || opts.fips || opts.dedupWith != nil || opts.deniable != 0 || opts.noMetadata {
+			return fileHeader{}, errVaultOptions
+		}
+		return header, nil
+	}
+	if len(opts.recipients) == 0 && opts.shared != nil {
+		if opts.fips || opts.dedupWith != nil {
+			return fileHeader{}, errSharedOptions
+		}
+		header.Salt = opts.shared.header.Salt
+		header.ArgonTime = opts.shared.header.ArgonTime
+		header.ArgonMemory = opts.shared.header.ArgonMemory
+		header.ArgonLanes = opts.shared.header.ArgonLanes
+		err = readRandom(opts.random(), header.Subkey[:])
+		if err != nil {
+			return fileHeader{}, err
+		}
+	}
+	return header, nil
+}
+
+// wrapFileKey generates the key of a file encrypted to the recipients in
+// opts, and adds a stanza wrapping it for each of them to header.
+func wrapFileKey(header *fileHeader, opts encryptOptions) (fileKey [32]byte, err error) {
+	err = readRandom(opts.random(), fileKey[:])
+	if err != nil {
+		return fileKey, err
+	}
+	keyIDSize := shortKeyIDSize
+	if opts.fullKeyID {
+		keyIDSize = fullKeyIDSize
+	}
+	if opts.noMetadata {
+		keyIDSize = 0
+	}
+	for _, r := range opts.recipients {
+		stanza, err := r.wrap(fileKey, keyIDSize, opts.random())
+		if err != nil {
+			return fileKey, err
+		}
+		if opts.antiForensic {
+			stanza, err = splitStanza(stanza, opts.random())
+			if err != nil {
+				return fileKey, err
+			}
+		}
+		header.Recipients = append(header.Recipients, stanza)
+	}
+	return fileKey, nil
+}
+
+// encryptTo encrypts the plaintext read from input to output and commits it,
+// recording flags in the header. It returns the file keys and the BLAKE2b-256
+// digest of the plaintext, which are needed to verify the output.
+func encryptTo(passphrase []byte, input io.Reader, output encryptOutput, flags uint32, opts encryptOptions) (sk [32]byte, macKey [32]byte, sum []byte, err error) {
+	defer output.abort()
+	trailer := !seekable(output)
+	resumable, _ := output.(*resumableOutput)
+	var header fileHeader
+	if resumable != nil && resumable.header != nil {
+		// the rest of the header was written to the partial output, and is
+		// not written again.
+		header = *resumable.header
+		err = checkResumed(header, opts)
+		if err != nil {
+			return
+		}
+	} else {
+		header, err = newFileHeader(flags, opts, trailer)
+		if err != nil {
+			return
+		}
+	}
+	if opts.hiddenPassphrase != nil && bytes.Equal(opts.hiddenPassphrase, passphrase) {
+		err = errHiddenSameKey
+		return
+	}
+	switch {
+	case len(opts.recipients) > 0:
+		var fileKey [32]byte
+		fileKey, err = wrapFileKey(&header, opts)
+		if err != nil {
+			return
+		}
+		sk, macKey = keysFromFileKey(fileKey)
+	case opts.vault != nil:
+		sk, macKey, err = opts.vault.newFileKeys(&header, opts.random())
+		if err != nil {
+			return
+		}
+	case opts.shared != nil:
+		sk, macKey, err = subkeys(opts.shared.key, header.Subkey)
+		if err != nil {
+			return
+		}
+	default:
+		var keys keySource = newPassphraseKeys(passphrase)
+		if opts.kdfProgress != nil {
+			keys = kdfHooks{keys, opts.kdfProgress}
+		}
+		if opts.ctx != nil {
+			keys = contextKeys{keys, opts.ctx}
+		}
+		sk, macKey, err = keys.fileKeys(header)
+		if err != nil {
+			return
+		}
+	}
+	resuming := resumable != nil && resumable.header != nil
+	if resuming {
+		// the header was read from the partial output, and is checked
+		// against the one written there once its MAC is sealed.
+		if header.checkHeader(macKey) != nil {
+			err = errResumeMismatch
+			return
+		}
+	}
+	err = header.sealHeader(macKey)
+	if err != nil {
+		return
+	}
+	encodedHeader := header.encode()
+	if len(encodedHeader) > maxHeaderSize {
+		err = errHeaderTooLarge
+		return
+	}
+	inputSize := readerSize(input)
+	if p, ok := output.(interface{ preallocate(int64) error }); ok && inputSize > 0 && !resuming {
+		if opts.noMetadata {
+			inputSize = paddedSize(inputSize)
+		}
+		err = p.preallocate(ciphertextSize(int64(len(encodedHeader))+header.Reserved, inputSize, opts.recovery))
+		if err != nil {
+			return
+		}
+	}
+	if !resuming {
+		_, err = output.Write(encodedHeader)
+		if err != nil {
+			return
+		}
+	}
+	if opts.handshake != nil {
+		err = opts.handshake(header, encodedHeader, macKey)
+		if err != nil {
+			return
+		}
+	}
+
+	hash, err := newFileMAC(header, macKey)
+	if err != nil {
+		return
+	}
+	streamOpts := append(header.chunkOptions(), WithParallelism(workers()), WithNonceRand(opts.random()))
+	encWriter := NewWriter(sk, io.MultiWriter(hash, output), streamOpts...)
+	if header.Flags&flagDedup != 0 {
+		encWriter = NewDedupWriter(sk, io.MultiWriter(hash, output), streamOpts...)
+	}
+	plaintextHash, err := blake2b.New256(nil)
+	if err != nil {
+		return
+	}
+	digest := newDigest(header.Suite, sk)
+	var resume *resumption
+	var offset int64
+	if resumable != nil {
+		resume = &resumption{output: resumable, encodedHeader: encodedHeader, sk: sk, random: opts.random(), encWriter: encWriter}
+		resume.hashes[0] = plaintextHash
+		if header.Flags&flagDigest != 0 {
+			resume.hashes[1] = digest
+		}
+		if resuming {
+			offset, err = resume.resume(header, hash, input)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if opts.bwlimit > 0 {
+		input = &rateLimitedReader{r: input, rate: opts.bwlimit}
+	}
+	if opts.progress != nil {
+		input = &progressReader{r: input, done: offset, total: inputSize, f: opts.progress}
+	}
+	if opts.ctx != nil {
+		input = contextReader{opts.ctx, input}
+	}
+	// writing to both lets an input that is already in memory, such as a
+	// mapped file, be encrypted straight from it.
+	var plaintextWriter io.Writer = encWriter
+	var padding *paddingWriter
+	if header.Flags&flagPadded != 0 {
+		padding = &paddingWriter{w: encWriter}
+		plaintextWriter = padding
+	}
+	writers := []io.Writer{plaintextWriter, plaintextHash}
+	if header.Flags&flagDigest != 0 {
+		writers = append(writers, digest)
+	}
+	if resume != nil {
+		err = resume.copy(io.MultiWriter(writers...), input, offset)
+	} else {
+		_, err = io.Copy(io.MultiWriter(writers...), input)
+	}
+	if err != nil {
+		return
+	}
+	if padding != nil {
+		err = padding.Close()
+		if err != nil {
+			return
+		}
+		header.Length, err = sealLength(sk, padding.n, opts.random())
+		if err != nil {
+			return
+		}
+	}
+	err = encWriter.Close()
+	if err != nil {
+		return
+	}
+	if header.Reserved != 0 {
+		var region []byte
+		region, err = sealHidden(opts.hiddenPassphrase, opts.hidden, header.Reserved, header, opts.random())
+		if err != nil {
+			return
+		}
+		_, err = io.MultiWriter(hash, output).Write(region)
+		if err != nil {
+			return
+		}
+	}
+	if header.Flags&flagDigest != 0 {
+		copy(header.Digest[:], digest.Sum(nil))
+		header.macDigest(hash)
+	}
+
+	// the MAC is the last field of the header; go back and fill it in, or
+	// append it if the output cannot seek. A signature covers the MAC, so
+	// then the whole header is written again with both, as it is with the
+	// sealed length of a padded file and the digest of the plaintext.
+	switch {
+	case opts.signingKey != nil || header.Flags&(flagPadded|flagDigest) != 0:
+		copy(header.Tag[:], hash.Sum(nil))
+		if opts.signingKey != nil {
+			header.sign(opts.signingKey)
+		}
+		_, err = output.Seek(0, 0)
+		if err != nil {
+			return
+		}
+		_, err = output.Write(header.encode())
+	case trailer:
+		_, err = output.Write(hash.Sum(nil))
+	default:
+		_, err = output.Seek(int64(len(encodedHeader)-len(header.Tag)), 0)
+		if err != nil {
+			return
+		}
+		_, err = output.Write(hash.Sum(nil))
+	}
+	if err != nil {
+		return
+	}
+	if opts.recovery > 0 {
+		err = addRecovery(output, opts.recovery)
+		if err != nil {
+			return
+		}
+	}
+	err = output.commit()
+	return sk, macKey, plaintextHash.Sum(nil), err
+}
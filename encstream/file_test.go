@@ -0,0 +1,323 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFileEncryptDecrypt(t *testing.T) {
+	testDatumz := make([]byte, maxChunkSize*16)
+	io.ReadFull(rand.Reader, testDatumz)
+	ciphertextFile, err := ioutil.TempFile("", "enctest-ciphertext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ciphertextFile.Name())
+	plaintextFile, err := ioutil.TempFile("", "enctest-plaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(plaintextFile.Name())
+	plaintextFile.Write(testDatumz)
+
+	passphrase := []byte("hunter2")
+	err = encryptFile(passphrase, plaintextFile, ciphertextFile.Name(), encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertextFile, err = os.OpenFile(ciphertextFile.Name(), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outFile, err := ioutil.TempFile("", "enctest-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outFile.Name())
+	err = decryptFile(newPassphraseKeys(passphrase), ciphertextFile, outFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	outFile, err = os.Open(outFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(out, outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), testDatumz) {
+		t.Fatal("decryption resulted in different plaintexts")
+	}
+
+	// let's cleanly lop off a chunk to verify that the entire-file BLAKE mac
+	// detects this.
+	stat, _ := ciphertextFile.Stat()
+	ciphertextFile.Seek(0, 0)
+	err = ciphertextFile.Truncate(stat.Size() - int64(maxChunkSize+16+24+8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decryptFile(newPassphraseKeys(passphrase), ciphertextFile, outFile.Name())
+	if err == nil {
+		t.Fatal("undetected modification")
+	}
+	if err != errBadMAC {
+		t.Fatal(err)
+	}
+}
+
+// TestRsyncableOptions verifies that -rsyncable only reuses the key of an
+// existing output if it was encrypted with deduplication.
+func TestRsyncableOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-rsyncable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.enc")
+
+	opts := rsyncableOptions(output)
+	if !opts.dedup || opts.dedupWith != nil {
+		t.Fatal("a missing output should get a fresh key")
+	}
+
+	header, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(output, header.encode(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if opts := rsyncableOptions(output); opts.dedupWith != nil {
+		t.Fatal("reused the key of an output without deduplication")
+	}
+
+	header.Flags = flagDedup
+	if err := ioutil.WriteFile(output, header.encode(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts = rsyncableOptions(output)
+	if opts.dedupWith == nil || opts.dedupWith.Salt != header.Salt {
+		t.Fatal("did not reuse the key of the existing output")
+	}
+}
+
+// TestTrailerMAC verifies that files written to outputs that cannot seek
+// carry their MAC in a trailer, which is checked like the header MAC.
+func TestTrailerMAC(t *testing.T) {
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, maxChunkSize*3+100)
+	io.ReadFull(rand.Reader, plaintext)
+	stream := new(bytes.Buffer)
+	opts := encryptOptions{recipients: []recipient{id.public}}
+	_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), streamOutput{stream}, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := stream.Bytes()
+	header, r, err := openCiphertext(identityKeys{id}, bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Flags&flagTrailerMAC == 0 {
+		t.Fatal("the trailer MAC flag was not set")
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	truncated := ciphertext[:len(ciphertext)-maxChunkSize]
+	for _, c := range [][]byte{tampered, truncated} {
+		if _, _, err := openCiphertext(identityKeys{id}, bytes.NewReader(c)); err != errBadMAC {
+			t.Fatal("expected errBadMAC, got", err)
+		}
+	}
+}
+
+// flippingOutput is an encryptOutput that flips a bit of the second write to
+// it, like a disk that corrupts what it stores.
+type flippingOutput struct {
+	encryptOutput
+	writes int
+}
+
+func (f *flippingOutput) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes == 2 && len(p) > 0 {
+		p = append([]byte{}, p...)
+		p[0] ^= 1
+	}
+	return f.encryptOutput.Write(p)
+}
+
+// TestVerify verifies that -verify accepts a file that decrypts to the input,
+// and fails and removes one that does not.
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, maxChunkSize*3+100)
+	io.ReadFull(rand.Reader, plaintext)
+	opts := encryptOptions{recipients: []recipient{id.public}, verify: true}
+
+	for _, corrupt := range []bool{false, true} {
+		name := filepath.Join(dir, "encrypted")
+		file, err := createAtomic(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output encryptOutput = file
+		if corrupt {
+			output = &flippingOutput{encryptOutput: file}
+		}
+		err = encryptVerified(nil, bytes.NewReader(plaintext), output, name, 0, opts)
+		if !corrupt && err != nil {
+			t.Fatal(err)
+		}
+		if corrupt && (err == nil || !strings.HasPrefix(err.Error(), errVerifyFailed.Error())) {
+			t.Fatal("expected errVerifyFailed, got", err)
+		}
+		if _, err := os.Stat(name); corrupt != os.IsNotExist(err) {
+			t.Fatalf("corrupt %v: the output was not removed only if it failed verification: %v", corrupt, err)
+		}
+	}
+}
+
+// TestThreads verifies that -threads refuses counts that are not between 1
+// and maxLanes, and that new files record one lane per thread.
+func TestThreads(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for _, c := range []struct {
+		threads int
+		valid   bool
+	}{
+		{-1, false},
+		{0, false},
+		{1, true},
+		{3, true},
+		{maxLanes, true},
+		{maxLanes + 1, false},
+	} {
+		before := runtime.GOMAXPROCS(0)
+		err := setThreads(c.threads)
+		if !c.valid {
+			if err != errThreads || runtime.GOMAXPROCS(0) != before {
+				t.Fatalf("%v threads: expected errThreads, got %v", c.threads, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workers() != c.threads {
+			t.Fatalf("%v threads run %v workers", c.threads, workers())
+		}
+		h, err := newHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.ArgonLanes != uint32(c.threads) && h.ArgonMemory >= 8*uint32(c.threads) {
+			t.Fatalf("%v threads: new files record %v lanes", c.threads, h.ArgonLanes)
+		}
+	}
+}
+
+// TestPreallocate verifies that the predicted ciphertext size used to
+// preallocate the output matches the file written, which must not be padded
+// by the preallocation.
+func TestPreallocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-preallocate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := make([]byte, maxChunkSize*16+5)
+	plaintextFile := filepath.Join(dir, "plaintext")
+	err = ioutil.WriteFile(plaintextFile, plaintext, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := os.Open(plaintextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	ciphertextFile := filepath.Join(dir, "ciphertext")
+	err = encryptFile([]byte("hunter2"), input, ciphertextFile, encryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeaderFile(ciphertextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(ciphertextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if predicted := ciphertextSize(int64(len(header.encode())), int64(len(plaintext)), 0); info.Size() != predicted {
+		t.Fatal("predicted", predicted, "bytes, but the file has", info.Size())
+	}
+}
+
+// TestDecryptStdout verifies that "-" decrypts to stdout.
+func TestDecryptStdout(t *testing.T) {
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, maxChunkSize*3+100)
+	io.ReadFull(rand.Reader, plaintext)
+	opts := encryptOptions{recipients: []recipient{id.public}}
+	file := new(memoryOutput)
+	_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), file, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	stdout := os.Stdout
+	os.Stdout = pw
+	defer func() { os.Stdout = stdout }()
+	read := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(pr)
+		read <- b
+	}()
+	err = decryptFile(identityKeys{id}, bytes.NewReader(file.buf), "-")
+	pw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(<-read, plaintext) {
+		t.Fatal("decryption to stdout resulted in a different plaintext")
+	}
+}
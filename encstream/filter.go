@@ -0,0 +1,215 @@
+package encstream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Filters leave files out of archives as the tree is walked. -exclude,
+// -include, -exclude-from and .encignore files all use the patterns of
+// .gitignore files:
+//
+//   - blank lines and lines starting with # are skipped, and trailing spaces
+//     are trimmed unless escaped with a backslash;
+//   - a pattern starting with ! includes what an earlier pattern excluded;
+//   - a pattern is a glob, where * and ? do not match /;
+//   - a pattern ending in a slash only matches directories;
+//   - a pattern without any other slash matches names at any depth, and one
+//     with a slash matches paths from the top of the tree, or from the
+//     directory of its .encignore file;
+//   - ** matches any number of directories, so **/a matches a at any depth,
+//     a/** everything inside a and a/**/b a/b, a/x/b, a/x/y/b and so on.
+//
+// The last pattern that matches an entry decides whether it is included, and
+// entries that no pattern matches are included. Leaving out a directory
+// leaves out everything beneath it, so a later pattern cannot bring back a
+// file in a directory that was excluded.
+
+var errFilterPattern = errors.New("malformed filter pattern")
+
+// filterRule excludes the entries matching a pattern, or includes them if
+// negate is set.
+type filterRule struct {
+	segments []string // the pattern split at slashes
+	negate   bool
+	dirOnly  bool // the pattern ended in a slash
+	anchored bool // the pattern contains a slash, so it matches whole paths
+}
+
+// parseFilterLine parses a line of a pattern file, returning false if it holds
+// no pattern.
+func parseFilterLine(line string) (filterRule, bool, error) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return filterRule{}, false, nil
+	}
+	var r filterRule
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return filterRule{}, false, errFilterPattern
+	}
+	r.segments = strings.Split(line, "/")
+	for _, s := range r.segments {
+		if _, err := path.Match(s, ""); err != nil || s == "" {
+			return filterRule{}, false, errFilterPattern
+		}
+	}
+	return r, true, nil
+}
+
+// matches reports whether the rule matches the entry at the slash-separated
+// path rel, relative to the top of the tree or the directory of its
+// .encignore file.
+func (r filterRule) matches(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if !r.anchored {
+		matched, _ := path.Match(r.segments[0], path.Base(rel))
+		return matched
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments reports whether the path segments name match the pattern
+// segments, where a ** segment matches any number of path segments, but a
+// trailing one at least one.
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(name) > 0
+		}
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchSegments(pattern[1:], name[1:])
+}
+
+// matchRules reports whether the last of rules that matches the entry at rel
+// excludes it, and whether any matched.
+func matchRules(rules []filterRule, rel string, dir bool) (excluded, matched bool) {
+	for _, r := range rules {
+		if r.matches(rel, dir) {
+			excluded, matched = !r.negate, true
+		}
+	}
+	return excluded, matched
+}
+
+// readFilterRules reads the rules of the pattern file name from r.
+func readFilterRules(r io.Reader, name string) ([]filterRule, error) {
+	var rules []filterRule
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		rule, ok, err := parseFilterLine(s.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", name, line, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, s.Err()
+}
+
+// pathFilter is an ordered list of rules. A nil *pathFilter excludes
+// nothing.
+type pathFilter struct {
+	rules []filterRule
+}
+
+// excluded reports whether the entry at the slash-separated path rel, which
+// is a directory if dir is set, is left out.
+func (f *pathFilter) excluded(rel string, dir bool) bool {
+	excluded, _ := f.match(rel, dir)
+	return excluded
+}
+
+// match is like excluded, but also reports whether any rule matched.
+func (f *pathFilter) match(rel string, dir bool) (excluded, matched bool) {
+	if f == nil {
+		return false, false
+	}
+	return matchRules(f.rules, rel, dir)
+}
+
+// add adds a rule for pattern, which includes what it matches if include is
+// set, as if it started with !.
+func (f *pathFilter) add(pattern string, include bool) error {
+	r, ok, err := parseFilterLine(pattern)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errFilterPattern
+	}
+	if include {
+		r.negate = !r.negate
+	}
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+// addFile adds the rules of the pattern file name.
+func (f *pathFilter) addFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rules, err := readFilterRules(file, name)
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, rules...)
+	return nil
+}
+
+// filterFlag is a flag.Value adding -include, -exclude or -exclude-from
+// rules to a pathFilter, in the order they are given.
+type filterFlag struct {
+	filter  *pathFilter
+	include bool
+	file    bool
+}
+
+func (f filterFlag) String() string {
+	return ""
+}
+
+func (f filterFlag) Set(value string) error {
+	if f.file {
+		return f.filter.addFile(value)
+	}
+	return f.filter.add(value, f.include)
+}
@@ -0,0 +1,178 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPathFilter verifies how filter patterns match entries, and that the
+// last matching rule wins.
+func TestPathFilter(t *testing.T) {
+	var f pathFilter
+	for _, r := range []struct {
+		pattern string
+		include bool
+	}{
+		{"*.o", false},
+		{"keep.o", true},
+		{"cache/", false},
+		{"/docs/*.pdf", false},
+		{"src/gen?", false},
+	} {
+		if err := f.add(r.pattern, r.include); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		rel      string
+		dir      bool
+		excluded bool
+	}{
+		{"main.o", false, true},
+		{"lib/util.o", false, true},
+		{"lib/keep.o", false, false},
+		{"main.c", false, false},
+		{"cache", true, true},
+		{"lib/cache", true, true},
+		{"cache", false, false},
+		{"docs/a.pdf", false, true},
+		{"docs/sub/a.pdf", false, false},
+		{"other/docs/a.pdf", false, false},
+		{"src/gen1", true, true},
+		{"lib/src/gen1", true, false},
+	} {
+		if got := f.excluded(c.rel, c.dir); got != c.excluded {
+			t.Fatalf("%v: excluded is %v, expected %v", c.rel, got, c.excluded)
+		}
+	}
+	var none *pathFilter
+	if none.excluded("main.o", false) {
+		t.Fatal("a nil filter excluded an entry")
+	}
+	for _, pattern := range []string{"", "/", "[a"} {
+		if err := f.add(pattern, false); err != errFilterPattern {
+			t.Fatalf("%q: expected errFilterPattern, got %v", pattern, err)
+		}
+	}
+}
+
+// TestFilteredArchive verifies that archives leave out what their filter
+// excludes, including everything beneath excluded directories.
+func TestFilteredArchive(t *testing.T) {
+	src, err := ioutil.TempDir("", "enctest-filter-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	for _, name := range []string{"main.c", "main.o", "keep.o", "build/out/app", "lib/util.c"} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignore := filepath.Join(src, "ignore")
+	if err := ioutil.WriteFile(ignore, []byte("# build artifacts\n\nbuild/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var f pathFilter
+	for _, set := range []func() error{
+		func() error { return filterFlag{filter: &f}.Set("*.o") },
+		func() error { return filterFlag{filter: &f, include: true}.Set("keep.o") },
+		func() error { return filterFlag{filter: &f}.Set("ignore") },
+		func() error { return filterFlag{filter: &f, file: true}.Set(ignore) },
+	} {
+		if err := set(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := new(bytes.Buffer)
+	m, err := writeArchive(src, archive, nil, archiveOptions{filter: &f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := archiveEntries(t, bytes.NewReader(archive.Bytes()))
+	for _, name := range []string{"main.c", "keep.o", "lib/", "lib/util.c"} {
+		if _, ok := entries[name]; !ok {
+			t.Fatal("the archive is missing", name)
+		}
+	}
+	for _, name := range []string{"main.o", "ignore", "build/", "build/out/", "build/out/app"} {
+		if _, ok := entries[name]; ok {
+			t.Fatal("the archive holds", name)
+		}
+	}
+	if len(m.Entries) != 3 {
+		t.Fatal("the manifest lists excluded files")
+	}
+}
+
+// TestFilterFiles verifies that a pattern file leaves the same entries out of
+// an archive whether it is given to -exclude-from or kept as a .encignore
+// file.
+func TestFilterFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-filter-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	for _, name := range []string{"a.log", "keep.log", "a.c", "logs/x", "doc/a.pdf", "doc/x/b.pdf", "x/doc/c.pdf", "a/b", "a/x/y/b", "build/app", "build/keep"} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patterns := []byte("# patterns\n*.log\n!keep.log\n**/logs\n/doc/**/*.pdf\na/**/b\nbuild/\n!build/keep\n.encignore\n")
+	excludeFrom := filepath.Join(dir, "patterns")
+	if err := ioutil.WriteFile(excludeFrom, patterns, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var f pathFilter
+	if err := (filterFlag{filter: &f, file: true}).Set(excludeFrom); err != nil {
+		t.Fatal(err)
+	}
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(src, archive, nil, archiveOptions{filter: &f}); err != nil {
+		t.Fatal(err)
+	}
+	excluded := archiveEntries(t, bytes.NewReader(archive.Bytes()))
+
+	if err := ioutil.WriteFile(filepath.Join(src, ignoreFileName), patterns, 0600); err != nil {
+		t.Fatal(err)
+	}
+	archive.Reset()
+	if _, err := writeArchive(src, archive, nil, archiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ignored := archiveEntries(t, bytes.NewReader(archive.Bytes()))
+
+	for _, name := range []string{"keep.log", "a.c", "doc/", "x/doc/c.pdf", "a/"} {
+		if _, ok := excluded[name]; !ok {
+			t.Fatal("-exclude-from left out", name)
+		}
+	}
+	for _, name := range []string{"a.log", "logs/", "doc/a.pdf", "doc/x/b.pdf", "a/b", "a/x/y/b", "build/", "build/keep"} {
+		if _, ok := excluded[name]; ok {
+			t.Fatal("-exclude-from kept", name)
+		}
+	}
+	if len(excluded) != len(ignored) {
+		t.Fatalf("-exclude-from kept %v entries, and .encignore %v", len(excluded), len(ignored))
+	}
+	for name := range excluded {
+		if _, ok := ignored[name]; !ok {
+			t.Fatal(".encignore left out", name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package encstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The algorithms a file is encrypted with are selected by the cipher suite
+// recorded in its header. The default suite uses Argon2id, XChaCha20-Poly1305
+// and keyed BLAKE2b; the FIPS suite restricts them to FIPS 140 approved
+// algorithms, for environments that require them: PBKDF2-HMAC-SHA256 as
+// described by SP 800-132, AES-256-GCM with random 96 bit nonces and
+// HMAC-SHA-512. The AES-GCM suite is the default suite with AES-256-GCM in
+// place of XChaCha20-Poly1305, for CPUs that have AES instructions (see
+// cipher.go).
+
+// cipher suites
+const (
+	suiteDefault uint8 = iota
+	suiteFIPS
+	suiteAESGCM
+)
+
+// defaultPBKDF2Iterations is the PBKDF2-HMAC-SHA256 work factor of the FIPS
+// suite, following the OWASP recommendation.
+const defaultPBKDF2Iterations = 600000
+
+var (
+	errFIPSOptions = errors.New("-fips cannot be combined with recipients or deduplication, which use algorithms that are not FIPS approved")
+	errBadSuite    = errors.New("unknown cipher suite")
+)
+
+// suiteAEAD returns the constructor of the AEAD that encrypts the chunks of
+// files in suite.
+func suiteAEAD(suite uint8) func(key []byte) (cipher.AEAD, error) {
+	if suite == suiteFIPS || suite == suiteAESGCM {
+		return newGCM
+	}
+	return chacha20poly1305.NewX
+}
+
+// newGCM returns AES-256-GCM with 96 bit nonces.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newMAC returns the hash that computes the 64 byte MAC of a file in suite.
+func newMAC(suite uint8, macKey [32]byte) (hash.Hash, error) {
+	if suite == suiteFIPS {
+		return hmac.New(sha512.New, macKey[:]), nil
+	}
+	return blake2b.New512(macKey[:])
+}
+
+// deriveFIPSKeys derives the secret key and MAC key described by header from
+// passphrase with PBKDF2-HMAC-SHA256.
+func deriveFIPSKeys(passphrase []byte, header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	skb, err := pbkdf2.Key(sha256.New, string(passphrase), header.Salt[:], int(header.Iterations), keyLen+macLen)
+	if err != nil {
+		return sk, macKey, err
+	}
+	copy(sk[:], skb[:keyLen])
+	copy(macKey[:], skb[keyLen:])
+	return sk, macKey, nil
+}
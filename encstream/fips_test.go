@@ -0,0 +1,45 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestFIPS verifies that files encrypted with the FIPS suite record it in
+// their header and decrypt as usual.
+func TestFIPS(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("approved "), 4000)
+	output := new(memoryOutput)
+	_, _, _, err := encryptTo([]byte("hunter2"), bytes.NewReader(plaintext), output, 0, encryptOptions{fips: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(output.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Suite != suiteFIPS || header.Iterations != defaultPBKDF2Iterations {
+		t.Fatal("the FIPS suite was not recorded", header)
+	}
+	_, r, err := openCiphertext(newPassphraseKeys([]byte("hunter2")), bytes.NewReader(output.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+	if _, _, err := openCiphertext(newPassphraseKeys([]byte("hunter3")), bytes.NewReader(output.buf)); err != errBadMAC {
+		t.Fatal("expected errBadMAC, got", err)
+	}
+
+	for _, opts := range []encryptOptions{{fips: true, dedup: true}, {fips: true, recipients: []recipient{{}}}} {
+		if _, _, _, err := encryptTo([]byte("hunter2"), bytes.NewReader(plaintext), new(memoryOutput), 0, opts); err != errFIPSOptions {
+			t.Fatal("expected errFIPSOptions, got", err)
+		}
+	}
+}
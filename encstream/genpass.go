@@ -0,0 +1,123 @@
+package encstream
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Generated passphrases are drawn uniformly with crypto/rand, either as
+// words from passphraseWords, diceware-style, or as characters from a
+// charset. Their entropy is then exactly the number of choices made times the
+// bits each carries.
+
+var (
+	errGenpassOptions = errors.New("genpass cannot encrypt with -r, -R, -passphrase-file, -passphrase-cmd, -pass-entry, -passphrase-ref or -dry-run, since the generated passphrase would not be used")
+	errCharset        = errors.New("the charset must have at least two characters, each listed once")
+)
+
+// defaultCharset is the charset of passphrases generated with -chars.
+const defaultCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&*+-=?@^_~"
+
+// genpassMain implements `enc genpass`, which prints a random passphrase. If
+// inputs are given, they are first encrypted with it as `enc encrypt` would,
+// and the passphrase is only printed once that succeeds.
+func genpassMain(args []string) {
+	fs := newFlagSet("genpass",
+		"enc genpass [-words N] [-separator -]",
+		"enc genpass -chars N [-charset characters]",
+		"enc genpass [-words N | -chars N] [encrypt flags] -o [output] [inputs...]")
+	words := fs.Int("words", 7, fmt.Sprintf("the number of words in the passphrase, each carrying %.1f bits of entropy", math.Log2(float64(len(passphraseWords)))))
+	separator := fs.String("separator", "-", "what to put between the words")
+	chars := fs.Int("chars", 0, "generate this many random characters instead of words")
+	charset := fs.String("charset", defaultCharset, "the characters to draw from, with -chars")
+	var cmd fileFlags
+	cmd.register(fs, true, false)
+	positional := parseArgs(fs, args)
+
+	var passphrase string
+	var bits float64
+	var err error
+	if *chars > 0 {
+		passphrase, bits, err = generateChars(rand.Reader, *chars, *charset)
+	} else {
+		passphrase, bits, err = generateWords(rand.Reader, *words, *separator)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := os.Stdout
+	if len(positional) > 0 || cmd.fileOutput != "" {
+		if len(cmd.recipientArgs) > 0 || len(cmd.recipientNames) > 0 || cmd.hasPassphraseSource() || cmd.dryRun {
+			log.Fatal(errGenpassOptions)
+		}
+		cmd.generated = []byte(passphrase)
+		fileMain(fs, &cmd, positional)
+		if cmd.fileOutput == "-" {
+			out = os.Stderr
+		}
+	}
+	fmt.Fprintln(out, passphrase)
+	if bits < weakEntropy {
+		log.Printf("warning: the passphrase is weak, with %.0f bits of entropy", bits)
+	}
+	log.Printf("%.0f bits of entropy; store it safely, it is not shown again", bits)
+}
+
+// generateWords returns a passphrase of n words from passphraseWords joined
+// by separator, and its entropy in bits.
+func generateWords(random io.Reader, n int, separator string) (string, float64, error) {
+	if n < 1 {
+		return "", 0, errors.New("a passphrase needs at least one word")
+	}
+	words := make([]string, n)
+	for i := range words {
+		j, err := randomIndex(random, len(passphraseWords))
+		if err != nil {
+			return "", 0, err
+		}
+		words[i] = passphraseWords[j]
+	}
+	return strings.Join(words, separator), float64(n) * math.Log2(float64(len(passphraseWords))), nil
+}
+
+// generateChars returns a passphrase of n characters from charset, and its
+// entropy in bits.
+func generateChars(random io.Reader, n int, charset string) (string, float64, error) {
+	set := []rune(charset)
+	seen := make(map[rune]bool)
+	for _, r := range set {
+		if seen[r] {
+			return "", 0, errCharset
+		}
+		seen[r] = true
+	}
+	if len(set) < 2 {
+		return "", 0, errCharset
+	}
+	passphrase := make([]rune, n)
+	for i := range passphrase {
+		j, err := randomIndex(random, len(set))
+		if err != nil {
+			return "", 0, err
+		}
+		passphrase[i] = set[j]
+	}
+	return string(passphrase), float64(n) * math.Log2(float64(len(set))), nil
+}
+
+// randomIndex returns a uniformly random integer in [0, n).
+func randomIndex(random io.Reader, n int) (int, error) {
+	i, err := rand.Int(random, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
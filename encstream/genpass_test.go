@@ -0,0 +1,53 @@
+package encstream
+
+import (
+	"crypto/rand"
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestGeneratePassphrase verifies that generated passphrases have the
+// requested shape and report the entropy of the choices made.
+func TestGeneratePassphrase(t *testing.T) {
+	known := make(map[string]bool)
+	for _, w := range passphraseWords {
+		if known[w] {
+			t.Fatal("duplicate word", w)
+		}
+		known[w] = true
+	}
+
+	passphrase, bits, err := generateWords(rand.Reader, 7, " ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := strings.Split(passphrase, " ")
+	if len(words) != 7 {
+		t.Fatal("expected 7 words, got", passphrase)
+	}
+	for _, w := range words {
+		if !known[w] {
+			t.Fatal("unknown word", w)
+		}
+	}
+	if want := 7 * math.Log2(float64(len(passphraseWords))); bits != want {
+		t.Fatal("reported", bits, "bits, wanted", want)
+	}
+
+	passphrase, bits, err = generateChars(rand.Reader, 20, "01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passphrase) != 20 || strings.Trim(passphrase, "01") != "" || bits != 20 {
+		t.Fatal("unexpected passphrase", passphrase, bits)
+	}
+	for _, charset := range []string{"", "a", "abca"} {
+		if _, _, err := generateChars(rand.Reader, 20, charset); err != errCharset {
+			t.Fatalf("%q: expected errCharset, got %v", charset, err)
+		}
+	}
+	if _, _, err := generateWords(rand.Reader, 0, "-"); err == nil {
+		t.Fatal("generated a passphrase of no words")
+	}
+}
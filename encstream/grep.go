@@ -0,0 +1,67 @@
+package encstream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// enc grep searches the plaintext of encrypted files for lines matching a
+// regular expression. The file is authenticated before anything is printed,
+// and its plaintext is then streamed through the matcher a line at a time,
+// so that it is never written to disk and large logs need not fit in memory.
+
+// grepOptions describe how enc grep matches lines.
+type grepOptions struct {
+	ignoreCase bool
+	fixed      bool // the pattern is a string rather than a regular expression
+	prefix     string
+}
+
+// compileGrepPattern compiles pattern as opts says.
+func compileGrepPattern(pattern string, opts grepOptions) (*regexp.Regexp, error) {
+	if opts.fixed {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if opts.ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// grepReader writes the lines of r that re matches to w, preceded by
+// opts.prefix and their line number, and returns how many matched.
+func grepReader(r io.Reader, re *regexp.Regexp, w io.Writer, opts grepOptions) (int, error) {
+	br := bufio.NewReader(r)
+	matches := 0
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if re.MatchString(line) {
+				matches++
+				if _, err := fmt.Fprintf(w, "%v%v:%v\n", opts.prefix, n, line); err != nil {
+					return matches, err
+				}
+			}
+		}
+		if err == io.EOF {
+			return matches, nil
+		}
+		if err != nil {
+			return matches, err
+		}
+	}
+}
+
+// grepFile authenticates input and writes the lines of its plaintext that re
+// matches to w, returning how many matched.
+func grepFile(keys keySource, input io.ReadSeeker, re *regexp.Regexp, w io.Writer, opts grepOptions) (int, error) {
+	_, plaintext, err := openCiphertext(keys, input)
+	if err != nil {
+		return 0, err
+	}
+	return grepReader(plaintext, re, w, opts)
+}
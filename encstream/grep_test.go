@@ -0,0 +1,61 @@
+package encstream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestGrep verifies that matching lines are printed with their line numbers,
+// and that files are authenticated before anything is printed.
+func TestGrep(t *testing.T) {
+	log := "boot\r\nERROR disk a.b\nok\nerror: disk axb\nlast ERROR"
+	for _, c := range []struct {
+		pattern string
+		opts    grepOptions
+		out     string
+	}{
+		{"ERROR", grepOptions{}, "2:ERROR disk a.b\n5:last ERROR\n"},
+		{"error", grepOptions{ignoreCase: true}, "2:ERROR disk a.b\n4:error: disk axb\n5:last ERROR\n"},
+		{"a.b", grepOptions{}, "2:ERROR disk a.b\n4:error: disk axb\n"},
+		{"a.b", grepOptions{fixed: true, prefix: "log.enc:"}, "log.enc:2:ERROR disk a.b\n"},
+		{"^boot$", grepOptions{}, "1:boot\n"},
+		{"missing", grepOptions{}, ""},
+	} {
+		re, err := compileGrepPattern(c.pattern, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(bytes.Buffer)
+		n, err := grepReader(strings.NewReader(log), re, out, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != c.out || n != strings.Count(c.out, "\n") {
+			t.Fatalf("%q: got %v matches:\n%v\nexpected:\n%v", c.pattern, n, out, c.out)
+		}
+	}
+	if _, err := compileGrepPattern("(", grepOptions{}); err == nil {
+		t.Fatal("a malformed pattern was accepted")
+	}
+
+	text, err := encryptText([]byte("pw"), []byte(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := new(bytes.Buffer)
+	if _, err := readArmor(ciphertext, strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	re, _ := compileGrepPattern("ok", grepOptions{})
+	out := new(bytes.Buffer)
+	if n, err := grepFile(newPassphraseKeys([]byte("pw")), bytes.NewReader(ciphertext.Bytes()), re, out, grepOptions{}); err != nil || n != 1 || out.String() != "3:ok\n" {
+		t.Fatal("wrong matches", n, out, err)
+	}
+	b := ciphertext.Bytes()
+	b[len(b)-1] ^= 1
+	out.Reset()
+	if _, err := grepFile(newPassphraseKeys([]byte("pw")), bytes.NewReader(b), re, out, grepOptions{}); err == nil || out.Len() != 0 {
+		t.Fatal("a modified file was searched")
+	}
+}
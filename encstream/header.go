@@ -0,0 +1,610 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// fileMagic identifies files written with a versioned header. Files that do
+// not start with it are assumed to use the original, unversioned header.
+var fileMagic = [4]byte{'e', 'n', 'c', 0}
+
+// fileVersion is the version of new headers. Version 2 added the header MAC;
+// see headermac.go. Version 3 made the MAC of the file a tree; see treemac.go.
+// Version 4 numbered the chunks; see headermac.go. Version 5 widened the
+// Argon2 lanes of the KDF record from 8 to 32 bits. Older files are still
+// read.
+const fileVersion = 5
+
+// header flags
+const (
+	flagArchive    = 1 << iota // the plaintext is a tar stream of a directory tree
+	flagDedup                  // chunks are content-defined and convergently encrypted
+	flagTrailerMAC             // the MAC follows the ciphertext instead of filling the Tag
+	flagPadded                 // the plaintext is padded, and its length sealed in the header
+	flagDigest                 // the header records a digest of the plaintext
+
+	knownFlags = flagArchive | flagDedup | flagTrailerMAC | flagPadded | flagDigest
+)
+
+// Header record types. A versioned header is a list of records, each prefixed
+// by its type and length, terminated by recordEnd and followed by the MAC.
+const (
+	recordEnd uint8 = iota
+	recordKDF
+	recordFlags
+	recordMetadata
+	recordLabel
+	recordRecipient
+	recordExpiry
+	recordSuite
+	recordPBKDF2
+	recordSubkey
+	recordSignature
+	recordReserved
+	recordSplitRecipient
+	recordLength
+	recordHeaderMAC
+	recordVaultKey
+	recordDigest
+)
+
+// fileHeader holds everything needed to derive the file keys and authenticate
+// the ciphertext that follows it. The keys are derived either from a
+// passphrase, with the KDF parameters of the cipher suite, from a file key
+// wrapped for each of the Recipients, or from a data key wrapped by Vault.
+type fileHeader struct {
+	Version     uint8
+	Flags       uint32
+	Suite       uint8
+	Salt        [32]byte
+	ArgonTime   uint32
+	ArgonMemory uint32
+	ArgonLanes  uint32
+	Iterations  uint32   // PBKDF2 iterations of the FIPS suite
+	Subkey      [32]byte // salt of the file's subkey of a shared key, or zero
+	Recipients  []recipientStanza
+	Vault       vaultKey // data key the file keys are a subkey of; see vault.go
+	Label       string
+	Metadata    []metadataField
+	NotAfter    int64    // Unix time after which the file has expired, or 0
+	Signer      [32]byte // Ed25519 key the file is signed with, or zero
+	Signature   [64]byte // signature of the header and the MAC; see sign.go
+	Reserved    int64    // size of the deniable region after the ciphertext; see hidden.go
+	Length      [48]byte // sealed plaintext length of a padded file; see nometadata.go
+	HeaderMAC   [32]byte // MAC of the header alone, from version 2; see headermac.go
+	Digest      [32]byte // digest of the plaintext, with -store-digest; see digest.go
+	Tag         [64]byte
+}
+
+// metadataField is a named value, such as a comment or the creation time,
+// that is stored in the header unencrypted but covered by the MAC, so that it
+// can be read without the key but not altered.
+type metadataField struct {
+	Key   string
+	Value string
+}
+
+// legacyHeader is the unversioned header written by earlier versions of enc.
+type legacyHeader struct {
+	Salt        [32]byte
+	ArgonTime   uint32
+	ArgonMemory uint32
+	ArgonLanes  uint8
+	Tag         [64]byte
+}
+
+// kdfRecord is the body of a recordKDF header record before version 5.
+type kdfRecord struct {
+	Salt        [32]byte
+	ArgonTime   uint32
+	ArgonMemory uint32
+	ArgonLanes  uint8
+}
+
+// wideKDFRecord is the body of a recordKDF header record from version 5.
+type wideKDFRecord struct {
+	Salt        [32]byte
+	ArgonTime   uint32
+	ArgonMemory uint32
+	ArgonLanes  uint32
+}
+
+// signatureRecord is the body of a recordSignature header record.
+type signatureRecord struct {
+	Signer    [32]byte
+	Signature [64]byte
+}
+
+// pbkdf2Record is the body of a recordPBKDF2 header record.
+type pbkdf2Record struct {
+	Salt       [32]byte
+	Iterations uint32
+}
+
+var (
+	errBadHeader   = errors.New("malformed header")
+	errBadMetadata = errors.New("metadata keys must be letters, digits and dashes, values must be a single line, and both must fit in the header")
+	errBadLabel    = errors.New("labels must be a single line and fit in the header")
+)
+
+// checkLabel checks that label can be stored in a header and shown in armor.
+func checkLabel(label string) error {
+	if strings.ContainsAny(label, "\r\n") || label != strings.TrimSpace(label) || len(label) > math.MaxUint16 {
+		return errBadLabel
+	}
+	return nil
+}
+
+// armorHeaders returns the fields of h that are shown in armor: the label
+// and expiry, if any, and the metadata.
+func (h fileHeader) armorHeaders() []metadataField {
+	var fields []metadataField
+	if h.Label != "" {
+		fields = append(fields, metadataField{Key: "Label", Value: h.Label})
+	}
+	if h.NotAfter != 0 {
+		fields = append(fields, metadataField{Key: "Not-After", Value: expiryString(h.NotAfter)})
+	}
+	return append(fields, h.Metadata...)
+}
+
+// expired reports whether h records an expiry that is before now.
+func (h fileHeader) expired(now time.Time) bool {
+	return h.NotAfter != 0 && now.Unix() > h.NotAfter
+}
+
+// checkMetadata checks that fields can be stored in a header and shown in
+// armor.
+func checkMetadata(fields []metadataField) error {
+	for _, f := range fields {
+		if f.Key == "" || strings.TrimFunc(f.Key, func(r rune) bool {
+			return r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+		}) != "" {
+			return errBadMetadata
+		}
+		if strings.ContainsAny(f.Value, "\r\n") || f.Value != strings.TrimSpace(f.Value) {
+			return errBadMetadata
+		}
+	}
+	if len(encodeMetadata(fields)) > math.MaxUint16 {
+		return errBadMetadata
+	}
+	return nil
+}
+
+// encodeMetadata returns the body of a recordMetadata header record: the
+// length-prefixed key and value of every field.
+func encodeMetadata(fields []metadataField) []byte {
+	buf := new(bytes.Buffer)
+	for _, f := range fields {
+		for _, s := range []string{f.Key, f.Value} {
+			binary.Write(buf, binary.LittleEndian, uint16(len(s)))
+			buf.WriteString(s)
+		}
+	}
+	return buf.Bytes()
+}
+
+// decodeMetadata parses the body of a recordMetadata header record.
+func decodeMetadata(body []byte) ([]metadataField, error) {
+	r := bytes.NewReader(body)
+	readString := func() (string, error) {
+		var length uint16
+		err := binary.Read(r, binary.LittleEndian, &length)
+		if err != nil {
+			return "", errBadHeader
+		}
+		if int(length) > r.Len() {
+			return "", errBadHeader
+		}
+		s := make([]byte, length)
+		_, err = io.ReadFull(r, s)
+		if err != nil {
+			return "", errBadHeader
+		}
+		return string(s), nil
+	}
+	var fields []metadataField
+	for r.Len() > 0 {
+		key, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, metadataField{Key: key, Value: value})
+	}
+	return fields, checkMetadata(fields)
+}
+
+// encodeStanza returns the body of a recordRecipient header record: the
+// length-prefixed key ID, the ephemeral key and the wrapped file key, or of
+// a recordSplitRecipient record, with the split of the wrapped file key
+// instead.
+func encodeStanza(s recipientStanza) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(uint8(len(s.KeyID)))
+	buf.Write(s.KeyID)
+	buf.Write(s.Ephemeral[:])
+	if s.Split != nil {
+		buf.Write(s.Split)
+	} else {
+		buf.Write(s.WrappedKey[:])
+	}
+	return buf.Bytes()
+}
+
+// decodeStanza parses the body of a recordRecipient header record, or of a
+// recordSplitRecipient record if split is set.
+func decodeStanza(body []byte, split bool) (recipientStanza, error) {
+	var s recipientStanza
+	if len(body) < 1 {
+		return s, errBadHeader
+	}
+	keyIDSize := int(body[0])
+	body = body[1:]
+	if keyIDSize > fullKeyIDSize || len(body) < keyIDSize+len(s.Ephemeral) {
+		return s, errBadHeader
+	}
+	s.KeyID = append([]byte{}, body[:keyIDSize]...)
+	body = body[keyIDSize:]
+	copy(s.Ephemeral[:], body)
+	body = body[len(s.Ephemeral):]
+	if !split {
+		if len(body) != len(s.WrappedKey) {
+			return s, errBadHeader
+		}
+		copy(s.WrappedKey[:], body)
+		return s, nil
+	}
+	wrappedKey, err := afMerge(body, len(s.WrappedKey))
+	if err != nil {
+		return s, errBadHeader
+	}
+	copy(s.WrappedKey[:], wrappedKey)
+	s.Split = append([]byte{}, body...)
+	return s, nil
+}
+
+// encode returns the serialized header, ending with the MAC.
+func (h fileHeader) encode() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(fileMagic[:])
+	buf.WriteByte(h.Version)
+	if h.Suite != suiteDefault {
+		writeRecord(buf, recordSuite, h.Suite)
+	}
+	switch {
+	case h.Suite == suiteFIPS:
+		writeRecord(buf, recordPBKDF2, pbkdf2Record{Salt: h.Salt, Iterations: h.Iterations})
+	case h.Vault.Path != "":
+		writeRecord(buf, recordVaultKey, encodeVaultKey(h.Vault))
+		writeRecord(buf, recordSubkey, h.Subkey)
+	case len(h.Recipients) == 0 && h.Version >= 5:
+		writeRecord(buf, recordKDF, wideKDFRecord{
+			Salt:        h.Salt,
+			ArgonTime:   h.ArgonTime,
+			ArgonMemory: h.ArgonMemory,
+			ArgonLanes:  h.ArgonLanes,
+		})
+		if h.Subkey != ([32]byte{}) {
+			writeRecord(buf, recordSubkey, h.Subkey)
+		}
+	case len(h.Recipients) == 0:
+		// checkKDF keeps the lanes of older versions within a byte.
+		writeRecord(buf, recordKDF, kdfRecord{
+			Salt:        h.Salt,
+			ArgonTime:   h.ArgonTime,
+			ArgonMemory: h.ArgonMemory,
+			ArgonLanes:  uint8(h.ArgonLanes),
+		})
+		if h.Subkey != ([32]byte{}) {
+			writeRecord(buf, recordSubkey, h.Subkey)
+		}
+	}
+	for _, s := range h.Recipients {
+		if s.Split != nil {
+			writeRecord(buf, recordSplitRecipient, encodeStanza(s))
+		} else {
+			writeRecord(buf, recordRecipient, encodeStanza(s))
+		}
+	}
+	if h.Flags != 0 {
+		writeRecord(buf, recordFlags, h.Flags)
+	}
+	if h.Label != "" {
+		writeRecord(buf, recordLabel, []byte(h.Label))
+	}
+	if h.NotAfter != 0 {
+		writeRecord(buf, recordExpiry, h.NotAfter)
+	}
+	if len(h.Metadata) > 0 {
+		writeRecord(buf, recordMetadata, encodeMetadata(h.Metadata))
+	}
+	if h.Signer != ([32]byte{}) {
+		writeRecord(buf, recordSignature, signatureRecord{Signer: h.Signer, Signature: h.Signature})
+	}
+	if h.Reserved != 0 {
+		writeRecord(buf, recordReserved, h.Reserved)
+	}
+	if h.Flags&flagPadded != 0 {
+		writeRecord(buf, recordLength, h.Length)
+	}
+	if h.Flags&flagDigest != 0 {
+		writeRecord(buf, recordDigest, h.Digest)
+	}
+	if h.Version >= 2 {
+		writeRecord(buf, recordHeaderMAC, h.HeaderMAC)
+	}
+	buf.WriteByte(recordEnd)
+	buf.Write(h.Tag[:])
+	return buf.Bytes()
+}
+
+// authenticatedData returns the portion of the serialized header that is
+// covered by the MAC, with the signature, sealed length and digest left as
+// zeros since they are made after the MAC, or after the ciphertext. Legacy
+// headers are not authenticated.
+func (h fileHeader) authenticatedData() []byte {
+	if h.Version == 0 {
+		return nil
+	}
+	h.Signature = [64]byte{}
+	h.Length = [48]byte{}
+	h.Digest = [32]byte{}
+	enc := h.encode()
+	return enc[:len(enc)-len(h.Tag)]
+}
+
+// writeRecord appends a header record of type t with the binary encoding of
+// v as its body.
+func writeRecord(buf *bytes.Buffer, t uint8, v interface{}) {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, v)
+	buf.WriteByte(t)
+	binary.Write(buf, binary.LittleEndian, uint16(body.Len()))
+	buf.Write(body.Bytes())
+}
+
+// readHeader reads a versioned or legacy header from r.
+func readHeader(r io.Reader) (fileHeader, error) {
+	return readHeaderLimit(r, maxHeaderSize)
+}
+
+// readHeaderLimit is readHeader, refusing a versioned header larger than
+// limit bytes before reading the record that would exceed it.
+func readHeaderLimit(r io.Reader, limit int) (fileHeader, error) {
+	var magic [4]byte
+	_, err := io.ReadFull(r, magic[:])
+	if err != nil {
+		return fileHeader{}, err
+	}
+	if magic != fileMagic {
+		var legacy legacyHeader
+		err = binary.Read(io.MultiReader(bytes.NewReader(magic[:]), r), binary.LittleEndian, &legacy)
+		if err != nil {
+			return fileHeader{}, err
+		}
+		h := fileHeader{
+			Salt:        legacy.Salt,
+			ArgonTime:   legacy.ArgonTime,
+			ArgonMemory: legacy.ArgonMemory,
+			ArgonLanes:  uint32(legacy.ArgonLanes),
+			Tag:         legacy.Tag,
+		}
+		err = h.checkKDF()
+		if err != nil {
+			return fileHeader{}, err
+		}
+		return h, nil
+	}
+
+	var h fileHeader
+	err = binary.Read(r, binary.LittleEndian, &h.Version)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	if h.Version < 1 || h.Version > fileVersion {
+		return fileHeader{}, fmt.Errorf("unsupported file version %v", h.Version)
+	}
+	sawKDF, sawPBKDF2, sawSubkey, sawLength, sawHeaderMAC, sawVault, sawDigest := false, false, false, false, false, false, false
+	// the size counts the whole header, as encode writes it.
+	size := len(fileMagic) + 2 + len(h.Tag)
+	for {
+		var t uint8
+		err = binary.Read(r, binary.LittleEndian, &t)
+		if err != nil {
+			return fileHeader{}, err
+		}
+		if t == recordEnd {
+			break
+		}
+		var length uint16
+		err = binary.Read(r, binary.LittleEndian, &length)
+		if err != nil {
+			return fileHeader{}, err
+		}
+		size += 3 + int(length)
+		if size > limit {
+			return fileHeader{}, headerTooLarge(limit)
+		}
+		body := make([]byte, length)
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return fileHeader{}, err
+		}
+		switch t {
+		case recordKDF:
+			var kdf wideKDFRecord
+			if h.Version >= 5 {
+				if len(body) != binary.Size(kdf) {
+					return fileHeader{}, errBadHeader
+				}
+				binary.Read(bytes.NewReader(body), binary.LittleEndian, &kdf)
+			} else {
+				var narrow kdfRecord
+				if len(body) != binary.Size(narrow) {
+					return fileHeader{}, errBadHeader
+				}
+				binary.Read(bytes.NewReader(body), binary.LittleEndian, &narrow)
+				kdf = wideKDFRecord{narrow.Salt, narrow.ArgonTime, narrow.ArgonMemory, uint32(narrow.ArgonLanes)}
+			}
+			h.Salt = kdf.Salt
+			h.ArgonTime = kdf.ArgonTime
+			h.ArgonMemory = kdf.ArgonMemory
+			h.ArgonLanes = kdf.ArgonLanes
+			err = h.checkKDF()
+			if err != nil {
+				return fileHeader{}, err
+			}
+			sawKDF = true
+		case recordFlags:
+			if len(body) != 4 {
+				return fileHeader{}, errBadHeader
+			}
+			h.Flags = binary.LittleEndian.Uint32(body)
+			if h.Flags&^knownFlags != 0 {
+				return fileHeader{}, fmt.Errorf("unknown header flags %#x", h.Flags)
+			}
+		case recordSuite:
+			if len(body) != 1 || (body[0] != suiteFIPS && body[0] != suiteAESGCM) {
+				return fileHeader{}, errBadSuite
+			}
+			h.Suite = body[0]
+		case recordPBKDF2:
+			var kdf pbkdf2Record
+			if len(body) != binary.Size(kdf) {
+				return fileHeader{}, errBadHeader
+			}
+			binary.Read(bytes.NewReader(body), binary.LittleEndian, &kdf)
+			h.Salt = kdf.Salt
+			h.Iterations = kdf.Iterations
+			sawPBKDF2 = true
+		case recordSubkey:
+			if len(body) != len(h.Subkey) {
+				return fileHeader{}, errBadHeader
+			}
+			copy(h.Subkey[:], body)
+			if h.Subkey == ([32]byte{}) {
+				return fileHeader{}, errBadHeader
+			}
+			sawSubkey = true
+		case recordVaultKey:
+			if sawVault {
+				return fileHeader{}, errBadHeader
+			}
+			h.Vault, err = decodeVaultKey(body)
+			if err != nil {
+				return fileHeader{}, err
+			}
+			sawVault = true
+		case recordRecipient, recordSplitRecipient:
+			stanza, err := decodeStanza(body, t == recordSplitRecipient)
+			if err != nil {
+				return fileHeader{}, err
+			}
+			h.Recipients = append(h.Recipients, stanza)
+		case recordExpiry:
+			if len(body) != 8 {
+				return fileHeader{}, errBadHeader
+			}
+			h.NotAfter = int64(binary.LittleEndian.Uint64(body))
+			if h.NotAfter == 0 {
+				return fileHeader{}, errBadHeader
+			}
+		case recordLabel:
+			h.Label = string(body)
+			err = checkLabel(h.Label)
+			if err != nil {
+				return fileHeader{}, err
+			}
+		case recordMetadata:
+			h.Metadata, err = decodeMetadata(body)
+			if err != nil {
+				return fileHeader{}, err
+			}
+		case recordSignature:
+			var sig signatureRecord
+			if len(body) != binary.Size(sig) {
+				return fileHeader{}, errBadHeader
+			}
+			binary.Read(bytes.NewReader(body), binary.LittleEndian, &sig)
+			if sig.Signer == ([32]byte{}) {
+				return fileHeader{}, errBadHeader
+			}
+			h.Signer = sig.Signer
+			h.Signature = sig.Signature
+		case recordLength:
+			if len(body) != len(h.Length) {
+				return fileHeader{}, errBadHeader
+			}
+			copy(h.Length[:], body)
+			sawLength = true
+		case recordDigest:
+			if len(body) != len(h.Digest) {
+				return fileHeader{}, errBadHeader
+			}
+			copy(h.Digest[:], body)
+			sawDigest = true
+		case recordHeaderMAC:
+			if len(body) != len(h.HeaderMAC) {
+				return fileHeader{}, errBadHeader
+			}
+			copy(h.HeaderMAC[:], body)
+			sawHeaderMAC = true
+		case recordReserved:
+			if len(body) != 8 {
+				return fileHeader{}, errBadHeader
+			}
+			h.Reserved = int64(binary.LittleEndian.Uint64(body))
+			if h.Reserved <= 0 {
+				return fileHeader{}, errBadHeader
+			}
+		default:
+			return fileHeader{}, fmt.Errorf("unknown header record %v", t)
+		}
+	}
+	// the keys come from a passphrase, with the KDF of the suite, from
+	// recipients or from a Vault data key, only one of them. Argon2id keys
+	// may be shared, and Vault data keys always are, by subkeys. The
+	// signature covers the MAC, so it cannot come before a trailer MAC. A
+	// deniable region uses the Argon2id parameters of the passphrase. The
+	// digest, like the signature, is written once the plaintext has been
+	// read, so there is none with a trailer MAC. Only version 2 and later
+	// headers, and all of them, have a header MAC.
+	switch {
+	case sawHeaderMAC != (h.Version >= 2):
+		return fileHeader{}, errBadHeader
+	case h.Reserved != 0 && (h.Suite == suiteFIPS || len(h.Recipients) > 0):
+		return fileHeader{}, errBadHeader
+	case sawLength != (h.Flags&flagPadded != 0) || (sawLength && h.Flags&(flagTrailerMAC|flagDedup) != 0):
+		return fileHeader{}, errBadHeader
+	case h.Signer != ([32]byte{}) && h.Flags&flagTrailerMAC != 0:
+		return fileHeader{}, errBadHeader
+	case sawDigest != (h.Flags&flagDigest != 0) || (sawDigest && h.Flags&flagTrailerMAC != 0):
+		return fileHeader{}, errBadHeader
+	case sawSubkey && (h.Suite == suiteFIPS || sawKDF == sawVault):
+		return fileHeader{}, errBadHeader
+	case sawVault && (!sawSubkey || len(h.Recipients) > 0 || h.Reserved != 0):
+		return fileHeader{}, errBadHeader
+	case h.Suite == suiteFIPS && (!sawPBKDF2 || sawKDF || sawVault || len(h.Recipients) > 0 || h.Iterations == 0):
+		return fileHeader{}, errBadHeader
+	case h.Suite != suiteFIPS && (sawPBKDF2 || sawKDF == (len(h.Recipients) > 0 || sawVault)):
+		return fileHeader{}, errBadHeader
+	}
+	_, err = io.ReadFull(r, h.Tag[:])
+	if err != nil {
+		return fileHeader{}, err
+	}
+	return h, nil
+}
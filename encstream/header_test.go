@@ -0,0 +1,91 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// TestHeaderRoundTrip verifies that versioned headers survive encoding and
+// decoding, and that legacy headers are still understood.
+func TestHeaderRoundTrip(t *testing.T) {
+	h, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Flags = flagArchive
+	h.Label = "prod DB backup 2024-06-01"
+	h.NotAfter = 1717200000
+	h.Metadata = []metadataField{{"Comment", "prod DB backup"}, {"Created", "2024-06-01T00:00:00Z"}}
+	h.Tag[0] = 0xff
+	decoded, err := readHeader(bytes.NewReader(h.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, h) {
+		t.Fatal("header mismatch got", decoded, "wanted", h)
+	}
+
+	legacy := legacyHeader{
+		Salt:        h.Salt,
+		ArgonTime:   h.ArgonTime,
+		ArgonMemory: h.ArgonMemory,
+		ArgonLanes:  uint8(h.ArgonLanes),
+		Tag:         h.Tag,
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, legacy); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = readHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Version != 0 || decoded.Salt != h.Salt || decoded.Tag != h.Tag || decoded.authenticatedData() != nil {
+		t.Fatal("legacy header was not decoded correctly")
+	}
+
+	// headers of files encrypted to recipients carry their stanzas instead
+	// of the KDF parameters.
+	r := fileHeader{Version: fileVersion, Recipients: []recipientStanza{{KeyID: []byte{1, 2, 3, 4}}, {KeyID: []byte{}}}}
+	r.Recipients[0].Ephemeral[0] = 1
+	decoded, err = readHeader(bytes.NewReader(r.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, r) {
+		t.Fatal("header mismatch got", decoded, "wanted", r)
+	}
+
+	f := fileHeader{Version: fileVersion, Suite: suiteFIPS, Iterations: defaultPBKDF2Iterations, Salt: h.Salt}
+	decoded, err = readHeader(bytes.NewReader(f.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, f) {
+		t.Fatal("header mismatch got", decoded, "wanted", f)
+	}
+
+	s := fileHeader{Version: fileVersion, Salt: h.Salt, ArgonTime: h.ArgonTime, ArgonMemory: h.ArgonMemory, ArgonLanes: h.ArgonLanes}
+	s.Subkey[0] = 1
+	decoded, err = readHeader(bytes.NewReader(s.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, s) {
+		t.Fatal("header mismatch got", decoded, "wanted", s)
+	}
+
+	for _, f := range []metadataField{{"", "empty key"}, {"Two Words", "x"}, {"Comment", "two\nlines"}} {
+		if checkMetadata([]metadataField{f}) == nil {
+			t.Fatal("invalid metadata was accepted:", f)
+		}
+	}
+
+	// unknown flags must be rejected rather than silently ignored.
+	h.Flags = 1 << 31
+	if _, err := readHeader(bytes.NewReader(h.encode())); err == nil {
+		t.Fatal("unknown flags were accepted")
+	}
+}
@@ -0,0 +1,92 @@
+package encstream
+
+import "crypto/subtle"
+
+// The MAC of a file covers its header, but it can only be checked once the
+// whole ciphertext has been read, and -range, -keep-going and received
+// transfers open chunks before it is, or without it. Version 2 headers
+// therefore carry a MAC of their own, which is checked as soon as the keys
+// are derived, so that a header whose salt, KDF parameters, suite or flags
+// were altered is refused before anything is decrypted. Their chunks are
+// sealed with the version as additional data, so that a header rewritten as
+// version 1, which has no header MAC, fails at the first chunk.
+//
+// Chunks opened without the MAC could still be reordered, dropped or cut off
+// at the end, so from version 4 the additional data of every chunk also
+// holds its index and whether it is the last chunk, as in the STREAM
+// construction, and every chunk but the last is full. A chunk then only
+// opens in its own place, and a file cut short at a chunk boundary fails at
+// its new last chunk. Deduplicated files are not numbered, since chunks with
+// the same plaintext must seal to the same ciphertext wherever they are.
+
+// headerMAC returns the MAC of h alone, made with macKey and truncated to 32
+// bytes.
+func (h fileHeader) headerMAC(macKey [32]byte) ([32]byte, error) {
+	var sum [32]byte
+	hash, err := newMAC(h.Suite, macKey)
+	if err != nil {
+		return sum, err
+	}
+	// the file MAC is made over the header too, with the header MAC in it,
+	// so the context tells the two apart.
+	h.HeaderMAC = [32]byte{}
+	hash.Write([]byte("enc header"))
+	hash.Write(h.authenticatedData())
+	copy(sum[:], hash.Sum(nil))
+	return sum, nil
+}
+
+// sealHeader fills in the header MAC of h, if its version has one.
+func (h *fileHeader) sealHeader(macKey [32]byte) error {
+	if h.Version < 2 {
+		return nil
+	}
+	sum, err := h.headerMAC(macKey)
+	h.HeaderMAC = sum
+	return err
+}
+
+// checkHeader checks the header MAC of h, if its version has one, returning
+// errBadMAC if the header was altered or macKey is wrong.
+func (h fileHeader) checkHeader(macKey [32]byte) error {
+	if h.Version < 2 {
+		return nil
+	}
+	sum, err := h.headerMAC(macKey)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(sum[:], h.HeaderMAC[:]) != 1 {
+		return errBadMAC
+	}
+	return nil
+}
+
+// chunkAAD returns the additional data the chunks that follow h are sealed
+// with: from version 2, the magic and version.
+func (h fileHeader) chunkAAD() []byte {
+	if h.Version < 2 {
+		return nil
+	}
+	return append(fileMagic[:len(fileMagic):len(fileMagic)], h.Version)
+}
+
+// indexedChunks reports whether the chunks that follow h are numbered.
+func (h fileHeader) indexedChunks() bool {
+	return h.Version >= 4 && h.Flags&flagDedup == 0
+}
+
+// chunkOptions returns the stream options of the chunks that follow h.
+func (h fileHeader) chunkOptions() []StreamOption {
+	return h.chunkOptionsAt(0)
+}
+
+// chunkOptionsAt returns the stream options of the chunks that follow h from
+// the chunk with index first.
+func (h fileHeader) chunkOptionsAt(first uint64) []StreamOption {
+	opts := []StreamOption{WithAEAD(suiteAEAD(h.Suite)), WithAAD(h.chunkAAD())}
+	if h.indexedChunks() {
+		opts = append(opts, WithIndexedChunks(first))
+	}
+	return opts
+}
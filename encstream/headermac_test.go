@@ -0,0 +1,65 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestHeaderMAC verifies that a header altered after encryption is refused
+// as soon as the keys are derived, even by -range, which does not read the
+// whole file, and that rewriting it as a version 1 header, which has no
+// header MAC, makes the chunks fail to open.
+func TestHeaderMAC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-headermac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("header "), 5000)
+	output := new(memoryOutput)
+	_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), output, 0, encryptOptions{recipients: []recipient{id.public}, label: "backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := output.buf
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != fileVersion || header.HeaderMAC == ([32]byte{}) {
+		t.Fatal("the header has no header MAC")
+	}
+	out := filepath.Join(dir, "slice")
+	if err := decryptRange(identityKeys{id}, bytes.NewReader(ciphertext), out, byteRange{0, 10}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Replace(ciphertext, []byte("backup"), []byte("backuq"), 1)
+	if err := decryptRange(identityKeys{id}, bytes.NewReader(tampered), out, byteRange{0, 10}, time.Now()); err != errBadMAC {
+		t.Fatal("expected errBadMAC from a tampered header, got", err)
+	}
+	if _, _, err := openCiphertext(identityKeys{id}, bytes.NewReader(tampered)); err != errBadMAC {
+		t.Fatal("expected errBadMAC from a tampered header, got", err)
+	}
+
+	downgraded := header
+	downgraded.Version = 1
+	encoded := downgraded.encode()
+	old := append(encoded[:0:0], encoded...)
+	old = append(old, ciphertext[len(header.encode()):]...)
+	if err := decryptRange(identityKeys{id}, bytes.NewReader(old), out, byteRange{0, 10}, time.Now()); err == nil {
+		t.Fatal("a header downgraded to version 1 was accepted")
+	}
+	encoded[len(fileMagic)] = fileVersion
+	if _, err := readHeader(bytes.NewReader(encoded)); err != errBadHeader {
+		t.Fatal("expected errBadHeader from a header without its header MAC, got", err)
+	}
+}
@@ -0,0 +1,198 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Experimental: a file encrypted with -deniable-size reserves a region of
+// that size after its ciphertext, which either holds a hidden payload,
+// encrypted with a second passphrase, or random bytes. The region is recorded
+// in the header and covered by the MAC like the rest of the file, so that
+// decrypting with the outer passphrase works as usual and shows the region,
+// but not what is in it:
+//
+//	salt (32 bytes) | nonce (24 bytes) | XChaCha20-Poly1305 sealed payload
+//
+// The sealed payload is the length of the hidden plaintext, the plaintext
+// and zero padding to the size of the region. Its key is derived from the
+// hidden passphrase and the salt with the KDF parameters in the header, so
+// nothing about it is stored in the clear. A region without a hidden payload
+// is filled with random bytes, which cannot be told apart from a salt, a
+// nonce and a ciphertext without the passphrase: a wrong passphrase and the
+// absence of a hidden payload fail in the same way.
+//
+// That a file has a region is not hidden, only what is in it. The hidden
+// payload is read into memory, so the region is limited to maxHiddenSize.
+
+const (
+	hiddenSaltSize = 32
+	hiddenOverhead = hiddenSaltSize + chacha20poly1305.NonceSizeX + 8 + chacha20poly1305.Overhead
+	maxHiddenSize  = 64 << 20
+)
+
+var (
+	errHiddenSize      = errors.New("the deniable region must be larger than 80 bytes and at most 64M")
+	errHiddenTooLarge  = errors.New("the hidden payload does not fit in the deniable region")
+	errHiddenOptions   = errors.New("a deniable region can only be added to files encrypted with a passphrase, without -fips")
+	errHiddenNotFound  = errors.New("no hidden payload opens with this passphrase")
+	errHiddenNoRegion  = errors.New("the file has no deniable region")
+	errHiddenSameKey   = errors.New("the hidden payload needs a different passphrase than the file")
+	errHiddenArguments = errors.New("-hide needs -deniable-size")
+
+	errHiddenDecryptOptions = errors.New("-hidden decrypts a single file, and cannot be combined with -l, -qr, -range, -require-signer or -i")
+)
+
+// checkHiddenSize checks that a deniable region of size bytes is supported.
+func checkHiddenSize(size int64) error {
+	if size <= hiddenOverhead || size > maxHiddenSize {
+		return errHiddenSize
+	}
+	return nil
+}
+
+// hiddenKey derives the key of a hidden payload from keys and salt, with
+// the KDF parameters of header. Only keys that come from a passphrase, such
+// as passphraseKeys, can derive it.
+func hiddenKey(keys keySource, salt []byte, header fileHeader) ([32]byte, error) {
+	kdf := fileHeader{
+		Version:     header.Version,
+		ArgonTime:   header.ArgonTime,
+		ArgonMemory: header.ArgonMemory,
+		ArgonLanes:  header.ArgonLanes,
+	}
+	copy(kdf.Salt[:], salt)
+	sk, _, err := keys.fileKeys(kdf)
+	return sk, err
+}
+
+// sealHidden returns the deniable region of size bytes for a file with
+// header, filled from random. It holds plaintext, encrypted with passphrase,
+// unless passphrase is nil, in which case it is only random.
+func sealHidden(passphrase []byte, plaintext []byte, size int64, header fileHeader, random io.Reader) ([]byte, error) {
+	region := make([]byte, size)
+	err := readRandom(random, region)
+	if err != nil || passphrase == nil {
+		return region, err
+	}
+	if int64(len(plaintext)) > size-hiddenOverhead {
+		return nil, errHiddenTooLarge
+	}
+	salt := region[:hiddenSaltSize]
+	nonce := region[hiddenSaltSize : hiddenSaltSize+chacha20poly1305.NonceSizeX]
+	key, err := hiddenKey(newPassphraseKeys(passphrase), salt, header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, size-hiddenSaltSize-chacha20poly1305.NonceSizeX-chacha20poly1305.Overhead)
+	binary.LittleEndian.PutUint64(padded, uint64(len(plaintext)))
+	copy(padded[8:], plaintext)
+	aead.Seal(region[:hiddenSaltSize+chacha20poly1305.NonceSizeX], nonce, padded, nil)
+	return region, nil
+}
+
+// openHidden decrypts the hidden payload in the deniable region of the
+// encrypted file read from input with keys. It fails with errHiddenNotFound
+// both if the passphrase is wrong and if the region holds no hidden payload.
+func openHidden(keys keySource, input io.ReadSeeker) ([]byte, error) {
+	_, err := input.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	header, err := readHeader(input)
+	if err != nil {
+		return nil, err
+	}
+	if header.Reserved == 0 {
+		return nil, errHiddenNoRegion
+	}
+	end, err := input.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if header.Flags&flagTrailerMAC != 0 {
+		end -= int64(len(header.Tag))
+	}
+	if end-header.Reserved < 0 {
+		return nil, errBadHeader
+	}
+	_, err = input.Seek(end-header.Reserved, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	region := make([]byte, header.Reserved)
+	_, err = io.ReadFull(input, region)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hiddenKey(keys, region[:hiddenSaltSize], header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := region[hiddenSaltSize : hiddenSaltSize+chacha20poly1305.NonceSizeX]
+	padded, err := aead.Open(nil, nonce, region[hiddenSaltSize+chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		return nil, errHiddenNotFound
+	}
+	length := binary.LittleEndian.Uint64(padded)
+	if length > uint64(len(padded)-8) {
+		return nil, errHiddenNotFound
+	}
+	return padded[8 : 8+length], nil
+}
+
+// decryptHidden decrypts the hidden payload of the encrypted file read from
+// input with keys to finalOutput.
+func decryptHidden(keys keySource, input io.ReadSeeker, finalOutput string) error {
+	plaintext, err := openHidden(keys, input)
+	if err != nil {
+		return err
+	}
+	output, err := createPlaintext(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	_, err = io.Copy(output, bytes.NewReader(plaintext))
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
+
+// hiddenPassphrase returns the passphrase of a hidden payload from the named
+// file, if any, or prompts for it twice. It exits on failure.
+func (p *prompts) hiddenPassphrase(name string) []byte {
+	if name != "" {
+		passphrase, err := readPassphraseFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return passphrase
+	}
+	if p.batch {
+		log.Println("the hidden payload needs a passphrase, but -batch does not allow prompting for it; use -hide-passphrase-file")
+		os.Exit(exitNoPassphrase)
+	}
+	passphrase, err := promptPassphrase(p.ask, "Enter passphrase for the hidden payload:", true)
+	exitIfUnanswered(err)
+	if err != nil {
+		log.Fatal("could not read passphrase")
+	}
+	return passphrase
+}
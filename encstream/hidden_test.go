@@ -0,0 +1,110 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestHiddenPayload verifies that a hidden payload only decrypts with its own
+// passphrase, that the outer file decrypts as usual, and that a region
+// without a payload fails like a wrong passphrase.
+func TestHiddenPayload(t *testing.T) {
+	passphrase := []byte("hunter2")
+	hiddenPassphrase := []byte("correct horse battery staple")
+	plaintext := bytes.Repeat([]byte("attack at dawn "), 10000)
+	hidden := []byte("attack at dusk")
+	const size = 4096
+
+	encrypt := func(output encryptOutput, opts encryptOptions) {
+		_, _, _, err := encryptTo(passphrase, bytes.NewReader(plaintext), output, 0, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	decrypt := func(ciphertext []byte) error {
+		_, r, err := openCiphertext(newPassphraseKeys(passphrase), bytes.NewReader(ciphertext))
+		if err != nil {
+			return err
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext")
+		}
+		return nil
+	}
+
+	withPayload := new(memoryOutput)
+	encrypt(withPayload, encryptOptions{deniable: size, hidden: hidden, hiddenPassphrase: hiddenPassphrase})
+	empty := new(memoryOutput)
+	encrypt(empty, encryptOptions{deniable: size})
+	var stream bytes.Buffer
+	encrypt(streamOutput{&stream}, encryptOptions{deniable: size, hidden: hidden, hiddenPassphrase: hiddenPassphrase})
+	if len(withPayload.buf) != len(empty.buf) {
+		t.Fatal("a region with a hidden payload has a different size than one without")
+	}
+
+	for _, ciphertext := range [][]byte{withPayload.buf, empty.buf, stream.Bytes()} {
+		if err := decrypt(ciphertext); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ciphertext := range [][]byte{withPayload.buf, stream.Bytes()} {
+		got, err := openHidden(newPassphraseKeys(hiddenPassphrase), bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, hidden) {
+			t.Fatal("the hidden payload decrypted to something else")
+		}
+	}
+
+	// a region without a payload cannot be told from a wrong passphrase.
+	for _, c := range []struct {
+		passphrase []byte
+		ciphertext []byte
+	}{{passphrase, withPayload.buf}, {[]byte("hunter3"), withPayload.buf}, {hiddenPassphrase, empty.buf}} {
+		_, err := openHidden(newPassphraseKeys(c.passphrase), bytes.NewReader(c.ciphertext))
+		if err != errHiddenNotFound {
+			t.Fatal("expected errHiddenNotFound, got", err)
+		}
+	}
+	plain := new(memoryOutput)
+	encrypt(plain, encryptOptions{})
+	if _, err := openHidden(newPassphraseKeys(hiddenPassphrase), bytes.NewReader(plain.buf)); err != errHiddenNoRegion {
+		t.Fatal("expected errHiddenNoRegion, got", err)
+	}
+
+	// the region is covered by the MAC of the outer file.
+	modified := append([]byte{}, withPayload.buf...)
+	modified[len(modified)-1] ^= 1
+	if err := decrypt(modified); err != errBadMAC {
+		t.Fatal("expected errBadMAC for a modified region, got", err)
+	}
+	if _, err := openHidden(newPassphraseKeys(hiddenPassphrase), bytes.NewReader(modified)); err != errHiddenNotFound {
+		t.Fatal("expected errHiddenNotFound for a modified region, got", err)
+	}
+
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		opts encryptOptions
+		err  error
+	}{
+		{encryptOptions{deniable: size, hidden: hidden, hiddenPassphrase: passphrase}, errHiddenSameKey},
+		{encryptOptions{deniable: size, hidden: make([]byte, size), hiddenPassphrase: hiddenPassphrase}, errHiddenTooLarge},
+		{encryptOptions{deniable: hiddenOverhead}, errHiddenSize},
+		{encryptOptions{deniable: size, recipients: []recipient{id.public}}, errHiddenOptions},
+		{encryptOptions{deniable: size, fips: true}, errHiddenOptions},
+	} {
+		_, _, _, err := encryptTo(passphrase, bytes.NewReader(plaintext), new(memoryOutput), 0, c.opts)
+		if err != c.err {
+			t.Fatalf("expected %v, got %v", c.err, err)
+		}
+	}
+}
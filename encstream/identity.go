@@ -0,0 +1,433 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Files can be encrypted to recipients, identified by X25519 public keys,
+// instead of a passphrase. The file keys are then derived from a random file
+// key, which is wrapped for every recipient in a stanza of the header: an
+// ephemeral public key, and the file key sealed under a key agreed between the
+// ephemeral key and the recipient's key.
+//
+// Every stanza starts with a key ID, a prefix of the recipient key's
+// fingerprint, so that decryption can go straight to the matching identity
+// and say clearly when none matches. The default 4 byte key ID is short
+// enough to be shared by many keys, so it does not identify the recipient
+// much; the full 32 byte fingerprint can be used instead.
+
+const (
+	publicKeyPrefix = "enc-pub-"
+	secretKeyPrefix = "ENC-SECRET-KEY-"
+
+	shortKeyIDSize = 4
+	fullKeyIDSize  = 32
+)
+
+var (
+	errBadKey        = errors.New("malformed key")
+	errNeedIdentity  = errors.New("the file is encrypted to recipients; decrypt it with an identity")
+	errNeedPassword  = errors.New("the file is encrypted with a passphrase, not to recipients")
+	errNoIdentities  = errors.New("no identities found")
+	errBadKeyIDSize  = errors.New("key IDs must be between 0 and 32 bytes")
+	errRecipientsKDF = errors.New("files encrypted to recipients cannot share a key with an earlier version")
+)
+
+// recipient is the X25519 public key of someone a file can be encrypted to.
+type recipient [32]byte
+
+// identity is an X25519 key pair that can decrypt files encrypted to its
+// public key.
+type identity struct {
+	secret [32]byte
+	public recipient
+	// card, if set, is the OpenPGP card that holds secret, which enc does not
+	// know; see openpgpcard.go.
+	card *openpgpCard
+}
+
+// recipientStanza wraps the file key for a single recipient.
+type recipientStanza struct {
+	KeyID      []byte
+	Ephemeral  [32]byte
+	WrappedKey [chacha20poly1305.KeySize + chacha20poly1305.Overhead]byte
+	// Split, if set, is what is stored instead of WrappedKey: its
+	// anti-forensic split; see afsplit.go.
+	Split []byte
+}
+
+// generateIdentity generates a new identity.
+func generateIdentity() (identity, error) {
+	return generateIdentityRand(rand.Reader)
+}
+
+// generateIdentityRand is generateIdentity, with the secret key read from
+// random.
+func generateIdentityRand(random io.Reader) (identity, error) {
+	var id identity
+	err := readRandom(random, id.secret[:])
+	if err != nil {
+		return identity{}, err
+	}
+	curve25519.ScalarBaseMult((*[32]byte)(&id.public), &id.secret)
+	return id, nil
+}
+
+// String returns the text form of r.
+func (r recipient) String() string {
+	return publicKeyPrefix + base64.RawURLEncoding.EncodeToString(r[:])
+}
+
+// String returns the text form of the secret key of id.
+func (id identity) String() string {
+	return secretKeyPrefix + base64.RawURLEncoding.EncodeToString(id.secret[:])
+}
+
+// fingerprint returns the BLAKE2b-256 fingerprint of r.
+func (r recipient) fingerprint() [32]byte {
+	return blake2b.Sum256(append([]byte("enc key id\x00"), r[:]...))
+}
+
+// keyID returns the first size bytes of the fingerprint of r.
+func (r recipient) keyID(size int) []byte {
+	fingerprint := r.fingerprint()
+	return fingerprint[:size]
+}
+
+// parseKey decodes a 32 byte key in the text form starting with prefix.
+func parseKey(s string, prefix string) ([32]byte, error) {
+	var key [32]byte
+	if !strings.HasPrefix(s, prefix) {
+		return key, errBadKey
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil || len(b) != len(key) {
+		return key, errBadKey
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// parseRecipient parses the text form of a recipient, or an ssh-ed25519
+// public key.
+func parseRecipient(s string) (recipient, error) {
+	if isSSHKey(s) {
+		return parseSSHRecipient(s)
+	}
+	key, err := parseKey(s, publicKeyPrefix)
+	return recipient(key), err
+}
+
+// parseIdentity parses the text form of an identity.
+func parseIdentity(s string) (identity, error) {
+	secret, err := parseKey(s, secretKeyPrefix)
+	if err != nil {
+		return identity{}, err
+	}
+	id := identity{secret: secret}
+	curve25519.ScalarBaseMult((*[32]byte)(&id.public), &id.secret)
+	return id, nil
+}
+
+// readKeyFile returns the non-empty lines of the named file that are not
+// comments, which start with #.
+func readKeyFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return keyLines(f)
+}
+
+// keyLines returns the non-empty lines read from r that are not comments.
+func keyLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readIdentities reads the identities stored in the named files, which may
+// also be OpenSSH ed25519 private keys. Files protected with a passphrase are
+// passed to unlock along with their name, sealed ones are unsealed, and
+// those naming keys on OpenPGP cards give identities that use the card.
+func readIdentities(names []string, unlock func(name string, contents string) ([]identity, error)) ([]identity, error) {
+	var ids []identity
+	for _, name := range names {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var unlocked []identity
+		switch {
+		case isCardIdentity(contents):
+			unlocked, err = cardIdentities(string(contents))
+		case isSealed(contents):
+			unlocked, err = unsealIdentities(name, string(contents))
+		case isProtected(contents):
+			unlocked, err = unlock(name, string(contents))
+		case isSSHPrivateKey(contents):
+			var id identity
+			id, err = parseSSHIdentity(contents, nil)
+			unlocked = []identity{id}
+		default:
+			unlocked, err = parseIdentities(bytes.NewReader(contents))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		ids = append(ids, unlocked...)
+	}
+	if len(ids) == 0 {
+		return nil, errNoIdentities
+	}
+	return ids, nil
+}
+
+// parseIdentities parses the identities listed in r, one per line.
+func parseIdentities(r io.Reader) ([]identity, error) {
+	lines, err := keyLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var ids []identity
+	for _, line := range lines {
+		id, err := parseIdentity(line)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// readRecipients parses recipients, each given either directly or as the
+// name of a file listing recipients.
+func readRecipients(args []string) ([]recipient, error) {
+	var recipients []recipient
+	for _, arg := range args {
+		lines := []string{arg}
+		if !strings.HasPrefix(arg, publicKeyPrefix) && !isSSHKey(arg) {
+			var err error
+			lines, err = readKeyFile(arg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, line := range lines {
+			r, err := parseRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", arg, err)
+			}
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients, nil
+}
+
+// wrapKey derives the key that wraps the file key for the recipient with the
+// given public key from their shared secret.
+func wrapKey(shared []byte, ephemeral [32]byte, public recipient) ([32]byte, error) {
+	var k [32]byte
+	hash, err := blake2b.New256(shared)
+	if err != nil {
+		return k, err
+	}
+	hash.Write([]byte("enc recipient"))
+	hash.Write(ephemeral[:])
+	hash.Write(public[:])
+	copy(k[:], hash.Sum(nil))
+	return k, nil
+}
+
+// wrap wraps fileKey for r, with a key ID of keyIDSize bytes and an
+// ephemeral key read from random.
+func (r recipient) wrap(fileKey [32]byte, keyIDSize int, random io.Reader) (recipientStanza, error) {
+	if keyIDSize < 0 || keyIDSize > fullKeyIDSize {
+		return recipientStanza{}, errBadKeyIDSize
+	}
+	ephemeral, err := generateIdentityRand(random)
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	shared, err := curve25519.X25519(ephemeral.secret[:], r[:])
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	k, err := wrapKey(shared, ephemeral.public, r)
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	aead, err := chacha20poly1305.New(k[:])
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	s := recipientStanza{
+		KeyID:     r.keyID(keyIDSize),
+		Ephemeral: ephemeral.public,
+	}
+	// every wrap key is used once, so a fixed nonce is safe.
+	copy(s.WrappedKey[:], aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey[:], nil))
+	return s, nil
+}
+
+// matches reports whether the stanza s may be addressed to id.
+func (id identity) matches(s recipientStanza) bool {
+	return bytes.Equal(id.public.keyID(len(s.KeyID)), s.KeyID)
+}
+
+// unwrap recovers the file key from s, if it was wrapped for id. It only
+// fails with an error if the card of id does.
+func (id identity) unwrap(s recipientStanza) ([32]byte, bool, error) {
+	var fileKey [32]byte
+	var shared []byte
+	var err error
+	if id.card != nil {
+		shared, err = id.card.agree(s.Ephemeral)
+		if err != nil {
+			return fileKey, false, err
+		}
+		if subtle.ConstantTimeCompare(shared, make([]byte, 32)) == 1 {
+			return fileKey, false, nil
+		}
+	} else {
+		shared, err = curve25519.X25519(id.secret[:], s.Ephemeral[:])
+		if err != nil {
+			return fileKey, false, nil
+		}
+	}
+	k, err := wrapKey(shared, s.Ephemeral, id.public)
+	if err != nil {
+		return fileKey, false, err
+	}
+	aead, err := chacha20poly1305.New(k[:])
+	if err != nil {
+		return fileKey, false, nil
+	}
+	key, err := aead.Open(nil, make([]byte, aead.NonceSize()), s.WrappedKey[:], nil)
+	if err != nil {
+		return fileKey, false, nil
+	}
+	copy(fileKey[:], key)
+	return fileKey, true, nil
+}
+
+// keysFromFileKey derives the file keys from the random file key of a file
+// encrypted to recipients.
+func keysFromFileKey(fileKey [32]byte) (sk [32]byte, macKey [32]byte) {
+	return subkey(fileKey, "enc secret key"), subkey(fileKey, "enc mac key")
+}
+
+// keySource derives the keys of an encrypted file from its header.
+type keySource interface {
+	fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error)
+}
+
+// passphraseKeys derives the file keys from a passphrase, refusing headers
+// that ask for more KDF work than its limits allow.
+type passphraseKeys struct {
+	passphrase []byte
+	limits     resourceLimits
+}
+
+// newPassphraseKeys returns passphraseKeys with the default limits.
+func newPassphraseKeys(passphrase []byte) passphraseKeys {
+	return passphraseKeys{passphrase: passphrase, limits: defaultLimits()}
+}
+
+func (p passphraseKeys) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if len(header.Recipients) > 0 {
+		return sk, macKey, errNeedIdentity
+	}
+	if header.Vault.Path != "" {
+		return sk, macKey, errNeedVault
+	}
+	err = p.limits.check(header)
+	if err != nil {
+		return sk, macKey, err
+	}
+	sk, macKey, err = p.kdfKeys(header)
+	if err != nil {
+		return sk, macKey, err
+	}
+	if header.Subkey != ([32]byte{}) {
+		return subkeys(sk, header.Subkey)
+	}
+	return sk, macKey, nil
+}
+
+// kdfKeys derives the keys the KDF of header gives, before any subkey.
+func (p passphraseKeys) kdfKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if header.Suite == suiteFIPS {
+		return deriveFIPSKeys(p.passphrase, header)
+	}
+	if header.ArgonLanes > maxLanes {
+		return sk, macKey, errArgonLanes
+	}
+	sk, macKey = deriveKeys(p.passphrase, header)
+	return sk, macKey, nil
+}
+
+// identityKeys unwraps the file keys with any of a set of identities.
+type identityKeys []identity
+
+func (ids identityKeys) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	fileKey, err := ids.fileKey(header)
+	if err != nil {
+		return sk, macKey, err
+	}
+	sk, macKey = keysFromFileKey(fileKey)
+	return sk, macKey, nil
+}
+
+// fileKey unwraps the file key of header with any of ids.
+func (ids identityKeys) fileKey(header fileHeader) (fileKey [32]byte, err error) {
+	if header.Vault.Path != "" {
+		return fileKey, errNeedVault
+	}
+	if len(header.Recipients) == 0 {
+		return fileKey, errNeedPassword
+	}
+	var keyIDs []string
+	for _, s := range header.Recipients {
+		for _, id := range ids {
+			if !id.matches(s) {
+				continue
+			}
+			fileKey, ok, err := id.unwrap(s)
+			if err != nil {
+				return fileKey, err
+			}
+			if ok {
+				return fileKey, nil
+			}
+		}
+		keyID := hex.EncodeToString(s.KeyID)
+		if keyID == "" {
+			keyID = "(hidden)"
+		}
+		keyIDs = append(keyIDs, keyID)
+	}
+	return fileKey, fmt.Errorf("no matching identity; the file is encrypted to key IDs %v", strings.Join(keyIDs, ", "))
+}
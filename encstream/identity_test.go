@@ -0,0 +1,74 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestRecipients verifies that a file encrypted to several recipients can be
+// decrypted by each of them, and that the key IDs in its stanzas name the
+// recipients when no identity matches.
+func TestRecipients(t *testing.T) {
+	var ids []identity
+	for i := 0; i < 3; i++ {
+		id, err := generateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := parseIdentity(id.String())
+		if err != nil || parsed != id {
+			t.Fatal("identity did not survive encoding", err)
+		}
+		r, err := parseRecipient(id.public.String())
+		if err != nil || r != id.public {
+			t.Fatal("recipient did not survive encoding", err)
+		}
+		ids = append(ids, id)
+	}
+
+	plaintext := []byte("attack at dawn")
+	for _, fullKeyID := range []bool{false, true} {
+		output := new(memoryOutput)
+		opts := encryptOptions{recipients: []recipient{ids[0].public, ids[1].public}, fullKeyID: fullKeyID}
+		_, _, _, err := encryptTo(nil, bytes.NewReader(plaintext), output, 0, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := readHeader(bytes.NewReader(output.buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyIDSize := shortKeyIDSize
+		if fullKeyID {
+			keyIDSize = fullKeyIDSize
+		}
+		if len(header.Recipients) != 2 || len(header.Recipients[1].KeyID) != keyIDSize {
+			t.Fatal("wrong recipient stanzas", header.Recipients)
+		}
+
+		for _, id := range ids[:2] {
+			_, r, err := openCiphertext(identityKeys{ids[2], id}, bytes.NewReader(output.buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("decryption resulted in a different plaintext")
+			}
+		}
+
+		_, _, err = openCiphertext(identityKeys{ids[2]}, bytes.NewReader(output.buf))
+		if err == nil || !strings.Contains(err.Error(), hex.EncodeToString(ids[1].public.keyID(keyIDSize))) {
+			t.Fatal("expected an error naming the key IDs, got", err)
+		}
+		if _, _, err = openCiphertext(newPassphraseKeys([]byte("hunter2")), bytes.NewReader(output.buf)); err != errNeedIdentity {
+			t.Fatal("expected errNeedIdentity, got", err)
+		}
+	}
+}
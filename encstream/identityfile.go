@@ -0,0 +1,228 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// An identity file can be protected with a passphrase. Its identities are
+// then encrypted as an armored enc file, below comments with their public
+// keys, which can still be read without the passphrase:
+//
+//	# public key: enc-pub-...
+//	-----BEGIN ENC FILE-----
+//	...
+//	-----END ENC FILE-----
+//
+// Decrypting with a protected identity file asks for its passphrase to unlock
+// it, and `enc identity change-pass` changes, adds or removes the passphrase.
+
+// publicKeyComment precedes the public key of each identity in an identity
+// file.
+const publicKeyComment = "# public key: "
+
+var (
+	errIdentityCommand = errors.New("unknown identity command; see enc identity -h")
+	errSSHChangePass   = errors.New("the passphrase of an SSH key is changed with ssh-keygen -p")
+)
+
+// identityFileContents returns the contents of an identity file holding ids,
+// protected with passphrase unless it is nil.
+func identityFileContents(ids []identity, passphrase []byte) (string, error) {
+	var comments, keys strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&comments, "%v%v\n", publicKeyComment, id.public)
+		fmt.Fprintf(&keys, "%v%v\n%v\n", publicKeyComment, id.public, id)
+	}
+	if passphrase == nil {
+		return keys.String(), nil
+	}
+	armored, err := encryptText(passphrase, []byte(keys.String()))
+	if err != nil {
+		return "", err
+	}
+	return comments.String() + armored, nil
+}
+
+// isProtected reports whether the identity file contents, or the OpenSSH
+// private key they hold, are protected with a passphrase.
+func isProtected(contents []byte) bool {
+	return bytes.Contains(contents, []byte(armorBegin)) || isProtectedSSHKey(contents)
+}
+
+// unlockIdentities decrypts the identities in the protected identity file
+// contents with passphrase.
+func unlockIdentities(contents string, passphrase []byte) ([]identity, error) {
+	if isSSHPrivateKey([]byte(contents)) {
+		id, err := parseSSHIdentity([]byte(contents), passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []identity{id}, nil
+	}
+	plaintext, err := decryptText(newPassphraseKeys(passphrase), contents)
+	if err != nil {
+		return nil, err
+	}
+	return parseIdentities(bytes.NewReader(plaintext))
+}
+
+// identityPublicKeys returns the public keys of the identities in the named
+// file without unlocking it: those in its public key comments, or for an SSH
+// key, the one in the .pub file beside it.
+func identityPublicKeys(name string) ([]string, error) {
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if isSSHPrivateKey(contents) {
+		public, err := os.ReadFile(name + ".pub")
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimSpace(string(public))
+		if _, err := parseSSHRecipient(key); err != nil {
+			return nil, fmt.Errorf("%v.pub: %v", name, err)
+		}
+		return []string{key}, nil
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if key, ok := strings.CutPrefix(strings.TrimSpace(line), publicKeyComment); ok {
+			if _, err := parseRecipient(key); err != nil {
+				return nil, fmt.Errorf("%v: %v", name, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 && !isProtected(contents) {
+		ids, err := parseIdentities(bytes.NewReader(contents))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		for _, id := range ids {
+			keys = append(keys, id.public.String())
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%v: %v", name, errNoIdentities)
+	}
+	return keys, nil
+}
+
+// writePrivateFile writes a file readable only by its owner, such as an
+// identity file. An existing file is only replaced if replace is set, and
+// then atomically.
+func writePrivateFile(name string, contents string, replace bool) error {
+	path := name
+	if replace {
+		path = name + ".temp"
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && replace {
+		err = os.Rename(path, name)
+	}
+	if err != nil && replace {
+		os.Remove(path)
+	}
+	return err
+}
+
+// identityCommands are the subcommands of enc identity.
+var identityCommands = map[string]func(args []string){
+	"change-pass": changePassMain,
+	"signer-key":  signerKeyMain,
+}
+
+// identityMain implements `enc identity`, which manages identity files.
+func identityMain(args []string) {
+	if len(args) == 0 || identityCommands[args[0]] == nil {
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			log.Fatal(errIdentityCommand)
+		}
+		// prints the usage for -h
+		fs := newFlagSet("identity",
+			"enc identity change-pass [-remove] [identity file]",
+			"enc identity signer-key [identity file]")
+		fs.Parse(args)
+		fs.Usage()
+		os.Exit(-1)
+	}
+	identityCommands[args[0]](args[1:])
+}
+
+// signerKeyMain implements `enc identity signer-key`, which prints the key
+// that signatures made with an identity file verify against.
+func signerKeyMain(args []string) {
+	fs := newFlagSet("identity signer-key", "enc identity signer-key [identity file]")
+	var p prompts
+	p.register(fs, false, false)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	key, err := readSigningKey(positional[0], p.unlockWith)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(signerKeyString(key.Public().(ed25519.PublicKey)))
+}
+
+// changePassMain implements `enc identity change-pass`, which changes the
+// passphrase of an identity file.
+func changePassMain(args []string) {
+	fs := newFlagSet("identity change-pass", "enc identity change-pass [-remove] [identity file]")
+	remove := fs.Bool("remove", false, "remove the passphrase, leaving the identities unprotected")
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	name := positional[0]
+	if contents, err := os.ReadFile(name); err == nil && isSSHPrivateKey(contents) {
+		log.Fatal(errSSHChangePass)
+	} else if err == nil && isSealed(contents) {
+		log.Fatal(errSealedChangePass)
+	} else if err == nil && isCardIdentity(contents) {
+		log.Fatal(errCardChangePass)
+	}
+
+	// the old and new passphrases are both typed in.
+	var p prompts
+	ids, err := readIdentities([]string{name}, p.unlock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var passphrase []byte
+	if !*remove {
+		fmt.Fprintln(os.Stderr, "Choose the new passphrase for", name)
+		passphrase = p.passphrase(true)
+	}
+	contents, err := identityFileContents(ids, passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writePrivateFile(name, contents, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,84 @@
+package encstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestProtectedIdentityFile verifies that identity files protected with a
+// passphrase are unlocked with it, keep their public keys readable, and can
+// have their passphrase changed and removed.
+func TestProtectedIdentityFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var ids []identity
+	for i := 0; i < 2; i++ {
+		id, err := generateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	name := filepath.Join(dir, "identity")
+
+	read := func(passphrase string) ([]identity, error) {
+		return readIdentities([]string{name}, func(n string, contents string) ([]identity, error) {
+			if n != name {
+				t.Fatal("asked to unlock", n)
+			}
+			return unlockIdentities(contents, []byte(passphrase))
+		})
+	}
+	check := func(got []identity) {
+		if len(got) != len(ids) || got[0] != ids[0] || got[1] != ids[1] {
+			t.Fatal("identities did not survive the identity file")
+		}
+	}
+
+	for i, passphrase := range []string{"first passphrase", "second passphrase", ""} {
+		var key []byte
+		if passphrase != "" {
+			key = []byte(passphrase)
+		}
+		contents, err := identityFileContents(ids, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writePrivateFile(name, contents, i > 0); err != nil {
+			t.Fatal(err)
+		}
+		if isProtected([]byte(contents)) != (key != nil) {
+			t.Fatal("protection not detected")
+		}
+		if key != nil && (strings.Contains(contents, secretKeyPrefix) || !strings.Contains(contents, ids[1].public.String())) {
+			t.Fatal("a protected identity file should only show the public keys")
+		}
+
+		got, err := read(passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(got)
+		if key != nil {
+			if _, err := read("wrong"); err == nil {
+				t.Fatal("unlocked with the wrong passphrase")
+			}
+		}
+	}
+	if err := writePrivateFile(name, "", false); !os.IsExist(err) {
+		t.Fatal("replaced an identity file without replace:", err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal("identity file is readable by others:", info.Mode())
+	}
+}
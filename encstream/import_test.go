@@ -0,0 +1,57 @@
+package encstream_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/avahowell/enc/encstream"
+)
+
+// TestImport verifies that programs that embed enc can encrypt and decrypt
+// files and streams through the exported API alone.
+func TestImport(t *testing.T) {
+	if err := encstream.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "enctest-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := bytes.Repeat([]byte("embedded "), 10000)
+
+	ciphertext := filepath.Join(dir, "ciphertext")
+	err = encstream.Encrypt([]byte("hunter2"), bytes.NewReader(plaintext), ciphertext, encstream.WithRand(rand.Reader), encstream.WithClock(time.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted := filepath.Join(dir, "decrypted")
+	if err := encstream.Decrypt([]byte("hunter2"), ciphertext, decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(decrypted); err != nil || !bytes.Equal(b, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext", err)
+	}
+
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	stream := new(bytes.Buffer)
+	w := encstream.NewWriter(key, stream, encstream.WithChunkSize(1024))
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(encstream.NewReader(key, stream, encstream.WithChunkSize(1024)))
+	if err != nil || !bytes.Equal(b, plaintext) {
+		t.Fatal("the stream decrypted to a different plaintext", err)
+	}
+}
@@ -0,0 +1,112 @@
+package encstream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// inspect prints what can be learned about the named encrypted file without
+// the key: the fields of its header and how it is stored. The label and
+// metadata are authenticated by the MAC, but that can only be checked when
+// decrypting. The expiry is shown as of now.
+func inspect(name string, w io.Writer, now time.Time) error {
+	f, err := openEncrypted(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header, err := readHeader(f)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "version:", header.Version)
+	if header.Label != "" {
+		fmt.Fprintln(w, "label:", header.Label)
+	}
+	if header.NotAfter != 0 {
+		status := ""
+		if header.expired(now) {
+			status = " (expired)"
+		}
+		fmt.Fprintf(w, "not after: %v%v\n", expiryString(header.NotAfter), status)
+	}
+	for _, field := range header.Metadata {
+		fmt.Fprintf(w, "%v: %v\n", strings.ToLower(field.Key), field.Value)
+	}
+	contents := "file"
+	if header.Flags&flagArchive != 0 {
+		contents = "archive"
+	}
+	fmt.Fprintln(w, "contents:", contents)
+	chunking := "fixed"
+	if header.Flags&flagDedup != 0 {
+		chunking = "content-defined"
+	}
+	fmt.Fprintln(w, "chunking:", chunking)
+	if header.Suite == suiteAESGCM {
+		fmt.Fprintln(w, "suite: aes-256-gcm, blake2b")
+	}
+	switch {
+	case header.Suite == suiteFIPS:
+		fmt.Fprintln(w, "suite: fips, aes-256-gcm, hmac-sha-512")
+		fmt.Fprintf(w, "kdf: pbkdf2-hmac-sha256, %v iterations\n", header.Iterations)
+	case header.Vault.Path != "":
+		fmt.Fprintln(w, "key: subkey of a data key of the Vault transit key", header.Vault.Path)
+	case len(header.Recipients) == 0:
+		fmt.Fprintf(w, "kdf: argon2id, %v passes, %v KiB, %v lanes\n", header.ArgonTime, header.ArgonMemory, header.ArgonLanes)
+		if header.Subkey != ([32]byte{}) {
+			fmt.Fprintln(w, "key: subkey of a key shared with other files")
+		}
+	}
+	for _, s := range header.Recipients {
+		keyID := hex.EncodeToString(s.KeyID)
+		if keyID == "" {
+			keyID = "(hidden)"
+		}
+		if s.Split != nil {
+			keyID += " (split)"
+		}
+		fmt.Fprintln(w, "recipient:", keyID)
+	}
+	if header.Signer != ([32]byte{}) {
+		fmt.Fprintln(w, "signer:", signerKeyString(header.Signer[:]))
+	}
+	if header.Reserved != 0 {
+		fmt.Fprintln(w, "deniable region:", header.Reserved, "bytes")
+	}
+	fmt.Fprintln(w, "size:", size, "bytes")
+	if header.Flags&flagPadded != 0 {
+		fmt.Fprintln(w, "plaintext: padded")
+	}
+	if header.Flags&flagDigest != 0 {
+		fmt.Fprintln(w, "digest:", header.digestString())
+	}
+	if fields := header.optionalFields(); len(fields) > 0 {
+		fmt.Fprintln(w, "optional fields:", strings.Join(fields, ", "))
+	} else {
+		fmt.Fprintln(w, "optional fields: none")
+	}
+
+	var storage []string
+	if _, ok := volumeBase(name); ok {
+		storage = append(storage, "volumes")
+	}
+	if hasRecovery(name) {
+		storage = append(storage, "recovery records")
+	}
+	if _, ok := f.(*dearmoredFile); ok {
+		storage = append(storage, "armored")
+	}
+	if len(storage) > 0 {
+		fmt.Fprintln(w, "storage:", strings.Join(storage, ", "))
+	}
+	return nil
+}
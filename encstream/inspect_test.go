@@ -0,0 +1,64 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestInspect verifies that inspect shows the label, metadata and expiry of
+// plain and armored files without the key.
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Flags = flagArchive
+	h.Label = "prod DB backup 2024-06-01"
+	h.Metadata = []metadataField{{"Comment", "nightly"}}
+	h.NotAfter = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC).Unix()
+	plain := filepath.Join(dir, "plain.enc")
+	if err := ioutil.WriteFile(plain, h.encode(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	armored := new(bytes.Buffer)
+	if err := writeArmor(armored, bytes.NewReader(h.encode()), h.armorHeaders()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(armored.String(), "Label: prod DB backup 2024-06-01\n") {
+		t.Fatal("label is not shown in the armor")
+	}
+	armoredName := filepath.Join(dir, "armored.enc")
+	if err := ioutil.WriteFile(armoredName, armored.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{plain, armoredName} {
+		out := new(bytes.Buffer)
+		if err := inspect(name, out, time.Unix(h.NotAfter-1, 0)); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"label: prod DB backup 2024-06-01\n", "comment: nightly\n", "not after: 2024-06-01T00:00:00Z\n", "contents: archive\n"} {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("%v: inspect output is missing %q:\n%v", name, want, out)
+			}
+		}
+		out.Reset()
+		if err := inspect(name, out, time.Unix(h.NotAfter+1, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "not after: 2024-06-01T00:00:00Z (expired)\n") {
+			t.Fatalf("%v: inspect does not show the file as expired:\n%v", name, out)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// enc k8s seals Kubernetes Secrets, so that their manifests can be kept in
+// version control. Sealing turns a Secret into a SealedSecret, which keeps the
+// Secret's metadata and key names in the clear, but holds each value as an
+// enc file encrypted to recipients. Each value is encrypted separately, so
+// that changing one value changes one line of the manifest, and its header
+// is labelled with the namespace, name and key it belongs to, so that values
+// cannot be moved between secrets or keys unnoticed. Unsealing, at deploy
+// time with the identity of the cluster's operators or CI, turns it back into
+// the Secret to pipe to kubectl apply.
+//
+// Manifests are read and written as JSON, which kubectl produces with -o json
+// and accepts in place of YAML. enc works as a kubectl plugin when installed
+// or linked as kubectl-enc, which runs enc k8s.
+//
+// A SealedSecret is not a resource any cluster knows about, so applying one
+// by mistake fails rather than storing ciphertext as the secret.
+
+const (
+	sealedSecretAPIVersion = "enc/v1"
+	sealedSecretKind       = "SealedSecret"
+
+	// kubectlPluginName is the name kubectl runs enc by as a plugin.
+	kubectlPluginName = "kubectl-enc"
+)
+
+var (
+	errNotSecret       = errors.New("the input is not a Kubernetes Secret in JSON; get one with kubectl -o json")
+	errNotSealedSecret = errors.New("the input is not a SealedSecret written by enc k8s seal")
+	errSealedLabel     = errors.New("a sealed value was moved from another secret or key")
+	errSealPassphrase  = errors.New("secrets are sealed to recipients; give -r or -R, or set a default identity")
+)
+
+// k8sMetadataRuntime are the metadata fields the cluster sets, which are left
+// out of sealed secrets.
+var k8sMetadataRuntime = []string{"creationTimestamp", "generation", "managedFields", "resourceVersion", "selfLink", "uid"}
+
+// k8sSecret is a Kubernetes Secret.
+type k8sSecret struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Type       string                 `json:"type,omitempty"`
+	Immutable  *bool                  `json:"immutable,omitempty"`
+	Data       map[string]string      `json:"data,omitempty"`
+	StringData map[string]string      `json:"stringData,omitempty"`
+}
+
+// sealedSecret is a Secret whose values are encrypted.
+type sealedSecret struct {
+	APIVersion    string                 `json:"apiVersion"`
+	Kind          string                 `json:"kind"`
+	Metadata      map[string]interface{} `json:"metadata"`
+	Type          string                 `json:"type,omitempty"`
+	Immutable     *bool                  `json:"immutable,omitempty"`
+	EncryptedData map[string]string      `json:"encryptedData"`
+}
+
+// sealedLabel returns the label of the sealed value of key in the secret
+// described by metadata.
+func sealedLabel(metadata map[string]interface{}, key string) string {
+	namespace, _ := metadata["namespace"].(string)
+	name, _ := metadata["name"].(string)
+	return fmt.Sprintf("k8s secret %v/%v/%v", namespace, name, key)
+}
+
+// sealSecret seals the Secret manifest input to opts.recipients.
+func sealSecret(input []byte, opts encryptOptions) ([]byte, error) {
+	if len(opts.recipients) == 0 {
+		return nil, errSealPassphrase
+	}
+	var secret k8sSecret
+	err := json.Unmarshal(input, &secret)
+	if err != nil || secret.Kind != "Secret" || secret.APIVersion != "v1" {
+		return nil, errNotSecret
+	}
+	if secret.Metadata == nil {
+		secret.Metadata = make(map[string]interface{})
+	}
+	for _, field := range k8sMetadataRuntime {
+		delete(secret.Metadata, field)
+	}
+
+	values := make(map[string][]byte)
+	for key, value := range secret.Data {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("data %v: %v", key, err)
+		}
+		values[key] = decoded
+	}
+	// as in the API server, stringData takes precedence.
+	for key, value := range secret.StringData {
+		values[key] = []byte(value)
+	}
+
+	sealed := sealedSecret{
+		APIVersion:    sealedSecretAPIVersion,
+		Kind:          sealedSecretKind,
+		Metadata:      secret.Metadata,
+		Type:          secret.Type,
+		Immutable:     secret.Immutable,
+		EncryptedData: make(map[string]string),
+	}
+	for key, value := range values {
+		output := new(memoryOutput)
+		opts.label = sealedLabel(secret.Metadata, key)
+		_, _, _, err := encryptTo(nil, bytes.NewReader(value), output, 0, opts)
+		if err != nil {
+			return nil, err
+		}
+		sealed.EncryptedData[key] = base64.StdEncoding.EncodeToString(output.buf)
+	}
+	return marshalManifest(sealed)
+}
+
+// unsealSecret decrypts the SealedSecret manifest input with keys, returning
+// the Secret.
+func unsealSecret(input []byte, keys keySource) ([]byte, error) {
+	var sealed sealedSecret
+	err := json.Unmarshal(input, &sealed)
+	if err != nil || sealed.Kind != sealedSecretKind || sealed.APIVersion != sealedSecretAPIVersion {
+		return nil, errNotSealedSecret
+	}
+	secret := k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   sealed.Metadata,
+		Type:       sealed.Type,
+		Immutable:  sealed.Immutable,
+		Data:       make(map[string]string),
+	}
+	keyNames := make([]string, 0, len(sealed.EncryptedData))
+	for key := range sealed.EncryptedData {
+		keyNames = append(keyNames, key)
+	}
+	sort.Strings(keyNames)
+	for _, key := range keyNames {
+		ciphertext, err := base64.StdEncoding.DecodeString(sealed.EncryptedData[key])
+		if err != nil {
+			return nil, fmt.Errorf("encryptedData %v: %v", key, err)
+		}
+		header, plaintext, err := openCiphertext(keys, bytes.NewReader(ciphertext))
+		if err != nil {
+			return nil, fmt.Errorf("encryptedData %v: %v", key, err)
+		}
+		if header.Label != sealedLabel(sealed.Metadata, key) {
+			return nil, fmt.Errorf("encryptedData %v: %v", key, errSealedLabel)
+		}
+		value, err := ioutil.ReadAll(plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("encryptedData %v: %v", key, err)
+		}
+		secret.Data[key] = base64.StdEncoding.EncodeToString(value)
+	}
+	return marshalManifest(secret)
+}
+
+// marshalManifest encodes a manifest as kubectl does with -o json.
+func marshalManifest(v interface{}) ([]byte, error) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// readK8sManifest reads the manifest named by name, or stdin if it is "-".
+func readK8sManifest(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// writeK8sManifest writes a manifest to output, or stdout if it is "-". Files
+// are readable only by their owner, since unsealed secrets are plaintext.
+func writeK8sManifest(output string, manifest []byte) error {
+	if output == "-" {
+		_, err := os.Stdout.Write(manifest)
+		return err
+	}
+	return writePrivateFile(output, string(manifest), true)
+}
+
+// isKubectlPlugin reports whether enc was run by kubectl as a plugin.
+func isKubectlPlugin(arg0 string) bool {
+	return strings.TrimSuffix(filepath.Base(arg0), ".exe") == kubectlPluginName
+}
+
+// k8sMain implements `enc k8s`, which seals and unseals Kubernetes Secrets.
+func k8sMain(args []string) {
+	fs := newFlagSet("k8s",
+		"enc k8s seal [-r key] [-R name] [-o output] [secret.json or -]",
+		"enc k8s unseal [-i identity] [-o output] [sealed.json or -]")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// prints the usage for -h
+		fs.Parse(args)
+		fs.Usage()
+		os.Exit(-1)
+	}
+	command := args[0]
+	output := fs.String("o", "-", "write the manifest to this file instead of stdout")
+	var recipientArgs, recipientNames, identityFiles stringList
+	var p prompts
+	switch command {
+	case "seal":
+		fs.Var(&recipientArgs, "r", "seal to this public key, or the public keys listed in this file; may be repeated")
+		fs.Var(&recipientNames, "R", "seal to the public keys stored under this name in the keyring (see enc keyring); may be repeated")
+	case "unseal":
+		fs.Var(&identityFiles, "i", "unseal with this identity file; may be repeated")
+		p.register(fs, false, false)
+	default:
+		fs.Usage()
+		os.Exit(-1)
+	}
+	positional := parseArgs(fs, args[1:])
+	if len(positional) > 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	inputName := "-"
+	if len(positional) == 1 {
+		inputName = positional[0]
+	}
+	input, err := readK8sManifest(inputName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var manifest []byte
+	if command == "seal" {
+		if len(recipientNames) > 0 {
+			keys, err := keyringRecipients(recipientNames)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recipientArgs = append(recipientArgs, keys...)
+		}
+		if len(recipientArgs) == 0 {
+			keys, err := defaultRecipients()
+			if err != nil {
+				log.Fatal(err)
+			}
+			recipientArgs = keys
+		}
+		var opts encryptOptions
+		if len(recipientArgs) > 0 {
+			opts.recipients, err = readRecipients(recipientArgs)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		manifest, err = sealSecret(input, opts)
+	} else {
+		manifest, err = unsealSecret(input, p.keys(identityFiles, p.limits()))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeK8sManifest(*output, manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
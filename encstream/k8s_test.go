@@ -0,0 +1,72 @@
+package encstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// TestSealSecret verifies that a sealed Secret unseals to the original values,
+// without the metadata the cluster sets, and that sealed values cannot be
+// moved between keys.
+func TestSealSecret(t *testing.T) {
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte(`{
+    "apiVersion": "v1",
+    "kind": "Secret",
+    "metadata": {"name": "db", "namespace": "prod", "uid": "1234", "resourceVersion": "5"},
+    "type": "Opaque",
+    "data": {"password": "aHVudGVyMg==", "user": "YWRtaW4="},
+    "stringData": {"user": "root"}
+}`)
+	if _, err := sealSecret(input, encryptOptions{}); err != errSealPassphrase {
+		t.Fatal("expected errSealPassphrase, got", err)
+	}
+	if _, err := sealSecret([]byte(`{"apiVersion": "v1", "kind": "ConfigMap"}`), encryptOptions{recipients: []recipient{id.public}}); err != errNotSecret {
+		t.Fatal("expected errNotSecret, got", err)
+	}
+	sealed, err := sealSecret(input, encryptOptions{recipients: []recipient{id.public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsealed, err := unsealSecret(sealed, identityKeys{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secret k8sSecret
+	if err := json.Unmarshal(unsealed, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Kind != "Secret" || secret.Type != "Opaque" || secret.Metadata["name"] != "db" {
+		t.Fatal("the secret changed:", string(unsealed))
+	}
+	if _, ok := secret.Metadata["uid"]; ok {
+		t.Fatal("the uid was kept")
+	}
+	for key, value := range map[string]string{"password": "hunter2", "user": "root"} {
+		decoded, err := base64.StdEncoding.DecodeString(secret.Data[key])
+		if err != nil || string(decoded) != value {
+			t.Fatalf("%v: expected %q, got %q", key, value, decoded)
+		}
+	}
+
+	var swapped sealedSecret
+	if err := json.Unmarshal(sealed, &swapped); err != nil {
+		t.Fatal(err)
+	}
+	swapped.EncryptedData["user"] = swapped.EncryptedData["password"]
+	moved, err := marshalManifest(swapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsealSecret(moved, identityKeys{id}); err == nil {
+		t.Fatal("a value moved to another key was unsealed")
+	}
+	if !isKubectlPlugin("/usr/local/bin/kubectl-enc") || isKubectlPlugin("/usr/local/bin/enc") {
+		t.Fatal("bad kubectl plugin detection")
+	}
+}
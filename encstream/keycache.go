@@ -0,0 +1,139 @@
+package encstream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// With -cache-keys, or the cache-keys setting, the keys derived from a
+// passphrase are kept in the user's kernel keyring for a while, so that
+// decrypting files with the same salt again, such as the same file or the
+// files of a batch, skips both the passphrase and the KDF without an agent.
+// Keys are only cached once they have authenticated a file, so a mistyped
+// passphrase is never cached, and a cached key that fails to is dropped.
+//
+// A key is found by a digest of the KDF parameters and salt that derived it,
+// so the keyring shows nothing of the file. Keys are only readable by the
+// user's own processes, and the kernel removes them once their timeout
+// passes; `keyctl purge -p user enc:` removes them sooner.
+
+const settingCacheKeys = "cache-keys"
+
+// keyCache derives the keys of files from a passphrase like passphraseKeys,
+// taking them from the kernel keyring if they are there. The passphrase is
+// only asked for when a key is not.
+type keyCache struct {
+	prompts *prompts
+	limits  resourceLimits
+	timeout time.Duration
+
+	passphrase []byte
+	// derived holds the keys derived rather than found, by description.
+	derived map[string][64]byte
+}
+
+// settler is a keySource that is told whether its keys authenticated a file.
+type settler interface {
+	settle(header fileHeader, authenticated bool)
+}
+
+// settleKeys tells keys, or the keySource it wraps, whether its keys for
+// header authenticated the file.
+func settleKeys(keys keySource, header fileHeader, authenticated bool) {
+	for {
+		switch k := keys.(type) {
+		case enforceExpiry:
+			keys = k.keySource
+		case requireSigner:
+			keys = k.keySource
+		case settler:
+			k.settle(header, authenticated)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// cacheDescription returns the description the key of header is cached
+// under.
+func cacheDescription(header fileHeader) string {
+	sum := blake2b.Sum256([]byte(fmt.Sprintf("enc key cache %v %x %v %v %v %v", header.Suite, header.Salt, header.ArgonTime, header.ArgonMemory, header.ArgonLanes, header.Iterations)))
+	return "enc:" + hex.EncodeToString(sum[:16])
+}
+
+func (k *keyCache) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if len(header.Recipients) > 0 {
+		return sk, macKey, errNeedIdentity
+	}
+	if header.Vault.Path != "" {
+		return sk, macKey, errNeedVault
+	}
+	err = k.limits.check(header)
+	if err != nil {
+		return sk, macKey, err
+	}
+	description := cacheDescription(header)
+	cached, err := readCachedKey(description)
+	if err == nil && len(cached) == keyLen+macLen {
+		copy(sk[:], cached[:keyLen])
+		copy(macKey[:], cached[keyLen:])
+	} else {
+		if k.passphrase == nil {
+			k.passphrase = k.prompts.passphrase(false)
+		}
+		sk, macKey, err = passphraseKeys{passphrase: k.passphrase, limits: k.limits}.kdfKeys(header)
+		if err != nil {
+			return sk, macKey, err
+		}
+		if k.derived == nil {
+			k.derived = make(map[string][64]byte)
+		}
+		var keys [64]byte
+		copy(keys[:], sk[:])
+		copy(keys[keyLen:], macKey[:])
+		k.derived[description] = keys
+	}
+	if header.Subkey != ([32]byte{}) {
+		return subkeys(sk, header.Subkey)
+	}
+	return sk, macKey, nil
+}
+
+// settle caches the key of header once it has authenticated the file, or
+// drops it from the cache if it was found there but did not.
+func (k *keyCache) settle(header fileHeader, authenticated bool) {
+	description := cacheDescription(header)
+	keys, derived := k.derived[description]
+	switch {
+	case derived && authenticated:
+		err := cacheKey(description, keys[:], k.timeout)
+		if err != nil {
+			log.Println("warning: could not cache the key:", err)
+		}
+		delete(k.derived, description)
+	case !derived && !authenticated:
+		uncacheKey(description)
+	}
+}
+
+// cacheTimeout returns how long -cache-keys, or else the cache-keys setting
+// of c, says to cache keys for; zero turns caching off.
+func (p *prompts) cacheTimeout(c config) time.Duration {
+	value := p.cacheKeys
+	if value == "" {
+		value = c[settingCacheKeys]
+	}
+	if value == "" {
+		return 0
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		log.Fatalf("invalid cache timeout %q", value)
+	}
+	return timeout
+}
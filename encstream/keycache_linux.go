@@ -0,0 +1,51 @@
+package encstream
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readCachedKey returns the key cached under description in the user
+// keyring.
+func readCachedKey(description string) ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, keyLen+macLen)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n > len(buf) {
+		n = 0
+	}
+	return buf[:n], nil
+}
+
+// cacheKey caches key under description in the user keyring, where the
+// kernel removes it after timeout.
+func cacheKey(description string, key []byte, timeout time.Duration) error {
+	id, err := unix.AddKey("user", description, key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return err
+	}
+	seconds := int(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, seconds, 0, 0)
+	if err != nil {
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	}
+	return err
+}
+
+// uncacheKey removes the key cached under description, if there is one.
+func uncacheKey(description string) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	if err == nil {
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	}
+}
@@ -0,0 +1,66 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// TestKeyCache verifies that a key is cached in the kernel keyring once it
+// has authenticated a file, so that decrypting it again needs no passphrase,
+// and that keys that do not authenticate are neither cached nor kept.
+func TestKeyCache(t *testing.T) {
+	if err := cacheKey("enc:test", make([]byte, 64), time.Second); err != nil {
+		t.Skip("the kernel keyring is not available:", err)
+	}
+	uncacheKey("enc:test")
+
+	decrypt := func(ciphertext []byte, passphrase string) error {
+		keys := &keyCache{prompts: &prompts{generated: []byte(passphrase)}, limits: defaultLimits(), timeout: time.Minute}
+		_, r, err := openCiphertext(keys, bytes.NewReader(ciphertext))
+		if err != nil {
+			return err
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || string(decrypted) != "cached" {
+			t.Fatal("decryption resulted in a different plaintext:", err)
+		}
+		return nil
+	}
+	output := new(memoryOutput)
+	if _, _, _, err := encryptTo([]byte("hunter2"), bytes.NewReader([]byte("cached")), output, 0, encryptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := output.buf
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	description := cacheDescription(header)
+	defer uncacheKey(description)
+
+	if err := decrypt(ciphertext, "hunter3"); err != errBadMAC {
+		t.Fatal("expected errBadMAC, got", err)
+	}
+	if _, err := readCachedKey(description); err == nil {
+		t.Fatal("a key that failed to authenticate was cached")
+	}
+	if err := decrypt(ciphertext, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	// the wrong passphrase is not asked for, as the key is cached.
+	if err := decrypt(ciphertext, "hunter3"); err != nil {
+		t.Fatal("the cached key was not used:", err)
+	}
+
+	if err := cacheKey(description, make([]byte, 64), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(ciphertext, "hunter2"); err != errBadMAC {
+		t.Fatal("expected errBadMAC from a wrong cached key, got", err)
+	}
+	if _, err := readCachedKey(description); err == nil {
+		t.Fatal("a cached key that failed to authenticate was kept")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package encstream
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoKeyring = errors.New("the kernel keyring is only available on Linux")
+
+// readCachedKey finds nothing on this platform.
+func readCachedKey(description string) ([]byte, error) {
+	return nil, errNoKeyring
+}
+
+// cacheKey fails on this platform, so -cache-keys has no effect.
+func cacheKey(description string, key []byte, timeout time.Duration) error {
+	return errNoKeyring
+}
+
+// uncacheKey does nothing on this platform.
+func uncacheKey(description string) {}
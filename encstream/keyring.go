@@ -0,0 +1,481 @@
+package encstream
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The keyring stores public keys under names, so that `-R alice` can stand
+// in for pasting alice's key. A name may hold several keys, such as those of
+// everyone on a team, and encrypting to it encrypts to all of them. The
+// keyring is a text file with a name and a key on every line, optionally
+// followed by when the key expires and a note:
+//
+//	alice enc-pub-... expires=2027-01-31T00:00:00Z # laptop
+//
+// It is kept in the user's configuration directory unless $ENC_KEYRING names
+// another file. `enc keyring export` writes entries in the same form, which
+// `enc keyring import` reads back, along with the ed25519 keys of
+// authorized_keys files, such as those GitHub publishes at
+// https://github.com/<user>.keys.
+
+var (
+	errKeyringCommand = errors.New("unknown keyring command; the commands are add, remove, list, export and import")
+	errKeyringName    = errors.New("names must be non-empty, without spaces or #, and not start with -")
+	errImportName     = errors.New("the keys have no name in the keyring; give one with -name")
+	errImportScheme   = errors.New("keys are only fetched over https")
+)
+
+// keyringFetchLimit is the most bytes read from a URL imported from.
+const keyringFetchLimit = 1 << 20
+
+// keyringEntry is a public key stored in the keyring under a name.
+type keyringEntry struct {
+	name    string
+	key     recipient
+	expires time.Time // the zero time if the key does not expire
+	note    string
+}
+
+// String returns the text form of e, as it is stored in the keyring.
+func (e keyringEntry) String() string {
+	s := fmt.Sprintf("%v %v", e.name, e.key)
+	if !e.expires.IsZero() {
+		s += " expires=" + expiryString(e.expires.Unix())
+	}
+	if e.note != "" {
+		s += " # " + e.note
+	}
+	return s
+}
+
+// expiryNote describes when e expires, relative to now, or returns "" if it
+// does not.
+func (e keyringEntry) expiryNote(now time.Time) string {
+	switch {
+	case e.expires.IsZero():
+		return ""
+	case !now.Before(e.expires):
+		return "expired " + e.expires.Format("2006-01-02")
+	case e.expires.Sub(now) < 30*24*time.Hour:
+		days := math.Ceil(e.expires.Sub(now).Hours() / 24)
+		return fmt.Sprintf("expires %v, in %v days", e.expires.Format("2006-01-02"), days)
+	}
+	return "expires " + e.expires.Format("2006-01-02")
+}
+
+// keyringPath returns the path of the keyring.
+func keyringPath() (string, error) {
+	if path := os.Getenv("ENC_KEYRING"); path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keyring"), nil
+}
+
+// readKeyring returns the entries of the keyring at path, which is empty if
+// the file does not exist.
+func readKeyring(path string) ([]keyringEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseKeyring(f)
+}
+
+// parseKeyring parses the entries of a keyring, one per line.
+func parseKeyring(r io.Reader) ([]keyringEntry, error) {
+	var entries []keyringEntry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		e, ok, err := parseKeyringLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("keyring line %v: %v", line, err)
+		}
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parseKeyringLine parses a line of a keyring. It returns false for blank
+// lines and comments.
+func parseKeyringLine(text string) (keyringEntry, bool, error) {
+	var e keyringEntry
+	if i := strings.Index(text, "#"); i >= 0 {
+		e.note = strings.TrimSpace(text[i+1:])
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return e, false, nil
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		return e, false, errors.New("expected a name and a key")
+	}
+	e.name = fields[0]
+	var err error
+	e.key, err = parseRecipient(fields[1])
+	if err != nil {
+		return e, false, err
+	}
+	if len(fields) == 3 {
+		expires, ok := strings.CutPrefix(fields[2], "expires=")
+		if !ok {
+			return e, false, fmt.Errorf("unexpected %q after the key", fields[2])
+		}
+		e.expires, err = time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return e, false, err
+		}
+	}
+	return e, true, nil
+}
+
+// encodeKeyring returns the text form of entries, sorted by name.
+func encodeKeyring(entries []keyringEntry) string {
+	sorted := append([]keyringEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	var b strings.Builder
+	for _, e := range sorted {
+		fmt.Fprintln(&b, e)
+	}
+	return b.String()
+}
+
+// mergeKeyring adds the entries of added that are not already in entries,
+// and returns the result and how many were added.
+func mergeKeyring(entries, added []keyringEntry) ([]keyringEntry, int) {
+	n := 0
+next:
+	for _, a := range added {
+		for _, e := range entries {
+			if e.name == a.name && e.key == a.key {
+				continue next
+			}
+		}
+		entries = append(entries, a)
+		n++
+	}
+	return entries, n
+}
+
+// checkKeyringName checks that name can be stored in the keyring.
+func checkKeyringName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n#") || strings.HasPrefix(name, "-") {
+		return errKeyringName
+	}
+	return nil
+}
+
+// lookupKeyring returns the entries stored under names in entries.
+func lookupKeyring(entries []keyringEntry, names []string) ([]keyringEntry, error) {
+	var found []keyringEntry
+	for _, name := range names {
+		n := len(found)
+		for _, e := range entries {
+			if e.name == name {
+				found = append(found, e)
+			}
+		}
+		if len(found) == n {
+			return nil, fmt.Errorf("%q is not in the keyring; add it with enc keyring add", name)
+		}
+	}
+	return found, nil
+}
+
+// keyringRecipients returns the text form of the keys stored under names in
+// the keyring, in the form -r takes them. Expired keys are warned about.
+func keyringRecipients(names []string) ([]string, error) {
+	path, err := keyringPath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+	found, err := lookupKeyring(entries, names)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range found {
+		if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+			log.Printf("warning: the key %x of %v in the keyring expired on %v", e.key.keyID(shortKeyIDSize), e.name, e.expires.Format("2006-01-02"))
+		}
+		keys = append(keys, e.key.String())
+	}
+	return keys, nil
+}
+
+// importKeys parses the keys read from r for the keyring: keyring entries,
+// or public keys and authorized_keys lines, which are stored under name.
+// Lines with SSH keys other than ed25519 keys are skipped and counted.
+func importKeys(r io.Reader, name string, expires time.Time, note string) (entries []keyringEntry, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		var e keyringEntry
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+			continue
+		case isSSHKey(text) || strings.HasPrefix(text, publicKeyPrefix):
+			if name == "" {
+				return nil, 0, errImportName
+			}
+			key, err := parseRecipient(text)
+			if err == errSSHKeyType {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %v: %v", line, err)
+			}
+			e = keyringEntry{name: name, key: key}
+		default:
+			var ok bool
+			e, ok, err = parseKeyringLine(text)
+			if err != nil || !ok {
+				return nil, 0, fmt.Errorf("line %v: %v", line, err)
+			}
+			if name != "" {
+				e.name = name
+			}
+		}
+		if !expires.IsZero() {
+			e.expires = expires
+		}
+		if note != "" {
+			e.note = note
+		}
+		entries = append(entries, e)
+	}
+	return entries, skipped, scanner.Err()
+}
+
+// openKeySource opens the file, URL or standard input ("-") keys are
+// imported from. For GitHub URLs of the form https://github.com/<user>.keys,
+// it also returns the user as the name to store the keys under.
+func openKeySource(source string) (io.ReadCloser, string, error) {
+	switch {
+	case source == "-":
+		return io.NopCloser(os.Stdin), "", nil
+	case strings.HasPrefix(source, "http://"):
+		return nil, "", errImportScheme
+	case !strings.HasPrefix(source, "https://"):
+		f, err := os.Open(source)
+		return f, "", err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("fetching %v: %v", source, resp.Status)
+	}
+	var name string
+	if resp.Request.URL.Host == "github.com" && strings.HasSuffix(resp.Request.URL.Path, ".keys") {
+		name = strings.TrimSuffix(path.Base(resp.Request.URL.Path), ".keys")
+	}
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, keyringFetchLimit), resp.Body}
+	return body, name, nil
+}
+
+// keyringMain implements `enc keyring`, which manages the keyring.
+func keyringMain(args []string) {
+	fs := newFlagSet("keyring",
+		"enc keyring list",
+		"enc keyring add [-expires date] [-note text] [name] [public keys or files of them...]",
+		"enc keyring remove [name]",
+		"enc keyring export [-o output] [names...]",
+		"enc keyring import [-name name] [-expires date] [-note text] [file, https URL or -]")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// prints the usage for -h
+		fs.Parse(args)
+		fs.Usage()
+		os.Exit(-1)
+	}
+	command := args[0]
+	var expiresArg, note, output, name string
+	switch command {
+	case "add", "import":
+		fs.StringVar(&expiresArg, "expires", "", "when the keys expire, as a date, e.g. 2027-01-31, or a duration, e.g. 365d; encrypting to expired keys warns")
+		fs.StringVar(&note, "note", "", "a note to keep with the keys, shown by enc keyring list")
+		if command == "import" {
+			fs.StringVar(&name, "name", "", "store the keys under this name, rather than the names in the input or the GitHub user they were fetched from")
+		}
+	case "export":
+		fs.StringVar(&output, "o", "", "write to this file instead of stdout")
+	}
+	positional := parseArgs(fs, args[1:])
+
+	var expires time.Time
+	if expiresArg != "" {
+		var err error
+		expires, err = parseExpiry(expiresArg, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if strings.ContainsAny(note, "\r\n") {
+		log.Fatal("notes must be a single line")
+	}
+
+	keyring, err := keyringPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := readKeyring(keyring)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch command {
+	case "list":
+		if len(positional) != 0 {
+			fs.Usage()
+			os.Exit(-1)
+		}
+		now := time.Now()
+		for _, e := range entries {
+			fingerprint := e.key.fingerprint()
+			line := fmt.Sprintf("%v %v %v", e.name, e.key, hex.EncodeToString(fingerprint[:]))
+			if expiry := e.expiryNote(now); expiry != "" {
+				line += " (" + expiry + ")"
+			}
+			if e.note != "" {
+				line += " # " + e.note
+			}
+			fmt.Println(line)
+		}
+		return
+	case "export":
+		selected := entries
+		if len(positional) > 0 {
+			selected, err = lookupKeyring(entries, positional)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if output == "" {
+			fmt.Print(encodeKeyring(selected))
+			return
+		}
+		err = os.WriteFile(output, []byte(encodeKeyring(selected)), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "add":
+		if len(positional) < 2 {
+			fs.Usage()
+			os.Exit(-1)
+		}
+		if err := checkKeyringName(positional[0]); err != nil {
+			log.Fatal(err)
+		}
+		keys, err := readRecipients(positional[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		var added []keyringEntry
+		for _, key := range keys {
+			added = append(added, keyringEntry{name: positional[0], key: key, expires: expires, note: note})
+		}
+		entries, _ = mergeKeyring(entries, added)
+	case "remove":
+		if len(positional) != 1 {
+			fs.Usage()
+			os.Exit(-1)
+		}
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.name != positional[0] {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(entries) {
+			log.Fatalf("%q is not in the keyring", positional[0])
+		}
+		entries = kept
+	case "import":
+		if len(positional) != 1 {
+			fs.Usage()
+			os.Exit(-1)
+		}
+		entries = importKeyring(entries, positional[0], name, expires, note)
+	default:
+		log.Fatal(errKeyringCommand)
+	}
+
+	err = os.MkdirAll(filepath.Dir(keyring), 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writePrivateFile(keyring, encodeKeyring(entries), true)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// importKeyring adds the keys read from source to entries, reporting what was
+// added, and exits on failure.
+func importKeyring(entries []keyringEntry, source, name string, expires time.Time, note string) []keyringEntry {
+	r, fetchedName, err := openKeySource(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	if name == "" {
+		name = fetchedName
+	}
+	if note == "" && strings.HasPrefix(source, "https://") {
+		note = "from " + source
+	}
+	if name != "" {
+		if err := checkKeyringName(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+	imported, skipped, err := importKeys(r, name, expires, note)
+	if err != nil {
+		log.Fatal(fmt.Errorf("%v: %v", source, err))
+	}
+	for _, e := range imported {
+		if err := checkKeyringName(e.name); err != nil {
+			log.Fatal(fmt.Errorf("%v: %q: %v", source, e.name, err))
+		}
+	}
+	entries, added := mergeKeyring(entries, imported)
+	log.Printf("imported %v new keys of %v", added, len(imported))
+	if skipped > 0 {
+		log.Printf("skipped %v SSH keys that are not ed25519 keys, which cannot be encrypted to", skipped)
+	}
+	return entries
+}
@@ -0,0 +1,126 @@
+package encstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestKeyring verifies that keyring entries survive encoding and that names
+// holding several keys resolve to all of them.
+func TestKeyring(t *testing.T) {
+	var keys []recipient
+	for i := 0; i < 3; i++ {
+		id, err := generateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, id.public)
+	}
+	expires := time.Date(2027, 1, 31, 0, 0, 0, 0, time.UTC)
+	entries := []keyringEntry{
+		{name: "team", key: keys[1], note: "bob's laptop"},
+		{name: "alice", key: keys[0], expires: expires},
+		{name: "team", key: keys[2], expires: expires, note: "carol"},
+	}
+	parsed, err := parseKeyring(strings.NewReader("# comment\n\n" + encodeKeyring(entries)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sorted by name, keeping the order of keys under a name.
+	if len(parsed) != 3 || parsed[0] != entries[1] || parsed[1] != entries[0] || parsed[2] != entries[2] {
+		t.Fatal("keyring did not survive encoding:", parsed)
+	}
+
+	found, err := lookupKeyring(parsed, []string{"team", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 || found[0].key != keys[1] || found[1].key != keys[2] || found[2].key != keys[0] {
+		t.Fatal("looked up", found)
+	}
+	if _, err := lookupKeyring(parsed, []string{"bob"}); err == nil {
+		t.Fatal("looked up a name that is not in the keyring")
+	}
+
+	merged, added := mergeKeyring(parsed, []keyringEntry{entries[0], {name: "alice", key: keys[1]}})
+	if added != 1 || len(merged) != 4 {
+		t.Fatal("merged", added, "entries:", merged)
+	}
+
+	now := expires.Add(-10 * 24 * time.Hour)
+	if note := entries[1].expiryNote(now); note != "expires 2027-01-31, in 10 days" {
+		t.Fatal("unexpected expiry note", note)
+	}
+	if note := entries[1].expiryNote(expires); note != "expired 2027-01-31" {
+		t.Fatal("unexpected expiry note", note)
+	}
+
+	for _, bad := range []string{"alice", "alice enc-pub-short", "alice " + keys[0].String() + " extra", "alice " + keys[0].String() + " expires=tomorrow"} {
+		if _, err := parseKeyring(strings.NewReader(bad)); err == nil {
+			t.Fatalf("parsed invalid keyring line %q", bad)
+		}
+	}
+	for _, name := range []string{"", "two words", "has#hash", "-flag"} {
+		if checkKeyringName(name) == nil {
+			t.Fatalf("accepted the name %q", name)
+		}
+	}
+	if err := checkKeyringName("backups-team@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestImportKeys verifies that the ed25519 keys of an authorized_keys file,
+// as GitHub publishes them, are imported under a name, and other SSH keys
+// skipped.
+func TestImportKeys(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ssh.NewPublicKey(&ecdsaPrivate.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))) + " alice@laptop\n" + string(ssh.MarshalAuthorizedKey(ecdsaKey))
+
+	if _, _, err := importKeys(strings.NewReader(input), "", time.Time{}, ""); err != errImportName {
+		t.Fatal("expected errImportName, got", err)
+	}
+	entries, skipped, err := importKeys(strings.NewReader(input), "alice", time.Time{}, "from github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ed25519ToRecipient(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || skipped != 1 || entries[0] != (keyringEntry{name: "alice", key: want, note: "from github"}) {
+		t.Fatal("imported", entries, "skipping", skipped)
+	}
+
+	// an export imports as it was.
+	exported := encodeKeyring(entries)
+	reimported, _, err := importKeys(strings.NewReader(exported), "", time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reimported) != 1 || reimported[0] != entries[0] {
+		t.Fatal("reimported", reimported)
+	}
+}
@@ -0,0 +1,186 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+)
+
+// The header of a file is read before it can be authenticated, so a malicious
+// header could ask for absurd amounts of KDF memory and work, or be endless.
+// Headers are limited to maxHeaderSize bytes, chunks to maxChunkSize bytes,
+// and the KDF parameters to resourceLimits, all checked before anything is
+// allocated or derived.
+//
+// The KDF limits can be raised, or lowered, with -max-kdf-memory and
+// -max-kdf-time, or the settings of the same names in the config file, and
+// lifted for a trusted file with -allow-expensive-kdf. A file that asks for
+// more is refused with the parameters it asks for.
+
+// maxHeaderSize bounds the size of a versioned header.
+const maxHeaderSize = 1 << 18
+
+// The settings of the config file that hold the KDF limits.
+const (
+	settingMaxKDFMemory = "max-kdf-memory"
+	settingMaxKDFTime   = "max-kdf-time"
+)
+
+var (
+	errHeaderTooLarge = fmt.Errorf("the header is larger than %v bytes", maxHeaderSize)
+	errBadKDF         = errors.New("the header has invalid KDF parameters")
+	errKDFMemoryLimit = errors.New("the KDF memory limit must be a size of at least 1K, and less than 4T")
+	errKDFTimeLimit   = errors.New("the KDF pass limit must be a positive number")
+)
+
+// decoderLimits bound what decrypting a file may read from its header and
+// write as plaintext, for services that decrypt files from untrusted sources
+// through Decrypt.
+type decoderLimits struct {
+	maxHeaderSize    int
+	maxPlaintextSize int64 // or -1 for no limit
+}
+
+// defaultDecoderLimits returns the limits of the command line: headers of up
+// to maxHeaderSize bytes, and plaintexts of any size.
+func defaultDecoderLimits() decoderLimits {
+	return decoderLimits{maxHeaderSize: maxHeaderSize, maxPlaintextSize: -1}
+}
+
+// resourceLimits bound the KDF parameters honored from untrusted headers.
+type resourceLimits struct {
+	maxArgonMemory uint32 // KiB
+	maxArgonTime   uint32
+	maxArgonLanes  uint32
+	maxIterations  uint32 // PBKDF2 iterations of the FIPS suite
+}
+
+// defaultLimits returns limits that leave headroom above the parameters enc
+// writes by default.
+func defaultLimits() resourceLimits {
+	return resourceLimits{
+		maxArgonMemory: 2 * defaultArgonMemory,
+		maxArgonTime:   4 * defaultArgonTime,
+		maxArgonLanes:  maxLanes,
+		maxIterations:  10 * defaultPBKDF2Iterations,
+	}.withinBudget()
+}
+
+// headerTooLarge returns the error for a header larger than limit bytes.
+func headerTooLarge(limit int) error {
+	if limit == maxHeaderSize {
+		return errHeaderTooLarge
+	}
+	return fmt.Errorf("the header is larger than %v bytes", limit)
+}
+
+// check checks that deriving the keys of a file with header h stays within
+// l.
+func (l resourceLimits) check(h fileHeader) error {
+	if len(h.Recipients) > 0 || h.Vault.Path != "" {
+		return nil
+	}
+	if h.Suite == suiteFIPS {
+		if h.Iterations > l.maxIterations {
+			return fmt.Errorf("the file asks for PBKDF2 with %v iterations, more than the limit of %v; if it is trusted, decrypt it with -allow-expensive-kdf", h.Iterations, l.maxIterations)
+		}
+		return nil
+	}
+	err := h.checkKDF()
+	if err != nil {
+		return err
+	}
+	requested := fmt.Sprintf("the file asks for Argon2id with memory %v KiB, passes %v, lanes %v", h.ArgonMemory, h.ArgonTime, h.ArgonLanes)
+	if h.ArgonMemory > l.maxArgonMemory {
+		return fmt.Errorf("%v, more than the limit of %v KiB of memory; if it is trusted, raise -max-kdf-memory or decrypt it with -allow-expensive-kdf", requested, l.maxArgonMemory)
+	}
+	if h.ArgonTime > l.maxArgonTime {
+		return fmt.Errorf("%v, more than the limit of %v passes; if it is trusted, raise -max-kdf-time or decrypt it with -allow-expensive-kdf", requested, l.maxArgonTime)
+	}
+	if h.ArgonLanes > l.maxArgonLanes {
+		return fmt.Errorf("%v, more than the limit of %v lanes", requested, l.maxArgonLanes)
+	}
+	return nil
+}
+
+// parseKDFMemoryLimit parses a limit on KDF memory, such as 16G, into KiB.
+func parseKDFMemoryLimit(s string) (uint32, error) {
+	size, err := parseSize(s)
+	if err != nil || size>>10 == 0 || size>>10 > math.MaxUint32 {
+		return 0, errKDFMemoryLimit
+	}
+	return uint32(size >> 10), nil
+}
+
+// parseKDFTimeLimit parses a limit on KDF passes.
+func parseKDFTimeLimit(s string) (uint32, error) {
+	passes, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || passes == 0 {
+		return 0, errKDFTimeLimit
+	}
+	return uint32(passes), nil
+}
+
+// limits returns the limits on the KDF work of files to decrypt: those of
+// -max-kdf-memory and -max-kdf-time, or else of the config file, or else the
+// defaults, or with -allow-expensive-kdf none but -max-memory. It exits on
+// failure.
+func (p *prompts) limits() resourceLimits {
+	if p.allowExpensiveKDF {
+		return resourceLimits{
+			maxArgonMemory: math.MaxUint32,
+			maxArgonTime:   math.MaxUint32,
+			maxArgonLanes:  maxLanes,
+			maxIterations:  math.MaxUint32,
+		}.withinBudget()
+	}
+	c, err := readConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits := defaultLimits()
+	memory, passes := p.maxKDFMemory, p.maxKDFTime
+	if memory == "" {
+		memory = c[settingMaxKDFMemory]
+	}
+	if passes == "" {
+		passes = c[settingMaxKDFTime]
+	}
+	if memory != "" {
+		limits.maxArgonMemory, err = parseKDFMemoryLimit(memory)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limits = limits.withinBudget()
+	}
+	if passes != "" {
+		limits.maxArgonTime, err = parseKDFTimeLimit(passes)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return limits
+}
+
+// checkKDF checks that the Argon2id parameters of h are valid at all,
+// whatever the limits: at least one pass and one lane, and the 8 KiB of
+// memory every lane needs, which x/crypto/argon2 quietly raises and other
+// implementations refuse. Headers are checked as they are made and as they
+// are read.
+//
+// Passes and KiB of memory are recorded as a uint32, which is far beyond
+// anything that can be derived. Lanes are recorded as a uint32 from version 5,
+// up to the 2^24-1 that Argon2 allows, and as a byte before. x/crypto/argon2
+// only takes a byte, so keys are derived with at most maxLanes lanes, which is
+// also the most new files record; see kdfKeys.
+func (h fileHeader) checkKDF() error {
+	if h.ArgonTime == 0 || h.ArgonLanes == 0 || uint64(h.ArgonMemory) < 8*uint64(h.ArgonLanes) {
+		return errBadKDF
+	}
+	if h.ArgonLanes > argon2MaxLanes || (h.Version < 5 && h.ArgonLanes > math.MaxUint8) {
+		return errBadKDF
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestResourceLimits verifies that headers asking for too much KDF work, or
+// that are too large, are refused before any of it is done.
+func TestResourceLimits(t *testing.T) {
+	h, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := newPassphraseKeys([]byte("hunter2"))
+	for _, mutate := range []func(*fileHeader){
+		func(h *fileHeader) { h.ArgonMemory = 1 << 31 },
+		func(h *fileHeader) { h.ArgonTime = 1 << 20 },
+		func(h *fileHeader) { h.ArgonTime = 0 },
+		func(h *fileHeader) { h.ArgonLanes = 0 },
+		func(h *fileHeader) { h.ArgonMemory, h.ArgonLanes = 64, 16 },
+		func(h *fileHeader) { h.Suite, h.Iterations = suiteFIPS, 1<<31 },
+	} {
+		bad := h
+		mutate(&bad)
+		if _, _, err := keys.fileKeys(bad); err == nil {
+			t.Fatal("KDF parameters beyond the limits were accepted:", bad)
+		}
+	}
+	keys.limits.maxArgonMemory = 1 << 31
+	if err := keys.limits.check(fileHeader{ArgonMemory: 1 << 31, ArgonTime: 1, ArgonLanes: 1}); err != nil {
+		t.Fatal("raised limit was not honored:", err)
+	}
+
+	huge := new(bytes.Buffer)
+	huge.Write(fileMagic[:])
+	huge.WriteByte(fileVersion)
+	label := bytes.Repeat([]byte("x"), 1<<16-1)
+	for i := 0; i < maxHeaderSize>>16+1; i++ {
+		huge.WriteByte(recordLabel)
+		binary.Write(huge, binary.LittleEndian, uint16(len(label)))
+		huge.Write(label)
+	}
+	if _, err := readHeader(huge); err != errHeaderTooLarge {
+		t.Fatal("expected errHeaderTooLarge, got", err)
+	}
+}
+
+// TestKDFValidation verifies that headers with KDF parameters that are not
+// valid at all are refused as they are read, legacy ones too, whatever the
+// limits, and that new headers never record more lanes than fit, however
+// many threads there are.
+func TestKDFValidation(t *testing.T) {
+	salt := [32]byte{1}
+	for _, kdf := range []kdfRecord{
+		{Salt: salt, ArgonTime: 0, ArgonMemory: 64 << 10, ArgonLanes: 4},
+		{Salt: salt, ArgonTime: 1, ArgonMemory: 64 << 10, ArgonLanes: 0},
+		{Salt: salt, ArgonTime: 1, ArgonMemory: 0, ArgonLanes: 1},
+		{Salt: salt, ArgonTime: 1, ArgonMemory: 8*255 - 1, ArgonLanes: 255},
+		{Salt: salt, ArgonTime: math.MaxUint32, ArgonMemory: 7, ArgonLanes: 1},
+	} {
+		h := fileHeader{Version: fileVersion, Salt: kdf.Salt, ArgonTime: kdf.ArgonTime, ArgonMemory: kdf.ArgonMemory, ArgonLanes: uint32(kdf.ArgonLanes)}
+		if _, err := readHeader(bytes.NewReader(h.encode())); err != errBadKDF {
+			t.Fatal("expected errBadKDF, got", err, "for", kdf)
+		}
+		legacy := new(bytes.Buffer)
+		binary.Write(legacy, binary.LittleEndian, legacyHeader{Salt: kdf.Salt, ArgonTime: kdf.ArgonTime, ArgonMemory: kdf.ArgonMemory, ArgonLanes: kdf.ArgonLanes})
+		if _, err := readHeader(legacy); err != errBadKDF {
+			t.Fatal("expected errBadKDF from a legacy header, got", err, "for", kdf)
+		}
+	}
+
+	// the widest valid parameters are read, and left to the limits.
+	h := fileHeader{Version: fileVersion, Salt: salt, ArgonTime: math.MaxUint32, ArgonMemory: math.MaxUint32, ArgonLanes: math.MaxUint8}
+	decoded, err := readHeader(bytes.NewReader(h.encode()))
+	if err != nil || decoded.ArgonTime != h.ArgonTime || decoded.ArgonMemory != h.ArgonMemory || decoded.ArgonLanes != h.ArgonLanes {
+		t.Fatal("valid KDF parameters were not read:", err)
+	}
+	if _, _, err := newPassphraseKeys([]byte("hunter2")).fileKeys(decoded); err == nil {
+		t.Fatal("KDF parameters beyond the limits were accepted")
+	}
+
+	// lanes take 32 bits from version 5, up to what Argon2 allows, and a
+	// byte before.
+	for _, c := range []struct {
+		version uint8
+		lanes   uint32
+		valid   bool
+	}{
+		{fileVersion, 256, true},
+		{fileVersion, 1000, true},
+		{fileVersion, argon2MaxLanes, true},
+		{fileVersion, argon2MaxLanes + 1, false},
+		{4, 255, true},
+		{4, 256, false},
+	} {
+		h := fileHeader{Version: c.version, Salt: salt, ArgonTime: 1, ArgonMemory: 8 * c.lanes, ArgonLanes: c.lanes}
+		if c.lanes > argon2MaxLanes {
+			h.ArgonMemory = math.MaxUint32
+		}
+		if err := h.checkKDF(); (err == nil) != c.valid {
+			t.Fatalf("version %v with %v lanes: checkKDF returned %v", c.version, c.lanes, err)
+		}
+		if !c.valid {
+			continue
+		}
+		decoded, err := readHeader(bytes.NewReader(h.encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.ArgonLanes != c.lanes {
+			t.Fatalf("version %v with %v lanes was read back with %v", c.version, c.lanes, decoded.ArgonLanes)
+		}
+	}
+	wide := fileHeader{Version: fileVersion, Salt: salt, ArgonTime: 1, ArgonMemory: 8 * 256, ArgonLanes: 256}
+	if _, _, err := newPassphraseKeys([]byte("hunter2")).kdfKeys(wide); err != errArgonLanes {
+		t.Fatal("expected errArgonLanes, got", err)
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4 * maxLanes))
+	h, err = newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with less than 8 KiB of memory per lane, there are fewer.
+	if h.checkKDF() != nil || (h.ArgonMemory >= 8*maxLanes && h.ArgonLanes != maxLanes) {
+		t.Fatal("a header made with", 4*maxLanes, "threads records", h.ArgonLanes, "lanes")
+	}
+}
+
+// TestKDFLimitSettings verifies that the KDF limits come from the flags, or
+// else the config file, that -allow-expensive-kdf lifts them, and that a file
+// beyond them is refused with the parameters it asks for.
+func TestKDFLimitSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("ENC_CONFIG", os.Getenv("ENC_CONFIG"))
+	os.Setenv("ENC_CONFIG", filepath.Join(dir, "config"))
+
+	if (&prompts{}).limits() != defaultLimits() {
+		t.Fatal("the limits are not the defaults without settings")
+	}
+	if err := writePrivateFile(filepath.Join(dir, "config"), "max-kdf-memory 1M\nmax-kdf-time 2\n", false); err != nil {
+		t.Fatal(err)
+	}
+	limits := (&prompts{}).limits()
+	if limits.maxArgonMemory != 1024 || limits.maxArgonTime != 2 {
+		t.Fatal("the settings were not used:", limits)
+	}
+	limits = (&prompts{maxKDFMemory: "2M", maxKDFTime: "3"}).limits()
+	if limits.maxArgonMemory != 2048 || limits.maxArgonTime != 3 {
+		t.Fatal("the flags did not override the settings:", limits)
+	}
+	limits = (&prompts{allowExpensiveKDF: true}).limits()
+	if limits.maxArgonTime != math.MaxUint32 || limits.maxArgonMemory != kdfMemoryBudget() {
+		t.Fatal("-allow-expensive-kdf did not lift the limits:", limits)
+	}
+
+	h := fileHeader{Version: fileVersion, ArgonTime: 3, ArgonMemory: 4096, ArgonLanes: 4}
+	err = (&prompts{maxKDFMemory: "2M"}).limits().check(h)
+	if err == nil || !strings.Contains(err.Error(), "memory 4096 KiB, passes 3, lanes 4") || !strings.Contains(err.Error(), "-allow-expensive-kdf") {
+		t.Fatal("the requested parameters were not reported:", err)
+	}
+	if err := (&prompts{maxKDFMemory: "2M", allowExpensiveKDF: true}).limits().check(h); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"0", "-1G", "8T", "lots"} {
+		if _, err := parseKDFMemoryLimit(bad); err != errKDFMemoryLimit {
+			t.Fatal("expected errKDFMemoryLimit for", bad, "got", err)
+		}
+	}
+	for _, bad := range []string{"0", "-1", "1.5", "4294967296"} {
+		if _, err := parseKDFTimeLimit(bad); err != errKDFTimeLimit {
+			t.Fatal("expected errKDFTimeLimit for", bad, "got", err)
+		}
+	}
+}
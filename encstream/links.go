@@ -0,0 +1,176 @@
+package encstream
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Symlinks are stored as links by default, so that an archive of a system
+// directory holds what is in the tree and nothing outside of it. -symlinks
+// follow stores what they point to instead, and -symlinks inside only
+// follows those that point inside the tree. Followed links to directories
+// that contain them would loop forever, so they are stored as links.
+//
+// Files with several hard links are only stored once: later links are tar
+// hard link entries, which extraction links to the file extracted first. So
+// are files that followed symlinks lead to more than once.
+
+var errSymlinkMode = errors.New("-symlinks must be store, follow or inside")
+
+// symlinksUsage describes -symlinks.
+const symlinksUsage = "how to archive symlinks: store them as links, follow them to store what they point to, or follow only those that point inside the directory (store, follow or inside)"
+
+// symlinkMode says how archives store symlinks.
+type symlinkMode int
+
+const (
+	storeSymlinks  symlinkMode = iota // store the link
+	followSymlinks                    // store what it points to
+	insideSymlinks                    // follow links inside the tree, store the others
+)
+
+// parseSymlinkMode parses -symlinks.
+func parseSymlinkMode(s string) (symlinkMode, error) {
+	switch s {
+	case "", "store":
+		return storeSymlinks, nil
+	case "follow":
+		return followSymlinks, nil
+	case "inside":
+		return insideSymlinks, nil
+	}
+	return 0, errSymlinkMode
+}
+
+// walkTree calls fn for root and everything beneath it in lexical order,
+// like filepath.Walk, following symlinks as mode says. fn is passed the
+// information of what a followed link points to rather than of the link.
+// Unlike filepath.Walk, walkTree follows root if it is a symlink.
+func walkTree(root string, mode symlinkMode, fn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	w := treeWalker{root: realRoot, mode: mode, fn: fn}
+	return w.walk(root, info, nil)
+}
+
+// treeWalker walks a tree for walkTree.
+type treeWalker struct {
+	root string // with symlinks resolved
+	mode symlinkMode
+	fn   filepath.WalkFunc
+}
+
+// walk visits p, which is described by info, and everything beneath it.
+// ancestors are the resolved paths of the directories being walked, for
+// finding loops.
+func (w treeWalker) walk(p string, info os.FileInfo, ancestors []string) error {
+	if info.Mode()&os.ModeSymlink != 0 && w.mode != storeSymlinks {
+		target, err := w.follow(p, ancestors)
+		if err != nil {
+			return w.fn(p, info, err)
+		}
+		if target != nil {
+			info = target
+		}
+	}
+	err := w.fn(p, info, nil)
+	if err == filepath.SkipDir && info.IsDir() {
+		return nil
+	}
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return w.fn(p, info, err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return w.fn(p, info, err)
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return w.fn(p, info, err)
+	}
+	sort.Strings(names)
+	ancestors = append(ancestors, real)
+	for _, name := range names {
+		child := filepath.Join(p, name)
+		info, err := os.Lstat(child)
+		if err != nil {
+			err = w.fn(child, nil, err)
+		} else {
+			err = w.walk(child, info, ancestors)
+		}
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// follow returns the information of what the symlink p points to, or nil if
+// the link is to be stored: if it dangles, points outside the tree with
+// -symlinks inside, or loops back to a directory being walked.
+func (w treeWalker) follow(p string, ancestors []string) (os.FileInfo, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.mode == insideSymlinks && !within(real, w.root) {
+		return nil, nil
+	}
+	for _, ancestor := range ancestors {
+		if real == ancestor {
+			log.Printf("warning: %v loops back to %v, storing it as a link", p, ancestor)
+			return nil, nil
+		}
+	}
+	return os.Stat(real)
+}
+
+// within reports whether the path p is dir or beneath it.
+func within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// hardlinks remembers the files stored in an archive that may be reached
+// again, by the index of their manifest entry: those with several links, and
+// with followed symlinks, every file.
+type hardlinks struct {
+	entries  map[fileID]int
+	followed bool
+}
+
+func newHardlinks(symlinks symlinkMode) hardlinks {
+	return hardlinks{entries: make(map[fileID]int), followed: symlinks != storeSymlinks}
+}
+
+// first returns the index of the manifest entry of the regular file info
+// describes if it was already stored, or records that it is stored as entry
+// i otherwise.
+func (h hardlinks) first(info os.FileInfo, i int) (int, bool) {
+	id, nlink, ok := identify(info)
+	if !ok || !info.Mode().IsRegular() || (nlink < 2 && !h.followed) {
+		return 0, false
+	}
+	if first, ok := h.entries[id]; ok {
+		return first, true
+	}
+	h.entries[id] = i
+	return 0, false
+}
@@ -0,0 +1,147 @@
+package encstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveEntries returns the headers of the entries of the tar stream r, but
+// for the manifest, by name.
+func archiveEntries(t *testing.T, r io.Reader) map[string]*tar.Header {
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != manifestName {
+			entries[hdr.Name] = hdr
+		}
+	}
+}
+
+// TestHardlinks verifies that a file with several hard links is stored once,
+// and extracted as hard links again.
+func TestHardlinks(t *testing.T) {
+	src, err := ioutil.TempDir("", "enctest-links-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("alpha"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")); err != nil {
+		t.Skip("hard links are not supported here:", err)
+	}
+
+	archive := new(bytes.Buffer)
+	m, err := writeArchive(src, archive, nil, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := archiveEntries(t, bytes.NewReader(archive.Bytes()))
+	if entries["a"].Typeflag != tar.TypeReg || entries["b"].Typeflag != tar.TypeLink || entries["b"].Linkname != "a" {
+		t.Fatal("the second link was not stored as a hard link")
+	}
+	if len(m.Entries) != 2 || m.Entries[1].Path != "b" || m.Entries[1].BLAKE2b != m.Entries[0].BLAKE2b {
+		t.Fatal("the manifest does not list both links")
+	}
+
+	dest, err := ioutil.TempDir("", "enctest-links-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if _, err := extractArchive(bytes.NewReader(archive.Bytes()), dest, extractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := os.Stat(filepath.Join(dest, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(dest, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatal("the links were extracted as separate files")
+	}
+}
+
+// TestSymlinkModes verifies that symlinks are stored or followed as asked,
+// that followed links to files already stored are stored as hard links, and
+// that links that loop are stored as links.
+func TestSymlinkModes(t *testing.T) {
+	src, err := ioutil.TempDir("", "enctest-symlinks-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	outside, err := ioutil.TempDir("", "enctest-symlinks-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(src, "dir", "f"), filepath.Join(outside, "g")} {
+		if err := ioutil.WriteFile(p, []byte("golf"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"in":   "dir",
+		"loop": ".",
+		"out":  filepath.Join(outside, "g"),
+	} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		mode  symlinkMode
+		types map[string]byte
+	}{
+		{storeSymlinks, map[string]byte{"dir/f": tar.TypeReg, "in": tar.TypeSymlink, "loop": tar.TypeSymlink, "out": tar.TypeSymlink}},
+		{followSymlinks, map[string]byte{"dir/f": tar.TypeReg, "in/": tar.TypeDir, "in/f": tar.TypeLink, "loop": tar.TypeSymlink, "out": tar.TypeReg}},
+		{insideSymlinks, map[string]byte{"dir/f": tar.TypeReg, "in/": tar.TypeDir, "in/f": tar.TypeLink, "loop": tar.TypeSymlink, "out": tar.TypeSymlink}},
+	} {
+		archive := new(bytes.Buffer)
+		if _, err := writeArchive(src, archive, nil, archiveOptions{symlinks: c.mode}); err != nil {
+			t.Fatal(err)
+		}
+		entries := archiveEntries(t, bytes.NewReader(archive.Bytes()))
+		for name, typ := range c.types {
+			if hdr, ok := entries[name]; !ok || hdr.Typeflag != typ {
+				t.Fatalf("mode %v: %v is missing or of the wrong type", c.mode, name)
+			}
+		}
+		if _, ok := entries["loop/dir/f"]; ok {
+			t.Fatalf("mode %v: the loop was followed", c.mode)
+		}
+
+		dest, err := ioutil.TempDir("", "enctest-symlinks-dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+		if _, err := extractArchive(bytes.NewReader(archive.Bytes()), dest, extractOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(dest, "in", "f")); err != nil || string(data) != "golf" {
+			t.Fatalf("mode %v: in/f was not extracted", c.mode)
+		}
+	}
+}
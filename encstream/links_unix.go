@@ -0,0 +1,39 @@
+//go:build unix
+
+package encstream
+
+import (
+	"os"
+	"syscall"
+)
+
+// lchmod changes the mode of the file at p, failing rather than following p
+// if it is a symlink. The file is opened to change its mode, and if that is
+// not permitted, as for an unreadable file when not running as root, p is
+// checked not to be a symlink first.
+func lchmod(p string, mode os.FileMode) error {
+	f, err := os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if os.IsPermission(err) {
+		return chmodChecked(p, mode)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Chmod(mode)
+}
+
+// fileID identifies a file by its device and inode.
+type fileID struct {
+	dev, ino uint64
+}
+
+// identify returns the identity of the file info describes and how many hard
+// links it has.
+func identify(info os.FileInfo) (id fileID, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
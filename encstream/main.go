@@ -0,0 +1,1537 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/fips140"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func askPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	res, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	return res, err
+}
+
+// readPassphrase prompts for the passphrase, exiting on failure. If confirm is
+// set, as it is when encrypting, the passphrase must be entered twice, and
+// is asked for again until both match. Decryption asks once, since a typo
+// only fails to decrypt.
+func (p *prompts) readPassphrase(confirm bool) []byte {
+	passphrase, err := promptPassphrase(p.ask, "Enter passphrase:", confirm)
+	exitIfUnanswered(err)
+	if err != nil {
+		fmt.Println("could not read passphrase")
+		os.Exit(-1)
+	}
+	return passphrase
+}
+
+// promptPassphrase asks for a passphrase with prompt, and if confirm is set,
+// asks for it again, starting over until both match.
+func promptPassphrase(ask func(prompt string) ([]byte, error), prompt string, confirm bool) ([]byte, error) {
+	for {
+		passphrase, err := ask(prompt)
+		if err != nil || !confirm {
+			return passphrase, err
+		}
+		again, err := ask("Again, please: ")
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(passphrase, again) {
+			return passphrase, nil
+		}
+		fmt.Fprintln(os.Stderr, "passphrases did not match, try again")
+	}
+}
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// openInput opens the named input file, exiting on failure.
+func openInput(fname string) *os.File {
+	f, err := os.Open(fname)
+	if err != nil {
+		fmt.Println("could not open file", fname)
+		os.Exit(-1)
+	}
+	return f
+}
+
+// parseArgs parses args with fs, allowing flags to appear after positional
+// arguments. It returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// backupMain implements `enc backup`, which takes full or incremental
+// snapshots of a directory.
+func backupMain(args []string) {
+	fs := newFlagSet("backup", "enc backup [directory] -o [output] [-since previous.manifest]")
+	fileOutput := fs.String("o", "", "output")
+	since := fs.String("since", "", "manifest of the previous snapshot; only files changed since are stored")
+	var archive archiveFlags
+	archive.register(fs)
+	var p prompts
+	p.register(fs, true, true)
+	positional := parseArgs(fs, args)
+
+	if *fileOutput == "" || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	p.checkOutputs(*fileOutput, *fileOutput+manifestSuffix)
+	passphrase := p.passphrase(true)
+	err := backupDir(passphrase, positional[0], *fileOutput, *since, archive.options())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// restoreMain implements `enc restore`, which applies a chain of snapshots in
+// order.
+func restoreMain(args []string) {
+	fs := newFlagSet("restore", "enc restore -o [output directory] [full snapshot] [incremental snapshots...]")
+	fileOutput := fs.String("o", "", "output directory")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var owners ownerFlags
+	owners.register(fs)
+	var p prompts
+	p.register(fs, false, false)
+	positional := parseArgs(fs, args)
+
+	if *fileOutput == "" || len(positional) < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	err := restoreSnapshots(p.keys(identityFiles, p.limits()), positional, *fileOutput, owners.options())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// appendMain implements `enc append`, which adds files to an encrypted
+// archive without rewriting it.
+func appendMain(args []string) {
+	fs := newFlagSet("append", "enc append [-prefix dir] [archive] [inputs...]")
+	prefix := fs.String("prefix", "", "store the inputs under this directory of the archive")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var archive archiveFlags
+	archive.register(fs)
+	var p prompts
+	p.register(fs, false, false)
+	positional := parseArgs(fs, args)
+
+	if len(positional) < 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	err := appendArchive(p.keys(identityFiles, p.limits()), positional[0], positional[1:], *prefix, archive.options())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openEncryptedInput opens the named encrypted file or volume set, exiting on
+// failure.
+func openEncryptedInput(fname string) io.ReadSeekCloser {
+	f, err := openEncrypted(fname)
+	if err != nil {
+		fmt.Println("could not open file", fname+":", err)
+		os.Exit(-1)
+	}
+	return f
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix, which
+// are powers of 1024.
+func parseSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	digits := strings.ToUpper(s)
+	multiplier := int64(1)
+	if len(digits) > 0 {
+		if m, ok := units[digits[len(digits)-1]]; ok {
+			multiplier = m
+			digits = digits[:len(digits)-1]
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// watchMain implements `enc watch`, which encrypts the files in a directory
+// as they are created or modified.
+func watchMain(args []string) {
+	fs := newFlagSet("watch", "enc watch [directory] -dest [output directory]")
+	dest := fs.String("dest", "", "directory to write the encrypted files to")
+	debounce := fs.Duration("debounce", 2*time.Second, "how long a file must go unmodified before it is encrypted")
+	selfTestOnStart := fs.Bool("selftest-on-start", false, "run the known-answer tests of the primitives first, and exit if any fails")
+	var p prompts
+	p.register(fs, false, true)
+	positional := parseArgs(fs, args)
+
+	if *dest == "" || len(positional) != 1 || *debounce <= 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if *selfTestOnStart {
+		if err := SelfTest(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	passphrase := p.passphrase(true)
+	// every file is encrypted with the same passphrase, so derive the key
+	// once rather than for each file.
+	shared, err := newSharedKey(passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w, err := newWatcher(positional[0], *dest, *debounce, func(input *os.File, output string) error {
+		return encryptFile(passphrase, input, output, encryptOptions{shared: shared})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(w.run())
+}
+
+// clipMain implements `enc clip`, which encrypts or decrypts the contents of
+// the system clipboard in place.
+func clipMain(args []string) {
+	fs := newFlagSet("clip", "enc clip [-d]")
+	decryptMode := fs.Bool("d", false, "decrypt the clipboard")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, false, true)
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	contents, err := readClipboard()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var result []byte
+	if *decryptMode {
+		result, err = decryptText(p.keys(identityFiles, p.limits()), string(contents))
+	} else {
+		var text string
+		text, err = encryptText(p.passphrase(true), contents)
+		result = []byte(text)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeClipboard(result)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// keygenMain implements `enc keygen`, which generates an identity to encrypt
+// files to.
+func keygenMain(args []string) {
+	fs := newFlagSet("keygen", "enc keygen [-protect | -secure-enclave | -dpapi | -openpgp-card] -o [identity file]")
+	fileOutput := fs.String("o", "", "output")
+	protect := fs.Bool("protect", false, "protect the identity file with a passphrase, asked for whenever it is used")
+	sealWith := make([]*bool, len(keySealers))
+	for i, s := range keySealers {
+		sealWith[i] = fs.Bool(s.flag, false, s.usage)
+	}
+	card := fs.Bool("openpgp-card", false, "instead of generating an identity, write an identity file for the Curve25519 decryption key of the OpenPGP card inserted, which decrypts with the card")
+	var p prompts
+	p.register(fs, false, true)
+	fs.Parse(args)
+
+	if *fileOutput == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	var sealer *keySealer
+	for i := range keySealers {
+		if !*sealWith[i] {
+			continue
+		}
+		if sealer != nil || *protect || *card {
+			log.Fatal(errSealOptions)
+		}
+		sealer = &keySealers[i]
+	}
+	if *card {
+		if *protect {
+			log.Fatal(errSealOptions)
+		}
+		public, serial, err := readCardKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writePrivateFile(*fileOutput, cardIdentityContents(public, serial), false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("public key:", public)
+		fmt.Println("key ID:", hex.EncodeToString(public.keyID(shortKeyIDSize)))
+		return
+	}
+
+	id, err := generateIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var contents string
+	if sealer != nil {
+		contents, err = sealedIdentityContents(*sealer, id)
+	} else {
+		var passphrase []byte
+		if *protect {
+			passphrase = p.passphrase(true)
+		}
+		contents, err = identityFileContents([]identity{id}, passphrase)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writePrivateFile(*fileOutput, contents, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("public key:", id.public)
+	fmt.Println("key ID:", hex.EncodeToString(id.public.keyID(shortKeyIDSize)))
+	fmt.Println("signer key:", signerKeyString(id.signingKey().Public().(ed25519.PublicKey)))
+}
+
+// selftestMain implements `enc selftest`, which checks the primitives and
+// file formats against known answers.
+func selftestMain(args []string) {
+	fs := newFlagSet("selftest", "enc selftest")
+	fs.Parse(args)
+
+	err := runSelfTests(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// inspectMain implements `enc inspect`, which shows the header of an
+// encrypted file without decrypting it.
+func inspectMain(args []string) {
+	fs := newFlagSet("inspect", "enc inspect [input]")
+	expect := fs.String("expect-digest", "", "check this file, or - for standard input, against the plaintext digest recorded with -store-digest, which needs the key and reads the whole encrypted file to authenticate the digest")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "with -expect-digest, decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, false, false)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	err := inspect(fs.Arg(0), os.Stdout, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *expect != "" {
+		err = inspectDigest(p.keys(identityFiles, p.limits()), fs.Arg(0), *expect)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(*expect, "matches the digest")
+	}
+}
+
+// parsePercent parses a percentage with an optional % suffix.
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return p, nil
+}
+
+// repairMain implements `enc repair`, which reconstructs a damaged file from
+// its recovery records.
+func repairMain(args []string) {
+	fs := newFlagSet("repair", "enc repair [input] -o [output]")
+	fileOutput := fs.String("o", "", "output")
+	positional := parseArgs(fs, args)
+
+	if *fileOutput == "" || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	repaired, err := repairFile(positional[0], *fileOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("repaired", repaired, "damaged blocks")
+}
+
+// verifyMain implements `enc verify`, which checks the authenticity of an
+// encrypted file, reporting the damaged chunks and entries if it fails, and,
+// with -deep, the integrity of files extracted from it.
+func verifyMain(args []string) {
+	fs := newFlagSet("verify",
+		"enc verify [input]",
+		"enc verify -deep [archive] [extracted directory]")
+	deep := fs.Bool("deep", false, "re-hash the files extracted from an archive against its manifest")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, false, false)
+	fs.Parse(args)
+
+	if (!*deep && fs.NArg() != 1) || (*deep && fs.NArg() != 2) {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	keys := p.keys(identityFiles, p.limits())
+	f := openEncryptedInput(fs.Arg(0))
+	var err error
+	if *deep {
+		err = verifyExtracted(keys, f, fs.Arg(1), os.Stdout)
+	} else {
+		err = verifyChunks(keys, f, os.Stdout)
+	}
+	if err == errDamaged {
+		log.Fatal(err, "; enc decrypt -keep-going recovers what is intact")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("OK")
+}
+
+// diffMain implements `enc diff`, which compares the plaintexts of two
+// encrypted files without writing them to disk. Like diff, it exits with
+// status 1 if they differ and 2 on errors.
+func diffMain(args []string) {
+	fs := newFlagSet("diff", "enc diff [-u] [input] [input]")
+	unified := fs.Bool("u", false, "show the differences of text files as a unified diff")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, false, false)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	keys := p.keys(identityFiles, p.limits())
+	var plaintexts [2][]byte
+	for i, name := range positional {
+		f := openEncryptedInput(name)
+		plaintext, err := decryptToMemory(keys, f)
+		f.Close()
+		if err != nil {
+			log.Println(name+":", err)
+			os.Exit(2)
+		}
+		plaintexts[i] = plaintext
+	}
+	a, b := plaintexts[0], plaintexts[1]
+	if bytes.Equal(a, b) {
+		return
+	}
+	if *unified && isText(a) && isText(b) {
+		err := writeUnifiedDiff(os.Stdout, positional[0], positional[1], a, b)
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+	} else {
+		fmt.Println("the plaintexts of", positional[0], "and", positional[1], "differ")
+	}
+	os.Exit(1)
+}
+
+// grepMain implements `enc grep`, which prints the lines of encrypted files
+// that match a pattern without writing their plaintexts to disk. Like grep,
+// it exits with status 1 if no line matched and 2 on errors.
+func grepMain(args []string) {
+	fs := newFlagSet("grep", "enc grep [pattern] [inputs...]")
+	var opts grepOptions
+	fs.BoolVar(&opts.ignoreCase, "ignore-case", false, "ignore case when matching")
+	fs.BoolVar(&opts.fixed, "F", false, "match the pattern as a plain string rather than a regular expression")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, false, false)
+	positional := parseArgs(fs, args)
+
+	if len(positional) < 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	re, err := compileGrepPattern(positional[0], opts)
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	keys := p.keys(identityFiles, p.limits())
+	inputs := positional[1:]
+	out := bufio.NewWriter(os.Stdout)
+	matched := false
+	for _, name := range inputs {
+		if len(inputs) > 1 {
+			opts.prefix = name + ":"
+		}
+		f := openEncryptedInput(name)
+		n, err := grepFile(keys, f, re, out, opts)
+		f.Close()
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			out.Flush()
+			log.Println(name+":", err)
+			os.Exit(2)
+		}
+		matched = matched || n > 0
+	}
+	if !matched {
+		os.Exit(1)
+	}
+}
+
+// sendMain implements `enc send`, which encrypts a file straight to a peer
+// running enc receive, or through a relay with a transfer code.
+func sendMain(args []string) {
+	fs := newFlagSet("send",
+		"enc send -to [host:port] [input]",
+		"enc send -relay [host:port] [input]")
+	to := fs.String("to", "", "the address enc receive listens on")
+	relayAddr := fs.String("relay", "", "send through the enc relay at this address, printing a code for the receiver to type in")
+	var recipientArgs, recipientNames stringList
+	fs.Var(&recipientArgs, "r", "encrypt to this public key, or the public keys listed in this file, instead of a passphrase; may be repeated")
+	fs.Var(&recipientNames, "R", "encrypt to the public keys stored under this name in the keyring (see enc keyring); may be repeated")
+	var p prompts
+	p.register(fs, false, true)
+	positional := parseArgs(fs, args)
+
+	if (*to == "") == (*relayAddr == "") || len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if *relayAddr != "" {
+		if len(recipientArgs) > 0 || len(recipientNames) > 0 {
+			log.Fatal("-r and -R cannot be combined with -relay, where the transfer code is the key")
+		}
+		input, err := os.Open(positional[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer input.Close()
+		err = relaySend(*relayAddr, input, func(code string) {
+			fmt.Println("on the other machine, run:")
+			fmt.Printf("enc receive -relay %v -code %v -o [output]\n", *relayAddr, code)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("sent", positional[0])
+		return
+	}
+
+	var opts encryptOptions
+	if len(recipientNames) > 0 {
+		keys, err := keyringRecipients(recipientNames)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recipientArgs = append(recipientArgs, keys...)
+	}
+	var passphrase []byte
+	if len(recipientArgs) > 0 {
+		recipients, err := readRecipients(recipientArgs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.recipients = recipients
+	} else {
+		passphrase = p.passphrase(true)
+	}
+	input, err := os.Open(positional[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer input.Close()
+	err = dialSend(*to, passphrase, input, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("sent", positional[0])
+}
+
+// receiveMain implements `enc receive`, which waits for a file from enc send
+// and decrypts it.
+func receiveMain(args []string) {
+	fs := newFlagSet("receive",
+		"enc receive -listen [address] -o [output]",
+		"enc receive -relay [host:port] -code [code] -o [output]")
+	listen := fs.String("listen", "", "the address to listen on, e.g. :7000")
+	relayAddr := fs.String("relay", "", "receive through the enc relay at this address")
+	code := fs.String("code", "", "with -relay, the transfer code enc send printed")
+	fileOutput := fs.String("o", "", "output")
+	selfTestOnStart := fs.Bool("selftest-on-start", false, "run the known-answer tests of the primitives first, and exit if any fails")
+	var identityFiles stringList
+	fs.Var(&identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	var p prompts
+	p.register(fs, true, false)
+	positional := parseArgs(fs, args)
+
+	if (*listen == "") == (*relayAddr == "") || (*relayAddr == "") != (*code == "") || *fileOutput == "" || *fileOutput == "-" || len(positional) != 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if *selfTestOnStart {
+		if err := SelfTest(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	p.checkOutputs(*fileOutput)
+	if *relayAddr != "" {
+		err := relayReceive(*relayAddr, *code, *fileOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("received", *fileOutput)
+		return
+	}
+
+	keys := p.keys(identityFiles, p.limits())
+	err := listenReceive(*listen, keys, *fileOutput, func(addr net.Addr) {
+		log.Println("listening on", addr)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("received", *fileOutput)
+}
+
+// relayMain implements `enc relay`, which pairs the ends of transfers made
+// with transfer codes.
+func relayMain(args []string) {
+	fs := newFlagSet("relay", "enc relay -listen [address]")
+	listen := fs.String("listen", "", "the address to listen on, e.g. :7001")
+	positional := parseArgs(fs, args)
+
+	if *listen == "" || len(positional) != 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("relaying on", l.Addr())
+	log.Fatal(newRelay().serve(l))
+}
+
+// pushMain implements `enc push`, which encrypts a file and copies the
+// ciphertext to another machine over ssh.
+func pushMain(args []string) {
+	fs := newFlagSet("push", "enc push [input] [user@]host:path")
+	sshCmd := fs.String("ssh", "ssh", "the ssh command to run, with any options, e.g. \"ssh -p 2222\"")
+	var recipientArgs, recipientNames stringList
+	fs.Var(&recipientArgs, "r", "encrypt to this public key, or the public keys listed in this file, instead of a passphrase; may be repeated")
+	fs.Var(&recipientNames, "R", "encrypt to the public keys stored under this name in the keyring (see enc keyring); may be repeated")
+	var p prompts
+	p.register(fs, false, true)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 2 || len(strings.Fields(*sshCmd)) == 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if _, _, err := parseDestination(positional[1]); err != nil {
+		log.Fatal(err)
+	}
+	var opts encryptOptions
+	if len(recipientNames) > 0 {
+		keys, err := keyringRecipients(recipientNames)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recipientArgs = append(recipientArgs, keys...)
+	}
+	var passphrase []byte
+	if len(recipientArgs) > 0 {
+		recipients, err := readRecipients(recipientArgs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.recipients = recipients
+	} else {
+		passphrase = p.passphrase(true)
+	}
+	err := pushFile(passphrase, positional[0], positional[1], strings.Fields(*sshCmd), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("pushed", positional[0], "to", positional[1])
+}
+
+// command is a subcommand of enc.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+// commands lists the subcommands of enc, in the order usage shows them.
+var commands = []command{
+	{"encrypt", "encrypt files and directories", encryptMain},
+	{"decrypt", "decrypt a file, or extract an archive", decryptMain},
+	{"list", "list the contents of an encrypted archive", listMain},
+	{"verify", "check a file, or the files extracted from an archive", verifyMain},
+	{"diff", "compare the plaintexts of two encrypted files", diffMain},
+	{"grep", "print the lines of encrypted files that match a pattern", grepMain},
+	{"sign", "write a detached signature of a file", signMain},
+	{"verify-sig", "check a detached signature of a file", verifySigMain},
+	{"inspect", "show the header of a file without decrypting it", inspectMain},
+	{"keygen", "generate an identity to encrypt files to", keygenMain},
+	{"genpass", "generate a strong passphrase, and optionally encrypt with it", genpassMain},
+	{"identity", "change the passphrase of an identity file, or show its signer key", identityMain},
+	{"keyring", "store public keys under names to encrypt to with -R", keyringMain},
+	{"config", "show and change settings, such as the default identity", configMain},
+	{"backup", "take a full or incremental snapshot of a directory", backupMain},
+	{"restore", "restore a chain of snapshots", restoreMain},
+	{"append", "add files to an encrypted archive without rewriting it", appendMain},
+	{"repo", "keep deduplicated snapshots of directories in a repository", repoMain},
+	{"rewrap", "change the recipients of a file without re-encrypting it", rewrapMain},
+	{"repair", "repair a damaged file from its recovery records", repairMain},
+	{"watch", "encrypt the files in a directory as they change", watchMain},
+	{"send", "encrypt a file straight to enc receive on another machine", sendMain},
+	{"receive", "receive a file from enc send and decrypt it", receiveMain},
+	{"relay", "pair the ends of transfers made with transfer codes", relayMain},
+	{"push", "encrypt a file and copy it to another machine over ssh", pushMain},
+	{"k8s", "seal Kubernetes Secrets for version control, and unseal them", k8sMain},
+	{"cred", "store secrets for services, bound to this machine", credMain},
+	{"exec", "run a command with the variables of encrypted env files", execMain},
+	{"dotenv", "print the variables of encrypted env files for eval in a shell", dotenvMain},
+	{"clip", "encrypt or decrypt the clipboard in place", clipMain},
+	{"selftest", "check the primitives and file formats against known answers", selftestMain},
+}
+
+// commandAliases are other names subcommands can be run by.
+var commandAliases = map[string]string{"ls": "list"}
+
+// findCommand returns the subcommand with the given name or alias.
+func findCommand(name string) (command, bool) {
+	if alias, ok := commandAliases[name]; ok {
+		name = alias
+	}
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// usage prints the subcommands of enc to w.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: enc [command] [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10v %v\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run enc help [command] for the flags of a command. The forms of earlier")
+	fmt.Fprintln(w, "versions, enc -o [output] [input] and enc -d -o [output] [input], still work")
+	fmt.Fprintln(w, "as aliases of enc encrypt and enc decrypt.")
+}
+
+// newFlagSet returns the flag set of the named subcommand. Its usage message,
+// also shown by -h and --help, lists the forms of the command given in lines
+// followed by its flags.
+func newFlagSet(name string, lines ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		w := fs.Output()
+		for i, line := range lines {
+			if i == 0 {
+				fmt.Fprintln(w, "Usage:", line)
+			} else {
+				fmt.Fprintln(w, "      ", line)
+			}
+		}
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "Flags:")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// fileFlags holds the flags of enc encrypt and enc decrypt, and of the
+// flag-only form of earlier versions, which takes both.
+type fileFlags struct {
+	decryptMode  bool
+	listMode     bool
+	listJSON     bool
+	fileOutput   string
+	qrMode       bool
+	bwlimit      string
+	nice         bool
+	dedup        bool
+	dedupWith    string
+	volumeSize   string
+	recovery     string
+	verify       bool
+	rm           bool
+	shred        bool
+	armor        bool
+	label        string
+	comment      string
+	created      bool
+	fullKeyID    bool
+	antiForensic bool
+	noMetadata   bool
+	storeDigest  bool
+	notAfter     string
+	fips         bool
+	cipher       string
+	rsyncable    bool
+	noCache      bool
+	ioUring      bool
+	jobs         int
+	threads      int
+	maxMemory    string
+	mmap         bool
+	resume       bool
+	dryRun       bool
+	enforce      bool
+	openSSL      string
+	rangeArg     string
+	keepGoing    bool
+	deniableSize string
+	hideFile     string
+	hidePassFile string
+	hiddenMode   bool
+	raw          bool
+	rawKDF       string
+	vaultKey     string
+
+	usePassphrase                                bool
+	signFile                                     string
+	recipientArgs, recipientNames, identityFiles stringList
+	requiredSigners                              stringList
+	owners                                       ownerFlags
+	archive                                      archiveFlags
+	prompts
+}
+
+// register defines the flags for encryption, decryption or both on fs.
+func (cmd *fileFlags) register(fs *flag.FlagSet, encrypt, decrypt bool) {
+	fs.StringVar(&cmd.fileOutput, "o", "", "output, or - for stdout")
+	switch {
+	case encrypt && decrypt:
+		fs.BoolVar(&cmd.qrMode, "qr", false, "encrypt a small input to a QR code, written as a PNG to the output or drawn on the terminal if there is no output; with -d, decrypt the text scanned from one")
+	case encrypt:
+		fs.BoolVar(&cmd.qrMode, "qr", false, "encrypt a small input to a QR code, written as a PNG to the output or drawn on the terminal if there is no output")
+	default:
+		fs.BoolVar(&cmd.qrMode, "qr", false, "decrypt the text scanned from a QR code")
+	}
+	fs.StringVar(&cmd.bwlimit, "bwlimit", "", "read the input at no more than this many bytes per second, e.g. 100M")
+	fs.BoolVar(&cmd.nice, "nice", false, "lower the CPU and I/O scheduling priority, for background jobs")
+	fs.StringVar(&cmd.maxMemory, "max-memory", "", "the most memory to use, e.g. 1G, fitting the KDF memory of new files and how many chunks and inputs are processed at once into it (default $GOMEMLIMIT, or no limit)")
+	fs.IntVar(&cmd.threads, "threads", defaultThreads(), fmt.Sprintf("how many threads to use, at most %v: the Argon2 lanes of new files, and how many chunks are encrypted or decrypted at once", maxLanes))
+	fs.BoolVar(&cmd.raw, "raw", false, "a raw file, with no header or anything else that identifies it, only random-looking bytes; it must be decrypted with -raw and the same -raw-kdf")
+	fs.StringVar(&cmd.rawKDF, "raw-kdf", "", fmt.Sprintf("the Argon2id passes, memory and lanes of a -raw file, e.g. 4,4G,4 (default %v)", defaultRawParams()))
+	cmd.prompts.register(fs, true, encrypt)
+	if encrypt {
+		fs.BoolVar(&cmd.dedup, "dedup", false, "use content-defined chunking so that repeated data produces identical ciphertext")
+		fs.StringVar(&cmd.dedupWith, "dedup-with", "", "an earlier encrypted version of the input to share deduplicated chunks with (implies -dedup)")
+		fs.StringVar(&cmd.volumeSize, "volume-size", "", "split the output into volumes of this size, e.g. 4G")
+		fs.StringVar(&cmd.recovery, "recovery", "", "append recovery records amounting to this percentage of the output, e.g. 5%, for use with enc repair")
+		fs.BoolVar(&cmd.verify, "verify", false, "re-read and decrypt the output after encrypting, checking that it matches the input")
+		fs.BoolVar(&cmd.rm, "rm", false, "remove the input after it has been encrypted (and verified, with -verify)")
+		fs.BoolVar(&cmd.shred, "shred", false, "overwrite the input with random data before removing it; best effort only (implies -rm)")
+		fs.BoolVar(&cmd.armor, "a", false, "write the output as ASCII armor, which decryption detects automatically")
+		fs.StringVar(&cmd.label, "label", "", "record what the input is in the header, readable without the key (see enc inspect) but authenticated")
+		fs.StringVar(&cmd.comment, "comment", "", "record a comment in the header, readable without the key but authenticated")
+		fs.BoolVar(&cmd.created, "created", false, "record the creation time in the header, readable without the key but authenticated")
+		fs.Var(&cmd.recipientArgs, "r", "encrypt to this public key, or the public keys listed in this file, instead of a passphrase; may be repeated")
+		fs.Var(&cmd.recipientNames, "R", "encrypt to the public keys stored under this name in the keyring (see enc keyring); may be repeated")
+		fs.BoolVar(&cmd.usePassphrase, "passphrase", false, "encrypt with a passphrase even if a default identity is configured (see enc config)")
+		fs.StringVar(&cmd.signFile, "sign", "", "sign the output with this identity file or OpenSSH ed25519 private key, so that decryption can require the signer")
+		fs.BoolVar(&cmd.fullKeyID, "full-key-id", false, "identify recipients in the header by their full key fingerprint rather than a short key ID")
+		fs.BoolVar(&cmd.antiForensic, "anti-forensic", false, "split the wrapped file keys over several KiB, so that overwriting the file, as enc rewrap does, destroys them more reliably")
+		cmd.archive.register(fs)
+		fs.BoolVar(&cmd.noMetadata, "no-metadata", false, "record nothing optional in the output: no label, comment, creation or expiry time, signer or key IDs, with the input padded and volumes of random sizes, so that little but its approximate size leaks (see enc inspect)")
+		fs.BoolVar(&cmd.storeDigest, "store-digest", false, "record a keyed digest of the input in the header, which decryption checks the output against (see enc inspect -expect-digest)")
+		fs.StringVar(&cmd.notAfter, "not-after", "", "record a date, e.g. 2025-01-31, or a duration, e.g. 30d, after which the output has expired and decrypting it warns")
+		fs.BoolVar(&cmd.fips, "fips", false, "only use FIPS 140 approved algorithms: PBKDF2-HMAC-SHA256, AES-256-GCM and HMAC-SHA-512")
+		fs.StringVar(&cmd.cipher, "cipher", "", "the cipher of the chunks: xchacha20-poly1305, the default, aes-256-gcm, or auto, which picks AES-256-GCM if the CPU has AES instructions")
+		fs.BoolVar(&cmd.rsyncable, "rsyncable", false, "reuse the key of an existing deduplicated output so that only modified regions of the ciphertext change (implies -dedup)")
+		fs.BoolVar(&cmd.noCache, "no-cache", false, "drop the input and output files from the page cache as they are read and written, so that encrypting large files does not evict everything else (Linux only)")
+		fs.BoolVar(&cmd.ioUring, "io-uring", false, "read a regular input file ahead and write the output behind through io_uring, so that disk I/O overlaps encryption; enc falls back to read and write calls where io_uring is not available (Linux only)")
+		fs.IntVar(&cmd.jobs, "jobs", runtime.NumCPU(), "with several inputs, how many to encrypt at once")
+		fs.BoolVar(&cmd.dryRun, "dry-run", false, "check the inputs and output, and estimate the output size and key derivation time, without encrypting anything")
+		fs.BoolVar(&cmd.mmap, "mmap", false, "read a regular input file through a memory map instead of read calls; it must not be modified while enc runs")
+		fs.BoolVar(&cmd.resume, "resume", false, "checkpoint the encryption of a large file next to the output, and if it is interrupted, continue from the checkpoint when run again with the same passphrase")
+		fs.StringVar(&cmd.deniableSize, "deniable-size", "", "experimental: reserve a region of this size after the ciphertext, e.g. 1M, filled with random bytes or the -hide payload, which cannot be told apart")
+		fs.StringVar(&cmd.hideFile, "hide", "", "experimental: encrypt this file in the -deniable-size region with a second passphrase, to be decrypted with -hidden")
+		fs.StringVar(&cmd.hidePassFile, "hide-passphrase-file", "", "read the passphrase of the -hide payload from the first line of this file instead of prompting for it")
+	}
+	if decrypt {
+		fs.BoolVar(&cmd.listMode, "l", false, "list the contents of an encrypted archive")
+		fs.Var(&cmd.identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+		fs.BoolVar(&cmd.enforce, "enforce-expiry", false, "refuse to decrypt files that have expired")
+		fs.Var(&cmd.requiredSigners, "require-signer", "refuse to decrypt files that are not signed by this signer key or ssh-ed25519 public key, or one of the keys listed in this file; may be repeated")
+		fs.StringVar(&cmd.openSSL, "openssl", "", "the options an openssl enc file was encrypted with, e.g. \"-aes-256-cbc -pbkdf2\"; openssl's defaults are assumed otherwise")
+		fs.StringVar(&cmd.rangeArg, "range", "", "only decrypt this range of plaintext offsets, e.g. 100G-101G, reading just the chunks it covers")
+		fs.BoolVar(&cmd.keepGoing, "keep-going", false, "if the file is damaged, decrypt the chunks that authenticate and extract the archive entries that are intact, reporting the rest")
+		cmd.owners.register(fs)
+		fs.BoolVar(&cmd.hiddenMode, "hidden", false, "experimental: decrypt the payload hidden in the file's deniable region with its passphrase, instead of the file")
+	}
+	// the flag set of enc -d registers both.
+	vaultUsage := "encrypt with a data key of this key of Vault's transit engine, e.g. transit/backups, instead of a passphrase, using the Vault and token that VAULT_ADDR and VAULT_TOKEN name"
+	if !encrypt {
+		vaultUsage = "decrypt a file encrypted with a data key of this key of Vault's transit engine, using the Vault and token that VAULT_ADDR and VAULT_TOKEN name"
+	}
+	fs.StringVar(&cmd.vaultKey, "vault", "", vaultUsage)
+}
+
+// encryptMain implements `enc encrypt`, which encrypts files and directories.
+func encryptMain(args []string) {
+	fs := newFlagSet("encrypt",
+		"enc encrypt [-a] -o [output] [input]",
+		"enc encrypt [-jobs N] -o [output directory] [inputs...]",
+		"enc encrypt -qr [-o output.png] [input]")
+	var cmd fileFlags
+	cmd.register(fs, true, false)
+	positional := parseArgs(fs, args)
+	fileMain(fs, &cmd, positional)
+}
+
+// decryptMain implements `enc decrypt`, which decrypts files and extracts
+// archives.
+func decryptMain(args []string) {
+	fs := newFlagSet("decrypt",
+		"enc decrypt -o [output] [input] [archive paths...]",
+		"enc decrypt -range [start-end] -o [output] [input]",
+		"enc decrypt -qr -o [output] [scanned text]")
+	cmd := fileFlags{decryptMode: true}
+	cmd.register(fs, false, true)
+	positional := parseArgs(fs, args)
+	fileMain(fs, &cmd, positional)
+}
+
+// listMain implements `enc list`, which lists the contents of an encrypted
+// archive.
+func listMain(args []string) {
+	fs := newFlagSet("list", "enc list [-json] [archive]")
+	cmd := fileFlags{decryptMode: true, listMode: true}
+	fs.BoolVar(&cmd.listJSON, "json", false, "print a JSON object for each entry, one per line, with its name, type, size, mode, mtime, owner, group and link")
+	fs.Var(&cmd.identityFiles, "i", "decrypt with the identities in this file instead of a passphrase; may be repeated")
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	fileMain(fs, &cmd, positional)
+}
+
+// Main runs the enc command line tool with the arguments in os.Args, and
+// exits on failure.
+func Main() {
+	if isKubectlPlugin(os.Args[0]) {
+		k8sMain(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 {
+		switch name := os.Args[1]; name {
+		case "help", "-h", "-help", "--help":
+			if len(os.Args) > 2 {
+				if c, ok := findCommand(os.Args[2]); ok {
+					c.run([]string{"-h"})
+					return
+				}
+			}
+			usage(os.Stdout)
+			return
+		default:
+			if c, ok := findCommand(name); ok {
+				c.run(os.Args[2:])
+				return
+			}
+		}
+	}
+
+	// the flag-only form of earlier versions takes the flags of both enc
+	// encrypt and enc decrypt, and -d to choose between them.
+	fs := flag.NewFlagSet("enc", flag.ExitOnError)
+	fs.Usage = func() { usage(fs.Output()) }
+	var cmd fileFlags
+	fs.BoolVar(&cmd.decryptMode, "d", false, "decrypt mode")
+	cmd.register(fs, true, true)
+	fs.Parse(os.Args[1:])
+	fileMain(fs, &cmd, fs.Args())
+}
+
+// fileMain encrypts or decrypts the files named by args as cmd describes,
+// showing the usage of fs if they do not make sense together.
+func fileMain(fs *flag.FlagSet, cmd *fileFlags, args []string) {
+	if (cmd.fileOutput == "" && !cmd.listMode && (!cmd.qrMode || cmd.decryptMode)) || len(args) < 1 || (!cmd.decryptMode && len(args) > 1 && (cmd.listMode || cmd.qrMode)) {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if cmd.listMode {
+		cmd.decryptMode = true
+	}
+
+	if cmd.nice {
+		if err := lowerPriority(); err != nil {
+			log.Println("warning: could not lower the priority:", err)
+		}
+	}
+	if err := setThreads(cmd.threads); err != nil {
+		log.Fatal(err)
+	}
+	if cmd.maxMemory != "" {
+		size, err := parseSize(cmd.maxMemory)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = setMemoryBudget(size)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts := encryptOptions{dedup: cmd.dedup, verify: cmd.verify, armor: cmd.armor, fips: cmd.fips, mmap: cmd.mmap, noCache: cmd.noCache, uring: cmd.ioUring}
+	if cmd.bwlimit != "" {
+		rate, err := parseSize(cmd.bwlimit)
+		if err != nil || rate == 0 {
+			log.Fatal("invalid -bwlimit ", cmd.bwlimit)
+		}
+		opts.bwlimit = rate
+	}
+	if cmd.volumeSize != "" {
+		size, err := parseSize(cmd.volumeSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.volumeSize = size
+	}
+	if cmd.recovery != "" {
+		percent, err := parsePercent(cmd.recovery)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := newRecoveryTrailer(0, percent); err != nil {
+			log.Fatal(err)
+		}
+		if opts.volumeSize > 0 {
+			log.Fatal(errRecoveryVolumes)
+		}
+		opts.recovery = percent
+	}
+	if cmd.comment != "" {
+		opts.metadata = append(opts.metadata, metadataField{Key: "Comment", Value: cmd.comment})
+	}
+	if cmd.created {
+		opts.metadata = append(opts.metadata, metadataField{Key: "Created", Value: time.Now().UTC().Format(time.RFC3339)})
+	}
+	if err := checkMetadata(opts.metadata); err != nil {
+		log.Fatal(err)
+	}
+	opts.label = cmd.label
+	if err := checkLabel(opts.label); err != nil {
+		log.Fatal(err)
+	}
+	if cmd.notAfter != "" {
+		t, err := parseExpiry(cmd.notAfter, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.notAfter = t
+	}
+	if opts.armor && (opts.volumeSize > 0 || opts.recovery > 0) {
+		log.Fatal(errArmorOptions)
+	}
+	if cmd.deniableSize != "" {
+		size, err := parseSize(cmd.deniableSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkHiddenSize(size); err != nil {
+			log.Fatal(err)
+		}
+		if cmd.qrMode {
+			log.Fatal("-deniable-size cannot be combined with -qr")
+		}
+		opts.deniable = size
+	}
+	if cmd.hideFile != "" {
+		if opts.deniable == 0 {
+			log.Fatal(errHiddenArguments)
+		}
+		hidden, err := ioutil.ReadFile(cmd.hideFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if int64(len(hidden)) > opts.deniable-hiddenOverhead {
+			log.Fatal(errHiddenTooLarge)
+		}
+		opts.hidden = hidden
+	}
+	if len(cmd.recipientNames) > 0 {
+		keys, err := keyringRecipients(cmd.recipientNames)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd.recipientArgs = append(cmd.recipientArgs, keys...)
+	}
+	if cmd.encryptsToSelf(opts.fips) {
+		keys, err := defaultRecipients()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd.recipientArgs = keys
+	}
+	if len(cmd.recipientArgs) > 0 {
+		recipients, err := readRecipients(cmd.recipientArgs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cmd.qrMode || cmd.rsyncable || cmd.dedupWith != "" {
+			log.Fatal("-r and -R cannot be combined with -qr, -rsyncable or -dedup-with")
+		}
+		opts.recipients = recipients
+		opts.fullKeyID = cmd.fullKeyID
+		opts.antiForensic = cmd.antiForensic
+	}
+	if cmd.antiForensic && len(opts.recipients) == 0 {
+		log.Fatal(errAntiForensicOptions)
+	}
+	if !cmd.decryptMode && !cmd.raw && len(opts.recipients) == 0 && !opts.fips && cmd.vaultKey == "" && kdfMemoryBudget() < defaultArgonMemory {
+		log.Printf("warning: -max-memory lowers the KDF memory to %v KiB, which makes the passphrase easier to guess", kdfMemoryBudget())
+	}
+	if opts.deniable != 0 && (len(opts.recipients) > 0 || opts.fips) {
+		log.Fatal(errHiddenOptions)
+	}
+	opts.archive = cmd.archive.options()
+	if cmd.noMetadata {
+		if opts.label != "" || opts.metadata != nil || !opts.notAfter.IsZero() || cmd.signFile != "" || cmd.fullKeyID || opts.dedup || cmd.rsyncable || cmd.dedupWith != "" || opts.deniable != 0 || cmd.storeDigest {
+			log.Fatal(errNoMetadata)
+		}
+		opts.noMetadata = true
+	}
+	opts.storeDigest = cmd.storeDigest
+	if cmd.cipher != "" {
+		suite, err := parseCipher(cmd.cipher)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.fips {
+			log.Fatal(errCipherFIPS)
+		}
+		opts.suite = suite
+	}
+	if opts.fips {
+		if opts.dedup || cmd.rsyncable || cmd.dedupWith != "" || len(cmd.recipientArgs) > 0 {
+			log.Fatal(errFIPSOptions)
+		}
+		if !fips140.Enabled() {
+			log.Println("warning: the Go FIPS 140-3 module is not enabled; run with GODEBUG=fips140=on to use it")
+		}
+	}
+	if cmd.rsyncable {
+		opts.dedup = true
+		opts.dedupWith = rsyncableOptions(cmd.fileOutput).dedupWith
+	}
+	if cmd.dedupWith != "" {
+		header, err := readHeaderFile(cmd.dedupWith)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.dedupWith = &header
+	}
+
+	var plaintextRange *byteRange
+	if cmd.rangeArg != "" {
+		r, err := parseRange(cmd.rangeArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !cmd.decryptMode || cmd.listMode || cmd.qrMode || len(args) > 1 {
+			log.Fatal(errRangeOptions)
+		}
+		plaintextRange = &r
+	}
+	if cmd.keepGoing && (!cmd.decryptMode || cmd.listMode || cmd.qrMode || cmd.raw || cmd.hiddenMode || plaintextRange != nil) {
+		log.Fatal(errKeepGoingOptions)
+	}
+	if cmd.hiddenMode && (!cmd.decryptMode || cmd.listMode || cmd.qrMode || plaintextRange != nil || len(cmd.requiredSigners) > 0 || len(cmd.identityFiles) > 0 || len(args) > 1) {
+		log.Fatal(errHiddenDecryptOptions)
+	}
+	var signers []ed25519.PublicKey
+	if len(cmd.requiredSigners) > 0 {
+		if plaintextRange != nil {
+			log.Fatal(errSignerRange)
+		}
+		var err error
+		signers, err = readSignerKeys(cmd.requiredSigners)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cmd.signFile != "" {
+		if cmd.qrMode {
+			log.Fatal("-sign cannot be combined with -qr")
+		}
+		key, err := readSigningKey(cmd.signFile, cmd.unlockWith)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.signingKey = key
+	}
+
+	batch := !cmd.decryptMode && len(args) > 1
+	if batch && (cmd.rm || cmd.shred || cmd.qrMode || cmd.hideFile != "" || cmd.rsyncable || cmd.dedupWith != "" || cmd.fileOutput == "-") {
+		log.Fatal(errBatchOptions)
+	}
+
+	if cmd.resume {
+		if cmd.decryptMode || batch || cmd.qrMode || cmd.raw || cmd.rsyncable || cmd.dedupWith != "" || cmd.vaultKey != "" {
+			log.Fatal(errResumeOptions)
+		}
+		if err := checkResume(cmd.fileOutput, opts); err != nil {
+			log.Fatal(err)
+		}
+		opts.resume = true
+	}
+
+	fname := args[0]
+	if (cmd.rm || cmd.shred) && !cmd.decryptMode {
+		within, err := contains(fname, cmd.fileOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if within {
+			log.Fatal(errRemoveOutput)
+		}
+	}
+
+	var raw rawParams
+	if cmd.raw {
+		raw = defaultRawParams()
+		if cmd.rawKDF != "" {
+			var err error
+			raw, err = parseRawParams(cmd.rawKDF)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(opts.recipients) > 0 || len(cmd.identityFiles) > 0 || opts.armor || opts.volumeSize > 0 || opts.recovery > 0 || opts.label != "" || opts.metadata != nil ||
+			!opts.notAfter.IsZero() || opts.fips || opts.suite != suiteDefault || opts.dedup || cmd.rsyncable || cmd.dedupWith != "" || opts.signingKey != nil || opts.deniable != 0 ||
+			opts.noMetadata || cmd.qrMode || cmd.listMode || cmd.dryRun || cmd.hiddenMode || plaintextRange != nil || signers != nil || cmd.openSSL != "" || len(args) > 1 {
+			log.Fatal(errRawOptions)
+		}
+	} else if cmd.rawKDF != "" {
+		log.Fatal("-raw-kdf needs -raw")
+	}
+	if cmd.vaultKey != "" {
+		if len(opts.recipients) > 0 || len(cmd.identityFiles) > 0 || opts.fips || cmd.rsyncable || cmd.dedupWith != "" || opts.deniable != 0 ||
+			opts.noMetadata || cmd.qrMode || cmd.raw || cmd.dryRun || cmd.hiddenMode {
+			log.Fatal(errVaultOptions)
+		}
+		v, err := vaultFromEnv(cmd.vaultKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer v.Close()
+		opts.vault = v
+	}
+
+	if cmd.dryRun {
+		if cmd.decryptMode || cmd.qrMode {
+			log.Fatal(errDryRunOptions)
+		}
+		err := dryRun(os.Stdout, args, cmd.fileOutput, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	switch {
+	case batch:
+		outputs, err := batchOutputs(args, cmd.fileOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd.checkOutputs(outputs...)
+	case cmd.listMode, cmd.rsyncable:
+		// nothing is written, or the output is meant to be updated.
+	default:
+		cmd.checkOutputs(cmd.fileOutput)
+	}
+
+	sslOpts, err := parseOpenSSLOptions(cmd.openSSL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cmd.decryptMode && !cmd.qrMode && !cmd.raw {
+		f := openInput(fname)
+		pgp, err := isOpenPGP(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if pgp {
+			if plaintextRange != nil {
+				log.Fatal(errRangeOptions)
+			}
+			if signers != nil {
+				log.Fatal(errSignerFormat)
+			}
+			if cmd.listMode {
+				log.Fatal(errNotArchive)
+			}
+			if cmd.hiddenMode {
+				log.Fatal(errHiddenNoRegion)
+			}
+			err = decryptOpenPGP(cmd.passphrase(false), f, cmd.fileOutput)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		ssl, err := isOpenSSL(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ssl {
+			if plaintextRange != nil {
+				log.Fatal(errRangeOptions)
+			}
+			if signers != nil {
+				log.Fatal(errSignerFormat)
+			}
+			if cmd.listMode {
+				log.Fatal(errNotArchive)
+			}
+			if cmd.hiddenMode {
+				log.Fatal(errHiddenNoRegion)
+			}
+			err = decryptOpenSSL(cmd.passphrase(false), f, cmd.fileOutput, sslOpts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Println("warning: openssl enc files are not authenticated, check that the output is what you expect")
+			return
+		}
+		vault, err := isAnsibleVault(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if vault {
+			if plaintextRange != nil {
+				log.Fatal(errRangeOptions)
+			}
+			if signers != nil {
+				log.Fatal(errSignerFormat)
+			}
+			if cmd.listMode {
+				log.Fatal(errNotArchive)
+			}
+			if cmd.hiddenMode {
+				log.Fatal(errHiddenNoRegion)
+			}
+			err = decryptAnsibleVault(cmd.passphrase(false), f, cmd.fileOutput)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		f.Close()
+	}
+
+	var passphrase []byte
+	var keys keySource
+	var decryptKeys func() keySource
+	switch {
+	case cmd.decryptMode:
+		limits := cmd.limits()
+		if cmd.raw {
+			limits = raw.allow(limits)
+		}
+		decryptKeys = func() keySource {
+			var keys keySource = opts.vault
+			if opts.vault == nil {
+				keys = cmd.keys(cmd.identityFiles, limits)
+			}
+			if cmd.enforce {
+				keys = enforceExpiry{keySource: keys, now: time.Now}
+			}
+			if signers != nil {
+				keys = requireSigner{keySource: keys, signers: signers}
+			}
+			return keys
+		}
+		keys = decryptKeys()
+	case len(opts.recipients) == 0 && opts.vault == nil:
+		passphrase = cmd.passphrase(true)
+	}
+	if opts.hidden != nil {
+		opts.hiddenPassphrase = cmd.hiddenPassphrase(cmd.hidePassFile)
+		if bytes.Equal(opts.hiddenPassphrase, passphrase) {
+			log.Fatal(errHiddenSameKey)
+		}
+	}
+	if cmd.qrMode {
+		var err error
+		if cmd.decryptMode {
+			err = decryptScanned(keys, fname, cmd.fileOutput)
+		} else {
+			var plaintext []byte
+			plaintext, err = ioutil.ReadFile(fname)
+			if err == nil {
+				err = encryptQR(passphrase, plaintext, cmd.fileOutput, os.Stdout)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if batch {
+		err := encryptBatch(passphrase, args, cmd.fileOutput, cmd.jobs, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if cmd.decryptMode {
+		owners := cmd.owners.options()
+		var input io.ReadSeeker
+		if cmd.raw {
+			// raw files cannot be told from armor, volumes or recovery
+			// records, so they are read as they are.
+			input = openInput(fname)
+		} else {
+			input = openEncryptedInput(fname)
+		}
+		if opts.bwlimit > 0 {
+			input = struct {
+				io.Reader
+				io.Seeker
+			}{&rateLimitedReader{r: input, rate: opts.bwlimit}, input}
+		}
+		err := retryPassphrase(keys, decryptKeys, cmd.typed && cmd.interactive(), func(keys keySource) error {
+			switch {
+			case cmd.listMode:
+				return listArchiveFile(keys, input, os.Stdout, cmd.listJSON)
+			case cmd.hiddenMode:
+				return decryptHidden(keys, input, cmd.fileOutput)
+			case cmd.raw:
+				return decryptRaw(keys, input, cmd.fileOutput, raw)
+			case plaintextRange != nil:
+				return decryptRange(keys, input, cmd.fileOutput, *plaintextRange, time.Now())
+			case cmd.keepGoing:
+				return salvageFile(keys, input, cmd.fileOutput, extractOptions{paths: args[1:], owners: owners}, os.Stderr)
+			default:
+				return decryptTo(keys, input, cmd.fileOutput, extractOptions{paths: args[1:], owners: owners})
+			}
+		})
+		if err == errBadMAC && hasRecovery(fname) {
+			log.Fatal(err, "; the file has recovery records, try enc repair")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	f := openInput(fname)
+	stat, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case cmd.raw:
+		if stat.IsDir() {
+			log.Fatal(errRawOptions)
+		}
+		var out encryptOutput
+		out, err = createOutput(cmd.fileOutput, encryptOptions{})
+		if err == nil {
+			err = encryptRaw(passphrase, f, out, raw, opts.random())
+		}
+	case stat.IsDir():
+		_, err = encryptArchive(passphrase, fname, cmd.fileOutput, nil, opts)
+	default:
+		err = encryptFile(passphrase, f, cmd.fileOutput, opts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cmd.rm || cmd.shred {
+		f.Close()
+		err = removeInput(fname, cmd.shred)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package encstream
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+)
+
+// TestPromptPassphrase verifies that a passphrase that must be confirmed is
+// asked for again until both match, and that one that need not be is asked
+// for once.
+func TestPromptPassphrase(t *testing.T) {
+	errRead := errors.New("could not read")
+	for _, c := range []struct {
+		answers []string
+		confirm bool
+		want    string
+		asked   int
+		err     error
+	}{
+		{[]string{"hunter2"}, false, "hunter2", 1, nil},
+		{[]string{"hunter2", "hunter2"}, true, "hunter2", 2, nil},
+		{[]string{"hunter2", "hunter3", "hunter4", "hunter4"}, true, "hunter4", 4, nil},
+		{[]string{"hunter2", "hunter3", "hunter2", "hunter3", "x", "x"}, true, "x", 6, nil},
+		{[]string{"hunter2"}, true, "", 2, errRead},
+		{nil, false, "", 1, errRead},
+	} {
+		asked := 0
+		ask := func(prompt string) ([]byte, error) {
+			asked++
+			if asked > len(c.answers) {
+				return nil, errRead
+			}
+			return []byte(c.answers[asked-1]), nil
+		}
+		passphrase, err := promptPassphrase(ask, "Enter passphrase:", c.confirm)
+		if err != c.err || string(passphrase) != c.want || asked != c.asked {
+			t.Fatalf("%q: got %q and %v after %v prompts, expected %q and %v after %v", c.answers, passphrase, err, asked, c.want, c.err, c.asked)
+		}
+	}
+}
+
+// TestCommands verifies that subcommands are found by name or alias, and
+// that encrypt and decrypt only take their own flags, which their help
+// lists.
+func TestCommands(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		found string
+	}{
+		{"encrypt", "encrypt"},
+		{"decrypt", "decrypt"},
+		{"list", "list"},
+		{"ls", "list"},
+		{"-o", ""},
+		{"encrypted.enc", ""},
+	} {
+		command, ok := findCommand(c.name)
+		if ok != (c.found != "") || command.name != c.found {
+			t.Fatalf("%v: found %q, expected %q", c.name, command.name, c.found)
+		}
+	}
+
+	for _, c := range []struct {
+		name             string
+		encrypt, decrypt bool
+		has, lacks       []string
+	}{
+		{"encrypt", true, false, []string{"o", "r", "a", "verify"}, []string{"d", "i", "range", "l"}},
+		{"decrypt", false, true, []string{"o", "i", "range", "l"}, []string{"d", "r", "a", "verify"}},
+		{"enc", true, true, []string{"o", "r", "a", "verify", "i", "range", "l"}, []string{"d"}},
+	} {
+		fs := newFlagSet(c.name, "enc "+c.name+" -o [output] [input]")
+		var cmd fileFlags
+		cmd.register(fs, c.encrypt, c.decrypt)
+		for _, name := range c.has {
+			if fs.Lookup(name) == nil {
+				t.Fatalf("%v does not take -%v", c.name, name)
+			}
+		}
+		for _, name := range c.lacks {
+			if fs.Lookup(name) != nil {
+				t.Fatalf("%v takes -%v", c.name, name)
+			}
+		}
+		help := new(bytes.Buffer)
+		fs.SetOutput(help)
+		fs.Usage()
+		if !strings.HasPrefix(help.String(), "Usage: enc "+c.name+" -o [output] [input]\n") || !strings.Contains(help.String(), "\nFlags:\n") {
+			t.Fatalf("%v: bad help:\n%v", c.name, help)
+		}
+		fs.VisitAll(func(f *flag.Flag) {
+			if !strings.Contains(help.String(), "-"+f.Name) {
+				t.Fatalf("%v: the help does not list -%v", c.name, f.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package encstream
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// manifestName is the name of the archive entry holding the manifest. It is
+// always the last entry of an archive.
+const manifestName = ".enc-manifest"
+
+var (
+	errNoManifest       = errors.New("archive has no manifest")
+	errManifestMismatch = errors.New("extracted files do not match the manifest")
+	errReservedName     = errors.New(manifestName + " is reserved for the archive manifest")
+)
+
+// manifestEntry records a regular file stored in an archive along with the
+// BLAKE2b-256 digest of its plaintext.
+type manifestEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	BLAKE2b string    `json:"blake2b"`
+}
+
+// manifest lists every regular file in the tree an archive was created from.
+// Incremental snapshots also list the files that were unchanged since their
+// parent, identified by the parent manifest's id.
+type manifest struct {
+	Parent  string          `json:"parent,omitempty"`
+	Entries []manifestEntry `json:"entries"`
+}
+
+// id returns the hex encoded BLAKE2b-256 digest of the serialized manifest.
+func (m manifest) id() string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	sum := blake2b.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// entries returns the manifest's entries indexed by path.
+func (m manifest) entries() map[string]manifestEntry {
+	entries := make(map[string]manifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		entries[e.Path] = e
+	}
+	return entries
+}
+
+// matches reports whether the file at path, described by info, still has the
+// contents recorded by e. The file is only re-hashed if its size matches but
+// its modification time does not.
+func (e manifestEntry) matches(path string, info os.FileInfo) (bool, error) {
+	if info.Size() != e.Size {
+		return false, nil
+	}
+	if info.ModTime().Equal(e.ModTime) {
+		return true, nil
+	}
+	_, digest, err := hashFile(path)
+	if err != nil {
+		return false, err
+	}
+	return digest == e.BLAKE2b, nil
+}
+
+// writeManifest writes m to tw as the manifest entry.
+func writeManifest(tw *tar.Writer, m manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     manifestName,
+		Mode:     0600,
+		Size:     int64(len(b)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// readManifest reads the tar stream r until it finds the manifest entry.
+func readManifest(r io.Reader) (manifest, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return manifest{}, errNoManifest
+		}
+		if err != nil {
+			return manifest{}, err
+		}
+		if hdr.Name != manifestName {
+			continue
+		}
+		var m manifest
+		err = json.NewDecoder(tr).Decode(&m)
+		return m, err
+	}
+}
+
+// hashFile returns the size and hex encoded BLAKE2b-256 digest of the file at
+// path.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	hash, err := blake2b.New256(nil)
+	if err != nil {
+		return 0, "", err
+	}
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verify re-hashes the files extracted into dir and compares them against the
+// manifest, reporting every missing or mismatched file to w.
+func (m manifest) verify(dir string, w io.Writer) error {
+	failed := false
+	for _, e := range m.Entries {
+		size, digest, err := hashFile(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		switch {
+		case os.IsNotExist(err):
+			fmt.Fprintln(w, "missing:", e.Path)
+			failed = true
+		case err != nil:
+			return err
+		case size != e.Size || digest != e.BLAKE2b:
+			fmt.Fprintln(w, "mismatch:", e.Path)
+			failed = true
+		}
+	}
+	if failed {
+		return errManifestMismatch
+	}
+	return nil
+}
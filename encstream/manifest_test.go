@@ -0,0 +1,69 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestManifestVerify verifies that archives carry a manifest of their files,
+// and that it detects extracted files that were corrupted or lost.
+func TestManifestVerify(t *testing.T) {
+	src, err := ioutil.TempDir("", "enctest-manifest-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte("contents of "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(src, archive, nil, archiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 2 {
+		t.Fatal("manifest has", len(m.Entries), "entries, wanted 2")
+	}
+
+	dest, err := ioutil.TempDir("", "enctest-manifest-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if _, err := extractArchive(bytes.NewReader(archive.Bytes()), dest, extractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, manifestName)); !os.IsNotExist(err) {
+		t.Fatal("the manifest was extracted as a file")
+	}
+	out := new(bytes.Buffer)
+	if err := m.verify(dest, out); err != nil {
+		t.Fatal(err, out.String())
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dest, "a.txt"), []byte("contents of a.txX"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dest, "dir", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := m.verify(dest, out); err != errManifestMismatch {
+		t.Fatal("expected", errManifestMismatch, "got", err)
+	}
+	if out.String() != "mismatch: a.txt\nmissing: dir/b.txt\n" {
+		t.Fatal("unexpected report:", out.String())
+	}
+}
@@ -0,0 +1,103 @@
+package encstream
+
+import (
+	"errors"
+	"math"
+	"runtime/debug"
+)
+
+// -max-memory bounds what enc allocates, so that it is not killed in
+// containers with hard memory limits. It sets the Go runtime's memory limit,
+// as GOMEMLIMIT does for every command, and enc fits itself into that limit:
+// the Argon2 memory of new files is lowered, with a warning, files whose KDF
+// needs more are refused, and fewer chunks are sealed or opened, and fewer
+// inputs encrypted, at once.
+
+const (
+	// memoryReserve is set aside from the budget for the runtime, buffers
+	// and everything enc does not count.
+	memoryReserve = 32 << 20
+	// workerMemory is about what each worker sealing or opening chunks
+	// holds: a chunk, sealed and opened, in the pool and in flight.
+	workerMemory = 4 * maxChunkSize
+	// jobMemory is about what each input of a batch holds besides its
+	// workers.
+	jobMemory = 1 << 20
+	// minMemory is the smallest budget enc can work in.
+	minMemory = 64 << 20
+)
+
+var errMaxMemory = errors.New("-max-memory must be at least 64M")
+
+// memoryBudget returns the memory limit of the Go runtime, set by -max-memory
+// or GOMEMLIMIT, or math.MaxInt64 if there is none.
+func memoryBudget() int64 {
+	return debug.SetMemoryLimit(-1)
+}
+
+// setMemoryBudget sets the memory limit to budget bytes.
+func setMemoryBudget(budget int64) error {
+	if budget < minMemory {
+		return errMaxMemory
+	}
+	debug.SetMemoryLimit(budget)
+	return nil
+}
+
+// fitWorkers returns n, or fewer if n workers would not fit in the budget.
+func fitWorkers(n int) int {
+	budget := memoryBudget()
+	if budget == math.MaxInt64 {
+		return n
+	}
+	fit := int((budget - memoryReserve) / workerMemory)
+	if fit < 1 {
+		fit = 1
+	}
+	if n > fit {
+		return fit
+	}
+	return n
+}
+
+// fitJobs returns jobs, or fewer if the inputs encrypted at once would not fit
+// in the budget.
+func fitJobs(jobs int) int {
+	budget := memoryBudget()
+	if budget == math.MaxInt64 {
+		return jobs
+	}
+	fit := int((budget - memoryReserve) / (jobMemory + int64(workers())*workerMemory))
+	if fit < 1 {
+		fit = 1
+	}
+	if jobs > fit {
+		return fit
+	}
+	return jobs
+}
+
+// kdfMemoryBudget returns the most Argon2 memory, in KiB, that fits in the
+// budget beside the workers.
+func kdfMemoryBudget() uint32 {
+	budget := memoryBudget()
+	if budget == math.MaxInt64 {
+		return math.MaxUint32
+	}
+	kib := (budget - memoryReserve - int64(workers())*workerMemory) >> 10
+	if kib > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	if kib < 8 {
+		return 8
+	}
+	return uint32(kib)
+}
+
+// withinBudget returns l lowered so that the KDF fits in the budget.
+func (l resourceLimits) withinBudget() resourceLimits {
+	if budget := kdfMemoryBudget(); l.maxArgonMemory > budget {
+		l.maxArgonMemory = budget
+	}
+	return l
+}
@@ -0,0 +1,80 @@
+package encstream
+
+import (
+	"math"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+// TestMemoryBudget verifies that a memory budget lowers the KDF memory of new
+// files and the limit honored from headers, and how many workers and jobs run
+// at once, and that without one nothing changes.
+func TestMemoryBudget(t *testing.T) {
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+	debug.SetMemoryLimit(math.MaxInt64)
+	if kdfMemoryBudget() != math.MaxUint32 || fitWorkers(8) != 8 || fitJobs(8) != 8 {
+		t.Fatal("no budget changed the defaults")
+	}
+
+	if err := setMemoryBudget(1 << 20); err != errMaxMemory {
+		t.Fatal("expected errMaxMemory, got", err)
+	}
+	const budget = 100 << 20
+	if err := setMemoryBudget(budget); err != nil {
+		t.Fatal(err)
+	}
+	if kdfMemoryBudget() > (budget-memoryReserve)>>10 {
+		t.Fatal("the KDF memory does not fit:", kdfMemoryBudget())
+	}
+	h, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ArgonMemory > kdfMemoryBudget() || h.ArgonMemory < 8*uint32(h.ArgonLanes) {
+		t.Fatalf("new headers ask for %v KiB over %v lanes", h.ArgonMemory, h.ArgonLanes)
+	}
+	if defaultLimits().maxArgonMemory > kdfMemoryBudget() {
+		t.Fatal("the limit does not fit the budget")
+	}
+	if workers := fitWorkers(1 << 20); workers*workerMemory > budget {
+		t.Fatal("too many workers:", workers)
+	}
+	if jobs := fitJobs(1 << 20); jobs*jobMemory > budget {
+		t.Fatal("too many jobs:", jobs)
+	}
+}
+
+// TestMemoryWorkers verifies how many workers, and so Argon2 lanes of new
+// files, -threads and -max-memory allow.
+func TestMemoryWorkers(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+	tests := []struct {
+		threads int
+		budget  int64
+		workers int
+		lanes   uint32
+	}{
+		{8, math.MaxInt64, 8, 8},
+		{2 * maxLanes, math.MaxInt64, maxLanes, maxLanes},
+		{8, memoryReserve + 4*workerMemory, 4, 1},
+		{8, memoryReserve + 4*workerMemory + 16<<10, 4, 2},
+		{8, memoryReserve + 4*workerMemory + 24<<10, 4, 3},
+		{8, memoryReserve, 1, 1},
+	}
+	for _, test := range tests {
+		runtime.GOMAXPROCS(test.threads)
+		debug.SetMemoryLimit(test.budget)
+		if w := workers(); w != test.workers {
+			t.Errorf("%v threads in %v bytes: %v workers, expected %v", test.threads, test.budget, w, test.workers)
+		}
+		h, err := newHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.ArgonLanes != test.lanes {
+			t.Errorf("%v threads in %v bytes: %v lanes, expected %v", test.threads, test.budget, h.ArgonLanes, test.lanes)
+		}
+	}
+}
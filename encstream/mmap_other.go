@@ -0,0 +1,15 @@
+//go:build !unix
+
+package encstream
+
+import "os"
+
+// mapFile always returns nil on this platform, so the file is read as usual.
+func mapFile(f *os.File) ([]byte, error) {
+	return nil, nil
+}
+
+// unmapFile unmaps data returned by mapFile.
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMmapInput verifies that files encrypted through a memory map decrypt to
+// the input, and that inputs that cannot be mapped fall back to reading.
+func TestMmapInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := make([]byte, maxChunkSize*8+3)
+	_, err = rand.Read(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintextFile := filepath.Join(dir, "plaintext")
+	err = ioutil.WriteFile(plaintextFile, plaintext, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(plaintextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+	if data, err := mapFile(pr); data != nil || err != nil {
+		t.Fatal("mapped a pipe", err)
+	}
+
+	passphrase := []byte("hunter2")
+	ciphertext := filepath.Join(dir, "ciphertext")
+	err = encryptFile(passphrase, f, ciphertext, encryptOptions{mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := openEncrypted(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	decrypted := filepath.Join(dir, "decrypted")
+	err = decryptFile(newPassphraseKeys(passphrase), input, decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+}
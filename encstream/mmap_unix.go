@@ -0,0 +1,35 @@
+//go:build unix
+
+package encstream
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the regular file f into memory for reading, so that it can be
+// encrypted without copying it through read calls. It returns nil if f cannot
+// be mapped, such as when it is a pipe or a special file, or is empty.
+//
+// If the file is truncated while it is mapped, reading the missing pages
+// crashes the process, so only map files that are not being written to.
+func mapFile(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if !info.Mode().IsRegular() || size == 0 || size != int64(int(size)) {
+		return nil, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// unmapFile unmaps data returned by mapFile.
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
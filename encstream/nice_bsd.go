@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package encstream
+
+import "golang.org/x/sys/unix"
+
+// lowerPriority lowers the CPU scheduling priority of enc. The I/O priority
+// follows it where the kernel supports that.
+func lowerPriority() error {
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, niceness)
+}
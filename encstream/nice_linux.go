@@ -0,0 +1,42 @@
+package encstream
+
+import (
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// I/O priorities, from linux/ioprio.h.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassBE    = 2
+	ioprioClassShift = 13
+)
+
+// lowerPriority lowers the CPU and I/O scheduling priority of enc. On Linux
+// both are set per thread, so they are set for every thread of the process;
+// threads created later inherit them.
+func lowerPriority() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		err = unix.Setpriority(unix.PRIO_PROCESS, tid, niceness)
+		if err != nil {
+			return err
+		}
+		// the lowest best-effort priority, rather than the idle class, which
+		// can starve enc completely on a busy disk.
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassBE<<ioprioClassShift|7)
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package encstream
+
+// lowerPriority is not supported on this platform.
+func lowerPriority() error {
+	return errNiceUnsupported
+}
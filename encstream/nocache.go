@@ -0,0 +1,79 @@
+package encstream
+
+import (
+	"io"
+	"os"
+)
+
+// With -no-cache, the pages of the input and output files are dropped from the
+// page cache as enc goes, so that encrypting a large file such as a disk image
+// does not evict everything else. Writing through the cache and dropping it
+// behind is used instead of O_DIRECT, which needs aligned buffers and is not
+// supported by every filesystem.
+
+// dropInterval is how many bytes are read or written between drops.
+const dropInterval = 8 << 20
+
+// cacheDropper drops the pages of a file that is read or written sequentially
+// from the page cache.
+type cacheDropper struct {
+	f       *os.File
+	done    int64 // bytes read or written
+	dropped int64 // bytes already dropped
+	written bool
+}
+
+// advance records that n more bytes have been read or written, dropping them
+// once dropInterval bytes have accumulated.
+func (c *cacheDropper) advance(n int) {
+	c.done += int64(n)
+	if c.done-c.dropped >= dropInterval {
+		dropCache(c.f, c.dropped, c.done-c.dropped, c.written)
+		c.dropped = c.done
+	}
+}
+
+// uncachedReader reads from a file, dropping what it has read from the page
+// cache.
+type uncachedReader struct {
+	cacheDropper
+}
+
+func (u *uncachedReader) Read(p []byte) (int, error) {
+	n, err := u.f.Read(p)
+	u.advance(n)
+	return n, err
+}
+
+// uncachedOutput is an atomicFile that drops what has been written to it from
+// the page cache.
+type uncachedOutput struct {
+	*atomicFile
+	cacheDropper
+}
+
+// newUncachedOutput returns f as an uncachedOutput.
+func newUncachedOutput(f *atomicFile) *uncachedOutput {
+	return &uncachedOutput{f, cacheDropper{f: f.File, written: true}}
+}
+
+func (u *uncachedOutput) Write(p []byte) (int, error) {
+	n, err := u.atomicFile.Write(p)
+	u.advance(n)
+	return n, err
+}
+
+func (u *uncachedOutput) commit() error {
+	err := u.atomicFile.Sync()
+	if err != nil {
+		return err
+	}
+	dropCache(u.atomicFile.File, 0, 0, false)
+	return u.atomicFile.commit()
+}
+
+// uncachedInput returns input, wrapped to drop what is read from it from the
+// page cache.
+func uncachedInput(input *os.File) io.Reader {
+	return &uncachedReader{cacheDropper{f: input}}
+}
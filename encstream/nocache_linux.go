@@ -0,0 +1,19 @@
+package encstream
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropCache drops n bytes of f from offset off from the page cache, or all of
+// it if n is 0. Dirty pages cannot be dropped, so if written is set they are
+// written back first. Failures are ignored, since the cache only affects
+// performance.
+func dropCache(f *os.File, off int64, n int64, written bool) {
+	fd := int(f.Fd())
+	if written {
+		unix.SyncFileRange(fd, off, n, unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+	}
+	unix.Fadvise(fd, off, n, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package encstream
+
+import "os"
+
+// dropCache does nothing on this platform, so -no-cache has no effect.
+func dropCache(f *os.File, off int64, n int64, written bool) {}
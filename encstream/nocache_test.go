@@ -0,0 +1,59 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestNoCache verifies that a file larger than the drop interval, encrypted
+// with noCache and verified, decrypts to the input.
+func TestNoCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-nocache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := make([]byte, dropInterval*2+maxChunkSize+1)
+	_, err = rand.Read(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintextFile := filepath.Join(dir, "plaintext")
+	err = ioutil.WriteFile(plaintextFile, plaintext, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(plaintextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	passphrase := []byte("hunter2")
+	ciphertext := filepath.Join(dir, "ciphertext")
+	err = encryptFile(passphrase, f, ciphertext, encryptOptions{noCache: true, verify: true, recovery: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := openEncrypted(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	decrypted := filepath.Join(dir, "decrypted")
+	err = decryptFile(newPassphraseKeys(passphrase), input, decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+}
@@ -0,0 +1,288 @@
+package encstream
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The handshake of a Channel is Noise_XX_25519_ChaChaPoly_BLAKE2b, or
+// Noise_IK_25519_ChaChaPoly_BLAKE2b when the client already knows the
+// server's static key, as specified at https://noiseprotocol.org/noise.html.
+// Handshake messages are framed with a 2 byte big-endian length and carry
+// empty payloads; the two keys from Split then seed the chunk streams of the
+// session.
+
+const noiseSuffix = "_25519_ChaChaPoly_BLAKE2b"
+
+var (
+	errNoiseMessage = errors.New("malformed handshake message")
+	errNoiseDecrypt = errors.New("the handshake failed to authenticate")
+)
+
+// noisePattern is a handshake pattern: its name, whether the initiator knows
+// the responder's static key beforehand, and the tokens of each message.
+type noisePattern struct {
+	name      string
+	preStatic bool
+	messages  [][]string
+}
+
+var (
+	noiseXX = noisePattern{"XX", false, [][]string{
+		{"e"},
+		{"e", "ee", "s", "es"},
+		{"s", "se"},
+	}}
+	noiseIK = noisePattern{"IK", true, [][]string{
+		{"e", "es", "s", "ss"},
+		{"e", "ee", "se"},
+	}}
+)
+
+// noiseState is the symmetric state of a handshake.
+type noiseState struct {
+	ck     [64]byte
+	h      [64]byte
+	k      [32]byte
+	hasKey bool
+	n      uint64
+}
+
+// newNoiseState initializes the symmetric state of the named protocol.
+func newNoiseState(protocol string, prologue []byte) *noiseState {
+	s := new(noiseState)
+	if len(protocol) <= len(s.h) {
+		copy(s.h[:], protocol)
+	} else {
+		s.h = blake2b.Sum512([]byte(protocol))
+	}
+	s.ck = s.h
+	s.mixHash(prologue)
+	return s
+}
+
+func (s *noiseState) mixHash(data []byte) {
+	h, _ := blake2b.New512(nil)
+	h.Write(s.h[:])
+	h.Write(data)
+	copy(s.h[:], h.Sum(nil))
+}
+
+func (s *noiseState) mixKey(ikm []byte) {
+	var temp [64]byte
+	s.ck, temp = noiseHKDF(s.ck, ikm)
+	copy(s.k[:], temp[:])
+	s.hasKey = true
+	s.n = 0
+}
+
+// nonce returns the ChaChaPoly nonce of the n'th message under the key.
+func (s *noiseState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], s.n)
+	return nonce
+}
+
+func (s *noiseState) encryptAndHash(plaintext []byte) []byte {
+	if !s.hasKey {
+		s.mixHash(plaintext)
+		return plaintext
+	}
+	aead, _ := chacha20poly1305.New(s.k[:])
+	ciphertext := aead.Seal(nil, s.nonce(), plaintext, s.h[:])
+	s.n++
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (s *noiseState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if !s.hasKey {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	aead, _ := chacha20poly1305.New(s.k[:])
+	plaintext, err := aead.Open(nil, s.nonce(), ciphertext, s.h[:])
+	if err != nil {
+		return nil, errNoiseDecrypt
+	}
+	s.n++
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the keys of the initiator's and the responder's messages.
+func (s *noiseState) split() (initiator, responder [32]byte) {
+	a, b := noiseHKDF(s.ck, nil)
+	copy(initiator[:], a[:])
+	copy(responder[:], b[:])
+	return initiator, responder
+}
+
+// noiseHKDF is the HKDF of the specification with two outputs, over
+// HMAC-BLAKE2b.
+func noiseHKDF(ck [64]byte, ikm []byte) (out1, out2 [64]byte) {
+	mac := func(key, data []byte) []byte {
+		m := hmac.New(func() hash.Hash {
+			h, _ := blake2b.New512(nil)
+			return h
+		}, key)
+		m.Write(data)
+		return m.Sum(nil)
+	}
+	temp := mac(ck[:], ikm)
+	copy(out1[:], mac(temp, []byte{1}))
+	copy(out2[:], mac(temp, append(out1[:], 2)))
+	return out1, out2
+}
+
+// noiseHandshake is the state of one end of a handshake.
+type noiseHandshake struct {
+	*noiseState
+	initiator bool
+	s, e      identity
+	rs, re    recipient
+}
+
+// dh mixes the X25519 agreement of the local key and the remote key a token
+// names into the state.
+func (hs *noiseHandshake) dh(token string) error {
+	local, remote := hs.e, hs.re
+	switch {
+	case token == "ee":
+	case token == "ss":
+		local, remote = hs.s, hs.rs
+	case token == "es" && hs.initiator, token == "se" && !hs.initiator:
+		remote = hs.rs
+	case token == "es", token == "se":
+		local = hs.s
+	}
+	shared, err := curve25519.X25519(local.secret[:], remote[:])
+	if err != nil {
+		return errNoiseMessage
+	}
+	hs.mixKey(shared)
+	return nil
+}
+
+// writeMessage returns the next handshake message, made of tokens.
+func (hs *noiseHandshake) writeMessage(tokens []string) ([]byte, error) {
+	var msg []byte
+	for _, token := range tokens {
+		switch token {
+		case "e":
+			e, err := generateIdentity()
+			if err != nil {
+				return nil, err
+			}
+			hs.e = e
+			msg = append(msg, e.public[:]...)
+			hs.mixHash(e.public[:])
+		case "s":
+			msg = append(msg, hs.encryptAndHash(hs.s.public[:])...)
+		default:
+			if err := hs.dh(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return append(msg, hs.encryptAndHash(nil)...), nil
+}
+
+// readMessage processes the next handshake message from the other end, made
+// of tokens.
+func (hs *noiseHandshake) readMessage(msg []byte, tokens []string) error {
+	for _, token := range tokens {
+		switch token {
+		case "e":
+			if len(msg) < len(hs.re) {
+				return errNoiseMessage
+			}
+			copy(hs.re[:], msg)
+			msg = msg[len(hs.re):]
+			hs.mixHash(hs.re[:])
+		case "s":
+			n := len(hs.rs)
+			if hs.hasKey {
+				n += chacha20poly1305.Overhead
+			}
+			if len(msg) < n {
+				return errNoiseMessage
+			}
+			public, err := hs.decryptAndHash(msg[:n])
+			if err != nil {
+				return err
+			}
+			copy(hs.rs[:], public)
+			msg = msg[n:]
+		default:
+			if err := hs.dh(token); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := hs.decryptAndHash(msg)
+	return err
+}
+
+// noiseHandshakeOver runs pattern over conn with the static key s, and the
+// other end's static key rs if the pattern needs it beforehand. It returns
+// the keys of the messages this end sends and receives, and the other end's
+// static key.
+func noiseHandshakeOver(conn io.ReadWriter, pattern noisePattern, initiator bool, s identity, rs recipient, prologue []byte) (send, receive [32]byte, peer recipient, err error) {
+	hs := &noiseHandshake{
+		noiseState: newNoiseState("Noise_"+pattern.name+noiseSuffix, prologue),
+		initiator:  initiator,
+		s:          s,
+	}
+	if pattern.preStatic {
+		if initiator {
+			hs.rs = rs
+			hs.mixHash(rs[:])
+		} else {
+			hs.mixHash(s.public[:])
+		}
+	}
+
+	for i, tokens := range pattern.messages {
+		if (i%2 == 0) == initiator {
+			msg, err := hs.writeMessage(tokens)
+			if err != nil {
+				return send, receive, peer, err
+			}
+			framed := make([]byte, 2, 2+len(msg))
+			binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+			_, err = conn.Write(append(framed, msg...))
+			if err != nil {
+				return send, receive, peer, err
+			}
+			continue
+		}
+		var size [2]byte
+		_, err := io.ReadFull(conn, size[:])
+		if err != nil {
+			return send, receive, peer, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+		_, err = io.ReadFull(conn, msg)
+		if err != nil {
+			return send, receive, peer, err
+		}
+		err = hs.readMessage(msg, tokens)
+		if err != nil {
+			return send, receive, peer, err
+		}
+	}
+
+	send, receive = hs.split()
+	if !initiator {
+		send, receive = receive, send
+	}
+	return send, receive, hs.rs, nil
+}
@@ -0,0 +1,175 @@
+package encstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// -no-metadata writes files that leak nothing optional: no label, metadata,
+// expiry, signer, recipient key IDs or deniable region, fixed rather than
+// content-defined chunks, volumes of random sizes, and a padded plaintext,
+// so that the size of the file only hints at the size of the input.
+//
+// The plaintext is padded with zeros to the Padmé length of PURBs, which
+// leaks at most O(log log n) bits of its length n, at an overhead of at most
+// 12%. Its real length is sealed with a subkey of the file key in the
+// recordLength header record, which is filled in once the input has been
+// read, so that inputs of unknown length can be padded too. Like the
+// signature, it is left out of the MAC; being sealed, it cannot be altered
+// without the key either.
+
+// minPaddedSize is what the plaintext of smaller files is padded to.
+const minPaddedSize = 256
+
+var errNoMetadata = errors.New("-no-metadata cannot be combined with -label, -comment, -created, -not-after, -sign, -full-key-id, -deniable-size, -store-digest or deduplication, which record optional metadata")
+
+// paddedSize returns the Padmé length of a plaintext of n bytes: n rounded up
+// so that only the top bits of the length, as many as its length in bits
+// takes to write, may be set.
+func paddedSize(n int64) int64 {
+	if n < minPaddedSize {
+		return minPaddedSize
+	}
+	e := bits.Len64(uint64(n)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<uint(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// sealLength seals the plaintext length n of a padded file with sk, under a
+// nonce read from random.
+func sealLength(sk [32]byte, n int64, random io.Reader) ([48]byte, error) {
+	var sealed [48]byte
+	key := subkey(sk, "enc plaintext length")
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return sealed, err
+	}
+	nonce := sealed[:aead.NonceSize()]
+	err = readRandom(random, nonce)
+	if err != nil {
+		return sealed, err
+	}
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(n))
+	aead.Seal(sealed[:len(nonce)], nonce, length[:], nil)
+	return sealed, nil
+}
+
+// openLength opens the plaintext length of a padded file sealed with sk.
+func openLength(sk [32]byte, sealed [48]byte) (int64, error) {
+	key := subkey(sk, "enc plaintext length")
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return 0, err
+	}
+	length, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return 0, errBadMAC
+	}
+	n := binary.LittleEndian.Uint64(length)
+	if n > 1<<62 {
+		return 0, errBadHeader
+	}
+	return int64(n), nil
+}
+
+// optionalFields returns what h records that it need not: its label,
+// metadata and so on. Files written with -no-metadata have none.
+func (h fileHeader) optionalFields() []string {
+	var fields []string
+	if h.Label != "" {
+		fields = append(fields, "label")
+	}
+	for _, field := range h.Metadata {
+		fields = append(fields, strings.ToLower(field.Key))
+	}
+	if h.NotAfter != 0 {
+		fields = append(fields, "not after")
+	}
+	if h.Signer != ([32]byte{}) {
+		fields = append(fields, "signer")
+	}
+	keyIDs := 0
+	for _, s := range h.Recipients {
+		if len(s.KeyID) > 0 {
+			keyIDs++
+		}
+	}
+	if keyIDs > 0 {
+		fields = append(fields, fmt.Sprintf("%v recipient key IDs", keyIDs))
+	}
+	if h.Reserved != 0 {
+		fields = append(fields, "deniable region")
+	}
+	if h.Flags&flagDedup != 0 {
+		fields = append(fields, "content-defined chunking")
+	}
+	if h.Flags&flagDigest != 0 {
+		fields = append(fields, "plaintext digest")
+	}
+	return fields
+}
+
+// paddingWriter writes the plaintext of a padded file to w in full chunks,
+// padding it once closed. EncWriter seals a chunk at the end of every write,
+// so writing the input as it is read, or the padding on its own, would leak
+// the length through the sizes of the chunks.
+type paddingWriter struct {
+	w   io.Writer
+	buf []byte
+	n   int64 // plaintext bytes written, without the padding
+}
+
+func (p *paddingWriter) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	return len(b), p.write(b)
+}
+
+// write buffers b, writing every full chunk.
+func (p *paddingWriter) write(b []byte) error {
+	for len(b) > 0 {
+		if p.buf == nil {
+			p.buf = make([]byte, 0, maxChunkSize)
+		}
+		n := copy(p.buf[len(p.buf):cap(p.buf)], b)
+		p.buf = p.buf[:len(p.buf)+n]
+		b = b[n:]
+		if len(p.buf) == cap(p.buf) {
+			_, err := p.w.Write(p.buf)
+			if err != nil {
+				return err
+			}
+			p.buf = p.buf[:0]
+		}
+	}
+	return nil
+}
+
+// Close pads the plaintext with zeros to its padded size, and writes the
+// rest of it.
+func (p *paddingWriter) Close() error {
+	zeros := make([]byte, maxChunkSize)
+	for pad := paddedSize(p.n) - p.n; pad > 0; {
+		n := int64(len(zeros))
+		if pad < n {
+			n = pad
+		}
+		err := p.write(zeros[:n])
+		if err != nil {
+			return err
+		}
+		pad -= n
+	}
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := p.w.Write(p.buf)
+	return err
+}
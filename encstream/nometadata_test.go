@@ -0,0 +1,153 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// TestPaddedSize verifies that padded sizes are never smaller than the
+// plaintext, grow with it, and add at most 12% to it.
+func TestPaddedSize(t *testing.T) {
+	for _, c := range []struct{ n, padded int64 }{
+		{0, minPaddedSize},
+		{1, minPaddedSize},
+		{minPaddedSize, minPaddedSize},
+		{1000, 1024},
+		{1 << 20, 1 << 20},
+		{1<<20 + 1, 1<<20 + 1<<15},
+	} {
+		if got := paddedSize(c.n); got != c.padded {
+			t.Fatalf("%v bytes padded to %v, expected %v", c.n, got, c.padded)
+		}
+	}
+	last := int64(0)
+	for n := int64(0); n < 1<<40; n = n*5/4 + 1 {
+		padded := paddedSize(n)
+		if padded < n || padded < last {
+			t.Fatalf("%v bytes padded to %v", n, padded)
+		}
+		if n >= minPaddedSize && padded-n > n*12/100 {
+			t.Fatalf("%v bytes padded by %v", n, padded-n)
+		}
+		last = padded
+	}
+}
+
+// TestNoMetadata verifies that files encrypted with noMetadata are padded,
+// decrypt to the plaintext alone, record no optional fields, and cannot have
+// their sealed length altered.
+func TestNoMetadata(t *testing.T) {
+	passphrase := []byte("hunter2")
+	decrypt := func(keys keySource, ciphertext []byte) ([]byte, error) {
+		_, r, err := openCiphertext(keys, bytes.NewReader(ciphertext))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	for _, size := range []int{0, 1, 1000, maxChunkSize + 5} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		output := new(memoryOutput)
+		_, _, _, err := encryptTo(passphrase, bytes.NewReader(plaintext), output, 0, encryptOptions{noMetadata: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := readHeader(bytes.NewReader(output.buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Flags&flagPadded == 0 {
+			t.Fatal("the file is not marked as padded")
+		}
+		if fields := header.optionalFields(); len(fields) > 0 {
+			t.Fatal("the file records optional fields", fields)
+		}
+		if expected := ciphertextSize(int64(len(header.encode())), paddedSize(int64(size)), 0); int64(len(output.buf)) != expected {
+			t.Fatalf("a padded file of %v bytes is %v bytes, expected %v", size, len(output.buf), expected)
+		}
+		decrypted, err := decrypt(newPassphraseKeys(passphrase), output.buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext")
+		}
+
+		// the length is left out of the MAC, but sealed.
+		modified := append([]byte{}, output.buf...)
+		i := bytes.Index(modified, header.Length[:])
+		modified[i+len(header.Length)-1] ^= 1
+		if _, err := decrypt(newPassphraseKeys(passphrase), modified); err != errBadMAC {
+			t.Fatal("expected errBadMAC for a modified length, got", err)
+		}
+	}
+
+	// sizes in the same padding bucket cannot be told apart, however the
+	// input is read.
+	sizes := map[int]bool{}
+	for _, input := range []io.Reader{
+		bytes.NewReader(make([]byte, 1000)),
+		iotest.OneByteReader(bytes.NewReader(make([]byte, 1001))),
+		iotest.HalfReader(bytes.NewReader(make([]byte, 1008))),
+	} {
+		output := new(memoryOutput)
+		_, _, _, err := encryptTo(passphrase, input, output, 0, encryptOptions{noMetadata: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[len(output.buf)] = true
+	}
+	if len(sizes) != 1 {
+		t.Fatal("plaintexts padded to the same size produced files of different sizes")
+	}
+
+	// recipients are not identified.
+	alice, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := new(memoryOutput)
+	_, _, _, err = encryptTo(nil, bytes.NewReader([]byte("attack at dawn")), output, 0, encryptOptions{recipients: []recipient{alice.public}, noMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(output.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Recipients) != 1 || len(header.Recipients[0].KeyID) != 0 {
+		t.Fatal("the recipient is identified")
+	}
+	if decrypted, err := decrypt(identityKeys{alice}, output.buf); err != nil || string(decrypted) != "attack at dawn" {
+		t.Fatal("a padded file encrypted to a recipient did not decrypt", err)
+	}
+
+	for _, opts := range []encryptOptions{
+		{label: "taxes"},
+		{metadata: []metadataField{{Key: "Comment", Value: "taxes"}}},
+		{notAfter: time.Now().Add(time.Hour)},
+		{dedup: true},
+		{deniable: 4096},
+		{recipients: []recipient{alice.public}, fullKeyID: true},
+	} {
+		opts.noMetadata = true
+		_, _, _, err := encryptTo(passphrase, bytes.NewReader(nil), new(memoryOutput), 0, opts)
+		if err != errNoMetadata {
+			t.Fatal("expected errNoMetadata, got", err)
+		}
+	}
+	var stream bytes.Buffer
+	_, _, _, err = encryptTo(passphrase, bytes.NewReader(nil), streamOutput{&stream}, 0, encryptOptions{noMetadata: true})
+	if err != errStreamOptions {
+		t.Fatal("expected errStreamOptions, got", err)
+	}
+}
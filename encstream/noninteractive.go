@@ -0,0 +1,294 @@
+package encstream
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Scripts, CI jobs and cron run enc with -batch, which guarantees that it
+// never waits for a prompt. A passphrase has to come from -passphrase-file,
+// or a command or secret manager, instead, outputs that already exist are
+// only replaced with -overwrite, and each of these failures exits with its
+// own code so that the caller can tell them apart from a failed encryption.
+//
+// Without -batch, a passphrase is only prompted for at a terminal: if stdin
+// is not one, enc exits as -batch would rather than fail to read it, and
+// -prompt-timeout gives up on a prompt nobody answers.
+
+const (
+	exitNoPassphrase  = 3 // a passphrase is needed, but there is no source for it
+	exitOutputExists  = 4 // an output exists and would be replaced
+	exitPromptTimeout = 5 // no passphrase was entered within -prompt-timeout
+)
+
+// passphraseAttempts is how many times the passphrase of a file is asked for
+// when it fails to decrypt it, if it is typed in at a terminal.
+const passphraseAttempts = 3
+
+var (
+	errEmptyPassphrase = errors.New("the passphrase file is empty")
+	errNoTerminal      = errors.New("a passphrase is needed, but stdin is not a terminal to prompt at; use -passphrase-file or -passphrase-cmd")
+	errPromptTimeout   = errors.New("no passphrase was entered within -prompt-timeout")
+)
+
+// prompts holds the flags that control whether and how enc prompts.
+type prompts struct {
+	batch          bool
+	passphraseFile string
+	passphraseCmd  string
+	passEntry      string
+	passphraseRef  string
+	overwrite      bool
+	minEntropy     int
+	cacheKeys      string
+	promptTimeout  time.Duration
+	// maxKDFMemory, maxKDFTime and allowExpensiveKDF bound the KDF work of
+	// files to decrypt; see limits.
+	maxKDFMemory      string
+	maxKDFTime        string
+	allowExpensiveKDF bool
+
+	// generated is the passphrase enc genpass generated, used instead of
+	// any other.
+	generated []byte
+	// typed is set once a passphrase has been typed in at the prompt.
+	typed bool
+}
+
+// register defines the flags of prompts on fs. Only commands that write
+// outputs take -overwrite, and only those that encrypt -min-entropy.
+func (p *prompts) register(fs *flag.FlagSet, outputs, encrypt bool) {
+	fs.BoolVar(&p.batch, "batch", false, fmt.Sprintf("never prompt: exit with status %v if a passphrase is needed but neither -passphrase-file nor -passphrase-cmd is given, and %v if an output already exists", exitNoPassphrase, exitOutputExists))
+	fs.StringVar(&p.passphraseFile, "passphrase-file", "", "read the passphrase from the first line of this file instead of prompting for it")
+	fs.StringVar(&p.passphraseCmd, "passphrase-cmd", "", "read the passphrase from the first line printed by this command, e.g. \"pass show backups/enc\", instead of prompting for it")
+	fs.StringVar(&p.passEntry, "pass-entry", "", "read the passphrase from this password-store entry, with pass show, instead of prompting for it")
+	fs.StringVar(&p.passphraseRef, "passphrase-ref", "", "read the passphrase from a secret manager instead of prompting for it, given a reference like op://vault/item/field (1Password), bw://item/field (Bitwarden) or pass://entry")
+	fs.DurationVar(&p.promptTimeout, "prompt-timeout", 0, fmt.Sprintf("give up on a passphrase prompt after this long, e.g. 60s, exiting with status %v (by default, wait forever)", exitPromptTimeout))
+	fs.StringVar(&p.cacheKeys, "cache-keys", "", "keep the keys derived from a passphrase in the user's kernel keyring for this long, e.g. 15m, so that decrypting files with them again skips the passphrase and KDF; 0 turns off the cache-keys setting (Linux only)")
+	fs.StringVar(&p.maxKDFMemory, "max-kdf-memory", "", "the most KDF memory a file may ask for when decrypting, e.g. 16G (by default, the max-kdf-memory setting, or twice what enc uses)")
+	fs.StringVar(&p.maxKDFTime, "max-kdf-time", "", "the most KDF passes a file may ask for when decrypting (by default, the max-kdf-time setting, or 16)")
+	fs.BoolVar(&p.allowExpensiveKDF, "allow-expensive-kdf", false, "decrypt files whatever KDF memory and passes they ask for, within -max-memory; only for files that are trusted")
+	if outputs {
+		fs.BoolVar(&p.overwrite, "overwrite", false, "with -batch, replace outputs that already exist")
+	}
+	if encrypt {
+		fs.IntVar(&p.minEntropy, "min-entropy", 0, fmt.Sprintf("refuse passphrases estimated to have fewer bits of entropy than this (those under %v bits are warned about regardless)", weakEntropy))
+	}
+}
+
+// passphrase returns the passphrase from -passphrase-file, -passphrase-cmd,
+// -pass-entry or -passphrase-ref, or prompts for it.
+// confirm is set when encrypting: a prompted passphrase is asked for twice,
+// and the strength of the passphrase is checked. It exits on failure.
+func (p *prompts) passphrase(confirm bool) []byte {
+	for {
+		var passphrase []byte
+		switch {
+		case p.generated != nil:
+			passphrase = p.generated
+		case p.hasPassphraseSource():
+			var err error
+			passphrase, err = p.readPassphraseSource()
+			if err != nil {
+				log.Fatal(err)
+			}
+		case p.batch:
+			log.Println("a passphrase is needed, but -batch does not allow prompting for it; use -passphrase-file or -passphrase-cmd")
+			os.Exit(exitNoPassphrase)
+		default:
+			passphrase = p.readPassphrase(confirm)
+			p.typed = true
+		}
+		if !confirm {
+			return passphrase
+		}
+
+		bits := passphraseEntropy(passphrase)
+		if bits >= float64(p.minEntropy) {
+			if bits < weakEntropy {
+				log.Printf("warning: the passphrase is weak, with an estimated %.0f bits of entropy; consider a longer one, or one from enc genpass", bits)
+			}
+			return passphrase
+		}
+		msg := fmt.Sprintf("the passphrase has an estimated %.0f bits of entropy, but -min-entropy requires %v", bits, p.minEntropy)
+		if !p.interactive() {
+			log.Fatal(msg)
+		}
+		log.Println(msg + "; choose a stronger one")
+	}
+}
+
+// interactive reports whether the passphrase is typed in at a terminal.
+func (p *prompts) interactive() bool {
+	return !p.batch && !p.hasPassphraseSource() && terminal.IsTerminal(int(syscall.Stdin))
+}
+
+// keys returns the source of the keys to decrypt with: the identities in
+// the named files, or if there are none, the default identity or a
+// passphrase, with the KDF work it allows bounded by limits, and the keys
+// derived from it cached as -cache-keys says. It exits on failure.
+func (p *prompts) keys(identityFiles []string, limits resourceLimits) keySource {
+	if len(identityFiles) == 0 {
+		c, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cache := p.cacheTimeout(c)
+		if name := c.defaultIdentity(); name != "" {
+			return &defaultIdentityKeys{prompts: p, identityFile: name, limits: limits, cache: cache}
+		}
+		if cache > 0 {
+			return &keyCache{prompts: p, limits: limits, timeout: cache}
+		}
+		return passphraseKeys{passphrase: p.passphrase(false), limits: limits}
+	}
+	ids, err := readIdentities(identityFiles, p.unlock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return identityKeys(ids)
+}
+
+// unlock decrypts the identities in the protected identity file contents,
+// read from the file name, with the passphrase from -passphrase-file,
+// -passphrase-cmd, -pass-entry or -passphrase-ref, or prompted for.
+func (p *prompts) unlock(name string, contents string) ([]identity, error) {
+	var ids []identity
+	err := p.unlockWith(name, func(passphrase []byte) (err error) {
+		ids, err = unlockIdentities(contents, passphrase)
+		return err
+	})
+	return ids, err
+}
+
+// unlockWith passes the passphrase of the protected file name, from
+// -passphrase-file, -passphrase-cmd, -pass-entry or -passphrase-ref, or
+// prompted for, to open, asking again if it fails with errBadMAC.
+func (p *prompts) unlockWith(name string, open func(passphrase []byte) error) error {
+	for attempt := 1; ; attempt++ {
+		var passphrase []byte
+		var err error
+		switch {
+		case p.hasPassphraseSource():
+			passphrase, err = p.readPassphraseSource()
+		case p.batch:
+			log.Println(name, "is protected with a passphrase, but -batch does not allow prompting for it; use -passphrase-file or -passphrase-cmd")
+			os.Exit(exitNoPassphrase)
+		default:
+			passphrase, err = p.ask(fmt.Sprintf("Enter passphrase for %v:", name))
+			exitIfUnanswered(err)
+		}
+		if err != nil {
+			return err
+		}
+		err = open(passphrase)
+		if err != errBadMAC || !p.interactive() || attempt == passphraseAttempts {
+			return err
+		}
+		log.Println("wrong passphrase, try again")
+	}
+}
+
+// retryPassphrase calls decrypt with keys. A mistyped passphrase fails the
+// MAC, so if retry is set, it is asked for again with newKeys rather than
+// make the user start over, up to passphraseAttempts times in all.
+func retryPassphrase(keys keySource, newKeys func() keySource, retry bool, decrypt func(keys keySource) error) error {
+	for attempt := 1; ; attempt++ {
+		err := decrypt(keys)
+		if (err != errBadMAC && err != errHiddenNotFound) || !retry || attempt == passphraseAttempts {
+			return err
+		}
+		log.Println("authentication failed; the passphrase may have been mistyped, try again")
+		keys = newKeys()
+	}
+}
+
+// ask prompts for a passphrase at the terminal. It fails with errNoTerminal
+// if stdin is not one, and with errPromptTimeout if no passphrase is entered
+// within -prompt-timeout.
+func (p *prompts) ask(prompt string) ([]byte, error) {
+	fd := int(syscall.Stdin)
+	if !terminal.IsTerminal(fd) {
+		return nil, errNoTerminal
+	}
+	if p.promptTimeout <= 0 {
+		return askPassphrase(prompt)
+	}
+	state, err := terminal.GetState(fd)
+	if err != nil {
+		return nil, err
+	}
+	type answer struct {
+		passphrase []byte
+		err        error
+	}
+	done := make(chan answer, 1)
+	go func() {
+		passphrase, err := askPassphrase(prompt)
+		done <- answer{passphrase, err}
+	}()
+	timer := time.NewTimer(p.promptTimeout)
+	defer timer.Stop()
+	select {
+	case a := <-done:
+		return a.passphrase, a.err
+	case <-timer.C:
+		// the abandoned read has turned off echo, which is turned back on
+		// before enc exits.
+		terminal.Restore(fd, state)
+		fmt.Fprintln(os.Stderr)
+		return nil, errPromptTimeout
+	}
+}
+
+// exitIfUnanswered exits with exitNoPassphrase or exitPromptTimeout if err
+// is errNoTerminal or errPromptTimeout, so that a prompt that cannot be
+// answered fails like -batch does.
+func exitIfUnanswered(err error) {
+	switch err {
+	case errNoTerminal:
+		log.Println(err)
+		os.Exit(exitNoPassphrase)
+	case errPromptTimeout:
+		log.Println(err)
+		os.Exit(exitPromptTimeout)
+	}
+}
+
+// checkOutputs exits if -batch is given without -overwrite and any of the
+// named outputs already exists.
+func (p *prompts) checkOutputs(names ...string) {
+	if !p.batch || p.overwrite {
+		return
+	}
+	for _, name := range names {
+		if name == "" || name == "-" {
+			continue
+		}
+		if _, err := os.Lstat(name); err == nil {
+			log.Println(name, "already exists; use -overwrite to replace it")
+			os.Exit(exitOutputExists)
+		}
+	}
+}
+
+// readPassphraseFile returns the first line of the named file.
+func readPassphraseFile(name string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	contents = firstLine(contents)
+	if len(contents) == 0 {
+		return nil, errEmptyPassphrase
+	}
+	return contents, nil
+}
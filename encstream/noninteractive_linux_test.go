@@ -0,0 +1,78 @@
+package encstream
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestPromptTimeout verifies that a passphrase prompt fails at once when
+// stdin is not a terminal, and that a prompt at a terminal gives up after
+// -prompt-timeout with echo turned back on.
+func TestPromptTimeout(t *testing.T) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("pseudo-terminals are not available:", err)
+	}
+	defer master.Close()
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Skip("pseudo-terminals are not available:", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tty, err := os.OpenFile(fmt.Sprintf("/dev/pts/%v", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("pseudo-terminals are not available:", err)
+	}
+	defer tty.Close()
+
+	stdin, err := unix.Dup(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		unix.Dup2(stdin, 0)
+		unix.Close(stdin)
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	p := &prompts{promptTimeout: 100 * time.Millisecond}
+	if err := unix.Dup2(int(r.Fd()), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ask("Enter passphrase:"); err != errNoTerminal {
+		t.Fatal("expected errNoTerminal from a pipe, got", err)
+	}
+
+	if err := unix.Dup2(int(tty.Fd()), 0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := p.ask("Enter passphrase:"); err != errPromptTimeout {
+		t.Fatal("expected errPromptTimeout, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatal("the prompt gave up after", elapsed)
+	}
+	termios, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ECHO == 0 {
+		t.Fatal("echo is still off after the prompt timed out")
+	}
+	// the abandoned read gets the line, so that it does not outlive the
+	// test.
+	master.Write([]byte("\n"))
+}
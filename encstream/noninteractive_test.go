@@ -0,0 +1,89 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReadPassphraseFile verifies that only the first line of a passphrase
+// file is used, and that an empty passphrase is rejected.
+func TestReadPassphraseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "passphrase")
+	for contents, want := range map[string]string{
+		"hunter2":            "hunter2",
+		"hunter2\n":          "hunter2",
+		"hunter2\r\n":        "hunter2",
+		"hunter2\nignored\n": "hunter2",
+		" spaces kept \n":    " spaces kept ",
+	} {
+		err = ioutil.WriteFile(name, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readPassphraseFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%q read as %q, wanted %q", contents, got, want)
+		}
+	}
+	for _, contents := range []string{"", "\n", "\r\nhunter2"} {
+		err = ioutil.WriteFile(name, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPassphraseFile(name); err != errEmptyPassphrase {
+			t.Fatalf("%q: expected errEmptyPassphrase, got %v", contents, err)
+		}
+	}
+}
+
+// TestRetryPassphrase verifies that a passphrase that fails to authenticate
+// is asked for again, up to passphraseAttempts times, only when it is typed
+// in, and only for authentication failures.
+func TestRetryPassphrase(t *testing.T) {
+	errOther := errors.New("other failure")
+	for _, c := range []struct {
+		results []error
+		retry   bool
+		calls   int
+		err     error
+	}{
+		{[]error{nil}, true, 1, nil},
+		{[]error{errBadMAC, nil}, true, 2, nil},
+		{[]error{errHiddenNotFound, errBadMAC, nil}, true, 3, nil},
+		{[]error{errBadMAC, errBadMAC, errBadMAC, nil}, true, passphraseAttempts, errBadMAC},
+		{[]error{errBadMAC, nil}, false, 1, errBadMAC},
+		{[]error{errOther, nil}, true, 1, errOther},
+	} {
+		calls := 0
+		var passphrases []string
+		newKeys := func() keySource {
+			return newPassphraseKeys([]byte(fmt.Sprint("attempt ", calls+1)))
+		}
+		err := retryPassphrase(newPassphraseKeys([]byte("attempt 1")), newKeys, c.retry, func(keys keySource) error {
+			passphrases = append(passphrases, string(keys.(passphraseKeys).passphrase))
+			calls++
+			return c.results[calls-1]
+		})
+		if err != c.err || calls != c.calls {
+			t.Fatalf("%v: got %v after %v calls, expected %v after %v", c.results, err, calls, c.err, c.calls)
+		}
+		for i, passphrase := range passphrases {
+			if want := fmt.Sprint("attempt ", i+1); passphrase != want {
+				t.Fatalf("call %v decrypted with %q, expected %q", i+1, passphrase, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// enc can decrypt files written by gpg --symmetric, so that old archives can
+// be migrated to its own format. Only passphrase-encrypted messages with an
+// integrity check (a SEIPD packet with an MDC) are accepted; the plaintext is
+// written to a temporary file that only replaces the output once the
+// integrity check has passed, at the end of the message.
+
+const openPGPArmorBegin = "-----BEGIN PGP MESSAGE-----"
+
+var (
+	errOpenPGPNotSymmetric = errors.New("only OpenPGP files encrypted with a passphrase (gpg --symmetric) can be decrypted")
+	errOpenPGPNoMDC        = errors.New("the OpenPGP file has no integrity protection, refusing to decrypt it")
+	errOpenPGPPassphrase   = errors.New("incorrect passphrase")
+	errOpenPGPStdout       = errors.New("OpenPGP files cannot be decrypted to standard output, since their integrity is only checked at the end")
+)
+
+// openPGP packet tags
+const (
+	openPGPTagSKESK = 3  // symmetric-key encrypted session key
+	openPGPTagAEAD  = 20 // AEAD encrypted data, written by newer versions of gpg
+)
+
+// isOpenPGP reports whether r, which is left at its start, holds an OpenPGP
+// message encrypted with a passphrase, either binary or armored.
+func isOpenPGP(r io.ReadSeeker) (bool, error) {
+	prefix := make([]byte, 512)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	prefix = prefix[:n]
+	if bytes.HasPrefix(bytes.TrimSpace(prefix), []byte(openPGPArmorBegin)) {
+		return true, nil
+	}
+
+	// a binary message starts with a SKESK packet, whose fields are checked
+	// as well since the legacy enc header starts with random bytes.
+	if len(prefix) < 8 || prefix[0]&0x80 == 0 {
+		return false, nil
+	}
+	var tag byte
+	body := prefix
+	if prefix[0]&0x40 != 0 {
+		tag = prefix[0] & 0x3f
+		if prefix[1] >= 192 {
+			return false, nil
+		}
+		body = prefix[2:]
+	} else {
+		tag = (prefix[0] >> 2) & 0xf
+		switch prefix[0] & 3 {
+		case 0:
+			body = prefix[2:]
+		case 1:
+			body = prefix[3:]
+		default:
+			return false, nil
+		}
+	}
+	version, cipher, s2k := body[0], body[1], body[2]
+	knownCipher := cipher >= 1 && cipher <= 4 || cipher >= 7 && cipher <= 9
+	knownS2K := s2k == 0 || s2k == 1 || s2k == 3
+	return tag == openPGPTagSKESK && (version == 4 || version == 5) && knownCipher && knownS2K, nil
+}
+
+// openPGPMessage returns the binary message read from r, removing the armor
+// if there is any.
+func openPGPMessage(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.ReadByte()
+	}
+	start, err := br.Peek(len(openPGPArmorBegin))
+	if err != nil || string(start) != openPGPArmorBegin {
+		return br, nil
+	}
+	block, err := armor.Decode(br)
+	if err != nil {
+		return nil, err
+	}
+	return block.Body, nil
+}
+
+// checkOpenPGPPackets checks that the message read from r is encrypted with
+// a passphrase and integrity protected, before anything is decrypted.
+func checkOpenPGPPackets(r io.Reader) error {
+	packets := packet.NewReader(r)
+	sawSKESK := false
+	for {
+		p, err := packets.Next()
+		if unknown, ok := err.(pgperrors.UnknownPacketTypeError); ok && uint8(unknown) == openPGPTagAEAD {
+			return errors.New("OpenPGP files using AEAD encryption are not supported; decrypt them with gpg")
+		}
+		if err != nil {
+			return err
+		}
+		switch p := p.(type) {
+		case *packet.SymmetricKeyEncrypted:
+			sawSKESK = true
+		case *packet.SymmetricallyEncrypted:
+			if !sawSKESK {
+				return errOpenPGPNotSymmetric
+			}
+			if !p.MDC {
+				return errOpenPGPNoMDC
+			}
+			return nil
+		default:
+			return errOpenPGPNotSymmetric
+		}
+	}
+}
+
+// decryptOpenPGP decrypts the OpenPGP message read from input, which is
+// encrypted with passphrase, to finalOutput.
+func decryptOpenPGP(passphrase []byte, input io.ReadSeeker, finalOutput string) error {
+	if finalOutput == "-" {
+		return errOpenPGPStdout
+	}
+	message, err := openPGPMessage(input)
+	if err != nil {
+		return err
+	}
+	err = checkOpenPGPPackets(message)
+	if err != nil {
+		return err
+	}
+	_, err = input.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	message, err = openPGPMessage(input)
+	if err != nil {
+		return err
+	}
+
+	// the prompt is called again for every passphrase that does not decrypt
+	// the message.
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted {
+			return nil, errOpenPGPPassphrase
+		}
+		prompted = true
+		return passphrase, nil
+	}
+	md, err := openpgp.ReadMessage(message, openpgp.EntityList{}, prompt, nil)
+	if err != nil {
+		return err
+	}
+	if !md.IsSymmetricallyEncrypted {
+		return errOpenPGPNotSymmetric
+	}
+
+	output, err := createAtomic(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	// the MDC is checked when the end of the message is read.
+	_, err = io.Copy(output, md.UnverifiedBody)
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
@@ -0,0 +1,90 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// gpgMessage was written by gpg 2.2 with gpg -c -a and the passphrase
+// hunter2.
+const gpgMessage = `-----BEGIN PGP MESSAGE-----
+
+jA0ECQMC6uGwfSKysjL/0lMBn6LU1OzqBNbgqAoKXeK6Cv1YXu7HfR97qxn7jqwL
+2RiDd264de/p+G9qphxU2NQkyOwMku6TSCLq1qFcrFoDPqFWZrCkAd/7QzY5NO8J
+Bhbzew==
+=jQ4B
+-----END PGP MESSAGE-----
+`
+
+// TestOpenPGP verifies that armored and binary gpg --symmetric files are
+// detected and decrypted.
+func TestOpenPGP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-openpgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binary := new(bytes.Buffer)
+	w, err := openpgp.SymmetricallyEncrypt(binary, []byte("hunter2"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("old archive contents\n"))
+	w.Close()
+
+	output := filepath.Join(dir, "out")
+	for _, message := range [][]byte{[]byte("\n" + gpgMessage), binary.Bytes()} {
+		os.Remove(output)
+		input := bytes.NewReader(message)
+		pgp, err := isOpenPGP(input)
+		if err != nil || !pgp {
+			t.Fatal("OpenPGP message was not detected", err)
+		}
+		if err := decryptOpenPGP([]byte("hunter3"), input, output); err == nil {
+			t.Fatal("wrong passphrase was accepted")
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Fatal("output was written with the wrong passphrase")
+		}
+		input.Seek(0, 0)
+		if err := decryptOpenPGP([]byte("hunter2"), input, output); err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != "old archive contents\n" {
+			t.Fatalf("got %q", plaintext)
+		}
+	}
+
+	// flipping a bit in the ciphertext must be caught by the MDC.
+	tampered := append([]byte{}, binary.Bytes()...)
+	tampered[len(tampered)-30] ^= 1
+	os.Remove(output)
+	err = decryptOpenPGP([]byte("hunter2"), bytes.NewReader(tampered), output)
+	if err == nil {
+		t.Fatal("tampering was not detected")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatal("output was written despite tampering")
+	}
+
+	h, err := newHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{h.encode(), []byte(strings.Repeat("x", 100))} {
+		if pgp, err := isOpenPGP(bytes.NewReader(data)); err != nil || pgp {
+			t.Fatal("enc file was detected as OpenPGP")
+		}
+	}
+}
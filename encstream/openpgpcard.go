@@ -0,0 +1,320 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// An OpenPGP card, such as a YubiKey's OpenPGP applet or a Gnuk token, can be
+// an identity if its decryption key is a Curve25519 key: unwrapping a file key
+// only needs the X25519 agreement between that key and the stanza's ephemeral
+// key, which the card computes with its decipher operation. enc keygen
+// -openpgp-card writes an identity file that names the card's key, and holds
+// nothing secret:
+//
+//	# public key: enc-pub-...
+//	# on the OpenPGP card <serial number>; decrypting asks for its PIN
+//	ENC-OPENPGP-CARD-<public key>
+//
+// enc reaches the card through gpg-agent and its scdaemon, which usually hold
+// it for GnuPG already, and which ask for the PIN with pinentry. The key stays
+// on the card, so such identities cannot sign or be given a passphrase.
+
+const cardKeyPrefix = "ENC-OPENPGP-CARD-"
+
+// cardDecryptionKey is the key reference of the decryption key on OpenPGP
+// cards, for scdaemon.
+const cardDecryptionKey = "OPENPGP.2"
+
+var (
+	errNoGnuPG          = errors.New("OpenPGP cards are used through gpg-agent, and gpgconf was not found; install GnuPG")
+	errCardNotX25519    = errors.New("the decryption key on the OpenPGP card is not a Curve25519 key; make it one with gpg --card-edit, which needs the key-attr and generate commands")
+	errCardKeyChanged   = errors.New("the OpenPGP card holds a different decryption key than the identity file; insert the card the file was made for")
+	errCardChangePass   = errors.New("an OpenPGP card identity keeps its key on the card, and cannot be given a passphrase")
+	errCardSigning      = errors.New("an OpenPGP card identity keeps its key on the card, and cannot sign")
+	errAgentLineTooLong = errors.New("gpg-agent sent a line that is too long")
+)
+
+// isCardIdentity reports whether the identity file contents name keys on
+// OpenPGP cards.
+func isCardIdentity(contents []byte) bool {
+	return bytes.Contains(contents, []byte(cardKeyPrefix))
+}
+
+// cardIdentityContents returns the contents of an identity file for the
+// decryption key of the OpenPGP card with serial number serial.
+func cardIdentityContents(public recipient, serial string) string {
+	return fmt.Sprintf("%v%v\n# on the OpenPGP card %v; decrypting asks for its PIN\n%v%v\n",
+		publicKeyComment, public, serial, cardKeyPrefix, base64.RawURLEncoding.EncodeToString(public[:]))
+}
+
+// cardIdentities returns the identities named in the contents of an OpenPGP
+// card identity file. The card is only used once they unwrap a file key.
+func cardIdentities(contents string) ([]identity, error) {
+	lines, err := keyLines(strings.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	var ids []identity
+	for _, line := range lines {
+		public, err := parseKey(line, cardKeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, identity{public: public, card: &openpgpCard{public: public}})
+	}
+	return ids, nil
+}
+
+// openpgpCard is an OpenPGP card whose decryption key is public.
+type openpgpCard struct {
+	public recipient
+	// checked is set once the card inserted was found to hold public.
+	checked bool
+}
+
+// agree returns the X25519 agreement between the key of c and ephemeral,
+// done by the card, which may ask for its PIN.
+func (c *openpgpCard) agree(ephemeral [32]byte) ([]byte, error) {
+	agent, err := dialAgent()
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+	if !c.checked {
+		key, err := agent.cardKey()
+		if err != nil {
+			return nil, err
+		}
+		if key != c.public {
+			return nil, errCardKeyChanged
+		}
+		c.checked = true
+	}
+	return agent.cardDecipher(ephemeral)
+}
+
+// readCardKey returns the decryption key of the OpenPGP card inserted, and
+// its serial number.
+func readCardKey() (public recipient, serial string, err error) {
+	agent, err := dialAgent()
+	if err != nil {
+		return public, "", err
+	}
+	defer agent.Close()
+	_, status, err := agent.transact("SCD SERIALNO openpgp")
+	if err != nil {
+		return public, "", err
+	}
+	for _, s := range status {
+		if s, ok := strings.CutPrefix(s, "SERIALNO "); ok {
+			serial, _, _ = strings.Cut(s, " ")
+		}
+	}
+	public, err = agent.cardKey()
+	return public, serial, err
+}
+
+// agentConn is a connection to gpg-agent, which speaks the Assuan protocol:
+// every command is a line, answered by lines of data (D), status (S),
+// comments (#) and inquiries (INQUIRE), and finally OK or ERR.
+type agentConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// agentError is an error gpg-agent or scdaemon answered a command with.
+type agentError struct {
+	description string
+}
+
+func (err agentError) Error() string {
+	return "the OpenPGP card could not be used: " + err.description
+}
+
+// dialAgent connects to the gpg-agent of the user, starting it if needed.
+func dialAgent() (*agentConn, error) {
+	if _, err := exec.LookPath("gpgconf"); err != nil {
+		return nil, errNoGnuPG
+	}
+	// gpg-agent is usually started by gpg; --launch starts it if it is not.
+	launch := exec.Command("gpgconf", "--launch", "gpg-agent")
+	launch.Stderr = os.Stderr
+	if err := launch.Run(); err != nil {
+		return nil, fmt.Errorf("could not start gpg-agent: %v", err)
+	}
+	out, err := exec.Command("gpgconf", "--list-dirs", "agent-socket").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not find the socket of gpg-agent: %v", err)
+	}
+	socket := strings.TrimSpace(string(out))
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to gpg-agent: %v", err)
+	}
+	agent := &agentConn{conn: conn, r: bufio.NewReader(conn)}
+	// the greeting
+	if _, _, err := agent.response(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// pinentry is shown on the terminal or display of enc, rather than on
+	// the one gpg-agent was started from.
+	for _, option := range [][2]string{{"ttyname", "GPG_TTY"}, {"display", "DISPLAY"}} {
+		if value := os.Getenv(option[1]); value != "" {
+			if _, _, err := agent.transact("OPTION " + option[0] + "=" + value); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+	return agent, nil
+}
+
+// Close closes the connection to gpg-agent.
+func (a *agentConn) Close() error {
+	a.transact("BYE")
+	return a.conn.Close()
+}
+
+// transact sends command to gpg-agent, and returns the data and status lines
+// it answers with.
+func (a *agentConn) transact(command string) (data []byte, status []string, err error) {
+	if _, err := fmt.Fprintf(a.conn, "%v\n", command); err != nil {
+		return nil, nil, err
+	}
+	return a.response()
+}
+
+// response reads the answer to a command, up to its OK or ERR. Inquiries are
+// cancelled, as the commands enc sends only cause scdaemon to ask gpg-agent
+// for the PIN, which it answers itself.
+func (a *agentConn) response() (data []byte, status []string, err error) {
+	for {
+		line, isPrefix, err := a.r.ReadLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		if isPrefix {
+			return nil, nil, errAgentLineTooLong
+		}
+		keyword, rest, _ := strings.Cut(string(line), " ")
+		switch keyword {
+		case "OK":
+			return data, status, nil
+		case "ERR":
+			// ERR <code> <description>
+			_, description, _ := strings.Cut(rest, " ")
+			return nil, nil, agentError{description}
+		case "D":
+			d, err := assuanUnescape(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			data = append(data, d...)
+		case "S":
+			status = append(status, rest)
+		case "INQUIRE":
+			if _, err := fmt.Fprintf(a.conn, "CAN\n"); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// assuanUnescape decodes the %XX escapes of an Assuan data line.
+func assuanUnescape(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, errors.New("gpg-agent sent malformed data")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, errors.New("gpg-agent sent malformed data")
+		}
+		b = append(b, byte(c))
+		i += 2
+	}
+	return b, nil
+}
+
+// cardKey returns the decryption key of the OpenPGP card inserted, which
+// must be a Curve25519 key.
+func (a *agentConn) cardKey() (recipient, error) {
+	var public recipient
+	key, _, err := a.transact("SCD READKEY " + cardDecryptionKey)
+	if err != nil {
+		return public, err
+	}
+	// (public-key(ecc(curve Curve25519)(flags djb-tweak)(q <point>)))
+	curve, _ := sexpValue(key, "curve")
+	q, ok := sexpValue(key, "q")
+	switch string(curve) {
+	case "Curve25519", "cv25519", "1.3.6.1.4.1.3029.1.5.1":
+	default:
+		return public, errCardNotX25519
+	}
+	// the point may be prefixed with 0x40, for its native encoding.
+	if len(q) == len(public)+1 && q[0] == 0x40 {
+		q = q[1:]
+	}
+	if !ok || len(q) != len(public) {
+		return public, errCardNotX25519
+	}
+	copy(public[:], q)
+	return public, nil
+}
+
+// cardDecipher returns the X25519 agreement between the decryption key of
+// the OpenPGP card inserted and ephemeral, which may ask for the PIN.
+func (a *agentConn) cardDecipher(ephemeral [32]byte) ([]byte, error) {
+	point := append([]byte{0x40}, ephemeral[:]...)
+	if _, _, err := a.transact("SCD SETDATA " + strings.ToUpper(hex.EncodeToString(point))); err != nil {
+		return nil, err
+	}
+	shared, _, err := a.transact("SCD PKDECRYPT " + cardDecryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(shared) == 33 && shared[0] == 0x40 {
+		shared = shared[1:]
+	}
+	if len(shared) != 32 {
+		return nil, errors.New("the OpenPGP card returned a malformed shared secret")
+	}
+	return shared, nil
+}
+
+// sexpValue returns the value of the list (name value) in the canonical
+// S-expression sexp, in which every atom is written as <length>:<bytes>.
+func sexpValue(sexp []byte, name string) ([]byte, bool) {
+	tag := []byte(fmt.Sprintf("(%d:%v", len(name), name))
+	i := bytes.Index(sexp, tag)
+	if i < 0 {
+		return nil, false
+	}
+	rest := sexp[i+len(tag):]
+	colon := bytes.IndexByte(rest, ':')
+	if colon < 0 {
+		return nil, false
+	}
+	n, err := strconv.Atoi(string(rest[:colon]))
+	if err != nil || n < 0 || n > len(rest)-colon-1 {
+		return nil, false
+	}
+	return rest[colon+1 : colon+1+n], true
+}
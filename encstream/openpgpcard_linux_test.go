@@ -0,0 +1,189 @@
+package encstream
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// fakeCardAgent stands in for gpg-agent with an OpenPGP card inserted, whose
+// decryption key is an identity, or an RSA key if key is nil.
+type fakeCardAgent struct {
+	mu     sync.Mutex
+	key    *identity
+	cancel bool // the PIN entry is cancelled
+}
+
+// assuanEscape escapes the data of an Assuan data line.
+func assuanEscape(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		if c == '%' || c == '\r' || c == '\n' {
+			fmt.Fprintf(&s, "%%%02X", c)
+		} else {
+			s.WriteByte(c)
+		}
+	}
+	return s.String()
+}
+
+func (a *fakeCardAgent) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "OK Pleased to meet you\n")
+	var data []byte
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		a.mu.Lock()
+		key, cancel := a.key, a.cancel
+		a.mu.Unlock()
+		command, arg, _ := strings.Cut(scanner.Text(), " ")
+		if command == "SCD" {
+			command, arg, _ = strings.Cut(arg, " ")
+		}
+		switch command {
+		case "OPTION":
+		case "BYE":
+			fmt.Fprintf(conn, "OK closing connection\n")
+			return
+		case "SERIALNO":
+			fmt.Fprintf(conn, "S SERIALNO D2760001240103040006123456780000 0\n")
+		case "READKEY":
+			sexp := "(10:public-key(3:rsa(1:n3:abc)(1:e3:\x01\x00\x01)))"
+			if key != nil {
+				sexp = "(10:public-key(3:ecc(5:curve10:Curve25519)(5:flags9:djb-tweak)(1:q33:@" + string(key.public[:]) + ")))"
+			}
+			fmt.Fprintf(conn, "D %v\n", assuanEscape([]byte(sexp)))
+		case "SETDATA":
+			data, _ = hex.DecodeString(arg)
+		case "PKDECRYPT":
+			if cancel {
+				fmt.Fprintf(conn, "ERR 83886179 Operation cancelled <Pinentry>\n")
+				continue
+			}
+			shared, err := curve25519.X25519(key.secret[:], data[1:])
+			if err != nil || data[0] != 0x40 {
+				fmt.Fprintf(conn, "ERR 100663351 Invalid value <SCD>\n")
+				continue
+			}
+			fmt.Fprintf(conn, "D %v\n", assuanEscape(append([]byte{0x40}, shared...)))
+		default:
+			fmt.Fprintf(conn, "ERR 536871187 Unknown IPC command <User defined source 1>\n")
+			continue
+		}
+		fmt.Fprintf(conn, "OK\n")
+	}
+}
+
+// TestOpenPGPCard verifies, against a stand-in for gpg-agent, that keygen's
+// identity files for OpenPGP cards unwrap file keys with the card, and that
+// a card with another key or no Curve25519 key, a cancelled PIN entry,
+// signing and changing the passphrase fail with errors that say so.
+func TestOpenPGPCard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-card")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "S.gpg-agent")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	script := "#!/bin/sh\n[ \"$1\" = --list-dirs ] && echo " + socket + "\nexit 0\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "gpgconf"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &fakeCardAgent{key: &id}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.serve(conn)
+		}
+	}()
+
+	public, serial, err := readCardKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public != id.public || serial != "D2760001240103040006123456780000" {
+		t.Fatal("wrong card key", public, serial)
+	}
+	name := filepath.Join(dir, "card.key")
+	if err := ioutil.WriteFile(name, []byte(cardIdentityContents(public, serial)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := identityPublicKeys(name)
+	if err != nil || len(keys) != 1 || keys[0] != id.public.String() {
+		t.Fatal("wrong public keys", keys, err)
+	}
+	fileKey := [32]byte{1, 2, 3}
+	s, err := id.public.wrap(fileKey, shortKeyIDSize, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := fileHeader{Recipients: []recipientStanza{s}}
+	ids, err := readIdentities([]string{name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := identityKeys(ids).fileKey(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != fileKey {
+		t.Fatal("the card unwrapped the wrong file key")
+	}
+
+	if _, err := readSigningKey(name, nil); err == nil || !strings.Contains(err.Error(), errCardSigning.Error()) {
+		t.Fatal("expected errCardSigning, got", err)
+	}
+
+	agent.mu.Lock()
+	agent.cancel = true
+	agent.mu.Unlock()
+	if _, err := identityKeys(ids).fileKey(header); err == nil || !strings.Contains(err.Error(), "Operation cancelled") {
+		t.Fatal("expected the cancelled PIN entry, got", err)
+	}
+
+	other, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.mu.Lock()
+	agent.key, agent.cancel = &other, false
+	agent.mu.Unlock()
+	ids, err = readIdentities([]string{name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := identityKeys(ids).fileKey(header); err != errCardKeyChanged {
+		t.Fatal("expected errCardKeyChanged, got", err)
+	}
+
+	agent.mu.Lock()
+	agent.key = nil
+	agent.mu.Unlock()
+	if _, _, err := readCardKey(); err != errCardNotX25519 {
+		t.Fatal("expected errCardNotX25519, got", err)
+	}
+}
@@ -0,0 +1,270 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// enc can also decrypt files written by openssl enc, which start with
+// "Salted__" and an 8 byte salt, optionally base64 encoded. The file does not
+// record how its key was derived or which cipher was used, so they are given
+// with the same options that were passed to openssl enc, and default to
+// openssl's own defaults. These files are not authenticated: a wrong
+// passphrase is usually, but not always, caught by the CBC padding, and CTR
+// files cannot be checked at all.
+
+const openSSLMagic = "Salted__"
+
+var (
+	errOpenSSLLength     = errors.New("the openssl file is truncated or not a multiple of the block size")
+	errOpenSSLPassphrase = errors.New("bad decrypt: wrong passphrase or openssl options")
+)
+
+// openSSLOptions describe how an openssl enc file was encrypted.
+type openSSLOptions struct {
+	cipher string // aes-{128,192,256}-{cbc,ctr}
+	pbkdf2 bool   // PBKDF2 instead of EVP_BytesToKey
+	iter   int    // PBKDF2 iterations
+	md     string // digest used by either KDF
+}
+
+// defaultOpenSSLOptions returns the options openssl enc uses by default.
+func defaultOpenSSLOptions() openSSLOptions {
+	return openSSLOptions{cipher: "aes-256-cbc", iter: 10000, md: "sha256"}
+}
+
+// parseOpenSSLOptions parses the options that were passed to openssl enc,
+// such as "-aes-256-cbc -pbkdf2 -iter 100000". Options that do not affect
+// decryption, such as -salt, -a or -in and their values, are ignored.
+func parseOpenSSLOptions(s string) (openSSLOptions, error) {
+	opts := defaultOpenSSLOptions()
+	args := strings.Fields(s)
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		switch {
+		case arg == "pbkdf2":
+			opts.pbkdf2 = true
+		case arg == "iter" || arg == "md":
+			if i+1 == len(args) {
+				return openSSLOptions{}, fmt.Errorf("openssl option -%v needs a value", arg)
+			}
+			i++
+			if arg == "md" {
+				opts.md = strings.ToLower(args[i])
+				continue
+			}
+			iter, err := strconv.Atoi(args[i])
+			if err != nil || iter < 1 {
+				return openSSLOptions{}, fmt.Errorf("invalid openssl iteration count %q", args[i])
+			}
+			opts.iter = iter
+			opts.pbkdf2 = true
+		case arg == "salt" || arg == "a" || arg == "base64" || arg == "A" || arg == "d" || arg == "e":
+		case arg == "in" || arg == "out" || arg == "pass" || arg == "k" || arg == "kfile":
+			i++
+		case arg == "aes128" || arg == "aes192" || arg == "aes256":
+			opts.cipher = "aes-" + strings.TrimPrefix(arg, "aes") + "-cbc"
+		default:
+			opts.cipher = strings.ToLower(arg)
+		}
+	}
+	if _, _, err := opts.keySize(); err != nil {
+		return openSSLOptions{}, err
+	}
+	if _, err := opts.hash(); err != nil {
+		return openSSLOptions{}, err
+	}
+	return opts, nil
+}
+
+// keySize returns the key size of the cipher and whether it is used in CBC
+// mode.
+func (o openSSLOptions) keySize() (int, bool, error) {
+	var bits int
+	var mode string
+	_, err := fmt.Sscanf(strings.Replace(o.cipher, "-", " ", -1), "aes %d %s", &bits, &mode)
+	if err != nil || (bits != 128 && bits != 192 && bits != 256) || (mode != "cbc" && mode != "ctr") {
+		return 0, false, fmt.Errorf("unsupported openssl cipher %q; use one of aes-{128,192,256}-{cbc,ctr}", o.cipher)
+	}
+	return bits / 8, mode == "cbc", nil
+}
+
+// hash returns the digest used to derive the key.
+func (o openSSLOptions) hash() (func() hash.Hash, error) {
+	switch o.md {
+	case "md5":
+		return md5.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported openssl digest %q", o.md)
+}
+
+// deriveKey derives the key and IV from passphrase and salt.
+func (o openSSLOptions) deriveKey(passphrase []byte, salt []byte) (key []byte, iv []byte, err error) {
+	keySize, _, err := o.keySize()
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := o.hash()
+	if err != nil {
+		return nil, nil, err
+	}
+	var material []byte
+	if o.pbkdf2 {
+		material = pbkdf2.Key(passphrase, salt, o.iter, keySize+aes.BlockSize, h)
+	} else {
+		// EVP_BytesToKey with a single iteration: D_i = H(D_{i-1} || passphrase || salt).
+		var d []byte
+		for len(material) < keySize+aes.BlockSize {
+			digest := h()
+			digest.Write(d)
+			digest.Write(passphrase)
+			digest.Write(salt)
+			d = digest.Sum(nil)
+			material = append(material, d...)
+		}
+	}
+	return material[:keySize], material[keySize : keySize+aes.BlockSize], nil
+}
+
+// openSSLCiphertext returns the binary file read from r, decoding base64 if
+// needed, and whether it is an openssl enc file at all.
+func openSSLCiphertext(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.ReadByte()
+	}
+	// the first 10 characters of the base64 encoding only depend on the
+	// magic, not on the salt that follows it.
+	encodedMagic := base64.StdEncoding.EncodeToString([]byte(openSSLMagic))[:10]
+	prefix, _ := br.Peek(len(encodedMagic))
+	switch {
+	case bytes.HasPrefix(prefix, []byte(openSSLMagic)):
+		return br, true, nil
+	case string(prefix) == encodedMagic:
+		return base64.NewDecoder(base64.StdEncoding, br), true, nil
+	}
+	return nil, false, nil
+}
+
+// isOpenSSL reports whether r, which is left at its start, holds an openssl
+// enc file.
+func isOpenSSL(r io.ReadSeeker) (bool, error) {
+	_, ok, err := openSSLCiphertext(r)
+	if err != nil {
+		return false, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return ok, err
+}
+
+// decryptOpenSSL decrypts the openssl enc file read from input, which was
+// encrypted with passphrase and opts, to finalOutput.
+func decryptOpenSSL(passphrase []byte, input io.Reader, finalOutput string, opts openSSLOptions) error {
+	r, ok, err := openSSLCiphertext(input)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not an openssl enc file")
+	}
+	header := make([]byte, len(openSSLMagic)+8)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return errOpenSSLLength
+	}
+	key, iv, err := opts.deriveKey(passphrase, header[len(openSSLMagic):])
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	output, err := createPlaintext(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	if _, cbc, _ := opts.keySize(); cbc {
+		err = decryptCBC(cipher.NewCBCDecrypter(block, iv), r, output)
+	} else {
+		_, err = io.Copy(output, cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r})
+	}
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
+
+// decryptCBC decrypts the CBC ciphertext read from r to w, removing the PKCS#7
+// padding from the last block.
+func decryptCBC(mode cipher.BlockMode, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n%aes.BlockSize != 0 {
+			return errOpenSSLLength
+		}
+		mode.CryptBlocks(buf[:n], buf[:n])
+		_, err = br.Peek(1)
+		if err == nil {
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return errOpenSSLLength
+		}
+		padding := int(buf[n-1])
+		if padding == 0 || padding > aes.BlockSize {
+			return errOpenSSLPassphrase
+		}
+		for _, b := range buf[n-padding : n] {
+			if int(b) != padding {
+				return errOpenSSLPassphrase
+			}
+		}
+		_, err = w.Write(buf[:n-padding])
+		return err
+	}
+}
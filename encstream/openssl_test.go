@@ -0,0 +1,91 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenSSL verifies that files written by openssl enc with various options
+// are decrypted.
+func TestOpenSSL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-openssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out")
+
+	// written by OpenSSL 3.0 with echo legacy artifact | openssl enc -a
+	// -pass pass:hunter2 and the given options.
+	files := map[string]string{
+		"-aes-256-cbc":                    "U2FsdGVkX1/bocdzFQAq1Mpfq1tOayGwLJl2EhHLdelyXp7ZHi3Hdw43yxLHe7Eb\n",
+		"-aes-256-cbc -pbkdf2":            "U2FsdGVkX18fOA1sTsWHWPPXb9fX8DhKuuqbd9uTOfXPTflOb+IOigIPaUmLki8v\n",
+		"-aes-128-cbc -md md5":            "U2FsdGVkX1/aNl1sSgVeUMWuiVEiSKNcVSw0Kx2VLojd5Fq8lHkZtzoKBZvNlX7z\n",
+		"-aes-256-ctr -pbkdf2 -iter 1000": "U2FsdGVkX1+SGLceTCXxZ8uBZmcNkt3hExGhcyKCW1k=\n",
+	}
+	for options, file := range files {
+		opts, err := parseOpenSSLOptions(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := bytes.NewReader([]byte(file))
+		if ok, err := isOpenSSL(input); err != nil || !ok {
+			t.Fatal("openssl file was not detected", err)
+		}
+		if err := decryptOpenSSL([]byte("hunter2"), input, output, opts); err != nil {
+			t.Fatal(options, err)
+		}
+		plaintext, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != "legacy artifact\n" {
+			t.Fatalf("%v: got %q", options, plaintext)
+		}
+	}
+	opts, _ := parseOpenSSLOptions("-aes-256-cbc -pbkdf2")
+	os.Remove(output)
+	err = decryptOpenSSL([]byte("hunter3"), bytes.NewReader([]byte(files["-aes-256-cbc -pbkdf2"])), output, opts)
+	if err == nil {
+		t.Fatal("wrong passphrase was not detected by the padding")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatal("output was written with the wrong passphrase")
+	}
+
+	// a binary file spanning several buffers.
+	plaintext := make([]byte, 200000)
+	rand.Read(plaintext)
+	salt := []byte("saltsalt")
+	key, iv, err := opts.deriveKey([]byte("hunter2"), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	file := append([]byte(openSSLMagic), append(salt, padded...)...)
+	if err := decryptOpenSSL([]byte("hunter2"), bytes.NewReader(file), output, opts); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+
+	for _, options := range []string{"-des3", "-aes-256-gcm", "-md whirlpool", "-iter x"} {
+		if _, err := parseOpenSSLOptions(options); err == nil {
+			t.Fatalf("unsupported options %q were accepted", options)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package encstream
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Archives record the owner of every entry as tar does, by user and group ID
+// and name, and the POSIX ACLs and file capabilities of files and directories
+// as the SCHILY.xattr PAX records of GNU tar and star. Extraction restores
+// them when it runs as root, so that a system backup restores faithfully, and
+// otherwise leaves the extracted files owned by whoever extracts them.
+//
+// As with tar, owners are restored by name where the name exists on the
+// system, and by ID otherwise or with -numeric-owner. -owner-map and
+// -group-map rewrite owners on the way, for restoring onto a system whose
+// IDs differ.
+
+// securityXattrs are the extended attributes that archives record: the
+// access and default ACLs, and the file capabilities.
+var securityXattrs = []string{"system.posix_acl_access", "system.posix_acl_default", "security.capability"}
+
+// xattrPrefix prefixes the names of the PAX records holding extended
+// attributes.
+const xattrPrefix = "SCHILY.xattr."
+
+var errOwnerMap = errors.New("each line of an owner or group map must be a name or +ID, followed by a name, +ID or name:ID to map it to")
+
+// ownerOptions says how extraction restores the owners of entries.
+type ownerOptions struct {
+	// numeric restores the recorded IDs, ignoring the names.
+	numeric bool
+	// users and groups map recorded names, and IDs prefixed with +, to the
+	// IDs to restore instead.
+	users, groups map[string]int
+}
+
+// ownerFlags are the flags of the commands that extract archives that say
+// how owners are restored.
+type ownerFlags struct {
+	sameOwner bool
+	numeric   bool
+	ownerMap  string
+	groupMap  string
+}
+
+func (f *ownerFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.sameOwner, "same-owner", os.Geteuid() == 0, "restore the owners, setuid bits, ACLs and capabilities of archive entries; the default as root")
+	fs.BoolVar(&f.numeric, "numeric-owner", false, "restore the user and group IDs of archive entries, ignoring their names")
+	fs.StringVar(&f.ownerMap, "owner-map", "", "map the owners of archive entries as listed in this file, one \"old new\" line each, where old is a name or +UID and new a name, +UID or name:UID")
+	fs.StringVar(&f.groupMap, "group-map", "", "map the groups of archive entries as listed in this file, like -owner-map")
+}
+
+// options returns the ownerOptions the flags describe, or nil if owners are
+// not restored. It exits on failure.
+func (f *ownerFlags) options() *ownerOptions {
+	if !f.sameOwner {
+		if f.numeric || f.ownerMap != "" || f.groupMap != "" {
+			log.Fatal("-numeric-owner, -owner-map and -group-map only apply with -same-owner")
+		}
+		return nil
+	}
+	o := &ownerOptions{numeric: f.numeric}
+	var err error
+	if f.ownerMap != "" {
+		o.users, err = readOwnerMap(f.ownerMap, lookupUser)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if f.groupMap != "" {
+		o.groups, err = readOwnerMap(f.groupMap, lookupGroup)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return o
+}
+
+// readOwnerMap reads an owner or group map in the format of GNU tar: a line
+// for each owner, with the name or +ID it maps from and the name, +ID or
+// name:ID it maps to. lookup resolves names to IDs.
+func readOwnerMap(name string, lookup func(string) (int, error)) (map[string]int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]int)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errOwnerMap
+		}
+		if strings.HasPrefix(fields[0], "+") {
+			if _, err := strconv.ParseUint(fields[0][1:], 10, 32); err != nil {
+				return nil, errOwnerMap
+			}
+		}
+		id, err := parseOwner(fields[1], lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		m[fields[0]] = id
+	}
+	return m, s.Err()
+}
+
+// parseOwner parses the target of an owner map: +ID, name:ID or a name
+// resolved with lookup.
+func parseOwner(s string, lookup func(string) (int, error)) (int, error) {
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		s = "+" + s[i+1:]
+	}
+	if strings.HasPrefix(s, "+") {
+		id, err := strconv.ParseUint(s[1:], 10, 32)
+		if err != nil {
+			return 0, errOwnerMap
+		}
+		return int(id), nil
+	}
+	return lookup(s)
+}
+
+// lookupUser returns the ID of the user called name.
+func lookupUser(name string) (int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the ID of the group called name.
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// resolveOwner returns the ID to restore for an entry owned by name and id,
+// given the map m and the system's lookup.
+func resolveOwner(name string, id int, numeric bool, m map[string]int, lookup func(string) (int, error)) int {
+	if mapped, ok := m[name]; ok && name != "" {
+		return mapped
+	}
+	if mapped, ok := m["+"+strconv.Itoa(id)]; ok {
+		return mapped
+	}
+	if numeric || name == "" {
+		return id
+	}
+	if resolved, err := lookup(name); err == nil {
+		return resolved
+	}
+	return id
+}
+
+// ids returns the user and group IDs to restore for hdr.
+func (o *ownerOptions) ids(hdr *tar.Header) (uid int, gid int) {
+	uid = resolveOwner(hdr.Uname, hdr.Uid, o.numeric, o.users, lookupUser)
+	gid = resolveOwner(hdr.Gname, hdr.Gid, o.numeric, o.groups, lookupGroup)
+	return uid, gid
+}
+
+// restore restores the owner, mode, ACLs and capabilities of the entry hdr
+// extracted to target. The owner comes first, since changing it clears the
+// setuid and setgid bits and the capabilities, and the ACLs last, since
+// changing the mode rewrites the access ACL. None of them follow target if it
+// is a symlink.
+func (o *ownerOptions) restore(hdr *tar.Header, target string) error {
+	uid, gid := o.ids(hdr)
+	err := os.Lchown(target, uid, gid)
+	if err != nil || hdr.Typeflag == tar.TypeSymlink {
+		return err
+	}
+	err = lchmod(target, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return err
+	}
+	for _, name := range securityXattrs {
+		value, ok := hdr.PAXRecords[xattrPrefix+name]
+		if !ok {
+			continue
+		}
+		err = setXattr(target, name, []byte(value))
+		if err != nil {
+			return fmt.Errorf("cannot restore %v of %v: %v", name, target, err)
+		}
+	}
+	return nil
+}
+
+// recordXattrs adds the security extended attributes of the file at p to
+// hdr.
+func recordXattrs(hdr *tar.Header, p string) error {
+	for _, name := range securityXattrs {
+		value, err := getXattr(p, name)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[xattrPrefix+name] = string(value)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package encstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestRestoreOwners verifies that extraction restores the owners, setuid
+// bits and capabilities of archive entries, which needs root.
+func TestRestoreOwners(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("restoring owners needs root")
+	}
+	src, err := ioutil.TempDir("", "enctest-owner-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	p := filepath.Join(src, "ping")
+	if err := ioutil.WriteFile(p, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(p, 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(p, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	// CAP_NET_RAW, permitted and effective.
+	capability := []byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if err := setXattr(p, "security.capability", capability); err != nil {
+		t.Log("capabilities are not supported here:", err)
+		capability = nil
+	}
+
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(src, archive, nil, archiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	extract := func(owners *ownerOptions) string {
+		dest, err := ioutil.TempDir("", "enctest-owner-dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := extractArchive(bytes.NewReader(archive.Bytes()), dest, extractOptions{owners: owners}); err != nil {
+			t.Fatal(err)
+		}
+		return dest
+	}
+
+	dest := extract(&ownerOptions{})
+	defer os.RemoveAll(dest)
+	restored := filepath.Join(dest, "ping")
+	info, err := os.Stat(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	if st.Uid != 1234 || st.Gid != 5678 {
+		t.Fatalf("restored as %v:%v", st.Uid, st.Gid)
+	}
+	if info.Mode() != 0755|os.ModeSetuid {
+		t.Fatal("restored with mode", info.Mode())
+	}
+	if capability != nil {
+		value, err := getXattr(restored, "security.capability")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, capability) {
+			t.Fatal("the capabilities were not restored")
+		}
+	}
+
+	mapped := extract(&ownerOptions{users: map[string]int{"+1234": 42}, groups: map[string]int{"+5678": 43}})
+	defer os.RemoveAll(mapped)
+	info, err = os.Stat(filepath.Join(mapped, "ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid != 42 || st.Gid != 43 {
+		t.Fatalf("mapped to %v:%v", st.Uid, st.Gid)
+	}
+
+	// without owners, entries belong to whoever extracts them.
+	plain := extract(nil)
+	defer os.RemoveAll(plain)
+	info, err = os.Stat(filepath.Join(plain, "ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid != 0 || info.Mode()&os.ModeSetuid != 0 {
+		t.Fatal("the owner was restored without owners")
+	}
+}
+
+// TestRestoreOverSymlink verifies that restoring the mode of a directory
+// entry does not follow a symlink of the same name planted by an earlier
+// entry.
+func TestRestoreOverSymlink(t *testing.T) {
+	outside, err := ioutil.TempDir("", "enctest-owner-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: outside}); err != nil {
+		t.Fatal(err)
+	}
+	dir := &tar.Header{Name: "x/", Typeflag: tar.TypeDir, Mode: 0777, Uid: os.Getuid(), Gid: os.Getgid()}
+	if err := tw.WriteHeader(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := ioutil.TempDir("", "enctest-owner-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if _, err := extractArchive(buf, dest, extractOptions{owners: &ownerOptions{numeric: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatal("the mode of a directory outside of the destination was changed")
+	}
+	info, err := os.Lstat(filepath.Join(dest, "x"))
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0777 {
+		t.Fatal("the directory entry was not extracted in place of the symlink")
+	}
+}
@@ -0,0 +1,68 @@
+package encstream
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOwnerMap verifies the parsing of owner maps, and that mapped owners
+// take precedence over names, and names over IDs unless numeric is set.
+func TestOwnerMap(t *testing.T) {
+	lookup := func(name string) (int, error) {
+		switch name {
+		case "alice":
+			return 1000, nil
+		case "bob":
+			return 1001, nil
+		}
+		return 0, errors.New("no such user")
+	}
+	dir, err := ioutil.TempDir("", "enctest-owner-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "map")
+	write := func(s string) {
+		if err := ioutil.WriteFile(name, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# old new\nalice bob\n+500 +600\ncarol dan:700\n\n")
+	m, err := readOwnerMap(name, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 || m["alice"] != 1001 || m["+500"] != 600 || m["carol"] != 700 {
+		t.Fatal("wrong map", m)
+	}
+	for _, c := range []struct {
+		name    string
+		id      int
+		numeric bool
+		want    int
+	}{
+		{"alice", 1, false, 1001},
+		{"alice", 1, true, 1001},
+		{"eve", 500, false, 600},
+		{"bob", 2, false, 1001},
+		{"bob", 2, true, 2},
+		{"eve", 3, false, 3},
+		{"", 4, false, 4},
+	} {
+		if got := resolveOwner(c.name, c.id, c.numeric, m, lookup); got != c.want {
+			t.Fatalf("%v (%v) resolved to %v, expected %v", c.name, c.id, got, c.want)
+		}
+	}
+
+	for _, s := range []string{"alice\n", "alice bob carol\n", "+x bob\n", "alice +x\n", "alice eve\n"} {
+		write(s)
+		if _, err := readOwnerMap(name, lookup); err == nil {
+			t.Fatalf("%q was accepted", s)
+		}
+	}
+}
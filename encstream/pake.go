@@ -0,0 +1,117 @@
+package encstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"filippo.io/edwards25519/field"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Transfer codes are short, so a key cannot be derived from them directly:
+// anyone who saw the exchange could try every code offline. Instead both ends
+// run CPace, a balanced PAKE, over X25519. The generator is derived from the
+// code by hashing it onto the curve with Elligator 2, and the ends exchange
+// their ephemeral keys over it as in Diffie-Hellman. Only an end that knows
+// the code agrees on the session key, and an attacker in the middle learns
+// nothing but whether its single guess of the code was right.
+
+var errPAKE = errors.New("the key exchange failed")
+
+// curveA is the A coefficient of Curve25519, v² = u³ + Au² + u.
+const curveA = 486662
+
+// elligator2 maps the field element r to the u-coordinate of a point of
+// Curve25519, as in RFC 9380 with Z = 2. It runs in constant time, since r is
+// derived from the code.
+func elligator2(r *field.Element) [32]byte {
+	var a, one, den, w, rhs, other field.Element
+	a.SetBytes([]byte{curveA & 0xff, curveA >> 8 & 0xff, curveA >> 16, 31: 0})
+	one.One()
+
+	// w = -A / (1 + 2r²), which is never a division by zero since 2 is not
+	// a square modulo p.
+	den.Square(r)
+	den.Add(&den, &den).Add(&den, &one)
+	w.Invert(&den).Multiply(&w, &a).Negate(&w)
+
+	// if w³ + Aw² + w is not a square, the point is at u = -w - A instead.
+	rhs.Add(&w, &a).Multiply(&rhs, &w).Add(&rhs, &one).Multiply(&rhs, &w)
+	_, isSquare := new(field.Element).SqrtRatio(&rhs, &one)
+	other.Add(&w, &a).Negate(&other)
+	w.Select(&w, &other, isSquare)
+
+	var u [32]byte
+	copy(u[:], w.Bytes())
+	return u
+}
+
+// cpaceGenerator derives the generator of a session from the code and the
+// session ID.
+func cpaceGenerator(code, sid []byte) [32]byte {
+	h, _ := blake2b.New512(nil)
+	h.Write([]byte("enc CPace generator"))
+	writePrefixed(h, sid)
+	writePrefixed(h, code)
+	digest := h.Sum(nil)
+
+	// the element is taken from 255 bits of the digest, little-endian;
+	// SetBytes ignores the top bit and reduces the rest.
+	r, _ := new(field.Element).SetBytes(digest[:32])
+	return elligator2(r)
+}
+
+// writePrefixed writes b to w preceded by its length.
+func writePrefixed(w io.Writer, b []byte) {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(b)))
+	w.Write(n[:])
+	w.Write(b)
+}
+
+// pakeSession runs CPace over conn with the other end, which must use the
+// same code and session ID, and returns the session key. Exactly one end is
+// the initiator, whose message comes first in the transcript.
+func pakeSession(conn io.ReadWriter, code, sid []byte, initiator bool, random io.Reader) ([32]byte, error) {
+	generator := cpaceGenerator(code, sid)
+	var scalar [32]byte
+	err := readRandom(random, scalar[:])
+	if err != nil {
+		return [32]byte{}, err
+	}
+	public, err := curve25519.X25519(scalar[:], generator[:])
+	if err != nil {
+		return [32]byte{}, err
+	}
+	_, err = conn.Write(public)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	peer := make([]byte, 32)
+	_, err = io.ReadFull(conn, peer)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	// X25519 fails on the low-order points that would force the shared
+	// secret.
+	shared, err := curve25519.X25519(scalar[:], peer)
+	if err != nil {
+		return [32]byte{}, errPAKE
+	}
+
+	first, second := public, peer
+	if !initiator {
+		first, second = peer, public
+	}
+	h, _ := blake2b.New256(nil)
+	h.Write([]byte("enc CPace session"))
+	writePrefixed(h, sid)
+	h.Write(shared)
+	h.Write(first)
+	h.Write(second)
+	var key [32]byte
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
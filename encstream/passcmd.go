@@ -0,0 +1,79 @@
+package encstream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A passphrase can be fetched from a secret manager rather than typed in or
+// kept in a file. -passphrase-cmd runs a command, split on spaces like -ssh
+// and not through a shell, and takes the first line of its output, as
+// -passphrase-file takes the first line of a file. -pass-entry is the
+// shorthand for password-store: it runs pass show with the entry, whatever
+// characters its name has. The command gets no stdin, which may hold the
+// input, but its errors, and prompts such as those of gpg, go to stderr.
+
+var (
+	errPassphraseSources = errors.New("only one of -passphrase-file, -passphrase-cmd, -pass-entry and -passphrase-ref can be given")
+	errNoCommand         = errors.New("-passphrase-cmd names no command")
+	errEmptyCommand      = errors.New("the passphrase command printed no passphrase")
+)
+
+// hasPassphraseSource reports whether the passphrase is read from a file or
+// a command rather than prompted for.
+func (p *prompts) hasPassphraseSource() bool {
+	return p.passphraseFile != "" || p.passphraseCmd != "" || p.passEntry != "" || p.passphraseRef != ""
+}
+
+// readPassphraseSource returns the passphrase from -passphrase-file,
+// -passphrase-cmd, -pass-entry or -passphrase-ref.
+func (p *prompts) readPassphraseSource() ([]byte, error) {
+	sources := 0
+	for _, s := range []string{p.passphraseFile, p.passphraseCmd, p.passEntry, p.passphraseRef} {
+		if s != "" {
+			sources++
+		}
+	}
+	switch {
+	case sources > 1:
+		return nil, errPassphraseSources
+	case p.passphraseFile != "":
+		return readPassphraseFile(p.passphraseFile)
+	case p.passEntry != "":
+		return runPassphraseCommand([]string{"pass", "show", p.passEntry})
+	case p.passphraseRef != "":
+		return readSecretRef(p.passphraseRef)
+	}
+	args := strings.Fields(p.passphraseCmd)
+	if len(args) == 0 {
+		return nil, errNoCommand
+	}
+	return runPassphraseCommand(args)
+}
+
+// runPassphraseCommand runs args and returns the first line of its output.
+func runPassphraseCommand(args []string) ([]byte, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", strings.Join(args, " "), err)
+	}
+	passphrase := firstLine(out)
+	if len(passphrase) == 0 {
+		return nil, errEmptyCommand
+	}
+	return passphrase, nil
+}
+
+// firstLine returns the first line of contents, without its line ending.
+func firstLine(contents []byte) []byte {
+	if i := bytes.IndexByte(contents, '\n'); i >= 0 {
+		contents = contents[:i]
+	}
+	return bytes.TrimSuffix(contents, []byte("\r"))
+}
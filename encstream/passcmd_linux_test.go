@@ -0,0 +1,53 @@
+package encstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPassphraseCommand verifies that -passphrase-cmd and -pass-entry take
+// the first line printed by their command, and that a failing command, one
+// that prints nothing and more than one passphrase source are refused.
+func TestPassphraseCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-passcmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a stand-in for pass, which prints the entry it is shown with a second
+	// line, as entries with a login do.
+	script := "#!/bin/sh\n[ \"$1\" = show ] || exit 1\nprintf '%s\\nlogin: enc\\n' \"pw:$2\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "pass"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, test := range []struct {
+		p    prompts
+		want string
+	}{
+		{prompts{passphraseCmd: "echo hunter2"}, "hunter2"},
+		{prompts{passphraseCmd: "pass show backups/enc"}, "pw:backups/enc"},
+		{prompts{passEntry: "backups/my enc"}, "pw:backups/my enc"},
+	} {
+		got, err := test.p.readPassphraseSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Fatalf("read %q, wanted %q", got, test.want)
+		}
+	}
+
+	for _, p := range []prompts{{passphraseCmd: "false"}, {passphraseCmd: "pass list"}, {passphraseCmd: " "}, {passphraseCmd: "true"}} {
+		if _, err := p.readPassphraseSource(); err == nil {
+			t.Fatalf("%q did not fail", p.passphraseCmd)
+		}
+	}
+	p := prompts{passphraseFile: filepath.Join(dir, "pass"), passEntry: "backups/enc"}
+	if _, err := p.readPassphraseSource(); err != errPassphraseSources {
+		t.Fatal("expected errPassphraseSources, got", err)
+	}
+}
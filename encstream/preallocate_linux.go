@@ -0,0 +1,21 @@
+package encstream
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which reserves the blocks without
+// changing the size of the file.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk space for f, so that the file is
+// laid out contiguously and a full disk is reported before any work is done.
+// Filesystems that cannot preallocate are left to allocate as f is written.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package encstream
+
+import "os"
+
+// preallocate does nothing on this platform. Extending the file with ftruncate
+// instead would only make it sparse, which neither reserves the space nor
+// avoids fragmentation.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
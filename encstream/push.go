@@ -0,0 +1,213 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// enc push encrypts a file and copies the ciphertext to another machine over
+// ssh, for backup scripts that would otherwise encrypt to a temporary file and
+// then scp it. It runs the ssh command, so the user's ssh configuration,
+// agent and known hosts apply, and needs nothing on the remote end but a
+// POSIX shell.
+//
+// So that an interrupted push can simply be run again, the ciphertext is
+// staged in the user's cache directory, under a name derived from the input
+// file, its size and modification time, the recipients and the destination,
+// and only removed once it has been copied. A rerun reuses it as long as the
+// input has not changed, and appends to the path.part file that the last
+// attempt left on the remote end, after checking that it starts with the same
+// ciphertext. path.part is renamed to path once complete.
+
+// pushCompareSize is how much of an existing path.part is compared with the
+// staged ciphertext before resuming; it covers the header and its random
+// salt.
+const pushCompareSize = 1024
+
+var (
+	errPushDestination = errors.New("the destination must be of the form [user@]host:path")
+	errPushRemote      = errors.New("unexpected response from the remote end")
+)
+
+// parseDestination splits a destination of the form [user@]host:path. As with
+// scp, a relative path, or one starting with ~/, is in the remote home
+// directory.
+func parseDestination(dest string) (host string, path string, err error) {
+	host, path, ok := strings.Cut(dest, ":")
+	path = strings.TrimPrefix(path, "~/")
+	if !ok || host == "" || path == "" || strings.Contains(host, "/") {
+		return "", "", errPushDestination
+	}
+	return host, path, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// pushStagingName returns the file the ciphertext of input is staged in for a
+// push to dest, creating the staging directory if needed.
+func pushStagingName(input string, dest string, recipients []recipient) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "enc", "push")
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(input)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	h, _ := blake2b.New256(nil)
+	fmt.Fprintf(h, "%q %v %v %q", abs, info.Size(), info.ModTime().UnixNano(), dest)
+	for _, r := range recipients {
+		h.Write(r[:])
+	}
+	return filepath.Join(dir, hex.EncodeToString(h.Sum(nil)[:16])+".enc"), nil
+}
+
+// stage encrypts input to staged, unless a previous push left it there and,
+// if a passphrase is used, it decrypts with it.
+func stage(passphrase []byte, input string, staged string, opts encryptOptions) error {
+	if f, err := os.Open(staged); err == nil {
+		reusable := len(opts.recipients) > 0
+		if !reusable {
+			_, _, err = openCiphertext(newPassphraseKeys(passphrase), f)
+			reusable = err == nil
+		}
+		f.Close()
+		if reusable {
+			return nil
+		}
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return encryptFile(passphrase, f, staged, opts)
+}
+
+// remoteCommand returns the command that runs command on host with sshCmd.
+func remoteCommand(sshCmd []string, host string, command string) *exec.Cmd {
+	args := append(append([]string(nil), sshCmd[1:]...), host, command)
+	cmd := exec.Command(sshCmd[0], args...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// remotePartial returns the size and the first bytes of the partial upload on
+// host, or 0 if there is none.
+func remotePartial(sshCmd []string, host string, part string) (int64, []byte, error) {
+	q := shellQuote(part)
+	out, err := remoteCommand(sshCmd, host, fmt.Sprintf("if [ -f %v ]; then wc -c < %v && head -c %v %v; fi", q, q, pushCompareSize, q)).Output()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(out) == 0 {
+		return 0, nil, nil
+	}
+	line, prefix, ok := bytes.Cut(out, []byte("\n"))
+	if !ok {
+		return 0, nil, errPushRemote
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(line)), 10, 64)
+	if err != nil {
+		return 0, nil, errPushRemote
+	}
+	return size, prefix, nil
+}
+
+// upload copies the file staged to path on host, resuming a partial upload
+// of the same file.
+func upload(sshCmd []string, staged string, host string, path string) error {
+	f, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	part := path + ".part"
+	offset, prefix, err := remotePartial(sshCmd, host, part)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		local := make([]byte, len(prefix))
+		_, err = io.ReadFull(f, local)
+		if err != nil || offset > info.Size() || !bytes.Equal(local, prefix) {
+			offset = 0
+		}
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	redirect := ">>"
+	if offset == 0 {
+		redirect = ">"
+	}
+	cmd := remoteCommand(sshCmd, host, fmt.Sprintf("cat %v %v && mv %v %v", redirect, shellQuote(part), shellQuote(part), shellQuote(path)))
+	cmd.Stdin = f
+	return cmd.Run()
+}
+
+// pushFile encrypts input with passphrase or to opts.recipients and copies the
+// ciphertext to dest, [user@]host:path, over ssh, run as sshCmd. An input of
+// "-" is read from stdin, and cannot be resumed.
+func pushFile(passphrase []byte, input string, dest string, sshCmd []string, opts encryptOptions) error {
+	host, path, err := parseDestination(dest)
+	if err != nil {
+		return err
+	}
+	var staged string
+	if input == "-" {
+		var name [16]byte
+		_, err = rand.Read(name[:])
+		if err != nil {
+			return err
+		}
+		staged = filepath.Join(os.TempDir(), "enc-push-"+hex.EncodeToString(name[:])+".enc")
+		err = encrypt(passphrase, os.Stdin, staged, 0, opts)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(staged)
+	} else {
+		staged, err = pushStagingName(input, dest, opts.recipients)
+		if err != nil {
+			return err
+		}
+		err = stage(passphrase, input, staged, opts)
+		if err != nil {
+			return err
+		}
+	}
+	err = upload(sshCmd, staged, host, path)
+	if err != nil {
+		return err
+	}
+	return os.Remove(staged)
+}
@@ -0,0 +1,104 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestParseDestination verifies the destinations enc push accepts.
+func TestParseDestination(t *testing.T) {
+	for _, c := range []struct {
+		dest, host, path string
+		ok               bool
+	}{
+		{"backup@example.com:enc/docs.enc", "backup@example.com", "enc/docs.enc", true},
+		{"example.com:/srv/docs.enc", "example.com", "/srv/docs.enc", true},
+		{"example.com:~/docs.enc", "example.com", "docs.enc", true},
+		{"example.com:", "", "", false},
+		{"docs.enc", "", "", false},
+		{"./a:b", "", "", false},
+	} {
+		host, path, err := parseDestination(c.dest)
+		if (err == nil) != c.ok || host != c.host || path != c.path {
+			t.Fatalf("%v: got %q, %q, %v", c.dest, host, path, err)
+		}
+	}
+	if shellQuote("it's") != `'it'\''s'` {
+		t.Fatal("bad quoting:", shellQuote("it's"))
+	}
+}
+
+// TestPush verifies that enc push copies the ciphertext to the remote end,
+// resuming a partial upload of the same staged file and replacing any other.
+func TestPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	remote := filepath.Join(dir, "remote")
+	if err := os.Mkdir(remote, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// a stand-in for ssh that runs the command in the remote directory.
+	sshCmd := []string{"sh", "-c", `cd "$0" && exec sh -c "$2"`, remote}
+
+	plaintext := bytes.Repeat([]byte("push "), 50000)
+	input := filepath.Join(dir, "input")
+	if err := ioutil.WriteFile(input, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dest := "backup@example.com:docs.enc"
+	passphrase := []byte("pw")
+
+	for _, partial := range []func(staged []byte) []byte{
+		nil,
+		func(staged []byte) []byte { return staged[:len(staged)/2] },
+		func(staged []byte) []byte { return bytes.Repeat([]byte("x"), 5000) },
+	} {
+		os.Remove(filepath.Join(remote, "docs.enc"))
+		var staged []byte
+		if partial != nil {
+			name, err := pushStagingName(input, dest, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stage(passphrase, input, name, encryptOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			staged, err = ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(remote, "docs.enc.part"), partial(staged), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := pushFile(passphrase, input, dest, sshCmd, encryptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		pushed, err := ioutil.ReadFile(filepath.Join(remote, "docs.enc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if staged != nil && !bytes.Equal(pushed, staged) {
+			t.Fatal("the pushed file is not the staged ciphertext")
+		}
+		if _, err := os.Stat(filepath.Join(remote, "docs.enc.part")); !os.IsNotExist(err) {
+			t.Fatal("the partial upload was left behind")
+		}
+		decrypted, err := decryptToMemory(newPassphraseKeys(passphrase), bytes.NewReader(pushed))
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("the pushed file does not decrypt", err)
+		}
+	}
+	staging, _ := ioutil.ReadDir(filepath.Join(dir, "cache", "enc", "push"))
+	if len(staging) != 0 {
+		t.Fatal("the staged ciphertext was left behind")
+	}
+}
@@ -0,0 +1,106 @@
+package encstream
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"rsc.io/qr"
+)
+
+// Small secrets, such as recovery codes and keys, can be encrypted to a QR
+// code for transport on paper. The code holds the same text as `enc clip`
+// produces, so the text read back by any QR scanner can be decrypted with
+// `enc -d -qr`, or with `enc clip -d` if the scanner puts it on the
+// clipboard.
+
+// maxQRPlaintext is a conservative limit on the size of a plaintext that
+// still fits in a QR code once encrypted and encoded as text.
+const maxQRPlaintext = 1536
+
+// qrQuietZone is the width, in modules, of the blank border a QR code needs
+// around it to be scanned.
+const qrQuietZone = 4
+
+var errQRTooLarge = fmt.Errorf("input is too large for a QR code, which holds at most %v bytes", maxQRPlaintext)
+
+// encryptQR encrypts plaintext to a QR code, which is written as a PNG image
+// to finalOutput, or drawn on w if finalOutput is empty.
+func encryptQR(passphrase []byte, plaintext []byte, finalOutput string, w io.Writer) error {
+	if len(plaintext) > maxQRPlaintext {
+		return errQRTooLarge
+	}
+	text, err := encryptText(passphrase, plaintext)
+	if err != nil {
+		return err
+	}
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return err
+	}
+	if finalOutput == "" {
+		return drawQR(w, code)
+	}
+	output, err := createAtomic(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	_, err = output.Write(code.PNG())
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
+
+// drawQR draws code on a terminal, using half blocks so that every line of
+// text holds two rows of modules. The light modules are drawn, which suits
+// terminals with a dark background.
+func drawQR(w io.Writer, code *qr.Code) error {
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+	blocks := map[[2]bool]string{
+		{false, false}: " ",
+		{true, false}:  "▀",
+		{false, true}:  "▄",
+		{true, true}:   "█",
+	}
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		line := ""
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			line += blocks[[2]bool{light(x, y), light(x, y+1)}]
+		}
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptScanned decrypts the text scanned from a QR code, read from the
+// named file, to finalOutput.
+func decryptScanned(keys keySource, input string, finalOutput string) error {
+	text, err := ioutil.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptText(keys, string(text))
+	if err != nil {
+		return err
+	}
+	output, err := createPlaintext(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	_, err = output.Write(plaintext)
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
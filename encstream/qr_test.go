@@ -0,0 +1,36 @@
+package encstream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"rsc.io/qr"
+)
+
+// TestDrawQR verifies that a QR code is drawn two rows to a line, surrounded
+// by its quiet zone.
+func TestDrawQR(t *testing.T) {
+	code, err := qr.Encode("enc", qr.L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := drawQR(out, code); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	width := code.Size + 2*qrQuietZone
+	if len(lines) != (width+1)/2 {
+		t.Fatal("drew", len(lines), "lines, wanted", (width+1)/2)
+	}
+	for _, line := range lines {
+		if utf8.RuneCountInString(line) != width {
+			t.Fatal("drew a line of", utf8.RuneCountInString(line), "modules, wanted", width)
+		}
+	}
+	if lines[0] != strings.Repeat("█", width) {
+		t.Fatal("the quiet zone is not blank")
+	}
+}
@@ -0,0 +1,197 @@
+package encstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Byte ranges are decrypted by seeking to the chunk that holds the start of
+// the range and decrypting from there, rather than decrypting the whole file.
+// The MAC over the whole file is not checked, since that would mean reading it
+// all. Every chunk that is decrypted is authenticated by the AEAD, and in
+// version 4 files is bound to its place in the file, so the range cannot be
+// made of chunks moved from elsewhere, and a range up to the end of the file
+// fails if the file was cut short. Chunks of older and deduplicated files are
+// only authenticated one by one, so they may have been reordered or dropped,
+// and nothing outside the range is checked at all.
+
+var (
+	errRangeArchive = errors.New("archives cannot be decrypted by range")
+	errRangeBounds  = errors.New("the range starts beyond the end of the file")
+	errRangeOptions = errors.New("-range cannot be combined with -l, -qr, archive paths or gpg and openssl files")
+)
+
+// byteRange is a range of plaintext offsets, from start up to but not
+// including end. An end of -1 extends the range to the end of the file.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange parses a range written as start-end, where start and end are
+// sizes as accepted by parseSize. Either may be omitted, meaning the start or
+// the end of the file.
+func parseRange(s string) (byteRange, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return byteRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	r := byteRange{end: -1}
+	var err error
+	if start != "" {
+		r.start, err = parseSize(start)
+		if err != nil {
+			return byteRange{}, err
+		}
+	}
+	if end != "" {
+		r.end, err = parseSize(end)
+		if err != nil {
+			return byteRange{}, err
+		}
+		if r.end < r.start {
+			return byteRange{}, fmt.Errorf("invalid range %q: it ends before it starts", s)
+		}
+	}
+	return r, nil
+}
+
+// decryptRange decrypts the plaintext bytes in r from input to finalOutput,
+// warning if the file has expired by now. Only the chunks that overlap r are
+// read. A range that extends beyond the end of the file is cut short.
+func decryptRange(keys keySource, input io.ReadSeeker, finalOutput string, r byteRange, now time.Time) error {
+	_, err := input.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	header, err := readHeader(input)
+	if err != nil {
+		return err
+	}
+	if header.Flags&flagArchive != 0 {
+		return errRangeArchive
+	}
+	sk, macKey, err := keys.fileKeys(header)
+	if err != nil {
+		return err
+	}
+	err = header.checkHeader(macKey)
+	if err != nil {
+		return err
+	}
+	if header.expired(now) {
+		log.Println("warning: the file expired on", expiryString(header.NotAfter))
+	}
+	aead, err := suiteAEAD(header.Suite)(sk[:])
+	if err != nil {
+		return err
+	}
+
+	ciphertextOffset, err := input.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := input.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if header.Flags&flagTrailerMAC != 0 {
+		end -= int64(len(header.Tag))
+	}
+	end -= header.Reserved
+	chunkOffset, plaintextOffset, index, err := seekChunk(input, header, ciphertextOffset, end, aead.Overhead(), r.start)
+	if err != nil {
+		return err
+	}
+	_, err = input.Seek(chunkOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	opts := header.chunkOptionsAt(index)
+	if header.Flags&flagPadded != 0 {
+		// the padding of a padded file is not part of its plaintext.
+		length, err := openLength(sk, header.Length)
+		if err != nil {
+			return err
+		}
+		if r.start > length {
+			return errRangeBounds
+		}
+		opts = append(opts, WithLimit(length-plaintextOffset))
+	}
+	plaintext := NewReader(sk, io.LimitReader(input, end-chunkOffset), opts...)
+	_, err = io.CopyN(io.Discard, plaintext, r.start-plaintextOffset)
+	if err == io.EOF {
+		return errRangeBounds
+	}
+	if err != nil {
+		return err
+	}
+
+	output, err := createPlaintext(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	if r.end < 0 {
+		_, err = io.Copy(output, plaintext)
+	} else {
+		_, err = io.CopyN(output, plaintext, r.end-r.start)
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return output.commit()
+}
+
+// seekChunk finds the chunk of the ciphertext between ciphertextOffset and end
+// that holds the plaintext offset start. It returns the offset of the chunk in
+// input, the plaintext offset the chunk starts at and its index.
+//
+// The chunks of version 4 files hold maxChunkSize bytes of plaintext, except
+// for the last one, so the chunk is found directly. Older files were written
+// a chunk per Write when Writes were small, and deduplicated files have
+// chunks of varying sizes, so their chunk headers are read one after another
+// until the chunk is found.
+func seekChunk(input io.ReadSeeker, header fileHeader, ciphertextOffset, end int64, overhead int, start int64) (chunkOffset, plaintextOffset int64, index uint64, err error) {
+	if header.indexedChunks() {
+		frame := int64(24 + 8 + maxChunkSize + overhead)
+		index := start / maxChunkSize
+		chunkOffset = ciphertextOffset + index*frame
+		if chunkOffset > end {
+			return 0, 0, 0, errRangeBounds
+		}
+		return chunkOffset, index * maxChunkSize, uint64(index), nil
+	}
+	var frame [32]byte
+	chunkOffset = ciphertextOffset
+	for chunkOffset < end {
+		_, err = input.Seek(chunkOffset, io.SeekStart)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		_, err = io.ReadFull(input, frame[:])
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size := binary.LittleEndian.Uint64(frame[24:])
+		if size < uint64(overhead) || size > uint64(maxChunkSize+overhead) {
+			return 0, 0, 0, errors.New("invalid chunk size")
+		}
+		n := int64(size) - int64(overhead)
+		if start < plaintextOffset+n {
+			return chunkOffset, plaintextOffset, index, nil
+		}
+		plaintextOffset += n
+		chunkOffset += int64(len(frame)) + int64(size)
+		index++
+	}
+	if start > plaintextOffset {
+		return 0, 0, 0, errRangeBounds
+	}
+	return chunkOffset, plaintextOffset, index, nil
+}
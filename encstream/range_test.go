@@ -0,0 +1,169 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDecryptRange verifies that byte ranges of fixed and content-defined
+// chunked files decrypt to the same bytes as the whole file, and that a
+// tampered chunk in the range is detected.
+func TestDecryptRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, maxChunkSize*8+100)
+	io.ReadFull(rand.Reader, plaintext)
+	size := int64(len(plaintext))
+
+	for _, opts := range []encryptOptions{{}, {dedup: true}} {
+		opts.recipients = []recipient{id.public}
+		stream := new(bytes.Buffer)
+		_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), streamOutput{stream}, 0, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext := stream.Bytes()
+
+		out := filepath.Join(dir, "slice")
+		for _, r := range []byteRange{
+			{0, -1},
+			{0, 10},
+			{maxChunkSize - 1, maxChunkSize + 1},
+			{3*maxChunkSize + 17, 5*maxChunkSize + 3},
+			{size - 50, size + 50},
+			{size, -1},
+		} {
+			err = decryptRange(identityKeys{id}, bytes.NewReader(ciphertext), out, r, time.Now())
+			if err != nil {
+				t.Fatal(r, err)
+			}
+			got, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := r.end
+			if end < 0 || end > size {
+				end = size
+			}
+			if !bytes.Equal(got, plaintext[r.start:end]) {
+				t.Fatal("range", r, "decrypted to different bytes")
+			}
+		}
+		err = decryptRange(identityKeys{id}, bytes.NewReader(ciphertext), out, byteRange{size + 1, -1}, time.Now())
+		if err != errRangeBounds {
+			t.Fatal("expected errRangeBounds, got", err)
+		}
+
+		// tampering with the last chunk is only noticed by ranges that
+		// include it.
+		tampered := append([]byte{}, ciphertext...)
+		tampered[len(tampered)-len(fileHeader{}.Tag)-1] ^= 1
+		if err := decryptRange(identityKeys{id}, bytes.NewReader(tampered), out, byteRange{0, 10}, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := decryptRange(identityKeys{id}, bytes.NewReader(tampered), out, byteRange{size - 10, -1}, time.Now()); err == nil {
+			t.Fatal("a tampered chunk was decrypted")
+		}
+	}
+}
+
+// TestRangeSmallWrites verifies that ranges of a version 3 file, whose
+// chunks were written one per small Write and so are not full, decrypt to
+// the right bytes.
+func TestRangeSmallWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := new(bytes.Buffer)
+	_, _, _, err = encryptTo(nil, bytes.NewReader(nil), streamOutput{stream}, 0, encryptOptions{recipients: []recipient{id.public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, macKey, err := identityKeys{id}.fileKeys(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Version = 3
+	if err := header.sealHeader(macKey); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := bytes.NewBuffer(header.encode())
+	plaintext := make([]byte, 48000)
+	io.ReadFull(rand.Reader, plaintext)
+	w := NewWriter(sk, ciphertext, header.chunkOptions()...)
+	for i := 0; i < len(plaintext); i += 1000 {
+		if _, err := w.Write(plaintext[i : i+1000]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if header.Flags&flagTrailerMAC != 0 {
+		ciphertext.Write(header.Tag[:])
+	}
+
+	out := filepath.Join(dir, "slice")
+	for _, r := range []byteRange{{0, -1}, {999, 1001}, {maxChunkSize + 10, 2 * maxChunkSize}, {47990, -1}} {
+		err = decryptRange(identityKeys{id}, bytes.NewReader(ciphertext.Bytes()), out, r, time.Now())
+		if err != nil {
+			t.Fatal(r, err)
+		}
+		got, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := r.end
+		if end < 0 {
+			end = int64(len(plaintext))
+		}
+		if !bytes.Equal(got, plaintext[r.start:end]) {
+			t.Fatal("range", r, "decrypted to different bytes")
+		}
+	}
+}
+
+// TestParseRange verifies the range syntax of -range.
+func TestParseRange(t *testing.T) {
+	for s, want := range map[string]byteRange{
+		"100G-101G": {100 << 30, 101 << 30},
+		"10-":       {10, -1},
+		"-1K":       {0, 1 << 10},
+	} {
+		r, err := parseRange(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != want {
+			t.Fatal(s, "parsed as", r, "wanted", want)
+		}
+	}
+	for _, s := range []string{"", "10", "2-1", "a-b"} {
+		if _, err := parseRange(s); err == nil {
+			t.Fatal("invalid range was accepted:", s)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package encstream
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Raw files have no header, so that nothing in them identifies enc or
+// encryption at all:
+//
+//	salt (32 bytes) | chunk | chunk | ... | last chunk
+//
+// Every chunk but the last seals maxChunkSize bytes of plaintext with
+// XChaCha20-Poly1305, and the last seals the rest, which may be nothing. The
+// nonce of a chunk is its index and whether it is the last, so chunks cannot
+// be reordered, dropped or truncated, and nothing but the ciphertext itself
+// is stored. The key is derived from the passphrase and the salt with
+// Argon2id, with parameters that are not recorded either: decryption must be
+// given the same -raw-kdf as encryption.
+//
+// Without a header there is nothing to authenticate but the chunks, so
+// decryption opens them all before writing any plaintext, and then opens
+// them again as it writes it. Raw files hold a single file encrypted with a
+// passphrase, without any of the options recorded in the header.
+
+// rawChunkSize is the size of a sealed full chunk of a raw file.
+const rawChunkSize = maxChunkSize + chacha20poly1305.Overhead
+
+var (
+	errRawParams  = errors.New("-raw-kdf must be passes, memory and lanes, e.g. 4,4G,4")
+	errRawOptions = errors.New("-raw files hold a single file encrypted with a passphrase, and cannot be combined with options recorded in the header, armor, volumes, recovery records, -fips, -qr or -i")
+	errRawMemory  = errors.New("the KDF memory of -raw-kdf does not fit in -max-memory; encrypt with less memory in -raw-kdf, and decrypt with the same -raw-kdf")
+)
+
+// rawParams are the Argon2id parameters of a raw file.
+type rawParams struct {
+	time   uint32
+	memory uint32 // KiB
+	lanes  uint8
+}
+
+// defaultRawParams returns the parameters raw files are encrypted with
+// unless -raw-kdf is given. Unlike the header's, they do not depend on the
+// machine.
+func defaultRawParams() rawParams {
+	return rawParams{time: defaultArgonTime, memory: defaultArgonMemory, lanes: 4}
+}
+
+// parseRawParams parses -raw-kdf: the passes, the memory as a size and the
+// lanes, separated by commas.
+func parseRawParams(s string) (rawParams, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return rawParams{}, errRawParams
+	}
+	time, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil || time == 0 {
+		return rawParams{}, errRawParams
+	}
+	memory, err := parseSize(fields[1])
+	if err != nil || memory>>10 == 0 || memory>>10 > 1<<32-1 {
+		return rawParams{}, errRawParams
+	}
+	lanes, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil || lanes == 0 || uint64(memory>>10) < 8*lanes {
+		return rawParams{}, errRawParams
+	}
+	return rawParams{time: uint32(time), memory: uint32(memory >> 10), lanes: uint8(lanes)}, nil
+}
+
+func (p rawParams) String() string {
+	return fmt.Sprintf("%v,%vK,%v", p.time, p.memory, p.lanes)
+}
+
+// header returns the header a raw file with salt would have, for deriving
+// its key.
+func (p rawParams) header(salt [32]byte) fileHeader {
+	return fileHeader{
+		Version:     fileVersion,
+		Salt:        salt,
+		ArgonTime:   p.time,
+		ArgonMemory: p.memory,
+		ArgonLanes:  uint32(p.lanes),
+	}
+}
+
+// allow returns l raised to allow deriving the key of a raw file with p,
+// which comes from the user rather than an untrusted header.
+func (p rawParams) allow(l resourceLimits) resourceLimits {
+	if p.memory > l.maxArgonMemory {
+		l.maxArgonMemory = p.memory
+	}
+	if p.time > l.maxArgonTime {
+		l.maxArgonTime = p.time
+	}
+	if uint32(p.lanes) > l.maxArgonLanes {
+		l.maxArgonLanes = uint32(p.lanes)
+	}
+	return l
+}
+
+// rawNonce returns the nonce of chunk i of a raw file.
+func rawNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	binary.LittleEndian.PutUint64(nonce, i)
+	if last {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// encryptRaw encrypts the plaintext read from input with passphrase to a raw
+// file written to output, with a salt read from random, and commits it.
+// Since params are not recorded, they cannot be lowered to fit the memory
+// budget like those of a header, so params that do not fit are refused.
+func encryptRaw(passphrase []byte, input io.Reader, output encryptOutput, params rawParams, random io.Reader) error {
+	defer output.abort()
+	if params.memory > kdfMemoryBudget() {
+		return errRawMemory
+	}
+	var salt [32]byte
+	err := readRandom(random, salt[:])
+	if err != nil {
+		return err
+	}
+	// params come from the user, so the limits on the KDF of untrusted
+	// headers do not apply.
+	sk, _, err := newPassphraseKeys(passphrase).kdfKeys(params.header(salt))
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(sk[:])
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(salt[:])
+	if err != nil {
+		return err
+	}
+
+	// a full chunk is only sealed once the next byte is read, since the
+	// last chunk is sealed differently.
+	buf := make([]byte, maxChunkSize+1)
+	sealed := make([]byte, 0, rawChunkSize)
+	n, err := io.ReadFull(input, buf)
+	for i := uint64(0); ; i++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n <= maxChunkSize {
+			_, err = output.Write(aead.Seal(sealed[:0], rawNonce(i, true), buf[:n], nil))
+			if err != nil {
+				return err
+			}
+			return output.commit()
+		}
+		_, err = output.Write(aead.Seal(sealed[:0], rawNonce(i, false), buf[:maxChunkSize], nil))
+		if err != nil {
+			return err
+		}
+		buf[0] = buf[maxChunkSize]
+		n, err = io.ReadFull(input, buf[1:])
+		n++
+	}
+}
+
+// openRawKey reads the salt of the raw file read from input and derives its
+// key with keys and params.
+func openRawKey(keys keySource, input io.ReadSeeker, params rawParams) (cipher.AEAD, error) {
+	_, err := input.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var salt [32]byte
+	_, err = io.ReadFull(input, salt[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errBadMAC
+	}
+	if err != nil {
+		return nil, err
+	}
+	sk, _, err := keys.fileKeys(params.header(salt))
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(sk[:])
+}
+
+// openRawChunks opens each chunk of the raw file read from input with aead,
+// passing its plaintext to f. A wrong passphrase or a modified file fails
+// with errBadMAC.
+func openRawChunks(aead cipher.AEAD, input io.ReadSeeker, f func(plaintext []byte) error) error {
+	size, err := input.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = input.Seek(32, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	remaining := size - 32
+	if remaining < chacha20poly1305.Overhead {
+		return errBadMAC
+	}
+	chunk := make([]byte, rawChunkSize)
+	opened := make([]byte, 0, maxChunkSize)
+	for i := uint64(0); remaining > 0; i++ {
+		n := int64(rawChunkSize)
+		if remaining < n {
+			n = remaining
+		}
+		remaining -= n
+		_, err = io.ReadFull(input, chunk[:n])
+		if err != nil {
+			return err
+		}
+		plaintext, err := aead.Open(opened[:0], rawNonce(i, remaining == 0), chunk[:n], nil)
+		if err != nil {
+			return errBadMAC
+		}
+		err = f(plaintext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptRaw decrypts the raw file read from input with keys and params to
+// finalOutput, once all of it has been authenticated.
+func decryptRaw(keys keySource, input io.ReadSeeker, finalOutput string, params rawParams) error {
+	aead, err := openRawKey(keys, input, params)
+	if err != nil {
+		return err
+	}
+	err = openRawChunks(aead, input, func([]byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	output, err := createPlaintext(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	err = openRawChunks(aead, input, func(plaintext []byte) error {
+		_, err := output.Write(plaintext)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
@@ -0,0 +1,107 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"runtime/debug"
+	"testing"
+)
+
+// TestRawFile verifies that raw files decrypt with the passphrase and
+// parameters they were encrypted with, hold nothing but the salt and the
+// sealed chunks, and cannot be truncated or modified.
+func TestRawFile(t *testing.T) {
+	passphrase := []byte("hunter2")
+	params := defaultRawParams()
+	if params.memory > kdfMemoryBudget() {
+		params.memory = kdfMemoryBudget()
+	}
+	decrypt := func(keys keySource, ciphertext []byte, params rawParams) ([]byte, error) {
+		var decrypted []byte
+		input := bytes.NewReader(ciphertext)
+		aead, err := openRawKey(keys, input, params)
+		if err != nil {
+			return nil, err
+		}
+		err = openRawChunks(aead, input, func(plaintext []byte) error {
+			decrypted = append(decrypted, plaintext...)
+			return nil
+		})
+		return decrypted, err
+	}
+
+	for _, size := range []int{0, 1, maxChunkSize - 1, maxChunkSize, maxChunkSize + 1, 3 * maxChunkSize} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		output := new(memoryOutput)
+		err := encryptRaw(passphrase, bytes.NewReader(plaintext), output, params, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := size/maxChunkSize + 1
+		if size > 0 && size%maxChunkSize == 0 {
+			chunks--
+		}
+		if expected := 32 + size + chunks*16; len(output.buf) != expected {
+			t.Fatalf("a raw file of %v bytes is %v bytes, expected %v", size, len(output.buf), expected)
+		}
+		decrypted, err := decrypt(newPassphraseKeys(passphrase), output.buf, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext")
+		}
+
+		if _, err := decrypt(newPassphraseKeys([]byte("hunter3")), output.buf, params); err != errBadMAC {
+			t.Fatal("expected errBadMAC for a wrong passphrase, got", err)
+		}
+		other := params
+		other.time++
+		if _, err := decrypt(newPassphraseKeys(passphrase), output.buf, other); err != errBadMAC {
+			t.Fatal("expected errBadMAC for the wrong parameters, got", err)
+		}
+		modified := append([]byte{}, output.buf...)
+		modified[len(modified)-1] ^= 1
+		if _, err := decrypt(newPassphraseKeys(passphrase), modified, params); err != errBadMAC {
+			t.Fatal("expected errBadMAC for a modified file, got", err)
+		}
+		if size > maxChunkSize {
+			truncated := output.buf[:32+rawChunkSize]
+			if _, err := decrypt(newPassphraseKeys(passphrase), truncated, params); err != errBadMAC {
+				t.Fatal("expected errBadMAC for a truncated file, got", err)
+			}
+		}
+	}
+
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+	if err := setMemoryBudget(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+	err := encryptRaw(passphrase, bytes.NewReader(nil), new(memoryOutput), defaultRawParams(), rand.Reader)
+	if err != errRawMemory {
+		t.Fatal("expected errRawMemory for parameters over the budget, got", err)
+	}
+}
+
+// TestRawParams verifies the parsing of -raw-kdf.
+func TestRawParams(t *testing.T) {
+	p, err := parseRawParams("3,1G,8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != (rawParams{time: 3, memory: 1 << 20, lanes: 8}) {
+		t.Fatal("wrong parameters", p)
+	}
+	again, err := parseRawParams(p.String())
+	if err != nil || again != p {
+		t.Fatal("the parameters do not parse back", p, err)
+	}
+	for _, s := range []string{"", "3,1G", "0,1G,8", "3,512,8", "3,1G,0", "3,1G,256", "3,1G,8,1"} {
+		if _, err := parseRawParams(s); err != errRawParams {
+			t.Fatalf("%q: expected errRawParams, got %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Recovery records protect an encrypted file against damage on unreliable
+// media. The file is divided into blocks, and each group of blocks gets
+// Reed-Solomon parity blocks along with a checksum of every data and parity
+// block. The checksums locate the damaged blocks, which can be reconstructed
+// from the rest of their group as long as no more blocks were damaged than the
+// group has parity blocks.
+//
+// For every group, the parity blocks and then the checksums are appended to
+// the encrypted file, followed by a fixed-size trailer that records where the
+// encrypted file ends. Decryption ignores everything after that point.
+
+const (
+	recoveryBlockSize    = 4096
+	recoveryGroupSize    = 200 // data blocks per group
+	recoveryChecksumSize = 16
+	maxRecoveryPercent   = 25
+)
+
+var recoveryMagic = [8]byte{'e', 'n', 'c', 'r', 'e', 'c', 'v', '1'}
+
+// recoveryTrailer ends a file with recovery records.
+type recoveryTrailer struct {
+	Magic        [8]byte
+	BlockSize    uint32
+	DataShards   uint16
+	ParityShards uint16
+	DataLength   uint64
+	Checksum     [recoveryChecksumSize]byte // of the fields above
+}
+
+var (
+	errRecoveryPercent  = fmt.Errorf("recovery must be more than 0%% and at most %v%%", maxRecoveryPercent)
+	errRecoveryVolumes  = errors.New("recovery records cannot be added to volumes")
+	errNoRecovery       = errors.New("file has no recovery records, or its recovery trailer is damaged")
+	errTooMuchDamage    = errors.New("too many damaged blocks to repair")
+	recoveryTrailerSize = int64(binary.Size(recoveryTrailer{}))
+)
+
+// checksum returns the checksum of the other fields of the trailer.
+func (t recoveryTrailer) checksum() [recoveryChecksumSize]byte {
+	buf := new(bytes.Buffer)
+	t.Checksum = [recoveryChecksumSize]byte{}
+	binary.Write(buf, binary.LittleEndian, t)
+	return blockChecksum(buf.Bytes()[:buf.Len()-recoveryChecksumSize])
+}
+
+// blockChecksum returns the BLAKE2b-128 digest of b.
+func blockChecksum(b []byte) [recoveryChecksumSize]byte {
+	hash, err := blake2b.New(recoveryChecksumSize, nil)
+	if err != nil {
+		panic(err)
+	}
+	hash.Write(b)
+	var sum [recoveryChecksumSize]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// groups returns the number of groups the protected data is divided into.
+func (t recoveryTrailer) groups() int64 {
+	blocks := (int64(t.DataLength) + int64(t.BlockSize) - 1) / int64(t.BlockSize)
+	return (blocks + int64(t.DataShards) - 1) / int64(t.DataShards)
+}
+
+// sectionSize returns the size of the recovery records of a single group.
+func (t recoveryTrailer) sectionSize() int64 {
+	return int64(t.ParityShards)*int64(t.BlockSize) + int64(t.DataShards+t.ParityShards)*recoveryChecksumSize
+}
+
+// newRecoveryTrailer chooses the group layout for protecting dataLength bytes
+// with parity amounting to percent of the data.
+func newRecoveryTrailer(dataLength int64, percent float64) (recoveryTrailer, error) {
+	if percent <= 0 || percent > maxRecoveryPercent {
+		return recoveryTrailer{}, errRecoveryPercent
+	}
+	dataShards := int64(recoveryGroupSize)
+	if blocks := (dataLength + recoveryBlockSize - 1) / recoveryBlockSize; blocks < dataShards {
+		dataShards = blocks
+	}
+	if dataShards == 0 {
+		dataShards = 1
+	}
+	t := recoveryTrailer{
+		Magic:        recoveryMagic,
+		BlockSize:    recoveryBlockSize,
+		DataShards:   uint16(dataShards),
+		ParityShards: uint16(math.Ceil(float64(dataShards) * percent / 100)),
+		DataLength:   uint64(dataLength),
+	}
+	t.Checksum = t.checksum()
+	return t, nil
+}
+
+// readRecoveryTrailer reads the recovery trailer from the end of r, which is
+// size bytes long.
+func readRecoveryTrailer(r io.ReaderAt, size int64) (recoveryTrailer, error) {
+	if size < recoveryTrailerSize {
+		return recoveryTrailer{}, errNoRecovery
+	}
+	var t recoveryTrailer
+	err := binary.Read(io.NewSectionReader(r, size-recoveryTrailerSize, recoveryTrailerSize), binary.LittleEndian, &t)
+	if err != nil {
+		return recoveryTrailer{}, err
+	}
+	if t.Magic != recoveryMagic || t.Checksum != t.checksum() || t.BlockSize == 0 || t.DataShards == 0 || t.ParityShards == 0 {
+		return recoveryTrailer{}, errNoRecovery
+	}
+	if int64(t.DataLength)+t.groups()*t.sectionSize()+recoveryTrailerSize != size {
+		return recoveryTrailer{}, errNoRecovery
+	}
+	return t, nil
+}
+
+// readGroup reads the data blocks of group g from data, padding the last
+// group with zeros.
+func (t recoveryTrailer) readGroup(data io.ReaderAt, g int64) ([][]byte, error) {
+	shards := make([][]byte, t.DataShards+t.ParityShards)
+	for i := range shards[:t.DataShards] {
+		shards[i] = make([]byte, t.BlockSize)
+		off := (g*int64(t.DataShards) + int64(i)) * int64(t.BlockSize)
+		if off >= int64(t.DataLength) {
+			continue
+		}
+		n := int64(t.BlockSize)
+		if off+n > int64(t.DataLength) {
+			n = int64(t.DataLength) - off
+		}
+		_, err := data.ReadAt(shards[i][:n], off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+// writeRecovery writes the recovery records of data, laid out as described by
+// t, to w.
+func writeRecovery(data io.ReaderAt, t recoveryTrailer, w io.Writer) error {
+	rs, err := reedsolomon.New(int(t.DataShards), int(t.ParityShards))
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for g := int64(0); g < t.groups(); g++ {
+		shards, err := t.readGroup(data, g)
+		if err != nil {
+			return err
+		}
+		for i := t.DataShards; i < t.DataShards+t.ParityShards; i++ {
+			shards[i] = make([]byte, t.BlockSize)
+		}
+		err = rs.Encode(shards)
+		if err != nil {
+			return err
+		}
+		for _, parity := range shards[t.DataShards:] {
+			bw.Write(parity)
+		}
+		for _, shard := range shards {
+			sum := blockChecksum(shard)
+			bw.Write(sum[:])
+		}
+	}
+	err = binary.Write(bw, binary.LittleEndian, t)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// addRecovery appends recovery records to output, which must not be split
+// into volumes.
+func addRecovery(output encryptOutput, percent float64) error {
+	data, ok := output.(io.ReaderAt)
+	if !ok {
+		return errRecoveryVolumes
+	}
+	dataLength, err := output.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	t, err := newRecoveryTrailer(dataLength, percent)
+	if err != nil {
+		return err
+	}
+	return writeRecovery(data, t, output)
+}
+
+// withoutRecovery returns a view of f that excludes any recovery records.
+func withoutRecovery(f *os.File) (io.ReadSeekCloser, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t, err := readRecoveryTrailer(f, stat.Size())
+	if err != nil {
+		return f, nil
+	}
+	return struct {
+		*io.SectionReader
+		io.Closer
+	}{io.NewSectionReader(f, 0, int64(t.DataLength)), f}, nil
+}
+
+// repairFile reconstructs the damaged blocks of the file at input using its
+// recovery records, writing the repaired file, with fresh recovery records, to
+// finalOutput. It returns the number of damaged data blocks that were
+// repaired.
+func repairFile(input string, finalOutput string) (int, error) {
+	in, err := os.Open(input)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	t, err := readRecoveryTrailer(in, stat.Size())
+	if err != nil {
+		return 0, err
+	}
+	rs, err := reedsolomon.New(int(t.DataShards), int(t.ParityShards))
+	if err != nil {
+		return 0, err
+	}
+
+	output, err := createAtomic(finalOutput)
+	if err != nil {
+		return 0, err
+	}
+	defer output.abort()
+	repaired := 0
+	for g := int64(0); g < t.groups(); g++ {
+		shards, err := t.readGroup(in, g)
+		if err != nil {
+			return 0, err
+		}
+		section := io.NewSectionReader(in, int64(t.DataLength)+g*t.sectionSize(), t.sectionSize())
+		for i := t.DataShards; i < t.DataShards+t.ParityShards; i++ {
+			shards[i] = make([]byte, t.BlockSize)
+			_, err = io.ReadFull(section, shards[i])
+			if err != nil {
+				return 0, err
+			}
+		}
+		var damaged []int
+		for i := range shards {
+			var sum [recoveryChecksumSize]byte
+			_, err = io.ReadFull(section, sum[:])
+			if err != nil {
+				return 0, err
+			}
+			if blockChecksum(shards[i]) != sum {
+				damaged = append(damaged, i)
+				shards[i] = nil
+			}
+		}
+		if len(damaged) > int(t.ParityShards) {
+			return 0, fmt.Errorf("%v: %v damaged blocks in group %v, at most %v can be repaired", errTooMuchDamage, len(damaged), g, t.ParityShards)
+		}
+		if len(damaged) > 0 {
+			err = rs.ReconstructData(shards)
+			if err != nil {
+				return 0, err
+			}
+			for _, i := range damaged {
+				if i < int(t.DataShards) {
+					repaired++
+				}
+			}
+		}
+
+		remaining := int64(t.DataLength) - g*int64(t.DataShards)*int64(t.BlockSize)
+		for _, shard := range shards[:t.DataShards] {
+			if remaining <= 0 {
+				break
+			}
+			if remaining < int64(len(shard)) {
+				shard = shard[:remaining]
+			}
+			_, err = output.Write(shard)
+			if err != nil {
+				return 0, err
+			}
+			remaining -= int64(len(shard))
+		}
+	}
+	err = writeRecovery(output, t, output)
+	if err != nil {
+		return 0, err
+	}
+	return repaired, output.commit()
+}
+
+// hasRecovery reports whether the named file has recovery records.
+func hasRecovery(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	_, err = readRecoveryTrailer(f, stat.Size())
+	return err == nil
+}
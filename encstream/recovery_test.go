@@ -0,0 +1,93 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRecovery verifies that recovery records are skipped when reading, that
+// damaged blocks are repaired, and that too much damage is reported.
+func TestRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "out.enc")
+
+	// three groups, the last one partial.
+	data := make([]byte, recoveryBlockSize*recoveryGroupSize*5/2+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	output, err := createAtomic(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := output.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := addRecovery(output, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.commit(); err != nil {
+		t.Fatal(err)
+	}
+	protected, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openEncrypted(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("recovery records were not skipped")
+	}
+
+	// damage four blocks, the most a group of 200 blocks at 2% can repair,
+	// including a parity block and the partial last block.
+	damaged := append([]byte(nil), protected...)
+	for _, off := range []int{0, recoveryBlockSize * 3, len(data) - 50, len(data) + 10} {
+		damaged[off] ^= 1
+	}
+	damaged[recoveryBlockSize*recoveryGroupSize+1] ^= 1
+	if err := ioutil.WriteFile(name, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	repairedName := filepath.Join(dir, "repaired.enc")
+	repaired, err := repairFile(name, repairedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 4 {
+		t.Fatal("repaired", repaired, "data blocks, wanted 4")
+	}
+	read, err = ioutil.ReadFile(repairedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, protected) {
+		t.Fatal("repaired file does not match the original")
+	}
+
+	for i := 0; i < 5; i++ {
+		damaged[recoveryBlockSize*i+1] ^= 1
+	}
+	if err := ioutil.WriteFile(name, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repairFile(name, repairedName); err == nil {
+		t.Fatal("too much damage was not reported")
+	}
+}
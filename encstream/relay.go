@@ -0,0 +1,271 @@
+package encstream
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transfer codes let two people move a file with enc send and enc receive
+// when neither can reach the other directly. Both connect to a relay, enc
+// relay, which pairs them by a channel number and then copies bytes between
+// them. The sender is given a code such as 7-canyon-lemon, the channel and
+// two words to be read out to the receiver, who types it in. Both ends run a
+// PAKE with the words (see pake.go) and send the file under the agreed key as
+// with enc send -to (see transfer.go), so the relay sees nothing but
+// ciphertext, and an attacker gets a single guess at the words per transfer.
+//
+// The relay protocol is a line from each client, "enc relay 1 send" or "enc
+// relay 1 receive N", answered with "channel N" to the sender, then "paired"
+// to both once the receiver arrives, or "error ..." to either.
+
+const (
+	relayHello        = "enc relay 1"
+	relayWait         = 30 * time.Minute
+	transferCodeWords = 2
+)
+
+var (
+	errRelayProtocol = errors.New("unexpected response from the relay")
+	errTransferCode  = errors.New("malformed transfer code")
+	errWrongCode     = errors.New("the other end typed a different code")
+)
+
+// relay pairs senders and receivers.
+type relay struct {
+	mu      sync.Mutex
+	waiting map[string]net.Conn // senders by channel
+}
+
+func newRelay() *relay {
+	return &relay{waiting: make(map[string]net.Conn)}
+}
+
+// serve pairs the clients that connect to l until it fails.
+func (r *relay) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+// handle reads the request of a client and pairs it.
+func (r *relay) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	line, err := readLine(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, relayHello))
+	switch {
+	case !strings.HasPrefix(line, relayHello) || len(fields) == 0:
+		fmt.Fprintln(conn, "error unknown request")
+		conn.Close()
+	case fields[0] == "send" && len(fields) == 1:
+		channel, err := r.allocate(conn)
+		if err != nil {
+			fmt.Fprintln(conn, "error", err)
+			conn.Close()
+			return
+		}
+		fmt.Fprintln(conn, "channel", channel)
+		time.AfterFunc(relayWait, func() {
+			if r.take(channel) != nil {
+				fmt.Fprintln(conn, "error no receiver arrived")
+				conn.Close()
+			}
+		})
+	case fields[0] == "receive" && len(fields) == 2:
+		sender := r.take(fields[1])
+		if sender == nil {
+			fmt.Fprintln(conn, "error no sender on channel", fields[1])
+			conn.Close()
+			return
+		}
+		fmt.Fprintln(sender, "paired")
+		fmt.Fprintln(conn, "paired")
+		splice(sender, conn)
+	default:
+		fmt.Fprintln(conn, "error unknown request")
+		conn.Close()
+	}
+}
+
+// allocate assigns a free channel to the sender conn. Channels are short
+// random numbers, drawn from a larger range as more senders wait.
+func (r *relay) allocate(conn net.Conn) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limit := int64(100)
+	for int64(len(r.waiting)) >= limit/2 {
+		limit *= 10
+	}
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(limit-1))
+		if err != nil {
+			return "", err
+		}
+		channel := fmt.Sprint(n.Int64() + 1)
+		if _, ok := r.waiting[channel]; !ok {
+			r.waiting[channel] = conn
+			return channel, nil
+		}
+	}
+}
+
+// take removes and returns the sender waiting on channel, if any, so that
+// every channel is used once.
+func (r *relay) take(channel string) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn := r.waiting[channel]
+	delete(r.waiting, channel)
+	return conn
+}
+
+// splice copies between a and b until both directions are done, passing on
+// half-closes, and then closes them.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// readLine reads a line from r a byte at a time, so that nothing after it is
+// consumed.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	var b [1]byte
+	for len(line) < 256 {
+		_, err := io.ReadFull(r, b[:])
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errRelayProtocol
+}
+
+// readRelayResponse reads a response from the relay, which must start with
+// want, and returns the rest of it.
+func readRelayResponse(conn net.Conn, want string) (string, error) {
+	line, err := readLine(conn)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "error ") {
+		return "", fmt.Errorf("relay: %v", strings.TrimPrefix(line, "error "))
+	}
+	if !strings.HasPrefix(line, want) {
+		return "", errRelayProtocol
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, want)), nil
+}
+
+// transferKey is the keySource of a file sent under a key agreed with a
+// PAKE, as a subkey of it.
+type transferKey [32]byte
+
+func (k transferKey) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if len(header.Recipients) > 0 || header.Subkey == ([32]byte{}) {
+		return sk, macKey, errTransferHeader
+	}
+	return subkeys(k, header.Subkey)
+}
+
+// transferSessionID binds the PAKE to the relay channel.
+func transferSessionID(channel string) []byte {
+	return []byte("enc transfer code " + channel)
+}
+
+// relaySend sends input through the relay at addr, calling showCode with the
+// code for the receiver once the relay has assigned a channel.
+func relaySend(addr string, input io.Reader, showCode func(code string)) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, relayHello, "send")
+	channel, err := readRelayResponse(conn, "channel ")
+	if err != nil {
+		return err
+	}
+	words, _, err := generateWords(rand.Reader, transferCodeWords, "-")
+	if err != nil {
+		return err
+	}
+	showCode(channel + "-" + words)
+	if _, err := readRelayResponse(conn, "paired"); err != nil {
+		return err
+	}
+
+	key, err := pakeSession(conn, []byte(words), transferSessionID(channel), true, rand.Reader)
+	if err != nil {
+		return err
+	}
+	header, err := newHeader()
+	if err != nil {
+		return err
+	}
+	err = sendFile(conn, nil, input, encryptOptions{shared: &sharedKey{header: header, key: key}})
+	if err == errTransferConfirm {
+		return errWrongCode
+	}
+	return err
+}
+
+// relayReceive receives the file sent with code through the relay at addr,
+// decrypting it to finalOutput.
+func relayReceive(addr string, code string, finalOutput string) error {
+	channel, words, ok := strings.Cut(strings.ToLower(strings.TrimSpace(code)), "-")
+	if !ok || channel == "" || words == "" {
+		return errTransferCode
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, relayHello, "receive", channel)
+	if _, err := readRelayResponse(conn, "paired"); err != nil {
+		return err
+	}
+
+	key, err := pakeSession(conn, []byte(words), transferSessionID(channel), false, rand.Reader)
+	if err != nil {
+		return err
+	}
+	err = receiveFile(conn, transferKey(key), finalOutput)
+	if err == errTransferRejected {
+		return errWrongCode
+	}
+	return err
+}
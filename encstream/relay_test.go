@@ -0,0 +1,156 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/edwards25519/field"
+)
+
+// tcpPair returns the two ends of a TCP connection on the loopback interface.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// elligator2Big is elligator2 computed with math/big, which is simpler to
+// check against RFC 9380 but not constant time.
+func elligator2Big(r *big.Int) *big.Int {
+	a := big.NewInt(curveA)
+	den := new(big.Int).Mul(r, r)
+	den.Lsh(den, 1).Add(den, big.NewInt(1)).Mod(den, fieldPrime)
+	w := new(big.Int).ModInverse(den, fieldPrime)
+	w.Mul(w, a).Neg(w).Mod(w, fieldPrime)
+	rhs := new(big.Int).Add(w, a)
+	rhs.Mul(rhs, w).Add(rhs, big.NewInt(1)).Mul(rhs, w).Mod(rhs, fieldPrime)
+	if big.Jacobi(rhs, fieldPrime) == -1 {
+		w.Add(w, a).Neg(w).Mod(w, fieldPrime)
+	}
+	return w
+}
+
+// TestPAKE verifies that Elligator 2 maps onto the curve, as computed with
+// math/big, and that the ends of a PAKE only agree on a key if they use the
+// same code.
+func TestPAKE(t *testing.T) {
+	for i := int64(0); i < 200; i++ {
+		r := new(big.Int).Exp(big.NewInt(i), big.NewInt(77), fieldPrime)
+		var le [32]byte
+		r.FillBytes(le[:])
+		fe, err := new(field.Element).SetBytes(reverse(le[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := elligator2(fe)
+		x := new(big.Int).SetBytes(reverse(u[:]))
+		if x.Cmp(elligator2Big(r)) != 0 {
+			t.Fatalf("elligator2(%v) differs from math/big", r)
+		}
+		rhs := new(big.Int).Add(x, big.NewInt(curveA))
+		rhs.Mul(rhs, x).Add(rhs, big.NewInt(1)).Mul(rhs, x).Mod(rhs, fieldPrime)
+		if big.Jacobi(rhs, fieldPrime) == -1 {
+			t.Fatalf("elligator2(%v) is not on the curve", r)
+		}
+	}
+
+	for _, c := range []struct {
+		code, other string
+		agree       bool
+	}{
+		{"canyon-lemon", "canyon-lemon", true},
+		{"canyon-lemon", "canyon-melon", false},
+	} {
+		a, b := tcpPair(t)
+		keys := make(chan [32]byte, 1)
+		go func() {
+			key, err := pakeSession(b, []byte(c.other), []byte("sid"), false, rand.Reader)
+			if err != nil {
+				t.Error(err)
+			}
+			keys <- key
+		}()
+		key, err := pakeSession(a, []byte(c.code), []byte("sid"), true, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (key == <-keys) != c.agree {
+			t.Fatalf("%v and %v: the keys do not agree as expected", c.code, c.other)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+// TestRelay verifies that files are sent through a relay with a transfer
+// code, and that a receiver with the wrong code is refused.
+func TestRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go newRelay().serve(l)
+	addr := l.Addr().String()
+	plaintext := bytes.Repeat([]byte("relayed "), 10000)
+
+	for _, wrong := range []bool{false, true} {
+		codes := make(chan string, 1)
+		sent := make(chan error, 1)
+		go func() {
+			sent <- relaySend(addr, bytes.NewReader(plaintext), func(code string) { codes <- code })
+		}()
+		code := <-codes
+		if wrong {
+			code = strings.SplitN(code, "-", 2)[0] + "-wrong-code"
+		}
+		output := filepath.Join(dir, "out")
+		receiveErr := relayReceive(addr, code, output)
+		sendErr := <-sent
+		received, err := ioutil.ReadFile(output)
+		if wrong {
+			if sendErr != errWrongCode || receiveErr != errWrongCode || !os.IsNotExist(err) {
+				t.Fatal("a wrong code was accepted:", sendErr, receiveErr)
+			}
+			continue
+		}
+		if sendErr != nil || receiveErr != nil {
+			t.Fatal("the transfer failed:", sendErr, receiveErr)
+		}
+		if err != nil || !bytes.Equal(received, plaintext) {
+			t.Fatal("the received file differs")
+		}
+		os.Remove(output)
+
+		// every channel is used once.
+		if err := relayReceive(addr, code, output); err == nil || !strings.HasPrefix(err.Error(), "relay: ") {
+			t.Fatal("a channel was used twice:", err)
+		}
+	}
+	if err := relayReceive(addr, "nochannel", filepath.Join(dir, "out")); err != errTransferCode {
+		t.Fatal("expected errTransferCode, got", err)
+	}
+}
@@ -0,0 +1,566 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// enc repo keeps snapshots of directories in a repository, a directory that
+// stores each distinct chunk of them once, in the manner of restic. A snapshot
+// is the archive of the directory that enc backup would write, cut into
+// chunks at content-defined boundaries (see cdc.go), so that the chunks of the
+// files that did not change since an earlier snapshot, or that are in it
+// twice, are found again and not stored again.
+//
+// The repository has a single random key, stored in an enc file encrypted
+// with a passphrase or to recipients like any other, so the usual identities
+// and keyring work. Every other key is derived from it: chunks are named by
+// their keyed BLAKE2b-256 digest, so that names do not confirm contents, and
+// sealed with XChaCha20-Poly1305, bound to their names. Snapshots list their
+// chunks in order and are sealed the same way.
+//
+//	key                the repository key, an enc file
+//	data/ab/abcd...    chunks, named by their digest
+//	snapshots/1a2b...  snapshots
+//
+// Object stores can hold a repository through a file system mount, since
+// files are only ever created, never modified.
+
+const (
+	repoKeyLabel = "enc repo key"
+
+	// repoMaxChunk is the largest chunk of a snapshot; they are 8KB on
+	// average.
+	repoMaxChunk = 64 << 10
+)
+
+var (
+	errRepoExists   = errors.New("the directory already holds a repository")
+	errRepoKey      = errors.New("the repository key is not one enc repo init wrote")
+	errRepoChunk    = errors.New("a chunk of the snapshot is damaged or was replaced")
+	errRepoSnapshot = errors.New("no such snapshot")
+)
+
+// repo is an open repository.
+type repo struct {
+	dir     string
+	key     [32]byte
+	idKey   [32]byte
+	dataKey [32]byte
+}
+
+// repoSnapshot is a snapshot stored in a repository.
+type repoSnapshot struct {
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Chunks []string  `json:"chunks"`
+
+	name string
+}
+
+// initRepo creates a repository in dir with a new key, encrypted with
+// passphrase or to opts.recipients.
+func initRepo(dir string, passphrase []byte, opts encryptOptions) error {
+	keyPath := filepath.Join(dir, "key")
+	if _, err := os.Stat(keyPath); err == nil {
+		return errRepoExists
+	}
+	for _, sub := range []string{"data", "snapshots"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	output := new(memoryOutput)
+	opts.label = repoKeyLabel
+	_, _, _, err = encryptTo(passphrase, bytes.NewReader(key), output, 0, opts)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(keyPath, string(output.buf), false)
+}
+
+// openRepo opens the repository in dir, decrypting its key with keys.
+func openRepo(dir string, keys keySource) (*repo, error) {
+	f, err := os.Open(filepath.Join(dir, "key"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, plaintext, err := openCiphertext(keys, f)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadAll(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if header.Label != repoKeyLabel || len(key) != 32 {
+		return nil, errRepoKey
+	}
+	r := &repo{dir: dir}
+	copy(r.key[:], key)
+	r.idKey = subkey(r.key, "enc repo chunk id")
+	r.dataKey = subkey(r.key, "enc repo data")
+	return r, nil
+}
+
+// seal seals plaintext under the data key, bound to name.
+func (r *repo) seal(name string, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(r.dataKey[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(name)), nil
+}
+
+// open opens what seal sealed under name.
+func (r *repo) open(name string, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(r.dataKey[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errRepoChunk
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, errRepoChunk
+	}
+	return plaintext, nil
+}
+
+// chunkPath returns the path of the chunk with the given id.
+func (r *repo) chunkPath(id string) string {
+	return filepath.Join(r.dir, "data", id[:2], id)
+}
+
+// storeChunk stores chunk unless the repository already holds it, returning
+// its id and whether it was stored.
+func (r *repo) storeChunk(chunk []byte) (string, bool, error) {
+	hash, err := blake2b.New256(r.idKey[:])
+	if err != nil {
+		return "", false, err
+	}
+	hash.Write(chunk)
+	id := hex.EncodeToString(hash.Sum(nil))
+	path := r.chunkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, false, nil
+	}
+	sealed, err := r.seal("chunk "+id, chunk)
+	if err != nil {
+		return "", false, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", false, err
+	}
+	return id, true, writePrivateFile(path, string(sealed), true)
+}
+
+// loadChunk reads the chunk with the given id.
+func (r *repo) loadChunk(id string) ([]byte, error) {
+	if len(id) != 64 {
+		return nil, errRepoChunk
+	}
+	sealed, err := ioutil.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	return r.open("chunk "+id, sealed)
+}
+
+// backup takes a snapshot of root, walked as opts says, reporting how many
+// chunks it has and how many of them were new.
+func (r *repo) backup(root string, opts archiveOptions) (s repoSnapshot, added int, err error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return repoSnapshot{}, 0, err
+	}
+	l, err := r.lock(false)
+	if err != nil {
+		return repoSnapshot{}, 0, err
+	}
+	defer l.release()
+	host, _ := os.Hostname()
+	s = repoSnapshot{Time: time.Now().UTC(), Host: host, Path: abs}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_, err := writeArchive(root, pw, nil, opts)
+		pw.CloseWithError(err)
+	}()
+	added, err = r.storeStream(pr, &s)
+	if err != nil {
+		return repoSnapshot{}, 0, err
+	}
+	return s, added, r.writeSnapshot(&s)
+}
+
+// storeStream cuts the archive read from stream into chunks, stores those
+// the repository does not hold, and lists them in s. It returns how many
+// were new.
+func (r *repo) storeStream(stream io.Reader, s *repoSnapshot) (added int, err error) {
+	c := newChunker(subkey(r.key, "enc repo chunker"), repoMaxChunk)
+	br := bufio.NewReader(stream)
+	chunk := make([]byte, 0, repoMaxChunk)
+	store := func() error {
+		id, stored, err := r.storeChunk(chunk)
+		if err != nil {
+			return err
+		}
+		if stored {
+			added++
+		}
+		s.Chunks = append(s.Chunks, id)
+		s.Size += int64(len(chunk))
+		chunk = chunk[:0]
+		return nil
+	}
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		chunk = append(chunk, b)
+		if c.boundary(b, len(chunk)) {
+			err = store()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(chunk) > 0 {
+		err = store()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return added, nil
+}
+
+// writeSnapshot names s and writes it to the repository.
+func (r *repo) writeSnapshot(s *repoSnapshot) error {
+	name := make([]byte, 16)
+	_, err := rand.Read(name)
+	if err != nil {
+		return err
+	}
+	s.name = hex.EncodeToString(name)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	sealed, err := r.seal("snapshot "+s.name, b)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(filepath.Join(r.dir, "snapshots", s.name), string(sealed), false)
+}
+
+// loadSnapshot reads the snapshot with the given name.
+func (r *repo) loadSnapshot(name string) (repoSnapshot, error) {
+	sealed, err := ioutil.ReadFile(filepath.Join(r.dir, "snapshots", name))
+	if err != nil {
+		return repoSnapshot{}, err
+	}
+	b, err := r.open("snapshot "+name, sealed)
+	if err != nil {
+		return repoSnapshot{}, fmt.Errorf("snapshot %v: %v", name, err)
+	}
+	s := repoSnapshot{name: name}
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return repoSnapshot{}, fmt.Errorf("snapshot %v: %v", name, err)
+	}
+	return s, nil
+}
+
+// snapshotNames returns the names of the snapshots in the repository.
+func (r *repo) snapshotNames() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(r.dir, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".temp") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// snapshots returns the snapshots in the repository, oldest first.
+func (r *repo) snapshots() ([]repoSnapshot, error) {
+	names, err := r.snapshotNames()
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []repoSnapshot
+	for _, name := range names {
+		s, err := r.loadSnapshot(name)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// findSnapshot returns the snapshot whose name starts with prefix, or the
+// latest one if prefix is "latest".
+func (r *repo) findSnapshot(prefix string) (repoSnapshot, error) {
+	snapshots, err := r.snapshots()
+	if err != nil {
+		return repoSnapshot{}, err
+	}
+	if prefix == "latest" && len(snapshots) > 0 {
+		return snapshots[len(snapshots)-1], nil
+	}
+	var found []repoSnapshot
+	for _, s := range snapshots {
+		if prefix != "" && strings.HasPrefix(s.name, prefix) {
+			found = append(found, s)
+		}
+	}
+	if len(found) > 1 {
+		return repoSnapshot{}, fmt.Errorf("%v names more than one snapshot", prefix)
+	}
+	if len(found) == 0 {
+		return repoSnapshot{}, errRepoSnapshot
+	}
+	return found[0], nil
+}
+
+// restore extracts the snapshot s into dest as opts says.
+func (r *repo) restore(s repoSnapshot, dest string, opts extractOptions) error {
+	l, err := r.lock(false)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		for _, id := range s.Chunks {
+			chunk, err := r.loadChunk(id)
+			if err == nil {
+				_, err = pw.Write(chunk)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	_, err = extractArchive(pr, dest, opts)
+	return err
+}
+
+// repoMain implements `enc repo`, which keeps deduplicated snapshots of
+// directories in a repository.
+func repoMain(args []string) {
+	fs := newFlagSet("repo",
+		"enc repo init [-r key] [-R name] [repository]",
+		"enc repo backup -repo [repository] [directory]",
+		"enc repo snapshots -repo [repository]",
+		"enc repo restore -repo [repository] -o [output directory] [snapshot or latest] [paths...]",
+		"enc repo forget -repo [repository] [-keep-daily N] [-keep-weekly N] [...] [snapshots...]",
+		"enc repo prune -repo [repository]",
+		"enc repo check -repo [repository] [-sample 10%] [-repair]")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// prints the usage for -h
+		fs.Parse(args)
+		fs.Usage()
+		os.Exit(-1)
+	}
+	command := args[0]
+	var dir, output *string
+	var recipientArgs, recipientNames, identityFiles stringList
+	var archive archiveFlags
+	var owners ownerFlags
+	var p prompts
+	var policy keepPolicy
+	var dryRun, repair *bool
+	var sample *string
+	switch command {
+	case "init":
+		fs.Var(&recipientArgs, "r", "encrypt the repository key to this public key, or the public keys listed in this file, instead of a passphrase; may be repeated")
+		fs.Var(&recipientNames, "R", "encrypt the repository key to the public keys stored under this name in the keyring (see enc keyring); may be repeated")
+		p.register(fs, false, true)
+	case "backup", "snapshots", "restore", "forget", "prune", "check":
+		dir = fs.String("repo", os.Getenv("ENC_REPO"), "the repository (default $ENC_REPO)")
+		fs.Var(&identityFiles, "i", "decrypt the repository key with the identities in this file instead of a passphrase; may be repeated")
+		p.register(fs, false, false)
+		if command == "backup" {
+			archive.register(fs)
+		}
+		if command == "restore" {
+			output = fs.String("o", "", "output directory")
+			owners.register(fs)
+		}
+		if command == "forget" {
+			fs.IntVar(&policy.last, "keep-last", 0, "keep the latest N snapshots")
+			fs.IntVar(&policy.hourly, "keep-hourly", 0, "keep the latest snapshot of each of the last N hours with snapshots")
+			fs.IntVar(&policy.daily, "keep-daily", 0, "keep the latest snapshot of each of the last N days with snapshots")
+			fs.IntVar(&policy.weekly, "keep-weekly", 0, "keep the latest snapshot of each of the last N weeks with snapshots")
+			fs.IntVar(&policy.monthly, "keep-monthly", 0, "keep the latest snapshot of each of the last N months with snapshots")
+			fs.IntVar(&policy.yearly, "keep-yearly", 0, "keep the latest snapshot of each of the last N years with snapshots")
+		}
+		if command == "forget" || command == "prune" {
+			dryRun = fs.Bool("dry-run", false, "only print what would be removed")
+		}
+		if command == "check" {
+			sample = fs.String("sample", "100%", "read only this percentage of the chunks, chosen at random")
+			repair = fs.Bool("repair", false, "delete what is damaged and rebuild the snapshots that lost chunks from those left; reads every chunk")
+		}
+	default:
+		fs.Usage()
+		os.Exit(-1)
+	}
+	positional := parseArgs(fs, args[1:])
+
+	switch {
+	case command == "init" && len(positional) == 1:
+		if len(recipientNames) > 0 {
+			keys, err := keyringRecipients(recipientNames)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recipientArgs = append(recipientArgs, keys...)
+		}
+		var opts encryptOptions
+		var passphrase []byte
+		if len(recipientArgs) > 0 {
+			var err error
+			opts.recipients, err = readRecipients(recipientArgs)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			passphrase = p.passphrase(true)
+		}
+		err := initRepo(positional[0], passphrase, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case dir == nil || *dir == "":
+	case command == "backup" && len(positional) == 1:
+		r := openRepoFlags(*dir, &p, identityFiles)
+		s, added, err := r.backup(positional[0], archive.options())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("snapshot %v saved: %v bytes in %v chunks, %v of them new\n", s.name[:8], s.Size, len(s.Chunks), added)
+		return
+	case command == "snapshots" && len(positional) == 0:
+		r := openRepoFlags(*dir, &p, identityFiles)
+		snapshots, err := r.snapshots()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range snapshots {
+			fmt.Printf("%v  %v  %v  %12d  %v\n", s.name[:8], s.Time.Local().Format("2006-01-02 15:04:05"), s.Host, s.Size, s.Path)
+		}
+		return
+	case command == "forget" && (len(positional) > 0) == !policy.empty():
+		log.Fatal(errKeepPolicy)
+	case command == "forget":
+		r := openRepoFlags(*dir, &p, identityFiles)
+		forgotten, err := r.forget(positional, policy, *dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range forgotten {
+			fmt.Printf("forget %v  %v  %v\n", s.name[:8], s.Time.Local().Format("2006-01-02 15:04:05"), s.Path)
+		}
+		return
+	case command == "prune" && len(positional) == 0:
+		r := openRepoFlags(*dir, &p, identityFiles)
+		chunks, size, err := r.prune(*dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		verb := "removed"
+		if *dryRun {
+			verb = "would remove"
+		}
+		fmt.Printf("%v %v unused chunks, %v bytes\n", verb, chunks, size)
+		return
+	case command == "check" && len(positional) == 0:
+		percent, err := parsePercent(*sample)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r := openRepoFlags(*dir, &p, identityFiles)
+		err = r.check(percent, *repair, os.Stdout)
+		if err == errRepoDamaged {
+			log.Fatal(err, "; enc repo check -repair rebuilds the snapshots from the chunks that are intact")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("OK")
+		return
+	case command == "restore" && *output != "" && len(positional) >= 1:
+		r := openRepoFlags(*dir, &p, identityFiles)
+		s, err := r.findSnapshot(positional[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = r.restore(s, *output, extractOptions{paths: positional[1:], owners: owners.options()})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fs.Usage()
+	os.Exit(-1)
+}
+
+// openRepoFlags opens the repository in dir with the keys the flags give,
+// exiting on errors.
+func openRepoFlags(dir string, p *prompts, identityFiles []string) *repo {
+	r, err := openRepo(dir, p.keys(identityFiles, p.limits()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return r
+}
@@ -0,0 +1,108 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRepo verifies that snapshots taken into a repository restore the trees
+// they were taken of, and that a second snapshot of a tree that barely
+// changed stores few new chunks.
+func TestRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	if err := ioutil.WriteFile(filepath.Join(src, "big.bin"), big, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "small.txt"), []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repoDir := filepath.Join(dir, "repo")
+	if err := initRepo(repoDir, nil, encryptOptions{recipients: []recipient{id.public}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := initRepo(repoDir, nil, encryptOptions{recipients: []recipient{id.public}}); err != errRepoExists {
+		t.Fatal("expected errRepoExists, got", err)
+	}
+	r, err := openRepo(repoDir, identityKeys{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, added, err := r.backup(src, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != len(first.Chunks) || added < 10 {
+		t.Fatalf("the first snapshot stored %v of %v chunks", added, len(first.Chunks))
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "small.txt"), []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	second, added, err := r.backup(src, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added > 4 {
+		t.Fatalf("the second snapshot stored %v of %v chunks", added, len(second.Chunks))
+	}
+
+	snapshots, err := r.snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].name != first.name || snapshots[1].name != second.name {
+		t.Fatal("wrong snapshots", snapshots)
+	}
+	for _, restore := range []struct {
+		snapshot string
+		small    string
+	}{
+		{first.name[:8], "first"},
+		{"latest", "second"},
+	} {
+		s, err := r.findSnapshot(restore.snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(dir, "out-"+restore.small)
+		if err := r.restore(s, out, extractOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := ioutil.ReadFile(filepath.Join(out, "big.bin"))
+		if err != nil || !bytes.Equal(restored, big) {
+			t.Fatal("big.bin was not restored:", err)
+		}
+		small, err := ioutil.ReadFile(filepath.Join(out, "sub", "small.txt"))
+		if err != nil || string(small) != restore.small {
+			t.Fatalf("small.txt restored as %q: %v", small, err)
+		}
+	}
+
+	// a chunk swapped for another is refused.
+	a, b := r.chunkPath(first.Chunks[0]), r.chunkPath(first.Chunks[1])
+	if err := os.Rename(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.restore(first, filepath.Join(dir, "out-swapped"), extractOptions{}); err != errRepoChunk {
+		t.Fatal("expected errRepoChunk, got", err)
+	}
+}
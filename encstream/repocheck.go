@@ -0,0 +1,259 @@
+package encstream
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// enc repo check reads every snapshot and every chunk of a repository, or a
+// random sample of the chunks, and reports the chunks that do not
+// authenticate, those that snapshots list but the repository lacks, and the
+// files that are misplaced or were left by interrupted writes.
+//
+// With -repair, it deletes what is damaged, so that the next backup stores
+// those chunks again, and rebuilds each snapshot that lost chunks from the
+// ones it has left: its archive is salvaged as enc decrypt -keep-going
+// salvages one, leaving out the entries that overlapped the lost chunks, and
+// stored again as a new snapshot with the same time, host and path. The
+// chunks that only the old snapshot used are left for enc repo prune.
+
+var errRepoDamaged = errors.New("the repository is damaged")
+
+// repoCheck is what check found.
+type repoCheck struct {
+	snapshots []repoSnapshot
+	// chunks holds the size of every chunk that was read and authenticated.
+	chunks map[string]int
+	// damaged holds the paths of the chunks that did not.
+	damaged map[string]string
+	present map[string]bool
+	lost    map[string]bool
+	bad     []string // snapshots that cannot be read
+	stray   []string // leftover and misplaced files
+	read    int
+	unused  int
+}
+
+// check checks r, reading every chunk, or a random sample of them of the
+// given percentage, and reports what it finds to w. With repair, every chunk
+// is read and what is damaged is repaired; otherwise errRepoDamaged is
+// returned if anything is.
+func (r *repo) check(sample float64, repair bool, w io.Writer) error {
+	l, err := r.lock(repair)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	if repair {
+		sample = 100
+	}
+	c := &repoCheck{
+		chunks:  make(map[string]int),
+		damaged: make(map[string]string),
+		present: make(map[string]bool),
+		lost:    make(map[string]bool),
+	}
+
+	names, err := r.snapshotNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		s, err := r.loadSnapshot(name)
+		if err != nil {
+			fmt.Fprintln(w, "damaged:", err)
+			c.bad = append(c.bad, name)
+			continue
+		}
+		c.snapshots = append(c.snapshots, s)
+	}
+	sort.SliceStable(c.snapshots, func(i, j int) bool { return c.snapshots[i].Time.Before(c.snapshots[j].Time) })
+
+	err = r.checkChunks(c, sample, repair, w)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, s := range c.snapshots {
+		var lost int
+		for _, id := range s.Chunks {
+			used[id] = true
+			if !c.present[id] {
+				c.lost[id] = true
+			}
+			if c.lost[id] {
+				lost++
+			}
+		}
+		if lost > 0 {
+			fmt.Fprintf(w, "snapshot %v of %v: %v of %v chunks missing or damaged\n", s.name[:8], s.Path, lost, len(s.Chunks))
+		}
+	}
+	for id := range c.present {
+		if !used[id] {
+			c.unused++
+		}
+	}
+	fmt.Fprintf(w, "%v snapshots, %v of %v chunks read, %v unused\n", len(c.snapshots)+len(c.bad), c.read, len(c.present), c.unused)
+	if len(c.bad) == 0 && len(c.damaged) == 0 && len(c.lost) == 0 && len(c.stray) == 0 {
+		return nil
+	}
+	if !repair {
+		return errRepoDamaged
+	}
+	return r.repair(c, w)
+}
+
+// checkChunks lists the chunks of r in c, moving those that are in the wrong
+// directory with repair, and reads those sampled.
+func (r *repo) checkChunks(c *repoCheck, sample float64, repair bool, w io.Writer) error {
+	var misplaced [][2]string
+	err := filepath.Walk(filepath.Join(r.dir, "data"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name := info.Name()
+		if strings.HasSuffix(name, ".temp") {
+			fmt.Fprintln(w, "interrupted write:", path)
+			c.stray = append(c.stray, path)
+			return nil
+		}
+		if _, err := hex.DecodeString(name); err != nil || len(name) != 64 {
+			fmt.Fprintln(w, "not a chunk:", path)
+			c.stray = append(c.stray, path)
+			return nil
+		}
+		if path != r.chunkPath(name) {
+			fmt.Fprintln(w, "misplaced:", path)
+			misplaced = append(misplaced, [2]string{path, name})
+			return nil
+		}
+		c.present[name] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range misplaced {
+		if !repair || c.present[m[1]] {
+			c.stray = append(c.stray, m[0])
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(r.chunkPath(m[1])), 0700)
+		if err == nil {
+			err = os.Rename(m[0], r.chunkPath(m[1]))
+		}
+		if err != nil {
+			return err
+		}
+		c.present[m[1]] = true
+	}
+
+	for id := range c.present {
+		if sample < 100 && mrand.Float64()*100 >= sample {
+			continue
+		}
+		c.read++
+		chunk, err := r.loadChunk(id)
+		if err != nil {
+			fmt.Fprintln(w, "damaged:", r.chunkPath(id))
+			c.damaged[id] = r.chunkPath(id)
+			c.lost[id] = true
+			continue
+		}
+		c.chunks[id] = len(chunk)
+	}
+	return nil
+}
+
+// repair deletes the damaged chunks, unreadable snapshots and leftover files
+// that c found, and rebuilds the snapshots that lost chunks.
+func (r *repo) repair(c *repoCheck, w io.Writer) error {
+	var remove []string
+	remove = append(remove, c.stray...)
+	for _, path := range c.damaged {
+		remove = append(remove, path)
+	}
+	for _, name := range c.bad {
+		remove = append(remove, filepath.Join(r.dir, "snapshots", name))
+	}
+	for _, path := range remove {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, s := range c.snapshots {
+		var lost bool
+		for _, id := range s.Chunks {
+			lost = lost || c.lost[id]
+		}
+		if !lost {
+			continue
+		}
+		rebuilt, err := r.rebuild(s, c, w)
+		if err != nil {
+			return fmt.Errorf("snapshot %v: %v", s.name[:8], err)
+		}
+		fmt.Fprintf(w, "snapshot %v rebuilt as %v\n", s.name[:8], rebuilt.name[:8])
+	}
+	return nil
+}
+
+// rebuild stores the entries of s that do not overlap the chunks c lost as a
+// new snapshot in place of s.
+func (r *repo) rebuild(s repoSnapshot, c *repoCheck, w io.Writer) (repoSnapshot, error) {
+	// the plaintext of a lost chunk is left out, so it is a gap where it
+	// was.
+	var damaged []damagedRange
+	var offset int64
+	for _, id := range s.Chunks {
+		if c.lost[id] {
+			damaged = append(damaged, damagedRange{plaintextStart: offset, plaintextEnd: offset})
+			continue
+		}
+		offset += int64(c.chunks[id])
+	}
+
+	chunks, pw := io.Pipe()
+	defer chunks.Close()
+	go func() {
+		for _, id := range s.Chunks {
+			if c.lost[id] {
+				continue
+			}
+			chunk, err := r.loadChunk(id)
+			if err == nil {
+				_, err = pw.Write(chunk)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	salvaged, sw := io.Pipe()
+	defer salvaged.Close()
+	go func() {
+		sw.CloseWithError(salvageArchive(chunks, damaged, sw, w))
+	}()
+
+	rebuilt := repoSnapshot{Time: s.Time, Host: s.Host, Path: s.Path}
+	_, err := r.storeStream(salvaged, &rebuilt)
+	if err != nil {
+		return repoSnapshot{}, err
+	}
+	err = r.writeSnapshot(&rebuilt)
+	if err != nil {
+		return repoSnapshot{}, err
+	}
+	return rebuilt, os.Remove(filepath.Join(r.dir, "snapshots", s.name))
+}
@@ -0,0 +1,114 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRepoCheck verifies that enc repo check finds damaged and missing
+// chunks, and that -repair rebuilds the snapshot that lost them, keeping the
+// files that did not overlap them.
+func TestRepoCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	files := map[string][]byte{
+		"a.txt":   []byte("alpha"),
+		"big.bin": big,
+		"z.txt":   []byte("zulu"),
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repoDir := filepath.Join(dir, "repo")
+	if err := initRepo(repoDir, nil, encryptOptions{recipients: []recipient{id.public}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRepo(repoDir, identityKeys{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, err := r.backup(src, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := new(bytes.Buffer)
+	if err := r.check(100, false, report); err != nil {
+		t.Fatal(err, report)
+	}
+	if err := r.check(10, false, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// damage one chunk of big.bin and lose another.
+	middle := len(s.Chunks) / 2
+	damagedPath, missingPath := r.chunkPath(s.Chunks[middle]), r.chunkPath(s.Chunks[middle+2])
+	sealed, err := ioutil.ReadFile(damagedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)/2] ^= 1
+	if err := ioutil.WriteFile(damagedPath, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(missingPath); err != nil {
+		t.Fatal(err)
+	}
+	report.Reset()
+	if err := r.check(100, false, report); err != errRepoDamaged {
+		t.Fatal("expected errRepoDamaged, got", err)
+	}
+	if !strings.Contains(report.String(), "damaged: "+damagedPath) || !strings.Contains(report.String(), "2 of") {
+		t.Fatalf("the report does not name the damage:\n%v", report)
+	}
+
+	report.Reset()
+	if err := r.check(100, true, report); err != nil {
+		t.Fatal(err, report)
+	}
+	if !strings.Contains(report.String(), "damaged: big.bin") || !strings.Contains(report.String(), "rebuilt as") {
+		t.Fatalf("the repair was not reported:\n%v", report)
+	}
+	if err := r.check(100, false, ioutil.Discard); err != nil {
+		t.Fatal("the repaired repository does not check:", err)
+	}
+	rebuilt, err := r.findSnapshot("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.name == s.name || !rebuilt.Time.Equal(s.Time) || rebuilt.Path != s.Path {
+		t.Fatal("the snapshot was not rebuilt in place:", rebuilt)
+	}
+	out := filepath.Join(dir, "out")
+	if err := r.restore(rebuilt, out, extractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "z.txt"} {
+		restored, err := ioutil.ReadFile(filepath.Join(out, name))
+		if err != nil || !bytes.Equal(restored, files[name]) {
+			t.Fatalf("%v was not kept: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "big.bin")); !os.IsNotExist(err) {
+		t.Fatal("the damaged file was restored")
+	}
+}
@@ -0,0 +1,139 @@
+package encstream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Repositories are locked so that enc repo prune cannot delete the chunks of
+// a snapshot that a backup has stored but not yet written, or that a restore
+// is reading. Backups, restores and forget take shared locks, which any number
+// of them can hold, and prune takes an exclusive lock, which it holds alone.
+//
+// A lock is a file in the locks directory. To take one, enc writes its lock
+// and then reads the others, and if any conflicts, removes its own and fails:
+// of two processes that race, at least one sees the other. Locks are sealed
+// like snapshots, and touched every few minutes while they are held; a lock
+// that was not touched for repoLockStale was left by a process that died, and
+// is removed by the next one to find it.
+
+const (
+	repoLockRefresh = 5 * time.Minute
+	repoLockStale   = 30 * time.Minute
+)
+
+// repoLockInfo is what a lock records about its holder.
+type repoLockInfo struct {
+	Exclusive bool      `json:"exclusive"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Time      time.Time `json:"time"`
+}
+
+// repoLock is a lock held on a repository.
+type repoLock struct {
+	path string
+	done chan struct{}
+}
+
+// lock locks r, exclusively if exclusive is set.
+func (r *repo) lock(exclusive bool) (*repoLock, error) {
+	dir := filepath.Join(r.dir, "locks")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	info := repoLockInfo{Exclusive: exclusive, Host: host, PID: os.Getpid(), Time: time.Now().UTC()}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	name := make([]byte, 16)
+	_, err = rand.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	l := &repoLock{path: filepath.Join(dir, hex.EncodeToString(name)), done: make(chan struct{})}
+	sealed, err := r.seal("lock "+filepath.Base(l.path), b)
+	if err != nil {
+		return nil, err
+	}
+	err = writePrivateFile(l.path, string(sealed), false)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		os.Remove(l.path)
+		return nil, err
+	}
+	for _, fi := range infos {
+		other := filepath.Join(dir, fi.Name())
+		if other == l.path || strings.HasSuffix(fi.Name(), ".temp") {
+			continue
+		}
+		if time.Since(fi.ModTime()) > repoLockStale {
+			os.Remove(other)
+			continue
+		}
+		sealed, err := ioutil.ReadFile(other)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var holder repoLockInfo
+		if err == nil {
+			b, err = r.open("lock "+fi.Name(), sealed)
+			if err == nil {
+				err = json.Unmarshal(b, &holder)
+			}
+		}
+		if err != nil {
+			// a lock that cannot be read is taken to be exclusive.
+			holder.Exclusive = true
+		}
+		if exclusive || holder.Exclusive {
+			os.Remove(l.path)
+			return nil, fmt.Errorf("the repository is locked by %v (pid %v on %v, since %v)", lockKind(holder.Exclusive), holder.PID, holder.Host, holder.Time.Local().Format("2006-01-02 15:04:05"))
+		}
+	}
+	go l.refresh()
+	return l, nil
+}
+
+// lockKind describes a lock.
+func lockKind(exclusive bool) string {
+	if exclusive {
+		return "an exclusive lock"
+	}
+	return "a shared lock"
+}
+
+// refresh touches the lock until it is released, so that it is not taken to
+// be stale.
+func (l *repoLock) refresh() {
+	ticker := time.NewTicker(repoLockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// release releases the lock.
+func (l *repoLock) release() error {
+	close(l.done)
+	return os.Remove(l.path)
+}
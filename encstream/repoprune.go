@@ -0,0 +1,174 @@
+package encstream
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// enc repo forget removes snapshots, either those it is given or those a
+// policy does not keep, and enc repo prune then deletes the chunks that no
+// snapshot refers to any more. Forgetting only removes snapshot files, so it
+// is quick and can run alongside backups; pruning reads every snapshot and
+// lists every chunk, and holds the repository's exclusive lock while it does.
+//
+// The policy keeps, for each rule, the latest snapshot of each of the last
+// so many hours, days, weeks, months or years that have snapshots, as restic
+// does; a snapshot kept by any rule is kept.
+
+var errKeepPolicy = errors.New("give the snapshots to forget, or a policy with -keep-last, -keep-hourly, -keep-daily, -keep-weekly, -keep-monthly or -keep-yearly")
+
+// keepPolicy says how many snapshots enc repo forget keeps for each rule.
+type keepPolicy struct {
+	last, hourly, daily, weekly, monthly, yearly int
+}
+
+// empty reports whether p keeps nothing.
+func (p keepPolicy) empty() bool {
+	return p == keepPolicy{}
+}
+
+// keep returns the names of the snapshots p keeps.
+func (p keepPolicy) keep(snapshots []repoSnapshot) map[string]bool {
+	newest := append([]repoSnapshot(nil), snapshots...)
+	sort.SliceStable(newest, func(i, j int) bool { return newest[i].Time.After(newest[j].Time) })
+	rules := []struct {
+		n      int
+		bucket func(t time.Time) string
+	}{
+		{p.last, nil},
+		{p.hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{p.daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprint(year, week)
+		}},
+		{p.monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{p.yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	kept := make(map[string]bool)
+	for _, rule := range rules {
+		n, last := rule.n, ""
+		for _, s := range newest {
+			if n <= 0 {
+				break
+			}
+			bucket := s.name
+			if rule.bucket != nil {
+				bucket = rule.bucket(s.Time.Local())
+			}
+			if bucket == last {
+				continue
+			}
+			kept[s.name] = true
+			last = bucket
+			n--
+		}
+	}
+	return kept
+}
+
+// forget removes the snapshots of r named by prefixes, or if there are none,
+// those that policy does not keep. It returns the snapshots removed, or that
+// would be with dryRun.
+func (r *repo) forget(prefixes []string, policy keepPolicy, dryRun bool) ([]repoSnapshot, error) {
+	l, err := r.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+	var forgotten []repoSnapshot
+	if len(prefixes) > 0 {
+		for _, prefix := range prefixes {
+			s, err := r.findSnapshot(prefix)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", prefix, err)
+			}
+			forgotten = append(forgotten, s)
+		}
+	} else {
+		snapshots, err := r.snapshots()
+		if err != nil {
+			return nil, err
+		}
+		kept := policy.keep(snapshots)
+		for _, s := range snapshots {
+			if !kept[s.name] {
+				forgotten = append(forgotten, s)
+			}
+		}
+	}
+	if dryRun {
+		return forgotten, nil
+	}
+	for _, s := range forgotten {
+		err := os.Remove(filepath.Join(r.dir, "snapshots", s.name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return forgotten, nil
+}
+
+// prune deletes the chunks of r that no snapshot refers to, and what
+// interrupted writes left behind, returning how many chunks it deleted and
+// their size. With dryRun, nothing is deleted.
+func (r *repo) prune(dryRun bool) (chunks int, size int64, err error) {
+	l, err := r.lock(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer l.release()
+	snapshots, err := r.snapshots()
+	if err != nil {
+		// pruning with a snapshot that cannot be read would delete its
+		// chunks.
+		return 0, 0, err
+	}
+	used := make(map[string]bool)
+	for _, s := range snapshots {
+		for _, id := range s.Chunks {
+			used[id] = true
+		}
+	}
+	for _, sub := range []string{"data", "snapshots"} {
+		err = filepath.Walk(filepath.Join(r.dir, sub), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			name := info.Name()
+			temp := strings.HasSuffix(name, ".temp")
+			if !temp && (sub == "snapshots" || used[name]) {
+				return nil
+			}
+			if !temp {
+				chunks++
+				size += info.Size()
+			}
+			if dryRun {
+				return nil
+			}
+			return os.Remove(path)
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if dryRun {
+		return chunks, size, nil
+	}
+	// remove the directories of chunks left empty.
+	dirs, err := ioutil.ReadDir(filepath.Join(r.dir, "data"))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, dir := range dirs {
+		os.Remove(filepath.Join(r.dir, "data", dir.Name()))
+	}
+	return chunks, size, nil
+}
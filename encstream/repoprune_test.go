@@ -0,0 +1,158 @@
+package encstream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestKeepPolicy verifies that each rule keeps the latest snapshot of each of
+// its periods.
+func TestKeepPolicy(t *testing.T) {
+	var snapshots []repoSnapshot
+	// two snapshots a day, for 60 days from March 1.
+	for i := 0; i < 120; i++ {
+		snapshots = append(snapshots, repoSnapshot{Time: time.Date(2024, 3, 1+i/2, 12*(i%2), 0, 0, 0, time.Local), name: fmt.Sprint(i)})
+	}
+	kept := keepPolicy{last: 1, daily: 3, monthly: 2}.keep(snapshots)
+	var names []string
+	for _, s := range snapshots {
+		if kept[s.name] {
+			names = append(names, s.Time.Format("01-02 15"))
+		}
+	}
+	want := []string{"03-31 12", "04-27 12", "04-28 12", "04-29 12"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("kept %v, want %v", names, want)
+	}
+}
+
+// TestRepoLocks verifies that exclusive locks exclude every other lock, that
+// shared locks only exclude exclusive ones, and that stale locks are ignored.
+func TestRepoLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initRepo(dir, nil, encryptOptions{recipients: []recipient{id.public}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRepo(dir, identityKeys{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := r.lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.lock(false)
+	if err != nil {
+		t.Fatal("shared locks exclude each other:", err)
+	}
+	if _, err := r.lock(true); err == nil {
+		t.Fatal("an exclusive lock was taken alongside shared ones")
+	}
+	a.release()
+	b.release()
+	c, err := r.lock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.lock(false); err == nil {
+		t.Fatal("a shared lock was taken alongside an exclusive one")
+	}
+	old := time.Now().Add(-2 * repoLockStale)
+	if err := os.Chtimes(c.path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	d, err := r.lock(false)
+	if err != nil {
+		t.Fatal("a stale lock was not ignored:", err)
+	}
+	d.release()
+	if _, err := os.Stat(c.path); !os.IsNotExist(err) {
+		t.Fatal("the stale lock was not removed")
+	}
+}
+
+// TestRepoPrune verifies that pruning after forgetting a snapshot deletes
+// only the chunks no other snapshot refers to.
+func TestRepoPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// the files are seeded differently so that they do not share chunks.
+	write := func(name string, seed int64, size int) {
+		contents := make([]byte, size)
+		rand.New(rand.NewSource(seed)).Read(contents)
+		if err := ioutil.WriteFile(filepath.Join(src, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("kept", 1, 200<<10)
+	write("gone", 2, 200<<10)
+
+	repoDir := filepath.Join(dir, "repo")
+	if err := initRepo(repoDir, nil, encryptOptions{recipients: []recipient{id.public}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRepo(repoDir, identityKeys{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _, err := r.backup(src, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(src, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := r.backup(src, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.forget(nil, keepPolicy{last: 1}, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := r.prune(false); err != nil || n != 0 {
+		t.Fatal("chunks of snapshots still kept were pruned:", n, err)
+	}
+	forgotten, err := r.forget(nil, keepPolicy{last: 1}, false)
+	if err != nil || len(forgotten) != 1 || forgotten[0].name != first.name {
+		t.Fatal("the wrong snapshots were forgotten:", forgotten, err)
+	}
+	n, size, err := r.prune(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || size < 100<<10 {
+		t.Fatalf("pruned %v chunks of %v bytes", n, size)
+	}
+	if err := r.restore(second, filepath.Join(dir, "out"), extractOptions{}); err != nil {
+		t.Fatal("the kept snapshot no longer restores:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", "kept")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,300 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// -resume makes the encryption of a large file resumable. As it encrypts, enc
+// periodically syncs the partial output and records how far it got in a
+// checkpoint next to it: how many bytes of input, ciphertext and chunks were
+// written, and the state of the plaintext hashes. If it is interrupted, the
+// partial output and checkpoint are kept, and running it again with the same
+// passphrase continues from the checkpoint instead of starting over. The
+// checkpoint is sealed under a subkey of the file's key, with the header as
+// additional data, so it neither leaks nor can be altered, and a different
+// passphrase fails to open it. The MAC of the file is keyed and its state
+// cannot be saved, so on resuming the ciphertext already written is read back,
+// which also checks that it decrypts to as much input as the checkpoint
+// records.
+
+var (
+	errResumeOptions  = errors.New("-resume only encrypts a regular file with a passphrase to an output file, and cannot be combined with -r, -R, -vault, -dedup, -rsyncable, -dedup-with, -no-metadata, -a, -volume-size, -no-cache, -io-uring or several inputs")
+	errResumeMismatch = errors.New("the checkpoint does not match the partial output or the passphrase; remove it to start over")
+)
+
+// checkpointSuffix is appended to the name of the output to name its
+// checkpoint.
+const checkpointSuffix = ".checkpoint"
+
+// checkpointInterval is how many bytes of input are encrypted between
+// checkpoints.
+var checkpointInterval int64 = 256 << 20
+
+// checkpoint records how far a resumable encryption got.
+type checkpoint struct {
+	Offset        int64  // bytes of input encrypted
+	Written       int64  // bytes of ciphertext written after the header
+	Chunks        uint64 // chunks written, numbered in version 4 files
+	PlaintextHash []byte // marshalled state
+	Digest        []byte // marshalled state, with -store-digest
+}
+
+// checkResume returns errResumeOptions if opts cannot be resumed.
+func checkResume(finalOutput string, opts encryptOptions) error {
+	if finalOutput == "-" || len(opts.recipients) > 0 || opts.vault != nil || opts.shared != nil || opts.dedup || opts.dedupWith != nil ||
+		opts.noMetadata || opts.armor || opts.volumeSize > 0 || opts.noCache || opts.uring || opts.handshake != nil {
+		return errResumeOptions
+	}
+	return nil
+}
+
+// checkResumed returns errResumeMismatch unless the header of a partial
+// output records what opts would: the rest of it is taken from opts, but the
+// header is not written again.
+func checkResumed(header fileHeader, opts encryptOptions) error {
+	var signer [32]byte
+	if opts.signingKey != nil {
+		copy(signer[:], opts.signingKey.Public().(ed25519.PublicKey))
+	}
+	if header.Signer != signer || header.Reserved != opts.deniable || (header.Flags&flagDigest != 0) != opts.storeDigest {
+		return errResumeMismatch
+	}
+	return nil
+}
+
+// resumableOutput is an atomicFile that keeps the partial output when it is
+// aborted once a checkpoint has been saved for it.
+type resumableOutput struct {
+	*atomicFile
+	checkpoint string
+	// header is that of the partial output, if there is one to resume.
+	header *fileHeader
+}
+
+// createResumable opens the partial output of finalOutput to resume it if it
+// has a checkpoint, or creates it otherwise.
+func createResumable(finalOutput string) (*resumableOutput, error) {
+	name := finalOutput + checkpointSuffix
+	if _, err := os.Stat(name); err == nil {
+		f, err := os.OpenFile(finalOutput+".temp", os.O_RDWR, 0)
+		if err == nil {
+			header, err := readHeader(f)
+			if err != nil {
+				f.Close()
+				return nil, errResumeMismatch
+			}
+			return &resumableOutput{atomicFile: &atomicFile{File: f, name: finalOutput}, checkpoint: name, header: &header}, nil
+		}
+	}
+	f, err := createAtomic(finalOutput)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(name)
+	return &resumableOutput{atomicFile: f, checkpoint: name}, nil
+}
+
+func (r *resumableOutput) commit() error {
+	err := r.atomicFile.commit()
+	if err != nil {
+		return err
+	}
+	os.Remove(r.checkpoint)
+	return nil
+}
+
+func (r *resumableOutput) abort() {
+	if _, err := os.Stat(r.checkpoint); err != nil {
+		r.atomicFile.abort()
+		return
+	}
+	r.Close()
+}
+
+// checkpointKey returns the key checkpoints of the file with secret key sk
+// are sealed with.
+func checkpointKey(sk [32]byte) []byte {
+	key := subkey(sk, "enc checkpoint")
+	return key[:]
+}
+
+// resumption is the state of a resumable encryption that its checkpoints
+// record.
+type resumption struct {
+	output        *resumableOutput
+	encodedHeader []byte
+	sk            [32]byte
+	random        io.Reader
+	encWriter     *EncWriter
+	// hashes are the hash of the plaintext and, with -store-digest, its
+	// digest.
+	hashes [2]hash.Hash
+}
+
+// resume continues the encryption from the checkpoint of the partial output.
+// It feeds the ciphertext already written to mac, checking that it decrypts
+// to as much input as the checkpoint records, restores the chunk count and
+// the plaintext hashes, and moves the output and input to where the
+// checkpoint left off, returning how much input was encrypted.
+func (r *resumption) resume(header fileHeader, mac io.Writer, input io.Reader) (int64, error) {
+	onDisk := make([]byte, len(r.encodedHeader))
+	_, err := r.output.ReadAt(onDisk, 0)
+	if err != nil || !bytes.Equal(onDisk, r.encodedHeader) {
+		return 0, errResumeMismatch
+	}
+	cp, err := r.load()
+	if err != nil {
+		return 0, err
+	}
+	written := io.NewSectionReader(r.output.File, int64(len(r.encodedHeader)), cp.Written)
+	decrypted, err := io.Copy(ioutil.Discard, NewReader(r.sk, io.TeeReader(written, mac), append(header.chunkOptions(), WithParallelism(workers()), withUnfinished())...))
+	if err != nil || decrypted != cp.Offset {
+		return 0, errResumeMismatch
+	}
+	r.encWriter.chunks = cp.Chunks
+	for i, state := range [][]byte{cp.PlaintextHash, cp.Digest} {
+		if r.hashes[i] == nil {
+			continue
+		}
+		err = r.hashes[i].(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		if err != nil {
+			return 0, errResumeMismatch
+		}
+	}
+	// anything written after the checkpoint is written again.
+	end := int64(len(r.encodedHeader)) + cp.Written
+	err = r.output.Truncate(end)
+	if err != nil {
+		return 0, err
+	}
+	_, err = r.output.Seek(end, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	seeker, ok := input.(io.Seeker)
+	if !ok {
+		return 0, errResumeOptions
+	}
+	_, err = seeker.Seek(cp.Offset, io.SeekStart)
+	return cp.Offset, err
+}
+
+// copy copies input to w, which encrypts it to the output, saving a
+// checkpoint every checkpointInterval bytes. offset is how much input was
+// encrypted before.
+func (r *resumption) copy(w io.Writer, input io.Reader, offset int64) error {
+	buf := make([]byte, 1<<20)
+	since := int64(0)
+	for {
+		n, err := input.Read(buf)
+		if n > 0 {
+			_, werr := w.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+			offset += int64(n)
+			since += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// a partial chunk held back by the EncWriter would be lost.
+		if since >= checkpointInterval && r.encWriter.buffered() == 0 {
+			err = r.save(offset)
+			if err != nil {
+				return err
+			}
+			since = 0
+		}
+	}
+}
+
+// save syncs the output and records that offset bytes of input have been
+// encrypted to it in its checkpoint. The EncWriter must hold back no
+// plaintext: it writes out every full chunk by the time its Write returns.
+func (r *resumption) save(offset int64) error {
+	pos, err := r.output.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	cp := checkpoint{Offset: offset, Written: pos - int64(len(r.encodedHeader)), Chunks: r.encWriter.chunks}
+	for i, h := range r.hashes {
+		if h == nil {
+			continue
+		}
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			cp.PlaintextHash = state
+		} else {
+			cp.Digest = state
+		}
+	}
+	plaintext, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(checkpointKey(r.sk))
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(r.random, nonce)
+	if err != nil {
+		return err
+	}
+	err = r.output.Sync()
+	if err != nil {
+		return err
+	}
+	f, err := createAtomic(r.output.checkpoint)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(aead.Seal(nonce, nonce, plaintext, r.encodedHeader))
+	if err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
+
+// load reads and opens the checkpoint of the output.
+func (r *resumption) load() (checkpoint, error) {
+	var cp checkpoint
+	sealed, err := ioutil.ReadFile(r.output.checkpoint)
+	if err != nil {
+		return cp, err
+	}
+	aead, err := chacha20poly1305.NewX(checkpointKey(r.sk))
+	if err != nil {
+		return cp, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return cp, errResumeMismatch
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], r.encodedHeader)
+	if err != nil {
+		return cp, errResumeMismatch
+	}
+	err = json.Unmarshal(plaintext, &cp)
+	if err != nil {
+		return cp, errResumeMismatch
+	}
+	return cp, nil
+}
@@ -0,0 +1,121 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// interruptedReader reads from r until n bytes have been read, and then
+// fails.
+type interruptedReader struct {
+	r io.ReadSeeker
+	n int64
+}
+
+func (i *interruptedReader) Read(p []byte) (int, error) {
+	if i.n <= 0 {
+		return 0, errors.New("interrupted")
+	}
+	if int64(len(p)) > i.n {
+		p = p[:i.n]
+	}
+	n, err := i.r.Read(p)
+	i.n -= int64(n)
+	return n, err
+}
+
+func (i *interruptedReader) Seek(offset int64, whence int) (int64, error) {
+	return i.r.Seek(offset, whence)
+}
+
+// TestResume verifies that an interrupted -resume encryption keeps its
+// partial output and checkpoint, that running it again continues from the
+// checkpoint to the same plaintext and hash as an uninterrupted one,
+// and that it refuses a different passphrase.
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(interval int64) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 1 << 20
+	plaintext := make([]byte, 3<<20+12345)
+	rand.Read(plaintext)
+	passphrase := []byte("hunter2")
+	opts := encryptOptions{resume: true, storeDigest: true}
+
+	interrupt := func(name string) {
+		output, err := createOutput(name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := &interruptedReader{r: bytes.NewReader(plaintext), n: 2<<20 + 4321}
+		if _, _, _, err := encryptTo(passphrase, input, output, 0, opts); err == nil {
+			t.Fatal("an interrupted encryption succeeded")
+		}
+		for _, kept := range []string{name + ".temp", name + checkpointSuffix} {
+			if _, err := os.Stat(kept); err != nil {
+				t.Fatal("an interrupted encryption did not keep", kept)
+			}
+		}
+	}
+	name := filepath.Join(dir, "file.enc")
+	interrupt(name)
+	output, err := createOutput(name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.(*resumableOutput).header == nil {
+		t.Fatal("the partial output was not resumed")
+	}
+	_, _, sum, err := encryptTo(passphrase, bytes.NewReader(plaintext), output, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := blake2b.Sum256(plaintext); !bytes.Equal(sum, want[:]) {
+		t.Fatal("the plaintext hash was not restored from the checkpoint")
+	}
+	for _, removed := range []string{name + ".temp", name + checkpointSuffix} {
+		if _, err := os.Stat(removed); !os.IsNotExist(err) {
+			t.Fatal("a finished encryption left", removed, "behind")
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	decrypted := filepath.Join(dir, "decrypted")
+	if err := decryptFile(newPassphraseKeys(passphrase), f, decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(decrypted); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatal("a resumed file did not decrypt to the input", err)
+	}
+
+	other := filepath.Join(dir, "other.enc")
+	interrupt(other)
+	output, err = createOutput(other, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := encryptTo([]byte("hunter3"), bytes.NewReader(plaintext), output, 0, opts); err != errResumeMismatch {
+		t.Fatal("expected errResumeMismatch from another passphrase, got", err)
+	}
+	if _, err := os.Stat(other + checkpointSuffix); err != nil {
+		t.Fatal("a failed resumption removed the checkpoint")
+	}
+
+	if _, err := createOutput(name, encryptOptions{resume: true, armor: true}); err != errResumeOptions {
+		t.Fatal("expected errResumeOptions, got", err)
+	}
+}
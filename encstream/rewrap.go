@@ -0,0 +1,363 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// A file encrypted to recipients can be rewrapped to change who they are.
+// The file key is unwrapped with any identity that can decrypt the file, the
+// stanzas of the removed recipients are dropped and new ones added, and the
+// ciphertext is copied unchanged behind the new header. The MAC covers the
+// header, so it is computed again in the same pass that checks the old one.
+//
+// Removing a recipient only stops them from decrypting the rewrapped file
+// with their key: anyone who has decrypted a file before may have kept its
+// file key or plaintext, and copies of the old file still decrypt.
+
+var (
+	errRewrapPassphrase = errors.New("only files encrypted to recipients can be rewrapped")
+	errRewrapHidden     = errors.New("the file hides the key IDs of its recipients, so they cannot be removed")
+	errRewrapEmpty      = errors.New("the file would have no recipients left")
+	errRewrapVolumes    = errors.New("volumes cannot be rewrapped; join them into a single file first")
+	errRewrapNothing    = errors.New("rewrap needs -add-recipient or -remove-recipient")
+)
+
+// rewrapOptions describes how rewrapFile changes the recipients of a file.
+type rewrapOptions struct {
+	add, remove []recipient
+	// signingKey, if set, signs the rewrapped file. Otherwise the
+	// signature of a signed file is dropped, since the header changes.
+	signingKey ed25519.PrivateKey
+	// recovery, if non-zero, adds recovery records amounting to this
+	// percentage of the file, as the input had.
+	recovery float64
+	// antiForensic splits the wrapped file keys of the rewrapped file; see
+	// afsplit.go. Files whose keys are already split stay split.
+	antiForensic bool
+}
+
+// rewrapFile writes the encrypted file read from input, with its recipients
+// changed as described by opts, to output and commits it. ids must include an
+// identity the file is encrypted to. It reports whether a signature was
+// dropped.
+func rewrapFile(ids identityKeys, input io.ReadSeeker, output encryptOutput, opts rewrapOptions) (unsigned bool, err error) {
+	defer output.abort()
+	header, err := readHeader(input)
+	if err != nil {
+		return false, err
+	}
+	if len(header.Recipients) == 0 {
+		return false, errRewrapPassphrase
+	}
+	fileKey, err := ids.fileKey(header)
+	if err != nil {
+		return false, err
+	}
+	_, macKey := keysFromFileKey(fileKey)
+	err = header.checkHeader(macKey)
+	if err != nil {
+		return false, err
+	}
+
+	rewrapped := header
+	rewrapped.Recipients, err = removeRecipients(header.Recipients, opts.remove)
+	if err != nil {
+		return false, err
+	}
+	keyIDSize := len(header.Recipients[0].KeyID)
+	for _, r := range opts.add {
+		if hasRecipient(rewrapped.Recipients, r) {
+			continue
+		}
+		stanza, err := r.wrap(fileKey, keyIDSize, rand.Reader)
+		if err != nil {
+			return false, err
+		}
+		rewrapped.Recipients = append(rewrapped.Recipients, stanza)
+	}
+	if len(rewrapped.Recipients) == 0 {
+		return false, errRewrapEmpty
+	}
+	if opts.antiForensic || isSplit(header) {
+		// the stanzas may be shared with header, which is still needed.
+		var split []recipientStanza
+		for _, s := range rewrapped.Recipients {
+			if s.Split == nil {
+				s, err = splitStanza(s, rand.Reader)
+				if err != nil {
+					return false, err
+				}
+			}
+			split = append(split, s)
+		}
+		rewrapped.Recipients = split
+	}
+	// the output can seek, so the MAC goes back in the header.
+	rewrapped.Flags &^= flagTrailerMAC
+	rewrapped.Tag = [64]byte{}
+	rewrapped.Signer, rewrapped.Signature = [32]byte{}, [64]byte{}
+	if opts.signingKey != nil {
+		copy(rewrapped.Signer[:], opts.signingKey.Public().(ed25519.PublicKey))
+	}
+	unsigned = header.Signer != ([32]byte{}) && opts.signingKey == nil
+
+	ciphertextOffset, err := input.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	end, err := input.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if header.Flags&flagTrailerMAC != 0 {
+		end -= int64(len(header.Tag))
+		if end < ciphertextOffset {
+			return false, errBadMAC
+		}
+		_, err = input.Seek(end, io.SeekStart)
+		if err == nil {
+			_, err = io.ReadFull(input, header.Tag[:])
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = input.Seek(ciphertextOffset, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	err = rewrapped.sealHeader(macKey)
+	if err != nil {
+		return false, err
+	}
+	encodedHeader := rewrapped.encode()
+	if len(encodedHeader) > maxHeaderSize {
+		return false, errHeaderTooLarge
+	}
+	_, err = output.Write(encodedHeader)
+	if err != nil {
+		return false, err
+	}
+	oldHash, err := newFileMAC(header, macKey)
+	if err != nil {
+		return false, err
+	}
+	newHash, err := newFileMAC(rewrapped, macKey)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.CopyN(io.MultiWriter(oldHash, newHash, output), input, end-ciphertextOffset)
+	if err != nil {
+		return false, err
+	}
+	header.macDigest(oldHash)
+	rewrapped.macDigest(newHash)
+	if subtle.ConstantTimeCompare(oldHash.Sum(nil), header.Tag[:]) != 1 {
+		return false, errBadMAC
+	}
+
+	copy(rewrapped.Tag[:], newHash.Sum(nil))
+	if opts.signingKey != nil {
+		rewrapped.sign(opts.signingKey)
+	}
+	_, err = output.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	_, err = output.Write(rewrapped.encode())
+	if err != nil {
+		return false, err
+	}
+	if opts.recovery > 0 {
+		err = addRecovery(output, opts.recovery)
+		if err != nil {
+			return false, err
+		}
+	}
+	return unsigned, output.commit()
+}
+
+// removeRecipients returns stanzas without those of the removed recipients,
+// each of which must have one.
+func removeRecipients(stanzas []recipientStanza, removed []recipient) ([]recipientStanza, error) {
+	if len(removed) == 0 {
+		return stanzas, nil
+	}
+	var kept []recipientStanza
+	found := make([]bool, len(removed))
+	for _, s := range stanzas {
+		if len(s.KeyID) == 0 {
+			return nil, errRewrapHidden
+		}
+		keep := true
+		for i, r := range removed {
+			if bytes.Equal(s.KeyID, r.keyID(len(s.KeyID))) {
+				found[i] = true
+				keep = false
+			}
+		}
+		if keep {
+			kept = append(kept, s)
+		}
+	}
+	for i, r := range removed {
+		if !found[i] {
+			return nil, fmt.Errorf("%v is not a recipient of the file", r)
+		}
+	}
+	return kept, nil
+}
+
+// hasRecipient reports whether one of stanzas is for r, going by its key ID.
+func hasRecipient(stanzas []recipientStanza, r recipient) bool {
+	for _, s := range stanzas {
+		if len(s.KeyID) > 0 && bytes.Equal(s.KeyID, r.keyID(len(s.KeyID))) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRecipients parses recipients given as public keys, files of public
+// keys, or names in the keyring.
+func resolveRecipients(args []string) ([]recipient, error) {
+	var keys []string
+	for _, arg := range args {
+		if _, err := os.Stat(arg); err == nil || strings.HasPrefix(arg, publicKeyPrefix) || isSSHKey(arg) {
+			keys = append(keys, arg)
+			continue
+		}
+		named, err := keyringRecipients([]string{arg})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, named...)
+	}
+	return readRecipients(keys)
+}
+
+// rewrapMain implements `enc rewrap`, which changes the recipients of a file
+// without re-encrypting it.
+func rewrapMain(args []string) {
+	fs := newFlagSet("rewrap", "enc rewrap [-i identity file] -add-recipient [key or name] -remove-recipient [key or name] [-o output] [input]")
+	var identityFiles, addArgs, removeArgs stringList
+	fs.Var(&identityFiles, "i", "unwrap the file key with the identities in this file (default: the default identity, see enc config); may be repeated")
+	fs.Var(&addArgs, "add-recipient", "encrypt the file to this public key, the public keys listed in this file, or those stored under this name in the keyring; may be repeated")
+	fs.Var(&removeArgs, "remove-recipient", "stop encrypting the file to this public key, the public keys listed in this file, or those stored under this name in the keyring; may be repeated")
+	signFile := fs.String("sign", "", "sign the rewrapped file with this identity file or OpenSSH ed25519 private key")
+	antiForensic := fs.Bool("anti-forensic", false, "split the wrapped file keys over several KiB, so that overwriting the file destroys them more reliably (kept if the input has them)")
+	fileOutput := fs.String("o", "", "output (default: replace the input)")
+	var p prompts
+	p.register(fs, true, false)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if len(addArgs) == 0 && len(removeArgs) == 0 {
+		log.Fatal(errRewrapNothing)
+	}
+	name := positional[0]
+	if _, ok := volumeBase(name); ok {
+		log.Fatal(errRewrapVolumes)
+	}
+	output := *fileOutput
+	if output == "" {
+		output = name
+	} else {
+		p.checkOutputs(output)
+	}
+
+	opts := rewrapOptions{antiForensic: *antiForensic}
+	var err error
+	opts.add, err = resolveRecipients(addArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.remove, err = resolveRecipients(removeArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *signFile != "" {
+		opts.signingKey, err = readSigningKey(*signFile, p.unlockWith)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(identityFiles) == 0 {
+		c, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.defaultIdentity() == "" {
+			log.Fatal("-i is needed, since there is no default identity")
+		}
+		identityFiles = append(identityFiles, c.defaultIdentity())
+	}
+	ids, err := readIdentities(identityFiles, p.unlock)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f := openInput(name)
+	armored, err := isArmored(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if t, err := readRecoveryTrailer(f, stat.Size()); err == nil {
+		opts.recovery = 100 * float64(t.ParityShards) / float64(t.DataShards)
+	}
+	f.Close()
+	input := openEncryptedInput(name)
+	defer input.Close()
+	header, err := readHeader(input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = input.Seek(0, io.SeekStart)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// when the file is replaced, the old copy of split keys is overwritten
+	// through a descriptor opened before the rename, so that the stanzas of
+	// removed recipients are destroyed rather than left in free space.
+	var old *os.File
+	if output == name && (opts.antiForensic || isSplit(header)) {
+		old, err = os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	out, err := createOutput(output, encryptOptions{armor: armored})
+	if err != nil {
+		log.Fatal(err)
+	}
+	unsigned, err := rewrapFile(ids, input, out, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if old != nil {
+		err = shredOpenFile(old, stat.Size())
+		if err != nil {
+			log.Fatal("could not overwrite the old copy of the file: ", err)
+		}
+	}
+	if unsigned {
+		log.Println("warning: the signature of the file was removed, since it no longer matches; use -sign to sign it again")
+	}
+}
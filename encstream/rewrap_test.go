@@ -0,0 +1,114 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestRewrap verifies that rewrapping a file changes who can decrypt it
+// without changing its ciphertext, and that a modified file is refused.
+func TestRewrap(t *testing.T) {
+	var ids []identity
+	for i := 0; i < 4; i++ {
+		id, err := generateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	alice, bob, carol, dan := ids[0], ids[1], ids[2], ids[3]
+	plaintext := bytes.Repeat([]byte("attack at dawn "), 10000)
+
+	decrypts := func(id identity, ciphertext []byte) bool {
+		_, r, err := openCiphertext(identityKeys{id}, bytes.NewReader(ciphertext))
+		if err != nil {
+			return false
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext", err)
+		}
+		return true
+	}
+
+	// the original is written to a stream, with a trailer MAC, and signed
+	// files are covered by TestSignedFile.
+	var stream bytes.Buffer
+	opts := encryptOptions{recipients: []recipient{alice.public, bob.public, carol.public}}
+	_, _, _, err := encryptTo(nil, bytes.NewReader(plaintext), streamOutput{&stream}, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := stream.Bytes()
+
+	output := new(memoryOutput)
+	unsigned, err := rewrapFile(identityKeys{carol}, bytes.NewReader(original), output, rewrapOptions{
+		add:    []recipient{dan.public, alice.public},
+		remove: []recipient{bob.public},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsigned {
+		t.Fatal("an unsigned file reported a dropped signature")
+	}
+	rewrapped := output.buf
+	header, err := readHeader(bytes.NewReader(rewrapped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Recipients) != 3 || header.Flags&flagTrailerMAC != 0 {
+		t.Fatal("wrong recipients or flags after rewrapping", len(header.Recipients), header.Flags)
+	}
+	for _, c := range []struct {
+		id       identity
+		decrypts bool
+	}{{alice, true}, {bob, false}, {carol, true}, {dan, true}} {
+		if decrypts(c.id, rewrapped) != c.decrypts {
+			t.Fatalf("identity %v: expected decrypting to be %v", c.id.public, c.decrypts)
+		}
+	}
+	// the ciphertext itself is unchanged.
+	original, err = ciphertextOf(original, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ciphertextOf(rewrapped, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(original, ciphertext) {
+		t.Fatal("rewrapping changed the ciphertext")
+	}
+
+	_, err = rewrapFile(identityKeys{alice}, bytes.NewReader(rewrapped), new(memoryOutput), rewrapOptions{remove: []recipient{bob.public}})
+	if err == nil {
+		t.Fatal("removing a recipient the file is not encrypted to succeeded")
+	}
+	_, err = rewrapFile(identityKeys{bob}, bytes.NewReader(rewrapped), new(memoryOutput), rewrapOptions{add: []recipient{bob.public}})
+	if err == nil {
+		t.Fatal("a removed recipient rewrapped the file")
+	}
+	modified := append([]byte{}, rewrapped...)
+	modified[len(modified)-1] ^= 1
+	_, err = rewrapFile(identityKeys{alice}, bytes.NewReader(modified), new(memoryOutput), rewrapOptions{add: []recipient{bob.public}})
+	if err != errBadMAC {
+		t.Fatal("expected errBadMAC for a modified file, got", err)
+	}
+}
+
+// ciphertextOf returns the ciphertext of the encrypted file, after
+// its header and before any trailer MAC.
+func ciphertextOf(file []byte, trailer bool) ([]byte, error) {
+	r := bytes.NewReader(file)
+	_, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := file[len(file)-r.Len():]
+	if trailer {
+		ciphertext = ciphertext[:len(ciphertext)-64]
+	}
+	return ciphertext, nil
+}
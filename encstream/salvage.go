@@ -0,0 +1,581 @@
+package encstream
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Damaged files are salvaged chunk by chunk. A single damaged byte fails the
+// MAC over the whole file, but every chunk is also authenticated by the AEAD,
+// so the chunks that still open can be trusted one by one: enc verify reports
+// the ranges of chunks that do not, and the entries of an archive they fall
+// in, and enc decrypt -keep-going recovers the rest.
+//
+// A damaged chunk is replaced by as many zeros as it held, so that the
+// plaintext after it keeps its offsets. If the size of a chunk is damaged, the
+// next chunk is found by trying every offset after it, and the plaintext lost
+// in between is left out. The entries of an archive that overlap a damaged
+// chunk are left out, and the tar stream is picked up again at the next
+// intact tar header, found by its checksum.
+//
+// Before version 4, and in deduplicated files, chunks are not numbered, so
+// without the MAC nothing shows that chunks were removed, duplicated or
+// reordered: what is salvaged is authentic chunk by chunk, but not as a
+// whole. From version 4, every chunk but the last is full, so the index of a
+// chunk follows from its offset, and a chunk that was moved, or a last chunk
+// that was cut off, does not open and is reported as damaged.
+
+var (
+	// errDamaged is returned once a damaged file has been reported or
+	// salvaged.
+	errDamaged          = errors.New("the file is damaged")
+	errKeepGoingOptions = errors.New("-keep-going cannot be combined with -l, -qr, -raw, -hidden or -range")
+)
+
+// damagedRange is a run of chunks that do not authenticate, from the file
+// offset start up to end, which held the plaintext from plaintextStart up to
+// plaintextEnd. The plaintext is empty where the chunks could not be told
+// apart.
+type damagedRange struct {
+	start, end                   int64
+	plaintextStart, plaintextEnd int64
+}
+
+func (d damagedRange) String() string {
+	if d.plaintextStart == d.plaintextEnd {
+		return fmt.Sprintf("bytes %v-%v of the file (plaintext lost at %v)", d.start, d.end-1, d.plaintextStart)
+	}
+	return fmt.Sprintf("bytes %v-%v of the file (plaintext %v-%v)", d.start, d.end-1, d.plaintextStart, d.plaintextEnd-1)
+}
+
+// overlaps reports whether d overlaps the plaintext from start up to end.
+func (d damagedRange) overlaps(start, end int64) bool {
+	if d.plaintextStart == d.plaintextEnd {
+		return d.plaintextStart >= start && d.plaintextStart < end
+	}
+	return d.plaintextStart < end && d.plaintextEnd > start
+}
+
+// salvageReader decrypts a ciphertext chunk by chunk without checking the MAC,
+// reading zeros in place of the chunks that do not authenticate and recording
+// them.
+type salvageReader struct {
+	in        *bufio.Reader
+	aead      cipher.AEAD
+	aad       []byte
+	indexed   bool  // chunks are numbered, see indexedChunks
+	start     int64 // file offset of the ciphertext
+	offset    int64 // file offset of the next chunk
+	end       int64 // file offset of the end of the ciphertext
+	plaintext int64 // plaintext offset of the next chunk
+	buf       []byte
+	opened    int // chunks that authenticated
+	damaged   []damagedRange
+}
+
+// newSalvageReader returns a salvageReader of the ciphertext of input, which
+// follows header from the file offset ciphertextOffset, decrypted with sk.
+func newSalvageReader(input io.ReadSeeker, header fileHeader, sk [32]byte, ciphertextOffset int64) (*salvageReader, error) {
+	end, err := input.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if header.Flags&flagTrailerMAC != 0 {
+		end -= int64(len(header.Tag))
+	}
+	end -= header.Reserved
+	if end < ciphertextOffset {
+		return nil, errBadHeader
+	}
+	_, err = input.Seek(ciphertextOffset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	newAEAD := suiteAEAD(header.Suite)
+	if header.Version == 0 {
+		// the first chunk tells the AEAD of a legacy file, unless it is
+		// damaged too.
+		legacy, err := legacyAEAD(io.LimitReader(input, end-ciphertextOffset), sk)
+		if err == nil {
+			newAEAD = legacy
+		}
+		_, err = input.Seek(ciphertextOffset, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newAEAD(sk[:])
+	if err != nil {
+		return nil, err
+	}
+	frame := 24 + 8 + maxChunkSize + aead.Overhead()
+	return &salvageReader{
+		in:      bufio.NewReaderSize(io.LimitReader(input, end-ciphertextOffset), 2*frame),
+		aead:    aead,
+		aad:     header.chunkAAD(),
+		indexed: header.indexedChunks(),
+		start:   ciphertextOffset,
+		offset:  ciphertextOffset,
+		end:     end,
+	}, nil
+}
+
+func (s *salvageReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.offset >= s.end {
+			return 0, io.EOF
+		}
+		err := s.nextChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// chunkAt returns the size of the sealed chunk whose frame starts the
+// buffered input, or false if its size field is not one enc writes.
+func (s *salvageReader) chunkAt() (int, bool, error) {
+	frame, err := s.in.Peek(24 + 8)
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	size := binary.LittleEndian.Uint64(frame[24:])
+	overhead := uint64(s.aead.Overhead())
+	if size < overhead || size > maxChunkSize+overhead || s.offset+int64(len(frame))+int64(size) > s.end {
+		return 0, false, nil
+	}
+	return int(size), true, nil
+}
+
+// open opens the chunk of size bytes whose frame starts the buffered input.
+func (s *salvageReader) open(size int) ([]byte, error) {
+	frame, err := s.in.Peek(24 + 8 + size)
+	if err != nil {
+		return nil, err
+	}
+	aad := s.aad
+	if s.indexed {
+		// chunks before the last are full, so only a chunk at a multiple of
+		// their size from the start can open, and only the chunk that ends
+		// the ciphertext as the last.
+		full := int64(24 + 8 + maxChunkSize + s.aead.Overhead())
+		last := s.offset+int64(len(frame)) == s.end
+		if (s.offset-s.start)%full != 0 || (!last && size != maxChunkSize+s.aead.Overhead()) {
+			return nil, errBadMAC
+		}
+		aad = indexedAAD(nil, s.aad, uint64((s.offset-s.start)/full), last)
+	}
+	return s.aead.Open(nil, frame[:s.aead.NonceSize()], frame[24+8:], aad)
+}
+
+// consume moves past the frame of a chunk of size bytes that held plaintext.
+func (s *salvageReader) consume(size int, plaintext []byte) {
+	s.in.Discard(24 + 8 + size)
+	s.offset += int64(24 + 8 + size)
+	s.plaintext += int64(len(plaintext))
+	s.buf = plaintext
+}
+
+// nextChunk reads the next chunk into buf.
+func (s *salvageReader) nextChunk() error {
+	size, ok, err := s.chunkAt()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return s.resync()
+	}
+	plaintext, err := s.open(size)
+	if err == nil {
+		s.opened++
+	} else {
+		plaintext = make([]byte, size-s.aead.Overhead())
+		s.markDamaged(s.offset, s.offset+int64(24+8+size), s.plaintext, s.plaintext+int64(len(plaintext)))
+	}
+	s.consume(size, plaintext)
+	return nil
+}
+
+// resync finds the next chunk that authenticates after a damaged size field,
+// trying every offset, and marks everything before it as damaged.
+func (s *salvageReader) resync() error {
+	start := s.offset
+	for s.offset < s.end {
+		s.in.Discard(1)
+		s.offset++
+		size, ok, err := s.chunkAt()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		plaintext, err := s.open(size)
+		if err != nil {
+			continue
+		}
+		s.markDamaged(start, s.offset, s.plaintext, s.plaintext)
+		s.opened++
+		s.consume(size, plaintext)
+		return nil
+	}
+	s.markDamaged(start, s.end, s.plaintext, s.plaintext)
+	return nil
+}
+
+// markDamaged records a damaged range, joining it to the one before if they
+// are adjacent and both held plaintext.
+func (s *salvageReader) markDamaged(start, end, plaintextStart, plaintextEnd int64) {
+	if n := len(s.damaged); n > 0 && s.damaged[n-1].end == start && s.damaged[n-1].plaintextEnd == plaintextStart &&
+		s.damaged[n-1].plaintextStart != plaintextStart && plaintextStart != plaintextEnd {
+		s.damaged[n-1].end = end
+		s.damaged[n-1].plaintextEnd = plaintextEnd
+		return
+	}
+	s.damaged = append(s.damaged, damagedRange{start, end, plaintextStart, plaintextEnd})
+}
+
+// salvage is a file whose MAC did not match, to be read chunk by chunk.
+type salvage struct {
+	input            io.ReadSeeker
+	header           fileHeader
+	sk               [32]byte
+	ciphertextOffset int64
+}
+
+// openSalvage reads the header of input and checks its MAC with keys. If the
+// MAC matches, it returns the plaintext like openCiphertext. Otherwise it
+// returns a salvage of input. Either way it warns if the file has expired by
+// now.
+func openSalvage(keys keySource, input io.ReadSeeker, now time.Time) (fileHeader, *DecReader, *salvage, error) {
+	_, err := input.Seek(0, io.SeekStart)
+	if err != nil {
+		return fileHeader{}, nil, nil, err
+	}
+	header, err := readHeader(input)
+	if err != nil {
+		return fileHeader{}, nil, nil, err
+	}
+	sk, macKey, err := keys.fileKeys(header)
+	if err != nil {
+		return fileHeader{}, nil, nil, err
+	}
+	// chunks can be salvaged, but not a header that fails its own MAC,
+	// since what they hold could not be trusted.
+	err = header.checkHeader(macKey)
+	if err != nil {
+		return fileHeader{}, nil, nil, err
+	}
+	ciphertextOffset, err := input.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fileHeader{}, nil, nil, err
+	}
+	if header.expired(now) {
+		log.Println("warning: the file expired on", expiryString(header.NotAfter))
+	}
+	plaintext, err := authenticate(input, header, sk, macKey)
+	if err == errBadMAC {
+		return header, nil, &salvage{input, header, sk, ciphertextOffset}, nil
+	}
+	if err != nil {
+		return fileHeader{}, nil, nil, err
+	}
+	return header, plaintext, nil, nil
+}
+
+// scan reads every chunk of s, returning the damaged ranges. If no chunk
+// authenticates, the key is more likely wrong than the file damaged, and
+// errBadMAC is returned.
+func (s *salvage) scan() ([]damagedRange, error) {
+	r, err := newSalvageReader(s.input, s.header, s.sk, s.ciphertextOffset)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+	if r.opened == 0 && len(r.damaged) > 0 {
+		return nil, errBadMAC
+	}
+	return r.damaged, nil
+}
+
+// plaintext returns a reader of the plaintext of s, with zeros in place of
+// the damaged chunks.
+func (s *salvage) plaintext() (io.Reader, error) {
+	r, err := newSalvageReader(s.input, s.header, s.sk, s.ciphertextOffset)
+	if err != nil {
+		return nil, err
+	}
+	if s.header.Flags&flagPadded != 0 {
+		length, err := openLength(s.sk, s.header.Length)
+		if err != nil {
+			return nil, err
+		}
+		return io.LimitReader(r, length), nil
+	}
+	return r, nil
+}
+
+// report scans s and reports its damaged ranges to w.
+func (s *salvage) report(w io.Writer) ([]damagedRange, error) {
+	damaged, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	if len(damaged) == 0 {
+		fmt.Fprintln(w, "damaged: the MAC does not match, though every chunk authenticates; chunks may be missing or out of order")
+	}
+	for _, d := range damaged {
+		fmt.Fprintln(w, "damaged:", d)
+	}
+	return damaged, nil
+}
+
+// verifyChunks checks the MAC of input with keys. If it does not match, the
+// damaged chunks and, for an archive, the entries they fall in are reported
+// to w, and errDamaged is returned.
+func verifyChunks(keys keySource, input io.ReadSeeker, w io.Writer) error {
+	header, _, s, err := openSalvage(keys, input, time.Now())
+	if err != nil || s == nil {
+		return err
+	}
+	damaged, err := s.report(w)
+	if err != nil {
+		return err
+	}
+	if header.Flags&flagArchive != 0 {
+		plaintext, err := s.plaintext()
+		if err != nil {
+			return err
+		}
+		err = salvageArchive(plaintext, damaged, ioutil.Discard, w)
+		if err != nil {
+			return err
+		}
+	}
+	return errDamaged
+}
+
+// salvageFile decrypts input to finalOutput like decryptTo. If its MAC does
+// not match, the chunks that authenticate are decrypted, with zeros in place
+// of the others, and an archive is extracted without the entries they fall
+// in; the damage is reported to w, and errDamaged is returned.
+func salvageFile(keys keySource, input io.ReadSeeker, finalOutput string, opts extractOptions, w io.Writer) error {
+	header, plaintext, s, err := openSalvage(keys, input, time.Now())
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return writePlaintext(header, plaintext.secretKey, plaintext, finalOutput, opts)
+	}
+	damaged, err := s.report(w)
+	if err != nil {
+		return err
+	}
+	salvaged, err := s.plaintext()
+	if err != nil {
+		return err
+	}
+	// the zeros and the entries left out cannot match the digest.
+	header.Flags &^= flagDigest
+	if header.Flags&flagArchive != 0 {
+		pr, pw := io.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			err := salvageArchive(salvaged, damaged, pw, w)
+			pw.CloseWithError(err)
+			errs <- err
+		}()
+		err = writePlaintext(header, s.sk, pr, finalOutput, opts)
+		pr.Close()
+		if walkErr := <-errs; err == nil && walkErr != io.ErrClosedPipe {
+			err = walkErr
+		}
+	} else {
+		err = writePlaintext(header, s.sk, salvaged, finalOutput, opts)
+	}
+	if err != nil {
+		return err
+	}
+	return errDamaged
+}
+
+// salvageArchive copies the entries of the salvaged tar stream r that do not
+// overlap damaged to w, reporting the others to report, along with the
+// regular files in the manifest that were not found at all.
+func salvageArchive(r io.Reader, damaged []damagedRange, w io.Writer, report io.Writer) error {
+	br := bufio.NewReaderSize(r, 1<<16)
+	cr := &countingReader{r: br}
+	tw := tar.NewWriter(w)
+	// headers are at multiples of 512 bytes from base, until plaintext is
+	// lost in a damaged range.
+	var base int64
+	aligned := true
+	for _, d := range damaged {
+		if d.plaintextStart == d.plaintextEnd {
+			aligned = false
+		}
+	}
+	var m *manifest
+	seen := make(map[string]bool)
+	lost := make(map[string]bool)
+	var intact int
+	for {
+		tr := tar.NewReader(cr)
+		for {
+			start := base + (cr.n-base+511)&^511
+			hdr, err := tr.Next()
+			if err != nil {
+				if err != io.EOF && len(damaged) == 0 {
+					return err
+				}
+				break
+			}
+			name := path.Clean(hdr.Name)
+			end := cr.n + hdr.Size
+			bad := false
+			for _, d := range damaged {
+				if d.overlaps(start, end) {
+					bad = true
+				}
+			}
+			if hdr.Typeflag == tar.TypeLink && lost[path.Clean(hdr.Linkname)] {
+				// the file it links to was left out.
+				bad = true
+			}
+			seen[name] = true
+			if bad {
+				lost[name] = true
+				fmt.Fprintln(report, "damaged:", hdr.Name)
+				// read past it, so that the next header starts where
+				// the count says, unless plaintext was lost in it, in
+				// which case the next header is looked for from there.
+				gap := end
+				for _, d := range damaged {
+					if d.plaintextStart == d.plaintextEnd && d.plaintextStart >= cr.n && d.plaintextStart < gap {
+						gap = d.plaintextStart
+					}
+				}
+				_, err = io.CopyN(ioutil.Discard, tr, gap-cr.n)
+				if err != nil || gap < end {
+					break
+				}
+				continue
+			}
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if hdr.Name == manifestName {
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				m = new(manifest)
+				if json.Unmarshal(b, m) != nil {
+					m = nil
+				}
+				_, err = tw.Write(b)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			intact++
+			_, err = io.Copy(tw, tr)
+			if err != nil {
+				return err
+			}
+		}
+		if len(damaged) == 0 {
+			break
+		}
+		found, err := nextTarHeader(br, cr, base, aligned)
+		if err != nil {
+			return err
+		}
+		if !found {
+			break
+		}
+		base = cr.n
+	}
+	if m != nil {
+		for _, e := range m.Entries {
+			if !seen[path.Clean(e.Path)] {
+				lost[e.Path] = true
+				fmt.Fprintln(report, "missing:", e.Path)
+			}
+		}
+	}
+	delete(lost, manifestName)
+	fmt.Fprintf(report, "%v of %v entries damaged or missing\n", len(lost), len(lost)+intact)
+	return tw.Close()
+}
+
+// nextTarHeader discards what br holds up to the next block that is a tar
+// header, counting it in cr, and reports whether there is one. If aligned is
+// set, only blocks at multiples of 512 bytes from base are considered.
+func nextTarHeader(br *bufio.Reader, cr *countingReader, base int64, aligned bool) (bool, error) {
+	for {
+		window, err := br.Peek(br.Size())
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		for i := 0; i+512 <= len(window); i++ {
+			if aligned && (cr.n+int64(i)-base)%512 != 0 {
+				continue
+			}
+			if isTarHeader(window[i : i+512]) {
+				br.Discard(i)
+				cr.n += int64(i)
+				return true, nil
+			}
+		}
+		if err == io.EOF || len(window) < 512 {
+			return false, nil
+		}
+		skip := len(window) - 511
+		br.Discard(skip)
+		cr.n += int64(skip)
+	}
+}
+
+// isTarHeader reports whether block is a ustar header with a valid checksum.
+func isTarHeader(block []byte) bool {
+	if !bytes.Equal(block[257:262], []byte("ustar")) {
+		return false
+	}
+	stored, err := strconv.ParseUint(strings.Trim(string(block[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum uint64
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += uint64(b)
+	}
+	return sum == stored
+}
@@ -0,0 +1,196 @@
+package encstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chunkAt returns the file offset of the chunk of the ciphertext b, which
+// starts at start, that holds the plaintext offset target.
+func chunkAt(t *testing.T, b []byte, start int64, target int64) int64 {
+	offset, plaintext := start, int64(0)
+	for offset < int64(len(b)) {
+		n := int64(binary.LittleEndian.Uint64(b[offset+24:])) - tagSize
+		if target < plaintext+n {
+			return offset
+		}
+		plaintext += n
+		offset += 24 + 8 + n + tagSize
+	}
+	t.Fatal("no chunk holds", target)
+	return 0
+}
+
+// TestSalvageArchive verifies that the damaged entries of an archive are
+// reported and left out, and the others extracted, whether a chunk's contents
+// or its size are damaged.
+func TestSalvageArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-salvage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("0123456789abcdef"), 8192)
+	files := map[string][]byte{
+		"a.txt":   []byte("alpha"),
+		"big.bin": big,
+		"c.txt":   []byte("charlie"),
+	}
+	for name, contents := range files {
+		if err := os.MkdirAll(filepath.Join(dir, "src"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "src", name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := identityKeys{id}
+	archive := filepath.Join(dir, "archive.enc")
+	if _, err := encryptArchive(nil, filepath.Join(dir, "src"), archive, nil, encryptOptions{recipients: []recipient{id.public}}); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int64(len(header.encode()))
+
+	// find where the contents of big.bin start in the plaintext.
+	_, plaintext, err := openCiphertext(keys, bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := &countingReader{r: plaintext}
+	tr := tar.NewReader(cr)
+	var bigOffset int64
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "big.bin" {
+			bigOffset = cr.n
+			break
+		}
+	}
+	chunk := chunkAt(t, ciphertext, start, bigOffset+int64(len(big))/2)
+
+	for _, damage := range []struct {
+		name   string
+		offset int64
+	}{
+		{"contents", chunk + 100},
+		{"size", chunk + 24},
+	} {
+		damaged := append([]byte(nil), ciphertext...)
+		damaged[damage.offset] ^= 0xff
+
+		report := new(bytes.Buffer)
+		if err := verifyChunks(keys, bytes.NewReader(damaged), report); err != errDamaged {
+			t.Fatal(damage.name, "expected errDamaged, got", err)
+		}
+		if !strings.Contains(report.String(), "damaged: bytes") || !strings.Contains(report.String(), "damaged: big.bin") || strings.Contains(report.String(), "c.txt") {
+			t.Fatalf("%v: the report does not name the damage:\n%v", damage.name, report)
+		}
+
+		out := filepath.Join(dir, "out-"+damage.name)
+		report.Reset()
+		if err := salvageFile(keys, bytes.NewReader(damaged), out, extractOptions{}, report); err != errDamaged {
+			t.Fatal(damage.name, "expected errDamaged, got", err)
+		}
+		for _, name := range []string{"a.txt", "c.txt"} {
+			extracted, err := ioutil.ReadFile(filepath.Join(out, name))
+			if err != nil || !bytes.Equal(extracted, files[name]) {
+				t.Fatalf("%v: %v was not salvaged: %v", damage.name, name, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(out, "big.bin")); !os.IsNotExist(err) {
+			t.Fatal(damage.name, "the damaged file was extracted")
+		}
+		if !strings.Contains(report.String(), "1 of 3 entries damaged or missing") {
+			t.Fatalf("%v: wrong summary:\n%v", damage.name, report)
+		}
+	}
+
+	// an intact file still verifies, and a wrong key still fails the MAC.
+	if err := verifyChunks(keys, bytes.NewReader(ciphertext), ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	wrong := append([]byte(nil), ciphertext...)
+	wrong[chunk+100] ^= 0xff
+	if err := verifyChunks(wrongKey{keys}, bytes.NewReader(wrong), ioutil.Discard); err != errBadMAC {
+		t.Fatal("expected errBadMAC with the wrong key, got", err)
+	}
+}
+
+// wrongKey unwraps the file keys with ids, but returns the wrong secret key.
+type wrongKey struct {
+	ids identityKeys
+}
+
+func (w wrongKey) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	sk, macKey, err = w.ids.fileKeys(header)
+	sk[0] ^= 1
+	return sk, macKey, err
+}
+
+// TestSalvageFile verifies that a damaged chunk of a file is salvaged as
+// zeros, leaving the rest of the plaintext where it was.
+func TestSalvageFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-salvage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := bytes.Repeat([]byte("enc"), 3*maxChunkSize)
+	name := filepath.Join(dir, "file.enc")
+	if err := encrypt(nil, bytes.NewReader(input), name, 0, encryptOptions{recipients: []recipient{id.public}}); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := chunkAt(t, ciphertext, int64(len(header.encode())), maxChunkSize)
+	ciphertext[chunk+50] ^= 1
+
+	out := filepath.Join(dir, "out")
+	report := new(bytes.Buffer)
+	if err := salvageFile(identityKeys{id}, bytes.NewReader(ciphertext), out, extractOptions{}, report); err != errDamaged {
+		t.Fatal("expected errDamaged, got", err)
+	}
+	salvaged, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte(nil), input...)
+	copy(want[maxChunkSize:2*maxChunkSize], make([]byte, maxChunkSize))
+	if !bytes.Equal(salvaged, want) {
+		t.Fatal("the salvaged plaintext is wrong")
+	}
+	if !strings.Contains(report.String(), "(plaintext 16384-32767)") {
+		t.Fatalf("the report does not give the damaged range:\n%v", report)
+	}
+}
@@ -0,0 +1,99 @@
+package encstream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Instead of a passphrase, an identity file can be protected by a key the
+// operating system keeps for the user: the Secure Enclave on a Mac, or DPAPI
+// on Windows. The identity's key is sealed with it, and the identity file
+// holds the sealed key below its public key, which can still be read:
+//
+//	# public key: enc-pub-...
+//	# <how the key is sealed>
+//	<prefix of the sealer><sealed key>
+//
+// Every command that reads the identity file unseals it, which only works for
+// the user and on the machine it was made for. Files encrypted to a sealed
+// identity are like any other.
+
+var (
+	errSealOptions      = errors.New("only one of -protect, -secure-enclave, -dpapi and -openpgp-card can be given")
+	errSealedChangePass = errors.New("a sealed identity cannot be given a passphrase or taken out of its seal; generate a new identity instead")
+)
+
+// keySealer seals the keys of identities with a key the platform keeps.
+type keySealer struct {
+	flag    string // of enc keygen
+	usage   string // of the flag
+	prefix  string // of the text form of sealed keys
+	comment string // explains the identity file
+	// seal returns the text form of secret, sealed, without prefix.
+	seal func(secret []byte) (string, error)
+	// unseal returns the secret sealed in the text form key, explaining to
+	// the user that it is needed to reason if it asks them.
+	unseal func(key string, reason string) ([]byte, error)
+}
+
+// keySealers are the ways identities can be sealed.
+var keySealers = []keySealer{enclaveSealer, dpapiSealer}
+
+// sealedIdentityContents seals id with s, and returns the contents of its
+// identity file.
+func sealedIdentityContents(s keySealer, id identity) (string, error) {
+	key, err := s.seal(id.secret[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v%v\n%v\n%v%v\n", publicKeyComment, id.public, s.comment, s.prefix, key), nil
+}
+
+// isSealed reports whether the identity file contents hold sealed keys.
+func isSealed(contents []byte) bool {
+	for _, s := range keySealers {
+		if bytes.Contains(contents, []byte(s.prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsealIdentities unseals the identities in the contents of the identity
+// file name.
+func unsealIdentities(name string, contents string) ([]identity, error) {
+	lines, err := keyLines(strings.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	var ids []identity
+	for _, line := range lines {
+		secret, err := unsealKey(line, fmt.Sprintf("decrypt with the identity %v", filepath.Base(name)))
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) != 32 {
+			return nil, errBadKey
+		}
+		var id identity
+		copy(id.secret[:], secret)
+		curve25519.ScalarBaseMult((*[32]byte)(&id.public), &id.secret)
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// unsealKey returns the secret sealed in the text form of a sealed key.
+func unsealKey(line string, reason string) ([]byte, error) {
+	for _, s := range keySealers {
+		if key, ok := strings.CutPrefix(line, s.prefix); ok {
+			return s.unseal(key, reason)
+		}
+	}
+	return nil, errBadKey
+}
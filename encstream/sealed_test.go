@@ -0,0 +1,60 @@
+package encstream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSealedIdentityFile verifies that keys sealed by the Secure Enclave
+// round trip through their text form, and that the public key of an identity
+// file holding a sealed key is read without unsealing it, while unsealing a
+// key that no enclave or account sealed fails.
+func TestSealedIdentityFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, sealed := []byte("handle to a key"), []byte("sealed secret key")
+	key := enclaveKeyString(handle, sealed)
+	h, s, err := parseEnclaveKey(key)
+	if err != nil || !bytes.Equal(h, handle) || !bytes.Equal(s, sealed) {
+		t.Fatal("the sealed key was parsed differently:", err)
+	}
+	for _, bad := range []string{"", "aGFuZGxl", ".c2VhbGVk", id.String()} {
+		if _, _, err := parseEnclaveKey(bad); err != errBadKey {
+			t.Fatalf("%q: expected errBadKey, got %v", bad, err)
+		}
+	}
+
+	for _, sealer := range keySealers {
+		name := filepath.Join(dir, sealer.flag)
+		contents := publicKeyComment + id.public.String() + "\n" + sealer.comment + "\n" + sealer.prefix + key + "\n"
+		if err := ioutil.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if !isSealed([]byte(contents)) || isProtected([]byte(contents)) {
+			t.Fatal(name, "was not recognized as sealed")
+		}
+		keys, err := identityPublicKeys(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0] != id.public.String() {
+			t.Fatal("wrong public keys", keys)
+		}
+		if _, err := readIdentities([]string{name}, nil); err == nil {
+			t.Fatal(name, "was unsealed, but nothing sealed it")
+		}
+	}
+	if isSealed([]byte(id.String())) {
+		t.Fatal("a plain identity was taken for a sealed one")
+	}
+}
@@ -0,0 +1,93 @@
+package encstream
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// The first versions of enc sealed chunks with NaCl's secretbox,
+// XSalsa20-Poly1305, rather than XChaCha20-Poly1305, behind the same
+// unversioned header and with the same framing: a random 24 byte nonce, the
+// size of the sealed chunk and the sealed chunk. Nothing records which was
+// used, so for files with the unversioned header, once the MAC over the whole
+// file has been checked, the first chunk is opened with each to tell them
+// apart. enc only reads secretbox chunks; it never writes them.
+
+var errSecretboxOpen = errors.New("secretbox: message authentication failed")
+
+// secretboxAEAD adapts secretbox to cipher.AEAD, for a DecReader. It has no
+// additional data.
+type secretboxAEAD struct {
+	key [32]byte
+}
+
+// newSecretbox returns a cipher.AEAD that seals with secretbox under key.
+func newSecretbox(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("secretbox: bad key length")
+	}
+	var a secretboxAEAD
+	copy(a.key[:], key)
+	return &a, nil
+}
+
+func (a *secretboxAEAD) NonceSize() int { return 24 }
+func (a *secretboxAEAD) Overhead() int  { return secretbox.Overhead }
+
+func (a *secretboxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(additionalData) > 0 {
+		panic("secretbox: additional data is not supported")
+	}
+	// secretbox does not seal in place, as cipher.AEAD allows.
+	return append(dst, secretbox.Seal(nil, plaintext, (*[24]byte)(nonce), &a.key)...)
+}
+
+func (a *secretboxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) > 0 {
+		return nil, errSecretboxOpen
+	}
+	plaintext, ok := secretbox.Open(nil, ciphertext, (*[24]byte)(nonce), &a.key)
+	if !ok {
+		return nil, errSecretboxOpen
+	}
+	return append(dst, plaintext...), nil
+}
+
+// legacyAEAD returns the AEAD the chunks of an unversioned file, read from r,
+// are sealed with under sk: XChaCha20-Poly1305 unless only secretbox opens the
+// first chunk.
+func legacyAEAD(r io.Reader, sk [32]byte) (func(key []byte) (cipher.AEAD, error), error) {
+	var frame [24 + 8]byte
+	_, err := io.ReadFull(r, frame[:])
+	if err == io.EOF {
+		// no chunks at all.
+		return chacha20poly1305.NewX, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint64(frame[24:])
+	if size > maxChunkSize+chacha20poly1305.Overhead {
+		return chacha20poly1305.NewX, nil
+	}
+	sealed := make([]byte, size)
+	_, err = io.ReadFull(r, sealed)
+	if err != nil {
+		return chacha20poly1305.NewX, nil
+	}
+	for _, newAEAD := range []func(key []byte) (cipher.AEAD, error){chacha20poly1305.NewX, newSecretbox} {
+		aead, err := newAEAD(sk[:])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := aead.Open(nil, frame[:24], sealed, nil); err == nil {
+			return newAEAD, nil
+		}
+	}
+	return chacha20poly1305.NewX, nil
+}
@@ -0,0 +1,72 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// legacyFile writes plaintext in the unversioned format of the first versions
+// of enc, with chunks sealed by newAEAD.
+func legacyFile(t *testing.T, passphrase []byte, plaintext []byte, newAEAD func(key []byte) (cipher.AEAD, error)) []byte {
+	header := legacyHeader{ArgonTime: 1, ArgonMemory: 64, ArgonLanes: 1}
+	if _, err := rand.Read(header.Salt[:]); err != nil {
+		t.Fatal(err)
+	}
+	sk, macKey := deriveKeys(passphrase, fileHeader{Salt: header.Salt, ArgonTime: 1, ArgonMemory: 64, ArgonLanes: 1})
+	aead, err := newAEAD(sk[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ciphertext bytes.Buffer
+	for len(plaintext) > 0 {
+		n := len(plaintext)
+		if n > maxChunkSize {
+			n = maxChunkSize
+		}
+		var nonce [24]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			t.Fatal(err)
+		}
+		sealed := aead.Seal(nil, nonce[:], plaintext[:n], nil)
+		ciphertext.Write(nonce[:])
+		binary.Write(&ciphertext, binary.LittleEndian, uint64(len(sealed)))
+		ciphertext.Write(sealed)
+		plaintext = plaintext[n:]
+	}
+	mac, _ := blake2b.New512(macKey[:])
+	mac.Write(ciphertext.Bytes())
+	copy(header.Tag[:], mac.Sum(nil))
+	var file bytes.Buffer
+	binary.Write(&file, binary.LittleEndian, header)
+	file.Write(ciphertext.Bytes())
+	return file.Bytes()
+}
+
+// TestLegacySecretbox verifies that files of the first versions of enc
+// decrypt whether their chunks were sealed with secretbox or
+// XChaCha20-Poly1305.
+func TestLegacySecretbox(t *testing.T) {
+	passphrase := []byte("hunter2")
+	plaintext := make([]byte, 2*maxChunkSize+1000)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	for _, newAEAD := range []func(key []byte) (cipher.AEAD, error){newSecretbox, chacha20poly1305.NewX} {
+		for _, input := range [][]byte{plaintext, nil} {
+			file := legacyFile(t, passphrase, input, newAEAD)
+			decrypted, err := decryptToMemory(newPassphraseKeys(passphrase), bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, input) {
+				t.Fatal("the legacy file decrypted to something else")
+			}
+		}
+	}
+}
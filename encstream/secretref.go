@@ -0,0 +1,178 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// -passphrase-ref reads the passphrase from a secret manager, named by a
+// reference such as op://vault/item/field, through the manager's CLI:
+//
+//	op://vault/item/field    op read, for 1Password
+//	bw://item[/field]        bw get, for Bitwarden; the password by default
+//	pass://entry             pass show, for password-store
+//
+// The CLIs have to be signed in, or unlocked, beforehand, and are run without
+// a terminal to prompt at, so a session that is missing or has expired fails
+// with an error that says how to set it up rather than with a hang.
+
+var (
+	errBadSecretRef = errors.New("-passphrase-ref must be a reference like op://vault/item/field, bw://item/field or pass://entry")
+	errNoSecret     = errors.New("the secret manager returned an empty passphrase")
+)
+
+// secretProvider reads secrets through the CLI of a secret manager.
+type secretProvider struct {
+	name string // of the manager, for errors
+	// command returns the command that prints the secret at path, the part
+	// of the reference after the scheme.
+	command func(path string) ([]string, error)
+	// secret returns the secret in the output of the command, or its first
+	// line if nil.
+	secret func(out []byte, path string) ([]byte, error)
+	// sessionErrors are what the CLI prints when it has no session.
+	sessionErrors []sessionError
+}
+
+// sessionError is a message of a CLI that has no session, in lower case, and
+// how to set one up.
+type sessionError struct {
+	message, fix string
+}
+
+// secretProviders are the secret managers of -passphrase-ref, by scheme.
+var secretProviders = map[string]secretProvider{
+	"op": {
+		name: "1Password",
+		command: func(path string) ([]string, error) {
+			if strings.Count(path, "/") < 2 {
+				return nil, errBadSecretRef
+			}
+			return []string{"op", "read", "--no-newline", "op://" + path}, nil
+		},
+		sessionErrors: []sessionError{
+			{"not currently signed in", "sign in with eval $(op signin), or set OP_SERVICE_ACCOUNT_TOKEN"},
+			{"no accounts configured", "add an account with op account add, or set OP_SERVICE_ACCOUNT_TOKEN"},
+			{"session expired", "sign in again with eval $(op signin)"},
+			{"authorization prompt", "approve the request in the 1Password app, or set OP_SERVICE_ACCOUNT_TOKEN"},
+		},
+	},
+	"bw": {
+		name:    "Bitwarden",
+		command: bitwardenCommand,
+		secret:  bitwardenSecret,
+		sessionErrors: []sessionError{
+			{"not logged in", "log in with bw login"},
+			{"vault is locked", "unlock it with bw unlock, and export the BW_SESSION it prints"},
+			{"session key is invalid", "unlock it again with bw unlock, and export the BW_SESSION it prints"},
+		},
+	},
+	"pass": {
+		name: "password-store",
+		command: func(path string) ([]string, error) {
+			return []string{"pass", "show", path}, nil
+		},
+	},
+}
+
+// bitwardenFields are the fields bw get reads on its own; others are custom
+// fields of the item.
+var bitwardenFields = map[string]bool{"password": true, "username": true, "notes": true, "totp": true, "uri": true}
+
+// bitwardenCommand returns the bw get command for the item and field of
+// path: the last element names the field, if there is more than one.
+func bitwardenCommand(path string) ([]string, error) {
+	item, field := path, "password"
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		item, field = path[:i], path[i+1:]
+	}
+	if item == "" || field == "" {
+		return nil, errBadSecretRef
+	}
+	if !bitwardenFields[field] {
+		field = "item"
+	}
+	return []string{"bw", "get", "--nointeraction", field, item}, nil
+}
+
+// bitwardenSecret returns the secret bw get printed for path, looking up a
+// custom field in the item it printed.
+func bitwardenSecret(out []byte, path string) ([]byte, error) {
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 || bitwardenFields[path[i+1:]] {
+		return firstLine(out), nil
+	}
+	field := path[i+1:]
+	var item struct {
+		Fields []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(out, &item); err != nil {
+		return nil, fmt.Errorf("bw get item printed an item that cannot be read: %v", err)
+	}
+	for _, f := range item.Fields {
+		if f.Name == field {
+			return []byte(f.Value), nil
+		}
+	}
+	return nil, fmt.Errorf("the Bitwarden item %v has no field %v", path[:i], field)
+}
+
+// readSecretRef returns the secret that ref refers to.
+func readSecretRef(ref string) ([]byte, error) {
+	i := strings.Index(ref, "://")
+	if i < 0 {
+		return nil, errBadSecretRef
+	}
+	provider, ok := secretProviders[ref[:i]]
+	path := ref[i+len("://"):]
+	if !ok || path == "" {
+		return nil, errBadSecretRef
+	}
+	args, err := provider.command(path)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("%v: the %v CLI, %v, is not installed", ref, provider.name, args[0])
+	}
+	if err != nil {
+		return nil, provider.commandError(ref, stderr.String(), err)
+	}
+	secret := firstLine(out)
+	if provider.secret != nil {
+		secret, err = provider.secret(out, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(secret) == 0 {
+		return nil, errNoSecret
+	}
+	return secret, nil
+}
+
+// commandError returns the error of a failed command of the provider, which
+// printed stderr, telling how to set up a session if it has none.
+func (p secretProvider) commandError(ref string, stderr string, err error) error {
+	message := strings.ToLower(stderr)
+	for _, e := range p.sessionErrors {
+		if strings.Contains(message, e.message) {
+			return fmt.Errorf("%v: the %v CLI has no session to read it with; %v", ref, p.name, e.fix)
+		}
+	}
+	if line := firstLine([]byte(strings.TrimSpace(stderr))); len(line) > 0 {
+		return fmt.Errorf("%v: %s", ref, line)
+	}
+	return fmt.Errorf("%v: %v", ref, err)
+}
@@ -0,0 +1,79 @@
+package encstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSecretRef verifies that -passphrase-ref reads secrets through stand-ins
+// for the 1Password and Bitwarden CLIs, including custom Bitwarden fields,
+// and that a CLI without a session, a CLI that is not installed and bad
+// references fail with errors that say so.
+func TestSecretRef(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-secretref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scripts := map[string]string{
+		"op": `[ -n "$SIGNED_OUT" ] && { echo '[ERROR] 2024/01/01 00:00:00 You are not currently signed in. Please run ` + "`op signin --help`" + `' >&2; exit 1; }
+[ "$1 $2 $3" = "read --no-newline op://vault/item/password" ] || { echo "[ERROR] could not read secret '$3': no such item" >&2; exit 1; }
+printf 'op secret'`,
+		"bw": `[ -n "$SIGNED_OUT" ] && { echo 'Vault is locked.' >&2; exit 1; }
+[ "$1 $2" = "get --nointeraction" ] || exit 1
+case "$3 $4" in
+"password server") echo 'bw secret' ;;
+"item server") echo '{"name":"server","fields":[{"name":"backup key","value":"custom secret"}]}' ;;
+*) echo 'Not found.' >&2; exit 1 ;;
+esac`,
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+
+	for ref, want := range map[string]string{
+		"op://vault/item/password": "op secret",
+		"bw://server":              "bw secret",
+		"bw://server/password":     "bw secret",
+		"bw://server/backup key":   "custom secret",
+	} {
+		p := prompts{passphraseRef: ref}
+		got, err := p.readPassphraseSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%v read as %q, wanted %q", ref, got, want)
+		}
+	}
+
+	for ref, want := range map[string]string{
+		"op://vault/item/missing": "no such item",
+		"bw://server/other":       "has no field other",
+		"bw://elsewhere":          "Not found.",
+		"pass://backups/enc":      "not installed",
+		"op://vault":              errBadSecretRef.Error(),
+		"bw://":                   errBadSecretRef.Error(),
+		"ftp://vault/item/field":  errBadSecretRef.Error(),
+	} {
+		if _, err := readSecretRef(ref); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%v: expected an error with %q, got %v", ref, want, err)
+		}
+	}
+
+	t.Setenv("SIGNED_OUT", "1")
+	for ref, want := range map[string]string{
+		"op://vault/item/password": "op signin",
+		"bw://server":              "bw unlock",
+	} {
+		if _, err := readSecretRef(ref); err == nil || !strings.Contains(err.Error(), "no session") || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%v: expected an error that says to run %v, got %v", ref, want, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// `enc selftest` checks a deployed binary on its platform before it is
+// trusted with backups: every primitive enc uses is run against published
+// known-answer vectors, frozen golden files are decrypted, and fresh files are
+// round-tripped through each format variant.
+//
+// Regulated deployments may also require the primitives to be tested each
+// time enc starts, like the power-on self tests of FIPS 140. SelfTest runs
+// the known-answer tests alone, which take milliseconds, for programs that
+// embed enc, and -selftest-on-start runs it before enc watch and enc receive
+// start.
+
+// selfTest is a single check run by `enc selftest`.
+type selfTest struct {
+	name string
+	run  func() error
+}
+
+var (
+	errKnownAnswer    = errors.New("output does not match the known answer")
+	errSelfTestFailed = errors.New("the self test failed, so enc refuses to encrypt or decrypt")
+)
+
+// startupFailure is the error of the SelfTest that failed, if one did.
+var startupFailure struct {
+	sync.Mutex
+	err error
+}
+
+// goldenPlaintext is the plaintext of the golden files.
+const goldenPlaintext = "enc known-answer test\n"
+
+// goldenFiles were encrypted with the passphrase "enc selftest", using cheap
+// KDF parameters so that they decrypt quickly.
+var goldenFiles = map[string]string{
+	"default suite": "656e630001012900930345dfb24ba774e4458722db11188efb5ce5e91c1447078ad3cca1d9860ed001000000400000000100ba6d120291f5d8862c954c1bd1be2a52b14a20712eca56a07c0819b631951be3cf78d9d5886bdc929bec799844675e5fd55b8eb59e0d41b8b817b8a0545988841f24720453f342062e6c04aea32f7bc30a2b040c87ba196626000000000000008986799d7597c28075f53b2d3c793387b63362d2f98d0d2ba8c27892a704f35181cfcf27deaf",
+	"aes-gcm suite": "656e63000107010002012900580f22703c63cd7d60be49126e5f3a990ee4b1b83411e6115ba5738588b8ec2e010000004000000001004e1ad444a17e5e246dec6013bdd25dc4d3f43cbb525d4599137041d1d2e79691daae056fa81247529f986681e4e8d12d22e1fe98ea7e8558ffd422b372ff616e35cfea26a18fc97c65d5a11f000000000000000000000000260000000000000094653a2bc42485512c02d83ffce60a34aea4390cb66d58e66f7f3bd323ed870d862a99aaf840",
+	"fips suite":    "656e63000107010001082400347171274f73a8b5f63b4c9cde3494f5e0e375fba06795a7417b724202d24cf8e803000000093c25b83965bc4c0cd284a3a019c1c4f20163e06929783674842fb294c33ba19e6beccbd9ea85abba95dcd27793d844701faca34b78652352fc2be1a2244a3919ef30735339e84e031562f60000000000000000000000002600000000000000979404263d4e5c2e96ec2475be967ae0d3d8c97aaa0d26c844c97f67f1e07baff2fb7e0ff1cc",
+}
+
+// knownAnswer compares got to the hex encoded want.
+func knownAnswer(got []byte, want string) error {
+	if hex.EncodeToString(got) != want {
+		return errKnownAnswer
+	}
+	return nil
+}
+
+// unhex decodes a hex constant of a test vector.
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// primitiveTests returns the known-answer tests of the primitives, which
+// SelfTest runs.
+func primitiveTests() []selfTest {
+	return []selfTest{
+		{"argon2id", func() error {
+			// from the reference implementation, as used by x/crypto.
+			return knownAnswer(argon2.IDKey([]byte("password"), []byte("somesalt"), 2, 64, 2, 24), "350ac37222f436ccb5c0972f1ebd3bf6b958bf2071841362")
+		}},
+		{"xchacha20-poly1305", func() error {
+			// draft-irtf-cfrg-xchacha-01, appendix A.3.1.
+			aead, err := chacha20poly1305.NewX(unhex("808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f"))
+			if err != nil {
+				return err
+			}
+			plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+			ciphertext := aead.Seal(nil, unhex("404142434445464748494a4b4c4d4e4f5051525354555657"), plaintext, unhex("50515253c0c1c2c3c4c5c6c7"))
+			return knownAnswer(ciphertext, "bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b4522f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff921f9664c97637da9768812f615c68b13b52ec0875924c1c7987947deafd8780acf49")
+		}},
+		{"blake2b-512", func() error {
+			// RFC 7693, appendix A.
+			sum := blake2b.Sum512([]byte("abc"))
+			return knownAnswer(sum[:], "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923")
+		}},
+		{"keyed blake2b-512", func() error {
+			// the first keyed vector of the BLAKE2 reference KAT.
+			key := make([]byte, 64)
+			for i := range key {
+				key[i] = byte(i)
+			}
+			hash, err := blake2b.New512(key)
+			if err != nil {
+				return err
+			}
+			return knownAnswer(hash.Sum(nil), "10ebb67700b1868efb4417987acf4690ae9d972fb7a590c2f02871799aaa4786b5e996e8f0f4eb981fc214b005f42d2ff4233499391653df7aefcbc13fc51568")
+		}},
+		{"x25519", func() error {
+			// RFC 7748, section 5.2.
+			out, err := curve25519.X25519(unhex("a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4"), unhex("e6db6867583030db3594c1a424b15f7c726624ec26b3353b10a903a6d0ab1c4c"))
+			if err != nil {
+				return err
+			}
+			return knownAnswer(out, "c3da55379de9c6908e94ea4df28d084f32eccf03491c71f754b4075577a28552")
+		}},
+		{"pbkdf2-hmac-sha256", func() error {
+			key, err := pbkdf2.Key(sha256.New, "password", []byte("salt"), 4096, 32)
+			if err != nil {
+				return err
+			}
+			return knownAnswer(key, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a")
+		}},
+		{"aes-256-gcm", func() error {
+			// test case 14 of the GCM specification.
+			aead, err := newGCM(make([]byte, 32))
+			if err != nil {
+				return err
+			}
+			return knownAnswer(aead.Seal(nil, make([]byte, 12), make([]byte, 16), nil), "cea7403d4d606b6e074ec5d3baf39d18d0d1c8a799996bf0265b98b5d48ab919")
+		}},
+		{"hmac-sha-512", func() error {
+			// RFC 4231, test case 2.
+			mac := hmac.New(sha512.New, []byte("Jefe"))
+			mac.Write([]byte("what do ya want for nothing?"))
+			return knownAnswer(mac.Sum(nil), "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea2505549758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737")
+		}},
+	}
+}
+
+// selfTests returns every check run by `enc selftest`.
+func selfTests() []selfTest {
+	tests := primitiveTests()
+	for _, name := range []string{"default suite", "fips suite", "aes-gcm suite"} {
+		golden := unhex(goldenFiles[name])
+		tests = append(tests, selfTest{"golden file, " + name, func() error {
+			return decryptsTo(newPassphraseKeys([]byte("enc selftest")), golden, []byte(goldenPlaintext))
+		}})
+	}
+	tests = append(tests,
+		selfTest{"round trip, recipients", func() error { return roundTrip(new(memoryOutput), false) }},
+		selfTest{"round trip, trailer mac", func() error { return roundTrip(streamOutput{new(bytes.Buffer)}, false) }},
+		selfTest{"round trip, fips suite", func() error { return roundTrip(new(memoryOutput), true) }},
+	)
+	return tests
+}
+
+// decryptsTo checks that the file ciphertext decrypts to plaintext, and that
+// a modified copy of it does not.
+func decryptsTo(keys keySource, ciphertext []byte, plaintext []byte) error {
+	_, r, err := openCiphertext(keys, bytes.NewReader(ciphertext))
+	if err != nil {
+		return err
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		return errKnownAnswer
+	}
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := openCiphertext(keys, bytes.NewReader(tampered)); err != errBadMAC {
+		return fmt.Errorf("a modified file was not rejected: %v", err)
+	}
+	return nil
+}
+
+// roundTrip encrypts a fresh plaintext to output, either with the FIPS suite
+// or to a new recipient, and checks that it decrypts again.
+func roundTrip(output encryptOutput, fips bool) error {
+	plaintext := make([]byte, maxChunkSize*2+1)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	opts := encryptOptions{fips: fips}
+	var keys keySource = newPassphraseKeys([]byte("enc selftest"))
+	if !fips {
+		id, err := generateIdentity()
+		if err != nil {
+			return err
+		}
+		opts.recipients = []recipient{id.public}
+		keys = identityKeys{id}
+	}
+	_, _, _, err := encryptTo([]byte("enc selftest"), bytes.NewReader(plaintext), output, 0, opts)
+	if err != nil {
+		return err
+	}
+	var ciphertext []byte
+	switch o := output.(type) {
+	case *memoryOutput:
+		ciphertext = o.buf
+	case streamOutput:
+		ciphertext = o.Writer.(*bytes.Buffer).Bytes()
+	}
+	return decryptsTo(keys, ciphertext, plaintext)
+}
+
+// runSelfTests runs every self test, reporting each to w, and fails if any
+// of them did.
+func runSelfTests(w io.Writer) error {
+	failed := 0
+	for _, test := range selfTests() {
+		err := test.run()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %v: %v\n", test.name, err)
+			continue
+		}
+		fmt.Fprintln(w, "ok  ", test.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v self tests failed", failed)
+	}
+	return nil
+}
+
+// SelfTest runs the known-answer tests of the AEADs, KDFs, MACs and key
+// agreement enc uses, for deployments that must test them before use. If any
+// fails, it returns an error naming them, and Encrypt and Decrypt fail from
+// then on, even if a later SelfTest passes.
+func SelfTest() error {
+	return runStartupTests(primitiveTests())
+}
+
+// runStartupTests runs tests for SelfTest.
+func runStartupTests(tests []selfTest) error {
+	var failed []string
+	for _, test := range tests {
+		if err := test.run(); err != nil {
+			failed = append(failed, test.name)
+		}
+	}
+	startupFailure.Lock()
+	defer startupFailure.Unlock()
+	if len(failed) > 0 && startupFailure.err == nil {
+		startupFailure.err = fmt.Errorf("%v: %v", errSelfTestFailed, strings.Join(failed, ", "))
+	}
+	return startupFailure.err
+}
+
+// checkSelfTest returns the error of the SelfTest that failed, if one did.
+func checkSelfTest() error {
+	startupFailure.Lock()
+	defer startupFailure.Unlock()
+	return startupFailure.err
+}
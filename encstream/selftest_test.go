@@ -0,0 +1,37 @@
+package encstream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestSelfTests verifies that every self test passes on this platform.
+func TestSelfTests(t *testing.T) {
+	out := new(bytes.Buffer)
+	if err := runSelfTests(out); err != nil {
+		t.Fatal(err, "\n", out)
+	}
+}
+
+// TestSelfTestFailsClosed verifies that SelfTest passes, and that once a
+// startup self test has failed, Encrypt and Decrypt refuse to run.
+func TestSelfTestFailsClosed(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { startupFailure.err = nil }()
+	broken := []selfTest{{"broken", func() error { return errKnownAnswer }}}
+	if err := runStartupTests(broken); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatal("expected the broken test to be named, got", err)
+	}
+	if err := SelfTest(); err == nil {
+		t.Fatal("a passing self test cleared the failure")
+	}
+	if err := Encrypt([]byte("passphrase"), strings.NewReader("plaintext"), "-"); err == nil || !strings.Contains(err.Error(), errSelfTestFailed.Error()) {
+		t.Fatal("Encrypt ran after the self test failed:", err)
+	}
+	if err := Decrypt([]byte("passphrase"), "missing.enc", "-"); err == nil || !strings.Contains(err.Error(), errSelfTestFailed.Error()) {
+		t.Fatal("Decrypt ran after the self test failed:", err)
+	}
+}
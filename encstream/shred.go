@@ -0,0 +1,79 @@
+package encstream
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errRemoveOutput = errors.New("refusing to remove the input, since the output is stored within it")
+
+// removeInput removes the plaintext at path, which may be a directory, once
+// it has been encrypted. With shred, every regular file is first overwritten
+// with random data. Shredding is best effort only: copy-on-write and
+// journaling filesystems, SSDs, snapshots and backups can all keep copies of
+// the original data.
+func removeInput(path string, shred bool) error {
+	if shred {
+		err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			return shredFile(name, info.Size())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+// shredFile overwrites the first size bytes of the named file with random
+// data.
+func shredFile(name string, size int64) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return shredOpenFile(f, size)
+}
+
+// shredOpenFile overwrites the first size bytes of f, which must be open for
+// writing, with random data and closes it.
+func shredOpenFile(f *os.File, size int64) error {
+	_, err := io.CopyN(f, rand.Reader, size)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// contains reports whether name is path itself or lies within the directory
+// path.
+func contains(path string, name string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(path, name)
+	if err != nil {
+		return false, err
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
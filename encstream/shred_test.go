@@ -0,0 +1,43 @@
+package encstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRemoveInput verifies that removeInput overwrites and removes a
+// directory tree without following symlinks out of it.
+func TestRemoveInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-shred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := ioutil.WriteFile(outside, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "input")
+	if err := os.MkdirAll(filepath.Join(input, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(input, "sub", "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(input, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeInput(input, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(input); !os.IsNotExist(err) {
+		t.Fatal("input was not removed")
+	}
+	contents, err := ioutil.ReadFile(outside)
+	if err != nil || string(contents) != "keep me" {
+		t.Fatal("the target of a symlink was modified:", err)
+	}
+}
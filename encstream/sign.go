@@ -0,0 +1,407 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Detached signatures authenticate a file, encrypted or not, to anyone who
+// holds the signer's public key, without any decryption key. They are
+// Ed25519ph signatures over the SHA-512 of the file, so that large files are
+// signed and verified in one streaming pass, stored as a small armored file:
+//
+//	-----BEGIN ENC SIGNATURE-----
+//	<base64 of a version byte, the signer key and the signature, wrapped at 64 columns>
+//	-----END ENC SIGNATURE-----
+//
+// An encrypted file can also carry a signature in its header, made with
+// -sign. It signs the authenticated part of the header, which names the
+// signer, followed by the MAC, which in turn covers the header and the whole
+// ciphertext. Decrypting with -require-signer checks it before deriving the
+// keys, and the MAC is checked before any plaintext is released, so a
+// substituted or modified file is refused even if it was encrypted with the
+// right key.
+//
+// Files are signed with an identity file. Its Ed25519 signing key is derived
+// from the secret of the first identity in it, and its public half, the
+// signer key, is what verifiers check against; an OpenSSH ed25519 private key
+// signs with the key itself, and verifies against its ssh-ed25519 public key.
+
+const (
+	signerKeyPrefix  = "enc-signer-"
+	signatureBegin   = "-----BEGIN ENC SIGNATURE-----"
+	signatureEnd     = "-----END ENC SIGNATURE-----"
+	signatureVersion = 1
+
+	// signatureContext and fileSignatureContext separate detached and
+	// embedded signatures from each other, and from any other use of the
+	// same Ed25519 key.
+	signatureContext     = "enc detached signature"
+	fileSignatureContext = "enc file signature"
+)
+
+var (
+	errSignature       = errors.New("invalid signature file")
+	errBadSignature    = errors.New("the signature does not match the file; it was modified, or signed with a different key")
+	errUnknownSigner   = errors.New("the file was signed by a key that is not among the accepted signers")
+	errNoSigners       = errors.New("verify-sig needs at least one -signer key")
+	errSignatureFormat = errors.New("unsupported signature version")
+	errUnsigned        = errors.New("the file is not signed, but -require-signer was given")
+	errSignerRange     = errors.New("-require-signer cannot be combined with -range, which does not authenticate the whole file")
+	errSignerFormat    = errors.New("-require-signer only applies to enc files; openpgp and openssl files carry no enc signature")
+)
+
+// signatureOptions are the Ed25519ph options of detached signatures, and
+// fileSignatureOptions the Ed25519ctx options of embedded ones.
+var (
+	signatureOptions     = &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext}
+	fileSignatureOptions = &ed25519.Options{Context: fileSignatureContext}
+)
+
+// signingKey returns the Ed25519 signing key derived from id.
+func (id identity) signingKey() ed25519.PrivateKey {
+	seed := subkey(id.secret, "enc signing key")
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// signerKeyString returns the text form of an Ed25519 public key.
+func signerKeyString(public ed25519.PublicKey) string {
+	return signerKeyPrefix + base64.RawURLEncoding.EncodeToString(public)
+}
+
+// parseSignerKey parses the text form of a signer key, or an ssh-ed25519
+// public key.
+func parseSignerKey(s string) (ed25519.PublicKey, error) {
+	if isSSHKey(s) {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, errSSHKeyType
+		}
+		public, ok := k.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, errSSHKeyType
+		}
+		return public, nil
+	}
+	key, err := parseKey(s, signerKeyPrefix)
+	return ed25519.PublicKey(key[:]), err
+}
+
+// readSignerKeys parses signer keys, each given either directly or as the
+// name of a file listing them.
+func readSignerKeys(args []string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, arg := range args {
+		lines := []string{arg}
+		if !strings.HasPrefix(arg, signerKeyPrefix) && !isSSHKey(arg) {
+			var err error
+			lines, err = readKeyFile(arg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, line := range lines {
+			key, err := parseSignerKey(line)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", line, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// readSigningKey returns the signing key of the named identity file,
+// unlocking it with unlock if it is protected with a passphrase.
+func readSigningKey(name string, unlock func(name string, open func(passphrase []byte) error) error) (ed25519.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var key ed25519.PrivateKey
+	switch {
+	case isSSHPrivateKey(contents):
+		if !isProtected(contents) {
+			key, err = parseSSHSigningKey(contents, nil)
+			break
+		}
+		err = unlock(name, func(passphrase []byte) (err error) {
+			key, err = parseSSHSigningKey(contents, passphrase)
+			return err
+		})
+	case isCardIdentity(contents):
+		err = errCardSigning
+	default:
+		var ids []identity
+		if isSealed(contents) {
+			ids, err = unsealIdentities(name, string(contents))
+		} else if !isProtected(contents) {
+			ids, err = parseIdentities(bytes.NewReader(contents))
+		} else {
+			err = unlock(name, func(passphrase []byte) (err error) {
+				ids, err = unlockIdentities(string(contents), passphrase)
+				return err
+			})
+		}
+		if err == nil && len(ids) == 0 {
+			err = errNoIdentities
+		}
+		if err == nil {
+			key = ids[0].signingKey()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return key, nil
+}
+
+// hashForSignature returns the SHA-512 of r, the message of an Ed25519ph
+// signature.
+func hashForSignature(r io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// signDetached returns the armored detached signature of r by key.
+func signDetached(key ed25519.PrivateKey, r io.Reader) (string, error) {
+	digest, err := hashForSignature(r)
+	if err != nil {
+		return "", err
+	}
+	sig, err := key.Sign(nil, digest, signatureOptions)
+	if err != nil {
+		return "", err
+	}
+	payload := append([]byte{signatureVersion}, key.Public().(ed25519.PublicKey)...)
+	payload = append(payload, sig...)
+	var b strings.Builder
+	b.WriteString(signatureBegin + "\n")
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	for len(encoded) > armorLineWidth {
+		b.WriteString(encoded[:armorLineWidth] + "\n")
+		encoded = encoded[armorLineWidth:]
+	}
+	b.WriteString(encoded + "\n" + signatureEnd + "\n")
+	return b.String(), nil
+}
+
+// parseSignature returns the signer key and signature of an armored detached
+// signature.
+func parseSignature(r io.Reader) (ed25519.PublicKey, []byte, error) {
+	var encoded strings.Builder
+	inside := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == signatureBegin:
+			inside = true
+		case line == signatureEnd && inside:
+			payload, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err != nil || len(payload) == 0 {
+				return nil, nil, errSignature
+			}
+			if payload[0] != signatureVersion {
+				return nil, nil, errSignatureFormat
+			}
+			if len(payload) != 1+ed25519.PublicKeySize+ed25519.SignatureSize {
+				return nil, nil, errSignature
+			}
+			return ed25519.PublicKey(payload[1 : 1+ed25519.PublicKeySize]), payload[1+ed25519.PublicKeySize:], nil
+		case inside:
+			encoded.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, errSignature
+}
+
+// isSigner reports whether key is one of signers.
+func isSigner(signers []ed25519.PublicKey, key ed25519.PublicKey) bool {
+	for _, signer := range signers {
+		if signer.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyDetached checks the armored detached signature sig of r against the
+// signer keys, returning the key that signed it.
+func verifyDetached(signers []ed25519.PublicKey, r io.Reader, sig io.Reader) (ed25519.PublicKey, error) {
+	signer, signature, err := parseSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	if !isSigner(signers, signer) {
+		return nil, fmt.Errorf("%v: %v", errUnknownSigner, signerKeyString(signer))
+	}
+	digest, err := hashForSignature(r)
+	if err != nil {
+		return nil, err
+	}
+	if ed25519.VerifyWithOptions(signer, digest, signature, signatureOptions) != nil {
+		return nil, errBadSignature
+	}
+	return signer, nil
+}
+
+// sign signs the header h, whose MAC has been filled in, with key.
+func (h *fileHeader) sign(key ed25519.PrivateKey) {
+	sig, err := key.Sign(nil, append(h.authenticatedData(), h.Tag[:]...), fileSignatureOptions)
+	if err != nil {
+		panic(err) // only an unsupported hash fails
+	}
+	copy(h.Signature[:], sig)
+}
+
+// verifySignature checks that h is signed by one of the signer keys.
+func (h fileHeader) verifySignature(signers []ed25519.PublicKey) error {
+	if h.Signer == ([32]byte{}) {
+		return errUnsigned
+	}
+	signer := ed25519.PublicKey(h.Signer[:])
+	if !isSigner(signers, signer) {
+		return fmt.Errorf("%v: %v", errUnknownSigner, signerKeyString(signer))
+	}
+	if ed25519.VerifyWithOptions(signer, append(h.authenticatedData(), h.Tag[:]...), h.Signature[:], fileSignatureOptions) != nil {
+		return errBadSignature
+	}
+	return nil
+}
+
+// requireSigner refuses to derive the keys of files that are not signed by
+// one of its signers. The signature covers the MAC, which is checked after
+// the keys are derived and before any plaintext is released.
+type requireSigner struct {
+	keySource
+	signers []ed25519.PublicKey
+}
+
+func (r requireSigner) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if err := header.verifySignature(r.signers); err != nil {
+		return sk, macKey, err
+	}
+	return r.keySource.fileKeys(header)
+}
+
+// signMain implements `enc sign`, which writes a detached signature of a
+// file.
+func signMain(args []string) {
+	fs := newFlagSet("sign", "enc sign -i [identity file] [-o signature] [input]")
+	identityFile := fs.String("i", "", "sign with this identity file or OpenSSH ed25519 private key (default: the default identity, see enc config)")
+	fileOutput := fs.String("o", "", "output, or - for stdout (default: the input with .sig appended)")
+	var p prompts
+	p.register(fs, true, false)
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	name := positional[0]
+	output := *fileOutput
+	if output == "" {
+		if name == "-" {
+			log.Fatal("-o is needed to sign standard input")
+		}
+		output = name + ".sig"
+	}
+	p.checkOutputs(output)
+
+	keyFile := *identityFile
+	if keyFile == "" {
+		c, err := readConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyFile = c.defaultIdentity()
+		if keyFile == "" {
+			log.Fatal("-i is needed, since there is no default identity")
+		}
+	}
+	key, err := readSigningKey(keyFile, p.unlockWith)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	input := os.Stdin
+	if name != "-" {
+		input = openInput(name)
+		defer input.Close()
+	}
+	sig, err := signDetached(key, input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if output == "-" {
+		fmt.Print(sig)
+		return
+	}
+	err = ioutil.WriteFile(output, []byte(sig), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// verifySigMain implements `enc verify-sig`, which checks a detached
+// signature.
+func verifySigMain(args []string) {
+	fs := newFlagSet("verify-sig", "enc verify-sig -signer [key] [input] [signature]")
+	var signerArgs stringList
+	fs.Var(&signerArgs, "signer", "accept signatures by this signer key or ssh-ed25519 public key, or the keys listed in this file; may be repeated")
+	positional := parseArgs(fs, args)
+
+	if len(positional) < 1 || len(positional) > 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if len(signerArgs) == 0 {
+		log.Fatal(errNoSigners)
+	}
+	signers, err := readSignerKeys(signerArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := positional[0]
+	sigName := name + ".sig"
+	if len(positional) == 2 {
+		sigName = positional[1]
+	}
+
+	input := os.Stdin
+	if name != "-" {
+		input = openInput(name)
+		defer input.Close()
+	}
+	sig := openInput(sigName)
+	defer sig.Close()
+	signer, err := verifyDetached(signers, input, sig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("OK, signed by", signerKeyString(signer))
+}
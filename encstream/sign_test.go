@@ -0,0 +1,194 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestDetachedSignature verifies that files signed with an identity file or
+// an OpenSSH key verify against the signer key, and that modified files and
+// unknown signers are refused.
+func TestDetachedSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := identityFileContents([]identity{id}, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(dir, "identity")
+	if err := writePrivateFile(identityFile, contents, false); err != nil {
+		t.Fatal(err)
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshFile := filepath.Join(dir, "id_ed25519")
+	if err := writePrivateFile(sshFile, string(pem.EncodeToMemory(block)), false); err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := func(name string, open func(passphrase []byte) error) error {
+		if name != identityFile {
+			t.Fatal("asked to unlock", name)
+		}
+		return open([]byte("hunter2"))
+	}
+	idKey, err := readSigningKey(identityFile, unlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := signerKeyString(idKey.Public().(ed25519.PublicKey))
+	sshSigner := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey)))
+
+	message := "attack at dawn"
+	for _, key := range []struct {
+		file, signer string
+	}{{identityFile, signer}, {sshFile, sshSigner}} {
+		private, err := readSigningKey(key.file, unlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signDetached(private, strings.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers, err := readSignerKeys([]string{key.signer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := verifyDetached(signers, strings.NewReader(message), strings.NewReader("comment\n"+sig))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(signers[0]) {
+			t.Fatal("wrong signer returned")
+		}
+
+		_, err = verifyDetached(signers, strings.NewReader("attack at dusk"), strings.NewReader(sig))
+		if err != errBadSignature {
+			t.Fatal("expected errBadSignature for a modified file, got", err)
+		}
+		other, err := generateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = verifyDetached([]ed25519.PublicKey{other.signingKey().Public().(ed25519.PublicKey)}, strings.NewReader(message), strings.NewReader(sig))
+		if err == nil || !strings.HasPrefix(err.Error(), errUnknownSigner.Error()) {
+			t.Fatal("expected an unknown signer error, got", err)
+		}
+	}
+}
+
+// TestSignedFile verifies that a file signed when it is encrypted only
+// decrypts with -require-signer if the signature is by one of the required
+// signers and matches the header and ciphertext.
+func TestSignedFile(t *testing.T) {
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := id.signingKey().Public().(ed25519.PublicKey)
+	passphrase := []byte("hunter2")
+	plaintext := []byte("attack at dawn")
+
+	encrypt := func(opts encryptOptions) []byte {
+		output := new(memoryOutput)
+		_, _, _, err := encryptTo(passphrase, bytes.NewReader(plaintext), output, 0, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output.buf
+	}
+	decrypt := func(signers []ed25519.PublicKey, ciphertext []byte) error {
+		keys := requireSigner{keySource: newPassphraseKeys(passphrase), signers: signers}
+		_, r, err := openCiphertext(keys, bytes.NewReader(ciphertext))
+		if err != nil {
+			return err
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext")
+		}
+		return nil
+	}
+
+	signed := encrypt(encryptOptions{signingKey: id.signingKey()})
+	header, err := readHeader(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.PublicKey(header.Signer[:]).Equal(signer) {
+		t.Fatal("the header does not name the signer")
+	}
+	if err := decrypt([]ed25519.PublicKey{signer}, signed); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openCiphertext(newPassphraseKeys(passphrase), bytes.NewReader(signed)); err != nil {
+		t.Fatal("a signed file should decrypt without -require-signer:", err)
+	}
+	otherSigner := other.signingKey().Public().(ed25519.PublicKey)
+	if err := decrypt([]ed25519.PublicKey{otherSigner}, signed); err == nil || !strings.HasPrefix(err.Error(), errUnknownSigner.Error()) {
+		t.Fatal("expected an unknown signer error, got", err)
+	}
+	if err := decrypt([]ed25519.PublicKey{signer}, encrypt(encryptOptions{})); err != errUnsigned {
+		t.Fatal("expected errUnsigned, got", err)
+	}
+
+	// a file encrypted with the same key by someone else cannot pass as
+	// signed by the required signer, nor can the signed file be modified.
+	forged := encrypt(encryptOptions{signingKey: other.signingKey()})
+	i := bytes.Index(forged, otherSigner)
+	copy(forged[i:], signer)
+	if err := decrypt([]ed25519.PublicKey{signer}, forged); err != errBadSignature {
+		t.Fatal("expected errBadSignature for a substituted file, got", err)
+	}
+	modified := append([]byte{}, signed...)
+	modified[len(modified)-1] ^= 1
+	if err := decrypt([]ed25519.PublicKey{signer}, modified); err != errBadMAC {
+		t.Fatal("expected errBadMAC for a modified ciphertext, got", err)
+	}
+	modified = append([]byte{}, signed...)
+	i = bytes.Index(modified, header.Signature[:])
+	modified[i] ^= 1
+	if err := decrypt([]ed25519.PublicKey{signer}, modified); err != errBadSignature {
+		t.Fatal("expected errBadSignature for a modified signature, got", err)
+	}
+
+	_, _, _, err = encryptTo(passphrase, bytes.NewReader(plaintext), streamOutput{ioutil.Discard}, 0, encryptOptions{signingKey: id.signingKey()})
+	if err != errStreamOptions {
+		t.Fatal("expected signing to a stream to fail, got", err)
+	}
+}
@@ -0,0 +1,73 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestSSHKeys verifies that a file encrypted to an ssh-ed25519 public key
+// decrypts with the OpenSSH private key, with or without a passphrase.
+func TestSSHKeys(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := parseRecipient(string(ssh.MarshalAuthorizedKey(sshKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("attack at dawn")
+	output := new(memoryOutput)
+	_, _, _, err = encryptTo(nil, bytes.NewReader(plaintext), output, 0, encryptOptions{recipients: []recipient{r}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unprotected := pem.EncodeToMemory(block)
+	block, err = ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected := pem.EncodeToMemory(block)
+	if isProtected(unprotected) || !isProtected(protected) {
+		t.Fatal("protection of SSH keys not detected")
+	}
+
+	for _, key := range []struct {
+		contents, passphrase []byte
+	}{{unprotected, nil}, {protected, []byte("hunter2")}} {
+		id, err := parseSSHIdentity(key.contents, key.passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.public != r {
+			t.Fatal("the identity of the private key does not match the public key")
+		}
+		_, decrypted, err := openCiphertext(identityKeys{id}, bytes.NewReader(output.buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(decrypted)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatal("decrypted to", string(got), err)
+		}
+	}
+	if _, err := parseSSHIdentity(protected, []byte("wrong")); err != errBadMAC {
+		t.Fatal("expected errBadMAC, got", err)
+	}
+}
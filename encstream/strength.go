@@ -0,0 +1,283 @@
+package encstream
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Passphrases are rated in the style of zxcvbn, by estimating how many
+// guesses an attacker who knows how people choose passphrases would need.
+// The passphrase is split into the pieces that are cheapest to guess:
+// common passwords and words, capitalized or with l33t substitutions, runs
+// of a repeated character or block, alphabetical and numerical sequences,
+// keyboard walks and years, and otherwise single characters guessed by brute
+// force. Its entropy is the base 2 logarithm of the guesses the cheapest
+// split takes. Argon2 makes each guess expensive, but cannot make up for a
+// passphrase that is among the first million guessed.
+
+// weakEntropy is the entropy, in bits, below which encrypting with a
+// passphrase warns that it is weak.
+const weakEntropy = 50
+
+// commonPasswords are frequently used passwords and words, most common first.
+var commonPasswords = strings.Fields(`
+	password 123456 qwerty letmein admin welcome monkey dragon master login
+	abc123 iloveyou princess sunshine football baseball shadow superman
+	michael jennifer hunter trustno1 batman starwars whatever freedom
+	passw0rd charlie donald secret mustang access hello ninja azerty
+	computer internet summer winter spring autumn love lovely flower
+	jordan harley ranger buster thomas tigger robert soccer hockey killer
+	george andrew jessica pepper daniel hannah maggie ashley amanda joshua
+	matthew cheese banana orange purple silver golden diamond pokemon
+	test guest root user default changeme backup private secure security
+	encrypt enc server office company family friend friends money
+	god angel heaven peace happy smile cookie chocolate coffee tiger lion
+	eagle wolf bear horse cat dog puppy kitty blue red green black white
+	yellow pink star sun moon sky ocean river mountain forest fire water
+	earth magic wizard knight king queen prince castle dream forever
+	london paris berlin newyork america england canada france germany
+	january february march april may june july august september october
+	november december monday tuesday wednesday thursday friday saturday
+	sunday one two three four five six seven eight nine ten zero
+`)
+
+// passphraseRanks maps each of commonPasswords to its rank, from 1.
+var passphraseRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, w := range commonPasswords {
+		if _, ok := ranks[w]; !ok {
+			ranks[w] = i + 1
+		}
+	}
+	return ranks
+}()
+
+// leetSubstitutions maps the characters commonly substituted for letters
+// back to the letters.
+var leetSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i',
+	'!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't',
+	'2': 'z',
+}
+
+// keyboardRows are the rows of a QWERTY keyboard.
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "!@#$%^&*()"}
+
+// keyboardKeys is how many keys keyboard walks are assumed to start from.
+const keyboardKeys = 47
+
+// maxPatternLength is the longest piece matched against the patterns, and
+// maxRatedLength the most characters of a passphrase that are rated, which
+// bound the time rating takes. Rating a prefix underestimates the entropy.
+const (
+	maxPatternLength = 64
+	maxRatedLength   = 256
+)
+
+// passphraseEntropy estimates the entropy of passphrase in bits.
+func passphraseEntropy(passphrase []byte) float64 {
+	s := []rune(string(passphrase))
+	if len(s) > maxRatedLength {
+		s = s[:maxRatedLength]
+	}
+	return entropy(s, bruteForceBits(s))
+}
+
+// entropy returns the bits needed to guess s by the cheapest split into
+// pieces, guessing each character outside of a pattern at charBits.
+func entropy(s []rune, charBits float64) float64 {
+	// best[i] is the fewest bits to guess the first i characters.
+	best := make([]float64, len(s)+1)
+	for i := 1; i <= len(s); i++ {
+		best[i] = math.Inf(1)
+	}
+	for i := 0; i < len(s); i++ {
+		if b := best[i] + charBits; b < best[i+1] {
+			best[i+1] = b
+		}
+		for j := i + 2; j <= len(s) && j-i <= maxPatternLength; j++ {
+			if b := best[i] + patternBits(s[i:j], charBits); b < best[j] {
+				best[j] = b
+			}
+		}
+	}
+	return best[len(s)]
+}
+
+// patternBits returns the bits needed to guess s as a single piece that
+// follows one of the patterns, or infinity if it follows none.
+func patternBits(s []rune, charBits float64) float64 {
+	bits := math.Inf(1)
+	for _, b := range []float64{dictionaryBits(s), repeatBits(s, charBits), sequenceBits(s), keyboardBits(s), yearBits(s)} {
+		bits = math.Min(bits, b)
+	}
+	return bits
+}
+
+// bruteForceBits returns the bits needed to guess a character of s by brute
+// force, from the classes of characters s uses.
+func bruteForceBits(s []rune) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			size += class.size
+		}
+	}
+	if size == 0 {
+		return 0
+	}
+	return math.Log2(float64(size))
+}
+
+// dictionaryBits returns the bits needed to guess s as a common password,
+// with its capitalization and l33t substitutions.
+func dictionaryBits(s []rune) float64 {
+	if len(s) < 3 {
+		return math.Inf(1)
+	}
+	word := []rune(strings.ToLower(string(s)))
+	substituted := 0
+	rank, ok := passphraseRanks[string(word)]
+	if !ok {
+		for i, r := range word {
+			if letter, ok := leetSubstitutions[r]; ok {
+				word[i] = letter
+				substituted++
+			}
+		}
+		rank, ok = passphraseRanks[string(word)]
+		if !ok {
+			return math.Inf(1)
+		}
+	}
+	return math.Log2(float64(rank)) + capitalizationBits(s) + float64(substituted)
+}
+
+// capitalizationBits returns the bits needed to guess which letters of s are
+// upper case.
+func capitalizationBits(s []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range s {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 0
+	case lower == 0, upper == 1 && unicode.IsUpper(s[0]):
+		return 1
+	}
+	return float64(min(upper, lower)) + 1
+}
+
+// repeatBits returns the bits needed to guess s as a character or a block
+// of characters repeated.
+func repeatBits(s []rune, charBits float64) float64 {
+	for size := 1; size <= len(s)/2; size++ {
+		if len(s)%size != 0 {
+			continue
+		}
+		repeated := true
+		for i := size; i < len(s) && repeated; i++ {
+			repeated = s[i] == s[i-size]
+		}
+		if repeated {
+			return entropy(s[:size], charBits) + math.Log2(float64(len(s)/size))
+		}
+	}
+	return math.Inf(1)
+}
+
+// sequenceBits returns the bits needed to guess s as a run of consecutive
+// characters, such as abcd, 9876 or acegi.
+func sequenceBits(s []rune) float64 {
+	if len(s) < 3 {
+		return math.Inf(1)
+	}
+	delta := s[1] - s[0]
+	if delta == 0 || delta > 2 || delta < -2 {
+		return math.Inf(1)
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i]-s[i-1] != delta {
+			return math.Inf(1)
+		}
+	}
+	var start float64
+	switch {
+	case strings.ContainsRune("aAzZ019", s[0]):
+		start = 1
+	case unicode.IsDigit(s[0]):
+		start = math.Log2(10)
+	default:
+		start = math.Log2(26)
+	}
+	if delta < 0 {
+		start++
+	}
+	return start + math.Log2(float64(len(s)))
+}
+
+// keyboardBits returns the bits needed to guess s as a walk along a row of
+// the keyboard, such as qwerty or lkjh.
+func keyboardBits(s []rune) float64 {
+	if len(s) < 3 {
+		return math.Inf(1)
+	}
+	walk := strings.ToLower(string(s))
+	reversed := []rune(walk)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	for _, row := range keyboardRows {
+		bits := math.Log2(keyboardKeys) + math.Log2(float64(len(s))) + capitalizationBits(s)
+		switch {
+		case strings.Contains(row, walk):
+			return bits
+		case strings.Contains(row, string(reversed)):
+			return bits + 1
+		}
+	}
+	return math.Inf(1)
+}
+
+// yearBits returns the bits needed to guess s as a recent year.
+func yearBits(s []rune) float64 {
+	if len(s) != 4 {
+		return math.Inf(1)
+	}
+	year := 0
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return math.Inf(1)
+		}
+		year = year*10 + int(r-'0')
+	}
+	if year < 1900 || year >= 2100 {
+		return math.Inf(1)
+	}
+	return math.Log2(200)
+}
@@ -0,0 +1,35 @@
+package encstream
+
+import "testing"
+
+// TestPassphraseEntropy verifies that passphrases built from common
+// passwords and patterns are rated weak, and random ones strong.
+func TestPassphraseEntropy(t *testing.T) {
+	for _, weak := range []string{
+		"",
+		"hunter2",
+		"Password1!",
+		"p4ssw0rd",
+		"qwertyuiop",
+		"aaaaaaaaaaaaaaaaaaaaaaaa",
+		"abcdefghijklmnop",
+		"123456789",
+		"monkeymonkeymonkey",
+		"Summer2024",
+		"iloveyou1990",
+	} {
+		if bits := passphraseEntropy([]byte(weak)); bits >= weakEntropy {
+			t.Errorf("%q rated at %.1f bits", weak, bits)
+		}
+	}
+	for _, strong := range []string{
+		"correct horse battery staple",
+		"Tr0ub4dor&3 sparkle",
+		"x8#kQ2!vLm9@pZ",
+		"vqzhmtkwpnrdyjgx",
+	} {
+		if bits := passphraseEntropy([]byte(strong)); bits < weakEntropy {
+			t.Errorf("%q rated at %.1f bits", strong, bits)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package encstream
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Background jobs on shared hosts can be throttled with -bwlimit, which limits
+// the rate the input is read and so the rate chunks are processed, and -nice,
+// which lowers the CPU and I/O scheduling priority of enc.
+
+// niceness is the scheduling priority set by -nice, the same as nice(1) uses
+// by default.
+const niceness = 10
+
+var errNiceUnsupported = errors.New("-nice is not supported on this platform")
+
+// rateLimitedReader reads from r at no more than rate bytes per second on
+// average.
+type rateLimitedReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	done  int64
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	// never read more than a second's worth at once, so that the rate holds
+	// over short periods too.
+	if int64(len(p)) > l.rate {
+		p = p[:l.rate]
+	}
+	n, err := l.r.Read(p)
+	l.done += int64(n)
+	due := time.Duration(float64(l.done) / float64(l.rate) * float64(time.Second))
+	if wait := due - time.Since(l.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,38 @@
+package encstream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// TestRateLimitedReader verifies that a rateLimitedReader holds the rate it is
+// given and passes the data through unchanged.
+func TestRateLimitedReader(t *testing.T) {
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	start := time.Now()
+	read, err := ioutil.ReadAll(&rateLimitedReader{r: bytes.NewReader(data), rate: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("the data changed")
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatal("read 3000 bytes at 10000 B/s in", elapsed)
+	}
+
+	// a single large read is split up rather than let through as a burst.
+	n, err := (&rateLimitedReader{r: bytes.NewReader(data), rate: 1000}).Read(make([]byte, len(data)))
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatal("read", n, "bytes at once at 1000 B/s")
+	}
+}
@@ -0,0 +1,227 @@
+package encstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+)
+
+// enc send and enc receive move a file between machines over TCP, without an
+// intermediate encrypted file or a third party. The sender encrypts the file
+// straight to the connection, as it would to a pipe, with the MAC in a
+// trailer after the ciphertext:
+//
+//	sender                        receiver
+//	header                  ->
+//	                        <-    confirmation
+//	verdict                 ->
+//	ciphertext, MAC         ->
+//	                        <-    acknowledgement
+//
+// The confirmation is a MAC of the header under the file's MAC key, which
+// proves that the receiver knows the passphrase, or holds an identity the
+// file is encrypted to, before any ciphertext is sent; the verdict tells it
+// whether it passed. The trailer MAC then authenticates the sender and the
+// whole transfer. The receiver decrypts the ciphertext as it arrives, to a
+// temporary file that is only renamed into place once the MAC is verified,
+// and acknowledges the transfer so that the sender knows it arrived intact.
+
+var (
+	errTransferHeader   = errors.New("the sender did not send a streamed enc file")
+	errTransferConfirm  = errors.New("the receiver could not derive the file keys; check the passphrase or its identity")
+	errTransferRejected = errors.New("the sender rejected the keys derived here; check the passphrase or identity")
+	errTransferAck      = errors.New("the receiver did not acknowledge the transfer")
+	errTransferShort    = errors.New("the transfer ended early")
+)
+
+const transferConfirmContext = "enc transfer confirmation"
+
+// The verdict and acknowledgement bytes.
+const (
+	transferAccept = 'y'
+	transferReject = 'n'
+	transferAck    = 'k'
+)
+
+// transferConfirmation returns the receiver's confirmation of the encoded
+// header, keyed with its MAC key.
+func transferConfirmation(suite uint8, macKey [32]byte, encoded []byte) ([]byte, error) {
+	hash, err := newMAC(suite, macKey)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write([]byte(transferConfirmContext))
+	hash.Write(encoded)
+	return hash.Sum(nil), nil
+}
+
+// sendFile encrypts input with passphrase or to opts.recipients over conn,
+// returning once the receiver has acknowledged it.
+func sendFile(conn io.ReadWriter, passphrase []byte, input io.Reader, opts encryptOptions) error {
+	opts.handshake = func(header fileHeader, encoded []byte, macKey [32]byte) error {
+		want, err := transferConfirmation(header.Suite, macKey, encoded)
+		if err != nil {
+			return err
+		}
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(conn, got)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errTransferConfirm
+		}
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			conn.Write([]byte{transferReject})
+			return errTransferConfirm
+		}
+		_, err = conn.Write([]byte{transferAccept})
+		return err
+	}
+	_, _, _, err := encryptTo(passphrase, input, streamOutput{conn}, 0, opts)
+	if err != nil {
+		return err
+	}
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		err = c.CloseWrite()
+		if err != nil {
+			return err
+		}
+	}
+	var ack [1]byte
+	_, err = io.ReadFull(conn, ack[:])
+	if err != nil || ack[0] != transferAck {
+		return errTransferAck
+	}
+	return nil
+}
+
+// receiveFile receives a file sent by sendFile over conn, decrypting it with
+// keys to finalOutput.
+func receiveFile(conn io.ReadWriter, keys keySource, finalOutput string) error {
+	r := bufio.NewReader(conn)
+	encoded := new(bytes.Buffer)
+	header, err := readHeader(io.TeeReader(r, encoded))
+	if err != nil {
+		return err
+	}
+	if header.Flags&flagTrailerMAC == 0 || header.Reserved != 0 {
+		return errTransferHeader
+	}
+	sk, macKey, err := keys.fileKeys(header)
+	if err != nil {
+		return err
+	}
+	confirmation, err := transferConfirmation(header.Suite, macKey, encoded.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(confirmation)
+	if err != nil {
+		return err
+	}
+	verdict, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if verdict != transferAccept {
+		return errTransferRejected
+	}
+	// the sender accepted the keys, so a header MAC that fails means the
+	// header was altered on the way.
+	err = header.checkHeader(macKey)
+	if err != nil {
+		return err
+	}
+
+	output, err := createAtomic(finalOutput)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	hash, err := newFileMAC(header, macKey)
+	if err != nil {
+		return err
+	}
+	ciphertext := &tailReader{r: r, n: len(header.Tag)}
+	plaintext := NewReader(sk, io.TeeReader(ciphertext, hash), header.chunkOptions()...)
+	_, err = io.Copy(output, plaintext)
+	if err != nil {
+		return err
+	}
+	tag := ciphertext.tail()
+	if len(tag) < len(header.Tag) {
+		return errTransferShort
+	}
+	if subtle.ConstantTimeCompare(hash.Sum(nil), tag) != 1 {
+		return errBadMAC
+	}
+	err = output.commit()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{transferAck})
+	return err
+}
+
+// tailReader reads all but the last n bytes of r, holding those back for
+// tail.
+type tailReader struct {
+	r       io.Reader
+	n       int
+	buf     []byte
+	scratch []byte
+	err     error
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for len(t.buf) <= t.n {
+		if t.err != nil {
+			return 0, t.err
+		}
+		if t.scratch == nil {
+			t.scratch = make([]byte, 32*1024)
+		}
+		var m int
+		m, t.err = t.r.Read(t.scratch)
+		t.buf = append(t.buf, t.scratch[:m]...)
+	}
+	k := copy(p, t.buf[:len(t.buf)-t.n])
+	t.buf = t.buf[:copy(t.buf, t.buf[k:])]
+	return k, nil
+}
+
+// tail returns the bytes held back once Read has returned io.EOF.
+func (t *tailReader) tail() []byte {
+	return t.buf
+}
+
+// dialSend connects to addr and sends input to it with sendFile.
+func dialSend(addr string, passphrase []byte, input io.Reader, opts encryptOptions) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return sendFile(conn, passphrase, input, opts)
+}
+
+// listenReceive listens on addr for a single sender, calling listening once
+// it is ready, and receives its file with receiveFile.
+func listenReceive(addr string, keys keySource, finalOutput string, listening func(net.Addr)) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	listening(l.Addr())
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return receiveFile(conn, keys, finalOutput)
+}
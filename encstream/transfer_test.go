@@ -0,0 +1,141 @@
+package encstream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// transfer sends plaintext from sendFile to receiveFile over a TCP connection
+// on the loopback interface, returning the errors of both sides.
+func transfer(t *testing.T, plaintext []byte, passphrase []byte, opts encryptOptions, keys keySource, output string) (sendErr, receiveErr error) {
+	addrs := make(chan net.Addr, 1)
+	received := make(chan error, 1)
+	go func() {
+		received <- listenReceive("127.0.0.1:0", keys, output, func(addr net.Addr) { addrs <- addr })
+	}()
+	var addr net.Addr
+	select {
+	case addr = <-addrs:
+	case err := <-received:
+		t.Fatal(err)
+	}
+	sendErr = dialSend(addr.String(), passphrase, bytes.NewReader(plaintext), opts)
+	return sendErr, <-received
+}
+
+// TestTransfer verifies that files sent with a passphrase or to a recipient
+// arrive intact, and that a receiver that cannot derive the keys is refused
+// before any ciphertext is sent.
+func TestTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := bytes.Repeat([]byte("transfer "), 10000)
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		passphrase []byte
+		opts       encryptOptions
+		keys       keySource
+		ok         bool
+	}{
+		{[]byte("pw"), encryptOptions{}, newPassphraseKeys([]byte("pw")), true},
+		{nil, encryptOptions{recipients: []recipient{id.public}}, identityKeys{id}, true},
+		{[]byte("pw"), encryptOptions{}, newPassphraseKeys([]byte("wrong")), false},
+		{nil, encryptOptions{recipients: []recipient{id.public}}, identityKeys{other}, false},
+	} {
+		output := filepath.Join(dir, "out")
+		sendErr, receiveErr := transfer(t, plaintext, c.passphrase, c.opts, c.keys, output)
+		received, err := ioutil.ReadFile(output)
+		if c.ok {
+			if sendErr != nil || receiveErr != nil {
+				t.Fatalf("case %v: the transfer failed: %v, %v", i, sendErr, receiveErr)
+			}
+			if err != nil || !bytes.Equal(received, plaintext) {
+				t.Fatalf("case %v: the received file differs", i)
+			}
+			os.Remove(output)
+			continue
+		}
+		if sendErr != errTransferConfirm || receiveErr == nil {
+			t.Fatalf("case %v: expected errTransferConfirm and a failure, got %v, %v", i, sendErr, receiveErr)
+		}
+		if !os.IsNotExist(err) {
+			t.Fatalf("case %v: a refused transfer was written", i)
+		}
+	}
+}
+
+// fakeConn reads what a sender would send, and records what is written.
+type fakeConn struct {
+	r       io.Reader
+	written bytes.Buffer
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+// TestTransferTampered verifies that a modified or truncated transfer is not
+// written or acknowledged.
+func TestTransferTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := bytes.Repeat([]byte("tamper "), 10000)
+	stream := new(bytes.Buffer)
+	if _, _, _, err := encryptTo([]byte("pw"), bytes.NewReader(plaintext), streamOutput{stream}, 0, encryptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(stream.Bytes())
+	if _, err := readHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	headerSize := stream.Len() - r.Len()
+	// what the sender sends, with the verdict after the header.
+	sent := append(append(append([]byte(nil), stream.Bytes()[:headerSize]...), transferAccept), stream.Bytes()[headerSize:]...)
+
+	output := filepath.Join(dir, "out")
+	for i, modify := range []func([]byte) []byte{
+		func(b []byte) []byte { return b },
+		func(b []byte) []byte { b[headerSize+100] ^= 1; return b },
+		func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+		func(b []byte) []byte { return b[:len(b)-32] },
+		func(b []byte) []byte { return b[:len(b)-maxChunkSize] },
+	} {
+		conn := &fakeConn{r: bytes.NewReader(modify(append([]byte(nil), sent...)))}
+		err := receiveFile(conn, newPassphraseKeys([]byte("pw")), output)
+		acknowledged := bytes.HasSuffix(conn.written.Bytes(), []byte{transferAck})
+		received, readErr := ioutil.ReadFile(output)
+		if i == 0 {
+			if err != nil || !acknowledged || !bytes.Equal(received, plaintext) {
+				t.Fatal("an intact transfer was not received", err)
+			}
+			os.Remove(output)
+			continue
+		}
+		if err == nil || acknowledged || !os.IsNotExist(readErr) {
+			t.Fatalf("case %v: a damaged transfer was accepted", i)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package encstream
+
+import (
+	"encoding/binary"
+	"hash"
+	"sync"
+)
+
+// Before version 3, the MAC of a file was a single keyed hash of its header
+// and ciphertext, which runs on one core while the chunks are encrypted and
+// decrypted on all of them, and so bounds how fast a large file is written
+// and checked. From version 3 it is a tree: the ciphertext, with any deniable
+// region, is split into leaves of macLeafSize bytes, which are MACed with
+// their index on as many cores as the chunks are encrypted on, and the MAC of
+// the file is the MAC of the header, the leaf MACs in order and the length of
+// the ciphertext. Leaves cannot be moved, dropped or added without changing
+// it, and it is still one 64 byte tag made with the hash of the file's suite,
+// so trailers, signatures and rewrapping are unchanged. A reader that
+// decrypts chunks as they arrive, as enc receive does, hashes the leaves in
+// the same pass.
+
+// macLeafSize is the size of the leaves of the MAC of a version 3 file.
+const macLeafSize = 1 << 20
+
+// macWriter computes the MAC of a file over the ciphertext written to it.
+type macWriter interface {
+	Write(p []byte) (int, error)
+	Sum(b []byte) []byte
+}
+
+// newFileMAC returns a macWriter for the file with header, keyed with
+// macKey, that has already been given the header.
+func newFileMAC(header fileHeader, macKey [32]byte) (macWriter, error) {
+	root, err := newMAC(header.Suite, macKey)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version < 3 {
+		root.Write(header.authenticatedData())
+		return root, nil
+	}
+	ad := header.authenticatedData()
+	root.Write([]byte("enc tree"))
+	root.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(ad))))
+	root.Write(ad)
+	n := workers()
+	t := &treeMAC{
+		suite:  header.Suite,
+		macKey: macKey,
+		free:   make(chan []byte, n),
+		root:   root,
+		done:   make(map[uint64][]byte),
+	}
+	for i := 0; i < n; i++ {
+		t.free <- make([]byte, 0, macLeafSize)
+	}
+	t.leaf = <-t.free
+	return t, nil
+}
+
+// treeMAC is the MAC of a version 3 file. Its leaves are hashed in the
+// background, each with a buffer from free, so that only as many are in
+// flight as there are workers. Sum may only be called once, after the last
+// Write.
+type treeMAC struct {
+	suite  uint8
+	macKey [32]byte
+	length uint64 // of the ciphertext written
+	leaf   []byte // being filled
+	leaves uint64 // started
+	free   chan []byte
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	root hash.Hash
+	// next is the index of the next leaf MAC the root is given, and done
+	// holds the leaf MACs that were finished before it.
+	next uint64
+	done map[uint64][]byte
+}
+
+func (t *treeMAC) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(t.leaf[len(t.leaf):macLeafSize], p)
+		t.leaf = t.leaf[:len(t.leaf)+c]
+		t.length += uint64(c)
+		p = p[c:]
+		if len(t.leaf) == macLeafSize {
+			t.hashLeaf()
+			t.leaf = <-t.free
+		}
+	}
+	return n, nil
+}
+
+// hashLeaf starts hashing the leaf being filled.
+func (t *treeMAC) hashLeaf() {
+	leaf, i := t.leaf, t.leaves
+	t.leaves++
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		sum := leafMAC(t.suite, t.macKey, i, leaf)
+		t.free <- leaf[:0]
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.done[i] = sum
+		for {
+			sum, ok := t.done[t.next]
+			if !ok {
+				return
+			}
+			t.root.Write(sum)
+			delete(t.done, t.next)
+			t.next++
+		}
+	}()
+}
+
+// Sum appends the MAC of the file to b.
+func (t *treeMAC) Sum(b []byte) []byte {
+	if len(t.leaf) > 0 {
+		t.hashLeaf()
+	}
+	t.leaf = nil
+	t.wg.Wait()
+	t.root.Write(binary.LittleEndian.AppendUint64(nil, t.length))
+	return t.root.Sum(b)
+}
+
+// leafMAC returns the MAC of the leaf with index i of a version 3 file.
+func leafMAC(suite uint8, macKey [32]byte, i uint64, leaf []byte) []byte {
+	// newMAC only fails for keys of the wrong size, and newFileMAC already
+	// made one with macKey.
+	hash, _ := newMAC(suite, macKey)
+	hash.Write([]byte("enc leaf"))
+	hash.Write(binary.LittleEndian.AppendUint64(nil, i))
+	hash.Write(leaf)
+	return hash.Sum(nil)
+}
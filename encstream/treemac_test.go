@@ -0,0 +1,124 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+// TestTreeMAC verifies that the MAC of a version 3 file is the MAC of its
+// leaves in order however the ciphertext is written, that version 2 files
+// keep the flat MAC, and that a file of several leaves is refused when a late
+// leaf is altered.
+func TestTreeMAC(t *testing.T) {
+	macKey := [32]byte{1, 2, 3}
+	ciphertext := make([]byte, 3*macLeafSize+12345)
+	rand.Read(ciphertext)
+	for _, suite := range []uint8{suiteDefault, suiteFIPS} {
+		header := fileHeader{Version: 3, Suite: suite, Label: "tree"}
+		ad := header.authenticatedData()
+		want, _ := newMAC(suite, macKey)
+		want.Write([]byte("enc tree"))
+		want.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(ad))))
+		want.Write(ad)
+		for i := uint64(0); i*macLeafSize < uint64(len(ciphertext)); i++ {
+			leaf := ciphertext[i*macLeafSize:]
+			if len(leaf) > macLeafSize {
+				leaf = leaf[:macLeafSize]
+			}
+			want.Write(leafMAC(suite, macKey, i, leaf))
+		}
+		want.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(ciphertext))))
+		wantSum := want.Sum(nil)
+
+		for _, size := range []int{len(ciphertext), macLeafSize, 4096, 1000003} {
+			hash, err := newFileMAC(header, macKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rest := ciphertext; len(rest) > 0; {
+				n := size
+				if n > len(rest) {
+					n = len(rest)
+				}
+				hash.Write(rest[:n])
+				rest = rest[n:]
+			}
+			if !bytes.Equal(hash.Sum(nil), wantSum) {
+				t.Fatalf("suite %v: writes of %v bytes gave the wrong MAC", suite, size)
+			}
+		}
+
+		empty, err := newFileMAC(header, macKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		one, err := newFileMAC(header, macKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		one.Write([]byte{0})
+		if bytes.Equal(empty.Sum(nil), one.Sum(nil)) {
+			t.Fatal("an empty ciphertext has the MAC of a one byte one")
+		}
+
+		v2 := header
+		v2.Version = 2
+		flat, _ := newMAC(suite, macKey)
+		flat.Write(v2.authenticatedData())
+		flat.Write(ciphertext)
+		hash, err := newFileMAC(v2, macKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash.Write(ciphertext)
+		if !bytes.Equal(hash.Sum(nil), flat.Sum(nil)) {
+			t.Fatal("a version 2 file did not get the flat MAC")
+		}
+	}
+
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := new(memoryOutput)
+	_, _, _, err = encryptTo(nil, bytes.NewReader(ciphertext), output, 0, encryptOptions{recipients: []recipient{id.public}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, plaintext, err := openCiphertext(identityKeys{id}, bytes.NewReader(output.buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version < 3 {
+		t.Fatal("a new file has version", header.Version)
+	}
+	var decrypted bytes.Buffer
+	if _, err := decrypted.ReadFrom(plaintext); err != nil || !bytes.Equal(decrypted.Bytes(), ciphertext) {
+		t.Fatal("the file did not decrypt", err)
+	}
+	output.buf[len(output.buf)-100] ^= 1
+	if _, _, err := openCiphertext(identityKeys{id}, bytes.NewReader(output.buf)); err != errBadMAC {
+		t.Fatal("expected errBadMAC from an altered last leaf, got", err)
+	}
+}
+
+// BenchmarkFileMAC measures the flat MAC of version 2 files against the tree
+// MAC of version 3 files.
+func BenchmarkFileMAC(b *testing.B) {
+	ciphertext := make([]byte, 64<<20)
+	for _, version := range []uint8{2, 3} {
+		b.Run(map[uint8]string{2: "flat", 3: "tree"}[version], func(b *testing.B) {
+			b.SetBytes(int64(len(ciphertext)))
+			for i := 0; i < b.N; i++ {
+				hash, err := newFileMAC(fileHeader{Version: version}, [32]byte{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				hash.Write(ciphertext)
+				hash.Sum(nil)
+			}
+		})
+	}
+}
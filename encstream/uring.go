@@ -0,0 +1,20 @@
+package encstream
+
+import "errors"
+
+// With -io-uring, regular input files are read ahead, and output files
+// written behind, through io_uring on Linux, so that disk I/O overlaps the
+// sealing of chunks rather than alternating with it. Several large reads are
+// kept in flight ahead of the reader, and writes are gathered into large
+// blocks that the kernel writes out while Write returns. Where io_uring is
+// missing, too old to read and write, or not allowed, and on other systems,
+// enc falls back to plain read and write calls.
+
+var errNoUring = errors.New("io_uring is not available")
+
+const (
+	// uringDepth is how many blocks are in flight at once.
+	uringDepth = 8
+	// uringBlockSize is the size of each read and write.
+	uringBlockSize = 1 << 20
+)
@@ -0,0 +1,514 @@
+package encstream
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// This is the little of io_uring that -io-uring needs: a ring on which reads
+// and writes at given offsets are submitted and their completions collected.
+// Buffers handed to the kernel are mapped outside the Go heap, so that they
+// stay put and alive while the kernel fills or drains them.
+
+const (
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringFeatSingleMmap = 1 << 0
+	// uringFeatRWCurPos came with IORING_OP_READ and IORING_OP_WRITE in
+	// Linux 5.6, so kernels without it are treated as having no io_uring.
+	uringFeatRWCurPos = 1 << 3
+
+	uringOpRead  = 22
+	uringOpWrite = 23
+
+	uringEnterGetEvents = 1 << 0
+)
+
+// uringParams is struct io_uring_params.
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+// uringSQOffsets is struct io_sqring_offsets.
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringCQOffsets is struct io_cqring_offsets.
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringSQE is struct io_uring_sqe.
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// uringCQE is struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an io_uring instance.
+type uring struct {
+	fd             int
+	sqRing, cqRing []byte
+	sqes           []byte
+	sqTail         *uint32
+	sqMask         uint32
+	sqArray        unsafe.Pointer
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           unsafe.Pointer
+}
+
+// newUring sets up a ring of entries entries, or returns errNoUring if the
+// kernel lacks io_uring, or reads and writes on it, or does not allow it.
+func newUring(entries uint32) (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errNoUring
+	}
+	u := &uring{fd: int(fd)}
+	if p.features&uringFeatRWCurPos == 0 {
+		u.close()
+		return nil, errNoUring
+	}
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	single := p.features&uringFeatSingleMmap != 0
+	if single && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	var err error
+	u.sqRing, err = unix.Mmap(u.fd, uringOffSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err == nil {
+		u.cqRing = u.sqRing
+		if !single {
+			u.cqRing, err = unix.Mmap(u.fd, uringOffCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		}
+	}
+	if err == nil {
+		u.sqes, err = unix.Mmap(u.fd, uringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	}
+	if err != nil {
+		u.close()
+		return nil, errNoUring
+	}
+	sq, cq := unsafe.Pointer(&u.sqRing[0]), unsafe.Pointer(&u.cqRing[0])
+	u.sqTail = (*uint32)(unsafe.Add(sq, p.sqOff.tail))
+	u.sqMask = *(*uint32)(unsafe.Add(sq, p.sqOff.ringMask))
+	u.sqArray = unsafe.Add(sq, p.sqOff.array)
+	u.cqHead = (*uint32)(unsafe.Add(cq, p.cqOff.head))
+	u.cqTail = (*uint32)(unsafe.Add(cq, p.cqOff.tail))
+	u.cqMask = *(*uint32)(unsafe.Add(cq, p.cqOff.ringMask))
+	u.cqes = unsafe.Add(cq, p.cqOff.cqes)
+	return u, nil
+}
+
+// submit submits a read or write of buf from or to fd at off. The caller
+// must not have more submissions in flight than the ring holds.
+func (u *uring) submit(op uint8, fd int, buf []byte, off int64, userData uint64) error {
+	tail := atomic.LoadUint32(u.sqTail)
+	index := tail & u.sqMask
+	sqe := (*uringSQE)(unsafe.Pointer(&u.sqes[uintptr(index)*unsafe.Sizeof(uringSQE{})]))
+	*sqe = uringSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		userData: userData,
+	}
+	*(*uint32)(unsafe.Add(u.sqArray, 4*index)) = index
+	atomic.StoreUint32(u.sqTail, tail+1)
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), 1, 0, 0, 0, 0)
+		if errno == syscall.EINTR || errno == syscall.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// wait returns the next completion, waiting for one if there is none. res is
+// what the read or write returned, or a negated errno.
+func (u *uring) wait() (userData uint64, res int32, err error) {
+	for {
+		head := atomic.LoadUint32(u.cqHead)
+		if head != atomic.LoadUint32(u.cqTail) {
+			cqe := (*uringCQE)(unsafe.Add(u.cqes, uintptr(head&u.cqMask)*unsafe.Sizeof(uringCQE{})))
+			userData, res = cqe.userData, cqe.res
+			atomic.StoreUint32(u.cqHead, head+1)
+			return userData, res, nil
+		}
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), 0, 1, uringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != syscall.EINTR {
+			return 0, 0, errno
+		}
+	}
+}
+
+func (u *uring) close() {
+	if u.sqes != nil {
+		unix.Munmap(u.sqes)
+	}
+	if u.cqRing != nil && &u.cqRing[0] != &u.sqRing[0] {
+		unix.Munmap(u.cqRing)
+	}
+	if u.sqRing != nil {
+		unix.Munmap(u.sqRing)
+	}
+	unix.Close(u.fd)
+}
+
+// uringBuffers sets up a ring with uringDepth buffers of uringBlockSize
+// bytes, mapped in mem.
+func uringBuffers() (ring *uring, bufs [][]byte, mem []byte, err error) {
+	ring, err = newUring(uringDepth)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mem, err = unix.Mmap(-1, 0, uringDepth*uringBlockSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		ring.close()
+		return nil, nil, nil, errNoUring
+	}
+	bufs = make([][]byte, uringDepth)
+	for i := range bufs {
+		bufs[i] = mem[i*uringBlockSize : (i+1)*uringBlockSize : (i+1)*uringBlockSize]
+	}
+	return ring, bufs, mem, nil
+}
+
+// uringReader reads a regular file from its start, with the next blocks read
+// ahead of its reader.
+type uringReader struct {
+	ring *uring
+	f    *os.File
+	bufs [][]byte
+	mem  []byte
+	// pending lists the buffers in flight, in file order; filled holds how
+	// much was read into each, or -1 while it is in flight, and offsets
+	// where it was read from.
+	pending []int
+	filled  []int
+	offsets []int64
+	next    int64 // the offset of the next read
+	current int   // the buffer being read from, or -1
+	unread  []byte
+	err     error
+}
+
+// newUringReader returns a uringReader of f, or errNoUring if f is not a
+// regular file or io_uring is not available.
+func newUringReader(f *os.File) (*uringReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errNoUring
+	}
+	ring, bufs, mem, err := uringBuffers()
+	if err != nil {
+		return nil, err
+	}
+	r := &uringReader{ring: ring, f: f, bufs: bufs, mem: mem, filled: make([]int, uringDepth), offsets: make([]int64, uringDepth), current: -1}
+	for i := range bufs {
+		r.read(i)
+	}
+	return r, nil
+}
+
+// read reads the next block into buffer i.
+func (r *uringReader) read(i int) {
+	if r.err != nil {
+		return
+	}
+	r.err = r.ring.submit(uringOpRead, int(r.f.Fd()), r.bufs[i], r.next, uint64(i))
+	if r.err != nil {
+		return
+	}
+	r.filled[i], r.offsets[i] = -1, r.next
+	r.pending = append(r.pending, i)
+	r.next += uringBlockSize
+}
+
+// collect waits until buffer i has been read.
+func (r *uringReader) collect(i int) error {
+	for r.filled[i] < 0 {
+		userData, res, err := r.ring.wait()
+		if err != nil {
+			return err
+		}
+		if res < 0 {
+			r.filled[userData] = 0
+			return syscall.Errno(-res)
+		}
+		r.filled[userData] = int(res)
+	}
+	return nil
+}
+
+func (r *uringReader) Read(p []byte) (int, error) {
+	for len(r.unread) == 0 {
+		if r.current >= 0 {
+			r.read(r.current)
+			r.current = -1
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		i := r.pending[0]
+		r.err = r.collect(i)
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pending = r.pending[1:]
+		n := r.filled[i]
+		if n == 0 {
+			r.err = io.EOF
+			return 0, r.err
+		}
+		r.current, r.unread = i, r.bufs[i][:n]
+		if n < uringBlockSize {
+			// the reads after a short one were at the wrong offsets, so
+			// they are made again from where it ended.
+			for _, j := range r.pending {
+				if r.err = r.collect(j); r.err != nil {
+					break
+				}
+			}
+			again := r.pending
+			r.pending = nil
+			r.next = r.offsets[i] + int64(n)
+			for _, j := range again {
+				r.read(j)
+			}
+		}
+	}
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+	return n, nil
+}
+
+// close waits for the reads in flight and releases the ring. The file is
+// left open.
+func (r *uringReader) close() {
+	for _, i := range r.pending {
+		if r.collect(i) != nil && r.filled[i] < 0 {
+			// the kernel may still write to the buffers, so they are
+			// left mapped.
+			r.ring.close()
+			return
+		}
+	}
+	r.ring.close()
+	unix.Munmap(r.mem)
+}
+
+// uringOutput is an atomicFile written through io_uring. Writes are gathered
+// into blocks, which the kernel writes out while the next chunks are sealed.
+type uringOutput struct {
+	*atomicFile
+	ring *uring
+	bufs [][]byte
+	mem  []byte
+	// free lists the buffers not in flight; filling is the one being
+	// filled, or -1, and offsets holds where each is written.
+	free     []int
+	filling  int
+	offsets  []int64
+	inFlight int
+	pos      int64
+	err      error
+}
+
+// newUringOutput returns f as a uringOutput, or errNoUring if io_uring is
+// not available.
+func newUringOutput(f *atomicFile) (*uringOutput, error) {
+	ring, bufs, mem, err := uringBuffers()
+	if err != nil {
+		return nil, err
+	}
+	u := &uringOutput{atomicFile: f, ring: ring, bufs: bufs, mem: mem, filling: -1, offsets: make([]int64, uringDepth)}
+	for i := range bufs {
+		u.free = append(u.free, i)
+		u.bufs[i] = u.bufs[i][:0]
+	}
+	return u, nil
+}
+
+// write writes out the buffer being filled.
+func (u *uringOutput) write() {
+	i := u.filling
+	u.filling = -1
+	if u.err == nil {
+		u.err = u.ring.submit(uringOpWrite, int(u.atomicFile.Fd()), u.bufs[i], u.offsets[i], uint64(i))
+	}
+	if u.err != nil {
+		u.free = append(u.free, i)
+		return
+	}
+	u.inFlight++
+}
+
+// collect waits for a write to complete, finishing it with a plain write if
+// it was short.
+func (u *uringOutput) collect() error {
+	userData, res, err := u.ring.wait()
+	if err != nil {
+		return err
+	}
+	u.inFlight--
+	i := int(userData)
+	u.free = append(u.free, i)
+	if res < 0 {
+		err = syscall.Errno(-res)
+	} else if n := int(res); n < len(u.bufs[i]) {
+		_, err = u.atomicFile.WriteAt(u.bufs[i][n:], u.offsets[i]+int64(n))
+	}
+	u.bufs[i] = u.bufs[i][:0]
+	return err
+}
+
+// flush writes out what has been written and waits for it.
+func (u *uringOutput) flush() error {
+	if u.filling >= 0 {
+		u.write()
+	}
+	for u.inFlight > 0 {
+		inFlight := u.inFlight
+		err := u.collect()
+		if err != nil && u.err == nil {
+			u.err = err
+		}
+		if u.inFlight == inFlight {
+			// the ring itself failed.
+			break
+		}
+	}
+	return u.err
+}
+
+func (u *uringOutput) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if u.err != nil {
+			return written, u.err
+		}
+		if u.filling < 0 {
+			if len(u.free) == 0 {
+				u.err = u.collect()
+				continue
+			}
+			u.filling = u.free[len(u.free)-1]
+			u.free = u.free[:len(u.free)-1]
+			u.offsets[u.filling] = u.pos
+		}
+		buf := u.bufs[u.filling]
+		n := copy(buf[len(buf):cap(buf)], p)
+		u.bufs[u.filling] = buf[:len(buf)+n]
+		if len(buf)+n == cap(buf) {
+			u.write()
+		}
+		u.pos += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Seek implements io.Seeker. Blocks are written at their offsets, so the
+// position is kept here rather than in the file.
+func (u *uringOutput) Seek(offset int64, whence int) (int64, error) {
+	if err := u.flush(); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += u.pos
+	case io.SeekEnd:
+		info, err := u.atomicFile.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	}
+	if offset < 0 {
+		return u.pos, errors.New("negative seek")
+	}
+	u.pos = offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt, once what has been written is.
+func (u *uringOutput) ReadAt(p []byte, off int64) (int, error) {
+	if err := u.flush(); err != nil {
+		return 0, err
+	}
+	return u.atomicFile.ReadAt(p, off)
+}
+
+// release waits for the writes in flight and releases the ring.
+func (u *uringOutput) release() error {
+	err := u.flush()
+	u.ring.close()
+	if u.inFlight == 0 {
+		unix.Munmap(u.mem)
+	}
+	return err
+}
+
+func (u *uringOutput) commit() error {
+	err := u.release()
+	if err != nil {
+		u.atomicFile.abort()
+		return err
+	}
+	return u.atomicFile.commit()
+}
+
+func (u *uringOutput) abort() {
+	u.release()
+	u.atomicFile.abort()
+}
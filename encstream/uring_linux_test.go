@@ -0,0 +1,206 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestUring verifies that a file larger than the blocks in flight, read and
+// encrypted through io_uring with recovery records and verified, decrypts to
+// the input.
+func TestUring(t *testing.T) {
+	skipWithoutUring(t)
+	dir, err := ioutil.TempDir("", "enctest-uring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := make([]byte, uringDepth*uringBlockSize+uringBlockSize/2+1)
+	_, err = rand.Read(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintextFile := filepath.Join(dir, "plaintext")
+	err = ioutil.WriteFile(plaintextFile, plaintext, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(plaintextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := newUringReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(r)
+	r.close()
+	if err != nil || !bytes.Equal(read, plaintext) {
+		t.Fatal("the file was read differently through io_uring:", err)
+	}
+
+	passphrase := []byte("hunter2")
+	ciphertext := filepath.Join(dir, "ciphertext")
+	err = encryptFile(passphrase, f, ciphertext, encryptOptions{uring: true, verify: true, recovery: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := openEncrypted(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	decrypted := filepath.Join(dir, "decrypted")
+	err = decryptFile(newPassphraseKeys(passphrase), input, decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plaintext) {
+		t.Fatal("decryption resulted in a different plaintext")
+	}
+}
+
+// skipWithoutUring skips the test if io_uring is not available.
+func skipWithoutUring(tb testing.TB) {
+	u, err := newUring(uringDepth)
+	if err != nil {
+		tb.Skip(err)
+	}
+	u.close()
+}
+
+// benchmarkFile writes a file of size random bytes in dir for a benchmark.
+func benchmarkFile(b *testing.B, dir string, size int) string {
+	data := make([]byte, size)
+	rand.Read(data)
+	name := filepath.Join(dir, "input")
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		b.Fatal(err)
+	}
+	return name
+}
+
+// benchmarkDir returns a temporary directory for a benchmark, removed once
+// it is done.
+func benchmarkDir(b *testing.B) string {
+	dir, err := ioutil.TempDir("", "enctest-uring")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// BenchmarkUringRead compares reading a file in chunks through io_uring with
+// reading it with read calls.
+func BenchmarkUringRead(b *testing.B) {
+	skipWithoutUring(b)
+	const size = 64 << 20
+	dir := benchmarkDir(b)
+	name := benchmarkFile(b, dir, size)
+	buf := make([]byte, maxChunkSize)
+	for _, mode := range []string{"standard", "io_uring"} {
+		b.Run(mode, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var r io.Reader = f
+				if mode == "io_uring" {
+					u, err := newUringReader(f)
+					if err != nil {
+						b.Fatal(err)
+					}
+					defer u.close()
+					r = u
+				}
+				// the reader is hidden so that io.CopyBuffer reads in chunks,
+				// as encryption does.
+				_, err = io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{r}, buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				f.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkUringWrite compares writing an output in chunks through io_uring
+// with writing it with write calls.
+func BenchmarkUringWrite(b *testing.B) {
+	skipWithoutUring(b)
+	const size = 64 << 20
+	name := filepath.Join(benchmarkDir(b), "output")
+	chunk := make([]byte, maxChunkSize)
+	rand.Read(chunk)
+	for _, mode := range []string{"standard", "io_uring"} {
+		b.Run(mode, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				f, err := createAtomic(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var output encryptOutput = f
+				if mode == "io_uring" {
+					if output, err = newUringOutput(f); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for written := 0; written < size; written += len(chunk) {
+					if _, err := output.Write(chunk); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := output.commit(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkUringEncrypt compares encrypting a file through io_uring with
+// encrypting it through read and write calls. The key is derived once, as in
+// a batch, so that only the encryption is measured.
+func BenchmarkUringEncrypt(b *testing.B) {
+	skipWithoutUring(b)
+	const size = 64 << 20
+	dir := benchmarkDir(b)
+	name := benchmarkFile(b, dir, size)
+	output := filepath.Join(dir, "output")
+	shared, err := newSharedKey([]byte("hunter2"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, mode := range []string{"standard", "io_uring"} {
+		b.Run(mode, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = encryptFile(nil, f, output, encryptOptions{shared: shared, uring: mode == "io_uring"})
+				f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
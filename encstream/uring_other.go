@@ -0,0 +1,20 @@
+//go:build !linux
+
+package encstream
+
+import "os"
+
+// uringReader is not available on this platform.
+type uringReader struct{}
+
+func newUringReader(f *os.File) (*uringReader, error) { return nil, errNoUring }
+
+func (r *uringReader) Read(p []byte) (int, error) { return 0, errNoUring }
+func (r *uringReader) close()                     {}
+
+// uringOutput is not available on this platform.
+type uringOutput struct {
+	*atomicFile
+}
+
+func newUringOutput(f *atomicFile) (*uringOutput, error) { return nil, errNoUring }
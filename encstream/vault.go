@@ -0,0 +1,362 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files can be encrypted with a data key of a key in HashiCorp Vault's
+// transit secrets engine instead of a passphrase, so that decrypting them
+// takes a Vault token allowed to use that key. Vault generates the data key
+// and returns it both in plaintext and wrapped by the transit key; the header
+// holds the wrapped data key and the path of the transit key in a
+// recordVaultKey record, and the file's keys are a subkey of the data key,
+// selected by the random salt of its recordSubkey record, as in a batch.
+//
+// A service that encrypts many files would otherwise make a round trip to
+// Vault for each, so data keys are cached; see datakeycache.go. The token is
+// renewed in the background once half its TTL has passed.
+
+var (
+	errBadVaultKey   = errors.New("Vault keys are given as the mount of the transit engine and the key name, such as transit/backups")
+	errNeedVault     = errors.New("the file is encrypted with a Vault data key; decrypt it with -vault")
+	errNotVault      = errors.New("the file is not encrypted with a Vault data key")
+	errVaultOptions  = errors.New("-vault cannot be combined with -r, -R, -i, -fips, -dedup-with, -rsyncable, -deniable-size, -no-metadata, -qr, -raw or -dry-run")
+	errVaultAddress  = errors.New("-vault needs the address of Vault in VAULT_ADDR")
+	errVaultToken    = errors.New("-vault needs a Vault token in VAULT_TOKEN")
+	errVaultResponse = errors.New("Vault sent a malformed response")
+)
+
+// vaultKey is a data key wrapped by the Vault transit key at Path.
+type vaultKey struct {
+	Path       string // of the transit key: its mount, a slash, and its name
+	Ciphertext string // the wrapped data key, vault:v<version>:...
+}
+
+// encodeVaultKey returns the body of a recordVaultKey header record: the
+// length-prefixed path, and the ciphertext.
+func encodeVaultKey(k vaultKey) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint16(len(k.Path)))
+	buf.WriteString(k.Path)
+	buf.WriteString(k.Ciphertext)
+	return buf.Bytes()
+}
+
+// decodeVaultKey parses the body of a recordVaultKey header record.
+func decodeVaultKey(body []byte) (vaultKey, error) {
+	if len(body) < 2 {
+		return vaultKey{}, errBadHeader
+	}
+	n := int(binary.LittleEndian.Uint16(body))
+	body = body[2:]
+	if n > len(body) {
+		return vaultKey{}, errBadHeader
+	}
+	k := vaultKey{Path: string(body[:n]), Ciphertext: string(body[n:])}
+	if _, _, err := splitVaultKey(k.Path); err != nil || k.Ciphertext == "" {
+		return vaultKey{}, errBadHeader
+	}
+	return k, nil
+}
+
+// splitVaultKey splits the path of a transit key into its mount and name.
+func splitVaultKey(path string) (mount, name string, err error) {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 || strings.HasPrefix(path, "/") || strings.ContainsAny(path, "?#% \r\n") {
+		return "", "", errBadVaultKey
+	}
+	return path[:i], path[i+1:], nil
+}
+
+// VaultConfig says how to reach a key of Vault's transit secrets engine.
+type VaultConfig struct {
+	// Address is the URL of Vault, such as https://vault.example.com:8200.
+	Address string
+	// Namespace is the Vault Enterprise namespace of the key and token, if
+	// any.
+	Namespace string
+	// Token authenticates to Vault. It needs the update capability on the
+	// transit key's datakey/plaintext endpoint to encrypt, and on its
+	// decrypt endpoint to decrypt.
+	Token string
+	// Key is the path of the transit key: the mount of the engine, a slash,
+	// and the key's name, such as transit/backups.
+	Key string
+	// Cache bounds how data keys are cached.
+	Cache DataKeyCache
+}
+
+// VaultTransit encrypts and decrypts files with data keys of a Vault
+// transit key, caching them and renewing its token; see WithVaultTransit. It
+// is safe for concurrent use, and should be shared by all the files it is
+// used for.
+type VaultTransit struct {
+	config VaultConfig
+	client *http.Client
+	cache  *dataKeyCache
+
+	mu sync.Mutex
+	// renewing is set once the token has been looked up, and its renewal
+	// started if it expires.
+	renewing bool
+	renewErr error // of the last renewal
+	done     chan struct{}
+}
+
+// NewVaultTransit returns a VaultTransit for the transit key of config.
+func NewVaultTransit(config VaultConfig) (*VaultTransit, error) {
+	if _, _, err := splitVaultKey(config.Key); err != nil {
+		return nil, err
+	}
+	if config.Address == "" {
+		return nil, errVaultAddress
+	}
+	if config.Token == "" {
+		return nil, errVaultToken
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	return &VaultTransit{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  newDataKeyCache(config.Cache),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Close stops renewing the token, and drops the cached data keys.
+func (v *VaultTransit) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	select {
+	case <-v.done:
+	default:
+		close(v.done)
+	}
+	v.cache.clear()
+	return nil
+}
+
+// request sends a request with the JSON body in, if any, to the Vault API at
+// path, and decodes the JSON response into out.
+func (v *VaultTransit) request(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, v.config.Address+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.config.Token)
+	req.Header.Set("X-Vault-Request", "true")
+	if v.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.config.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&failure)
+		if len(failure.Errors) == 0 {
+			failure.Errors = []string{resp.Status}
+		}
+		err := fmt.Errorf("Vault: %v", strings.Join(failure.Errors, "; "))
+		v.mu.Lock()
+		if v.renewErr != nil {
+			err = fmt.Errorf("%v (the token could not be renewed: %v)", err, v.renewErr)
+		}
+		v.mu.Unlock()
+		return err
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil {
+		return errVaultResponse
+	}
+	return nil
+}
+
+// startRenewal looks up the token the first time it is called, and if the
+// token expires and is renewable, renews it in the background.
+func (v *VaultTransit) startRenewal() error {
+	v.mu.Lock()
+	renewing := v.renewing
+	v.mu.Unlock()
+	if renewing {
+		return nil
+	}
+	var lookup struct {
+		Data struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := v.request("GET", "auth/token/lookup-self", nil, &lookup); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.renewing {
+		return nil
+	}
+	v.renewing = true
+	if lookup.Data.Renewable && lookup.Data.TTL > 0 {
+		go v.renew(time.Duration(lookup.Data.TTL) * time.Second)
+	}
+	return nil
+}
+
+// renew renews the token whenever half of its TTL, ttl, has passed, until
+// v is closed or the token cannot be renewed any more. Failures are retried
+// sooner, and remembered to explain why requests fail.
+func (v *VaultTransit) renew(ttl time.Duration) {
+	for {
+		wait := ttl / 2
+		select {
+		case <-time.After(wait):
+		case <-v.done:
+			return
+		}
+		var renewal struct {
+			Auth struct {
+				LeaseDuration int64 `json:"lease_duration"`
+				Renewable     bool  `json:"renewable"`
+			} `json:"auth"`
+		}
+		err := v.request("POST", "auth/token/renew-self", struct{}{}, &renewal)
+		v.mu.Lock()
+		v.renewErr = err
+		v.mu.Unlock()
+		switch {
+		case err != nil:
+			// try again in a while, while the token is still valid.
+			ttl = wait
+		case !renewal.Auth.Renewable || renewal.Auth.LeaseDuration <= 0:
+			return
+		default:
+			ttl = time.Duration(renewal.Auth.LeaseDuration) * time.Second
+		}
+		if ttl < 2*time.Second {
+			ttl = 2 * time.Second
+		}
+	}
+}
+
+// generateDataKey returns a new data key from Vault, in plaintext and
+// wrapped by the transit key.
+func (v *VaultTransit) generateDataKey() ([32]byte, string, error) {
+	if err := v.startRenewal(); err != nil {
+		return [32]byte{}, "", err
+	}
+	mount, name, _ := splitVaultKey(v.config.Key)
+	var resp struct {
+		Data struct {
+			Plaintext  string `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := v.request("POST", mount+"/datakey/plaintext/"+name, map[string]int{"bits": 256}, &resp)
+	if err != nil {
+		return [32]byte{}, "", err
+	}
+	key, err := decodeDataKey(resp.Data.Plaintext)
+	if err != nil || resp.Data.Ciphertext == "" || len(resp.Data.Ciphertext) > math.MaxUint16 {
+		return [32]byte{}, "", errVaultResponse
+	}
+	return key, resp.Data.Ciphertext, nil
+}
+
+// unwrap asks Vault for the plaintext of the data key ciphertext.
+func (v *VaultTransit) unwrap(ciphertext string) ([32]byte, error) {
+	if err := v.startRenewal(); err != nil {
+		return [32]byte{}, err
+	}
+	mount, name, _ := splitVaultKey(v.config.Key)
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	err := v.request("POST", mount+"/decrypt/"+name, map[string]string{"ciphertext": ciphertext}, &resp)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	key, err := decodeDataKey(resp.Data.Plaintext)
+	if err != nil {
+		return [32]byte{}, errVaultResponse
+	}
+	return key, nil
+}
+
+// decodeDataKey decodes a 256 bit data key sent by Vault in base64.
+func decodeDataKey(s string) ([32]byte, error) {
+	var key [32]byte
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		return key, errVaultResponse
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// newFileKeys sets the Vault key of header to a data key of v, picks the
+// salt of the file's subkey of it from random, and returns the file keys.
+func (v *VaultTransit) newFileKeys(header *fileHeader, random io.Reader) (sk [32]byte, macKey [32]byte, err error) {
+	key, ciphertext, err := v.cache.forEncryption(v.generateDataKey)
+	if err != nil {
+		return sk, macKey, err
+	}
+	header.Vault = vaultKey{Path: v.config.Key, Ciphertext: ciphertext}
+	err = readRandom(random, header.Subkey[:])
+	if err != nil {
+		return sk, macKey, err
+	}
+	return subkeys(key, header.Subkey)
+}
+
+func (v *VaultTransit) fileKeys(header fileHeader) (sk [32]byte, macKey [32]byte, err error) {
+	if header.Vault.Path == "" {
+		return sk, macKey, errNotVault
+	}
+	if header.Vault.Path != v.config.Key {
+		return sk, macKey, fmt.Errorf("the file is encrypted with a data key of the Vault key %v, not %v", header.Vault.Path, v.config.Key)
+	}
+	key, err := v.cache.forDecryption(header.Vault.Ciphertext, func() ([32]byte, error) {
+		return v.unwrap(header.Vault.Ciphertext)
+	})
+	if err != nil {
+		return sk, macKey, err
+	}
+	return subkeys(key, header.Subkey)
+}
+
+// vaultFromEnv returns a VaultTransit for the transit key at path, in the
+// Vault that VAULT_ADDR, VAULT_NAMESPACE and VAULT_TOKEN name, as for the
+// vault CLI.
+func vaultFromEnv(path string) (*VaultTransit, error) {
+	return NewVaultTransit(VaultConfig{
+		Address:   os.Getenv("VAULT_ADDR"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Key:       path,
+	})
+}
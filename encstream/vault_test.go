@@ -0,0 +1,195 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault stands in for a Vault with the transit key transit/backups, and
+// counts the requests it is sent by path.
+type fakeVault struct {
+	mu       sync.Mutex
+	keys     map[string][]byte // data keys by ciphertext
+	requests map[string]int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.URL.Path]++
+	if r.Header.Get("X-Vault-Token") != "s.token" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errors":["permission denied"]}`)
+		return
+	}
+	var in map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&in)
+	var data interface{}
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		data = map[string]interface{}{"data": map[string]interface{}{"ttl": 1, "renewable": true}}
+	case "/v1/auth/token/renew-self":
+		data = map[string]interface{}{"auth": map[string]interface{}{"lease_duration": 3600, "renewable": true}}
+	case "/v1/transit/datakey/plaintext/backups":
+		key := make([]byte, 32)
+		rand.Read(key)
+		ciphertext := fmt.Sprintf("vault:v1:%v", len(f.keys))
+		f.keys[ciphertext] = key
+		data = map[string]interface{}{"data": map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key), "ciphertext": ciphertext}}
+	case "/v1/transit/decrypt/backups":
+		key, ok := f.keys[in["ciphertext"].(string)]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":["invalid ciphertext"]}`)
+			return
+		}
+		data = map[string]interface{}{"data": map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[]}`)
+		return
+	}
+	json.NewEncoder(w).Encode(data)
+}
+
+// count returns how many requests were sent to path.
+func (f *fakeVault) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+// TestVaultTransit verifies that files encrypted with Vault data keys share a
+// data key until it is too old, that decrypting them unwraps it once, that
+// the token is renewed, and that the wrong key, token or passphrase fail.
+func TestVaultTransit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vault := &fakeVault{keys: make(map[string][]byte), requests: make(map[string]int)}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	config := VaultConfig{Address: server.URL, Token: "s.token", Key: "transit/backups"}
+
+	v, err := NewVaultTransit(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	var names []string
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, fmt.Sprint(i))
+		err = Encrypt(nil, strings.NewReader(fmt.Sprint("file ", i)), name, WithVaultTransit(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if n := vault.count("/v1/transit/datakey/plaintext/backups"); n != 1 {
+		t.Fatal("the files were encrypted with", n, "data keys, wanted 1")
+	}
+	header, err := readHeaderFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Vault != (vaultKey{Path: "transit/backups", Ciphertext: "vault:v1:0"}) || header.Subkey == ([32]byte{}) {
+		t.Fatal("wrong header", header.Vault, header.Subkey)
+	}
+
+	decrypter, err := NewVaultTransit(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decrypter.Close()
+	for i, name := range names {
+		output := name + ".out"
+		if err := Decrypt(nil, name, output, WithVaultTransit(decrypter)); err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ioutil.ReadFile(output)
+		if err != nil || string(plaintext) != fmt.Sprint("file ", i) {
+			t.Fatalf("%v decrypted to %q: %v", name, plaintext, err)
+		}
+	}
+	if n := vault.count("/v1/transit/decrypt/backups"); n != 1 {
+		t.Fatal("the data key was unwrapped", n, "times, wanted 1")
+	}
+
+	if err := Decrypt([]byte("hunter2"), names[0], names[0]+".pass"); err != errNeedVault {
+		t.Fatal("expected errNeedVault, got", err)
+	}
+	other := config
+	other.Key = "transit/other"
+	o, err := NewVaultTransit(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if err := Decrypt(nil, names[0], names[0]+".other", WithVaultTransit(o)); err == nil || !strings.Contains(err.Error(), "transit/backups") {
+		t.Fatal("expected an error naming the file's key, got", err)
+	}
+	badToken := config
+	badToken.Token = "s.wrong"
+	b, err := NewVaultTransit(badToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := Decrypt(nil, names[0], names[0]+".token", WithVaultTransit(b)); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatal("expected permission denied, got", err)
+	}
+
+	// the fake token expires in a second, so it is renewed after half that.
+	deadline := time.Now().Add(5 * time.Second)
+	for vault.count("/v1/auth/token/renew-self") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the token was not renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	short := config
+	short.Cache.MaxAge = time.Nanosecond
+	s, err := NewVaultTransit(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	before := vault.count("/v1/transit/datakey/plaintext/backups")
+	for i := 0; i < 2; i++ {
+		if err := Encrypt(nil, strings.NewReader("short"), filepath.Join(dir, fmt.Sprint("short", i)), WithVaultTransit(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := vault.count("/v1/transit/datakey/plaintext/backups") - before; n != 2 {
+		t.Fatal("expired data keys were used again;", n, "were fetched for 2 files")
+	}
+
+	for _, key := range []string{"", "backups", "transit/", "/backups", "transit/back ups"} {
+		bad := config
+		bad.Key = key
+		if _, err := NewVaultTransit(bad); err != errBadVaultKey {
+			t.Fatalf("%q: expected errBadVaultKey, got %v", key, err)
+		}
+	}
+	if _, err := decodeVaultKey(encodeVaultKey(vaultKey{Path: "transit/backups"})); err != errBadHeader {
+		t.Fatal("a Vault key without ciphertext was accepted")
+	}
+	if !bytes.Contains(encodeVaultKey(header.Vault), []byte("vault:v1:0")) {
+		t.Fatal("the ciphertext was not encoded")
+	}
+}
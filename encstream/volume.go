@@ -0,0 +1,461 @@
+package encstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A ciphertext can be split into a set of volumes named out.enc.001,
+// out.enc.002, and so on. Each volume starts with a small header identifying
+// the set it belongs to and its position within it, followed by the next
+// slice of the ciphertext. The volume headers are not authenticated, but any
+// reordering or substitution of volumes is caught by the MAC over the
+// ciphertext; they exist so that a missing or mismatched volume can be
+// reported as such.
+//
+// Volumes are all the same size but for the last, unless the set is marked
+// as varying, as -no-metadata writes it: then every volume after the first
+// has a random size between half the volume size and all of it, so that the
+// sizes do not give away how the set was split.
+
+// volumeMagic starts every volume.
+var volumeMagic = [4]byte{'e', 'n', 'c', 'v'}
+
+// minVolumeSize ensures that the file header, and with it the MAC that is
+// filled in last, always fits in the first volume.
+const minVolumeSize = 1 << 16
+
+type volumeHeader struct {
+	Magic [4]byte
+	SetID [16]byte
+	Index uint32 // starting at 1
+	Flags uint8
+}
+
+// Volume header flags.
+const (
+	volumeLast    uint8 = 1 << iota // the last volume of the set
+	volumeVarying                   // the volumes of the set vary in size
+)
+
+var (
+	errVolumeSeek     = errors.New("cannot seek to a volume that has already been closed")
+	errVolumeTooSmall = fmt.Errorf("volume size must be at least %v bytes", minVolumeSize)
+)
+
+// volumeName returns the name of the volume with the given index.
+func volumeName(base string, index int) string {
+	return fmt.Sprintf("%s.%03d", base, index)
+}
+
+// volumeBase returns the name of the volume set that name refers to, if any.
+// Both the base name and the name of the first volume are accepted.
+func volumeBase(name string) (string, bool) {
+	if strings.HasSuffix(name, ".001") {
+		return strings.TrimSuffix(name, ".001"), true
+	}
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		if _, err := os.Stat(volumeName(name, 1)); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// volumeWriter writes a stream split into volumes of a fixed or varying size.
+// The volumes are written to temporary files that only replace the final
+// volumes on commit. Only the first and the current volume are kept open, so
+// seeking is limited to those.
+type volumeWriter struct {
+	base        string
+	payloadSize int64
+	varying     bool
+	random      io.Reader // source of the set ID and varying sizes
+	setID       [16]byte
+	pos         int64
+	end         int64
+	starts      []int64 // offset in the stream of each volume's payload
+	sizes       []int64 // size of each volume's payload
+
+	first   *os.File
+	current *os.File
+	index   int
+}
+
+// newVolumeWriter creates a volumeWriter writing volumes of volumeSize bytes
+// named after base, or with varying set, of random sizes up to volumeSize.
+// The set ID and the sizes are read from random.
+func newVolumeWriter(base string, volumeSize int64, varying bool, random io.Reader) (*volumeWriter, error) {
+	if volumeSize < minVolumeSize {
+		return nil, errVolumeTooSmall
+	}
+	v := &volumeWriter{
+		base:        base,
+		payloadSize: volumeSize - int64(binary.Size(volumeHeader{})),
+		varying:     varying,
+		random:      random,
+	}
+	err := readRandom(random, v.setID[:])
+	if err != nil {
+		return nil, err
+	}
+	v.first, err = v.create(1)
+	if err != nil {
+		return nil, err
+	}
+	v.current = v.first
+	v.index = 1
+	return v, nil
+}
+
+// create creates the temporary file for the volume with the given index and
+// writes its header.
+func (v *volumeWriter) create(index int) (*os.File, error) {
+	f, err := os.Create(volumeName(v.base, index) + ".temp")
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(f, binary.LittleEndian, volumeHeader{
+		Magic: volumeMagic,
+		SetID: v.setID,
+		Index: uint32(index),
+		Flags: v.flags(),
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// flags returns the header flags of every volume but the last.
+func (v *volumeWriter) flags() uint8 {
+	if v.varying {
+		return volumeVarying
+	}
+	return 0
+}
+
+// locate returns the index, counting from 0, of the volume holding the byte
+// at pos of the stream, the offset of pos in its payload and how many bytes
+// of the payload follow it, choosing the sizes of new volumes as needed.
+func (v *volumeWriter) locate(pos int64) (index int, off int64, room int64, err error) {
+	for n := len(v.starts); n == 0 || v.starts[n-1]+v.sizes[n-1] <= pos; n = len(v.starts) {
+		size := v.payloadSize
+		// the first volume holds the file header, so it is always full size.
+		if v.varying && n > 0 {
+			var b [8]byte
+			err = readRandom(v.random, b[:])
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			size = v.payloadSize/2 + int64(binary.LittleEndian.Uint64(b[:])%uint64(v.payloadSize-v.payloadSize/2+1))
+		}
+		start := int64(0)
+		if n > 0 {
+			start = v.starts[n-1] + v.sizes[n-1]
+		}
+		v.starts = append(v.starts, start)
+		v.sizes = append(v.sizes, size)
+	}
+	index = sort.Search(len(v.starts), func(i int) bool { return v.starts[i] > pos }) - 1
+	off = pos - v.starts[index]
+	return index, off, v.sizes[index] - off, nil
+}
+
+// volume returns the open volume with the given index, starting the next
+// volume if needed.
+func (v *volumeWriter) volume(index int) (*os.File, error) {
+	switch {
+	case index == 1:
+		return v.first, nil
+	case index == v.index:
+		return v.current, nil
+	case index != v.index+1 || v.pos != v.end:
+		return nil, errVolumeSeek
+	}
+	if v.current != v.first {
+		err := v.current.Sync()
+		if err != nil {
+			return nil, err
+		}
+		err = v.current.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := v.create(index)
+	if err != nil {
+		return nil, err
+	}
+	v.current = f
+	v.index = index
+	return f, nil
+}
+
+// Write implements io.Writer.
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	written := 0
+	headerSize := int64(binary.Size(volumeHeader{}))
+	for len(p) > 0 {
+		index, off, room, err := v.locate(v.pos)
+		if err != nil {
+			return written, err
+		}
+		f, err := v.volume(index + 1)
+		if err != nil {
+			return written, err
+		}
+		n := int64(len(p))
+		if n > room {
+			n = room
+		}
+		_, err = f.WriteAt(p[:n], headerSize+off)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += int(n)
+		v.pos += n
+		if v.pos > v.end {
+			v.end = v.pos
+		}
+	}
+	return written, nil
+}
+
+// Seek implements io.Seeker.
+func (v *volumeWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += v.pos
+	case io.SeekEnd:
+		offset += v.end
+	}
+	if offset < 0 || offset > v.end {
+		return v.pos, errVolumeSeek
+	}
+	v.pos = offset
+	return offset, nil
+}
+
+// commit marks the current volume as the last one of the set and moves every
+// volume into place, removing any leftover volumes of an earlier set with the
+// same name.
+func (v *volumeWriter) commit() error {
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.LittleEndian, volumeHeader{
+		Magic: volumeMagic,
+		SetID: v.setID,
+		Index: uint32(v.index),
+		Flags: v.flags() | volumeLast,
+	})
+	_, err := v.current.WriteAt(header.Bytes(), 0)
+	if err != nil {
+		return err
+	}
+	for _, f := range []*os.File{v.first, v.current} {
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	v.close()
+	for i := 1; i <= v.index; i++ {
+		err = os.Rename(volumeName(v.base, i)+".temp", volumeName(v.base, i))
+		if err != nil {
+			return err
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(v.base))
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(v.base) + "."
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(e.Name(), prefix))
+		if err != nil || index <= v.index {
+			continue
+		}
+		err = os.Remove(volumeName(v.base, index))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort removes the temporary volumes. It has no effect after commit.
+func (v *volumeWriter) abort() {
+	v.close()
+	for i := 1; i <= v.index; i++ {
+		os.Remove(volumeName(v.base, i) + ".temp")
+	}
+}
+
+func (v *volumeWriter) close() {
+	v.first.Close()
+	v.current.Close()
+}
+
+// volumeReader reads the stream stored in a set of volumes.
+type volumeReader struct {
+	files       []*os.File
+	starts      []int64 // offset in the stream of each volume's payload
+	payloadSize int64
+	size        int64
+	pos         int64
+}
+
+// openVolumes opens the set of volumes named after base, checking that it is
+// complete and that every volume belongs to it.
+func openVolumes(base string) (*volumeReader, error) {
+	v := new(volumeReader)
+	headerSize := int64(binary.Size(volumeHeader{}))
+	var setID [16]byte
+	var varying bool
+	for index := 1; ; index++ {
+		f, err := os.Open(volumeName(base, index))
+		if os.IsNotExist(err) {
+			v.Close()
+			return nil, fmt.Errorf("volume %v is missing", volumeName(base, index))
+		}
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.files = append(v.files, f)
+		var h volumeHeader
+		err = binary.Read(f, binary.LittleEndian, &h)
+		if err != nil || h.Magic != volumeMagic {
+			v.Close()
+			return nil, fmt.Errorf("%v is not a volume", f.Name())
+		}
+		if index == 1 {
+			setID = h.SetID
+			varying = h.Flags&volumeVarying != 0
+		}
+		if h.SetID != setID {
+			v.Close()
+			return nil, fmt.Errorf("%v belongs to a different volume set", f.Name())
+		}
+		if h.Index != uint32(index) {
+			v.Close()
+			return nil, fmt.Errorf("%v claims to be volume %v", f.Name(), h.Index)
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		payload := stat.Size() - headerSize
+		if index == 1 {
+			v.payloadSize = payload
+		}
+		last := h.Flags&volumeLast != 0
+		// varying volumes are only checked to be at least half the size of
+		// the first; the MAC catches any other truncation.
+		wrongSize := payload > v.payloadSize || (!last && payload != v.payloadSize)
+		if varying {
+			wrongSize = payload > v.payloadSize || (!last && payload < v.payloadSize/2)
+		}
+		if wrongSize {
+			v.Close()
+			return nil, fmt.Errorf("%v has the wrong size, it may be truncated", f.Name())
+		}
+		v.starts = append(v.starts, v.size)
+		v.size += payload
+		if last {
+			return v, nil
+		}
+	}
+}
+
+// Read implements io.Reader.
+func (v *volumeReader) Read(p []byte) (int, error) {
+	if v.pos >= v.size {
+		return 0, io.EOF
+	}
+	index := sort.Search(len(v.starts), func(i int) bool { return v.starts[i] > v.pos }) - 1
+	off := v.pos - v.starts[index]
+	end := v.size
+	if index+1 < len(v.starts) {
+		end = v.starts[index+1]
+	}
+	if int64(len(p)) > end-v.pos {
+		p = p[:end-v.pos]
+	}
+	n, err := v.files[index].ReadAt(p, int64(binary.Size(volumeHeader{}))+off)
+	v.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (v *volumeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += v.pos
+	case io.SeekEnd:
+		offset += v.size
+	}
+	if offset < 0 {
+		return v.pos, errors.New("negative seek")
+	}
+	v.pos = offset
+	return offset, nil
+}
+
+// Close closes every volume.
+func (v *volumeReader) Close() error {
+	for _, f := range v.files {
+		f.Close()
+	}
+	return nil
+}
+
+// openEncrypted opens the named encrypted file, which may also name a set of
+// volumes. Armored files are decoded, and recovery records at the end of the
+// file are skipped.
+func openEncrypted(name string) (io.ReadSeekCloser, error) {
+	base, ok := volumeBase(name)
+	if !ok {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		armored, err := isArmored(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if armored {
+			defer f.Close()
+			d, err := dearmor(f)
+			if err != nil {
+				return nil, err
+			}
+			return d, nil
+		}
+		return withoutRecovery(f)
+	}
+	v, err := openVolumes(base)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
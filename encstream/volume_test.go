@@ -0,0 +1,152 @@
+package encstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestVolumes verifies that a stream written as a set of volumes, including a
+// seek back into the first volume, reads back identically, and that missing
+// or foreign volumes are detected.
+func TestVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "out.enc")
+
+	data := make([]byte, minVolumeSize*5/2)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	write := func(data []byte) {
+		v, err := newVolumeWriter(base, minVolumeSize, false, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.abort()
+		if _, err := v.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := v.Seek(10, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := v.Write([]byte("patched")); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(data)
+	copy(data[10:], "patched")
+	if _, err := os.Stat(volumeName(base, 3)); err != nil {
+		t.Fatal("expected 3 volumes:", err)
+	}
+
+	for _, name := range []string{base, volumeName(base, 1)} {
+		r, err := openEncrypted(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Fatal("volume set did not read back identically")
+		}
+	}
+
+	// swap in the last volume of a different set.
+	last, err := ioutil.ReadFile(volumeName(base, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(data)
+	if err := ioutil.WriteFile(volumeName(base, 3), last, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openVolumes(base); err == nil {
+		t.Fatal("a volume from a different set was accepted")
+	}
+
+	if err := os.Remove(volumeName(base, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openVolumes(base); err == nil {
+		t.Fatal("a missing volume was not detected")
+	}
+
+	// rewriting a smaller set removes the leftover volumes.
+	write(data[:100])
+	if _, err := os.Stat(volumeName(base, 3)); !os.IsNotExist(err) {
+		t.Fatal("leftover volume was not removed")
+	}
+}
+
+// TestVaryingVolumes verifies that a set of volumes of random sizes reads
+// back identically, with every volume after the first between half the
+// volume size and all of it.
+func TestVaryingVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "out.enc")
+
+	data := make([]byte, minVolumeSize*8)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	v, err := newVolumeWriter(base, minVolumeSize, true, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.abort()
+	if _, err := v.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := map[int64]bool{}
+	for index := 1; ; index++ {
+		fi, err := os.Stat(volumeName(base, index))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > minVolumeSize || (index == 1 && fi.Size() != minVolumeSize) {
+			t.Fatalf("volume %v is %v bytes", index, fi.Size())
+		}
+		sizes[fi.Size()] = true
+	}
+	if len(sizes) < 3 {
+		t.Fatal("the volumes do not vary in size")
+	}
+
+	r, err := openVolumes(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("volume set did not read back identically")
+	}
+}
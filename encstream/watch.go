@@ -0,0 +1,304 @@
+package encstream
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch mode keeps a drop directory encrypted. Every regular file in the
+// directory, and every file later created or modified in it, is encrypted to
+// the same relative path under a destination directory with .enc appended. A
+// file is only encrypted once writes to it have settled for the debounce
+// interval, and failed encryptions are retried with an increasing delay.
+// Removing a file does not remove its encrypted copy. Files and directories
+// that .encignore files leave out are not encrypted, and changing a
+// .encignore file rescans its directory.
+//
+// The files encrypted so far are recorded in a state file, in the same form as
+// an archive manifest, so that restarting the watch does not re-encrypt
+// unchanged files. The state file is kept in the watched directory rather than
+// next to the ciphertext, since it reveals the names and digests of the
+// plaintexts.
+
+const (
+	watchStateName = ".enc-watch"
+	watchRetries   = 5
+)
+
+var errWatchDest = errors.New("the destination must not be within the watched directory")
+
+// watcher encrypts the files in dir to dest as they change.
+type watcher struct {
+	dir      string
+	dest     string
+	debounce time.Duration
+	encrypt  func(input *os.File, output string) error
+
+	ignores  *ignoreTree
+	state    map[string]manifestEntry
+	pending  map[string]time.Time
+	attempts map[string]int
+}
+
+// newWatcher creates a watcher for dir, loading its state file if there is
+// one. encrypt is called to encrypt each changed file.
+func newWatcher(dir string, dest string, debounce time.Duration, encrypt func(input *os.File, output string) error) (*watcher, error) {
+	within, err := contains(dir, dest)
+	if err != nil {
+		return nil, err
+	}
+	if within {
+		return nil, errWatchDest
+	}
+	w := &watcher{
+		dir:      dir,
+		dest:     dest,
+		debounce: debounce,
+		encrypt:  encrypt,
+		ignores:  newIgnoreTree(dir),
+		state:    make(map[string]manifestEntry),
+		pending:  make(map[string]time.Time),
+		attempts: make(map[string]int),
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, watchStateName))
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+	w.state = m.entries()
+	return w, nil
+}
+
+// saveState writes the state file.
+func (w *watcher) saveState() error {
+	var m manifest
+	for _, e := range w.state {
+		m.Entries = append(m.Entries, e)
+	}
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	output, err := createAtomic(filepath.Join(w.dir, watchStateName))
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	_, err = output.Write(b)
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
+
+// ignored reports whether path is one of the watcher's own files.
+func (w *watcher) ignored(path string) bool {
+	state := filepath.Join(w.dir, watchStateName)
+	return path == state || path == state+".temp"
+}
+
+// excluded reports whether .encignore files leave out path, which is a
+// directory if dir is set.
+func (w *watcher) excluded(path string, dir bool) (bool, error) {
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil || rel == "." {
+		return false, err
+	}
+	return w.ignores.ignoredPath(filepath.ToSlash(rel), dir)
+}
+
+// schedule schedules path to be synced after the debounce interval, pushing
+// back any sync that was already scheduled.
+func (w *watcher) schedule(path string) {
+	if w.ignored(path) {
+		return
+	}
+	excluded, err := w.excluded(path, false)
+	if err != nil {
+		log.Println("could not check", path+":", err)
+		return
+	}
+	if excluded {
+		return
+	}
+	w.pending[path] = time.Now().Add(w.debounce)
+}
+
+// sync encrypts the file at path, unless it was removed or has not changed
+// since it was last encrypted.
+func (w *watcher) sync(path string) error {
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	if e, ok := w.state[rel]; ok {
+		unchanged, err := e.matches(path, info)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			return nil
+		}
+	}
+
+	_, digest, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	output := filepath.Join(w.dest, filepath.FromSlash(rel)) + ".enc"
+	err = os.MkdirAll(filepath.Dir(output), 0700)
+	if err != nil {
+		return err
+	}
+	err = w.encrypt(f, output)
+	if err != nil {
+		return err
+	}
+	log.Println("encrypted", rel)
+
+	// a write that raced the encryption changes the modification time, so
+	// the file will not be mistaken for unchanged; its event syncs it again.
+	w.state[rel] = manifestEntry{
+		Path:    rel,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		BLAKE2b: digest,
+	}
+	return w.saveState()
+}
+
+// syncPending syncs every file whose debounce interval has passed by now,
+// rescheduling failed syncs with an increasing delay until they have been
+// retried watchRetries times.
+func (w *watcher) syncPending(now time.Time) {
+	for path, due := range w.pending {
+		if due.After(now) {
+			continue
+		}
+		err := w.sync(path)
+		if err == nil {
+			delete(w.pending, path)
+			delete(w.attempts, path)
+			continue
+		}
+		w.attempts[path]++
+		if w.attempts[path] > watchRetries {
+			log.Println("giving up on", path+":", err)
+			delete(w.pending, path)
+			delete(w.attempts, path)
+			continue
+		}
+		log.Println("could not encrypt", path+", retrying:", err)
+		w.pending[path] = now.Add(w.debounce << uint(w.attempts[path]))
+	}
+}
+
+// add watches the directory tree rooted at path and schedules every file in
+// it, but for those .encignore files leave out.
+func (w *watcher) add(fsw *fsnotify.Watcher, path string) error {
+	return filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			excluded, err := w.excluded(name, true)
+			if err != nil {
+				return err
+			}
+			if excluded {
+				return filepath.SkipDir
+			}
+			return fsw.Add(name)
+		}
+		w.schedule(name)
+		return nil
+	})
+}
+
+// reloadIgnores re-reads the .encignore file of dir after it changed, and
+// rescans dir for files it no longer leaves out.
+func (w *watcher) reloadIgnores(fsw *fsnotify.Watcher, dir string) {
+	rel, err := filepath.Rel(w.dir, dir)
+	if err != nil {
+		return
+	}
+	if rel == "." {
+		rel = ""
+	}
+	w.ignores.forget(filepath.ToSlash(rel))
+	err = w.add(fsw, dir)
+	if err != nil {
+		log.Println("could not rescan", dir+":", err)
+	}
+}
+
+// run watches the directory until an error occurs.
+func (w *watcher) run() error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	err = w.add(fsw, w.dir)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(w.debounce / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-fsw.Events:
+			if filepath.Base(event.Name) == ignoreFileName {
+				w.reloadIgnores(fsw, filepath.Dir(event.Name))
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			info, err := os.Lstat(event.Name)
+			if err == nil && info.IsDir() {
+				err = w.add(fsw, event.Name)
+				if err != nil {
+					log.Println("could not watch", event.Name+":", err)
+				}
+				continue
+			}
+			w.schedule(event.Name)
+		case err := <-fsw.Errors:
+			return err
+		case now := <-ticker.C:
+			w.syncPending(now)
+		}
+	}
+}
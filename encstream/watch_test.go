@@ -0,0 +1,87 @@
+package encstream
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWatcher verifies that the watcher only encrypts new and changed files,
+// remembers them across restarts, and retries failed encryptions.
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enctest-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", "a")
+	write("sub/b", "b")
+
+	if _, err := newWatcher(src, filepath.Join(src, "out"), time.Second, nil); err != errWatchDest {
+		t.Fatal("expected", errWatchDest, "got", err)
+	}
+
+	var encrypted []string
+	var failure error
+	encrypt := func(input *os.File, output string) error {
+		if failure != nil {
+			return failure
+		}
+		encrypted = append(encrypted, output)
+		return ioutil.WriteFile(output, nil, 0600)
+	}
+	w, err := newWatcher(src, dest, time.Second, encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := func(names ...string) {
+		encrypted = nil
+		for _, name := range names {
+			w.schedule(filepath.Join(src, name))
+		}
+		w.syncPending(time.Now().Add(time.Hour))
+	}
+	sync("a", "sub/b", watchStateName)
+	if len(encrypted) != 2 {
+		t.Fatal("encrypted", encrypted, "wanted a and sub/b")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "sub", "b.enc")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted watcher only encrypts the modified file.
+	w, err = newWatcher(src, dest, time.Second, encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("a", "modified")
+	sync("a", "sub/b")
+	if len(encrypted) != 1 || encrypted[0] != filepath.Join(dest, "a.enc") {
+		t.Fatal("encrypted", encrypted, "wanted only a")
+	}
+
+	write("c", "c")
+	failure = errors.New("disk full")
+	sync("c")
+	if w.attempts[filepath.Join(src, "c")] != 1 {
+		t.Fatal("failed encryption was not scheduled for a retry")
+	}
+	failure = nil
+	w.syncPending(time.Now().Add(2 * time.Hour))
+	if len(encrypted) != 1 || len(w.pending) != 0 {
+		t.Fatal("failed encryption was not retried")
+	}
+}
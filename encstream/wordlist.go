@@ -0,0 +1,120 @@
+package encstream
+
+import "strings"
+
+// passphraseWords are the words genpass draws diceware-style passphrases
+// from: short, common and easy to type, and all distinct.
+var passphraseWords = strings.Fields(`
+	able acid acorn acre act actor adapt add adobe adult aft agent agile aid
+	aim air aisle alarm album alert algae alibi alley allow alloy almond
+	aloe alpha alpine amber amble amend ample amuse angel anger angle ankle
+	anvil apple apron aqua arbor arch arena argue arm armor army aroma array
+	arrow art ash aside ask aspen atlas atom attic audio audit aunt autumn
+	avid awake award axis axle bacon badge bagel bake baker balm bamboo
+	banjo bank barge bark barn baron basil basin batch bath baton bay beach
+	beacon bead beak beam bean bear beard beast bed beech beef beet begin
+	bell belt bench berry bike birch bird bison black blade blank blaze
+	blend bless blimp blink bliss block bloom blue blues blunt blur board
+	boat body bolt bonus book boost boot booth bore boss botany bow bowl box
+	brain brake bran brass brave bread break brick bride brief brim brine
+	bring brink brisk broad broil brook broom brush bucket buddy budget
+	buggy build bulb bulk bunch bunny burst bus bush butter button buyer
+	buzz cabin cable cactus cage cake calf call calm camel camp canal candy
+	cane canoe canvas canyon cape card cargo carol carpet carrot cart carve
+	case cash cast castle cat catch cave cedar cell cello chair chalk champ
+	chant chaos charm chart chase cheek cheer cheese chef cherry chess chest
+	chew chick chief chili chime chin chip chord chore chunk cider cigar
+	cinema circle citrus city civic claim clamp clap clash clasp class claw
+	clay clean clerk click cliff climb cling clip cloak clock close cloth
+	cloud clove clown club clue coach coast coat cobra cocoa code coil coin
+	comet comic coral cord core cork corn couch cough count court cover
+	cowboy coyote crab craft crane crate crawl crayon crazy cream creek
+	crest crew crisp crop cross crow crowd crown crumb crust cube cup curb
+	curl curry curve cushion cycle daisy dance dart dash data dawn deal
+	debut decal decoy deed deer delta denim dent depot depth desk detail
+	dial diary dice diet digit dime diner dingo dish dive dock dog dolphin
+	dome donor donut door dose dot dough dove draft dragon drain drama drape
+	draw dream dress drift drill drink drip drive drone drum duck duet dune
+	dusk dust duty dwarf dye eager eagle early earth easel east echo edge
+	eel effort egg eight elbow elder elk elm ember emu enamel energy engine
+	enjoy entry envoy epic equal era erase errand essay ether even event
+	evict exact exam exile exit expert extra eye fable face fact fade fair
+	fairy faith fall fame fancy fang farm fawn feast feather fence fern
+	ferry fetch fever fiber field fiesta fig film final finch fine finger
+	fire firm fish five fjord flag flame flash flask flat flax fleet flick
+	flint flip float flock flood floor flour flow flower fluid flute foam
+	focus fog foil folk font food foot force forest forge fork form fort
+	forum fossil fox frame fresh friend frog front frost fruit fudge fuel
+	fund fungi fur gable gadget galaxy gale game gap garage garden garlic
+	gate gauge gear gecko gem genre ghost giant gift ginger girder glad
+	glade glass glaze gleam glide globe glove glow glue goat gold golf goose
+	gorge gospel gourd grace grade grain grand grape graph grass gravel
+	gravy great green grid grill grin grip grit groove group grove growl
+	guard guava guess guest guide guitar gulf gull gum guru gust habit hail
+	hair hall halo hammer hand happy harbor hare harp harvest hatch haven
+	hawk hazel head heap heart hearth heat hedge heel helm hen herb herd
+	hero heron hill hinge hint hippo hive hobby hockey holly home honey hood
+	hook hoop hope horn horse host hotel hound hour house human humor hunt
+	hurry husky hut hymn ice icon idea igloo image inch index ink inlet
+	input iris iron island item ivory ivy jacket jade jaguar jam jar jasmine
+	jazz jeans jelly jet jewel jigsaw job jog joint joke jolly journal joy
+	judge juice jumbo jump jungle junior jury kayak keel keen kettle key
+	kick kid kidney king kiosk kit kite kitten kiwi knee knife knight knob
+	knot koala label lace ladder lady lake lamb lamp lance land lane lantern
+	lap large laser latch lava lawn layer lead leaf lean ledge legend lemon
+	lens lentil level lever lid life lift light lilac lily limb lime limit
+	line linen lion lip liquid list liver lizard llama load loaf lobby local
+	lock lodge loft logic long loom loop lotus loud lounge love loyal lucky
+	lumber lunar lunch lung lute lyric macro magic magnet maid mail major
+	mango manor maple marble march mare marsh mask mason mast match meadow
+	meal medal melon melt memo menu merit mesa metal meter midst might mile
+	milk mill mimic mind mine minor mint mirror mist mixer moat model modem
+	mold mole moment monk month moon moose moral morse moss motel moth motor
+	mound mount mouse mouth movie mule mural muse museum music must myth
+	nail name nap navy near neck nectar needle neon nerve nest net never
+	nickel night ninja noble node noise noodle north nose notch note novel
+	nudge number nurse nut nylon oak oasis oat ocean octave odor offer
+	office olive omega onion opal open opera orbit orchid order organ otter
+	ounce outer oval oven owl owner oxide oyster pace pack paddle page paint
+	pair palace palm panda panel panic paper parade parcel park parrot party
+	pasta paste patch path patio pause paw peach peak pear pearl pecan pedal
+	pelican pen pencil penny pepper perch petal piano pickle picnic pier pig
+	pigeon pilot pine pink pint pipe pitch pixel pizza place plain plan
+	plane planet plank plant plate plaza plum plume plush pocket poem poet
+	point polar pole polka pond pony pool poppy porch port pose pouch pound
+	powder prairie press price pride prism prize probe prose proud prune
+	pulse pump punch pupil puppy purple puzzle pylon quail quake quart queen
+	quest quick quiet quill quilt quirk quiz quota rabbit race rack radar
+	radio raft rail rain rake ramp ranch range rapid raven ray razor reach
+	realm reef reel relay relic rhyme ribbon rice ridge rifle ring rinse
+	ripple river road roast robin robot rock rocket rodeo roof room root
+	rope rose rotor round route rover royal ruby rudder rug ruler rumor rune
+	rural rust saddle safari sage sail salad salmon salon salt sand satin
+	sauce sauna scale scarf scene scent school scoop scout scrap screw
+	scroll sea seal season seat seed shade shadow shake shape share shark
+	shed sheep shelf shell shield shift shine ship shirt shoe shore shovel
+	shrub siege sign silk silver siren sister sketch ski skill skirt skull
+	sky slate sled sleet slice slide slope sloth slug smile smoke snack
+	snail snake snow soap soccer sock sofa soil solar solid sonar song sonic
+	soup south space spade spark spear spice spider spine spiral spoon sport
+	spot spray spring spruce squad squid stable stack staff stage stair
+	stamp stand star state steam steel stem step stew stick stone stool
+	storm story stove straw stream street string stripe studio sugar suit
+	summer summit sun sunset super surf swamp swan sweater swift swing sword
+	syrup table tablet taco tail talent tango tank tape target taxi tea
+	teacher team teapot tempo tent term test text theme thorn thread throne
+	thumb thunder ticket tide tiger tile timber timer tin tiny title toast
+	today token tomato tone tongs tool tooth topic torch total tower town
+	toy track trade trail train tram trap tray treat tree trend tribe trick
+	trio trophy truck trumpet trunk trust tuba tulip tuna tundra tunnel
+	turkey turtle tutor twig twin ultra umbrella uncle union unit upper
+	urban usage usher utmost vacuum valley valve van vapor vase vault vector
+	velvet vendor venue verb verse vessel vest veto video view villa vine
+	vinyl violet violin visit visor vista vital vivid vocal voice volt vote
+	voyage wafer wagon waist walk wall walnut walrus wand wave wax weasel
+	weaver web wedge weed week well west whale wheat wheel whip whisk white
+	widget width willow wind window wing winter wire wisdom wizard wolf wood
+	wool word world worm wrist yacht yak yard yarn year yeast yellow yodel
+	yogurt yolk young youth yoyo zebra zero zest zigzag zinc zipper zone
+	zoom
+`)
@@ -0,0 +1,35 @@
+package encstream
+
+import "golang.org/x/sys/unix"
+
+// getXattr returns the value of the extended attribute name of the file at
+// p, or nil if it has none or the filesystem does not support them.
+func getXattr(p string, name string) ([]byte, error) {
+	for {
+		n, err := unix.Lgetxattr(p, name, nil)
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		n, err = unix.Lgetxattr(p, name, value)
+		// the attribute may have grown in between.
+		if err == unix.ERANGE {
+			continue
+		}
+		if err == unix.ENODATA {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
+
+// setXattr sets the extended attribute name of the file at p to value.
+func setXattr(p string, name string, value []byte) error {
+	return unix.Lsetxattr(p, name, value, 0)
+}
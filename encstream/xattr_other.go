@@ -0,0 +1,17 @@
+//go:build !linux
+
+package encstream
+
+import "errors"
+
+// getXattr reports no extended attributes on this platform, so archives
+// written on it record no ACLs or capabilities.
+func getXattr(p string, name string) ([]byte, error) {
+	return nil, nil
+}
+
+// setXattr fails on this platform, which cannot restore ACLs or
+// capabilities.
+func setXattr(p string, name string, value []byte) error {
+	return errors.New("extended attributes are only supported on Linux")
+}
@@ -0,0 +1,188 @@
+// Package mobile binds the file and stream APIs of encstream for Android and
+// iOS with gomobile, which only passes strings, numbers, byte slices,
+// pointers to structs and interfaces between Go and Java or Swift:
+//
+//	gomobile bind -target=android -o enc.aar github.com/avahowell/enc/mobile
+//	gomobile bind -target=ios -o Enc.xcframework github.com/avahowell/enc/mobile
+//
+// Files written here are the files the enc command writes, so a file
+// encrypted on a phone decrypts with enc decrypt and the same passphrase,
+// and the other way around.
+//
+// An app that does not ask the user for a passphrase can keep a random key
+// wrapped by the Android Keystore or the iOS Keychain instead: it implements
+// KeyWrapper with the platform's key, stores what NewWrappedKey returns, and
+// passes it to EncryptWrapped and DecryptWrapped. The key never leaves the
+// keystore unwrapped except while a file is encrypted or decrypted, and
+// ExportWrappedKey gives the passphrase that enc decrypt takes for it.
+package mobile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/avahowell/enc/encstream"
+)
+
+// keySize is the size of wrapped keys and of stream keys.
+const keySize = 32
+
+var errKeySize = errors.New("keys must be 32 bytes")
+
+// KeyWrapper wraps and unwraps keys with a key that is kept by the platform,
+// such as an Android Keystore or iOS Keychain key, and implemented by the
+// app in Java, Kotlin or Swift.
+type KeyWrapper interface {
+	Wrap(key []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// SetMaxMemory bounds the memory enc uses to n bytes, at least 64 MiB, which
+// also lowers the KDF memory of new files to fit. Phones cannot spare the
+// 4GB enc derives keys with by default, so apps should call it first.
+func SetMaxMemory(n int64) error {
+	return encstream.SetMaxMemory(n)
+}
+
+// EncryptFile encrypts the file input to the file output with passphrase.
+func EncryptFile(passphrase []byte, input, output string) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return encstream.Encrypt(passphrase, f, output)
+}
+
+// DecryptFile decrypts the file input with passphrase to the file output, or
+// extracts it into the directory output if it is an archive.
+func DecryptFile(passphrase []byte, input, output string) error {
+	return encstream.Decrypt(passphrase, input, output)
+}
+
+// NewWrappedKey returns a new random key wrapped by w, for the app to store.
+func NewWrappedKey(w KeyWrapper) ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	return w.Wrap(key)
+}
+
+// ExportWrappedKey returns the passphrase that the key wrapped by w stands
+// for, so that its files can be decrypted with enc decrypt elsewhere.
+func ExportWrappedKey(w KeyWrapper, wrapped []byte) (string, error) {
+	passphrase, err := unwrapPassphrase(w, wrapped)
+	return string(passphrase), err
+}
+
+// EncryptWrapped is EncryptFile with the key wrapped by w.
+func EncryptWrapped(w KeyWrapper, wrapped []byte, input, output string) error {
+	passphrase, err := unwrapPassphrase(w, wrapped)
+	if err != nil {
+		return err
+	}
+	return EncryptFile(passphrase, input, output)
+}
+
+// DecryptWrapped is DecryptFile with the key wrapped by w.
+func DecryptWrapped(w KeyWrapper, wrapped []byte, input, output string) error {
+	passphrase, err := unwrapPassphrase(w, wrapped)
+	if err != nil {
+		return err
+	}
+	return DecryptFile(passphrase, input, output)
+}
+
+// unwrapPassphrase unwraps a key made by NewWrappedKey with w, returning it
+// hex encoded, as it is typed in as a passphrase.
+func unwrapPassphrase(w KeyWrapper, wrapped []byte) ([]byte, error) {
+	key, err := w.Unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, errKeySize
+	}
+	passphrase := make([]byte, hex.EncodedLen(len(key)))
+	hex.Encode(passphrase, key)
+	return passphrase, nil
+}
+
+// Writer encrypts a stream of chunks to a file with a 32 byte key, as
+// encstream.NewWriter does.
+type Writer struct {
+	f *os.File
+	w *encstream.EncWriter
+}
+
+// NewWriter creates the file name and returns a Writer encrypting to it
+// with key.
+func NewWriter(key []byte, name string) (*Writer, error) {
+	if len(key) != keySize {
+		return nil, errKeySize
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	var k [keySize]byte
+	copy(k[:], key)
+	return &Writer{f: f, w: encstream.NewWriter(k, f)}, nil
+}
+
+// Write encrypts p.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Close seals the last chunk and closes the file.
+func (w *Writer) Close() error {
+	err := w.w.Close()
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// Reader decrypts a stream written by a Writer from a file.
+type Reader struct {
+	f *os.File
+	r *encstream.DecReader
+}
+
+// NewReader opens the file name and returns a Reader decrypting it with key.
+func NewReader(key []byte, name string) (*Reader, error) {
+	if len(key) != keySize {
+		return nil, errKeySize
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var k [keySize]byte
+	copy(k[:], key)
+	return &Reader{f: f, r: encstream.NewReader(k, f)}, nil
+}
+
+// Read returns up to n bytes of plaintext, and nothing once the stream has
+// ended. Byte slices are copied between Go and Java or Swift, so the
+// plaintext is returned rather than read into a buffer of the caller.
+func (r *Reader) Read(n int) ([]byte, error) {
+	p := make([]byte, n)
+	read, err := io.ReadFull(r.r, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return p[:read], err
+}
+
+// Close closes the file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
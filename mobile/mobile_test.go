@@ -0,0 +1,158 @@
+package mobile
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+// xorWrapper stands in for a platform keystore.
+type xorWrapper byte
+
+func (x xorWrapper) Wrap(key []byte) ([]byte, error) {
+	wrapped := append([]byte{}, key...)
+	for i := range wrapped {
+		wrapped[i] ^= byte(x)
+	}
+	return wrapped, nil
+}
+
+func (x xorWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	return x.Wrap(wrapped)
+}
+
+// TestBindable verifies that the exported functions and methods only take
+// and return types that gomobile bind can pass to Java and Swift.
+func TestBindable(t *testing.T) {
+	bindable := map[string]bool{
+		"string": true, "bool": true, "int": true, "int64": true, "[]byte": true, "error": true,
+		"*Writer": true, "*Reader": true, "KeyWrapper": true,
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "mobile.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || !fn.Name.IsExported() {
+			continue
+		}
+		fields := fn.Type.Params.List
+		if fn.Type.Results != nil {
+			if len(fn.Type.Results.List) > 2 {
+				t.Fatalf("%v returns more than two results", fn.Name)
+			}
+			fields = append(fields, fn.Type.Results.List...)
+		}
+		for _, field := range fields {
+			typ := new(bytes.Buffer)
+			printer.Fprint(typ, fset, field.Type)
+			if !bindable[typ.String()] {
+				t.Fatalf("%v takes or returns %v, which gomobile cannot bind", fn.Name, typ)
+			}
+		}
+	}
+}
+
+// TestMobile verifies that files and streams round trip through the bound
+// API, with a passphrase and with a wrapped key, and that the passphrase a
+// wrapped key is exported as decrypts its files.
+func TestMobile(t *testing.T) {
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+	if err := SetMaxMemory(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "enctest-mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plaintext := bytes.Repeat([]byte("mobile "), 10000)
+	input := filepath.Join(dir, "input")
+	if err := ioutil.WriteFile(input, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string) {
+		b, err := ioutil.ReadFile(name)
+		if err != nil || !bytes.Equal(b, plaintext) {
+			t.Fatal("decryption resulted in a different plaintext", err)
+		}
+	}
+
+	encrypted, decrypted := filepath.Join(dir, "encrypted"), filepath.Join(dir, "decrypted")
+	if err := EncryptFile([]byte("hunter2"), input, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptFile([]byte("hunter2"), encrypted, decrypted); err != nil {
+		t.Fatal(err)
+	}
+	check(decrypted)
+
+	w := xorWrapper(0x5c)
+	wrapped, err := NewWrappedKey(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptWrapped(w, wrapped, input, encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptWrapped(w, wrapped, encrypted, decrypted); err != nil {
+		t.Fatal(err)
+	}
+	check(decrypted)
+	passphrase, err := ExportWrappedKey(w, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptFile([]byte(passphrase), encrypted, decrypted); err != nil {
+		t.Fatal(err)
+	}
+	check(decrypted)
+	if err := DecryptWrapped(w, wrapped[1:], encrypted, decrypted); err != errKeySize {
+		t.Fatal("expected errKeySize, got", err)
+	}
+
+	key := make([]byte, keySize)
+	key[0] = 1
+	stream := filepath.Join(dir, "stream")
+	sw, err := NewWriter(key, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := NewReader(key, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	var read []byte
+	for {
+		p, err := sr.Read(1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) == 0 {
+			break
+		}
+		read = append(read, p...)
+	}
+	if !bytes.Equal(read, plaintext) {
+		t.Fatal("the stream decrypted to a different plaintext")
+	}
+	if _, err := NewWriter(key[1:], stream); err != errKeySize {
+		t.Fatal("expected errKeySize, got", err)
+	}
+}